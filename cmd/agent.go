@@ -0,0 +1,224 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/chunk"
+	"github.com/juicedata/juicefs/pkg/jobs"
+	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/juicedata/juicefs/pkg/qos"
+	"github.com/juicedata/juicefs/pkg/vfs"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/urfave/cli/v2"
+)
+
+func agentFlags() *cli.Command {
+	flags := []cli.Flag{
+		&cli.StringFlag{
+			Name:  "metrics",
+			Value: ":9568",
+			Usage: "address to export metrics and the state of jobs (/jobs)",
+		},
+		&cli.DurationFlag{
+			Name:  "compact-interval",
+			Value: time.Hour,
+			Usage: "interval to compact the chunks of all files, 0 means never",
+		},
+		&cli.IntFlag{
+			Name:  "min-slices",
+			Value: 5,
+			Usage: "compact the chunks with at least this number of slices",
+		},
+		&cli.DurationFlag{
+			Name:  "defrag-interval",
+			Value: 24 * time.Hour,
+			Usage: "interval to defragment the chunks of all files, 0 means never",
+		},
+		&cli.IntFlag{
+			Name:  "defrag-slices",
+			Value: 10,
+			Usage: "defragment the chunks with at least this number of slices",
+		},
+		&cli.DurationFlag{
+			Name:  "defrag-age",
+			Value: time.Hour,
+			Usage: "defragment only the files not modified in this duration",
+		},
+	}
+	for _, f := range clientFlags() {
+		switch f.Names()[0] {
+		case "maintenance-window", "max-compactions", "max-deletions", "io-limit", "io-schedule", "heartbeat", "token",
+			"max-idle-conns", "max-conns-per-host", "idle-conn-timeout", "http2", "tls-session-cache":
+			flags = append(flags, f)
+		}
+	}
+	return &cli.Command{
+		Name:      "agent",
+		Usage:     "run the background jobs of a volume without mounting it",
+		ArgsUsage: "REDIS-URL",
+		Action:    runAgent,
+		Flags:     flags,
+		Description: `
+The agent deletes the data of removed files, compacts the fragmented chunks and
+cleans up the leaked objects for all the clients of a volume. It also defragments
+the chunks which are written in many pieces (such as the logs appended slowly), by
+rewriting all the slices of them into fresh blocks to be read sequentially, while
+the compaction keeps the large slices as they are. It takes part in the
+election of leader like the other clients, so the latency-sensitive clients should
+be mounted with --no-bgjob to leave the jobs to the agent.
+
+Examples:
+$ juicefs agent redis://localhost/1
+$ juicefs agent --maintenance-window "22:00-06:00" redis://localhost/1`,
+	}
+}
+
+// compactAll compacts the fragmented chunks periodically on the leader.
+func compactAll(m meta.Meta, interval time.Duration, minSlices int) {
+	for {
+		time.Sleep(interval)
+		if !jobs.IsLeader() {
+			continue
+		}
+		start := time.Now()
+		if st := m.CompactAll(meta.Background, minSlices); st != 0 {
+			logger.Errorf("compact all: %s", st)
+			continue
+		}
+		logger.Infof("Compacted the chunks with at least %d slices in %s", minSlices, time.Since(start))
+	}
+}
+
+// defragAll defragments the chunks periodically on the leader.
+func defragAll(m meta.Meta, interval time.Duration, minSlices int, age time.Duration) {
+	for {
+		time.Sleep(interval)
+		if !jobs.TryStart(jobs.Defrag) {
+			continue
+		}
+		start := time.Now()
+		var count uint64
+		if st := m.Defrag(meta.Background, minSlices, age, &count); st != 0 {
+			logger.Errorf("defrag: %s", st)
+		} else {
+			logger.Infof("Defragmented %d chunks with at least %d slices in %s", count, minSlices, time.Since(start))
+		}
+		jobs.Done(jobs.Defrag)
+	}
+}
+
+func runAgent(c *cli.Context) error {
+	setLoggerLevel(c)
+	if c.Args().Len() < 1 {
+		logger.Fatalf("REDIS-URL is needed")
+	}
+	addr := c.Args().Get(0)
+	if !strings.Contains(addr, "://") {
+		addr = "redis://" + addr
+	}
+
+	setupJobs(c)
+	setupQoS(c)
+	setupHTTP(c)
+	logger.Infof("Meta address: %s", addr)
+	var rc = meta.RedisConfig{
+		Retries:   10,
+		Strict:    true,
+		Token:     clientToken(c),
+		Heartbeat: time.Duration(c.Int("heartbeat")) * time.Second,
+	}
+	m, err := meta.NewClient(addr, &rc)
+	if err != nil {
+		logger.Fatalf("Meta: %s", err)
+	}
+	format, err := m.Load()
+	if err != nil {
+		logger.Fatalf("load setting: %s", err)
+	}
+
+	// Wrap the default registry, all prometheus.MustRegister() calls should be afterwards
+	prometheus.DefaultRegisterer = prometheus.WrapRegistererWith(prometheus.Labels{"vol_name": format.Name, "mp": "agent"},
+		prometheus.WrapRegistererWithPrefix("juicefs_", prometheus.DefaultRegisterer))
+
+	chunkConf := chunk.Config{
+		BlockSize:  format.BlockSize * 1024,
+		Compress:   format.Compression,
+		PackSize:   format.PackSize << 10,
+		PackIndex:  m,
+		Dedup:      format.Dedup,
+		DedupIndex: m,
+
+		ExternalIndex: m,
+
+		GetTimeout: time.Second * 60,
+		PutTimeout: time.Second * 60,
+		MaxUpload:  20,
+		BufferSize: 300 << 20,
+		CacheDir:   "memory",
+	}
+	blob, err := createReplicatedStorage(format, m, false, false)
+	if err != nil {
+		logger.Fatalf("object storage: %s", err)
+	}
+	logger.Infof("Data use %s", blob)
+	if chunkConf.ExternalStorage, err = createExternalStorage(format); err != nil {
+		logger.Fatalf("object storage: %s", err)
+	}
+	store := chunk.NewCachedStore(blob, chunkConf)
+	m.OnMsg(meta.DeleteChunk, meta.MsgCallback(func(args ...interface{}) error {
+		chunkid := args[0].(uint64)
+		length := args[1].(uint32)
+		return store.Remove(chunkid, int(length))
+	}))
+	m.OnMsg(meta.CompactChunk, meta.MsgCallback(func(args ...interface{}) error {
+		slices := args[0].([]meta.Slice)
+		chunkid := args[1].(uint64)
+		return vfs.Compact(chunkConf, store, slices, chunkid)
+	}))
+	if err = m.NewSession(); err != nil {
+		logger.Fatalf("new session: %s", err)
+	}
+
+	meta.InitMetrics()
+	qos.InitMetrics()
+	go updateMetrics(m)
+	http.Handle("/metrics", promhttp.Handler())
+	http.HandleFunc("/jobs", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		data, _ := json.MarshalIndent(jobs.List(), "", "  ")
+		_, _ = w.Write(append(data, '\n'))
+	})
+	go func() {
+		if err := http.ListenAndServe(c.String("metrics"), nil); err != nil {
+			logger.Errorf("listen and serve for metrics: %s", err)
+		}
+	}()
+
+	if interval := c.Duration("compact-interval"); interval > 0 {
+		go compactAll(m, interval, c.Int("min-slices"))
+	}
+	if interval := c.Duration("defrag-interval"); interval > 0 {
+		go defragAll(m, interval, c.Int("defrag-slices"), c.Duration("defrag-age"))
+	}
+	logger.Infof("Agent of %s is running", format.Name)
+	select {}
+}
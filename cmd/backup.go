@@ -0,0 +1,911 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/chunk"
+	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/juicedata/juicefs/pkg/object"
+	osync "github.com/juicedata/juicefs/pkg/sync"
+	"github.com/urfave/cli/v2"
+)
+
+func backupFlags() *cli.Command {
+	return &cli.Command{
+		Name:      "backup",
+		Usage:     "back up the metadata of a volume into its bucket",
+		ArgsUsage: "REDIS-URL [NAME]",
+		Action:    backup,
+		Description: `
+A backup is stored under backups/NAME/ in the bucket of the volume, it has the metadata
+of all the files (meta.json.gz), the keys of all the objects referenced by them (blocks.gz)
+and a description of the backup and volume (backup.json), which is written at last.
+The name is the current time by default.
+
+The deletion of data is held on all the clients during the backup, so the referenced
+objects are all there when it's finished. The metadata is dumped after all the clients
+have acknowledged the hold in their sessions, the clients without heartbeat in 3 minutes
+are ignored. The objects are not copied, they're deleted
+as usual after the files are removed, so keep the objects in blocks.gz (e.g. by the
+versioning of bucket) if the backup should be restorable after that.
+
+Examples:
+$ juicefs backup redis://localhost
+$ juicefs backup --list redis://localhost`,
+		Flags: []cli.Flag{
+			&cli.BoolFlag{
+				Name:  "list",
+				Usage: "list the finished backups",
+			},
+			&cli.DurationFlag{
+				Name:  "wait",
+				Value: time.Minute * 3,
+				Usage: "max time to wait for all the clients to hold the deletion",
+			},
+		},
+	}
+}
+
+func restoreFlags() *cli.Command {
+	return &cli.Command{
+		Name:      "restore",
+		Usage:     "restore a backup into an empty volume",
+		ArgsUsage: "REDIS-URL NAME",
+		Action:    restore,
+		Description: `
+The volume should be formatted with the bucket of the backup, and the same block size,
+compression, partitions, pack size and encryption key, and have no file in it. The
+files are restored with their attributes, extended attributes, tags and hard links,
+the quotas and the users of gateway are not.
+
+Examples:
+$ juicefs format --storage s3 --bucket https://mybucket.s3.amazonaws.com redis://new myjfs
+$ juicefs restore redis://new 20211016-103000`,
+		Flags: []cli.Flag{
+			&cli.BoolFlag{
+				Name:  "skip-check",
+				Usage: "do not check the existence of the referenced objects",
+			},
+			&cli.IntFlag{
+				Name:  "threads",
+				Value: 50,
+				Usage: "number of threads to check the objects",
+			},
+		},
+	}
+}
+
+const (
+	backupPrefix  = "backups/"
+	backupVersion = 1
+	holdLease     = time.Minute * 5
+	staleSession  = time.Minute * 3 // sessions without heartbeat longer than it are ignored by backup
+)
+
+// backupInfo describes a backup and the volume, it's stored as backup.json after
+// the metadata and the manifest of objects, so a backup without it is incomplete.
+type backupInfo struct {
+	Version  int
+	Name     string
+	Volume   string
+	UUID     string
+	Format   *meta.Format // secrets are removed
+	Started  time.Time
+	Finished time.Time
+	Entries  uint64
+	Chunks   uint64
+	Objects  uint64
+	MaxChunk uint64 // max id of chunks, the new chunks should use larger ones
+}
+
+type backupChunk struct {
+	Indx   uint32
+	Slices []meta.Slice
+}
+
+type backupPack struct {
+	Chunkid   uint64
+	Pack      uint64
+	Off, Size uint32
+}
+
+type backupExternal struct {
+	Chunkid uint64
+	Key     string
+	Off     uint64
+}
+
+type backupDedup struct {
+	Chunkid uint64
+	Indx    int
+	Key     string
+}
+
+// backupEntry is a node in the dump of metadata, the nodes are dumped in the order
+// of walking the tree, the parents come first. The attributes and data of a node
+// are only in the first entry of its hard links.
+type backupEntry struct {
+	Inode     meta.Ino
+	Parent    meta.Ino
+	Name      string            `json:",omitempty"`
+	Attr      *meta.Attr        `json:",omitempty"`
+	Symlink   string            `json:",omitempty"`
+	Xattrs    map[string][]byte `json:",omitempty"`
+	Tags      map[string]string `json:",omitempty"`
+	Inline    []byte            `json:",omitempty"`
+	Chunks    []backupChunk     `json:",omitempty"`
+	Packs     []backupPack      `json:",omitempty"` // the packed blocks first seen in this node
+	Externals []backupExternal  `json:",omitempty"` // the imported chunks first seen in this node
+	Dedups    []backupDedup     `json:",omitempty"` // the deduplicated blocks first seen in this node
+}
+
+// dumper walks the tree of a volume, writes the nodes into meta and the keys of
+// the objects referenced by them into objects.
+type dumper struct {
+	m       meta.Meta
+	conf    chunk.Config // to get the keys of objects
+	meta    *json.Encoder
+	objects io.Writer
+	info    *backupInfo
+	linked  map[meta.Ino]bool // files with hard links
+	chunks  map[uint64]bool
+	packs   map[uint64]bool
+	dedups  map[string]bool // the objects holding deduplicated blocks
+}
+
+func newDumper(m meta.Meta, format *meta.Format, metaOut, objects io.Writer, info *backupInfo) *dumper {
+	return &dumper{
+		m: m,
+		conf: chunk.Config{BlockSize: format.BlockSize * 1024, Partitions: format.Partitions, PackSize: format.PackSize << 10,
+			Dedup: format.Dedup, DedupIndex: m},
+		meta:    json.NewEncoder(metaOut),
+		objects: objects,
+		info:    info,
+		linked:  make(map[meta.Ino]bool),
+		chunks:  make(map[uint64]bool),
+		packs:   make(map[uint64]bool),
+		dedups:  make(map[string]bool),
+	}
+}
+
+func (d *dumper) addObject(key string) error {
+	d.info.Objects++
+	_, err := fmt.Fprintln(d.objects, key)
+	return err
+}
+
+// addChunk records the location and the objects of a chunk when it's first seen.
+func (d *dumper) addChunk(e *backupEntry, s meta.Slice) error {
+	if d.chunks[s.Chunkid] {
+		return nil
+	}
+	d.chunks[s.Chunkid] = true
+	d.info.Chunks++
+	if id := s.Chunkid &^ (chunk.ExternalChunk | meta.ChunkHints); id > d.info.MaxChunk {
+		d.info.MaxChunk = id
+	}
+	if s.Chunkid&chunk.ExternalChunk != 0 {
+		key, off, err := d.m.LookupExternal(s.Chunkid)
+		if err != nil {
+			return fmt.Errorf("lookup external chunk %d: %s", s.Chunkid, err)
+		}
+		if key == "" {
+			return fmt.Errorf("external chunk %d is not found", s.Chunkid)
+		}
+		e.Externals = append(e.Externals, backupExternal{s.Chunkid, key, off})
+		return d.addObject(key)
+	}
+	if d.conf.PackSize > 0 && int(s.Size) <= d.conf.PackSize {
+		pack, off, size, err := d.m.LookupPack(s.Chunkid)
+		if err != nil {
+			return fmt.Errorf("lookup pack of chunk %d: %s", s.Chunkid, err)
+		}
+		if pack > 0 {
+			e.Packs = append(e.Packs, backupPack{s.Chunkid, pack, off, size})
+			if d.packs[pack] {
+				return nil
+			}
+			d.packs[pack] = true
+			return d.addObject(fmt.Sprintf("packs/%d/%d", pack/1000/1000, pack))
+		}
+	}
+	keys, err := chunk.ObjectKeys(&d.conf, s.Chunkid, int(s.Size))
+	if err != nil {
+		return err
+	}
+	for i, k := range keys {
+		if d.conf.Dedup {
+			e.Dedups = append(e.Dedups, backupDedup{s.Chunkid, i, k})
+			if d.dedups[k] {
+				continue
+			}
+			d.dedups[k] = true
+		}
+		if err = d.addObject(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *dumper) dumpNode(e *backupEntry) error {
+	ctx := meta.Background
+	ino, attr := e.Inode, e.Attr
+	var names []byte
+	if st := d.m.ListXattr(ctx, ino, &names); st != 0 {
+		return fmt.Errorf("list xattr of %d: %s", ino, st)
+	}
+	for _, name := range strings.Split(string(names), "\x00") {
+		if name == "" {
+			continue
+		}
+		var value []byte
+		if st := d.m.GetXattr(ctx, ino, name, &value); st != 0 && st != meta.ENOATTR {
+			return fmt.Errorf("get xattr %s of %d: %s", name, ino, st)
+		}
+		if e.Xattrs == nil {
+			e.Xattrs = make(map[string][]byte)
+		}
+		e.Xattrs[name] = value
+	}
+	if st := d.m.GetTags(ctx, ino, &e.Tags); st != 0 {
+		return fmt.Errorf("get tags of %d: %s", ino, st)
+	}
+	switch attr.Typ {
+	case meta.TypeSymlink:
+		var target []byte
+		if st := d.m.ReadLink(ctx, ino, &target); st != 0 {
+			return fmt.Errorf("readlink %d: %s", ino, st)
+		}
+		e.Symlink = string(target)
+	case meta.TypeFile:
+		if st := d.m.ReadInline(ctx, ino, &e.Inline); st != 0 {
+			return fmt.Errorf("read inline data of %d: %s", ino, st)
+		}
+		if e.Inline != nil || attr.Length == 0 {
+			break
+		}
+		for indx := uint32(0); uint64(indx)*meta.ChunkSize < attr.Length; indx++ {
+			var slices []meta.Slice
+			if st := d.m.Read(ctx, ino, indx, &slices); st != 0 {
+				return fmt.Errorf("read chunk %d of %d: %s", indx, ino, st)
+			}
+			var used bool
+			for _, s := range slices {
+				if s.Chunkid > 0 {
+					used = true
+					if err := d.addChunk(e, s); err != nil {
+						return err
+					}
+				}
+			}
+			if used {
+				e.Chunks = append(e.Chunks, backupChunk{indx, slices})
+			}
+		}
+	}
+	d.info.Entries++
+	return d.meta.Encode(e)
+}
+
+// dump dumps the directory and all the nodes under it.
+func (d *dumper) dump(dir *backupEntry) error {
+	if err := d.dumpNode(dir); err != nil {
+		return err
+	}
+	var entries []*meta.Entry
+	if st := d.m.Readdir(meta.Background, dir.Inode, 1, &entries); st != 0 {
+		return fmt.Errorf("readdir %d: %s", dir.Inode, st)
+	}
+	for _, en := range entries {
+		name := string(en.Name)
+		if name == "." || name == ".." {
+			continue
+		}
+		e := &backupEntry{Inode: en.Inode, Parent: dir.Inode, Name: name, Attr: en.Attr}
+		if en.Attr.Typ == meta.TypeDirectory {
+			if err := d.dump(e); err != nil {
+				return err
+			}
+			continue
+		}
+		if en.Attr.Typ == meta.TypeFile && en.Attr.Nlink > 1 {
+			if d.linked[en.Inode] {
+				e.Attr = nil
+				d.info.Entries++
+				if err := d.meta.Encode(e); err != nil {
+					return err
+				}
+				continue
+			}
+			d.linked[en.Inode] = true
+		}
+		if err := d.dumpNode(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dumpVolume dumps the whole tree of a volume.
+func dumpVolume(m meta.Meta, format *meta.Format, metaOut, objects io.Writer, info *backupInfo) error {
+	var attr meta.Attr
+	if st := m.GetAttr(meta.Background, 1, &attr); st != 0 {
+		return fmt.Errorf("getattr of root: %s", st)
+	}
+	return newDumper(m, format, metaOut, objects, info).dump(&backupEntry{Inode: 1, Attr: &attr})
+}
+
+// holdDeletion holds the deletion of data on all the clients until the time, zero releases it.
+func holdDeletion(m meta.Meta, until time.Time) error {
+	format, err := m.Load()
+	if err != nil {
+		return err
+	}
+	format.HoldDeletionUntil = 0
+	if !until.IsZero() {
+		format.HoldDeletionUntil = until.Unix()
+	}
+	return m.UpdateFormat(*format)
+}
+
+// waitForHold waits until the hold of deletion is acknowledged by all the sessions, the stale ones are ignored.
+func waitForHold(m meta.Meta, until int64, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	ignored := make(map[uint64]bool)
+	for {
+		sessions, err := m.ListSessions()
+		if err != nil {
+			return err
+		}
+		var waiting []string
+		for _, s := range sessions {
+			if s.HoldDeletionUntil >= until {
+				continue
+			}
+			if time.Since(s.Heartbeat) > staleSession {
+				if !ignored[s.Sid] {
+					logger.Warnf("Session %d is ignored, no heartbeat since %s", s.Sid, s.Heartbeat)
+					ignored[s.Sid] = true
+				}
+				continue
+			}
+			waiting = append(waiting, strconv.FormatUint(s.Sid, 10))
+		}
+		if len(waiting) == 0 {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("sessions %s have not held the deletion in %s", strings.Join(waiting, ","), timeout)
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// gzipFile is a temporary file compressed by gzip.
+type gzipFile struct {
+	*os.File
+	w *bufio.Writer
+	z *gzip.Writer
+}
+
+func newGzipFile() (*gzipFile, error) {
+	f, err := ioutil.TempFile("", "juicefs-backup-")
+	if err != nil {
+		return nil, err
+	}
+	_ = os.Remove(f.Name())
+	w := bufio.NewWriterSize(f, 1<<20)
+	return &gzipFile{f, w, gzip.NewWriter(w)}, nil
+}
+
+func (g *gzipFile) Write(p []byte) (int, error) {
+	return g.z.Write(p)
+}
+
+// upload finishes the compression and puts the file as key.
+func (g *gzipFile) upload(blob object.ObjectStorage, key string) error {
+	if err := g.z.Close(); err != nil {
+		return err
+	}
+	if err := g.w.Flush(); err != nil {
+		return err
+	}
+	if _, err := g.File.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return blob.Put(key, g.File)
+}
+
+func getBackupInfo(blob object.ObjectStorage, name string) (*backupInfo, error) {
+	in, err := blob.Get(backupPrefix+name+"/backup.json", 0, -1)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+	var info backupInfo
+	if err = json.NewDecoder(in).Decode(&info); err != nil {
+		return nil, fmt.Errorf("decode backup %s: %s", name, err)
+	}
+	if info.Version > backupVersion {
+		return nil, fmt.Errorf("backup %s is in version %d, which is not supported", name, info.Version)
+	}
+	return &info, nil
+}
+
+func listBackups(w io.Writer, blob object.ObjectStorage) error {
+	objs, err := osync.ListAll(blob, backupPrefix, "")
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "%-20s %-20s %10s %10s %10s\n", "NAME", "FINISHED", "ENTRIES", "CHUNKS", "OBJECTS")
+	for o := range objs {
+		if o == nil {
+			return fmt.Errorf("list backups failed")
+		}
+		if !strings.HasSuffix(o.Key(), "/backup.json") {
+			continue
+		}
+		name := strings.TrimSuffix(strings.TrimPrefix(o.Key(), backupPrefix), "/backup.json")
+		info, err := getBackupInfo(blob, name)
+		if err != nil {
+			logger.Warnf("backup %s: %s", name, err)
+			continue
+		}
+		fmt.Fprintf(w, "%-20s %-20s %10d %10d %10d\n", name, info.Finished.Format("2006-01-02 15:04:05"), info.Entries, info.Chunks, info.Objects)
+	}
+	return nil
+}
+
+func openVolume(addr string) (meta.Meta, *meta.Format, object.ObjectStorage) {
+	if !strings.Contains(addr, "://") {
+		addr = "redis://" + addr
+	}
+	logger.Infof("Meta address: %s", addr)
+	var rc = meta.RedisConfig{Retries: 10, Strict: true}
+	m, err := meta.NewClient(addr, &rc)
+	if err != nil {
+		logger.Fatalf("Meta: %s", err)
+	}
+	format, err := m.Load()
+	if err != nil {
+		logger.Fatalf("load setting: %s", err)
+	}
+	blob, err := createReplicatedStorage(format, m, false, false)
+	if err != nil {
+		logger.Fatalf("object storage: %s", err)
+	}
+	logger.Infof("Data use %s", blob)
+	return m, format, blob
+}
+
+func backup(ctx *cli.Context) error {
+	setLoggerLevel(ctx)
+	if ctx.Args().Len() < 1 {
+		return fmt.Errorf("REDIS-URL is needed")
+	}
+	m, format, blob := openVolume(ctx.Args().Get(0))
+	if ctx.Bool("list") {
+		return listBackups(ctx.App.Writer, blob)
+	}
+	name := ctx.Args().Get(1)
+	if name == "" {
+		name = time.Now().Format("20060102-150405")
+	}
+	if strings.ContainsAny(name, "/\\") {
+		return fmt.Errorf("invalid name of backup: %s", name)
+	}
+	if _, err := blob.Head(backupPrefix + name + "/backup.json"); err == nil {
+		return fmt.Errorf("backup %s already exists", name)
+	}
+
+	info := &backupInfo{Version: backupVersion, Name: name, Volume: format.Name, UUID: format.UUID, Started: time.Now()}
+	until := time.Now().Add(holdLease)
+	if err := holdDeletion(m, until); err != nil {
+		return fmt.Errorf("hold deletion: %s", err)
+	}
+	done := make(chan bool)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				if err := holdDeletion(m, time.Time{}); err != nil {
+					logger.Errorf("release the deletion, it's held until %s: %s", time.Now().Add(holdLease), err)
+				}
+				return
+			case <-time.After(holdLease / 5):
+				if err := holdDeletion(m, time.Now().Add(holdLease)); err != nil {
+					logger.Warnf("renew the hold of deletion: %s", err)
+				}
+			}
+		}
+	}()
+	defer func() {
+		close(done)
+		wg.Wait()
+	}()
+	logger.Infof("Deletion is held, wait for all the clients to acknowledge it")
+	if err := waitForHold(m, until.Unix(), ctx.Duration("wait")); err != nil {
+		return fmt.Errorf("hold deletion: %s", err)
+	}
+
+	metaFile, err := newGzipFile()
+	if err != nil {
+		return err
+	}
+	defer metaFile.Close()
+	objFile, err := newGzipFile()
+	if err != nil {
+		return err
+	}
+	defer objFile.Close()
+	if err = dumpVolume(m, format, metaFile, objFile, info); err != nil {
+		return fmt.Errorf("dump metadata: %s", err)
+	}
+	logger.Infof("Dumped %d entries, %d chunks in %d objects", info.Entries, info.Chunks, info.Objects)
+	prefix := backupPrefix + name + "/"
+	if err = metaFile.upload(blob, prefix+"meta.json.gz"); err != nil {
+		return fmt.Errorf("upload metadata: %s", err)
+	}
+	if err = objFile.upload(blob, prefix+"blocks.gz"); err != nil {
+		return fmt.Errorf("upload manifest of objects: %s", err)
+	}
+	format.RemoveSecret()
+	info.Format = format
+	info.Finished = time.Now()
+	data, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = blob.Put(prefix+"backup.json", bytes.NewReader(data)); err != nil {
+		return fmt.Errorf("upload backup.json: %s", err)
+	}
+	logger.Infof("Backup %s is finished in %s", name, info.Finished.Sub(info.Started))
+	return nil
+}
+
+// restoredChunk is where a chunk is restored first, the other references of it are copied from there.
+type restoredChunk struct {
+	inode meta.Ino
+	off   uint64 // in the file
+	s     meta.Slice
+}
+
+// restorer creates the nodes of a backup in an empty volume.
+type restorer struct {
+	m        meta.Meta
+	inodes   map[meta.Ino]meta.Ino // the directories and hard linked files, from the old inodes to new ones
+	chunks   map[uint64]*restoredChunk
+	dirs     map[meta.Ino]*meta.Attr // the attributes are set after the children are restored
+	retained map[meta.Ino][]byte     // the retention is set at last, it blocks restoring the content and children
+	unshared int                     // references of shared chunks which are restored as new ones
+}
+
+func newRestorer(m meta.Meta) *restorer {
+	return &restorer{
+		m:        m,
+		inodes:   map[meta.Ino]meta.Ino{1: 1},
+		chunks:   make(map[uint64]*restoredChunk),
+		dirs:     make(map[meta.Ino]*meta.Attr),
+		retained: make(map[meta.Ino][]byte),
+	}
+}
+
+func (r *restorer) setAttr(ino meta.Ino, attr *meta.Attr) error {
+	ctx := meta.Background
+	a := *attr
+	if st := r.m.SetAttr(ctx, ino, meta.SetAttrUID|meta.SetAttrGID, 0, &a); st != 0 {
+		return fmt.Errorf("set owner of %d: %s", ino, st)
+	}
+	a = *attr
+	var set uint16 = meta.SetAttrMode | meta.SetAttrAtime | meta.SetAttrMtime
+	if a.Flags != 0 {
+		set |= meta.SetAttrFlag
+	}
+	if st := r.m.SetAttr(ctx, ino, set, 0, &a); st != 0 {
+		return fmt.Errorf("set attributes of %d: %s", ino, st)
+	}
+	return nil
+}
+
+func (r *restorer) writeChunks(ino meta.Ino, e *backupEntry) error {
+	ctx := meta.Background
+	for _, p := range e.Packs {
+		if err := r.m.AddPack(p.Pack, []uint64{p.Chunkid}, []uint32{p.Off, p.Off + p.Size}); err != nil {
+			return fmt.Errorf("add packed chunk %d: %s", p.Chunkid, err)
+		}
+	}
+	for _, x := range e.Externals {
+		if err := r.m.AddExternal(x.Chunkid, x.Key, x.Off); err != nil {
+			return fmt.Errorf("add external chunk %d: %s", x.Chunkid, err)
+		}
+	}
+	for _, b := range e.Dedups {
+		// the content is not known, so the restored blocks are only shared with each other
+		if _, err := r.m.AddDedup(b.Key, b.Chunkid, b.Indx, b.Key); err != nil {
+			return fmt.Errorf("add deduplicated block %d_%d: %s", b.Chunkid, b.Indx, err)
+		}
+	}
+	for _, c := range e.Chunks {
+		var pos uint32
+		for _, s := range c.Slices {
+			off := uint64(c.Indx)*meta.ChunkSize + uint64(pos)
+			pos += s.Len
+			if s.Chunkid == 0 {
+				continue
+			}
+			if rc := r.chunks[s.Chunkid]; rc != nil {
+				if s.Off >= rc.s.Off && s.Off+s.Len <= rc.s.Off+rc.s.Len {
+					var copied uint64
+					if st := r.m.CopyFileRange(ctx, rc.inode, rc.off+uint64(s.Off-rc.s.Off), ino, off, uint64(s.Len), 0, &copied); st != 0 {
+						return fmt.Errorf("copy chunk %d into %d: %s", s.Chunkid, ino, st)
+					}
+					continue
+				}
+				r.unshared++
+			} else {
+				r.chunks[s.Chunkid] = &restoredChunk{ino, off, s}
+			}
+			if st := r.m.Write(ctx, ino, c.Indx, pos-s.Len, s); st != 0 {
+				return fmt.Errorf("write chunk %d into %d: %s", s.Chunkid, ino, st)
+			}
+		}
+	}
+	return nil
+}
+
+func (r *restorer) restore(e *backupEntry) error {
+	ctx := meta.Background
+	var ino meta.Ino
+	var attr meta.Attr
+	if e.Inode == 1 && e.Parent == 0 {
+		ino = 1
+	} else {
+		parent, ok := r.inodes[e.Parent]
+		if !ok {
+			return fmt.Errorf("parent %d of %s is not restored", e.Parent, e.Name)
+		}
+		if e.Attr == nil {
+			src, ok := r.inodes[e.Inode]
+			if !ok {
+				return fmt.Errorf("the source %d of link %s is not restored", e.Inode, e.Name)
+			}
+			if st := r.m.Link(ctx, src, parent, e.Name, &attr); st != 0 {
+				return fmt.Errorf("link %s: %s", e.Name, st)
+			}
+			return nil
+		}
+		a := e.Attr
+		var st syscall.Errno
+		switch a.Typ {
+		case meta.TypeDirectory:
+			st = r.m.Mkdir(ctx, parent, e.Name, a.Mode, 0, 0, &ino, &attr)
+		case meta.TypeSymlink:
+			st = r.m.Symlink(ctx, parent, e.Name, e.Symlink, &ino, &attr)
+		default:
+			st = r.m.Mknod(ctx, parent, e.Name, a.Typ, a.Mode, 0, a.Rdev, &ino, &attr)
+		}
+		if st != 0 {
+			return fmt.Errorf("create %s: %s", e.Name, st)
+		}
+	}
+	if e.Attr.Typ == meta.TypeDirectory || e.Attr.Nlink > 1 {
+		r.inodes[e.Inode] = ino
+	}
+	for name, value := range e.Xattrs {
+		if name == meta.RetentionXattr {
+			r.retained[ino] = value
+			continue
+		}
+		if st := r.m.SetXattr(ctx, ino, name, value); st != 0 {
+			return fmt.Errorf("set xattr %s of %s: %s", name, e.Name, st)
+		}
+	}
+	for key, value := range e.Tags {
+		if st := r.m.SetTag(ctx, ino, key, value); st != 0 {
+			return fmt.Errorf("set tag %s of %s: %s", key, e.Name, st)
+		}
+	}
+	if e.Attr.Typ == meta.TypeFile {
+		if e.Inline != nil {
+			if st := r.m.WriteInline(ctx, ino, e.Inline); st != 0 {
+				return fmt.Errorf("write inline data of %s: %s", e.Name, st)
+			}
+		} else if e.Attr.Length > 0 {
+			if st := r.m.Truncate(ctx, ino, 0, e.Attr.Length, &attr); st != 0 {
+				return fmt.Errorf("truncate %s: %s", e.Name, st)
+			}
+			if err := r.writeChunks(ino, e); err != nil {
+				return err
+			}
+		}
+	}
+	if e.Attr.Typ == meta.TypeDirectory {
+		r.dirs[ino] = e.Attr
+		return nil
+	}
+	return r.setAttr(ino, e.Attr)
+}
+
+// finish sets the attributes of directories, which are changed by restoring the children.
+func (r *restorer) finish() error {
+	for ino, attr := range r.dirs {
+		if err := r.setAttr(ino, attr); err != nil {
+			return err
+		}
+	}
+	for ino, value := range r.retained {
+		if st := r.m.SetXattr(meta.Background, ino, meta.RetentionXattr, value); st != 0 {
+			return fmt.Errorf("set retention of %d: %s", ino, st)
+		}
+	}
+	if r.unshared > 0 {
+		logger.Warnf("%d references of shared chunks are restored as new ones, the chunks could be deleted with any of them", r.unshared)
+	}
+	return nil
+}
+
+// restoreVolume restores the dumped nodes into an empty volume.
+func restoreVolume(m meta.Meta, info *backupInfo, in io.Reader) (uint64, error) {
+	if err := m.ReserveChunks(info.MaxChunk); err != nil {
+		return 0, fmt.Errorf("reserve chunks: %s", err)
+	}
+	r := newRestorer(m)
+	dec := json.NewDecoder(in)
+	var n uint64
+	for {
+		var e backupEntry
+		if err := dec.Decode(&e); err == io.EOF {
+			break
+		} else if err != nil {
+			return n, fmt.Errorf("decode entry %d: %s", n, err)
+		}
+		if err := r.restore(&e); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, r.finish()
+}
+
+// checkObjects returns the objects in the manifest which are not found in the storage.
+func checkObjects(blob object.ObjectStorage, in io.Reader, threads int) ([]string, error) {
+	keys := make(chan string, threads)
+	var mu sync.Mutex
+	var missing []string
+	var wg sync.WaitGroup
+	for i := 0; i < threads; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := range keys {
+				if _, err := blob.Head(key); err != nil {
+					mu.Lock()
+					missing = append(missing, key)
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		keys <- scanner.Text()
+	}
+	close(keys)
+	wg.Wait()
+	sort.Strings(missing)
+	return missing, scanner.Err()
+}
+
+func openBackup(blob object.ObjectStorage, key string) (io.ReadCloser, error) {
+	in, err := blob.Get(key, 0, -1)
+	if err != nil {
+		return nil, err
+	}
+	z, err := gzip.NewReader(in)
+	if err != nil {
+		in.Close()
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{z, in}, nil
+}
+
+// checkCompatible returns an error if the objects of the backup can't be read by the volume.
+func checkCompatible(info *backupInfo, format *meta.Format) error {
+	b := info.Format
+	if b.BlockSize != format.BlockSize || b.Compression != format.Compression || b.Partitions != format.Partitions ||
+		b.PackSize != format.PackSize || b.Dedup != format.Dedup || (b.EncryptKey != "") != (format.EncryptKey != "") {
+		return fmt.Errorf("block size, compression, partitions, pack size, dedup or encryption of volume %s is different from the backup of %s", format.Name, info.Volume)
+	}
+	return nil
+}
+
+func restore(ctx *cli.Context) error {
+	setLoggerLevel(ctx)
+	if ctx.Args().Len() < 2 {
+		return fmt.Errorf("REDIS-URL and NAME are needed")
+	}
+	m, format, blob := openVolume(ctx.Args().Get(0))
+	name := ctx.Args().Get(1)
+	info, err := getBackupInfo(blob, name)
+	if err != nil {
+		return fmt.Errorf("backup %s: %s", name, err)
+	}
+	if err = checkCompatible(info, format); err != nil {
+		return err
+	}
+	var entries []*meta.Entry
+	if st := m.Readdir(meta.Background, 1, 0, &entries); st != 0 {
+		return fmt.Errorf("readdir of root: %s", st)
+	}
+	for _, e := range entries {
+		if n := string(e.Name); n != "." && n != ".." {
+			return fmt.Errorf("volume %s is not empty", format.Name)
+		}
+	}
+
+	prefix := backupPrefix + name + "/"
+	if !ctx.Bool("skip-check") {
+		in, err := openBackup(blob, prefix+"blocks.gz")
+		if err != nil {
+			return fmt.Errorf("open manifest of objects: %s", err)
+		}
+		missing, err := checkObjects(blob, in, ctx.Int("threads"))
+		in.Close()
+		if err != nil {
+			return fmt.Errorf("read manifest of objects: %s", err)
+		}
+		if len(missing) > 0 {
+			for _, key := range missing {
+				logger.Errorf("object %s is not found", key)
+			}
+			return fmt.Errorf("%d of %d objects are not found", len(missing), info.Objects)
+		}
+		logger.Infof("All the %d objects are found", info.Objects)
+	}
+	in, err := openBackup(blob, prefix+"meta.json.gz")
+	if err != nil {
+		return fmt.Errorf("open metadata: %s", err)
+	}
+	defer in.Close()
+	n, err := restoreVolume(m, info, in)
+	if err != nil {
+		return fmt.Errorf("restore after %d entries: %s", n, err)
+	}
+	logger.Infof("Restored %d entries of volume %s from backup %s (%s)", n, info.Volume, name, info.Finished.Format(time.RFC3339))
+	return nil
+}
@@ -0,0 +1,169 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/chunk"
+	"github.com/juicedata/juicefs/pkg/fs"
+	"github.com/juicedata/juicefs/pkg/jobs"
+	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/juicedata/juicefs/pkg/object"
+	"github.com/juicedata/juicefs/pkg/vfs"
+)
+
+func newTestFS(t *testing.T, blob object.ObjectStorage, format *meta.Format) (meta.Meta, *fs.FileSystem) {
+	m, err := meta.NewClient("memkv://backup", &meta.RedisConfig{})
+	if err != nil {
+		t.Fatalf("create meta: %s", err)
+	}
+	if err = m.Init(*format, true); err != nil {
+		t.Fatalf("format: %s", err)
+	}
+	chunkConf := chunk.Config{BlockSize: format.BlockSize << 10, MaxUpload: 1, CacheDir: "memory", BufferSize: 100 << 20}
+	conf := vfs.Config{Meta: &meta.Config{}, Format: format, Chunk: &chunkConf}
+	jfs, err := fs.NewFileSystem(&conf, m, chunk.NewCachedStore(blob, chunkConf))
+	if err != nil {
+		t.Fatalf("create fs: %s", err)
+	}
+	return m, jfs
+}
+
+// nolint:errcheck
+func TestBackupRestore(t *testing.T) {
+	blob, _ := object.CreateStorage("mem", "", "", "")
+	format := &meta.Format{Name: "test", BlockSize: 1024}
+	m, jfs := newTestFS(t, blob, format)
+	ctx := meta.Background
+	jfs.Mkdir(ctx, "/d", 0700)
+	files := map[string]string{"/a": "hello", "/d/big": strings.Repeat("0123456789", 300000), "/d/empty": ""}
+	for name, data := range files {
+		f, st := jfs.Create(ctx, name, 0640)
+		if st != 0 {
+			t.Fatalf("create %s: %s", name, st)
+		}
+		f.Write(ctx, []byte(data))
+		f.Close(ctx)
+	}
+	f, _ := jfs.Create(ctx, "/d/clone", 0644)
+	f.Close(ctx)
+	if _, st := jfs.CopyFileRange(ctx, "/d/big", 0, "/d/clone", 0, 3000000); st != 0 {
+		t.Fatalf("copy file range: %s", st)
+	}
+	jfs.Symlink(ctx, "../a", "/d/link")
+	jfs.SetXattr(ctx, "/a", "user.k", []byte("v"), 0)
+	fi, _ := jfs.Stat(ctx, "/a")
+	var d meta.Ino
+	var attr meta.Attr
+	m.Lookup(ctx, 1, "d", &d, &attr)
+	m.Link(ctx, fi.Inode(), d, "hardlink", &attr)
+	m.SetTag(ctx, fi.Inode(), "team", "ml")
+	retention := []byte(strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10))
+	if st := m.SetXattr(ctx, d, meta.RetentionXattr, retention); st != 0 {
+		t.Fatalf("set retention of /d: %s", st)
+	}
+	jfs.Flush()
+
+	var metaOut, objects bytes.Buffer
+	info := &backupInfo{Version: backupVersion}
+	if err := dumpVolume(m, format, &metaOut, &objects, info); err != nil {
+		t.Fatalf("dump: %s", err)
+	}
+	// /, /d, 5 nodes and a hard link
+	if info.Entries != 8 || info.Chunks != 2 || info.Objects != 4 || info.MaxChunk == 0 {
+		t.Fatalf("backup: %+v", info)
+	}
+	missing, err := checkObjects(blob, bytes.NewReader(objects.Bytes()), 2)
+	if err != nil || len(missing) > 0 {
+		t.Fatalf("missing objects: %v %s", missing, err)
+	}
+
+	m2, jfs2 := newTestFS(t, blob, format)
+	if n, err := restoreVolume(m2, info, &metaOut); err != nil || n != info.Entries {
+		t.Fatalf("restore %d entries: %s", n, err)
+	}
+	files["/d/clone"] = files["/d/big"]
+	files["/d/hardlink"] = files["/a"]
+	for name, data := range files {
+		f, st := jfs2.Open(ctx, name, 0)
+		if st != 0 {
+			t.Fatalf("open %s: %s", name, st)
+		}
+		buf := make([]byte, len(data)+1)
+		n, _ := f.Pread(ctx, buf, 0)
+		f.Close(ctx)
+		if string(buf[:n]) != data {
+			t.Fatalf("content of %s: %d bytes, expect %d", name, n, len(data))
+		}
+	}
+	if target, _ := jfs2.Readlink(ctx, "/d/link"); string(target) != "../a" {
+		t.Fatalf("symlink: %s", target)
+	}
+	if v, _ := jfs2.GetXattr(ctx, "/d/hardlink", "user.k"); string(v) != "v" {
+		t.Fatalf("xattr: %s", v)
+	}
+	fi, _ = jfs2.Stat(ctx, "/a")
+	if st := m2.GetAttr(ctx, fi.Inode(), &attr); st != 0 || attr.Nlink != 2 || attr.Mode != 0640 {
+		t.Fatalf("attr of /a: %+v", attr)
+	}
+	var tags map[string]string
+	if m2.GetTags(ctx, fi.Inode(), &tags); tags["team"] != "ml" {
+		t.Fatalf("tags: %v", tags)
+	}
+	if st, _ := jfs2.Stat(ctx, "/d"); st.Mode().Perm() != 0700 {
+		t.Fatalf("mode of /d: %s", st.Mode())
+	}
+	if v, _ := jfs2.GetXattr(ctx, "/d", meta.RetentionXattr); string(v) != string(retention) {
+		t.Fatalf("retention of /d: %s", v)
+	}
+	var chunkid uint64
+	m2.NewChunk(ctx, fi.Inode(), 0, 0, &chunkid)
+	if chunkid <= info.MaxChunk {
+		t.Fatalf("new chunk %d should be after %d", chunkid, info.MaxChunk)
+	}
+
+}
+
+func TestWaitForHold(t *testing.T) {
+	m, err := meta.NewClient("memkv://hold", &meta.RedisConfig{})
+	if err != nil {
+		t.Fatalf("create meta: %s", err)
+	}
+	until := time.Now().Add(time.Minute)
+	if err = m.Init(meta.Format{Name: "test", HoldDeletionUntil: until.Unix()}, true); err != nil {
+		t.Fatalf("format: %s", err)
+	}
+	defer jobs.Hold(time.Time{}, jobs.Deletion, jobs.Compaction, jobs.Cleanup, jobs.Defrag)
+	// a client started during the backup holds the deletion at start
+	if err = m.NewSession(); err != nil {
+		t.Fatalf("new session: %s", err)
+	}
+	if err = waitForHold(m, until.Unix(), time.Second); err != nil {
+		t.Fatalf("wait for hold: %s", err)
+	}
+	until = until.Add(time.Minute)
+	if err = holdDeletion(m, until); err != nil {
+		t.Fatalf("hold deletion: %s", err)
+	}
+	if err = waitForHold(m, until.Unix(), time.Second); err == nil {
+		t.Fatalf("the session has not reloaded the setting")
+	}
+}
@@ -0,0 +1,346 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/chunk"
+	"github.com/juicedata/juicefs/pkg/fs"
+	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/juicedata/juicefs/pkg/object"
+	osync "github.com/juicedata/juicefs/pkg/sync"
+	"github.com/juicedata/juicefs/pkg/version"
+	"github.com/juicedata/juicefs/pkg/vfs"
+	"github.com/urfave/cli/v2"
+)
+
+func exportFlags() *cli.Command {
+	return &cli.Command{
+		Name:      "export",
+		Usage:     "export files in a directory as objects",
+		ArgsUsage: "REDIS-URL PATH DST",
+		Description: `
+The regular files under PATH are copied into DST as whole objects, the keys are the paths
+relative to PATH. DST has the same format as the destination of sync, e.g. s3://bucket/prefix/.
+The mtime of files is kept if DST supports it (local disk, SFTP or HDFS), otherwise only the
+files modified after last export are copied again when it's run again.
+
+The holes of sparse files are found in the metadata, they're kept if DST is local disk, or
+filled with zeros in the objects.`,
+		Action: export,
+		Flags: []cli.Flag{
+			&cli.IntFlag{
+				Name:  "threads",
+				Value: 10,
+				Usage: "number of concurrent threads",
+			},
+			&cli.BoolFlag{
+				Name:  "delete-dst",
+				Usage: "delete the objects which are not in PATH from destination",
+			},
+			&cli.IntFlag{
+				Name:  "bwlimit",
+				Usage: "limit bandwidth in Mbps (0 means unlimited)",
+			},
+			&cli.BoolFlag{
+				Name:  "no-https",
+				Usage: "donot use HTTPS",
+			},
+		},
+	}
+}
+
+var errReadOnly = errors.New("read-only storage")
+
+// jfsObject is a regular file in the exported directory.
+type jfsObject struct {
+	key string
+	fi  *fs.FileStat
+}
+
+func (o *jfsObject) Key() string      { return o.key }
+func (o *jfsObject) Size() int64      { return o.fi.Size() }
+func (o *jfsObject) Mtime() time.Time { return o.fi.ModTime() }
+func (o *jfsObject) IsDir() bool      { return o.fi.IsDir() }
+
+// jfsReader reads a range of file.
+type jfsReader struct {
+	ctx meta.Context
+	f   *fs.File
+	off int64
+	end int64
+}
+
+func (r *jfsReader) Read(b []byte) (int, error) {
+	if r.off >= r.end {
+		return 0, io.EOF
+	}
+	if int64(len(b)) > r.end-r.off {
+		b = b[:r.end-r.off]
+	}
+	n, err := r.f.Pread(r.ctx, b, r.off)
+	r.off += int64(n)
+	return n, err
+}
+
+func (r *jfsReader) Close() error {
+	if st := r.f.Close(r.ctx); st != 0 {
+		return st
+	}
+	return nil
+}
+
+// jfsStore exposes the files under a directory as a read-only object storage.
+type jfsStore struct {
+	object.DefaultObjectStorage
+	fs   *fs.FileSystem
+	ctx  meta.Context
+	name string
+	root string
+}
+
+func newJfsStore(jfs *fs.FileSystem, name, root string) *jfsStore {
+	root = strings.TrimSuffix(path.Clean("/"+root), "/") + "/"
+	return &jfsStore{fs: jfs, ctx: meta.NewContext(uint32(os.Getpid()), 0, []uint32{0}), name: name, root: root}
+}
+
+func (s *jfsStore) String() string {
+	return fmt.Sprintf("jfs://%s%s", s.name, s.root)
+}
+
+func (s *jfsStore) Head(key string) (object.Object, error) {
+	fi, st := s.fs.Stat(s.ctx, s.root+key)
+	if st != 0 {
+		return nil, st
+	}
+	return &jfsObject{key, fi}, nil
+}
+
+func (s *jfsStore) Get(key string, off, limit int64) (io.ReadCloser, error) {
+	f, st := s.fs.Open(s.ctx, s.root+key, 0)
+	if st != 0 {
+		return nil, st
+	}
+	fi, _ := f.Stat()
+	end := fi.Size()
+	if limit >= 0 && off+limit < end {
+		end = off + limit
+	}
+	return &jfsReader{s.ctx, f, off, end}, nil
+}
+
+func (s *jfsStore) Checksum(key string) (string, error) {
+	sum, st := s.fs.GetXattr(s.ctx, s.root+key, vfs.ChecksumXattr)
+	if st != 0 {
+		return "", nil
+	}
+	return string(sum), nil
+}
+
+// Extents returns the ranges of a file which have data, the holes are the chunks or the ranges
+// in them which are never written.
+func (s *jfsStore) Extents(key string) ([]object.Extent, error) {
+	fi, st := s.fs.Stat(s.ctx, s.root+key)
+	if st != 0 {
+		return nil, st
+	}
+	m := s.fs.Meta()
+	var inline []byte
+	if st = m.ReadInline(s.ctx, fi.Inode(), &inline); st != 0 {
+		return nil, st
+	}
+	if inline != nil {
+		return []object.Extent{{Off: 0, Len: fi.Size()}}, nil
+	}
+	var exts []object.Extent
+	for indx := uint32(0); int64(indx)*meta.ChunkSize < fi.Size(); indx++ {
+		var slices []meta.Slice
+		if st = m.Read(s.ctx, fi.Inode(), indx, &slices); st != 0 {
+			return nil, st
+		}
+		off := int64(indx) * meta.ChunkSize
+		for _, sl := range slices {
+			if sl.Chunkid > 0 {
+				if n := len(exts); n > 0 && exts[n-1].Off+exts[n-1].Len == off {
+					exts[n-1].Len += int64(sl.Len)
+				} else {
+					exts = append(exts, object.Extent{Off: off, Len: int64(sl.Len)})
+				}
+			}
+			off += int64(sl.Len)
+		}
+	}
+	return exts, nil
+}
+
+func (s *jfsStore) Put(key string, in io.Reader) error {
+	return errReadOnly
+}
+
+func (s *jfsStore) Delete(key string) error {
+	return errReadOnly
+}
+
+// walk sends the regular files under dir in the order of keys, the directories
+// are sorted as their names end with '/'.
+func (s *jfsStore) walk(dir, prefix, marker string, out chan<- object.Object) error {
+	f, st := s.fs.Open(s.ctx, s.root+dir, 0)
+	if st != 0 {
+		return fmt.Errorf("open %s: %s", s.root+dir, st)
+	}
+	entries, st := f.Readdir(s.ctx, 0)
+	f.Close(s.ctx)
+	if st != 0 {
+		return fmt.Errorf("readdir %s: %s", s.root+dir, st)
+	}
+	keys := make([]string, 0, len(entries))
+	infos := make(map[string]*fs.FileStat, len(entries))
+	for _, e := range entries {
+		fi := e.(*fs.FileStat)
+		if fi.Name() == "." || fi.Name() == ".." {
+			continue
+		}
+		key := dir + fi.Name()
+		if fi.IsDir() {
+			key += "/"
+		} else if fi.IsSymlink() {
+			logger.Warnf("skip symlink %s", s.root+key)
+			continue
+		} else if !fi.Mode().IsRegular() {
+			continue
+		}
+		keys = append(keys, key)
+		infos[key] = fi
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if infos[key].IsDir() {
+			if (strings.HasPrefix(key, prefix) || strings.HasPrefix(prefix, key)) &&
+				(key > marker || strings.HasPrefix(marker, key)) {
+				if err := s.walk(key, prefix, marker, out); err != nil {
+					return err
+				}
+			}
+		} else if strings.HasPrefix(key, prefix) && key > marker {
+			out <- &jfsObject{key, infos[key]}
+		}
+	}
+	return nil
+}
+
+func (s *jfsStore) ListAll(prefix, marker string) (<-chan object.Object, error) {
+	out := make(chan object.Object, 10240)
+	go func() {
+		if err := s.walk("", prefix, marker, out); err != nil {
+			logger.Errorf("list %s: %s", s, err)
+			out <- nil
+		}
+		close(out)
+	}()
+	return out, nil
+}
+
+func export(c *cli.Context) error {
+	setLoggerLevel(c)
+	if c.Args().Len() < 3 {
+		return fmt.Errorf("REDIS-URL, PATH and DST are needed")
+	}
+	addr := c.Args().Get(0)
+	if !strings.Contains(addr, "://") {
+		addr = "redis://" + addr
+	}
+	logger.Infof("Meta address: %s", addr)
+	var rc = meta.RedisConfig{Retries: 10, Strict: true}
+	m, err := meta.NewClient(addr, &rc)
+	if err != nil {
+		logger.Fatalf("Meta: %s", err)
+	}
+	format, err := m.Load()
+	if err != nil {
+		logger.Fatalf("load setting: %s", err)
+	}
+
+	chunkConf := chunk.Config{
+		BlockSize:  format.BlockSize * 1024,
+		Compress:   format.Compression,
+		PackSize:   format.PackSize << 10,
+		PackIndex:  m,
+		Dedup:      format.Dedup,
+		DedupIndex: m,
+		Partitions: format.Partitions,
+
+		ExternalIndex: m,
+
+		GetTimeout: time.Second * 60,
+		PutTimeout: time.Second * 60,
+		MaxUpload:  20,
+		BufferSize: 300 << 20,
+		Readahead:  4 << 20,
+		CacheDir:   "memory",
+	}
+	blob, err := createReplicatedStorage(format, m, false, false)
+	if err != nil {
+		logger.Fatalf("object storage: %s", err)
+	}
+	logger.Infof("Data use %s", blob)
+	if chunkConf.ExternalStorage, err = createExternalStorage(format); err != nil {
+		logger.Fatalf("object storage: %s", err)
+	}
+	store := chunk.NewCachedStore(blob, chunkConf)
+	conf := &vfs.Config{
+		Meta:    &meta.Config{IORetries: 10},
+		Format:  format,
+		Version: version.Version(),
+		Chunk:   &chunkConf,
+	}
+	jfs, err := fs.NewFileSystem(conf, m, store)
+	if err != nil {
+		logger.Fatalf("Initialize failed: %s", err)
+	}
+	src := newJfsStore(jfs, format.Name, c.Args().Get(1))
+	if fi, err := src.Head(""); err != nil || !fi.IsDir() {
+		logger.Fatalf("%s is not a directory: %v", src.root, err)
+	}
+
+	config := &osync.Config{
+		Threads:   c.Int("threads"),
+		Update:    true,
+		Sparse:    true,
+		DeleteDst: c.Bool("delete-dst"),
+		BWLimit:   c.Int("bwlimit"),
+		NoHTTPS:   c.Bool("no-https"),
+	}
+	dstURL := c.Args().Get(2)
+	if !strings.HasSuffix(dstURL, "/") {
+		dstURL += "/"
+	}
+	dst, err := createSyncStorage(dstURL, config)
+	if err != nil {
+		logger.Fatalf("create %s: %s", dstURL, err)
+	}
+	if err = dst.Create(); err != nil {
+		logger.Warnf("create %s: %s", dst, err)
+	}
+	return osync.Sync(src, dst, config)
+}
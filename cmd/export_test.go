@@ -0,0 +1,138 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/juicedata/juicefs/pkg/chunk"
+	"github.com/juicedata/juicefs/pkg/fs"
+	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/juicedata/juicefs/pkg/object"
+	osync "github.com/juicedata/juicefs/pkg/sync"
+	"github.com/juicedata/juicefs/pkg/vfs"
+)
+
+// nolint:errcheck
+func TestExportStore(t *testing.T) {
+	m, err := meta.NewClient("memkv://test", &meta.RedisConfig{})
+	if err != nil {
+		t.Fatalf("create meta: %s", err)
+	}
+	format := meta.Format{Name: "test", BlockSize: 4096}
+	_ = m.Init(format, true)
+	chunkConf := chunk.Config{BlockSize: 4 << 20, MaxUpload: 1, CacheDir: "memory", BufferSize: 100 << 20}
+	blob, _ := object.CreateStorage("mem", "", "", "")
+	conf := vfs.Config{Meta: &meta.Config{}, Format: &format, Chunk: &chunkConf}
+	jfs, _ := fs.NewFileSystem(&conf, m, chunk.NewCachedStore(blob, chunkConf))
+
+	ctx := meta.Background
+	jfs.Rmr(ctx, "/export")
+	defer jfs.Rmr(ctx, "/export")
+	jfs.Mkdir(ctx, "/export", 0755)
+	jfs.Mkdir(ctx, "/export/b", 0755)
+	files := map[string]string{"a": "1", "b.txt": "22", "b/c": "333"}
+	for name, data := range files {
+		f, st := jfs.Create(ctx, "/export/"+name, 0644)
+		if st != 0 {
+			t.Fatalf("create %s: %s", name, st)
+		}
+		f.Write(ctx, []byte(data))
+		f.Close(ctx)
+	}
+	jfs.Symlink(ctx, "a", "/export/link")
+
+	src := newJfsStore(jfs, "test", "/export")
+	ch, _ := src.ListAll("", "")
+	var keys []string
+	for o := range ch {
+		if o == nil {
+			t.Fatalf("list failed")
+		}
+		keys = append(keys, o.Key())
+	}
+	if len(keys) != 3 || keys[0] != "a" || keys[1] != "b.txt" || keys[2] != "b/c" {
+		t.Fatalf("keys should be sorted: %v", keys)
+	}
+	ch, _ = src.ListAll("", "b.txt")
+	if o := <-ch; o == nil || o.Key() != "b/c" {
+		t.Fatalf("list after b.txt: %v", o)
+	}
+
+	dst, _ := object.CreateStorage("mem", "", "", "")
+	if err := osync.Sync(src, dst, &osync.Config{Threads: 2, Update: true, Quiet: true}); err != nil {
+		t.Fatalf("export: %s", err)
+	}
+	for name, data := range files {
+		in, err := dst.Get(name, 0, -1)
+		if err != nil {
+			t.Fatalf("get %s: %s", name, err)
+		}
+		d, _ := ioutil.ReadAll(in)
+		in.Close()
+		if string(d) != data {
+			t.Fatalf("content of %s: %q != %q", name, d, data)
+		}
+		o, _ := dst.Head(name)
+		fi, _ := jfs.Stat(ctx, "/export/"+name)
+		if !o.Mtime().Equal(fi.ModTime()) {
+			t.Fatalf("mtime of %s: %s != %s", name, o.Mtime(), fi.ModTime())
+		}
+	}
+}
+
+// nolint:errcheck
+func TestExportSparse(t *testing.T) {
+	m, err := meta.NewClient("memkv://test", &meta.RedisConfig{})
+	if err != nil {
+		t.Fatalf("create meta: %s", err)
+	}
+	format := meta.Format{Name: "test", BlockSize: 4096}
+	_ = m.Init(format, true)
+	chunkConf := chunk.Config{BlockSize: 4 << 20, MaxUpload: 1, CacheDir: "memory", BufferSize: 100 << 20}
+	blob, _ := object.CreateStorage("mem", "", "", "")
+	conf := vfs.Config{Meta: &meta.Config{}, Format: &format, Chunk: &chunkConf}
+	jfs, _ := fs.NewFileSystem(&conf, m, chunk.NewCachedStore(blob, chunkConf))
+
+	ctx := meta.Background
+	jfs.Mkdir(ctx, "/sparse", 0755)
+	f, st := jfs.Create(ctx, "/sparse/img", 0644)
+	if st != 0 {
+		t.Fatalf("create: %s", st)
+	}
+	f.Pwrite(ctx, []byte("hello"), 10<<20)
+	f.Pwrite(ctx, []byte("world"), meta.ChunkSize+100)
+	f.Close(ctx)
+	jfs.Truncate(ctx, "/sparse/img", meta.ChunkSize*2)
+
+	src := newJfsStore(jfs, "test", "/sparse")
+	exts, err := src.Extents("img")
+	if err != nil || len(exts) != 2 || exts[0] != (object.Extent{Off: 10 << 20, Len: 5}) || exts[1] != (object.Extent{Off: meta.ChunkSize + 100, Len: 5}) {
+		t.Fatalf("extents: %+v %v", exts, err)
+	}
+
+	dir := t.TempDir()
+	dst, _ := object.CreateStorage("file", dir+"/", "", "")
+	if err := osync.Sync(src, dst, &osync.Config{Threads: 2, Update: true, Sparse: true, Quiet: true}); err != nil {
+		t.Fatalf("export: %s", err)
+	}
+	d, err := ioutil.ReadFile(filepath.Join(dir, "img"))
+	if err != nil || len(d) != meta.ChunkSize*2 || string(d[10<<20:10<<20+5]) != "hello" || string(d[meta.ChunkSize+100:meta.ChunkSize+105]) != "world" {
+		t.Fatalf("exported file: %d %v", len(d), err)
+	}
+}
@@ -0,0 +1,95 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+	"syscall"
+
+	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/juicedata/juicefs/pkg/utils"
+	"github.com/urfave/cli/v2"
+)
+
+func faultFlags() *cli.Command {
+	return &cli.Command{
+		Name:      "fault",
+		Usage:     "List or inject faults into a mount point built with tag faultinjection (for testing)",
+		ArgsUsage: "MOUNTPOINT [OP=ACTION[:ARG][,p=PROBABILITY][,n=COUNT] ...]",
+		Action:    injectFaults,
+		Description: `
+The rules replace the existing ones, OP is meta.<method> (e.g. meta.lookup) or
+object.get/put/delete/head/list, a trailing '*' matches all the operations with
+the prefix. ACTION is error[:ERRNO], delay:DURATION or drop[:DURATION].
+
+Examples:
+$ juicefs fault /jfs meta.lookup=error:ENOENT,p=0.1 object.get=delay:3s,n=10
+$ juicefs fault /jfs --clear`,
+		Flags: []cli.Flag{
+			&cli.BoolFlag{
+				Name:  "clear",
+				Usage: "remove all the rules",
+			},
+		},
+	}
+}
+
+func injectFaults(ctx *cli.Context) error {
+	setLoggerLevel(ctx)
+	if runtime.GOOS == "windows" {
+		logger.Infof("Windows is not supported")
+		return nil
+	}
+	if ctx.Args().Len() < 1 {
+		return fmt.Errorf("MOUNTPOINT is needed")
+	}
+	f := openControler(ctx.Args().Get(0))
+	if f == nil {
+		logger.Fatalf("%s is not inside JuiceFS", ctx.Args().Get(0))
+	}
+	defer f.Close()
+	rules := strings.Join(ctx.Args().Slice()[1:], "\n")
+	var set uint8
+	if rules != "" || ctx.Bool("clear") {
+		set = 1
+	}
+	wb := utils.NewBuffer(8 + 1 + uint32(len(rules)))
+	wb.Put32(meta.Fault)
+	wb.Put32(1 + uint32(len(rules)))
+	wb.Put8(set)
+	wb.Put([]byte(rules))
+	if _, err := f.Write(wb.Bytes()); err != nil {
+		logger.Fatalf("write message: %s", err)
+	}
+	buf := make([]byte, 1<<16)
+	n, err := f.Read(buf)
+	if err != nil || n < 1 {
+		logger.Fatalf("read message: %d %s", n, err)
+	}
+	switch syscall.Errno(buf[0]) {
+	case 0:
+	case syscall.ENOTSUP:
+		logger.Fatalf("fault injection is not enabled, the client should be built with tag faultinjection")
+	default:
+		logger.Fatalf("inject faults: %s", buf[1:n])
+	}
+	if n > 1 {
+		fmt.Println(string(buf[1:n]))
+	}
+	return nil
+}
@@ -0,0 +1,271 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/urfave/cli/v2"
+)
+
+func findFlags() *cli.Command {
+	return &cli.Command{
+		Name:      "find",
+		Usage:     "Find files by name, type, size and mtime using the name index",
+		ArgsUsage: "REDIS-URL [PATH]",
+		Action:    find,
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:  "name",
+				Value: "*",
+				Usage: "glob pattern of the base name, a literal suffix like *.jpg is the fastest",
+			},
+			&cli.StringFlag{
+				Name:  "type",
+				Usage: "type of the file: f (regular file), d (directory) or l (symlink)",
+			},
+			&cli.StringFlag{
+				Name:  "size",
+				Usage: "size in bytes (with unit k, M, G or T): +N for larger, -N for smaller, N for exactly",
+			},
+			&cli.StringFlag{
+				Name:  "mtime",
+				Usage: "days since last modified: +N for more than N, -N for less than N, N for exactly",
+			},
+		},
+	}
+}
+
+// bound is a numeric test like find(1).
+type bound struct {
+	cmp int // 1: greater than, -1: less than, 0: equal
+	n   int64
+}
+
+var sizeUnits = map[byte]int64{'k': 1 << 10, 'K': 1 << 10, 'M': 1 << 20, 'G': 1 << 30, 'T': 1 << 40}
+
+func parseBound(s string, units map[byte]int64) (*bound, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var b bound
+	v := s
+	switch v[0] {
+	case '+':
+		b.cmp, v = 1, v[1:]
+	case '-':
+		b.cmp, v = -1, v[1:]
+	}
+	unit := int64(1)
+	if len(v) > 0 && units[v[len(v)-1]] > 0 {
+		unit, v = units[v[len(v)-1]], v[:len(v)-1]
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("invalid number: %s", s)
+	}
+	b.n = n * unit
+	return &b, nil
+}
+
+func (b *bound) match(v int64) bool {
+	if b == nil {
+		return true
+	}
+	switch b.cmp {
+	case 1:
+		return v > b.n
+	case -1:
+		return v < b.n
+	default:
+		return v == b.n
+	}
+}
+
+type findTests struct {
+	typ   uint8
+	size  *bound
+	mtime *bound
+	now   time.Time
+}
+
+func (t *findTests) needAttr() bool {
+	return t.typ != 0 || t.size != nil || t.mtime != nil
+}
+
+func (t *findTests) match(attr *meta.Attr) bool {
+	if t.typ != 0 && attr.Typ != t.typ {
+		return false
+	}
+	if t.size != nil && (attr.Typ != meta.TypeFile || !t.size.match(int64(attr.Length))) {
+		return false
+	}
+	return t.mtime.match(int64(t.now.Sub(time.Unix(attr.Mtime, 0)) / (time.Hour * 24)))
+}
+
+func parseFindTests(ctx *cli.Context) (*findTests, error) {
+	t := &findTests{now: time.Now()}
+	switch ctx.String("type") {
+	case "":
+	case "f":
+		t.typ = meta.TypeFile
+	case "d":
+		t.typ = meta.TypeDirectory
+	case "l":
+		t.typ = meta.TypeSymlink
+	default:
+		return nil, fmt.Errorf("invalid type: %s", ctx.String("type"))
+	}
+	var err error
+	if t.size, err = parseBound(ctx.String("size"), sizeUnits); err != nil {
+		return nil, err
+	}
+	if t.mtime, err = parseBound(ctx.String("mtime"), nil); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// dirPaths resolves the paths of directories by their parents, the names of
+// sub-directories are cached when a parent is listed.
+type dirPaths struct {
+	m     meta.Meta
+	paths map[meta.Ino]string
+}
+
+func (d *dirPaths) get(inode meta.Ino) (string, syscall.Errno) {
+	if p, ok := d.paths[inode]; ok {
+		return p, 0
+	}
+	var attr meta.Attr
+	if st := d.m.GetAttr(meta.Background, inode, &attr); st != 0 {
+		return "", st
+	}
+	if attr.Typ != meta.TypeDirectory || attr.Parent == 0 {
+		return "", syscall.ENOTDIR
+	}
+	parent, st := d.get(attr.Parent)
+	if st != 0 {
+		return "", st
+	}
+	var entries []*meta.Entry
+	if st = d.m.Readdir(meta.Background, attr.Parent, 0, &entries); st != 0 {
+		return "", st
+	}
+	for _, e := range entries {
+		name := string(e.Name)
+		if e.Attr.Typ == meta.TypeDirectory && name != "." && name != ".." {
+			d.paths[e.Inode] = path.Join(parent, name)
+		}
+	}
+	if p, ok := d.paths[inode]; ok {
+		return p, 0
+	}
+	return "", syscall.ENOENT
+}
+
+// walk lists the tree under dir recursively, it's used when the name index is not enabled.
+func walk(m meta.Meta, dir meta.Ino, p, pattern string, tests *findTests) {
+	var entries []*meta.Entry
+	if st := m.Readdir(meta.Background, dir, 1, &entries); st != 0 {
+		logger.Errorf("readdir %s: %s", p, st)
+		return
+	}
+	for _, e := range entries {
+		name := string(e.Name)
+		if name == "." || name == ".." {
+			continue
+		}
+		if ok, _ := path.Match(pattern, name); ok && tests.match(e.Attr) {
+			fmt.Println(path.Join(p, name))
+		}
+		if e.Attr.Typ == meta.TypeDirectory {
+			walk(m, e.Inode, path.Join(p, name), pattern, tests)
+		}
+	}
+}
+
+func find(ctx *cli.Context) error {
+	setLoggerLevel(ctx)
+	if ctx.Args().Len() < 1 {
+		return fmt.Errorf("REDIS-URL is needed")
+	}
+	addr := ctx.Args().Get(0)
+	if !strings.Contains(addr, "://") {
+		addr = "redis://" + addr
+	}
+	root := path.Clean("/" + ctx.Args().Get(1))
+	pattern := ctx.String("name")
+	if _, err := path.Match(pattern, ""); err != nil {
+		return fmt.Errorf("invalid pattern %s: %s", pattern, err)
+	}
+	tests, err := parseFindTests(ctx)
+	if err != nil {
+		return err
+	}
+
+	logger.Infof("Meta address: %s", addr)
+	var rc = meta.RedisConfig{Retries: 10, Strict: true}
+	m, err := meta.NewClient(addr, &rc)
+	if err != nil {
+		logger.Fatalf("Meta: %s", err)
+	}
+	if _, err = m.Load(); err != nil {
+		logger.Fatalf("load setting: %s", err)
+	}
+	var entries []*meta.IndexEntry
+	st := m.FindNames(meta.Background, pattern, &entries)
+	if st == syscall.ENOTSUP {
+		logger.Warnf("The name index is not enabled, walking the tree of %s", root)
+		inode, st := resolve(m, root)
+		if st != 0 {
+			logger.Fatalf("lookup %s: %s", root, st)
+		}
+		walk(m, inode, root, pattern, tests)
+		return nil
+	}
+	if st != 0 {
+		logger.Fatalf("find %s: %s", pattern, st)
+	}
+	dirs := &dirPaths{m, map[meta.Ino]string{1: "/"}}
+	var attr meta.Attr
+	for _, e := range entries {
+		if tests.needAttr() {
+			if st = m.GetAttr(meta.Background, e.Inode, &attr); st != 0 {
+				continue // removed
+			}
+			if !tests.match(&attr) {
+				continue
+			}
+		}
+		dir, st := dirs.get(e.Parent)
+		if st != 0 {
+			logger.Debugf("path of directory %d: %s", e.Parent, st)
+			continue
+		}
+		p := path.Join(dir, string(e.Name))
+		if root == "/" || strings.HasPrefix(p, root+"/") {
+			fmt.Println(p)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/meta"
+)
+
+func TestParseBound(t *testing.T) {
+	if b, err := parseBound("", sizeUnits); err != nil || b != nil || !b.match(100) {
+		t.Fatalf("empty bound: %+v %s", b, err)
+	}
+	b, err := parseBound("+10k", sizeUnits)
+	if err != nil || b.cmp != 1 || b.n != 10<<10 || b.match(10<<10) || !b.match(10<<10+1) {
+		t.Fatalf("+10k: %+v %s", b, err)
+	}
+	b, err = parseBound("-2", nil)
+	if err != nil || b.cmp != -1 || !b.match(1) || b.match(2) {
+		t.Fatalf("-2: %+v %s", b, err)
+	}
+	if _, err = parseBound("1x", sizeUnits); err == nil {
+		t.Fatalf("1x should be invalid")
+	}
+
+	now := time.Now()
+	tests := &findTests{typ: meta.TypeFile, size: &bound{1, 100}, mtime: &bound{-1, 1}, now: now}
+	if !tests.match(&meta.Attr{Typ: meta.TypeFile, Length: 200, Mtime: now.Unix()}) {
+		t.Fatalf("should match a new large file")
+	}
+	if tests.match(&meta.Attr{Typ: meta.TypeFile, Length: 200, Mtime: now.Unix() - 86400*2}) {
+		t.Fatalf("should not match an old file")
+	}
+	if tests.match(&meta.Attr{Typ: meta.TypeDirectory, Mtime: now.Unix()}) {
+		t.Fatalf("should not match a directory")
+	}
+}
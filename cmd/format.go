@@ -18,6 +18,7 @@ package main
 import (
 	"bytes"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"math/rand"
 	_ "net/http/pprof"
@@ -36,6 +37,9 @@ import (
 	"github.com/urfave/cli/v2"
 )
 
+// the data of inlined files are loaded together with the attributes, so it should be small
+const maxInlineSize = 64 << 10
+
 func fixObjectSize(s int) int {
 	const min, max = 64, 16 << 10
 	var bits uint
@@ -52,14 +56,21 @@ func fixObjectSize(s int) int {
 	return s
 }
 
-func createStorage(format *meta.Format) (object.ObjectStorage, error) {
-	object.UserAgent = "JuiceFS-" + version.Version()
-	blob, err := object.CreateStorage(strings.ToLower(format.Storage), format.Bucket, format.AccessKey, format.SecretKey)
+func newStorage(format *meta.Format, storage, bucket, accessKey, secretKey string) (object.ObjectStorage, error) {
+	blob, err := object.CreateStorage(strings.ToLower(storage), bucket, accessKey, secretKey)
 	if err != nil {
 		return nil, err
 	}
-	blob = object.WithPrefix(blob, format.Name+"/")
+	return object.WithPrefix(blob, format.Name+"/"), nil
+}
 
+// createExternalStorage returns the bucket of volume without prefix, where
+// the imported objects are read from.
+func createExternalStorage(format *meta.Format) (object.ObjectStorage, error) {
+	return object.CreateStorage(strings.ToLower(format.Storage), format.Bucket, format.AccessKey, format.SecretKey)
+}
+
+func encryptStorage(blob object.ObjectStorage, format *meta.Format) (object.ObjectStorage, error) {
 	if format.EncryptKey != "" {
 		passphrase := os.Getenv("JFS_RSA_PASSPHRASE")
 		privKey, err := object.ParseRsaPrivateKeyFromPem(format.EncryptKey, passphrase)
@@ -72,6 +83,38 @@ func createStorage(format *meta.Format) (object.ObjectStorage, error) {
 	return blob, nil
 }
 
+func createStorage(format *meta.Format) (object.ObjectStorage, error) {
+	object.UserAgent = "JuiceFS-" + version.Version()
+	blob, err := newStorage(format, format.Storage, format.Bucket, format.AccessKey, format.SecretKey)
+	if err != nil {
+		return nil, err
+	}
+	return encryptStorage(blob, format)
+}
+
+// createReplicatedStorage creates the object storage which replicates all the changes
+// into the replica in format (if any), the encrypted objects are replicated as they are.
+// The requests can be served by the replica if failover is enabled.
+func createReplicatedStorage(format *meta.Format, queue object.ReplicationQueue, failover, failoverWrite bool) (object.ObjectStorage, error) {
+	if format.ReplicaStorage == "" {
+		return createStorage(format)
+	}
+	object.UserAgent = "JuiceFS-" + version.Version()
+	primary, err := newStorage(format, format.Storage, format.Bucket, format.AccessKey, format.SecretKey)
+	if err != nil {
+		return nil, err
+	}
+	replica, err := newStorage(format, format.ReplicaStorage, format.ReplicaBucket, format.ReplicaAccessKey, format.ReplicaSecretKey)
+	if err != nil {
+		return nil, fmt.Errorf("replica: %s", err)
+	}
+	blob := object.WithReplica(primary, replica, queue, 10)
+	if failover || failoverWrite {
+		blob = object.WithFailover(blob, replica, queue, failoverWrite)
+	}
+	return encryptStorage(blob, format)
+}
+
 var letters = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789")
 
 func randSeq(n int) string {
@@ -84,6 +127,9 @@ func randSeq(n int) string {
 
 func doTesting(store object.ObjectStorage, key string, data []byte) error {
 	if err := store.Put(key, bytes.NewReader(data)); err != nil {
+		if err == object.ErrReadOnly {
+			return err
+		}
 		if strings.Contains(err.Error(), "Access Denied") {
 			return fmt.Errorf("Failed to put: %s", err)
 		}
@@ -127,11 +173,112 @@ func test(store object.ObjectStorage) error {
 		if err == nil {
 			return nil
 		}
+		if err == object.ErrReadOnly {
+			logger.Warnf("%s is read-only, skip testing", store)
+			return nil
+		}
 		time.Sleep(time.Second * time.Duration(i*3+1))
 	}
 	return err
 }
 
+// the UUID of volume is kept in the bucket by format, to make sure that the metadata and
+// the data belong to the same volume
+const uuidKey = "juicefs_uuid"
+
+// writeUUID writes the UUID in plain text, so it can be read without the encryption key.
+func writeUUID(format *meta.Format) error {
+	blob, err := newStorage(format, format.Storage, format.Bucket, format.AccessKey, format.SecretKey)
+	if err != nil {
+		return err
+	}
+	return blob.Put(uuidKey, bytes.NewReader([]byte(format.UUID)))
+}
+
+// readUUID returns the UUID kept in the bucket, or an empty string if it's not found.
+func readUUID(blob object.ObjectStorage) (string, error) {
+	r, err := blob.Get(uuidKey, 0, -1)
+	if err == nil {
+		data, err := ioutil.ReadAll(io.LimitReader(r, 1<<10))
+		_ = r.Close()
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(data)), nil
+	}
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	// the errors of missing objects are different in object storages, so check it by listing
+	if objs, err2 := blob.List(uuidKey, "", 1); err2 == nil && (len(objs) == 0 || objs[0].Key() != uuidKey) {
+		return "", nil
+	}
+	return "", err
+}
+
+// checkUUID verifies that the bucket is used by the volume, the mismatched pairs are refused
+// since they would overwrite or delete the objects of another volume. The UUID is written if
+// it's not found (formatted by older versions) and the storage is writable.
+func checkUUID(format *meta.Format, writable bool) error {
+	blob, err := newStorage(format, format.Storage, format.Bucket, format.AccessKey, format.SecretKey)
+	if err != nil {
+		return err
+	}
+	id, err := readUUID(blob)
+	if err != nil {
+		logger.Warnf("Can't check the UUID of volume in %s: %s", blob, err)
+		return nil
+	}
+	if id != "" && id != format.UUID {
+		return fmt.Errorf("%s belongs to volume %s, but the UUID of %s is %s", blob, id, format.Name, format.UUID)
+	}
+	if id == "" && writable {
+		if err = blob.Put(uuidKey, bytes.NewReader([]byte(format.UUID))); err != nil {
+			logger.Warnf("Write the UUID of volume into %s: %s", blob, err)
+		}
+	}
+	return nil
+}
+
+// formatDryRun prints the settings to be changed by format, nothing is written into
+// the metadata engine or the bucket.
+func formatDryRun(old, format *meta.Format, force bool) {
+	if old == nil {
+		f := *format
+		f.RemoveSecret()
+		fmt.Printf("Volume %s would be formatted as %+v\n", f.Name, f)
+	} else {
+		if !force {
+			format.UUID = old.UUID
+		}
+		changes := old.Diff(format)
+		if len(changes) == 0 {
+			fmt.Printf("No setting of volume %s would be changed\n", old.Name)
+		}
+		var unsafe []string
+		for _, ch := range changes {
+			note := "applied online"
+			if ch.Restart {
+				note = "applied after the clients are restarted"
+			} else if ch.Unsafe {
+				note = "unsafe, the existing files may become unreadable"
+				unsafe = append(unsafe, ch.Name)
+			}
+			fmt.Printf("%-18s %v -> %v (%s)\n", ch.Name, ch.Old, ch.New, note)
+		}
+		if len(unsafe) > 0 && !force {
+			fmt.Printf("%s can't be changed with --adopt, they're overwritten only with --force\n", strings.Join(unsafe, ", "))
+		}
+	}
+	if plain, err := newStorage(format, format.Storage, format.Bucket, format.AccessKey, format.SecretKey); err != nil {
+		fmt.Printf("Object storage is not available: %s\n", err)
+	} else if id, err := readUUID(plain); err != nil {
+		fmt.Printf("Can't check the UUID of volume in %s: %s\n", plain, err)
+	} else if id != "" && id != format.UUID && !force {
+		fmt.Printf("%s is used by volume %s, it's used anyway only with --force\n", plain, id)
+	}
+}
+
 func format(c *cli.Context) error {
 	setLoggerLevel(c)
 	if c.Args().Len() < 1 {
@@ -142,8 +289,12 @@ func format(c *cli.Context) error {
 		addr = "redis://" + addr
 	}
 	logger.Infof("Meta address: %s", addr)
-	var rc = meta.RedisConfig{Retries: 2}
-	m, err := meta.NewRedisMeta(addr, &rc)
+	// the read-write token of existing volume is required to change its tokens
+	var rc = meta.RedisConfig{Retries: 2, Token: c.String("current-token")}
+	if rc.Token == "" {
+		rc.Token = os.Getenv("JFS_TOKEN")
+	}
+	m, err := meta.NewClient(addr, &rc)
 	if err != nil {
 		logger.Fatalf("Meta is not available: %s", err)
 	}
@@ -170,6 +321,43 @@ func format(c *cli.Context) error {
 		SecretKey:   c.String("secret-key"),
 		BlockSize:   fixObjectSize(c.Int("block-size")),
 		Compression: c.String("compress"),
+		PackSize:    c.Int("pack-size"),
+		InlineSize:  c.Int("inline-size"),
+		Dedup:       c.Bool("dedup"),
+		Capacity:    c.Uint64("capacity") << 30,
+
+		MaxNameLength: c.Int("max-name-length"),
+		UTF8Names:     c.Bool("utf8-names"),
+		WindowsNames:  c.Bool("windows-names"),
+
+		CaseInsensitive: c.Bool("case-insensitive"),
+		NameIndex:       c.Bool("name-index"),
+		DirShards:       c.Bool("dir-shards"),
+		VersionDays:     c.Int("version-days"),
+		MetaVersion:     meta.MetaVersion,
+
+		ReplicaStorage:   c.String("replica-storage"),
+		ReplicaBucket:    c.String("replica-bucket"),
+		ReplicaAccessKey: c.String("replica-access-key"),
+		ReplicaSecretKey: c.String("replica-secret-key"),
+		KeyEncrypted:     c.Bool("encrypt-secret"),
+
+		TokenHash:         meta.HashToken(c.String("token")),
+		ReadOnlyTokenHash: meta.HashToken(c.String("read-only-token")),
+		AllowedNetworks:   c.StringSlice("allowed-networks"),
+	}
+	format.SetFeatures()
+	if format.PackSize >= format.BlockSize {
+		logger.Fatalf("pack size (%d KiB) should be smaller than block size (%d KiB)", format.PackSize, format.BlockSize)
+	}
+	if format.MaxNameLength < 0 || format.MaxNameLength > 255 {
+		logger.Fatalf("max name length (%d) should be between 0 and 255 bytes", format.MaxNameLength)
+	}
+	if format.InlineSize < 0 || format.InlineSize > maxInlineSize {
+		logger.Fatalf("inline size (%d) should be between 0 and %d bytes", format.InlineSize, maxInlineSize)
+	}
+	if _, err := meta.ParseNetworks(format.AllowedNetworks); err != nil {
+		logger.Fatalf("allowed networks: %s", err)
 	}
 	if format.AccessKey == "" && os.Getenv("ACCESS_KEY") != "" {
 		format.AccessKey = os.Getenv("ACCESS_KEY")
@@ -183,6 +371,13 @@ func format(c *cli.Context) error {
 	if format.Storage == "file" && !strings.HasSuffix(format.Bucket, "/") {
 		format.Bucket += "/"
 	}
+	if format.ReplicaStorage == "file" && !strings.HasSuffix(format.ReplicaBucket, "/") {
+		format.ReplicaBucket += "/"
+	}
+
+	if format.KeyEncrypted && os.Getenv("JFS_META_PASSPHRASE") == "" {
+		logger.Fatalf("JFS_META_PASSPHRASE is required to encrypt the secret keys")
+	}
 
 	keyPath := c.String("encrypt-rsa-key")
 	if keyPath != "" {
@@ -193,6 +388,50 @@ func format(c *cli.Context) error {
 		format.EncryptKey = string(pem)
 	}
 
+	force, adopt := c.Bool("force"), c.Bool("adopt")
+	if force && adopt {
+		logger.Fatalf("--force and --adopt can't be used together")
+	}
+	old, err := m.Load()
+	if err != nil {
+		if err != meta.ErrNoVolume && !force {
+			logger.Fatalf("load existing format: %s, use --force to overwrite it", err)
+		}
+		old = nil
+	} else {
+		// the tokens are kept unless they're given explicitly, an empty one removes it
+		if !c.IsSet("token") {
+			format.TokenHash = old.TokenHash
+		}
+		if !c.IsSet("read-only-token") {
+			format.ReadOnlyTokenHash = old.ReadOnlyTokenHash
+		}
+		// the existing files are not upgraded, the features are recorded by the upgrade to version 2
+		format.MetaVersion = old.MetaVersion
+		format.Features, format.WriteFeatures = old.Features, old.WriteFeatures
+		if old.MetaVersion >= 2 {
+			format.SetFeatures()
+		}
+	}
+	if format.DirShards && format.MetaVersion < meta.ShardsVersion {
+		logger.Fatalf("Directory shards need the metadata of version %d, run upgrade-meta first", meta.ShardsVersion)
+	}
+	if c.Bool("dry-run") {
+		formatDryRun(old, &format, force)
+		return nil
+	}
+	if old != nil {
+		switch {
+		case adopt:
+			logger.Infof("Adopt existing volume %s (%s)", old.Name, old.UUID)
+			format.UUID = old.UUID
+		case force:
+			logger.Warnf("Existing volume %s (%s) will be overwritten, the files in it (and the root directory) are kept, but their data is lost if the bucket is changed", old.Name, old.UUID)
+		default:
+			logger.Fatalf("Volume %s (%s) is already formatted in %s, use --adopt to keep it and update the credentials, tokens, capacity or name policies, or --force to overwrite it", old.Name, old.UUID, addr)
+		}
+	}
+
 	blob, err := createStorage(&format)
 	if err != nil {
 		logger.Fatalf("object storage: %s", err)
@@ -201,17 +440,33 @@ func format(c *cli.Context) error {
 	if err := test(blob); err != nil {
 		logger.Fatalf("Storage %s is not configured correctly: %s", blob, err)
 	}
+	// the bucket may have the data of another volume
+	if plain, err := newStorage(&format, format.Storage, format.Bucket, format.AccessKey, format.SecretKey); err == nil {
+		if id, err := readUUID(plain); err != nil {
+			logger.Warnf("Can't check the UUID of volume in %s: %s", plain, err)
+		} else if id != "" && id != format.UUID && !force {
+			logger.Fatalf("%s is used by volume %s, use --force to format it anyway, the objects of the old volume will be overwritten or removed by gc", plain, id)
+		}
+	}
+	if format.ReplicaStorage != "" {
+		replica, err := newStorage(&format, format.ReplicaStorage, format.ReplicaBucket, format.ReplicaAccessKey, format.ReplicaSecretKey)
+		if err != nil {
+			logger.Fatalf("replica: %s", err)
+		}
+		logger.Infof("Data are replicated to %s", replica)
+		if err := test(replica); err != nil {
+			logger.Fatalf("Replica %s is not configured correctly: %s", replica, err)
+		}
+	}
 
-	err = m.Init(format, c.Bool("force"))
+	err = m.Init(format, force)
 	if err != nil {
 		logger.Fatalf("format: %s", err)
 	}
-	if format.SecretKey != "" {
-		format.SecretKey = "removed"
-	}
-	if format.EncryptKey != "" {
-		format.EncryptKey = "removed"
+	if err = writeUUID(&format); err != nil && err != object.ErrReadOnly {
+		logger.Fatalf("write UUID into %s: %s", blob, err)
 	}
+	format.RemoveSecret()
 	logger.Infof("Volume is formatted as %+v", format)
 	return nil
 }
@@ -240,11 +495,23 @@ func formatFlags() *cli.Command {
 				Value: 4096,
 				Usage: "size of block in KiB",
 			},
+			&cli.IntFlag{
+				Name:  "pack-size",
+				Usage: "pack files smaller than this size (in KiB) into shared objects, 0 means disabled",
+			},
+			&cli.IntFlag{
+				Name:  "inline-size",
+				Usage: "store data of files not larger than this size (in bytes) in meta, 0 means disabled",
+			},
 			&cli.StringFlag{
 				Name:  "compress",
 				Value: "lz4",
 				Usage: "compression algorithm (lz4, zstd, none)",
 			},
+			&cli.BoolFlag{
+				Name:  "dedup",
+				Usage: "store the blocks with the same content once, it can't be changed later",
+			},
 			&cli.StringFlag{
 				Name:  "storage",
 				Value: "file",
@@ -263,14 +530,90 @@ func formatFlags() *cli.Command {
 				Name:  "secret-key",
 				Usage: "Secret key for object storage (env SECRET_KEY)",
 			},
+			&cli.StringFlag{
+				Name:  "replica-storage",
+				Usage: "Object storage type of the replica, which all the blocks are replicated to",
+			},
+			&cli.StringFlag{
+				Name:  "replica-bucket",
+				Usage: "A bucket URL to store the replicated data",
+			},
+			&cli.StringFlag{
+				Name:  "replica-access-key",
+				Usage: "Access key for the replica",
+			},
+			&cli.StringFlag{
+				Name:  "replica-secret-key",
+				Usage: "Secret key for the replica",
+			},
 			&cli.StringFlag{
 				Name:  "encrypt-rsa-key",
 				Usage: "A path to RSA private key (PEM)",
 			},
+			&cli.Uint64Flag{
+				Name:  "capacity",
+				Usage: "the limit for space in GiB, 0 means unlimited",
+			},
+			&cli.BoolFlag{
+				Name:  "encrypt-secret",
+				Usage: "encrypt the secret keys in meta with the passphrase in JFS_META_PASSPHRASE",
+			},
+			&cli.StringFlag{
+				Name:  "token",
+				Usage: "token required by clients to read and write the volume",
+			},
+			&cli.StringFlag{
+				Name:  "read-only-token",
+				Usage: "token for clients which can only read the volume",
+			},
+			&cli.StringFlag{
+				Name:  "current-token",
+				Usage: "read-write token of the existing volume (or JFS_TOKEN), required to change its tokens",
+			},
+			&cli.StringSliceFlag{
+				Name:  "allowed-networks",
+				Usage: "CIDR of the clients which can mount the volume, checked against the address seen by Redis (not supported by other engines), any client is allowed if not set",
+			},
+			&cli.IntFlag{
+				Name:  "max-name-length",
+				Usage: "max bytes of new file names (up to 255), 0 means 255",
+			},
+			&cli.BoolFlag{
+				Name:  "utf8-names",
+				Usage: "reject new file names which are not valid UTF-8",
+			},
+			&cli.BoolFlag{
+				Name:  "windows-names",
+				Usage: "reject new file names which are invalid on Windows",
+			},
+			&cli.BoolFlag{
+				Name:  "case-insensitive",
+				Usage: "make file names case-insensitive (with Unicode case folding) but case-preserving, it can't be changed later",
+			},
+			&cli.BoolFlag{
+				Name:  "name-index",
+				Usage: "maintain an index of all the names for find, it can't be changed later",
+			},
+			&cli.BoolFlag{
+				Name:  "dir-shards",
+				Usage: "split the entries of huge directories into multiple hashes (Redis only), the clients without this feature can't mount the volume",
+			},
+			&cli.IntFlag{
+				Name:  "version-days",
+				Usage: "days to keep the previous versions of overwritten or removed files in .jfs-versions, 0 means not kept",
+			},
 
 			&cli.BoolFlag{
 				Name:  "force",
-				Usage: "overwrite existing format",
+				Usage: "overwrite existing format, or use a bucket with the data of another volume",
+			},
+			&cli.BoolFlag{
+				Name:  "dry-run",
+				Usage: "print the settings to be changed without formatting",
+			},
+			&cli.BoolFlag{
+				Name:  "adopt",
+				Usage: "keep existing volume and update the credentials, tokens, capacity or name policies of it",
 			},
 		},
 		Action: format,
@@ -15,7 +15,14 @@
 
 package main
 
-import "testing"
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/juicedata/juicefs/pkg/meta"
+)
 
 func TestFixObjectSize(t *testing.T) {
 	t.Run("Should make sure the size is in range", func(t *testing.T) {
@@ -48,3 +55,45 @@ func TestFixObjectSize(t *testing.T) {
 		}
 	})
 }
+
+func TestCheckUUID(t *testing.T) {
+	dir, err := ioutil.TempDir("", "uuid")
+	if err != nil {
+		t.Fatalf("temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	format := &meta.Format{Name: "test", UUID: "uuid-1", Storage: "file", Bucket: dir + "/"}
+
+	// formatted by older versions
+	if err := checkUUID(format, false); err != nil {
+		t.Fatalf("check missing UUID: %s", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "test", uuidKey)); !os.IsNotExist(err) {
+		t.Fatalf("UUID should not be written for read-only client: %v", err)
+	}
+	if err := checkUUID(format, true); err != nil {
+		t.Fatalf("check missing UUID: %s", err)
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(dir, "test", uuidKey)); err != nil || string(data) != "uuid-1" {
+		t.Fatalf("UUID should be written: %q %v", data, err)
+	}
+	if err := checkUUID(format, false); err != nil {
+		t.Fatalf("check UUID: %s", err)
+	}
+
+	// reformatted with the same name
+	other := *format
+	other.UUID = "uuid-2"
+	if err := checkUUID(&other, true); err == nil {
+		t.Fatalf("the bucket of another volume should be refused")
+	}
+	if err := writeUUID(&other); err != nil {
+		t.Fatalf("write UUID: %s", err)
+	}
+	if err := checkUUID(&other, false); err != nil {
+		t.Fatalf("check UUID: %s", err)
+	}
+	if err := checkUUID(format, true); err == nil {
+		t.Fatalf("the old metadata should be refused")
+	}
+}
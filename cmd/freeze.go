@@ -0,0 +1,106 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"syscall"
+
+	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/juicedata/juicefs/pkg/utils"
+	"github.com/juicedata/juicefs/pkg/vfs"
+	"github.com/urfave/cli/v2"
+)
+
+func freezeFlags() *cli.Command {
+	return &cli.Command{
+		Name:      "freeze",
+		Usage:     "block the modifications of a mount point to take consistent backups",
+		ArgsUsage: "MOUNTPOINT",
+		Action:    freeze,
+		Flags: []cli.Flag{
+			&cli.BoolFlag{
+				Name:  "unfreeze",
+				Usage: "resume the modifications",
+			},
+			&cli.UintFlag{
+				Name:  "timeout",
+				Value: 600,
+				Usage: "number of seconds to unfreeze automatically, 0 means never",
+			},
+		},
+		Description: `
+Like fsfreeze, the modifications of the mount point wait until it's unfrozen, and the
+buffered data of all files is flushed before it returns, so a consistent backup or
+snapshot of the applications on it can be taken. The reads are not blocked. It's
+unfrozen automatically after the timeout, in case the backup job is gone.
+
+Examples:
+$ juicefs freeze /jfs
+$ juicefs freeze --unfreeze /jfs`,
+	}
+}
+
+func freeze(ctx *cli.Context) error {
+	setLoggerLevel(ctx)
+	if ctx.Args().Len() < 1 {
+		return fmt.Errorf("MOUNTPOINT is needed")
+	}
+	mp := ctx.Args().Get(0)
+	f := openControler(mp)
+	if f == nil {
+		return fmt.Errorf("%s is not inside JuiceFS", mp)
+	}
+	defer f.Close()
+	var op uint8 = 1
+	if ctx.Bool("unfreeze") {
+		op = 0
+	}
+	wb := utils.NewBuffer(8 + 1 + 4)
+	wb.Put32(meta.Freeze)
+	wb.Put32(1 + 4)
+	wb.Put8(op)
+	wb.Put32(uint32(ctx.Uint("timeout")))
+	if _, err := f.Write(wb.Bytes()); err != nil {
+		return fmt.Errorf("write message: %s", err)
+	}
+	data, err := ioutil.ReadAll(f)
+	if err != nil && err != io.EOF || len(data) == 0 {
+		return fmt.Errorf("read message: %d %s", len(data), err)
+	}
+	if data[0] != 0 {
+		if len(data) > 1 {
+			return fmt.Errorf("%s: %s", syscall.Errno(data[0]), data[1:])
+		}
+		return fmt.Errorf("%s", syscall.Errno(data[0]))
+	}
+	var st vfs.FreezeState
+	if err = json.Unmarshal(data[1:], &st); err != nil {
+		return fmt.Errorf("decode %q: %s", data[1:], err)
+	}
+	switch {
+	case !st.Frozen:
+		fmt.Fprintf(ctx.App.Writer, "%s is unfrozen\n", mp)
+	case st.Deadline.IsZero():
+		fmt.Fprintf(ctx.App.Writer, "%s is frozen until unfrozen\n", mp)
+	default:
+		fmt.Fprintf(ctx.App.Writer, "%s is frozen until %s\n", mp, st.Deadline.Format("2006-01-02 15:04:05"))
+	}
+	return nil
+}
@@ -17,6 +17,8 @@ package main
 
 import (
 	"fmt"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -33,6 +35,17 @@ func checkFlags() *cli.Command {
 		Usage:     "Check consistency of file system",
 		ArgsUsage: "REDIS-URL",
 		Action:    fsck,
+		Flags: []cli.Flag{
+			&cli.IntFlag{
+				Name:  "list-threads",
+				Value: 10,
+				Usage: "number of threads to list the objects in parallel",
+			},
+			&cli.BoolFlag{
+				Name:  "restart",
+				Usage: "start over instead of resuming from the checkpoint of the interrupted run",
+			},
+		},
 	}
 }
 
@@ -48,7 +61,7 @@ func fsck(ctx *cli.Context) error {
 
 	logger.Infof("Meta address: %s", addr)
 	var rc = meta.RedisConfig{Retries: 10, Strict: true}
-	m, err := meta.NewRedisMeta(addr, &rc)
+	m, err := meta.NewClient(addr, &rc)
 	if err != nil {
 		logger.Fatalf("Meta: %s", err)
 	}
@@ -58,8 +71,12 @@ func fsck(ctx *cli.Context) error {
 	}
 
 	chunkConf := chunk.Config{
-		BlockSize: format.BlockSize * 1024,
-		Compress:  format.Compression,
+		BlockSize:  format.BlockSize * 1024,
+		Compress:   format.Compression,
+		PackSize:   format.PackSize << 10,
+		Partitions: format.Partitions,
+		Dedup:      format.Dedup,
+		DedupIndex: m,
 
 		GetTimeout: time.Second * 60,
 		PutTimeout: time.Second * 60,
@@ -75,33 +92,10 @@ func fsck(ctx *cli.Context) error {
 		logger.Fatalf("object storage: %s", err)
 	}
 	logger.Infof("Data use %s", blob)
-
-	logger.Infof("Listing all blocks ...")
-	blob = object.WithPrefix(blob, "chunks/")
-	objs, err := osync.ListAll(blob, "", "")
+	external, err := createExternalStorage(format)
 	if err != nil {
-		logger.Fatalf("list all blocks: %s", err)
-	}
-	var blocks = make(map[string]int64)
-	var totalBlockBytes int64
-	for obj := range objs {
-		if obj == nil {
-			break // failed listing
-		}
-		if obj.IsDir() {
-			continue
-		}
-
-		logger.Debugf("found block %s", obj.Key())
-		parts := strings.Split(obj.Key(), "/")
-		if len(parts) != 3 {
-			continue
-		}
-		name := parts[2]
-		blocks[name] = obj.Size()
-		totalBlockBytes += obj.Size()
+		logger.Fatalf("object storage: %s", err)
 	}
-	logger.Infof("Found %d blocks (%d bytes)", len(blocks), totalBlockBytes)
 
 	logger.Infof("Listing all slices ...")
 	var c = meta.NewContext(0, 0, []uint32{0})
@@ -110,28 +104,121 @@ func fsck(ctx *cli.Context) error {
 	if r != 0 {
 		logger.Fatalf("list all slices: %s", r)
 	}
+	cp := resumeScan(m, "fsck", "", ctx.Bool("restart"))
 	keys := make(map[uint64]uint32)
 	var totalBytes uint64
 	var lost, lostBytes int
+	var expected []string // the blocks after the cursor, in the order of listing
 	for _, s := range slices {
 		keys[s.Chunkid] = s.Size
 		totalBytes += uint64(s.Size)
-		n := (s.Size - 1) / uint32(chunkConf.BlockSize)
-		for i := uint32(0); i <= n; i++ {
-			sz := chunkConf.BlockSize
-			if i == n {
-				sz = int(s.Size) - int(i)*chunkConf.BlockSize
+		if s.Chunkid&chunk.ExternalChunk != 0 {
+			key, _, err := m.LookupExternal(s.Chunkid)
+			if err != nil {
+				logger.Fatalf("lookup imported chunk %d: %s", s.Chunkid, err)
+			}
+			if key == "" {
+				err = fmt.Errorf("not imported")
+			} else {
+				_, err = external.Head(key)
+			}
+			if err != nil {
+				logger.Errorf("can't find object %q of chunk %d: %s", key, s.Chunkid, err)
+				lost++
+				lostBytes += int(s.Size)
+			}
+			continue
+		}
+		if int(s.Size) <= chunkConf.PackSize {
+			pack, _, _, err := m.LookupPack(s.Chunkid)
+			if err != nil {
+				logger.Fatalf("lookup packed block %d: %s", s.Chunkid, err)
+			}
+			if pack > 0 {
+				continue
+			}
+		}
+		blocks, _ := chunk.ObjectKeys(&chunkConf, s.Chunkid, int(s.Size))
+		for _, key := range blocks {
+			if key = strings.TrimPrefix(key, "chunks/"); key > cp.Cursor {
+				expected = append(expected, key)
+			}
+		}
+	}
+	sort.Strings(expected)
+	uniq := expected[:0] // the blocks could be shared by cloned files
+	for _, key := range expected {
+		if len(uniq) == 0 || key != uniq[len(uniq)-1] {
+			uniq = append(uniq, key)
+		}
+	}
+	expected = uniq
+
+	logger.Infof("Listing all blocks ...")
+	blob = object.WithPrefix(blob, "chunks/")
+	objs, err := osync.ListAllParallel(blob, cp.Cursor, "", ctx.Int("list-threads"))
+	if err != nil {
+		logger.Fatalf("list all blocks: %s", err)
+	}
+	// the blocks are compared with the listed objects in order, the missing ones are checked again
+	var i int
+	checkUpTo := func(key string) {
+		for ; i < len(expected) && (key == "" || expected[i] < key); i++ {
+			if _, err := blob.Head(expected[i]); err != nil {
+				logger.Debugf("block %s is missing: %s", expected[i], err)
+				cp.Keys = append(cp.Keys, expected[i])
+			}
+		}
+		if i < len(expected) && expected[i] == key {
+			i++
+		}
+	}
+	var totalBlocks, totalBlockBytes = cp.Stats["blocks"], cp.Stats["blockBytes"]
+	flush := func() {
+		cp.Stats["blocks"], cp.Stats["blockBytes"] = totalBlocks, totalBlockBytes
+	}
+	for obj := range objs {
+		if obj == nil {
+			break // failed listing, the left blocks are checked one by one
+		}
+		if obj.IsDir() || obj.Key() <= cp.Cursor {
+			continue
+		}
+		cp.save(false, flush) // all the blocks before this one are checked
+		cp.Cursor = obj.Key()
+		logger.Debugf("found block %s", obj.Key())
+		checkUpTo(obj.Key())
+		totalBlocks++
+		totalBlockBytes += obj.Size()
+	}
+	checkUpTo("")
+	logger.Infof("Found %d blocks (%d bytes)", totalBlocks, totalBlockBytes)
+
+	// the blocks could be removed together with the files during checking
+	if len(cp.Keys) > 0 {
+		slices = nil
+		if r = m.ListSlices(c, &slices); r != 0 {
+			logger.Fatalf("list all slices: %s", r)
+		}
+		used := make(map[uint64]bool, len(slices))
+		for _, s := range slices {
+			used[s.Chunkid] = true
+		}
+		for _, key := range cp.Keys {
+			parts := strings.Split(key[strings.LastIndex(key, "/")+1:], "_")
+			if len(parts) != 3 {
+				continue
 			}
-			key := fmt.Sprintf("%d_%d_%d", s.Chunkid, i, sz)
-			if _, ok := blocks[key]; !ok {
-				if _, err := blob.Head(key); err != nil {
-					logger.Errorf("can't find block %s: %s", key, err)
-					lost++
-					lostBytes += sz
-				}
+			cid, _ := strconv.ParseUint(parts[0], 10, 64)
+			sz, _ := strconv.Atoi(parts[2])
+			if used[cid] {
+				logger.Errorf("can't find block %s", key)
+				lost++
+				lostBytes += sz
 			}
 		}
 	}
+	cp.done()
 	logger.Infof("Used by %d slices (%d bytes)", len(keys), totalBytes)
 	if lost > 0 {
 		logger.Fatalf("%d object is lost (%d bytes)", lost, lostBytes)
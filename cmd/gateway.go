@@ -16,8 +16,11 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
 	"fmt"
+	"hash"
 	"io"
+	"mime"
 	"path/filepath"
 
 	"net/http"
@@ -32,6 +35,7 @@ import (
 	"time"
 
 	"github.com/juicedata/juicefs/pkg/chunk"
+	"github.com/juicedata/juicefs/pkg/event"
 	"github.com/juicedata/juicefs/pkg/fs"
 	"github.com/juicedata/juicefs/pkg/meta"
 	"github.com/juicedata/juicefs/pkg/object"
@@ -67,6 +71,23 @@ func gatewayFlags() *cli.Command {
 		&cli.BoolFlag{
 			Name:  "no-banner",
 			Usage: "disable MinIO startup information",
+		},
+		&cli.Float64Flag{
+			Name:  "upload-expiry",
+			Value: 168,
+			Usage: "hours to keep incomplete multipart uploads and temporary files before they are removed (0 means forever)",
+		},
+		&cli.BoolFlag{
+			Name:  "multi-user",
+			Usage: "serve the users managed by 'juicefs gateway-user' besides the root user",
+		},
+		&cli.BoolFlag{
+			Name:  "checksum",
+			Usage: "compute the SHA256 of uploaded objects, which is used in ETag and kept in xattr juicefs.checksum",
+		},
+		&cli.StringSliceFlag{
+			Name:  "event-target",
+			Usage: "send the events of objects to a webhook (http://), Kafka (kafka://) or Redis stream (redis://)",
 		})
 	return &cli.Command{
 		Name:      "gateway",
@@ -90,7 +111,16 @@ func gateway(c *cli.Context) error {
 		logger.Fatalf("Redis URL and listen address are required")
 	}
 	address := c.Args().Get(1)
-	gw = &GateWay{c}
+	gw = &GateWay{ctx: c}
+	if c.Bool("multi-user") {
+		// MinIO listens on loopback behind the proxy for users
+		internal, err := freeAddress()
+		if err != nil {
+			logger.Fatalf("find a free port: %s", err)
+		}
+		gw.address, gw.upstream = address, internal
+		address = internal
+	}
 
 	args := []string{"gateway", "--address", address, "--anonymous"}
 	if c.Bool("no-banner") {
@@ -129,7 +159,9 @@ func gateway2(ctx *mcli.Context) error {
 }
 
 type GateWay struct {
-	ctx *cli.Context
+	ctx      *cli.Context
+	address  string // serve the users of gateway at this address if it's not empty
+	upstream string // address of MinIO behind the proxy
 }
 
 func (g *GateWay) Name() string {
@@ -148,9 +180,23 @@ func (g *GateWay) NewGatewayLayer(creds auth.Credentials) (minio.ObjectLayer, er
 	if !strings.Contains(redisAddr, "://") {
 		redisAddr = "redis://" + redisAddr
 	}
+	setupJobs(c)
+	setupQoS(c)
+	setupHTTP(c)
 	logger.Infof("Meta address: %s", redisAddr)
-	var rc = meta.RedisConfig{Retries: 10, Strict: true}
-	m, err := meta.NewRedisMeta(redisAddr, &rc)
+	var rc = meta.RedisConfig{
+		Retries:      10,
+		Strict:       true,
+		ReadReplica:  c.String("read-replica"),
+		MaxStaleness: time.Duration(c.Float64("max-staleness") * float64(time.Second)),
+		Token:        clientToken(c),
+		Heartbeat:    time.Duration(c.Int("heartbeat")) * time.Second,
+		Grace:        time.Duration(c.Float64("meta-grace") * float64(time.Second)),
+		ReadOnly:     c.Bool("cache-only"),
+		NoBGJob:      noBGJob(c),
+		HotCache:     time.Duration(c.Float64("hot-cache") * float64(time.Second)),
+	}
+	m, err := meta.NewClient(redisAddr, &rc)
 	if err != nil {
 		logger.Fatalf("Meta: %s", err)
 	}
@@ -159,9 +205,16 @@ func (g *GateWay) NewGatewayLayer(creds auth.Credentials) (minio.ObjectLayer, er
 		logger.Fatalf("load setting: %s", err)
 	}
 
+	setupLimits(c)
 	chunkConf := chunk.Config{
-		BlockSize: format.BlockSize * 1024,
-		Compress:  format.Compression,
+		BlockSize:  format.BlockSize * 1024,
+		Compress:   format.Compression,
+		PackSize:   format.PackSize << 10,
+		PackIndex:  m,
+		Dedup:      format.Dedup,
+		DedupIndex: m,
+
+		ExternalIndex: m,
 
 		GetTimeout: time.Second * time.Duration(c.Int("get-timeout")),
 		PutTimeout: time.Second * time.Duration(c.Int("put-timeout")),
@@ -169,13 +222,30 @@ func (g *GateWay) NewGatewayLayer(creds auth.Credentials) (minio.ObjectLayer, er
 		Writeback:  c.Bool("writeback"),
 		Prefetch:   c.Int("prefetch"),
 		BufferSize: c.Int("buffer-size") << 20,
+		Multipart: object.MultipartConfig{
+			Threshold: c.Int("multipart-threshold") << 20,
+			PartSize:  c.Int("part-size") << 20,
+			Threads:   c.Int("part-threads"),
+		},
 
-		CacheDir:       c.String("cache-dir"),
-		CacheSize:      int64(c.Int("cache-size")),
-		FreeSpace:      float32(c.Float64("free-space-ratio")),
-		CacheMode:      os.FileMode(0600),
-		CacheFullBlock: !c.Bool("cache-partial-only"),
-		AutoCreate:     true,
+		CacheDir:        c.String("cache-dir"),
+		CacheSize:       int64(c.Int("cache-size")),
+		SharedCacheSize: int64(c.Int("shared-cache-size")),
+		PinSize:         int64(c.Int("pin-size")),
+		CacheEviction:   c.String("cache-eviction"),
+		CacheIO:         c.String("cache-io"),
+		CacheDirect:     c.Bool("cache-direct"),
+		FreeSpace:       float32(c.Float64("free-space-ratio")),
+		CacheMode:       os.FileMode(0600),
+		CacheFullBlock:  !c.Bool("cache-partial-only"),
+		DegradedRead:    c.Bool("degraded-read"),
+		AutoCreate:      true,
+	}
+	if err := chunk.CheckEvictPolicy(chunkConf.CacheEviction); err != nil {
+		logger.Fatalf("%s", err)
+	}
+	if err := chunk.CheckCacheIO(chunkConf.CacheIO); err != nil {
+		logger.Fatalf("%s", err)
 	}
 	if chunkConf.CacheDir != "memory" {
 		ds := utils.SplitDir(chunkConf.CacheDir)
@@ -184,12 +254,18 @@ func (g *GateWay) NewGatewayLayer(creds auth.Credentials) (minio.ObjectLayer, er
 		}
 		chunkConf.CacheDir = strings.Join(ds, string(os.PathListSeparator))
 	}
-	blob, err := createStorage(format)
+	blob, err := createReplicatedStorage(format, m, c.Bool("failover"), c.Bool("failover-write"))
 	if err != nil {
 		logger.Fatalf("object storage: %s", err)
 	}
 	logger.Infof("Data use %s", blob)
+	if err = checkUUID(format, !rc.ReadOnly); err != nil {
+		logger.Fatalf("check volume: %s", err)
+	}
 	blob = object.WithMetrics(blob)
+	if chunkConf.ExternalStorage, err = createExternalStorage(format); err != nil {
+		logger.Fatalf("object storage: %s", err)
+	}
 
 	store := chunk.NewCachedStore(blob, chunkConf)
 	m.OnMsg(meta.DeleteChunk, meta.MsgCallback(func(args ...interface{}) error {
@@ -215,6 +291,8 @@ func (g *GateWay) NewGatewayLayer(creds auth.Credentials) (minio.ObjectLayer, er
 		Version:   version.Version(),
 		AccessLog: c.String("access-log"),
 		Chunk:     &chunkConf,
+		// the buffered data can be committed when capacity is almost reached
+		CapacityGrace: uint64(c.Int("buffer-size")) << 20,
 	}
 
 	if !c.Bool("no-usage-report") {
@@ -225,7 +303,24 @@ func (g *GateWay) NewGatewayLayer(creds auth.Credentials) (minio.ObjectLayer, er
 	if err != nil {
 		logger.Fatalf("Initialize failed: %s", err)
 	}
-	return &jfsObjects{fs: jfs, conf: conf, listPool: minio.NewTreeWalkPool(time.Minute * 30)}, nil
+	if g.address != "" {
+		go serveUsers(m, creds, g.address, g.upstream)
+	}
+	jfsObj := &jfsObjects{fs: jfs, conf: conf, listPool: minio.NewTreeWalkPool(time.Minute * 30), checksum: c.Bool("checksum")}
+	if targets := c.StringSlice("event-target"); len(targets) > 0 {
+		if jfsObj.events, err = event.NewNotifier(format.Name, event.SourceGateway, targets); err != nil {
+			logger.Fatalf("event target: %s", err)
+		}
+	}
+	if expiry := time.Duration(c.Float64("upload-expiry") * float64(time.Hour)); expiry > 0 {
+		go func() {
+			for {
+				jfsObj.cleanupUploads(format.Name, expiry)
+				time.Sleep(time.Hour)
+			}
+		}()
+	}
+	return jfsObj, nil
 }
 
 type jfsObjects struct {
@@ -233,6 +328,15 @@ type jfsObjects struct {
 	conf     *vfs.Config
 	fs       *fs.FileSystem
 	listPool *minio.TreeWalkPool
+	events   *event.Notifier
+	checksum bool // compute the SHA256 of uploaded objects
+}
+
+// notify emits an event of the object if there are any targets.
+func (n *jfsObjects) notify(name, object string, size int64, etag string) {
+	if n.events != nil {
+		n.events.Notify(name, object, size, etag)
+	}
 }
 
 func (n *jfsObjects) IsCompressionSupported() bool {
@@ -539,6 +643,9 @@ func (n *jfsObjects) DeleteObject(ctx context.Context, bucket, object string, op
 			}
 			break
 		}
+		if p == n.path(bucket, object) {
+			n.notify(event.ObjectRemovedDelete, object, 0, "")
+		}
 		p = path.Dir(p)
 	}
 	return minio.ObjectInfo{}, nil
@@ -578,6 +685,9 @@ func (n *jfsObjects) GetObjectNInfo(ctx context.Context, bucket, object string,
 	if eno != 0 {
 		return nil, jfsToObjectErr(ctx, eno, bucket, object)
 	}
+	if rs != nil {
+		f.LimitRead(startOffset + length)
+	}
 	_, _ = f.Seek(mctx, startOffset, 0)
 	r := &io.LimitedReader{R: &fReader{f}, N: length}
 	closer := func() { _ = f.Close(mctx) }
@@ -594,7 +704,16 @@ func (n *jfsObjects) CopyObject(ctx context.Context, srcBucket, srcObject, dstBu
 	dst := n.path(dstBucket, dstObject)
 	src := n.path(srcBucket, srcObject)
 	if minio.IsStringEqual(src, dst) {
-		return n.GetObjectInfo(ctx, srcBucket, srcObject, minio.ObjectOptions{})
+		// the metadata is replaced
+		if t := userContentType(srcInfo.UserDefined); t != "" {
+			if eno := n.fs.SetXattr(mctx, src, contentTypeKey, []byte(t), 0); eno != 0 {
+				logger.Warnf("set content type of %s: %s", srcObject, eno)
+			}
+		}
+		if info, err = n.GetObjectInfo(ctx, srcBucket, srcObject, minio.ObjectOptions{}); err == nil {
+			n.notify(event.ObjectCreatedCopy, dstObject, info.Size, info.ETag)
+		}
+		return
 	}
 	tmp := n.tpath(dstBucket, "tmp", minio.MustGetUUID())
 	_ = n.mkdirAll(ctx, path.Dir(tmp), 0755)
@@ -611,6 +730,11 @@ func (n *jfsObjects) CopyObject(ctx context.Context, srcBucket, srcObject, dstBu
 		logger.Errorf("copy %s to %s: %s", src, tmp, err)
 		return
 	}
+	if t := userContentType(srcInfo.UserDefined); t != "" {
+		if eno = n.fs.SetXattr(mctx, tmp, contentTypeKey, []byte(t), 0); eno != 0 {
+			logger.Warnf("set content type of %s: %s", dstObject, eno)
+		}
+	}
 	eno = n.fs.Rename(mctx, tmp, dst)
 	if eno != 0 {
 		err = jfsToObjectErr(ctx, eno, srcBucket, srcObject)
@@ -622,14 +746,16 @@ func (n *jfsObjects) CopyObject(ctx context.Context, srcBucket, srcObject, dstBu
 		err = jfsToObjectErr(ctx, eno, dstBucket, dstObject)
 		return
 	}
+	n.notify(event.ObjectCreatedCopy, dstObject, fi.Size(), "")
 	return minio.ObjectInfo{
 		Bucket: dstBucket,
 		Name:   dstObject,
 		// ETag:    r.MD5CurrentHexString(),
-		ModTime: fi.ModTime(),
-		Size:    fi.Size(),
-		IsDir:   fi.IsDir(),
-		AccTime: fi.ModTime(),
+		ModTime:     fi.ModTime(),
+		Size:        fi.Size(),
+		IsDir:       fi.IsDir(),
+		AccTime:     fi.ModTime(),
+		ContentType: n.contentType(dst, fi),
 	}, nil
 }
 
@@ -696,15 +822,84 @@ func (n *jfsObjects) GetObjectInfo(ctx context.Context, bucket, object string, o
 		return
 	}
 	return minio.ObjectInfo{
-		Bucket:  bucket,
-		Name:    object,
-		ModTime: fi.ModTime(),
-		Size:    fi.Size(),
-		IsDir:   fi.IsDir(),
-		AccTime: fi.ModTime(),
+		Bucket:      bucket,
+		Name:        object,
+		ETag:        n.etag(n.path(bucket, object), fi),
+		ModTime:     fi.ModTime(),
+		Size:        fi.Size(),
+		IsDir:       fi.IsDir(),
+		AccTime:     fi.ModTime(),
+		ContentType: n.contentType(n.path(bucket, object), fi),
 	}, nil
 }
 
+// etag returns the SHA256 of an object kept in xattr, or the one made of the inode, mtime and
+// size of it, so it's changed after the object is modified. It contains '-' like the ETags of
+// multipart uploads, so the clients don't take it as MD5 of the content.
+func (n *jfsObjects) etag(p string, fi *fs.FileStat) string {
+	if fi.IsDir() {
+		return ""
+	}
+	if v, eno := n.fs.GetXattr(mctx, p, vfs.ChecksumXattr); eno == 0 && strings.HasPrefix(string(v), "sha256:") {
+		return strings.TrimPrefix(string(v), "sha256:") + "-1"
+	}
+	return fmt.Sprintf("%x-%x-%x", fi.Inode(), fi.ModTime().UnixNano(), fi.Size())
+}
+
+// The Content-Type given by PutObject is kept in an extended attribute, the one
+// of files written through POSIX is guessed by extension, or detected from the
+// first 512 bytes and cached together with the mtime it's detected for.
+const contentTypeKey = "s3-content-type"
+
+const detectedTypeKey = "s3-detected-type"
+
+// userContentType returns the Content-Type in the request, minio fills a
+// default one if it's missing, which is ignored.
+func userContentType(metadata map[string]string) string {
+	t := metadata["content-type"]
+	if t == "binary/octet-stream" {
+		return ""
+	}
+	return t
+}
+
+func (n *jfsObjects) contentType(p string, fi *fs.FileStat) string {
+	if fi.IsDir() {
+		return ""
+	}
+	if v, eno := n.fs.GetXattr(mctx, p, contentTypeKey); eno == 0 && len(v) > 0 {
+		return string(v)
+	}
+	if t := mime.TypeByExtension(path.Ext(p)); t != "" {
+		return t
+	}
+	if fi.Size() == 0 {
+		return ""
+	}
+	mtime := strconv.FormatInt(fi.Mtime(), 10)
+	if v, eno := n.fs.GetXattr(mctx, p, detectedTypeKey); eno == 0 {
+		if ps := strings.SplitN(string(v), " ", 2); len(ps) == 2 && ps[0] == mtime {
+			return ps[1]
+		}
+	}
+	f, eno := n.fs.Open(mctx, p, 0)
+	if eno != 0 {
+		return ""
+	}
+	defer func() { _ = f.Close(mctx) }()
+	buf := make([]byte, 512)
+	l, err := f.Pread(mctx, buf, 0)
+	if err != nil && err != io.EOF {
+		logger.Warnf("detect content type of %s: %s", p, err)
+		return ""
+	}
+	t := http.DetectContentType(buf[:l])
+	if eno = n.fs.SetXattr(mctx, p, detectedTypeKey, []byte(mtime+" "+t), 0); eno != 0 {
+		logger.Debugf("cache content type of %s: %s", p, eno)
+	}
+	return t
+}
+
 func (n *jfsObjects) mkdirAll(ctx context.Context, p string, mode os.FileMode) error {
 	if fi, eno := n.fs.Stat(mctx, p); eno == 0 {
 		if !fi.IsDir() {
@@ -738,6 +933,10 @@ func (n *jfsObjects) putObject(ctx context.Context, bucket, object string, r *mi
 		return
 	}
 	defer func() { _ = n.fs.Delete(mctx, tmpname) }()
+	var h hash.Hash
+	if n.checksum {
+		h = sha256.New()
+	}
 	var buf = buffPool.Get().(*[]byte)
 	defer buffPool.Put(buf)
 	for {
@@ -754,6 +953,9 @@ func (n *jfsObjects) putObject(ctx context.Context, bucket, object string, r *mi
 			err = eno
 			break
 		}
+		if h != nil {
+			_, _ = h.Write((*buf)[:n])
+		}
 	}
 	if err == nil {
 		eno = f.Close(mctx)
@@ -766,6 +968,16 @@ func (n *jfsObjects) putObject(ctx context.Context, bucket, object string, r *mi
 	if err != nil {
 		return
 	}
+	if h != nil {
+		if eno := n.fs.SaveChecksum(mctx, tmpname, h.Sum(nil)); eno != 0 {
+			logger.Warnf("save checksum of %s: %s", object, eno)
+		}
+	}
+	if t := userContentType(opts.UserDefined); t != "" {
+		if eno := n.fs.SetXattr(mctx, tmpname, contentTypeKey, []byte(t), 0); eno != 0 {
+			logger.Warnf("set content type of %s: %s", object, eno)
+		}
+	}
 	dir := path.Dir(object)
 	if dir != "" {
 		_ = n.mkdirAll(ctx, dir, os.FileMode(0755))
@@ -795,14 +1007,16 @@ func (n *jfsObjects) PutObject(ctx context.Context, bucket string, object string
 	if eno != 0 {
 		return objInfo, jfsToObjectErr(ctx, eno, bucket, object)
 	}
+	n.notify(event.ObjectCreatedPut, object, fi.Size(), r.MD5CurrentHexString())
 	return minio.ObjectInfo{
-		Bucket:  bucket,
-		Name:    object,
-		ETag:    r.MD5CurrentHexString(),
-		ModTime: fi.ModTime(),
-		Size:    fi.Size(),
-		IsDir:   fi.IsDir(),
-		AccTime: fi.ModTime(),
+		Bucket:      bucket,
+		Name:        object,
+		ETag:        r.MD5CurrentHexString(),
+		ModTime:     fi.ModTime(),
+		Size:        fi.Size(),
+		IsDir:       fi.IsDir(),
+		AccTime:     fi.ModTime(),
+		ContentType: n.contentType(p, fi),
 	}, nil
 }
 
@@ -814,17 +1028,73 @@ func (n *jfsObjects) NewMultipartUpload(ctx context.Context, bucket string, obje
 	p := n.upath(bucket, uploadID)
 	err = n.mkdirAll(ctx, p, os.FileMode(0755))
 	if err == nil {
-		eno := n.fs.SetXattr(mctx, p, "s3-object", []byte(object), 0)
+		eno := n.fs.SetXattr(mctx, p, uploadKeyName, []byte(object), 0)
 		if eno != 0 {
 			logger.Warnf("set object %s on upload %s: %s", object, uploadID, eno)
 		}
+		now := strconv.FormatInt(time.Now().UnixNano(), 10)
+		if eno = n.fs.SetXattr(mctx, p, uploadInitiated, []byte(now), 0); eno != 0 {
+			logger.Warnf("set initiated time on upload %s: %s", uploadID, eno)
+		}
+		if t := userContentType(opts.UserDefined); t != "" {
+			if eno = n.fs.SetXattr(mctx, p, contentTypeKey, []byte(t), 0); eno != 0 {
+				logger.Warnf("set content type on upload %s: %s", uploadID, eno)
+			}
+		}
 	}
 	return
 }
 
 const uploadKeyName = "s3-object"
+const uploadInitiated = "s3-initiated"
 const partEtag = "s3-etag"
 
+// initiated returns the time when an upload is initiated, which is recorded in
+// NewMultipartUpload, or the atime of the upload for the old ones.
+func (n *jfsObjects) initiated(bucket, uploadID string, attr *meta.Attr) time.Time {
+	if v, eno := n.fs.GetXattr(mctx, n.upath(bucket, uploadID), uploadInitiated); eno == 0 {
+		if ns, err := strconv.ParseInt(string(v), 10, 64); err == nil {
+			return time.Unix(0, ns)
+		}
+	}
+	return time.Unix(attr.Atime, int64(attr.Atimensec))
+}
+
+// cleanupUploads aborts the multipart uploads initiated before expiry, and
+// removes the temporary files which are not modified in expiry, which are
+// left by failed uploads.
+func (n *jfsObjects) cleanupUploads(bucket string, expiry time.Duration) {
+	deadline := time.Now().Add(-expiry)
+	for _, dir := range []string{"uploads", "tmp"} {
+		f, eno := n.fs.Open(mctx, n.tpath(bucket, dir), 0)
+		if eno != 0 {
+			continue
+		}
+		entries, eno := f.ReaddirPlus(mctx, 0)
+		_ = f.Close(mctx)
+		if eno != 0 {
+			logger.Warnf("list %s: %s", n.tpath(bucket, dir), eno)
+			continue
+		}
+		for _, e := range entries {
+			name := string(e.Name)
+			if dir == "uploads" {
+				if n.initiated(bucket, name, e.Attr).Before(deadline) {
+					logger.Infof("Abort expired upload %s", name)
+					if eno = n.fs.Rmr(mctx, n.upath(bucket, name)); eno != 0 && !fs.IsNotExist(eno) {
+						logger.Warnf("abort upload %s: %s", name, eno)
+					}
+				}
+			} else if time.Unix(e.Attr.Mtime, int64(e.Attr.Mtimensec)).Before(deadline) {
+				logger.Infof("Remove expired temporary file %s", name)
+				if eno = n.fs.Delete(mctx, n.tpath(bucket, dir, name)); eno != 0 && !fs.IsNotExist(eno) {
+					logger.Warnf("remove %s: %s", name, eno)
+				}
+			}
+		}
+	}
+}
+
 func (n *jfsObjects) ListMultipartUploads(ctx context.Context, bucket string, prefix string, keyMarker string, uploadIDMarker string, delimiter string, maxUploads int) (lmi minio.ListMultipartsInfo, err error) {
 	if err = n.checkBucket(ctx, bucket); err != nil {
 		return
@@ -852,7 +1122,7 @@ func (n *jfsObjects) ListMultipartUploads(ctx context.Context, bucket string, pr
 				lmi.Uploads = append(lmi.Uploads, minio.MultipartInfo{
 					Object:    object,
 					UploadID:  uploadID,
-					Initiated: time.Unix(int64(e.Attr.Atime), int64(e.Attr.Atimensec)),
+					Initiated: n.initiated(bucket, uploadID, e.Attr),
 				})
 			}
 		}
@@ -976,6 +1246,11 @@ func (n *jfsObjects) CompleteMultipartUpload(ctx context.Context, bucket, object
 		}
 		total += copied
 	}
+	if t, eno := n.fs.GetXattr(mctx, n.upath(bucket, uploadID), contentTypeKey); eno == 0 {
+		if eno = n.fs.SetXattr(mctx, tmp, contentTypeKey, t, 0); eno != 0 {
+			logger.Warnf("set content type of %s: %s", object, eno)
+		}
+	}
 
 	name := n.path(bucket, object)
 	dir := path.Dir(name)
@@ -1007,14 +1282,16 @@ func (n *jfsObjects) CompleteMultipartUpload(ctx context.Context, bucket, object
 
 	// Calculate s3 compatible md5sum for complete multipart.
 	s3MD5 := minio.ComputeCompleteMultipartMD5(parts)
+	n.notify(event.ObjectCreatedComplete, object, fi.Size(), s3MD5)
 	return minio.ObjectInfo{
-		Bucket:  bucket,
-		Name:    object,
-		ETag:    s3MD5,
-		ModTime: fi.ModTime(),
-		Size:    fi.Size(),
-		IsDir:   fi.IsDir(),
-		AccTime: fi.ModTime(),
+		Bucket:      bucket,
+		Name:        object,
+		ETag:        s3MD5,
+		ModTime:     fi.ModTime(),
+		Size:        fi.Size(),
+		IsDir:       fi.IsDir(),
+		AccTime:     fi.ModTime(),
+		ContentType: n.contentType(name, fi),
 	}, nil
 }
 
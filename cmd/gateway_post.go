@@ -0,0 +1,286 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// The browsers can upload objects with HTML forms (POST policy) signed by the users of gateway.
+// The signature of policy and the permission of the key are checked by the proxy, then the policy
+// is signed again with the root credentials, so MinIO checks the other conditions of it as before.
+
+const maxPostFieldsSize = 1 << 20
+
+var (
+	errMalformedPost = &s3Error{http.StatusBadRequest, "MalformedPOSTRequest", "The body of your POST request is not well-formed multipart/form-data."}
+	errPostPolicy    = &s3Error{http.StatusForbidden, "AccessDenied", "Invalid according to Policy: Policy Condition failed."}
+)
+
+// the fields of credentials in a form, which are replaced when it's signed again
+var credentialFields = map[string]bool{
+	"x-amz-algorithm": true, "x-amz-credential": true, "x-amz-date": true, "x-amz-security-token": true,
+}
+
+// isPostUpload returns true if it's an upload by HTML form.
+func isPostUpload(r *http.Request) bool {
+	if r.Method != http.MethodPost || r.URL.RawQuery != "" {
+		return false
+	}
+	mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return mt == "multipart/form-data"
+}
+
+// recorder keeps the bytes read from the body before the file, so the body can be restored.
+type recorder struct {
+	r   io.Reader
+	buf bytes.Buffer
+	off bool
+}
+
+func (r *recorder) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if !r.off {
+		r.buf.Write(p[:n])
+		if r.buf.Len() > maxPostFieldsSize {
+			return n, errMalformedPost
+		}
+	}
+	return n, err
+}
+
+type postField struct {
+	name, value string
+}
+
+// postForm is the fields of a form before the file, which must be the last one.
+type postForm struct {
+	fields []postField
+	file   *multipart.Part
+}
+
+// get returns the value of a field, the names are case insensitive.
+func (f *postForm) get(name string) string {
+	for _, fd := range f.fields {
+		if strings.EqualFold(fd.name, name) {
+			return fd.value
+		}
+	}
+	return ""
+}
+
+func readPostForm(r *http.Request, body io.Reader) (*postForm, error) {
+	_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || params["boundary"] == "" {
+		return nil, errMalformedPost
+	}
+	mr := multipart.NewReader(body, params["boundary"])
+	var f postForm
+	for {
+		part, err := mr.NextPart()
+		if err != nil {
+			return nil, errMalformedPost // no file
+		}
+		if strings.EqualFold(part.FormName(), "file") {
+			f.file = part
+			return &f, nil
+		}
+		value, err := ioutil.ReadAll(part)
+		if err != nil {
+			return nil, err
+		}
+		f.fields = append(f.fields, postField{part.FormName(), string(value)})
+	}
+}
+
+type postPolicy struct {
+	Expiration string            `json:"expiration"`
+	Conditions []json.RawMessage `json:"conditions"`
+}
+
+// parsePostPolicy checks the expiration and the conditions on the credentials of a policy, the
+// latter are dropped because the credentials will be replaced.
+func parsePostPolicy(f *postForm, encoded string) (*postPolicy, error) {
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, errMalformedPost
+	}
+	var pp postPolicy
+	if err = json.Unmarshal(data, &pp); err != nil {
+		return nil, errMalformedPost
+	}
+	expiration, err := time.Parse(time.RFC3339, pp.Expiration)
+	if err != nil {
+		return nil, errMalformedPost
+	}
+	if !expiration.After(time.Now()) {
+		return nil, errExpired
+	}
+	var kept []json.RawMessage
+	for _, c := range pp.Conditions {
+		var op, name, value string
+		var eq map[string]string
+		var cond []interface{}
+		if json.Unmarshal(c, &eq) == nil && len(eq) == 1 {
+			for k, v := range eq {
+				op, name, value = "eq", k, v
+			}
+		} else if json.Unmarshal(c, &cond) == nil && len(cond) == 3 {
+			op, _ = cond[0].(string)
+			name, _ = cond[1].(string)
+			value, _ = cond[2].(string)
+			name = strings.TrimPrefix(name, "$")
+		}
+		name = strings.ToLower(name)
+		if !credentialFields[name] {
+			kept = append(kept, c)
+			continue
+		}
+		v := f.get(name)
+		switch strings.ToLower(op) {
+		case "eq":
+			if v != value {
+				return nil, errPostPolicy
+			}
+		case "starts-with":
+			if !strings.HasPrefix(v, value) {
+				return nil, errPostPolicy
+			}
+		default:
+			return nil, errPostPolicy
+		}
+	}
+	pp.Conditions = kept
+	return &pp, nil
+}
+
+// spooled is a body with the file in a temporary file, which is removed after it's closed.
+type spooled struct {
+	io.Reader
+	f *os.File
+}
+
+func (s *spooled) Close() error {
+	_ = s.f.Close()
+	return os.Remove(s.f.Name())
+}
+
+// handlePost verifies an upload by HTML form from a user, then signs it again with the root credentials.
+func (p *userProxy) handlePost(r *http.Request) error {
+	rec := &recorder{r: r.Body}
+	f, err := readPostForm(r, rec)
+	var a v4Auth
+	var u *gatewayUser
+	if err == nil && f.get("x-amz-algorithm") == signV4Algorithm &&
+		a.setCredential(f.get("x-amz-credential"), f.get("x-amz-date")) == nil && a.accessKey != p.root.AccessKey {
+		u = p.getUser(a.accessKey)
+	}
+	if u == nil {
+		// passed through as is, MinIO handles or rejects it
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(&rec.buf, r.Body), r.Body}
+		return nil
+	}
+	rec.off = true
+
+	policy := f.get("policy")
+	key := signingKey(u.SecretKey, a.date, a.region)
+	if sig := hex.EncodeToString(sumHMAC(key, policy)); !hmac.Equal([]byte(sig), []byte(f.get("x-amz-signature"))) {
+		return errSignatureMismatch
+	}
+	pp, err := parsePostPolicy(f, policy)
+	if err != nil {
+		return err
+	}
+	bucket := strings.Trim(r.URL.Path, "/")
+	object := f.get("key")
+	if name := f.file.FileName(); name != "" {
+		object = strings.Replace(object, "${filename}", name, -1)
+	}
+	if bucket == "" || bucket == "minio" || strings.Contains(bucket, "/") || object == "" || !u.canAccess(bucket+"/"+object, true) {
+		return errAccessDenied
+	}
+	return p.resignPost(r, f, pp, a.region)
+}
+
+// resignPost rebuilds the form with the policy signed by the root credentials.
+func (p *userProxy) resignPost(r *http.Request, f *postForm, pp *postPolicy, region string) error {
+	now := time.Now().UTC()
+	credential := strings.Join([]string{p.root.AccessKey, now.Format(yyyymmdd), region, "s3", "aws4_request"}, "/")
+	creds := []postField{
+		{"x-amz-algorithm", signV4Algorithm},
+		{"x-amz-credential", credential},
+		{"x-amz-date", now.Format(iso8601Format)},
+	}
+	for _, c := range creds {
+		data, _ := json.Marshal(map[string]string{c.name: c.value})
+		pp.Conditions = append(pp.Conditions, data)
+	}
+	data, err := json.Marshal(pp)
+	if err != nil {
+		return err
+	}
+	policy := base64.StdEncoding.EncodeToString(data)
+	sig := hex.EncodeToString(sumHMAC(signingKey(p.root.SecretKey, now, region), policy))
+
+	// MinIO requires the length of body
+	tmp, err := ioutil.TempFile("", "juicefs-post-")
+	if err != nil {
+		return err
+	}
+	size, err := io.Copy(tmp, f.file)
+	if err == nil {
+		_, err = tmp.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+	for _, fd := range f.fields {
+		if n := strings.ToLower(fd.name); n != "policy" && n != "x-amz-signature" && !credentialFields[n] {
+			_ = w.WriteField(fd.name, fd.value)
+		}
+	}
+	for _, fd := range append(creds, postField{"policy", policy}, postField{"x-amz-signature", sig}) {
+		_ = w.WriteField(fd.name, fd.value)
+	}
+	_, _ = w.CreatePart(f.file.Header)
+	head := append([]byte{}, buf.Bytes()...)
+	buf.Reset()
+	_ = w.Close()
+	r.ContentLength = int64(len(head)) + size + int64(buf.Len())
+	r.Body = &spooled{io.MultiReader(bytes.NewReader(head), tmp, &buf), tmp}
+	r.Header.Set("Content-Type", w.FormDataContentType())
+	return nil
+}
@@ -0,0 +1,580 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/minio/minio-go/pkg/s3utils"
+	"github.com/minio/minio/pkg/auth"
+)
+
+// The users of S3 gateway are served by a proxy in front of MinIO, which only
+// knows the root credentials. The requests signed by the users are verified
+// and checked against their permissions, then signed again with the root
+// credentials. Other requests (root, anonymous or unknown keys) are passed
+// through as is, so MinIO handles them as before.
+
+const (
+	signV4Algorithm   = "AWS4-HMAC-SHA256"
+	iso8601Format     = "20060102T150405Z"
+	yyyymmdd          = "20060102"
+	unsignedPayload   = "UNSIGNED-PAYLOAD"
+	streamingPayload  = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+	maxSkewTime       = time.Minute * 15
+	maxChunkSize      = 16 << 20
+	maxDeleteBodySize = 2 << 20
+)
+
+type s3Error struct {
+	status  int
+	Code    string
+	Message string
+}
+
+func (e *s3Error) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+var (
+	errAccessDenied      = &s3Error{http.StatusForbidden, "AccessDenied", "Access Denied."}
+	errSignatureMismatch = &s3Error{http.StatusForbidden, "SignatureDoesNotMatch", "The request signature we calculated does not match the signature you provided."}
+	errExpired           = &s3Error{http.StatusForbidden, "AccessDenied", "Request has expired."}
+	errSkewed            = &s3Error{http.StatusForbidden, "RequestTimeTooSkewed", "The difference between the request time and the server's time is too large."}
+	errSignV2            = &s3Error{http.StatusForbidden, "AccessDenied", "Signature V2 is not supported for the users of gateway."}
+	errMalformed         = &s3Error{http.StatusBadRequest, "AuthorizationHeaderMalformed", "The authorization header is malformed."}
+	errChunkSignature    = &s3Error{http.StatusForbidden, "SignatureDoesNotMatch", "The signature of a chunk does not match."}
+	errMalformedXML      = &s3Error{http.StatusBadRequest, "MalformedXML", "The XML you provided was not well-formed."}
+)
+
+func writeS3Error(w http.ResponseWriter, r *http.Request, e *s3Error) {
+	body, _ := xml.Marshal(struct {
+		XMLName  xml.Name `xml:"Error"`
+		Code     string
+		Message  string
+		Resource string
+	}{Code: e.Code, Message: e.Message, Resource: r.URL.Path})
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(e.status)
+	_, _ = w.Write([]byte(xml.Header))
+	_, _ = w.Write(body)
+}
+
+// v4Auth is the signature V4 of a request, from the Authorization header or the query (presigned).
+type v4Auth struct {
+	accessKey     string
+	scope         string // date/region/service/aws4_request
+	region        string
+	signedHeaders []string
+	signature     string
+	date          time.Time
+	expires       time.Duration
+	presigned     bool
+}
+
+// parseV4Auth returns the signature of a request, nil if it's not signed with V4.
+func parseV4Auth(r *http.Request) (*v4Auth, error) {
+	var a v4Auth
+	var credential, signedHeaders, date string
+	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, signV4Algorithm+" ") {
+		for _, f := range strings.Split(h[len(signV4Algorithm)+1:], ",") {
+			kv := strings.SplitN(strings.TrimSpace(f), "=", 2)
+			if len(kv) != 2 {
+				return nil, errMalformed
+			}
+			switch kv[0] {
+			case "Credential":
+				credential = kv[1]
+			case "SignedHeaders":
+				signedHeaders = kv[1]
+			case "Signature":
+				a.signature = kv[1]
+			}
+		}
+		date = r.Header.Get("X-Amz-Date")
+		if date == "" {
+			date = r.Header.Get("Date")
+		}
+	} else if q := r.URL.Query(); q.Get("X-Amz-Algorithm") == signV4Algorithm {
+		a.presigned = true
+		credential = q.Get("X-Amz-Credential")
+		signedHeaders = q.Get("X-Amz-SignedHeaders")
+		a.signature = q.Get("X-Amz-Signature")
+		date = q.Get("X-Amz-Date")
+		expires, err := strconv.ParseInt(q.Get("X-Amz-Expires"), 10, 64)
+		if err != nil || expires < 0 || expires > 7*24*3600 {
+			return nil, errMalformed
+		}
+		a.expires = time.Duration(expires) * time.Second
+	} else {
+		return nil, nil
+	}
+
+	if signedHeaders == "" || a.signature == "" {
+		return nil, errMalformed
+	}
+	a.signedHeaders = strings.Split(signedHeaders, ";")
+	if err := a.setCredential(credential, date); err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+// setCredential parses the credential as "access-key/date/region/s3/aws4_request", and the date of request.
+func (a *v4Auth) setCredential(credential, date string) error {
+	ps := strings.Split(credential, "/")
+	if len(ps) < 5 || ps[len(ps)-1] != "aws4_request" {
+		return errMalformed
+	}
+	a.accessKey = strings.Join(ps[:len(ps)-4], "/")
+	a.scope = strings.Join(ps[len(ps)-4:], "/")
+	a.region = ps[len(ps)-3]
+	var err error
+	if a.date, err = time.Parse(iso8601Format, date); err != nil {
+		if a.date, err = http.ParseTime(date); err != nil {
+			return errMalformed
+		}
+	}
+	if a.date.UTC().Format(yyyymmdd) != ps[len(ps)-4] {
+		return errMalformed
+	}
+	return nil
+}
+
+// canonicalRequest builds the canonical request of signature V4 with the signed headers.
+func canonicalRequest(r *http.Request, signedHeaders []string, payload string) (string, error) {
+	query := r.URL.Query()
+	query.Del("X-Amz-Signature")
+	var headers bytes.Buffer
+	for _, h := range signedHeaders {
+		var vals []string
+		if vs, ok := r.Header[http.CanonicalHeaderKey(h)]; ok {
+			vals = vs
+		} else {
+			switch h {
+			case "host":
+				vals = []string{r.Host}
+			case "expect":
+				vals = []string{"100-continue"}
+			case "content-length":
+				vals = []string{strconv.FormatInt(r.ContentLength, 10)}
+			case "transfer-encoding":
+				vals = r.TransferEncoding
+			default:
+				return "", errMalformed
+			}
+		}
+		headers.WriteString(h)
+		headers.WriteByte(':')
+		for i, v := range vals {
+			if i > 0 {
+				headers.WriteByte(',')
+			}
+			headers.WriteString(strings.Join(strings.Fields(v), " "))
+		}
+		headers.WriteByte('\n')
+	}
+	return strings.Join([]string{
+		r.Method,
+		s3utils.EncodePath(r.URL.Path),
+		strings.Replace(query.Encode(), "+", "%20", -1),
+		headers.String(),
+		strings.Join(signedHeaders, ";"),
+		payload,
+	}, "\n"), nil
+}
+
+func sumHMAC(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	_, _ = h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func signingKey(secret string, t time.Time, region string) []byte {
+	key := sumHMAC([]byte("AWS4"+secret), t.UTC().Format(yyyymmdd))
+	key = sumHMAC(key, region)
+	key = sumHMAC(key, "s3")
+	return sumHMAC(key, "aws4_request")
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func signString(key []byte, t time.Time, scope, data string) string {
+	stringToSign := strings.Join([]string{signV4Algorithm, t.UTC().Format(iso8601Format), scope, data}, "\n")
+	return hex.EncodeToString(sumHMAC(key, stringToSign))
+}
+
+// chunkReader decodes the body with aws-chunked encoding and verifies the signatures of chunks.
+type chunkReader struct {
+	r       *bufio.Reader
+	key     []byte
+	date    time.Time
+	scope   string
+	prevSig string
+	buf     []byte
+	done    bool
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	for len(c.buf) == 0 {
+		if c.done {
+			return 0, io.EOF
+		}
+		if err := c.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, c.buf)
+	c.buf = c.buf[n:]
+	return n, nil
+}
+
+// next reads a chunk as "hex(size);chunk-signature=signature\r\n" + data + "\r\n".
+func (c *chunkReader) next() error {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	ps := strings.SplitN(strings.TrimRight(line, "\r\n"), ";chunk-signature=", 2)
+	size, err := strconv.ParseInt(ps[0], 16, 64)
+	if len(ps) != 2 || err != nil || size < 0 || size > maxChunkSize {
+		return errMalformed
+	}
+	data := make([]byte, size+2)
+	if _, err = io.ReadFull(c.r, data); err != nil {
+		return err
+	}
+	if !bytes.HasSuffix(data, []byte("\r\n")) {
+		return errMalformed
+	}
+	data = data[:size]
+	hashes := strings.Join([]string{"AWS4-HMAC-SHA256-PAYLOAD", c.date.UTC().Format(iso8601Format), c.scope, c.prevSig, sha256Hex(nil), sha256Hex(data)}, "\n")
+	if sig := hex.EncodeToString(sumHMAC(c.key, hashes)); !hmac.Equal([]byte(sig), []byte(ps[1])) {
+		return errChunkSignature
+	}
+	c.prevSig = ps[1]
+	c.buf = data
+	c.done = size == 0
+	return nil
+}
+
+func (c *chunkReader) Close() error {
+	return nil
+}
+
+// verify checks the signature of a request signed by the user, then returns the hash of payload.
+func verify(r *http.Request, a *v4Auth, secret string) (string, error) {
+	now := time.Now()
+	if a.presigned {
+		if a.date.Sub(now) > maxSkewTime {
+			return "", errSkewed
+		}
+		if now.Sub(a.date) > a.expires {
+			return "", errExpired
+		}
+	} else if d := now.Sub(a.date); d > maxSkewTime || d < -maxSkewTime {
+		return "", errSkewed
+	}
+	// the same defaults as MinIO
+	payload := sha256Hex(nil)
+	if v, ok := r.Header["X-Amz-Content-Sha256"]; ok {
+		payload = v[0]
+	} else if a.presigned {
+		payload = unsignedPayload
+	}
+	if v, ok := r.URL.Query()["X-Amz-Content-Sha256"]; ok && a.presigned {
+		payload = v[0]
+	}
+	canonical, err := canonicalRequest(r, a.signedHeaders, payload)
+	if err != nil {
+		return "", err
+	}
+	key := signingKey(secret, a.date, a.region)
+	if sig := signString(key, a.date, a.scope, sha256Hex([]byte(canonical))); !hmac.Equal([]byte(sig), []byte(a.signature)) {
+		return "", errSignatureMismatch
+	}
+	if payload == streamingPayload {
+		decoded, err := strconv.ParseInt(r.Header.Get("X-Amz-Decoded-Content-Length"), 10, 64)
+		if err != nil {
+			return "", errMalformed
+		}
+		r.Body = &chunkReader{r: bufio.NewReader(r.Body), key: key, date: a.date, scope: a.scope, prevSig: a.signature}
+		r.ContentLength = decoded
+		r.Header.Del("X-Amz-Decoded-Content-Length")
+		var encodings []string
+		for _, e := range strings.Split(r.Header.Get("Content-Encoding"), ",") {
+			if e = strings.TrimSpace(e); e != "" && e != "aws-chunked" {
+				encodings = append(encodings, e)
+			}
+		}
+		if len(encodings) > 0 {
+			r.Header.Set("Content-Encoding", strings.Join(encodings, ","))
+		} else {
+			r.Header.Del("Content-Encoding")
+		}
+		payload = unsignedPayload
+	}
+	return payload, nil
+}
+
+// resign removes the signature of the user from a request and signs it with the credentials.
+func resign(r *http.Request, host, region, payload string, cred auth.Credentials) {
+	query := r.URL.Query()
+	for k := range query {
+		if strings.HasPrefix(k, "X-Amz-") {
+			query.Del(k)
+		}
+	}
+	r.URL.RawQuery = query.Encode()
+	r.Host = host
+	r.Header.Del("X-Amz-Security-Token")
+	now := time.Now().UTC()
+	r.Header.Set("X-Amz-Date", now.Format(iso8601Format))
+	r.Header.Set("X-Amz-Content-Sha256", payload)
+	signed := []string{"host", "x-amz-content-sha256", "x-amz-date"}
+	canonical, _ := canonicalRequest(r, signed, payload)
+	scope := strings.Join([]string{now.Format(yyyymmdd), region, "s3", "aws4_request"}, "/")
+	sig := signString(signingKey(cred.SecretKey, now, region), now, scope, sha256Hex([]byte(canonical)))
+	r.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		signV4Algorithm, cred.AccessKey, scope, strings.Join(signed, ";"), sig))
+}
+
+// listParams are the parameters of listing objects or uploads in a bucket.
+var listParams = map[string]bool{
+	"prefix": true, "delimiter": true, "marker": true, "max-keys": true, "encoding-type": true,
+	"list-type": true, "continuation-token": true, "start-after": true, "fetch-owner": true,
+	"uploads": true, "key-marker": true, "upload-id-marker": true, "max-uploads": true,
+}
+
+// authorize checks the permissions of the user for a request in path style.
+func authorize(u *gatewayUser, r *http.Request) error {
+	ps := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	bucket := ps[0]
+	if bucket == "" {
+		if r.Method == http.MethodGet {
+			return nil // list buckets
+		}
+		return errAccessDenied
+	}
+	if bucket == "minio" || !u.inBucket(bucket) {
+		return errAccessDenied // admin API
+	}
+	query := r.URL.Query()
+	if len(ps) == 1 || ps[1] == "" {
+		// the configurations of bucket (policy, lifecycle, notification and so on) are
+		// not granted by the prefixes, only the root user can read or change them
+		switch r.Method {
+		case http.MethodHead:
+			if len(query) == 0 {
+				return nil
+			}
+		case http.MethodGet:
+			if _, ok := query["location"]; ok && len(query) == 1 {
+				return nil
+			}
+			listing := true
+			for k := range query {
+				listing = listing && listParams[k]
+			}
+			if listing && u.canList(bucket+"/"+query.Get("prefix")) {
+				return nil
+			}
+		case http.MethodPost:
+			if _, ok := query["delete"]; ok && len(query) == 1 {
+				return authorizeDelete(u, bucket, r)
+			}
+		}
+		return errAccessDenied
+	}
+
+	write := r.Method != http.MethodGet && r.Method != http.MethodHead
+	if _, ok := query["select"]; ok && r.Method == http.MethodPost {
+		write = false
+	}
+	if !u.canAccess(bucket+"/"+ps[1], write) {
+		return errAccessDenied
+	}
+	if src := r.Header.Get("X-Amz-Copy-Source"); src != "" {
+		if i := strings.Index(src, "?"); i >= 0 {
+			src = src[:i]
+		}
+		if s, err := url.PathUnescape(src); err == nil {
+			src = s
+		}
+		if !u.canAccess(strings.TrimPrefix(src, "/"), false) {
+			return errAccessDenied
+		}
+	}
+	return nil
+}
+
+// authorizeDelete checks all the objects in a request to delete multiple objects.
+func authorizeDelete(u *gatewayUser, bucket string, r *http.Request) error {
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxDeleteBodySize+1))
+	if err != nil {
+		return err
+	}
+	if len(body) > maxDeleteBodySize {
+		return errMalformedXML
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	var req struct {
+		Objects []struct {
+			Key string
+		} `xml:"Object"`
+	}
+	if err = xml.Unmarshal(body, &req); err != nil {
+		return errMalformedXML
+	}
+	for _, o := range req.Objects {
+		if !u.canAccess(bucket+"/"+o.Key, true) {
+			return errAccessDenied
+		}
+	}
+	return nil
+}
+
+// userProxy serves the users of gateway in front of MinIO.
+type userProxy struct {
+	m        meta.Meta
+	root     auth.Credentials
+	upstream string
+	proxy    *httputil.ReverseProxy
+
+	sync.Mutex
+	users map[string]*gatewayUser
+}
+
+func newUserProxy(m meta.Meta, root auth.Credentials, upstream string) *userProxy {
+	p := &userProxy{m: m, root: root, upstream: upstream}
+	p.proxy = &httputil.ReverseProxy{Director: func(r *http.Request) {
+		r.URL.Scheme = "http"
+		r.URL.Host = upstream
+	}}
+	return p
+}
+
+// refresh reloads the users from meta.
+func (p *userProxy) refresh() {
+	users, err := loadGatewayUsers(p.m)
+	if err != nil {
+		logger.Warnf("load gateway users: %s", err)
+		return
+	}
+	p.Lock()
+	p.users = users
+	p.Unlock()
+}
+
+func (p *userProxy) getUser(accessKey string) *gatewayUser {
+	p.Lock()
+	defer p.Unlock()
+	return p.users[accessKey]
+}
+
+func (p *userProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := p.handle(r); err != nil {
+		e, ok := err.(*s3Error)
+		if !ok {
+			e = &s3Error{http.StatusBadRequest, "InvalidRequest", err.Error()}
+		}
+		logger.Debugf("deny %s %s: %s", r.Method, r.URL.Path, err)
+		writeS3Error(w, r, e)
+		return
+	}
+	p.proxy.ServeHTTP(w, r)
+}
+
+// handle verifies and re-signs the requests from the users of gateway.
+func (p *userProxy) handle(r *http.Request) error {
+	a, err := parseV4Auth(r)
+	if err != nil {
+		return err
+	}
+	if a == nil {
+		if isPostUpload(r) {
+			return p.handlePost(r)
+		}
+		h := r.Header.Get("Authorization")
+		if strings.HasPrefix(h, "AWS ") {
+			if ak := strings.SplitN(h[4:], ":", 2)[0]; ak != p.root.AccessKey && p.getUser(ak) != nil {
+				return errSignV2
+			}
+		}
+		return nil
+	}
+	if a.accessKey == p.root.AccessKey {
+		return nil
+	}
+	u := p.getUser(a.accessKey)
+	if u == nil {
+		return nil // rejected by MinIO
+	}
+	payload, err := verify(r, a, u.SecretKey)
+	if err != nil {
+		return err
+	}
+	if err = authorize(u, r); err != nil {
+		return err
+	}
+	r.Header.Del("Authorization")
+	resign(r, p.upstream, a.region, payload, p.root)
+	return nil
+}
+
+// serveUsers serves the users of gateway at address, and forwards the requests to MinIO at upstream.
+func serveUsers(m meta.Meta, root auth.Credentials, address, upstream string) {
+	p := newUserProxy(m, root, upstream)
+	p.refresh()
+	go func() {
+		for {
+			time.Sleep(time.Second * 10)
+			p.refresh()
+		}
+	}()
+	logger.Infof("Serve the users of gateway at %s", address)
+	logger.Fatalf("serve users: %s", http.ListenAndServe(address, p))
+}
+
+// freeAddress returns a free address on loopback for MinIO behind the proxy.
+func freeAddress() (string, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	defer l.Close()
+	return l.Addr().String(), nil
+}
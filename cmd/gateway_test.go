@@ -0,0 +1,180 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/chunk"
+	"github.com/juicedata/juicefs/pkg/fs"
+	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/juicedata/juicefs/pkg/object"
+	"github.com/juicedata/juicefs/pkg/vfs"
+	minio "github.com/minio/minio/cmd"
+	"github.com/minio/minio/pkg/hash"
+)
+
+func newTestGateway(t *testing.T) *jfsObjects {
+	m, err := meta.NewClient("memkv://test", &meta.RedisConfig{})
+	if err != nil {
+		t.Fatalf("create meta: %s", err)
+	}
+	format := meta.Format{Name: "test", BlockSize: 4096}
+	_ = m.Init(format, true)
+	chunkConf := chunk.Config{BlockSize: 4 << 20, MaxUpload: 1, CacheDir: "memory", BufferSize: 100 << 20}
+	blob, _ := object.CreateStorage("mem", "", "", "")
+	conf := vfs.Config{Meta: &meta.Config{}, Format: &format, Chunk: &chunkConf}
+	jfs, _ := fs.NewFileSystem(&conf, m, chunk.NewCachedStore(blob, chunkConf))
+	mctx = meta.Background
+	return &jfsObjects{conf: &conf, fs: jfs}
+}
+
+// nolint:errcheck
+func TestContentType(t *testing.T) {
+	n := newTestGateway(t)
+	jfs := n.fs
+
+	files := map[string]string{
+		"/page.html": "plain text",
+		"/page":      "<html><body>hello</body></html>",
+		"/empty":     "",
+	}
+	for name, data := range files {
+		f, st := jfs.Create(mctx, name, 0644)
+		if st != 0 {
+			t.Fatalf("create %s: %s", name, st)
+		}
+		f.Write(mctx, []byte(data))
+		f.Close(mctx)
+	}
+	cases := map[string]string{
+		"/page.html": "text/html",
+		"/page":      "text/html",
+		"/empty":     "",
+	}
+	for name, expected := range cases {
+		fi, _ := jfs.Stat(mctx, name)
+		if ct := n.contentType(name, fi); !strings.HasPrefix(ct, expected) || expected == "" && ct != "" {
+			t.Fatalf("content type of %s: expect %q, but got %q", name, expected, ct)
+		}
+	}
+	if v, st := jfs.GetXattr(mctx, "/page", detectedTypeKey); st != 0 || !strings.HasSuffix(string(v), "text/html; charset=utf-8") {
+		t.Fatalf("detected type should be cached: %q %s", v, st)
+	}
+
+	// rewritten through POSIX
+	time.Sleep(time.Millisecond * 10)
+	f, _ := jfs.Open(mctx, "/page", 0)
+	f.Pwrite(mctx, []byte("\x89PNG\r\n\x1a\n"), 0)
+	f.Close(mctx)
+	fi, _ := jfs.Stat(mctx, "/page")
+	if ct := n.contentType("/page", fi); ct != "image/png" {
+		t.Fatalf("content type after rewrite: %q", ct)
+	}
+
+	jfs.SetXattr(mctx, "/page", contentTypeKey, []byte("application/x-custom"), 0)
+	if ct := n.contentType("/page", fi); ct != "application/x-custom" {
+		t.Fatalf("content type set by user: %q", ct)
+	}
+	if ct := userContentType(map[string]string{"content-type": "binary/octet-stream"}); ct != "" {
+		t.Fatalf("default content type should be ignored: %q", ct)
+	}
+}
+
+// nolint:errcheck
+func TestCleanupUploads(t *testing.T) {
+	n := newTestGateway(t)
+	ctx := context.Background()
+	_ = n.mkdirAll(ctx, n.tpath("test", "uploads"), 0755)
+	old, _ := n.NewMultipartUpload(ctx, "test", "a", minio.ObjectOptions{})
+	recent, _ := n.NewMultipartUpload(ctx, "test", "b", minio.ObjectOptions{})
+	initiated := strconv.FormatInt(time.Now().Add(-time.Hour*2).UnixNano(), 10)
+	n.fs.SetXattr(mctx, n.upath("test", old), uploadInitiated, []byte(initiated), 0)
+	_ = n.mkdirAll(ctx, n.tpath("test", "tmp"), 0755)
+	f, _ := n.fs.Create(mctx, n.tpath("test", "tmp", "x"), 0644)
+	f.Utime(mctx, time.Now().Add(-time.Hour*2).UnixNano()/1e6, time.Now().Add(-time.Hour*2).UnixNano()/1e6)
+	f.Close(mctx)
+
+	n.cleanupUploads("test", time.Hour)
+	if _, eno := n.fs.Stat(mctx, n.upath("test", old)); eno == 0 {
+		t.Fatalf("expired upload should be removed")
+	}
+	if _, eno := n.fs.Stat(mctx, n.upath("test", recent)); eno != 0 {
+		t.Fatalf("recent upload should be kept: %s", eno)
+	}
+	if _, eno := n.fs.Stat(mctx, n.tpath("test", "tmp", "x")); eno == 0 {
+		t.Fatalf("expired temporary file should be removed")
+	}
+	lmi, err := n.ListMultipartUploads(ctx, "test", "", "", "", "", 10)
+	if err != nil || len(lmi.Uploads) != 1 || lmi.Uploads[0].Object != "b" || time.Since(lmi.Uploads[0].Initiated) > time.Minute {
+		t.Fatalf("list uploads: %+v %s", lmi.Uploads, err)
+	}
+}
+
+// nolint:errcheck
+func TestETagAndRange(t *testing.T) {
+	n := newTestGateway(t)
+	ctx := context.Background()
+	put := func(object, data string) minio.ObjectInfo {
+		hr, err := hash.NewReader(strings.NewReader(data), int64(len(data)), "", "", int64(len(data)), false)
+		if err != nil {
+			t.Fatalf("hash reader: %s", err)
+		}
+		info, err := n.PutObject(ctx, "test", object, minio.NewPutObjReader(hr), minio.ObjectOptions{})
+		if err != nil {
+			t.Fatalf("put %s: %s", object, err)
+		}
+		return info
+	}
+
+	put("plain", "hello world")
+	info, _ := n.GetObjectInfo(ctx, "test", "plain", minio.ObjectOptions{})
+	if strings.Count(info.ETag, "-") != 2 {
+		t.Fatalf("etag without checksum: %q", info.ETag)
+	}
+	time.Sleep(time.Millisecond * 10)
+	put("plain", "hello world!")
+	if info2, _ := n.GetObjectInfo(ctx, "test", "plain", minio.ObjectOptions{}); info2.ETag == info.ETag {
+		t.Fatalf("etag should be changed after rewrite: %q", info2.ETag)
+	}
+
+	n.checksum = true
+	put("sum", "hello world")
+	info, _ = n.GetObjectInfo(ctx, "test", "sum", minio.ObjectOptions{})
+	if info.ETag != "b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9-1" {
+		t.Fatalf("etag with checksum: %q", info.ETag)
+	}
+
+	r, err := n.GetObjectNInfo(ctx, "test", "sum", &minio.HTTPRangeSpec{Start: 6, End: 8}, nil, 0, minio.ObjectOptions{})
+	if err != nil {
+		t.Fatalf("get range: %s", err)
+	}
+	data, _ := ioutil.ReadAll(r)
+	r.Close()
+	if string(data) != "wor" {
+		t.Fatalf("range of object: %q", data)
+	}
+
+	opts := minio.ObjectOptions{CheckPrecondFn: func(oi minio.ObjectInfo) bool { return oi.ETag == info.ETag }}
+	if _, err = n.GetObjectNInfo(ctx, "test", "sum", nil, nil, 0, opts); err == nil {
+		t.Fatalf("precondition should fail")
+	}
+}
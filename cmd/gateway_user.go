@@ -0,0 +1,222 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/urfave/cli/v2"
+)
+
+func gatewayUserFlags() *cli.Command {
+	return &cli.Command{
+		Name:      "gateway-user",
+		Usage:     "Manage the users of S3 gateway and their permissions",
+		ArgsUsage: "REDIS-URL [ACCESS-KEY]",
+		Action:    gatewayUsers,
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:  "secret-key",
+				Usage: "secret key of the user, a random one is generated for a new user if it's not set",
+			},
+			&cli.StringSliceFlag{
+				Name:  "read",
+				Usage: "prefix of BUCKET/KEY the user can read and list",
+			},
+			&cli.StringSliceFlag{
+				Name:  "write",
+				Usage: "prefix of BUCKET/KEY the user can write and delete",
+			},
+			&cli.StringSliceFlag{
+				Name:  "deny",
+				Usage: "prefix of BUCKET/KEY the user can't access, it overrides --read and --write",
+			},
+			&cli.BoolFlag{
+				Name:    "remove",
+				Aliases: []string{"r"},
+				Usage:   "remove the user",
+			},
+		},
+	}
+}
+
+// gatewayUser is a user of the S3 gateway, the permissions are granted by the
+// prefixes of "bucket/key". An object can be read (or written) if it's under
+// any prefix in Read (or Write) and none in Deny. The prefixes are directories,
+// "bucket/team" grants the objects under "bucket/team/", but not "bucket/team2/".
+type gatewayUser struct {
+	SecretKey string   `json:"secretKey"`
+	Read      []string `json:"read,omitempty"`
+	Write     []string `json:"write,omitempty"`
+	Deny      []string `json:"deny,omitempty"`
+}
+
+// dirPrefix returns the prefix as a directory, which ends with "/".
+func dirPrefix(p string) string {
+	if !strings.HasSuffix(p, "/") {
+		p += "/"
+	}
+	return p
+}
+
+func dirPrefixes(prefixes []string) []string {
+	for i, p := range prefixes {
+		prefixes[i] = dirPrefix(p)
+	}
+	return prefixes
+}
+
+func hasPrefix(prefixes []string, s string) bool {
+	for _, p := range prefixes {
+		if strings.HasPrefix(s, dirPrefix(p)) {
+			return true
+		}
+	}
+	return false
+}
+
+// canAccess returns true if the user can read (or write) the object with the path "bucket/key".
+func (u *gatewayUser) canAccess(p string, write bool) bool {
+	if hasPrefix(u.Deny, p) {
+		return false
+	}
+	if write {
+		return hasPrefix(u.Write, p)
+	}
+	return hasPrefix(u.Read, p)
+}
+
+// canList returns true if the user can list the objects under prefix "bucket/prefix",
+// which should not contain any denied object.
+func (u *gatewayUser) canList(prefix string) bool {
+	for _, d := range u.Deny {
+		if strings.HasPrefix(dirPrefix(d), prefix) {
+			return false
+		}
+	}
+	return u.canAccess(prefix, false)
+}
+
+// inBucket returns true if the user has any permission in the bucket.
+func (u *gatewayUser) inBucket(bucket string) bool {
+	for _, ps := range [][]string{u.Read, u.Write} {
+		for _, p := range ps {
+			if p = dirPrefix(p); strings.HasPrefix(p, bucket+"/") || strings.HasPrefix(bucket+"/", p) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func loadGatewayUsers(m meta.Meta) (map[string]*gatewayUser, error) {
+	vals, err := m.ListGatewayUsers()
+	if err != nil {
+		return nil, err
+	}
+	users := make(map[string]*gatewayUser, len(vals))
+	for k, v := range vals {
+		var u gatewayUser
+		if err = json.Unmarshal(v, &u); err != nil {
+			logger.Warnf("invalid gateway user %s: %s", k, err)
+			continue
+		}
+		users[k] = &u
+	}
+	return users, nil
+}
+
+func gatewayUsers(ctx *cli.Context) error {
+	setLoggerLevel(ctx)
+	if ctx.Args().Len() < 1 {
+		return fmt.Errorf("REDIS-URL is needed")
+	}
+	addr := ctx.Args().Get(0)
+	if !strings.Contains(addr, "://") {
+		addr = "redis://" + addr
+	}
+
+	logger.Infof("Meta address: %s", addr)
+	var rc = meta.RedisConfig{Retries: 10, Strict: true}
+	m, err := meta.NewClient(addr, &rc)
+	if err != nil {
+		logger.Fatalf("Meta: %s", err)
+	}
+	if _, err = m.Load(); err != nil {
+		logger.Fatalf("load setting: %s", err)
+	}
+	users, err := loadGatewayUsers(m)
+	if err != nil {
+		logger.Fatalf("list gateway users: %s", err)
+	}
+	if ctx.Args().Len() < 2 {
+		keys := make([]string, 0, len(users))
+		for k := range users {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			u := users[k]
+			fmt.Printf("%s read=%s write=%s deny=%s\n", k, strings.Join(u.Read, ","), strings.Join(u.Write, ","), strings.Join(u.Deny, ","))
+		}
+		return nil
+	}
+	accessKey := ctx.Args().Get(1)
+	if ctx.Bool("remove") {
+		if users[accessKey] == nil {
+			logger.Fatalf("user %s is not found", accessKey)
+		}
+		if err = m.SetGatewayUser(accessKey, nil); err != nil {
+			logger.Fatalf("remove user %s: %s", accessKey, err)
+		}
+		return nil
+	}
+	u := users[accessKey]
+	if u == nil {
+		u = &gatewayUser{}
+	}
+	if ctx.IsSet("secret-key") {
+		u.SecretKey = ctx.String("secret-key")
+	} else if u.SecretKey == "" {
+		buf := make([]byte, 20)
+		_, _ = rand.Read(buf)
+		u.SecretKey = hex.EncodeToString(buf)
+		fmt.Printf("secret key of %s: %s\n", accessKey, u.SecretKey)
+	}
+	if len(u.SecretKey) < 8 {
+		return fmt.Errorf("secret key should be at least 8 characters")
+	}
+	if ctx.IsSet("read") {
+		u.Read = dirPrefixes(ctx.StringSlice("read"))
+	}
+	if ctx.IsSet("write") {
+		u.Write = dirPrefixes(ctx.StringSlice("write"))
+	}
+	if ctx.IsSet("deny") {
+		u.Deny = dirPrefixes(ctx.StringSlice("deny"))
+	}
+	data, _ := json.Marshal(u)
+	if err = m.SetGatewayUser(accessKey, data); err != nil {
+		logger.Fatalf("save user %s: %s", accessKey, err)
+	}
+	return nil
+}
@@ -0,0 +1,324 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/minio/minio-go/pkg/s3signer"
+	"github.com/minio/minio/pkg/auth"
+)
+
+func TestUserPermissions(t *testing.T) {
+	u := &gatewayUser{Read: []string{"vol/team-a/", "vol/shared/"}, Write: []string{"vol/team-a/"}, Deny: []string{"vol/team-a/secret/"}}
+	cases := []struct {
+		method, path, copySource string
+		allowed                  bool
+	}{
+		{"GET", "/", "", true},
+		{"GET", "/vol/team-a/x", "", true},
+		{"PUT", "/vol/team-a/x", "", true},
+		{"GET", "/vol/shared/x", "", true},
+		{"PUT", "/vol/shared/x", "", false},
+		{"GET", "/vol/team-b/x", "", false},
+		{"GET", "/vol/team-a/secret/x", "", false},
+		{"DELETE", "/vol/team-a/secret/x", "", false},
+		{"PUT", "/vol/team-a/y", "/vol/shared/x", true},
+		{"PUT", "/vol/team-a/y", "/vol/team-b/x", false},
+		{"GET", "/vol?list-type=2&prefix=team-a/sub/", "", true},
+		{"GET", "/vol?list-type=2&prefix=team-a/", "", false}, // contains a denied prefix
+		{"GET", "/vol?list-type=2&prefix=", "", false},
+		{"GET", "/vol?location", "", true},
+		{"GET", "/vol?policy", "", false},
+		{"HEAD", "/vol", "", true},
+		{"HEAD", "/other", "", false},
+		{"PUT", "/vol", "", false},
+		{"GET", "/minio/admin/v3/info", "", false},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest(c.method, c.path, nil)
+		if c.copySource != "" {
+			r.Header.Set("X-Amz-Copy-Source", c.copySource)
+		}
+		if err := authorize(u, r); (err == nil) != c.allowed {
+			t.Fatalf("%s %s (copy from %s): expect allowed=%v, but got %v", c.method, c.path, c.copySource, c.allowed, err)
+		}
+	}
+
+	owner := &gatewayUser{Read: []string{"vol"}, Write: []string{"vol"}}
+	for _, c := range []struct {
+		method, path string
+		allowed      bool
+	}{
+		{"GET", "/vol?list-type=2", true},
+		{"GET", "/vol?location", true},
+		{"HEAD", "/vol", true},
+		{"HEAD", "/vol2", false},
+		{"GET", "/vol2/x", false},
+		{"PUT", "/vol/x", true},
+		{"PUT", "/vol?policy", false},
+		{"PUT", "/vol?notification", false},
+		{"PUT", "/vol?lifecycle", false},
+		{"PUT", "/vol?versioning", false},
+		{"DELETE", "/vol?policy", false},
+		{"DELETE", "/vol", false},
+		{"PUT", "/vol", false},
+		{"GET", "/vol?policy", false},
+		{"GET", "/vol?location&policy", false},
+		{"POST", "/vol?delete&policy", false},
+	} {
+		if err := authorize(owner, httptest.NewRequest(c.method, c.path, nil)); (err == nil) != c.allowed {
+			t.Fatalf("owner of bucket %s %s: expect allowed=%v, but got %v", c.method, c.path, c.allowed, err)
+		}
+	}
+
+	team := &gatewayUser{Read: []string{"vol/team"}, Write: []string{"vol/team"}, Deny: []string{"vol/team/secret"}}
+	for _, c := range []struct {
+		method, path string
+		allowed      bool
+	}{
+		{"PUT", "/vol/team/x", true},
+		{"GET", "/vol/team/secret2/x", true},
+		{"GET", "/vol/team/secret/x", false},
+		{"PUT", "/vol/team2/x", false},
+		{"GET", "/vol/team2/x", false},
+		{"GET", "/vol/teamx", false},
+		{"GET", "/vol?list-type=2&prefix=team/a/", true},
+		{"GET", "/vol?list-type=2&prefix=team", false},
+	} {
+		if err := authorize(team, httptest.NewRequest(c.method, c.path, nil)); (err == nil) != c.allowed {
+			t.Fatalf("prefix without slash %s %s: expect allowed=%v, but got %v", c.method, c.path, c.allowed, err)
+		}
+	}
+
+	body := `<Delete><Object><Key>team-a/x</Key></Object><Object><Key>team-a/secret/y</Key></Object></Delete>`
+	r := httptest.NewRequest("POST", "/vol?delete", strings.NewReader(body))
+	if err := authorize(u, r); err != errAccessDenied {
+		t.Fatalf("delete denied objects: %v", err)
+	}
+	r = httptest.NewRequest("POST", "/vol?delete", strings.NewReader(`<Delete><Object><Key>team-a/x</Key></Object></Delete>`))
+	if err := authorize(u, r); err != nil {
+		t.Fatalf("delete objects: %v", err)
+	}
+	if data, _ := ioutil.ReadAll(r.Body); !strings.Contains(string(data), "team-a/x") {
+		t.Fatalf("body should be kept: %s", data)
+	}
+}
+
+func TestUserProxy(t *testing.T) {
+	m, err := meta.NewClient("memkv://test", &meta.RedisConfig{})
+	if err != nil {
+		t.Fatalf("create meta: %s", err)
+	}
+	_ = m.Init(meta.Format{Name: "test"}, true)
+	data, _ := json.Marshal(&gatewayUser{SecretKey: "team-a-secret", Read: []string{"vol/team-a/"}, Write: []string{"vol/team-a/"}})
+	if err = m.SetGatewayUser("team-a", data); err != nil {
+		t.Fatalf("set user: %s", err)
+	}
+
+	root := auth.Credentials{AccessKey: "root", SecretKey: "root-secret"}
+	var received []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		a, err := parseV4Auth(r)
+		if err == nil && a != nil {
+			secret := root.SecretKey
+			if a.accessKey != root.AccessKey {
+				secret = "unknown"
+			}
+			_, err = verify(r, a, secret)
+		}
+		if a == nil || err != nil {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		received = append(received, a.accessKey+" "+r.Method+" "+r.URL.Path+" "+string(body))
+	}))
+	defer upstream.Close()
+	p := newUserProxy(m, root, strings.TrimPrefix(upstream.URL, "http://"))
+	p.refresh()
+	front := httptest.NewServer(p)
+	defer front.Close()
+
+	do := func(method, path string, body []byte, ak, sk string, sign func(r *http.Request) *http.Request) int {
+		r, _ := http.NewRequest(method, front.URL+path, bytes.NewReader(body))
+		if sign == nil {
+			r.Header.Set("X-Amz-Content-Sha256", sha256Hex(body))
+			r = s3signer.SignV4(*r, ak, sk, "", "us-east-1")
+		} else {
+			r = sign(r)
+		}
+		resp, err := http.DefaultClient.Do(r)
+		if err != nil {
+			t.Fatalf("%s %s: %s", method, path, err)
+		}
+		_ = resp.Body.Close()
+		return resp.StatusCode
+	}
+	if s := do("GET", "/vol/team-a/x", nil, "team-a", "team-a-secret", nil); s != 200 {
+		t.Fatalf("get object: %d", s)
+	}
+	if s := do("GET", "/vol/team-b/x", nil, "team-a", "team-a-secret", nil); s != 403 {
+		t.Fatalf("get object of other team: %d", s)
+	}
+	if s := do("GET", "/vol/team-a/x", nil, "team-a", "wrong-secret", nil); s != 403 {
+		t.Fatalf("get object with wrong secret: %d", s)
+	}
+	if s := do("PUT", "/vol/team-a/y", []byte("hello"), "team-a", "team-a-secret", nil); s != 200 {
+		t.Fatalf("put object: %d", s)
+	}
+	payload := bytes.Repeat([]byte("chunk"), 30000)
+	streaming := func(r *http.Request) *http.Request {
+		r.Header.Set("Content-Encoding", "aws-chunked")
+		return s3signer.StreamingSignV4(r, "team-a", "team-a-secret", "", "us-east-1", int64(len(payload)), time.Now().UTC())
+	}
+	if s := do("PUT", "/vol/team-a/z", payload, "", "", streaming); s != 200 {
+		t.Fatalf("put object with streaming signature: %d", s)
+	}
+	presigned := func(r *http.Request) *http.Request {
+		return s3signer.PreSignV4(*r, "team-a", "team-a-secret", "", "us-east-1", 60)
+	}
+	if s := do("GET", "/vol/team-a/x", nil, "", "", presigned); s != 200 {
+		t.Fatalf("get object with presigned URL: %d", s)
+	}
+	if s := do("PUT", "/vol/team-a/p", []byte("presigned"), "", "", presigned); s != 200 {
+		t.Fatalf("put object with presigned URL: %d", s)
+	}
+	if s := do("PUT", "/vol/team-b/p", []byte("presigned"), "", "", presigned); s != 403 {
+		t.Fatalf("put object of other team with presigned URL: %d", s)
+	}
+	if s := do("GET", "/vol/team-b/x", nil, "root", "root-secret", nil); s != 200 {
+		t.Fatalf("root should be passed through: %d", s)
+	}
+	expected := []string{
+		"root GET /vol/team-a/x ",
+		"root PUT /vol/team-a/y hello",
+		"root PUT /vol/team-a/z " + string(payload),
+		"root GET /vol/team-a/x ",
+		"root PUT /vol/team-a/p presigned",
+		"root GET /vol/team-b/x ",
+	}
+	if len(received) != len(expected) {
+		t.Fatalf("expect %d requests, but got %d", len(expected), len(received))
+	}
+	for i, e := range expected {
+		if received[i] != e {
+			t.Fatalf("request %d: expect %.40q, but got %.40q", i, e, received[i])
+		}
+	}
+}
+
+func TestPostPolicy(t *testing.T) {
+	m, err := meta.NewClient("memkv://test", &meta.RedisConfig{})
+	if err != nil {
+		t.Fatalf("create meta: %s", err)
+	}
+	_ = m.Init(meta.Format{Name: "test"}, true)
+	data, _ := json.Marshal(&gatewayUser{SecretKey: "team-a-secret", Read: []string{"vol/team-a/"}, Write: []string{"vol/team-a/"}})
+	if err = m.SetGatewayUser("team-a", data); err != nil {
+		t.Fatalf("set user: %s", err)
+	}
+
+	root := auth.Credentials{AccessKey: "root", SecretKey: "root-secret"}
+	var received []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseMultipartForm(1 << 20); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var a v4Auth
+		v := r.MultipartForm.Value
+		if a.setCredential(v["x-amz-credential"][0], v["x-amz-date"][0]) != nil || a.accessKey != root.AccessKey ||
+			sigPolicy(root.SecretKey, a.date, v["policy"][0]) != v["x-amz-signature"][0] {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		file, _ := r.MultipartForm.File["file"][0].Open()
+		content, _ := ioutil.ReadAll(file)
+		policy, _ := base64.StdEncoding.DecodeString(v["policy"][0])
+		received = append(received, v["key"][0]+" "+string(content)+" "+string(policy))
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer upstream.Close()
+	p := newUserProxy(m, root, strings.TrimPrefix(upstream.URL, "http://"))
+	p.refresh()
+	front := httptest.NewServer(p)
+	defer front.Close()
+
+	upload := func(key, sk string, expiration time.Time, conditions ...string) int {
+		now := time.Now().UTC()
+		credential := "team-a/" + now.Format(yyyymmdd) + "/us-east-1/s3/aws4_request"
+		conditions = append(conditions, `{"x-amz-credential":"`+credential+`"}`, `["starts-with","$x-amz-date",""]`)
+		policy := base64.StdEncoding.EncodeToString([]byte(`{"expiration":"` + expiration.Format(time.RFC3339) +
+			`","conditions":[` + strings.Join(conditions, ",") + `]}`))
+		var body bytes.Buffer
+		w := multipart.NewWriter(&body)
+		for _, kv := range [][2]string{
+			{"key", key}, {"x-amz-algorithm", signV4Algorithm}, {"x-amz-credential", credential},
+			{"x-amz-date", now.Format(iso8601Format)}, {"policy", policy}, {"x-amz-signature", sigPolicy(sk, now, policy)},
+		} {
+			_ = w.WriteField(kv[0], kv[1])
+		}
+		fw, _ := w.CreateFormFile("file", "a.txt")
+		_, _ = fw.Write([]byte("hello"))
+		_ = w.Close()
+		resp, err := http.Post(front.URL+"/vol", w.FormDataContentType(), &body)
+		if err != nil {
+			t.Fatalf("post %s: %s", key, err)
+		}
+		_ = resp.Body.Close()
+		return resp.StatusCode
+	}
+	future := time.Now().Add(time.Hour)
+	if s := upload("team-a/${filename}", "team-a-secret", future, `["starts-with","$key","team-a/"]`); s != 204 {
+		t.Fatalf("upload: %d", s)
+	}
+	if s := upload("team-b/x", "team-a-secret", future); s != 403 {
+		t.Fatalf("upload to other team: %d", s)
+	}
+	if s := upload("team-a/x", "wrong-secret", future); s != 403 {
+		t.Fatalf("upload with wrong secret: %d", s)
+	}
+	if s := upload("team-a/x", "team-a-secret", time.Now().Add(-time.Minute)); s != 403 {
+		t.Fatalf("upload with expired policy: %d", s)
+	}
+	if len(received) != 1 {
+		t.Fatalf("expect 1 upload, but got %d", len(received))
+	}
+	if r := received[0]; !strings.HasPrefix(r, "team-a/${filename} hello ") || !strings.Contains(r, `["starts-with","$key","team-a/"]`) ||
+		strings.Contains(r, "team-a/2") || !strings.Contains(r, `"root/`) {
+		t.Fatalf("unexpected upload: %s", r)
+	}
+}
+
+func sigPolicy(secret string, t time.Time, policy string) string {
+	return hex.EncodeToString(sumHMAC(signingKey(secret, t, "us-east-1"), policy))
+}
@@ -17,10 +17,12 @@ package main
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/juicedata/juicefs/pkg/chunk"
@@ -34,7 +36,7 @@ import (
 func gcFlags() *cli.Command {
 	return &cli.Command{
 		Name:      "gc",
-		Usage:     "collect any leaked objects",
+		Usage:     "collect any leaked objects and show the usage of object storage",
 		ArgsUsage: "REDIS-URL",
 		Action:    gc,
 		Flags: []cli.Flag{
@@ -47,6 +49,15 @@ func gcFlags() *cli.Command {
 				Value: 50,
 				Usage: "number threads to delete leaked objects",
 			},
+			&cli.IntFlag{
+				Name:  "list-threads",
+				Value: 10,
+				Usage: "number of threads to list the objects in parallel",
+			},
+			&cli.BoolFlag{
+				Name:  "restart",
+				Usage: "start over instead of resuming from the checkpoint of the interrupted run",
+			},
 		},
 	}
 }
@@ -108,7 +119,7 @@ func gc(ctx *cli.Context) error {
 
 	logger.Infof("Meta address: %s", addr)
 	var rc = meta.RedisConfig{Retries: 10, Strict: true}
-	m, err := meta.NewRedisMeta(addr, &rc)
+	m, err := meta.NewClient(addr, &rc)
 	if err != nil {
 		logger.Fatalf("Meta: %s", err)
 	}
@@ -118,8 +129,14 @@ func gc(ctx *cli.Context) error {
 	}
 
 	chunkConf := chunk.Config{
-		BlockSize: format.BlockSize * 1024,
-		Compress:  format.Compression,
+		BlockSize:  format.BlockSize * 1024,
+		Compress:   format.Compression,
+		PackSize:   format.PackSize << 10,
+		PackIndex:  m,
+		Dedup:      format.Dedup,
+		DedupIndex: m,
+
+		ExternalIndex: m,
 
 		GetTimeout: time.Second * 60,
 		PutTimeout: time.Second * 60,
@@ -130,14 +147,18 @@ func gc(ctx *cli.Context) error {
 		CacheSize:  0,
 	}
 
-	blob, err := createStorage(format)
+	blob, err := createReplicatedStorage(format, m, false, false)
 	if err != nil {
 		logger.Fatalf("object storage: %s", err)
 	}
 	logger.Infof("Data use %s", blob)
+	if err = checkUUID(format, true); err != nil {
+		logger.Fatalf("check volume: %s", err)
+	}
 
+	cp := resumeScan(m, "gc", fmt.Sprintf("delete=%v", ctx.Bool("delete")), ctx.Bool("restart"))
 	blob = object.WithPrefix(blob, "chunks/")
-	objs, err := osync.ListAll(blob, "", "")
+	objs, err := osync.ListAllParallel(blob, cp.Cursor, "", ctx.Int("list-threads"))
 	if err != nil {
 		logger.Fatalf("list all blocks: %s", err)
 	}
@@ -149,31 +170,87 @@ func gc(ctx *cli.Context) error {
 		logger.Fatalf("list all slices: %s", r)
 	}
 	keys := make(map[uint64]uint32)
+	refs := make(map[uint64]int)
 	var totalBytes uint64
 	for _, s := range slices {
 		keys[s.Chunkid] = s.Size
+		refs[s.Chunkid]++
 		totalBytes += uint64(s.Size)
 	}
 	logger.Infof("using %d slices (%d bytes)", len(keys), totalBytes)
 
+	// the deduplicated blocks are kept in the first uploaded one, which could be removed already
+	var shared map[string]int64
+	if format.Dedup {
+		if shared, err = m.ListDedup(); err != nil {
+			logger.Fatalf("list deduplicated blocks: %s", err)
+		}
+	}
+
+	// the slices only used by removed files or released by compaction will be deleted in background
+	var backlog meta.Backlog
+	if r = m.ListDeleted(c, true, &backlog); r != 0 {
+		logger.Fatalf("list deleted files: %s", r)
+	}
+	pending := make(map[uint64]bool)
+	for _, f := range backlog.Files {
+		for _, s := range f.Slices {
+			refs[s.Chunkid]--
+			if refs[s.Chunkid] <= 0 {
+				pending[s.Chunkid] = true
+			}
+		}
+	}
+	for _, s := range backlog.Released {
+		if _, ok := keys[s.Chunkid]; !ok {
+			keys[s.Chunkid] = s.Size
+			pending[s.Chunkid] = true
+		}
+	}
+
 	var p = gcProgress{total: len(keys)}
 	if isatty.IsTerminal(os.Stdout.Fd()) {
 		go showProgress(&p)
 	}
 
 	var skipped, skippedBytes int64
+	var live, deleting storageUsage
 	maxMtime := time.Now().Add(time.Hour * -1)
+	p.found = int(cp.Stats["found"])
+	p.leaked, p.leakedBytes = int(cp.Stats["leaked"]), cp.Stats["leakedBytes"]
+	skipped, skippedBytes = cp.Stats["skipped"], cp.Stats["skippedBytes"]
+	live = storageUsage{int(cp.Stats["liveObjects"]), cp.Stats["liveBytes"]}
+	deleting = storageUsage{int(cp.Stats["pendingObjects"]), cp.Stats["pendingBytes"]}
+
+	// the deletion is held during backup, the hold is reloaded in case a backup is started later
+	var heldUntil int64
+	if ctx.Bool("delete") {
+		if format.HoldDeletionUntil > time.Now().Unix() {
+			logger.Fatalf("deletion is held by backup until %s, try again later", time.Unix(format.HoldDeletionUntil, 0))
+		}
+		go func() {
+			for {
+				time.Sleep(time.Second * 10)
+				if f, err := m.Load(); err == nil {
+					atomic.StoreInt64(&heldUntil, f.HoldDeletionUntil)
+				}
+			}
+		}()
+	}
 
 	var leakedObj = make(chan string, 10240)
-	var wg sync.WaitGroup
+	var wg, pendingDel sync.WaitGroup
 	for i := 0; i < 10; i++ {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
 			for key := range leakedObj {
-				if err := blob.Delete(key); err != nil {
+				if atomic.LoadInt64(&heldUntil) > time.Now().Unix() {
+					logger.Warnf("skip deleting %s, deletion is held by backup", key)
+				} else if err := blob.Delete(key); err != nil {
 					logger.Warnf("delete %s: %s", key, err)
 				}
+				pendingDel.Done()
 			}
 		}()
 	}
@@ -182,16 +259,30 @@ func gc(ctx *cli.Context) error {
 		p.leakedBytes += obj.Size()
 		p.leaked++
 		if ctx.Bool("delete") {
+			pendingDel.Add(1)
 			leakedObj <- obj.Key()
 		}
 	}
+	// the leaked objects before the cursor should be deleted before saving the checkpoint
+	flush := func() {
+		pendingDel.Wait()
+		cp.Stats["found"] = int64(p.found)
+		cp.Stats["leaked"], cp.Stats["leakedBytes"] = int64(p.leaked), p.leakedBytes
+		cp.Stats["skipped"], cp.Stats["skippedBytes"] = skipped, skippedBytes
+		cp.Stats["liveObjects"], cp.Stats["liveBytes"] = int64(live.objects), live.bytes
+		cp.Stats["pendingObjects"], cp.Stats["pendingBytes"] = int64(deleting.objects), deleting.bytes
+	}
+	var failed bool
 	for obj := range objs {
 		if obj == nil {
+			failed = true
 			break // failed listing
 		}
-		if obj.IsDir() {
+		if obj.IsDir() || obj.Key() <= cp.Cursor {
 			continue
 		}
+		cp.save(false, flush) // all the objects before this one are done
+		cp.Cursor = obj.Key()
 		if obj.Mtime().After(maxMtime) || obj.Mtime().Unix() == 0 {
 			logger.Debugf("ignore new block: %s %s", obj.Key(), obj.Mtime())
 			skippedBytes += obj.Size()
@@ -211,6 +302,10 @@ func gc(ctx *cli.Context) error {
 		}
 		cid, _ := strconv.Atoi(parts[0])
 		size := keys[uint64(cid)]
+		if size == 0 && shared["chunks/"+obj.Key()] > 0 {
+			live.add(obj.Size())
+			continue
+		}
 		if size == 0 {
 			logger.Debugf("find leaked object: %s, size: %d", obj.Key(), obj.Size())
 			foundLeaked(obj)
@@ -222,6 +317,7 @@ func gc(ctx *cli.Context) error {
 			if (indx+1)*csize > int(size) {
 				logger.Warnf("size of slice %d is larger than expected: %d > %d", cid, indx*chunkConf.BlockSize+csize, size)
 				foundLeaked(obj)
+				continue
 			} else if (indx+1)*csize == int(size) {
 				p.found++
 			}
@@ -229,13 +325,23 @@ func gc(ctx *cli.Context) error {
 			if indx*chunkConf.BlockSize+csize != int(size) {
 				logger.Warnf("size of slice %d is %d, but expect %d", cid, indx*chunkConf.BlockSize+csize, size)
 				foundLeaked(obj)
-			} else {
-				p.found++
+				continue
 			}
+			p.found++
+		}
+		if pending[uint64(cid)] {
+			deleting.add(obj.Size())
+		} else {
+			live.add(obj.Size())
 		}
 	}
 	close(leakedObj)
 	wg.Wait()
+	if failed {
+		cp.save(true, flush)
+	} else {
+		cp.done()
+	}
 
 	if p.leaked > 0 {
 		logger.Infof("found %d leaked objects (%d bytes), skipped %d (%d bytes)", p.leaked, p.leakedBytes, skipped, skippedBytes)
@@ -246,5 +352,60 @@ func gc(ctx *cli.Context) error {
 		logger.Infof("scan %d objects, no leaked found", p.found)
 	}
 
+	var frag meta.Fragmentation
+	if r = m.Fragmentation(c, 1, &frag); r != 0 {
+		logger.Warnf("fragmentation of root: %s", r)
+	}
+	var totalspace, availspace, iused, iavail uint64
+	if r = m.StatFS(c, &totalspace, &availspace, &iused, &iavail); r != 0 {
+		logger.Warnf("statfs: %s", r)
+	}
+	printStorageUsage(os.Stdout, []storageRow{
+		{"live data", live, ""},
+		{"pending deletion", deleting, describeBacklog(&backlog)},
+		{"leaked", storageUsage{p.leaked, p.leakedBytes}, ""},
+		{"new (not checked)", storageUsage{int(skipped), skippedBytes}, "uploaded in last hour"},
+	}, totalspace-availspace, frag.Overwritten())
 	return nil
 }
+
+// storageUsage is the number and size of objects in object storage.
+type storageUsage struct {
+	objects int
+	bytes   int64
+}
+
+func (u *storageUsage) add(size int64) {
+	u.objects++
+	u.bytes += size
+}
+
+type storageRow struct {
+	name  string
+	usage storageUsage
+	note  string
+}
+
+func describeBacklog(b *meta.Backlog) string {
+	s := newBacklogStatus(b)
+	return fmt.Sprintf("%d removed files (%s), %d opened files (%s), %d released slices (%s)", s.RemovedFiles,
+		humanizeBytes(s.RemovedBytes), s.OpenedFiles, humanizeBytes(s.OpenedBytes), s.ReleasedSlices, humanizeBytes(s.ReleasedBytes))
+}
+
+// printStorageUsage explains the size of object storage, used is the space used by files and overwritten
+// is the data which is overwritten but not compacted yet, they are the length before compression.
+func printStorageUsage(w io.Writer, rows []storageRow, used, overwritten uint64) {
+	var total storageUsage
+	fmt.Fprintf(w, "%-18s %10s %12s\n", "CATEGORY", "OBJECTS", "SIZE")
+	for _, row := range rows {
+		fmt.Fprintf(w, "%-18s %10d %12s", row.name, row.usage.objects, humanizeBytes(uint64(row.usage.bytes)))
+		if row.note != "" {
+			fmt.Fprintf(w, "  %s", row.note)
+		}
+		fmt.Fprintln(w)
+		total.objects += row.usage.objects
+		total.bytes += row.usage.bytes
+	}
+	fmt.Fprintf(w, "%-18s %10d %12s\n", "total", total.objects, humanizeBytes(uint64(total.bytes)))
+	fmt.Fprintf(w, "Used by files (as df): %s, overwritten but not compacted: %s\n", humanizeBytes(used), humanizeBytes(overwritten))
+}
@@ -0,0 +1,251 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/chunk"
+	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/juicedata/juicefs/pkg/object"
+	osync "github.com/juicedata/juicefs/pkg/sync"
+	"github.com/urfave/cli/v2"
+)
+
+func importFlags() *cli.Command {
+	return &cli.Command{
+		Name:      "import",
+		Usage:     "import existing objects in the bucket as files",
+		ArgsUsage: "REDIS-URL PREFIX [PATH]",
+		Description: `
+The objects under PREFIX of the bucket used by the volume are mapped into files under PATH
+(default: /) without copying, the names of files are the keys with PREFIX trimmed. The objects
+are read directly, so they should not be changed or deleted after imported. The imported
+files are copy-on-write by default: the new data is written into the volume and the objects
+are never modified.`,
+		Action: importObjects,
+		Flags: []cli.Flag{
+			&cli.BoolFlag{
+				Name:  "read-only",
+				Usage: "the content of imported files can't be changed",
+			},
+			&cli.IntFlag{
+				Name:  "threads",
+				Value: 10,
+				Usage: "number of concurrent threads",
+			},
+		},
+	}
+}
+
+type importer struct {
+	m        meta.Meta
+	ctx      meta.Context
+	root     meta.Ino
+	readOnly bool
+
+	sync.Mutex
+	dirs map[string]meta.Ino
+
+	imported, skipped, failed int64
+}
+
+func newImporter(m meta.Meta, root meta.Ino, readOnly bool) *importer {
+	return &importer{
+		m:        m,
+		ctx:      meta.NewContext(0, 0, []uint32{0}),
+		root:     root,
+		readOnly: readOnly,
+		dirs:     map[string]meta.Ino{"": root},
+	}
+}
+
+// mkdirAll returns the inode of dir (relative to root), the missing parents are created.
+func (im *importer) mkdirAll(dir string) (meta.Ino, syscall.Errno) {
+	im.Lock()
+	defer im.Unlock()
+	if dir == "." {
+		dir = ""
+	}
+	if ino, ok := im.dirs[dir]; ok {
+		return ino, 0
+	}
+	parent := im.root
+	var p string
+	for _, name := range strings.Split(dir, "/") {
+		p = path.Join(p, name)
+		if ino, ok := im.dirs[p]; ok {
+			parent = ino
+			continue
+		}
+		var ino meta.Ino
+		var attr meta.Attr
+		st := im.m.Mkdir(im.ctx, parent, name, 0755, 0, 0, &ino, &attr)
+		if st == syscall.EEXIST {
+			st = im.m.Lookup(im.ctx, parent, name, &ino, &attr)
+			if st == 0 && attr.Typ != meta.TypeDirectory {
+				st = syscall.ENOTDIR
+			}
+		}
+		if st != 0 {
+			return 0, st
+		}
+		im.dirs[p] = ino
+		parent = ino
+	}
+	return parent, 0
+}
+
+// importObject creates a file named name which has the content of object key.
+func (im *importer) importObject(key, name string, size int64, mtime time.Time) error {
+	parent, st := im.mkdirAll(path.Dir(name))
+	if st != 0 {
+		return fmt.Errorf("mkdir %s: %s", path.Dir(name), st)
+	}
+	var inode meta.Ino
+	var attr meta.Attr
+	if st = im.m.Create(im.ctx, parent, path.Base(name), 0644, 0, &inode, &attr); st == syscall.EEXIST {
+		// imported before
+		if im.m.Lookup(im.ctx, parent, path.Base(name), &inode, &attr) == 0 && attr.Length != uint64(size) {
+			logger.Warnf("%s exists with different size: %d != %d", name, attr.Length, size)
+		}
+		atomic.AddInt64(&im.skipped, 1)
+		return nil
+	} else if st != 0 {
+		return fmt.Errorf("create %s: %s", name, st)
+	}
+	for indx := uint32(0); int64(indx)*meta.ChunkSize < size; indx++ {
+		off := int64(indx) * meta.ChunkSize
+		length := size - off
+		if length > meta.ChunkSize {
+			length = meta.ChunkSize
+		}
+		var chunkid uint64
+		if st = im.m.NewChunk(im.ctx, inode, indx, 0, &chunkid); st != 0 {
+			return fmt.Errorf("new chunk: %s", st)
+		}
+		chunkid |= chunk.ExternalChunk
+		if err := im.m.AddExternal(chunkid, key, uint64(off)); err != nil {
+			return fmt.Errorf("add external chunk %d: %s", chunkid, err)
+		}
+		if st = im.m.Write(im.ctx, inode, indx, 0, meta.Slice{Chunkid: chunkid, Size: uint32(length), Len: uint32(length)}); st != 0 {
+			return fmt.Errorf("write chunk %d of %s: %s", indx, name, st)
+		}
+	}
+	var set uint16 = meta.SetAttrMtime
+	attr.Mtime = mtime.Unix()
+	attr.Mtimensec = uint32(mtime.Nanosecond())
+	if im.readOnly {
+		set |= meta.SetAttrFlag
+		attr.Flags |= meta.FlagReadOnly
+	}
+	if st = im.m.SetAttr(im.ctx, inode, set, 0, &attr); st != 0 {
+		return fmt.Errorf("setattr %s: %s", name, st)
+	}
+	atomic.AddInt64(&im.imported, 1)
+	return nil
+}
+
+func importObjects(c *cli.Context) error {
+	setLoggerLevel(c)
+	if c.Args().Len() < 2 {
+		return fmt.Errorf("REDIS-URL and PREFIX are needed")
+	}
+	addr := c.Args().Get(0)
+	if !strings.Contains(addr, "://") {
+		addr = "redis://" + addr
+	}
+	prefix := c.Args().Get(1)
+	dst := strings.Trim(c.Args().Get(2), "/")
+
+	logger.Infof("Meta address: %s", addr)
+	var rc = meta.RedisConfig{Retries: 10, Strict: true}
+	m, err := meta.NewClient(addr, &rc)
+	if err != nil {
+		logger.Fatalf("Meta: %s", err)
+	}
+	format, err := m.Load()
+	if err != nil {
+		logger.Fatalf("load setting: %s", err)
+	}
+	if strings.HasPrefix(prefix, format.Name+"/") {
+		logger.Fatalf("can't import the objects of volume %s", format.Name)
+	}
+	blob, err := createExternalStorage(format)
+	if err != nil {
+		logger.Fatalf("object storage: %s", err)
+	}
+
+	readOnly := c.Bool("read-only")
+	root := meta.Ino(1)
+	if dst != "" {
+		var st syscall.Errno
+		if root, st = newImporter(m, root, readOnly).mkdirAll(dst); st != 0 {
+			logger.Fatalf("mkdir %s: %s", dst, st)
+		}
+	}
+	im := newImporter(m, root, readOnly)
+
+	logger.Infof("Importing objects from %s%s into /%s", blob, prefix, dst)
+	objs, err := osync.ListAll(object.WithPrefix(blob, prefix), "", "")
+	if err != nil {
+		logger.Fatalf("list objects: %s", err)
+	}
+	var listed = true
+	todo := make(chan object.Object, 1000)
+	go func() {
+		defer close(todo)
+		for obj := range objs {
+			if obj == nil {
+				listed = false
+				break
+			}
+			if obj.IsDir() || strings.HasSuffix(obj.Key(), "/") || strings.HasPrefix(prefix+obj.Key(), format.Name+"/") {
+				continue
+			}
+			todo <- obj
+		}
+	}()
+	var wg sync.WaitGroup
+	for i := 0; i < c.Int("threads"); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for obj := range todo {
+				name := strings.Trim(path.Clean("/"+obj.Key()), "/")
+				if name == "" {
+					continue
+				}
+				if err := im.importObject(prefix+obj.Key(), name, obj.Size(), obj.Mtime()); err != nil {
+					logger.Errorf("import %s: %s", obj.Key(), err)
+					atomic.AddInt64(&im.failed, 1)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	logger.Infof("Imported %d objects, skipped %d existing files, failed %d", im.imported, im.skipped, im.failed)
+	if im.failed > 0 || !listed {
+		logger.Fatalf("some objects are not imported, please run it again")
+	}
+	return nil
+}
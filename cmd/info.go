@@ -0,0 +1,157 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+
+	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/juicedata/juicefs/pkg/utils"
+	"github.com/juicedata/juicefs/pkg/vfs"
+	"github.com/urfave/cli/v2"
+)
+
+func infoFlags() *cli.Command {
+	return &cli.Command{
+		Name:      "info",
+		Usage:     "show the summary and fragmentation of files or directories",
+		ArgsUsage: "PATH ...",
+		Action:    info,
+		Description: `
+The directories are counted recursively. A chunk has more slices when it's written
+in small pieces or overwritten, the overwritten data is not reclaimed until the
+chunk is compacted.
+
+Examples:
+$ juicefs info /jfs/file
+$ juicefs info /jfs`,
+	}
+}
+
+func humanizeBytes(n uint64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB", "PiB", "EiB"}
+	v := float64(n)
+	i := 0
+	for v >= 1024 && i < len(units)-1 {
+		v /= 1024
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%d B", n)
+	}
+	return fmt.Sprintf("%.1f %s", v, units[i])
+}
+
+func getInfo(path string) (*vfs.FileInfo, error) {
+	inode, err := utils.GetFileInode(path)
+	if err != nil {
+		return nil, fmt.Errorf("lookup inode for %s: %s", path, err)
+	}
+	f := openControler(path)
+	if f == nil {
+		return nil, fmt.Errorf("%s is not inside JuiceFS", path)
+	}
+	defer f.Close()
+	wb := utils.NewBuffer(8 + 8)
+	wb.Put32(meta.Info)
+	wb.Put32(8)
+	wb.Put64(inode)
+	if _, err = f.Write(wb.Bytes()); err != nil {
+		return nil, fmt.Errorf("write message: %s", err)
+	}
+	data, err := ioutil.ReadAll(f)
+	if err != nil && err != io.EOF || len(data) == 0 {
+		return nil, fmt.Errorf("read message: %d %s", len(data), err)
+	}
+	if data[0] != 0 {
+		errno := syscall.Errno(data[0])
+		if runtime.GOOS == "windows" {
+			errno += 0x20000000
+		}
+		return nil, errno
+	}
+	var fi vfs.FileInfo
+	if err = json.Unmarshal(data[1:], &fi); err != nil {
+		return nil, fmt.Errorf("decode %q: %s", data[1:], err)
+	}
+	return &fi, nil
+}
+
+func printInfo(w io.Writer, path string, fi *vfs.FileInfo) {
+	s, f := &fi.Summary, &fi.Fragmentation
+	fmt.Fprintf(w, "%s:\n", path)
+	fmt.Fprintf(w, "  files: %d\n", s.Files)
+	fmt.Fprintf(w, "  dirs: %d\n", s.Dirs)
+	fmt.Fprintf(w, "  length: %s\n", humanizeBytes(s.Length))
+	fmt.Fprintf(w, "  size: %s\n", humanizeBytes(s.Size))
+	fmt.Fprintf(w, "  chunks: %d\n", f.Chunks)
+	fmt.Fprintf(w, "  slices: %d\n", f.Slices)
+	if f.Chunks > 0 {
+		var hist []string
+		var low uint64 = 1
+		for i, n := range f.Histogram {
+			var bucket string
+			switch {
+			case i == len(meta.FragmentBuckets):
+				bucket = fmt.Sprintf(">%d", low-1)
+			case low == meta.FragmentBuckets[i]:
+				bucket = fmt.Sprint(low)
+			default:
+				bucket = fmt.Sprintf("%d-%d", low, meta.FragmentBuckets[i])
+			}
+			if i < len(meta.FragmentBuckets) {
+				low = meta.FragmentBuckets[i] + 1
+			}
+			if n > 0 {
+				hist = append(hist, fmt.Sprintf("%s: %d", bucket, n))
+			}
+		}
+		fmt.Fprintf(w, "  slices per chunk: %s\n", strings.Join(hist, ", "))
+	}
+	var ratio float64
+	if f.SliceBytes > 0 {
+		ratio = float64(f.Overwritten()) * 100 / float64(f.SliceBytes)
+	}
+	fmt.Fprintf(w, "  overwritten: %s (%.1f%% of %s referenced)\n", humanizeBytes(f.Overwritten()), ratio, humanizeBytes(f.SliceBytes))
+}
+
+func info(ctx *cli.Context) error {
+	setLoggerLevel(ctx)
+	if ctx.Args().Len() < 1 {
+		return fmt.Errorf("PATH is needed")
+	}
+	for _, path := range ctx.Args().Slice() {
+		p, err := filepath.Abs(path)
+		if err != nil {
+			logger.Errorf("abs of %s: %s", path, err)
+			continue
+		}
+		fi, err := getInfo(p)
+		if err != nil {
+			logger.Errorf("info of %s: %s", path, err)
+			continue
+		}
+		printInfo(ctx.App.Writer, path, fi)
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/jobs"
+	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/juicedata/juicefs/pkg/utils"
+	"github.com/urfave/cli/v2"
+)
+
+func jobsFlags() *cli.Command {
+	return &cli.Command{
+		Name:      "jobs",
+		Usage:     "list, pause or resume the background jobs of a mount point",
+		ArgsUsage: "MOUNTPOINT [pause|resume [JOB ...]]",
+		Action:    manageJobs,
+		Description: `
+The jobs are compaction, deletion, cleanup and replication, all of them are paused
+or resumed if no JOB is given. The running ones are not interrupted by pausing.
+
+Examples:
+$ juicefs jobs /jfs
+$ juicefs jobs /jfs pause compaction deletion
+$ juicefs jobs /jfs resume`,
+	}
+}
+
+func printJobs(w io.Writer, st *jobs.Status) {
+	if st.Windows != "" {
+		state := "outside"
+		if st.InWindow {
+			state = "inside"
+		}
+		fmt.Fprintf(w, "Maintenance windows: %s (%s now)\n", st.Windows, state)
+	}
+	switch {
+	case st.Disabled:
+		fmt.Fprintf(w, "Background jobs are disabled on this client\n")
+	case st.Leader:
+		fmt.Fprintf(w, "Leader: yes\n")
+	default:
+		fmt.Fprintf(w, "Leader: no, the exclusive jobs run on another client\n")
+	}
+	fmt.Fprintf(w, "%-12s %-8s %8s %8s %10s %10s  %s\n", "JOB", "STATE", "RUNNING", "LIMIT", "DONE", "SKIPPED", "LAST STARTED")
+	for _, j := range st.Jobs {
+		state, limit, last := "active", "-", "-"
+		if st.Disabled {
+			state = "disabled"
+		} else if j.Paused {
+			state = "paused"
+		} else if time.Now().Before(j.HeldUntil) {
+			state = "held"
+		} else if j.Exclusive && !st.Leader {
+			state = "standby"
+		}
+		if j.Limit > 0 {
+			limit = fmt.Sprint(j.Limit)
+		}
+		if !j.Last.IsZero() {
+			last = j.Last.Format("2006-01-02 15:04:05")
+		}
+		fmt.Fprintf(w, "%-12s %-8s %8d %8s %10d %10d  %s\n", j.Name, state, j.Running, limit, j.Done, j.Skipped, last)
+	}
+}
+
+func manageJobs(ctx *cli.Context) error {
+	setLoggerLevel(ctx)
+	if ctx.Args().Len() < 1 {
+		return fmt.Errorf("MOUNTPOINT is needed")
+	}
+	var op uint8
+	switch ctx.Args().Get(1) {
+	case "":
+	case "pause":
+		op = 1
+	case "resume":
+		op = 2
+	default:
+		return fmt.Errorf("unknown action %q, it should be pause or resume", ctx.Args().Get(1))
+	}
+	var names string
+	if ctx.Args().Len() > 2 {
+		names = strings.Join(ctx.Args().Slice()[2:], "\n")
+	}
+	f := openControler(ctx.Args().Get(0))
+	if f == nil {
+		return fmt.Errorf("%s is not inside JuiceFS", ctx.Args().Get(0))
+	}
+	defer f.Close()
+	wb := utils.NewBuffer(8 + 1 + uint32(len(names)))
+	wb.Put32(meta.Jobs)
+	wb.Put32(1 + uint32(len(names)))
+	wb.Put8(op)
+	wb.Put([]byte(names))
+	if _, err := f.Write(wb.Bytes()); err != nil {
+		return fmt.Errorf("write message: %s", err)
+	}
+	data, err := ioutil.ReadAll(f)
+	if err != nil && err != io.EOF || len(data) == 0 {
+		return fmt.Errorf("read message: %d %s", len(data), err)
+	}
+	if data[0] != 0 {
+		return fmt.Errorf("%s: %s", syscall.Errno(data[0]), data[1:])
+	}
+	var st jobs.Status
+	if err = json.Unmarshal(data[1:], &st); err != nil {
+		return fmt.Errorf("decode %q: %s", data[1:], err)
+	}
+	printJobs(ctx.App.Writer, &st)
+	return nil
+}
@@ -0,0 +1,85 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"math"
+	"runtime"
+	"strconv"
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/utils"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/urfave/cli/v2"
+)
+
+// The buffers are allocated from Go heap, which could grow to twice of them before GC.
+const bufferShare = 4
+
+// setupLimits applies the limits of CPU and memory, which are derived from the limits
+// of cgroup by default. It should be called before the buffer size is used.
+func setupLimits(c *cli.Context) {
+	cg := utils.GetCgroupLimits()
+	procs := c.Int("max-procs")
+	if procs == 0 && cg.CPUs > 0 {
+		procs = int(math.Ceil(cg.CPUs))
+	}
+	if procs > 0 && procs < runtime.NumCPU() {
+		runtime.GOMAXPROCS(procs)
+		logger.Infof("Use at most %d of %d CPUs", procs, runtime.NumCPU())
+	}
+	memLimit := int64(c.Int("memory-limit")) << 20
+	if memLimit == 0 {
+		memLimit = cg.Memory
+	}
+	if memLimit > 0 {
+		if max := int(memLimit / bufferShare >> 20); c.Int("buffer-size") > max {
+			logger.Warnf("Reduce buffer-size from %d MiB to %d MiB, which is 1/%d of the memory limit", c.Int("buffer-size"), max, bufferShare)
+			_ = c.Set("buffer-size", strconv.Itoa(max))
+		}
+	}
+
+	_ = prometheus.Register(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "cpu_limit",
+		Help: "Max number of CPUs used at the same time.",
+	}, func() float64 { return float64(runtime.GOMAXPROCS(0)) }))
+	_ = prometheus.Register(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "memory_limit",
+		Help: "Memory limit in bytes, 0 means unlimited.",
+	}, func() float64 { return float64(memLimit) }))
+	_ = prometheus.Register(prometheus.NewCounterFunc(prometheus.CounterOpts{
+		Name: "cpu_throttled_seconds",
+		Help: "Time throttled because of the CPU quota of cgroup.",
+	}, func() float64 { return utils.CgroupThrottled().Seconds() }))
+	go watchLimits(cg.CPUs, memLimit)
+}
+
+// watchLimits warns when the CPU quota or memory limit may be the bottleneck.
+func watchLimits(cpus float64, memLimit int64) {
+	const interval = time.Minute
+	last := utils.CgroupThrottled()
+	for {
+		time.Sleep(interval)
+		throttled := utils.CgroupThrottled()
+		if ratio := float64(throttled-last) / float64(interval); ratio > 0.1 {
+			logger.Warnf("Throttled for %.0f%% of the last minute because of the CPU quota (%.1f CPUs) of cgroup, it may limit the throughput", ratio*100, cpus)
+		}
+		last = throttled
+		if _, rss := utils.MemoryUsage(); memLimit > 0 && rss > uint64(memLimit)*9/10 {
+			logger.Warnf("Memory usage %d MiB is close to the limit %d MiB, reduce buffer-size or raise the limit", rss>>20, memLimit>>20)
+		}
+	}
+}
@@ -24,6 +24,8 @@ import (
 
 	"github.com/sirupsen/logrus"
 
+	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/juicedata/juicefs/pkg/object"
 	"github.com/juicedata/juicefs/pkg/utils"
 	"github.com/juicedata/juicefs/pkg/version"
 	"github.com/urfave/cli/v2"
@@ -56,7 +58,23 @@ func main() {
 				Name:  "trace",
 				Usage: "enable trace log",
 			},
+			&cli.StringFlag{
+				Name:    "ca-file",
+				EnvVars: []string{"JFS_CA_FILE"},
+				Usage:   "PEM file of the CA certificates trusted by the TLS connections to object storage and Redis, besides the system ones",
+			},
+			&cli.StringSliceFlag{
+				Name:    "pinned-keys",
+				EnvVars: []string{"JFS_PINNED_KEYS"},
+				Usage:   "only accept the TLS servers with these public keys (base64 of SHA256 of SubjectPublicKeyInfo) in their chains",
+			},
+			&cli.StringFlag{
+				Name:    "ip-family",
+				EnvVars: []string{"JFS_IP_FAMILY"},
+				Usage:   "preferred IP family (ipv4 or ipv6) to connect to object storage and Redis, in the order of DNS by default",
+			},
 		},
+		Before: setupNetwork,
 		Commands: []*cli.Command{
 			formatFlags(),
 			mountFlags(),
@@ -67,6 +85,28 @@ func main() {
 			benchmarkFlags(),
 			gcFlags(),
 			checkFlags(),
+			scrubFlags(),
+			rebucketFlags(),
+			importFlags(),
+			exportFlags(),
+			quotaFlags(),
+			tagFlags(),
+			findFlags(),
+			gatewayUserFlags(),
+			statusFlags(),
+			faultFlags(),
+			verifyFlags(),
+			replayFlags(),
+			infoFlags(),
+			jobsFlags(),
+			pinFlags(),
+			statsFlags(),
+			freezeFlags(),
+			backupFlags(),
+			restoreFlags(),
+			agentFlags(),
+			shrinkFlags(),
+			upgradeMetaFlags(),
 		},
 	}
 
@@ -228,6 +268,25 @@ func reorderOptions(app *cli.App, args []string) []string {
 	return append(newArgs, others...)
 }
 
+// setupNetwork applies the preferred IP family, trusted CAs and pinned keys to the connections to
+// object storage and Redis, the proxies for object storage are set by HTTPS_PROXY and NO_PROXY.
+func setupNetwork(c *cli.Context) error {
+	switch f := strings.ToLower(c.String("ip-family")); f {
+	case "", "ipv4", "ipv6":
+		utils.IPFamily = f
+	default:
+		return fmt.Errorf("invalid IP family %q, it should be ipv4 or ipv6", f)
+	}
+	conf, err := utils.NewTLSConfig(c.String("ca-file"), c.StringSlice("pinned-keys"))
+	if err != nil || conf == nil {
+		return err
+	}
+	object.DefaultHTTPConfig.TLS = conf
+	object.SetHTTPConfig(&object.DefaultHTTPConfig)
+	meta.SetTLSConfig(conf)
+	return nil
+}
+
 func setLoggerLevel(c *cli.Context) {
 	if c.Bool("trace") {
 		utils.SetLogLevel(logrus.TraceLevel)
@@ -16,6 +16,7 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
 	_ "net/http/pprof"
@@ -25,18 +26,23 @@ import (
 	"path"
 	"path/filepath"
 	"runtime"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
 
 	"github.com/google/gops/agent"
+	"github.com/google/uuid"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/urfave/cli/v2"
 
 	"github.com/juicedata/juicefs/pkg/chunk"
+	"github.com/juicedata/juicefs/pkg/fault"
+	"github.com/juicedata/juicefs/pkg/jobs"
 	"github.com/juicedata/juicefs/pkg/meta"
 	"github.com/juicedata/juicefs/pkg/object"
+	"github.com/juicedata/juicefs/pkg/qos"
 	"github.com/juicedata/juicefs/pkg/usage"
 	"github.com/juicedata/juicefs/pkg/utils"
 	"github.com/juicedata/juicefs/pkg/version"
@@ -108,6 +114,8 @@ func installHandler(mp string) {
 					}
 				} else if runtime.GOOS == "darwin" {
 					_ = exec.Command("diskutil", "umount", "force", mp).Run()
+				} else if runtime.GOOS == "freebsd" {
+					_ = exec.Command("umount", "-f", mp).Run()
 				}
 			}()
 			go func() {
@@ -137,16 +145,62 @@ func mount(c *cli.Context) error {
 		}
 	}
 
+	setupJobs(c)
+	setupQoS(c)
+	setupHTTP(c)
 	logger.Infof("Meta address: %s", addr)
-	var rc = meta.RedisConfig{Retries: 10, Strict: true}
-	m, err := meta.NewRedisMeta(addr, &rc)
+	anonymous := c.Bool("anonymous")
+	var rc = meta.RedisConfig{
+		Retries:      10,
+		Strict:       true,
+		ReadReplica:  c.String("read-replica"),
+		MaxStaleness: time.Duration(c.Float64("max-staleness") * float64(time.Second)),
+		Token:        clientToken(c),
+		Heartbeat:    time.Duration(c.Int("heartbeat")) * time.Second,
+		Grace:        time.Duration(c.Float64("meta-grace") * float64(time.Second)),
+		ReadOnly:     c.Bool("cache-only") || anonymous,
+		NoBGJob:      noBGJob(c) || anonymous,
+		HotCache:     time.Duration(c.Float64("hot-cache") * float64(time.Second)),
+	}
+	m, err := meta.NewClient(addr, &rc)
 	if err != nil {
 		logger.Fatalf("Meta: %s", err)
 	}
 	format, err := m.Load()
+	if err != nil && strings.HasPrefix(addr, "memkv://") {
+		// a scratch volume, everything is lost after unmounted
+		format = &meta.Format{
+			Name:        "scratch",
+			UUID:        uuid.New().String(),
+			Storage:     "mem",
+			BlockSize:   4096,
+			Compression: "none",
+			MetaVersion: meta.MetaVersion,
+		}
+		err = m.Init(*format, false)
+	}
 	if err != nil {
 		logger.Fatalf("load setting: %s", err)
 	}
+	if format.Storage == "http" && !anonymous {
+		// the HTTP object storage can't be written
+		anonymous = true
+		rc.ReadOnly, rc.NoBGJob = true, true
+		if format, err = m.Load(); err != nil {
+			logger.Fatalf("load setting: %s", err)
+		}
+	}
+	if anonymous {
+		logger.Infof("Read the object storage without credentials, writes are rejected with EROFS")
+		format.AccessKey, format.SecretKey = object.AnonymousKey, ""
+		if format.ReplicaStorage != "" {
+			format.ReplicaAccessKey, format.ReplicaSecretKey = object.AnonymousKey, ""
+		}
+	}
+	if fault.Enabled {
+		logger.Warnf("Fault injection is enabled, it should be used only for testing")
+		m = meta.WithFaults(m)
+	}
 
 	mntLabels := prometheus.Labels{
 		"vol_name": format.Name,
@@ -156,9 +210,16 @@ func mount(c *cli.Context) error {
 	prometheus.DefaultRegisterer = prometheus.WrapRegistererWith(mntLabels,
 		prometheus.WrapRegistererWithPrefix("juicefs_", prometheus.DefaultRegisterer))
 
+	setupLimits(c)
 	chunkConf := chunk.Config{
-		BlockSize: format.BlockSize * 1024,
-		Compress:  format.Compression,
+		BlockSize:  format.BlockSize * 1024,
+		Compress:   format.Compression,
+		PackSize:   format.PackSize << 10,
+		PackIndex:  m,
+		Dedup:      format.Dedup,
+		DedupIndex: m,
+
+		ExternalIndex: m,
 
 		GetTimeout: time.Second * time.Duration(c.Int("get-timeout")),
 		PutTimeout: time.Second * time.Duration(c.Int("put-timeout")),
@@ -166,13 +227,30 @@ func mount(c *cli.Context) error {
 		Writeback:  c.Bool("writeback"),
 		Prefetch:   c.Int("prefetch"),
 		BufferSize: c.Int("buffer-size") << 20,
+		Multipart: object.MultipartConfig{
+			Threshold: c.Int("multipart-threshold") << 20,
+			PartSize:  c.Int("part-size") << 20,
+			Threads:   c.Int("part-threads"),
+		},
 
-		CacheDir:       c.String("cache-dir"),
-		CacheSize:      int64(c.Int("cache-size")),
-		FreeSpace:      float32(c.Float64("free-space-ratio")),
-		CacheMode:      os.FileMode(0600),
-		CacheFullBlock: !c.Bool("cache-partial-only"),
-		AutoCreate:     true,
+		CacheDir:        c.String("cache-dir"),
+		CacheSize:       int64(c.Int("cache-size")),
+		SharedCacheSize: int64(c.Int("shared-cache-size")),
+		PinSize:         int64(c.Int("pin-size")),
+		CacheEviction:   c.String("cache-eviction"),
+		CacheIO:         c.String("cache-io"),
+		CacheDirect:     c.Bool("cache-direct"),
+		FreeSpace:       float32(c.Float64("free-space-ratio")),
+		CacheMode:       os.FileMode(0600),
+		CacheFullBlock:  !c.Bool("cache-partial-only"),
+		DegradedRead:    c.Bool("degraded-read"),
+		AutoCreate:      true,
+	}
+	if err := chunk.CheckEvictPolicy(chunkConf.CacheEviction); err != nil {
+		logger.Fatalf("%s", err)
+	}
+	if err := chunk.CheckCacheIO(chunkConf.CacheIO); err != nil {
+		logger.Fatalf("%s", err)
 	}
 	if chunkConf.CacheDir != "memory" {
 		ds := utils.SplitDir(chunkConf.CacheDir)
@@ -181,12 +259,21 @@ func mount(c *cli.Context) error {
 		}
 		chunkConf.CacheDir = strings.Join(ds, string(os.PathListSeparator))
 	}
-	blob, err := createStorage(format)
+	blob, err := createReplicatedStorage(format, m, c.Bool("failover"), c.Bool("failover-write"))
 	if err != nil {
 		logger.Fatalf("object storage: %s", err)
 	}
 	logger.Infof("Data use %s", blob)
+	if err = checkUUID(format, !rc.ReadOnly); err != nil {
+		logger.Fatalf("check volume: %s", err)
+	}
 	blob = object.WithMetrics(blob)
+	if fault.Enabled {
+		blob = object.WithFaults(blob)
+	}
+	if chunkConf.ExternalStorage, err = createExternalStorage(format); err != nil {
+		logger.Fatalf("object storage: %s", err)
+	}
 	store := chunk.NewCachedStore(blob, chunkConf)
 	m.OnMsg(meta.DeleteChunk, meta.MsgCallback(func(args ...interface{}) error {
 		chunkid := args[0].(uint64)
@@ -211,6 +298,11 @@ func mount(c *cli.Context) error {
 		Version:    version.Version(),
 		Mountpoint: mp,
 		Chunk:      &chunkConf,
+		// the buffered data can be committed when capacity is almost reached
+		CapacityGrace: uint64(c.Int("buffer-size")) << 20,
+		Delegation:    c.Bool("delegation"),
+		Checksum:      c.Bool("checksum"),
+		Events:        c.StringSlice("event-target"),
 	}
 	vfs.Init(conf, m, store)
 
@@ -252,6 +344,7 @@ func mount(c *cli.Context) error {
 
 	meta.InitMetrics()
 	vfs.InitMetrics()
+	qos.InitMetrics()
 	go updateMetrics(m)
 	http.Handle("/metrics", promhttp.HandlerFor(
 		prometheus.DefaultGatherer,
@@ -261,6 +354,8 @@ func mount(c *cli.Context) error {
 		},
 	))
 	prometheus.MustRegister(prometheus.NewBuildInfoCollector())
+	vfs.RegisterHealthCheck("object", func() error { return checkStorage(blob) })
+	http.HandleFunc("/health", healthHandler(mp))
 	go func() {
 		err = http.ListenAndServe(c.String("metrics"), nil)
 		if err != nil {
@@ -275,6 +370,97 @@ func mount(c *cli.Context) error {
 	return nil
 }
 
+// checkStorage checks that the object storage is reachable by listing it, or checking
+// the root directory if listing is not supported (file, hdfs and sftp).
+func checkStorage(blob object.ObjectStorage) error {
+	_, err := blob.List("", "", 1)
+	if err != nil && err.Error() == "not supported" {
+		_, err = blob.Head("")
+	}
+	return err
+}
+
+// healthHandler serves the health of the mount for liveness and readiness probes,
+// the status is 503 if any check fails.
+func healthHandler(mp string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		timeout := time.Second * 10
+		if t, err := strconv.ParseFloat(r.URL.Query().Get("timeout"), 64); err == nil && t > 0 {
+			timeout = time.Duration(t * float64(time.Second))
+		}
+		var fuse *vfs.HealthCheck
+		done := make(chan struct{})
+		go func() {
+			// a random name can't be cached by kernel, so it's looked up by the FUSE loop
+			fuse = vfs.RunHealthCheck("fuse", func() error {
+				_, err := os.Lstat(filepath.Join(mp, fmt.Sprintf(".health-%d", time.Now().UnixNano())))
+				if os.IsNotExist(err) {
+					return nil
+				}
+				return err
+			}, timeout)
+			close(done)
+		}()
+		h := vfs.CheckHealth(timeout)
+		<-done
+		h.Checks = append([]*vfs.HealthCheck{fuse}, h.Checks...)
+		h.OK = h.OK && fuse.OK
+		w.Header().Set("Content-Type", "application/json")
+		if !h.OK {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		data, _ := json.MarshalIndent(h, "", "  ")
+		_, _ = w.Write(append(data, '\n'))
+	}
+}
+
+// setupJobs applies the settings of background jobs.
+func setupJobs(c *cli.Context) {
+	if err := jobs.SetWindows(c.String("maintenance-window")); err != nil {
+		logger.Fatalf("maintenance window: %s", err)
+	}
+	jobs.SetLimit(jobs.Compaction, c.Int("max-compactions"))
+	jobs.SetLimit(jobs.Deletion, c.Int("max-deletions"))
+	if noBGJob(c) {
+		jobs.Disable()
+	}
+}
+
+// setupQoS applies the bandwidth budgets of I/O classes.
+func setupQoS(c *cli.Context) {
+	if err := qos.SetLimits(c.String("io-limit")); err != nil {
+		logger.Fatalf("io limit: %s", err)
+	}
+	if err := qos.SetSchedules(c.String("io-schedule")); err != nil {
+		logger.Fatalf("io schedule: %s", err)
+	}
+}
+
+// setupHTTP applies the settings of the HTTP client to object storage.
+func setupHTTP(c *cli.Context) {
+	object.SetHTTPConfig(&object.HTTPConfig{
+		MaxIdleConnsPerHost: c.Int("max-idle-conns"),
+		MaxConnsPerHost:     c.Int("max-conns-per-host"),
+		IdleConnTimeout:     time.Duration(c.Int("idle-conn-timeout")) * time.Second,
+		HTTP2:               c.Bool("http2"),
+		TLSSessionCache:     c.Int("tls-session-cache"),
+		TLS:                 object.DefaultHTTPConfig.TLS,
+	})
+}
+
+// noBGJob returns true if the background jobs should be left to other clients.
+func noBGJob(c *cli.Context) bool {
+	return c.Bool("no-bgjob") || c.Bool("cache-only")
+}
+
+// clientToken returns the access token from flag or environment variable.
+func clientToken(c *cli.Context) string {
+	if c.String("token") != "" {
+		return c.String("token")
+	}
+	return os.Getenv("JFS_TOKEN")
+}
+
 func clientFlags() []cli.Flag {
 	var defaultCacheDir = "/var/jfsCache"
 	switch runtime.GOOS {
@@ -306,13 +492,58 @@ func clientFlags() []cli.Flag {
 		},
 		&cli.IntFlag{
 			Name:  "max-uploads",
-			Value: 20,
-			Usage: "number of connections to upload",
+			Usage: "number of connections to upload, 0 means tuned automatically by the latency",
+		},
+		&cli.IntFlag{
+			Name:  "multipart-threshold",
+			Value: object.DefaultMultipartConfig.Threshold >> 20,
+			Usage: "upload the blocks larger than this (in MiB) part by part, 0 means disabled",
+		},
+		&cli.IntFlag{
+			Name:  "part-size",
+			Value: object.DefaultMultipartConfig.PartSize >> 20,
+			Usage: "size of parts (in MiB) in multipart upload",
+		},
+		&cli.IntFlag{
+			Name:  "part-threads",
+			Value: object.DefaultMultipartConfig.Threads,
+			Usage: "number of parts of a block uploaded concurrently",
+		},
+		&cli.IntFlag{
+			Name:  "max-idle-conns",
+			Value: object.DefaultHTTPConfig.MaxIdleConnsPerHost,
+			Usage: "max number of idle HTTP connections kept for each host of object storage",
+		},
+		&cli.IntFlag{
+			Name:  "max-conns-per-host",
+			Usage: "max number of HTTP connections to each host of object storage (0 means unlimited)",
+		},
+		&cli.IntFlag{
+			Name:  "idle-conn-timeout",
+			Value: int(object.DefaultHTTPConfig.IdleConnTimeout / time.Second),
+			Usage: "number of seconds to keep an idle HTTP connection",
+		},
+		&cli.BoolFlag{
+			Name:  "http2",
+			Usage: "try HTTP/2 for object storage over HTTPS",
+		},
+		&cli.IntFlag{
+			Name:  "tls-session-cache",
+			Value: object.DefaultHTTPConfig.TLSSessionCache,
+			Usage: "number of TLS sessions cached to resume connections (0 means disabled)",
 		},
 		&cli.IntFlag{
 			Name:  "buffer-size",
 			Value: 300,
-			Usage: "total read/write buffering in MB",
+			Usage: "total read/write buffering in MB, shared by all files",
+		},
+		&cli.IntFlag{
+			Name:  "max-procs",
+			Usage: "max number of CPUs used at the same time (GOMAXPROCS), 0 means the CPU quota of cgroup or all the CPUs",
+		},
+		&cli.IntFlag{
+			Name:  "memory-limit",
+			Usage: "memory limit in MiB, buffer-size is capped by a quarter of it, 0 means the memory limit of cgroup",
 		},
 		&cli.IntFlag{
 			Name:  "prefetch",
@@ -334,15 +565,105 @@ func clientFlags() []cli.Flag {
 			Value: 1 << 10,
 			Usage: "size of cached objects in MiB",
 		},
+		&cli.IntFlag{
+			Name:  "pin-size",
+			Usage: "size of pinned objects in cache in MiB, they're counted in cache-size and never evicted, 0 means pinning is disabled",
+		},
+		&cli.IntFlag{
+			Name:  "shared-cache-size",
+			Usage: "size of cached objects in MiB of all the mounts sharing the cache directories on this host, 0 means not shared",
+		},
 		&cli.Float64Flag{
 			Name:  "free-space-ratio",
 			Value: 0.1,
 			Usage: "min free space (ratio)",
 		},
+		&cli.StringFlag{
+			Name:  "cache-eviction",
+			Value: chunk.EvictRandom,
+			Usage: "policy to evict the cached objects: 2-random, lru, lfu or fifo",
+		},
+		&cli.StringFlag{
+			Name:  "cache-io",
+			Value: chunk.CacheIOPsync,
+			Usage: "engine to read and write the cache files: psync or io_uring (Linux 5.1+)",
+		},
+		&cli.BoolFlag{
+			Name:  "cache-direct",
+			Usage: "read and write the cache files with direct I/O (O_DIRECT), so they're not kept in the page cache of kernel",
+		},
 		&cli.BoolFlag{
 			Name:  "cache-partial-only",
 			Usage: "cache only random/small read",
 		},
+		&cli.BoolFlag{
+			Name:  "degraded-read",
+			Usage: "read only the cached blocks when the object storage is unreachable, others fail with EIO",
+		},
+		&cli.BoolFlag{
+			Name:  "failover",
+			Usage: "read from the replica when the object storage is unhealthy",
+		},
+		&cli.BoolFlag{
+			Name:  "failover-write",
+			Usage: "also write into the replica when the object storage is unhealthy",
+		},
+		&cli.StringFlag{
+			Name:  "read-replica",
+			Usage: "URL of a Redis replica to serve lookup, getattr and readdir",
+		},
+		&cli.Float64Flag{
+			Name:  "max-staleness",
+			Value: 5,
+			Usage: "max seconds the read replica can lag behind before reading from primary",
+		},
+		&cli.StringFlag{
+			Name:  "token",
+			Usage: "access token of the volume (or JFS_TOKEN)",
+		},
+		&cli.IntFlag{
+			Name:  "heartbeat",
+			Value: 60,
+			Usage: "interval in seconds to refresh the session, at most 60",
+		},
+		&cli.Float64Flag{
+			Name:  "meta-grace",
+			Value: 30,
+			Usage: "seconds to wait for Redis to recover from an outage before operations fail with EIO",
+		},
+		&cli.Float64Flag{
+			Name:  "hot-cache",
+			Usage: "seconds to cache the attributes of hot directories, 0 means disabled",
+		},
+		&cli.StringFlag{
+			Name:  "maintenance-window",
+			Usage: "run the background jobs only in the windows, e.g. \"mon-fri 22:00-06:00; sat,sun 00:00-24:00\"",
+		},
+		&cli.IntFlag{
+			Name:  "max-compactions",
+			Value: 10,
+			Usage: "max number of chunks compacted concurrently (0 means unlimited)",
+		},
+		&cli.IntFlag{
+			Name:  "max-deletions",
+			Usage: "max number of removed files deleted concurrently (0 means unlimited)",
+		},
+		&cli.StringFlag{
+			Name:  "io-limit",
+			Usage: "bandwidth limits of I/O classes in Mbps, e.g. \"prefetch=100,compaction=50,replication=200\"",
+		},
+		&cli.StringFlag{
+			Name:  "io-schedule",
+			Usage: "bandwidth limits of I/O classes in Mbps in some windows, e.g. \"replication@00:00-06:00=0; replication@mon-fri 09:00-18:00=10\", --io-limit applies out of them",
+		},
+		&cli.BoolFlag{
+			Name:  "no-bgjob",
+			Usage: "do not run background jobs, leave them to other clients or the agent",
+		},
+		&cli.BoolFlag{
+			Name:  "cache-only",
+			Usage: "read-only client serving from the object storage and local cache, without background jobs",
+		},
 	}
 }
 
@@ -351,17 +672,36 @@ func mountFlags() *cli.Command {
 		Name:      "mount",
 		Usage:     "mount a volume",
 		ArgsUsage: "REDIS-URL MOUNTPOINT",
-		Action:    mount,
+		Description: `
+Use memkv://scratch as REDIS-URL to mount a scratch volume in memory without formatting,
+all the data is lost after unmounted.`,
+		Action: mount,
 		Flags: []cli.Flag{
 			&cli.StringFlag{
 				Name:  "metrics",
 				Value: ":9567",
-				Usage: "address to export metrics",
+				Usage: "address to export metrics and health (/health)",
 			},
 			&cli.BoolFlag{
 				Name:  "no-usage-report",
 				Usage: "do not send usage report",
 			},
+			&cli.BoolFlag{
+				Name:  "delegation",
+				Usage: "acquire write delegations of the opened files to cache the dirty data longer, until they're opened by other clients",
+			},
+			&cli.BoolFlag{
+				Name:  "checksum",
+				Usage: "compute the SHA256 of files after they're written and closed, which is read from xattr juicefs.checksum (used by sync --checksum)",
+			},
+			&cli.StringSliceFlag{
+				Name:  "event-target",
+				Usage: "send the changes of files made by this client as S3 events to a webhook (http://), Kafka (kafka://) or Redis stream (redis://)",
+			},
+			&cli.BoolFlag{
+				Name:  "anonymous",
+				Usage: "read the object storage without credentials (public bucket), the volume is mounted read-only",
+			},
 		},
 	}
 	cmd.Flags = append(cmd.Flags, mount_flags()...)
@@ -20,6 +20,7 @@ package main
 import (
 	"os"
 	"path/filepath"
+	"runtime"
 	"syscall"
 	"time"
 
@@ -103,14 +104,19 @@ func mount_flags() []cli.Flag {
 		},
 		&cli.BoolFlag{
 			Name:  "enable-xattr",
-			Usage: "enable extended attributes (xattr)",
+			Value: runtime.GOOS == "darwin",
+			Usage: "enable extended attributes (xattr), which is enabled on macOS by default to keep the metadata of Finder",
+		},
+		&cli.BoolFlag{
+			Name:  "splice-read",
+			Usage: "splice data from cached blocks into FUSE without copying",
 		},
 	}
 }
 
 func mount_main(conf *vfs.Config, m meta.Meta, store chunk.ChunkStore, c *cli.Context) {
 	logger.Infof("Mounting volume %s at %s ...", conf.Format.Name, conf.Mountpoint)
-	err := fuse.Serve(conf, c.String("o"), c.Float64("attr-cache"), c.Float64("entry-cache"), c.Float64("dir-entry-cache"), c.Bool("enable-xattr"))
+	err := fuse.Serve(conf, c.String("o"), c.Float64("attr-cache"), c.Float64("entry-cache"), c.Float64("dir-entry-cache"), c.Bool("enable-xattr"), c.Bool("splice-read"))
 	if err != nil {
 		logger.Fatalf("fuse: %s", err)
 	}
@@ -0,0 +1,146 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"syscall"
+
+	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/juicedata/juicefs/pkg/utils"
+	"github.com/juicedata/juicefs/pkg/vfs"
+	"github.com/urfave/cli/v2"
+)
+
+func pinFlags() *cli.Command {
+	return &cli.Command{
+		Name:      "pin",
+		Usage:     "keep the data of files in local cache",
+		ArgsUsage: "PATH ...",
+		Action:    pin,
+		Flags: []cli.Flag{
+			&cli.BoolFlag{
+				Name:  "unpin",
+				Usage: "make the data evictable again",
+			},
+		},
+		Description: `
+The blocks of the files are downloaded into the cache of the mount point if they're
+not cached, and they're not evicted until unpinned, up to the size set by --pin-size
+of the mount point. The directories are pinned recursively. The data written or
+compacted after pinning is not pinned.
+
+Examples:
+$ juicefs pin /jfs/models/bert
+$ juicefs pin --unpin /jfs/models/bert`,
+	}
+}
+
+func pinPath(path string, unpin bool) (*vfs.PinResult, error) {
+	inode, err := utils.GetFileInode(path)
+	if err != nil {
+		return nil, fmt.Errorf("lookup inode for %s: %s", path, err)
+	}
+	f := openControler(path)
+	if f == nil {
+		return nil, fmt.Errorf("%s is not inside JuiceFS", path)
+	}
+	defer f.Close()
+	var op uint8 = 1
+	if unpin {
+		op = 0
+	}
+	wb := utils.NewBuffer(8 + 8 + 1)
+	wb.Put32(meta.Pin)
+	wb.Put32(8 + 1)
+	wb.Put64(inode)
+	wb.Put8(op)
+	if _, err = f.Write(wb.Bytes()); err != nil {
+		return nil, fmt.Errorf("write message: %s", err)
+	}
+	data, err := ioutil.ReadAll(f)
+	if err != nil && err != io.EOF || len(data) == 0 {
+		return nil, fmt.Errorf("read message: %d %s", len(data), err)
+	}
+	if data[0] != 0 {
+		errno := syscall.Errno(data[0])
+		if runtime.GOOS == "windows" {
+			errno += 0x20000000
+		}
+		if len(data) > 1 {
+			return nil, fmt.Errorf("%s: %s", errno, data[1:])
+		}
+		return nil, errno
+	}
+	var res vfs.PinResult
+	if err = json.Unmarshal(data[1:], &res); err != nil {
+		return nil, fmt.Errorf("decode %q: %s", data[1:], err)
+	}
+	return &res, nil
+}
+
+func pin(ctx *cli.Context) error {
+	setLoggerLevel(ctx)
+	if ctx.Args().Len() < 1 {
+		return fmt.Errorf("PATH is needed")
+	}
+	unpin := ctx.Bool("unpin")
+	verb := "pin"
+	if unpin {
+		verb = "unpin"
+	}
+	var files, blocks int
+	var last *vfs.PinResult
+	var err error
+	for _, path := range ctx.Args().Slice() {
+		var p string
+		if p, err = filepath.Abs(path); err != nil {
+			return fmt.Errorf("abs of %s: %s", path, err)
+		}
+		err = filepath.Walk(p, func(path string, fi os.FileInfo, err error) error {
+			if err != nil {
+				logger.Errorf("walk %s: %s", path, err)
+				return nil
+			}
+			if !fi.Mode().IsRegular() {
+				return nil
+			}
+			res, err := pinPath(path, unpin)
+			if err != nil {
+				return fmt.Errorf("%s %s: %s", verb, path, err)
+			}
+			files++
+			blocks += res.Blocks
+			last = res
+			return nil
+		})
+		if err != nil {
+			break
+		}
+	}
+	fmt.Fprintf(ctx.App.Writer, "%sned %d blocks of %d files\n", verb, blocks, files)
+	if last != nil {
+		st := &last.Stats
+		fmt.Fprintf(ctx.App.Writer, "pinned in cache: %d blocks, %s of %s\n", st.Blocks, humanizeBytes(uint64(st.Bytes)), humanizeBytes(uint64(st.Limit)))
+	}
+	return err
+}
@@ -0,0 +1,176 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"os/user"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/urfave/cli/v2"
+)
+
+func quotaFlags() *cli.Command {
+	return &cli.Command{
+		Name:      "quota",
+		Usage:     "Report the space and inodes used by every user, group or project",
+		ArgsUsage: "REDIS-URL",
+		Action:    quota,
+		Flags: []cli.Flag{
+			&cli.BoolFlag{
+				Name:    "group",
+				Aliases: []string{"g"},
+				Usage:   "report the usage of groups instead of users",
+			},
+			&cli.BoolFlag{
+				Name:    "numeric",
+				Aliases: []string{"n"},
+				Usage:   "show numeric ids instead of resolving them to names",
+			},
+			&cli.BoolFlag{
+				Name:    "project",
+				Aliases: []string{"P"},
+				Usage:   "report the usage and quotas of projects (set by extended attribute project.id)",
+			},
+			&cli.Uint64Flag{
+				Name:  "set",
+				Usage: "set the quota of the project with this id instead of reporting",
+			},
+			&cli.Uint64Flag{
+				Name:  "space",
+				Usage: "the limit on space of the project in GiB (0 means unlimited)",
+			},
+			&cli.Int64Flag{
+				Name:  "inodes",
+				Usage: "the limit on number of inodes of the project (0 means unlimited)",
+			},
+		},
+	}
+}
+
+func ownerName(id uint32, group, numeric bool) string {
+	s := strconv.FormatUint(uint64(id), 10)
+	if !numeric {
+		if group {
+			if g, err := user.LookupGroupId(s); err == nil {
+				return g.Name
+			}
+		} else if u, err := user.LookupId(s); err == nil {
+			return u.Username
+		}
+	}
+	return "#" + s
+}
+
+// printUsage prints the usage in the format of repquota, the space is in KiB
+// and there are no limits on it.
+func printUsage(w io.Writer, name string, usage []meta.Usage, group, numeric bool) {
+	kind := "User"
+	if group {
+		kind = "Group"
+	}
+	fmt.Fprintf(w, "*** Report for %s quotas on volume %s\n", strings.ToLower(kind), name)
+	fmt.Fprintf(w, "Block grace time: 00:00; Inode grace time: 00:00\n")
+	fmt.Fprintf(w, "%-20s %26s %29s\n", "", "Block limits", "File limits")
+	fmt.Fprintf(w, "%-20s   %10s %7s %7s  %5s %7s %5s %5s  %5s\n", kind, "used", "soft", "hard", "grace", "used", "soft", "hard", "grace")
+	fmt.Fprintln(w, strings.Repeat("-", 96))
+	for _, u := range usage {
+		if u.Space <= 0 && u.Inodes <= 0 {
+			continue
+		}
+		fmt.Fprintf(w, "%-20s --%10d %7d %7d  %5s %7d %5d %5d  %5s\n", ownerName(u.ID, group, numeric), u.Space>>10, 0, 0, "", u.Inodes, 0, 0, "")
+	}
+	fmt.Fprintln(w)
+}
+
+// printQuotas prints the usage and limits of projects in the format of repquota.
+func printQuotas(w io.Writer, name string, quotas map[uint32]*meta.Quota) {
+	fmt.Fprintf(w, "*** Report for project quotas on volume %s\n", name)
+	fmt.Fprintf(w, "Block grace time: 00:00; Inode grace time: 00:00\n")
+	fmt.Fprintf(w, "%-20s %26s %29s\n", "", "Block limits", "File limits")
+	fmt.Fprintf(w, "%-20s   %10s %7s %7s  %5s %7s %5s %5s  %5s\n", "Project", "used", "soft", "hard", "grace", "used", "soft", "hard", "grace")
+	fmt.Fprintln(w, strings.Repeat("-", 96))
+	prjs := make([]uint32, 0, len(quotas))
+	for prj := range quotas {
+		prjs = append(prjs, prj)
+	}
+	sort.Slice(prjs, func(i, j int) bool { return prjs[i] < prjs[j] })
+	for _, prj := range prjs {
+		q := quotas[prj]
+		flags := []byte("--")
+		if q.MaxSpace > 0 && q.UsedSpace >= q.MaxSpace {
+			flags[0] = '+'
+		}
+		if q.MaxInodes > 0 && q.UsedInodes >= q.MaxInodes {
+			flags[1] = '+'
+		}
+		fmt.Fprintf(w, "#%-19d %s%10d %7d %7d  %5s %7d %5d %5d  %5s\n", prj, flags, q.UsedSpace>>10, 0, q.MaxSpace>>10, "", q.UsedInodes, 0, q.MaxInodes, "")
+	}
+	fmt.Fprintln(w)
+}
+
+func quota(ctx *cli.Context) error {
+	setLoggerLevel(ctx)
+	if ctx.Args().Len() < 1 {
+		return fmt.Errorf("REDIS-URL is needed")
+	}
+	addr := ctx.Args().Get(0)
+	if !strings.Contains(addr, "://") {
+		addr = "redis://" + addr
+	}
+
+	logger.Infof("Meta address: %s", addr)
+	var rc = meta.RedisConfig{Retries: 10, Strict: true}
+	m, err := meta.NewClient(addr, &rc)
+	if err != nil {
+		logger.Fatalf("Meta: %s", err)
+	}
+	format, err := m.Load()
+	if err != nil {
+		logger.Fatalf("load setting: %s", err)
+	}
+	if ctx.IsSet("set") {
+		prj := ctx.Uint64("set")
+		if prj == 0 || prj > math.MaxUint32 {
+			logger.Fatalf("invalid project id: %d", prj)
+		}
+		if err = m.SetQuota(uint32(prj), int64(ctx.Uint64("space")<<30), ctx.Int64("inodes")); err != nil {
+			logger.Fatalf("set quota of project %d: %s", prj, err)
+		}
+		return nil
+	}
+	if ctx.Bool("project") {
+		quotas, err := m.ListQuotas()
+		if err != nil {
+			logger.Fatalf("list quotas: %s", err)
+		}
+		printQuotas(os.Stdout, format.Name, quotas)
+		return nil
+	}
+	group := ctx.Bool("group")
+	usage, err := m.ListUsage(group)
+	if err != nil {
+		logger.Fatalf("list usage: %s", err)
+	}
+	printUsage(os.Stdout, format.Name, usage, group, ctx.Bool("numeric"))
+	return nil
+}
@@ -0,0 +1,326 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/juicedata/juicefs/pkg/chunk"
+	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/juicedata/juicefs/pkg/object"
+	"github.com/juju/ratelimit"
+	"github.com/urfave/cli/v2"
+)
+
+func rebucketFlags() *cli.Command {
+	return &cli.Command{
+		Name:      "rebucket",
+		Usage:     "migrate data into another object storage",
+		ArgsUsage: "REDIS-URL",
+		Description: `
+All the blocks used by the volume are copied into the new object storage, then the
+volume is switched to it. The clients should be remounted to use the new one, run it
+again after that to copy the blocks written by them in the meantime.`,
+		Action: rebucket,
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:  "storage",
+				Value: "file",
+				Usage: "Object storage type (e.g. s3, gcs, oss, cos)",
+			},
+			&cli.StringFlag{
+				Name:  "bucket",
+				Usage: "A bucket URL to store data",
+			},
+			&cli.StringFlag{
+				Name:  "access-key",
+				Usage: "Access key for object storage (env ACCESS_KEY)",
+			},
+			&cli.StringFlag{
+				Name:  "secret-key",
+				Usage: "Secret key for object storage (env SECRET_KEY)",
+			},
+			&cli.IntFlag{
+				Name:  "threads",
+				Value: 20,
+				Usage: "number of concurrent threads",
+			},
+			&cli.IntFlag{
+				Name:  "bwlimit",
+				Usage: "limit bandwidth in Mbps (0 means unlimited)",
+			},
+			&cli.StringFlag{
+				Name:  "checkpoint",
+				Usage: "path of the checkpoint file to resume (default: rebucket-UUID.json)",
+			},
+		},
+	}
+}
+
+// rebucketCheckpoint keeps the source storage and the progress, which
+// are needed to resume after the volume is switched.
+type rebucketCheckpoint struct {
+	Storage   string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	Chunkid   uint64 // all the chunks before it are copied
+}
+
+func loadCheckpoint(path string) (*rebucketCheckpoint, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var ck rebucketCheckpoint
+	if err = json.Unmarshal(data, &ck); err != nil {
+		return nil, fmt.Errorf("json: %s", err)
+	}
+	return &ck, nil
+}
+
+func saveCheckpoint(path string, ck *rebucketCheckpoint) error {
+	data, err := json.Marshal(ck)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+type rebucketStats struct {
+	copied, skipped, failed int64
+	bytes                   int64
+}
+
+func copyObject(src, dst object.ObjectStorage, key string, limiter *ratelimit.Bucket, stats *rebucketStats) error {
+	if _, err := dst.Head(key); err == nil {
+		atomic.AddInt64(&stats.skipped, 1)
+		return nil
+	}
+	in, err := src.Get(key, 0, -1)
+	if err != nil {
+		if _, e := src.Head(key); e != nil {
+			logger.Debugf("skip deleted object %s: %s", key, e)
+			atomic.AddInt64(&stats.skipped, 1)
+			return nil
+		}
+		return err
+	}
+	data, err := ioutil.ReadAll(in)
+	in.Close()
+	if err != nil {
+		return err
+	}
+	if limiter != nil {
+		limiter.Wait(int64(len(data)))
+	}
+	if err = dst.Put(key, bytes.NewReader(data)); err != nil {
+		return err
+	}
+	atomic.AddInt64(&stats.copied, 1)
+	atomic.AddInt64(&stats.bytes, int64(len(data)))
+	return nil
+}
+
+// copyChunks copies the objects of chunks newer than ck.Chunkid in batches,
+// the checkpoint is saved after every batch.
+func copyChunks(m meta.Meta, conf *chunk.Config, src, dst object.ObjectStorage, ck *rebucketCheckpoint, path string,
+	threads int, limiter *ratelimit.Bucket) (*rebucketStats, error) {
+	var c = meta.NewContext(0, 0, []uint32{0})
+	var slices []meta.Slice
+	if r := m.ListSlices(c, &slices); r != 0 {
+		return nil, fmt.Errorf("list all slices: %s", r)
+	}
+	sizes := make(map[uint64]uint32)
+	for _, s := range slices {
+		if s.Chunkid > ck.Chunkid && s.Size > 0 {
+			sizes[s.Chunkid] = s.Size
+		}
+	}
+	ids := make([]uint64, 0, len(sizes))
+	for id := range sizes {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	logger.Infof("Copying %d chunks after %d", len(ids), ck.Chunkid)
+
+	var stats rebucketStats
+	for len(ids) > 0 {
+		batch := ids
+		if len(batch) > 1000 {
+			batch = batch[:1000]
+		}
+		ids = ids[len(batch):]
+		var keys = make(map[string]bool)
+		for _, id := range batch {
+			ks, err := chunk.ObjectKeys(conf, id, int(sizes[id]))
+			if err != nil {
+				return &stats, fmt.Errorf("keys of chunk %d: %s", id, err)
+			}
+			for _, k := range ks {
+				keys[k] = true
+			}
+		}
+		todo := make(chan string, len(keys))
+		for k := range keys {
+			todo <- k
+		}
+		close(todo)
+		var wg sync.WaitGroup
+		for i := 0; i < threads; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for key := range todo {
+					if err := copyObject(src, dst, key, limiter, &stats); err != nil {
+						logger.Errorf("copy %s: %s", key, err)
+						atomic.AddInt64(&stats.failed, 1)
+					}
+				}
+			}()
+		}
+		wg.Wait()
+		if stats.failed > 0 {
+			return &stats, fmt.Errorf("failed to copy %d objects", stats.failed)
+		}
+		ck.Chunkid = batch[len(batch)-1]
+		if err := saveCheckpoint(path, ck); err != nil {
+			return &stats, fmt.Errorf("save checkpoint: %s", err)
+		}
+	}
+	return &stats, nil
+}
+
+func rebucket(c *cli.Context) error {
+	setLoggerLevel(c)
+	if c.Args().Len() < 1 {
+		return fmt.Errorf("REDIS-URL is needed")
+	}
+	if c.String("bucket") == "" {
+		return fmt.Errorf("bucket of the new object storage is needed")
+	}
+	addr := c.Args().Get(0)
+	if !strings.Contains(addr, "://") {
+		addr = "redis://" + addr
+	}
+	logger.Infof("Meta address: %s", addr)
+	var rc = meta.RedisConfig{Retries: 10, Strict: true}
+	m, err := meta.NewClient(addr, &rc)
+	if err != nil {
+		logger.Fatalf("Meta: %s", err)
+	}
+	format, err := m.Load()
+	if err != nil {
+		logger.Fatalf("load setting: %s", err)
+	}
+
+	target := *format
+	target.Storage = c.String("storage")
+	target.Bucket = c.String("bucket")
+	target.AccessKey = c.String("access-key")
+	target.SecretKey = c.String("secret-key")
+	if target.AccessKey == "" && os.Getenv("ACCESS_KEY") != "" {
+		target.AccessKey = os.Getenv("ACCESS_KEY")
+		os.Unsetenv("ACCESS_KEY")
+	}
+	if target.SecretKey == "" && os.Getenv("SECRET_KEY") != "" {
+		target.SecretKey = os.Getenv("SECRET_KEY")
+		os.Unsetenv("SECRET_KEY")
+	}
+	if target.Storage == "file" && !strings.HasSuffix(target.Bucket, "/") {
+		target.Bucket += "/"
+	}
+
+	path := c.String("checkpoint")
+	if path == "" {
+		path = fmt.Sprintf("rebucket-%s.json", format.UUID)
+	}
+	ck, err := loadCheckpoint(path)
+	if err != nil {
+		logger.Fatalf("load checkpoint from %s: %s", path, err)
+	}
+	if ck == nil {
+		if format.Storage == target.Storage && format.Bucket == target.Bucket {
+			logger.Fatalf("volume %s is already stored in %s", format.Name, target.Bucket)
+		}
+		ck = &rebucketCheckpoint{Storage: format.Storage, Bucket: format.Bucket, AccessKey: format.AccessKey, SecretKey: format.SecretKey}
+	} else {
+		logger.Infof("Resume from %s: chunk %d", path, ck.Chunkid)
+	}
+
+	src, err := newStorage(format, ck.Storage, ck.Bucket, ck.AccessKey, ck.SecretKey)
+	if err != nil {
+		logger.Fatalf("object storage: %s", err)
+	}
+	dst, err := newStorage(format, target.Storage, target.Bucket, target.AccessKey, target.SecretKey)
+	if err != nil {
+		logger.Fatalf("object storage: %s", err)
+	}
+	if err := test(dst); err != nil {
+		logger.Fatalf("Storage %s is not configured correctly: %s", dst, err)
+	}
+	logger.Infof("Migrating data from %s to %s", src, dst)
+
+	chunkConf := chunk.Config{
+		BlockSize:  format.BlockSize * 1024,
+		Partitions: format.Partitions,
+		PackSize:   format.PackSize << 10,
+		PackIndex:  m,
+		Dedup:      format.Dedup,
+		DedupIndex: m,
+	}
+	var limiter *ratelimit.Bucket
+	if bw := c.Int("bwlimit"); bw > 0 {
+		bps := float64(bw*(1<<20)/8) * 0.85 // 15% overhead
+		limiter = ratelimit.NewBucketWithRate(bps, int64(bps)*3)
+	}
+	// the chunks written during last round are copied in next round, until there are only a few
+	for round := 0; round < 5; round++ {
+		stats, err := copyChunks(m, &chunkConf, src, dst, ck, path, c.Int("threads"), limiter)
+		if err != nil {
+			logger.Fatalf("%s, please run it again to resume", err)
+		}
+		logger.Infof("Round %d: copied %d objects (%d bytes), skipped %d", round+1, stats.copied, stats.bytes, stats.skipped)
+		if stats.copied < 100 {
+			break
+		}
+	}
+
+	if format.Storage != target.Storage || format.Bucket != target.Bucket || format.AccessKey != target.AccessKey || format.SecretKey != target.SecretKey {
+		if err = m.UpdateFormat(target); err != nil {
+			logger.Fatalf("update format: %s", err)
+		}
+		logger.Infof("Volume %s is switched to %s, please remount all the clients and run it again", format.Name, dst)
+	} else {
+		logger.Infof("All the blocks are copied into %s, the checkpoint %s can be removed if all the clients are remounted", dst, path)
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/juicedata/juicefs/pkg/object"
+)
+
+func TestRebucketCheckpoint(t *testing.T) {
+	path := filepath.Join(os.TempDir(), "rebucket-test.json")
+	defer os.Remove(path)
+	if ck, err := loadCheckpoint(path); err != nil || ck != nil {
+		t.Fatalf("load missing checkpoint: %v %s", ck, err)
+	}
+	ck := &rebucketCheckpoint{Storage: "file", Bucket: "/tmp/old/", Chunkid: 100}
+	if err := saveCheckpoint(path, ck); err != nil {
+		t.Fatalf("save checkpoint: %s", err)
+	}
+	if ck2, err := loadCheckpoint(path); err != nil || *ck2 != *ck {
+		t.Fatalf("load checkpoint: %+v %s", ck2, err)
+	}
+}
+
+func TestCopyObject(t *testing.T) {
+	src, _ := object.CreateStorage("mem", "", "", "")
+	dst, _ := object.CreateStorage("mem", "", "", "")
+	_ = src.Put("a", bytes.NewReader([]byte("data")))
+	var stats rebucketStats
+	if err := copyObject(src, dst, "a", nil, &stats); err != nil {
+		t.Fatalf("copy: %s", err)
+	}
+	if err := copyObject(src, dst, "a", nil, &stats); err != nil {
+		t.Fatalf("copy again: %s", err)
+	}
+	if err := copyObject(src, dst, "deleted", nil, &stats); err != nil {
+		t.Fatalf("copy deleted object: %s", err)
+	}
+	if stats.copied != 1 || stats.skipped != 2 || stats.bytes != 4 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+}
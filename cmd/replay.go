@@ -0,0 +1,596 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
+
+func replayFlags() *cli.Command {
+	return &cli.Command{
+		Name:      "replay",
+		Usage:     "replay the operations recorded in .accesslog against a directory",
+		ArgsUsage: "TRACE TARGET",
+		Action:    replay,
+		Description: `
+The operations are issued with the original timing, the ones from the same
+process are issued in order and different processes run concurrently. The
+inodes in the trace are mapped to paths under TARGET by the results of lookup,
+create, mkdir and so on, the operations on unknown inodes are skipped.
+
+Examples:
+$ cat /jfs/.accesslog > trace.log
+$ juicefs replay --prepare trace.log /jfs2/replay`,
+		Flags: []cli.Flag{
+			&cli.Float64Flag{
+				Name:  "speed",
+				Value: 1,
+				Usage: "speed up the replay by this factor, 0 means as fast as possible (the order between processes is not kept)",
+			},
+			&cli.BoolFlag{
+				Name:  "prepare",
+				Usage: "create the files and directories which exist before the trace",
+			},
+		},
+	}
+}
+
+const replayTimeFormat = "2006.01.02 15:04:05.000000"
+
+var (
+	traceLineRE  = regexp.MustCompile(`^(\d{4}\.\d\d\.\d\d \d\d:\d\d:\d\d\.\d{6}) \[uid:\d+,gid:\d+,pid:(\d+)(?:,trace:[\w-]+)?\] (\w+) \((.*?)\): (.*) <([\d.]+)>$`)
+	traceEntryRE = regexp.MustCompile(`\((\d+),\[(.)[^:]*:0[0-7]+,\d+,\d+,\d+,-?\d+,-?\d+,-?\d+,(\d+)\]\)`)
+)
+
+// traceOp is an operation recorded in .accesslog.
+type traceOp struct {
+	start time.Time // the time it's issued
+	used  time.Duration
+	pid   uint32
+	op    string
+	args  []string
+	ok    bool
+	inode uint64 // inode of the entry in result
+	typ   byte   // type of the entry: '-', 'd', 'l' ...
+	size  int64  // length of the entry
+}
+
+// position of the name and number of arguments of the operations, the name may
+// have comma in it (the names in rename should not have comma).
+var traceNameArgs = map[string][2]int{
+	"lookup":  {1, 2},
+	"unlink":  {1, 2},
+	"rmdir":   {1, 2},
+	"mkdir":   {1, 3},
+	"create":  {1, 3},
+	"symlink": {1, 3},
+	"mknod":   {1, 4},
+	"link":    {2, 3},
+	"rename":  {1, 4},
+}
+
+func parseTraceLine(line string) (*traceOp, error) {
+	ms := traceLineRE.FindStringSubmatch(line)
+	if ms == nil {
+		return nil, fmt.Errorf("invalid line: %q", line)
+	}
+	end, err := time.ParseInLocation(replayTimeFormat, ms[1], time.Local)
+	if err != nil {
+		return nil, err
+	}
+	pid, _ := strconv.ParseUint(ms[2], 10, 32)
+	used, _ := strconv.ParseFloat(ms[6], 64)
+	o := &traceOp{
+		used: time.Duration(used * 1e9),
+		pid:  uint32(pid),
+		op:   ms[3],
+		args: strings.Split(ms[4], ","),
+		ok:   strings.HasPrefix(ms[5], "OK"),
+	}
+	o.start = end.Add(-o.used)
+	if na, ok := traceNameArgs[o.op]; ok && len(o.args) > na[1] {
+		idx, extra := na[0], len(o.args)-na[1]
+		name := strings.Join(o.args[idx:idx+extra+1], ",")
+		o.args = append(append(o.args[:idx:idx], name), o.args[idx+extra+1:]...)
+	} else if ok && len(o.args) < na[1] {
+		return nil, fmt.Errorf("invalid arguments: %q", line)
+	}
+	if e := traceEntryRE.FindStringSubmatch(ms[5]); e != nil {
+		o.inode, _ = strconv.ParseUint(e[1], 10, 64)
+		o.typ = e[2][0]
+		o.size, _ = strconv.ParseInt(e[3], 10, 64)
+	}
+	return o, nil
+}
+
+// parseTrace reads the operations and sorts them by the time they are issued.
+func parseTrace(r io.Reader) ([]*traceOp, error) {
+	var ops []*traceOp
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 1<<16), 1<<20)
+	for s.Scan() {
+		line := s.Text()
+		if line == "" || line == "#" {
+			continue
+		}
+		o, err := parseTraceLine(line)
+		if err != nil {
+			logger.Debugf("skip %s", err)
+			continue
+		}
+		ops = append(ops, o)
+	}
+	sort.SliceStable(ops, func(i, j int) bool { return ops[i].start.Before(ops[j].start) })
+	return ops, s.Err()
+}
+
+type replayStat struct {
+	count    int
+	mismatch int // succeeded in trace but failed in replay, or the opposite
+	recorded time.Duration
+	replayed time.Duration
+}
+
+type replayer struct {
+	target string
+	data   []byte
+
+	sync.Mutex
+	paths   map[uint64]string
+	handles map[uint64][]*os.File
+	stats   map[string]*replayStat
+	skipped map[string]int
+}
+
+func newReplayer(target string) *replayer {
+	r := &replayer{
+		target:  target,
+		data:    make([]byte, 1<<20),
+		paths:   map[uint64]string{1: target},
+		handles: make(map[uint64][]*os.File),
+		stats:   make(map[string]*replayStat),
+		skipped: make(map[string]int),
+	}
+	_, _ = rand.Read(r.data)
+	return r
+}
+
+func (r *replayer) path(ino uint64) string {
+	r.Lock()
+	defer r.Unlock()
+	return r.paths[ino]
+}
+
+func (r *replayer) child(parent uint64, name string) string {
+	if p := r.path(parent); p != "" {
+		return filepath.Join(p, name)
+	}
+	return ""
+}
+
+// track updates the paths of inodes by the result recorded in trace.
+func (r *replayer) track(o *traceOp, p string) {
+	if !o.ok {
+		return
+	}
+	r.Lock()
+	defer r.Unlock()
+	switch o.op {
+	case "lookup", "mkdir", "mknod", "create", "symlink", "link":
+		if o.inode != 0 && p != "" {
+			r.paths[o.inode] = p
+		}
+	case "unlink", "rmdir":
+		for ino, q := range r.paths {
+			if q == p {
+				delete(r.paths, ino)
+			}
+		}
+	case "rename":
+		dir, ok := r.paths[parseIno(o.args[2])]
+		np := filepath.Join(dir, o.args[3])
+		for ino, q := range r.paths {
+			if q == np {
+				delete(r.paths, ino)
+			}
+		}
+		for ino, q := range r.paths {
+			if !ok && (q == p || strings.HasPrefix(q, p+"/")) {
+				delete(r.paths, ino) // moved to unknown directory
+			} else if q == p {
+				r.paths[ino] = np
+			} else if strings.HasPrefix(q, p+"/") {
+				r.paths[ino] = np + q[len(p):]
+			}
+		}
+	}
+}
+
+func parseIno(s string) uint64 {
+	ino, _ := strconv.ParseUint(s, 10, 64)
+	return ino
+}
+
+func parseMode(s string) os.FileMode {
+	if i := strings.LastIndexByte(s, ':'); i >= 0 {
+		s = s[i+1:]
+	}
+	mode, _ := strconv.ParseUint(s, 8, 32)
+	return os.FileMode(mode) & os.ModePerm
+}
+
+func (r *replayer) pushHandle(ino uint64, f *os.File) {
+	r.Lock()
+	r.handles[ino] = append(r.handles[ino], f)
+	r.Unlock()
+}
+
+func (r *replayer) popHandle(ino uint64) *os.File {
+	r.Lock()
+	defer r.Unlock()
+	hs := r.handles[ino]
+	if len(hs) == 0 {
+		return nil
+	}
+	r.handles[ino] = hs[1:]
+	return hs[0]
+}
+
+func (r *replayer) handle(ino uint64) *os.File {
+	r.Lock()
+	defer r.Unlock()
+	if hs := r.handles[ino]; len(hs) > 0 {
+		return hs[0]
+	}
+	return nil
+}
+
+// withHandle runs f with an opened handle of ino, or open it temporarily.
+func (r *replayer) withHandle(ino uint64, p string, flag int, f func(*os.File) error) error {
+	if h := r.handle(ino); h != nil {
+		return f(h)
+	}
+	h, err := os.OpenFile(p, flag, 0)
+	if err != nil {
+		return err
+	}
+	defer h.Close()
+	return f(h)
+}
+
+func (r *replayer) payload(size int) []byte {
+	if size <= len(r.data) {
+		return r.data[:size]
+	}
+	return make([]byte, size)
+}
+
+func argInt(args []string, i int) int64 {
+	if i >= len(args) {
+		return 0
+	}
+	v, _ := strconv.ParseInt(args[i], 10, 64)
+	return v
+}
+
+// opPath returns the path of the entry which the operation works on.
+func (r *replayer) opPath(o *traceOp) string {
+	a := o.args
+	switch o.op {
+	case "lookup", "mkdir", "mknod", "create", "unlink", "rmdir", "symlink", "rename":
+		return r.child(parseIno(a[0]), a[1])
+	case "link":
+		return r.child(parseIno(a[1]), a[2])
+	default:
+		return r.path(parseIno(a[0]))
+	}
+}
+
+// do issues the operation, it returns false if the operation is skipped.
+func (r *replayer) do(o *traceOp) (bool, error) {
+	a := o.args
+	p := r.opPath(o)
+	if p == "" {
+		return false, nil
+	}
+	defer r.track(o, p)
+	ino := parseIno(a[0])
+	var err error
+	switch o.op {
+	case "lookup", "getattr", "access":
+		_, err = os.Lstat(p)
+	case "setattr":
+		if len(a) < 3 {
+			return false, nil
+		}
+		for _, kv := range strings.Split(strings.Trim(a[2], "[]"), ";") {
+			switch {
+			case strings.HasPrefix(kv, "mode="):
+				err = os.Chmod(p, parseMode(kv))
+			case strings.HasPrefix(kv, "size="):
+				size, _ := strconv.ParseInt(kv[5:], 10, 64)
+				err = os.Truncate(p, size)
+			case kv != "atime=" && kv != "mtime=" && kv != "":
+				now := time.Now()
+				err = os.Chtimes(p, now, now)
+			}
+			if err != nil {
+				break
+			}
+		}
+	case "mkdir":
+		err = os.Mkdir(p, parseMode(a[2]))
+	case "mknod":
+		if len(a) < 3 || !strings.HasPrefix(a[2], "-") {
+			return false, nil
+		}
+		var f *os.File
+		if f, err = os.OpenFile(p, os.O_CREATE|os.O_EXCL|os.O_WRONLY, parseMode(a[2])); err == nil {
+			err = f.Close()
+		}
+	case "create":
+		var f *os.File
+		if f, err = os.OpenFile(p, os.O_CREATE|os.O_RDWR, parseMode(a[2])); err == nil {
+			r.pushHandle(o.inode, f)
+		}
+	case "open", "opendir":
+		var f *os.File
+		if f, err = os.OpenFile(p, os.O_RDWR, 0); err != nil {
+			f, err = os.Open(p)
+		}
+		if err == nil {
+			r.pushHandle(ino, f)
+		}
+	case "release", "releasedir":
+		if f := r.popHandle(ino); f != nil {
+			err = f.Close()
+		}
+	case "readdir":
+		if argInt(a, 2) != 0 {
+			return false, nil
+		}
+		var d *os.File
+		if d, err = os.Open(p); err == nil {
+			_, err = d.Readdirnames(-1)
+			d.Close()
+		}
+	case "read":
+		err = r.withHandle(ino, p, os.O_RDONLY, func(f *os.File) error {
+			_, err := f.ReadAt(make([]byte, argInt(a, 1)), argInt(a, 2))
+			if err == io.EOF {
+				err = nil
+			}
+			return err
+		})
+	case "write":
+		err = r.withHandle(ino, p, os.O_WRONLY, func(f *os.File) error {
+			_, err := f.WriteAt(r.payload(int(argInt(a, 1))), argInt(a, 2))
+			return err
+		})
+	case "fsync":
+		err = r.withHandle(ino, p, os.O_RDONLY, func(f *os.File) error { return f.Sync() })
+	case "truncate":
+		err = os.Truncate(p, argInt(a, 1))
+	case "unlink", "rmdir":
+		err = os.Remove(p)
+	case "rename":
+		np := r.child(parseIno(a[2]), a[3])
+		if np == "" {
+			return false, nil
+		}
+		err = os.Rename(p, np)
+	case "link":
+		err = os.Link(r.path(ino), p)
+	case "symlink":
+		err = os.Symlink(a[2], p)
+	case "readlink":
+		_, err = os.Readlink(p)
+	default:
+		// flush, statfs, xattr, locks, fallocate and copy_file_range
+		return false, nil
+	}
+	return true, err
+}
+
+// prepare creates the files and directories which are looked up but not created in the trace.
+func (r *replayer) prepare(ops []*traceOp) error {
+	created := make(map[uint64]bool)
+	var n int
+	for _, o := range ops {
+		if !o.ok {
+			continue
+		}
+		p := r.opPath(o)
+		r.track(o, p)
+		if o.op != "lookup" || o.inode == 0 || created[o.inode] || p == "" {
+			created[o.inode] = true
+			continue
+		}
+		created[o.inode] = true
+		var err error
+		switch o.typ {
+		case 'd':
+			err = os.MkdirAll(p, 0755)
+		case '-':
+			err = r.prepareFile(p, o.size)
+		}
+		if err != nil {
+			return fmt.Errorf("prepare %s: %s", p, err)
+		}
+		n++
+	}
+	r.paths = map[uint64]string{1: r.target}
+	logger.Infof("Prepared %d files and directories in %s", n, r.target)
+	return nil
+}
+
+func (r *replayer) prepareFile(p string, size int64) error {
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(p, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	for off := int64(0); off < size; off += int64(len(r.data)) {
+		n := int64(len(r.data))
+		if size-off < n {
+			n = size - off
+		}
+		if _, err = f.Write(r.data[:n]); err != nil {
+			return err
+		}
+	}
+	return f.Close()
+}
+
+// run replays the operations, the ones from the same process are issued in order.
+func (r *replayer) run(ops []*traceOp, speed float64) time.Duration {
+	if len(ops) == 0 {
+		return 0
+	}
+	byPid := make(map[uint32][]*traceOp)
+	for _, o := range ops {
+		byPid[o.pid] = append(byPid[o.pid], o)
+	}
+	first := ops[0].start
+	started := time.Now()
+	var wg sync.WaitGroup
+	var lag time.Duration
+	for _, ops := range byPid {
+		wg.Add(1)
+		go func(ops []*traceOp) {
+			defer wg.Done()
+			for _, o := range ops {
+				if speed > 0 {
+					at := started.Add(time.Duration(float64(o.start.Sub(first)) / speed))
+					if d := time.Until(at); d > 0 {
+						time.Sleep(d)
+					} else {
+						r.Lock()
+						if -d > lag {
+							lag = -d
+						}
+						r.Unlock()
+					}
+				}
+				start := time.Now()
+				done, err := r.do(o)
+				used := time.Since(start)
+				r.Lock()
+				if !done {
+					r.skipped[o.op]++
+				} else {
+					s := r.stats[o.op]
+					if s == nil {
+						s = &replayStat{}
+						r.stats[o.op] = s
+					}
+					s.count++
+					s.recorded += o.used
+					s.replayed += used
+					if o.ok != (err == nil) {
+						s.mismatch++
+						logger.Debugf("%s %v: recorded %v, replayed %v", o.op, o.args, o.ok, err)
+					}
+				}
+				r.Unlock()
+			}
+		}(ops)
+	}
+	wg.Wait()
+	for _, hs := range r.handles {
+		for _, f := range hs {
+			_ = f.Close()
+		}
+	}
+	return lag
+}
+
+func (r *replayer) report(w io.Writer) {
+	var names []string
+	for name := range r.stats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprintf(w, "%-12s %10s %10s %14s %14s\n", "OPERATION", "COUNT", "MISMATCH", "RECORDED(ms)", "REPLAYED(ms)")
+	for _, name := range names {
+		s := r.stats[name]
+		avg := func(d time.Duration) float64 { return d.Seconds() * 1000 / float64(s.count) }
+		fmt.Fprintf(w, "%-12s %10d %10d %14.3f %14.3f\n", name, s.count, s.mismatch, avg(s.recorded), avg(s.replayed))
+	}
+	var skipped []string
+	for name, n := range r.skipped {
+		skipped = append(skipped, fmt.Sprintf("%s:%d", name, n))
+	}
+	if len(skipped) > 0 {
+		sort.Strings(skipped)
+		fmt.Fprintf(w, "Skipped: %s\n", strings.Join(skipped, " "))
+	}
+}
+
+func replay(c *cli.Context) error {
+	setLoggerLevel(c)
+	if c.Args().Len() < 2 {
+		return fmt.Errorf("TRACE and TARGET are needed")
+	}
+	f, err := os.Open(c.Args().Get(0))
+	if err != nil {
+		return err
+	}
+	ops, err := parseTrace(f)
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("read trace: %s", err)
+	}
+	if len(ops) == 0 {
+		return fmt.Errorf("no operation is found in %s", c.Args().Get(0))
+	}
+	target, err := filepath.Abs(c.Args().Get(1))
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(target, 0755); err != nil {
+		return err
+	}
+	r := newReplayer(target)
+	if c.Bool("prepare") {
+		if err = r.prepare(ops); err != nil {
+			return err
+		}
+	}
+	speed := c.Float64("speed")
+	logger.Infof("Replay %d operations of %s at speed %g", len(ops), ops[len(ops)-1].start.Sub(ops[0].start), speed)
+	start := time.Now()
+	lag := r.run(ops, speed)
+	fmt.Printf("Replayed in %s, max lag behind schedule: %s\n", time.Since(start), lag)
+	r.report(os.Stdout)
+	return nil
+}
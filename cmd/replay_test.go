@@ -0,0 +1,90 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testTrace = `2021.06.01 10:00:00.000200 [uid:0,gid:0,pid:10] lookup (1,data): OK (2,[drwxr-xr-x:0040755,2,0,0,1,1,1,4096]) <0.000100>
+2021.06.01 10:00:00.000300 [uid:0,gid:0,pid:10] lookup (2,old,1.txt): OK (3,[-rw-r--r--:0100644,1,0,0,1,1,1,5000]) <0.000050>
+#
+2021.06.01 10:00:00.000500 [uid:0,gid:0,pid:10] open (3): OK [fh:1] <0.000010>
+2021.06.01 10:00:00.000600 [uid:0,gid:0,pid:10,trace:1a2b3c-2f] read (3,4096,4096): OK (904) <0.000020>
+2021.06.01 10:00:00.000700 [uid:0,gid:0,pid:10] release (3): OK <0.000010>
+2021.06.01 10:00:00.001000 [uid:0,gid:0,pid:11] mkdir (2,out,drwxr-xr-x:00755): OK (4,[drwxr-xr-x:0040755,2,0,0,1,1,1,4096]) <0.000100>
+2021.06.01 10:00:00.001200 [uid:0,gid:0,pid:11] create (4,f,-rw-r--r--:00600): OK (5,[-rw-------:0100600,1,0,0,1,1,1,0]) [fh:2] <0.000100>
+2021.06.01 10:00:00.001300 [uid:0,gid:0,pid:11] write (5,1000,0): OK <0.000010>
+2021.06.01 10:00:00.001400 [uid:0,gid:0,pid:11] flush (5): OK <0.000010>
+2021.06.01 10:00:00.001500 [uid:0,gid:0,pid:11] release (5): OK <0.000010>
+2021.06.01 10:00:00.001600 [uid:0,gid:0,pid:11] rename (4,f,2,g): OK <0.000100>
+2021.06.01 10:00:00.001700 [uid:0,gid:0,pid:11] setattr (5,0x8,[atime=;mtime=;size=100;]): OK (5,[-rw-------:0100600,1,0,0,1,1,1,100]) <0.000100>
+2021.06.01 10:00:00.001800 [uid:0,gid:0,pid:11] lookup (2,missing): no such file or directory <0.000100>
+2021.06.01 10:00:00.001900 [uid:0,gid:0,pid:11] getattr (99): OK (99,[-rw-r--r--:0100644,1,0,0,1,1,1,0]) <0.000100>
+`
+
+func TestParseTrace(t *testing.T) {
+	ops, err := parseTrace(strings.NewReader(testTrace))
+	if err != nil || len(ops) != 14 {
+		t.Fatalf("parse trace: %d %s", len(ops), err)
+	}
+	o := ops[1]
+	if o.op != "lookup" || len(o.args) != 2 || o.args[1] != "old,1.txt" || !o.ok || o.inode != 3 || o.typ != '-' || o.size != 5000 {
+		t.Fatalf("lookup: %+v", o)
+	}
+	if o.used != 50*time.Microsecond || o.pid != 10 || o.start.Nanosecond() != 250000 {
+		t.Fatalf("timing of lookup: %+v", o)
+	}
+	if o := ops[12]; o.ok || o.inode != 0 {
+		t.Fatalf("failed lookup: %+v", o)
+	}
+	if _, err = parseTraceLine("2021.06.01 10:00:00.000200 [uid:0,gid:0,pid:10] lookup (1): OK <0.1>"); err == nil {
+		t.Fatalf("lookup without name should be invalid")
+	}
+}
+
+func TestReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "juicefs-replay")
+	if err != nil {
+		t.Fatalf("temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	ops, _ := parseTrace(strings.NewReader(testTrace))
+	r := newReplayer(dir)
+	if err = r.prepare(ops); err != nil {
+		t.Fatalf("prepare: %s", err)
+	}
+	if st, err := os.Stat(filepath.Join(dir, "data", "old,1.txt")); err != nil || st.Size() != 5000 {
+		t.Fatalf("prepared file: %+v %s", st, err)
+	}
+	r.run(ops, 0.01) // slow down to keep the order between processes
+	if st, err := os.Stat(filepath.Join(dir, "data", "g")); err != nil || st.Size() != 100 || st.Mode().Perm() != 0600 {
+		t.Fatalf("replayed file: %+v %s", st, err)
+	}
+	for _, name := range []string{"lookup", "open", "read", "release", "mkdir", "create", "write", "rename", "setattr"} {
+		if s := r.stats[name]; s == nil || s.mismatch != 0 {
+			t.Fatalf("stats of %s: %+v", name, s)
+		}
+	}
+	if r.stats["lookup"].count != 3 || r.skipped["flush"] != 1 || r.skipped["getattr"] != 1 {
+		t.Fatalf("stats: %+v, skipped: %+v", r.stats["lookup"], r.skipped)
+	}
+}
@@ -0,0 +1,98 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/meta"
+)
+
+const checkpointInterval = time.Second * 10
+
+// scanCheckpoint is the progress of a maintenance command which scans all the objects in the order
+// of keys, the objects up to Cursor are processed and counted in Stats. It's saved in meta
+// periodically, so the command resumes from Cursor after it's interrupted, instead of listing
+// billions of objects again.
+type scanCheckpoint struct {
+	Args    string // the options which change the results, the checkpoint is ignored if they are changed
+	Started time.Time
+	Cursor  string
+	Stats   map[string]int64
+	Keys    []string // the objects to be reported at the end
+
+	m     meta.Meta
+	name  string
+	saved time.Time
+}
+
+// resumeScan returns the checkpoint of the interrupted command with the same args, or a new one.
+func resumeScan(m meta.Meta, name, args string, restart bool) *scanCheckpoint {
+	cp := &scanCheckpoint{Args: args, Started: time.Now(), Stats: make(map[string]int64), m: m, name: name, saved: time.Now()}
+	if restart {
+		return cp
+	}
+	buf, err := m.GetCheckpoint(name)
+	if err != nil {
+		logger.Warnf("load checkpoint of %s: %s", name, err)
+		return cp
+	}
+	if buf == nil {
+		return cp
+	}
+	var last scanCheckpoint
+	if err = json.Unmarshal(buf, &last); err != nil {
+		logger.Warnf("invalid checkpoint of %s: %s", name, err)
+		return cp
+	}
+	if last.Args != args {
+		logger.Infof("Ignore the checkpoint of %s with different options: %s", name, last.Args)
+		return cp
+	}
+	logger.Infof("Resume %s started at %s from %q", name, last.Started.Format(time.RFC3339), last.Cursor)
+	cp.Started, cp.Cursor, cp.Keys = last.Started, last.Cursor, last.Keys
+	for k, v := range last.Stats {
+		cp.Stats[k] = v
+	}
+	return cp
+}
+
+// save saves the progress at most once per checkpointInterval unless force is true, flush is
+// called before saving to finish the pending work and update the stats.
+func (cp *scanCheckpoint) save(force bool, flush func()) {
+	if !force && time.Since(cp.saved) < checkpointInterval {
+		return
+	}
+	if flush != nil {
+		flush()
+	}
+	buf, err := json.Marshal(cp)
+	if err == nil {
+		err = cp.m.SetCheckpoint(cp.name, buf)
+	}
+	if err != nil {
+		logger.Warnf("save checkpoint of %s: %s", cp.name, err)
+	}
+	cp.saved = time.Now()
+}
+
+// done removes the checkpoint after the command is finished.
+func (cp *scanCheckpoint) done() {
+	if err := cp.m.SetCheckpoint(cp.name, nil); err != nil {
+		logger.Warnf("remove checkpoint of %s: %s", cp.name, err)
+	}
+}
@@ -0,0 +1,53 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"testing"
+
+	"github.com/juicedata/juicefs/pkg/meta"
+)
+
+func TestScanCheckpoint(t *testing.T) {
+	m, err := meta.NewClient("memkv://scan", &meta.RedisConfig{})
+	if err != nil {
+		t.Fatalf("create meta: %s", err)
+	}
+	cp := resumeScan(m, "gc", "delete=false", false)
+	if cp.Cursor != "" || len(cp.Stats) != 0 {
+		t.Fatalf("new checkpoint: %+v", cp)
+	}
+	cp.save(false, nil) // too soon
+	if buf, _ := m.GetCheckpoint("gc"); buf != nil {
+		t.Fatalf("checkpoint should not be saved: %s", buf)
+	}
+	cp.Cursor = "01/0/1_0_4"
+	cp.save(true, func() { cp.Stats["leaked"] = 3 })
+
+	if cp = resumeScan(m, "gc", "delete=false", false); cp.Cursor != "01/0/1_0_4" || cp.Stats["leaked"] != 3 {
+		t.Fatalf("resumed checkpoint: %+v", cp)
+	}
+	if cp = resumeScan(m, "gc", "delete=true", false); cp.Cursor != "" {
+		t.Fatalf("checkpoint with different options: %+v", cp)
+	}
+	if cp = resumeScan(m, "gc", "delete=false", true); cp.Cursor != "" {
+		t.Fatalf("restarted checkpoint: %+v", cp)
+	}
+	cp.done()
+	if cp = resumeScan(m, "gc", "delete=false", false); cp.Cursor != "" {
+		t.Fatalf("removed checkpoint: %+v", cp)
+	}
+}
@@ -0,0 +1,245 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/chunk"
+	"github.com/juicedata/juicefs/pkg/jobs"
+	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/urfave/cli/v2"
+)
+
+func scrubFlags() *cli.Command {
+	return &cli.Command{
+		Name:      "scrub",
+		Usage:     "verify sampled blocks in object storage",
+		ArgsUsage: "REDIS-URL",
+		Action:    scrub,
+		Description: `
+The sampled blocks are downloaded and verified by their sizes and decompressing them.
+There is no checksum of the blocks, so the content of the uncompressed ones (compression
+is none, or imported from external storage) is NOT verified, only the existence and sizes.
+
+Examples:
+$ juicefs scrub --sample 0.1 redis://localhost
+$ juicefs scrub --interval 24h --quarantine redis://localhost`,
+		Flags: []cli.Flag{
+			&cli.Float64Flag{
+				Name:  "sample",
+				Value: 0.01,
+				Usage: "ratio of blocks to verify in each round (0-1]",
+			},
+			&cli.DurationFlag{
+				Name:  "interval",
+				Usage: "run in background and start a new round after this interval, 0 means run once",
+			},
+			&cli.BoolFlag{
+				Name:  "quarantine",
+				Usage: "move corrupted blocks into quarantine/",
+			},
+			&cli.IntFlag{
+				Name:  "threads",
+				Value: 10,
+				Usage: "number threads to verify blocks",
+			},
+			&cli.StringFlag{
+				Name:  "maintenance-window",
+				Usage: "start the rounds only in the windows, e.g. \"mon-fri 22:00-06:00; sat,sun 00:00-24:00\"",
+			},
+		},
+	}
+}
+
+type brokenBlock struct {
+	chunkid uint64
+	length  int
+	indx    int
+	err     *chunk.BlockError
+}
+
+// scrubRound verifies sampled blocks of all slices, returns the number of checked blocks and
+// the ones with only sizes checked, and the blocks which are still broken after confirmed with
+// meta (the slice could be deleted during checking).
+func scrubRound(m meta.Meta, checker chunk.BlockChecker, blockSize int, ratio float64, threads int) (int, int, []*brokenBlock) {
+	var c = meta.NewContext(0, 0, []uint32{0})
+	var slices []meta.Slice
+	if r := m.ListSlices(c, &slices); r != 0 {
+		logger.Errorf("list all slices: %s", r)
+		return 0, 0, nil
+	}
+
+	var checked, unverified int
+	var broken []*brokenBlock
+	var mu sync.Mutex
+	var todo = make(chan *brokenBlock, 1024)
+	var wg sync.WaitGroup
+	for i := 0; i < threads; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for b := range todo {
+				verified, err := checker.CheckBlock(b.chunkid, b.length, b.indx)
+				mu.Lock()
+				checked++
+				if err == nil && !verified {
+					unverified++
+				}
+				if e, ok := err.(*chunk.BlockError); ok {
+					b.err = e
+					broken = append(broken, b)
+				} else if err != nil {
+					logger.Warnf("check block %d_%d_%d: %s", b.chunkid, b.indx, b.length, err)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	seen := make(map[uint64]bool)
+	for _, s := range slices {
+		if s.Chunkid == 0 || s.Size == 0 || seen[s.Chunkid] {
+			continue
+		}
+		seen[s.Chunkid] = true
+		n := (int(s.Size)-1)/blockSize + 1
+		for i := 0; i < n; i++ {
+			if rand.Float64() < ratio {
+				todo <- &brokenBlock{chunkid: s.Chunkid, length: int(s.Size), indx: i}
+			}
+		}
+	}
+	close(todo)
+	wg.Wait()
+	if len(broken) == 0 {
+		return checked, unverified, nil
+	}
+
+	slices = slices[:0]
+	if r := m.ListSlices(c, &slices); r != 0 {
+		logger.Errorf("list all slices: %s", r)
+		return checked, unverified, nil
+	}
+	used := make(map[uint64]bool)
+	for _, s := range slices {
+		used[s.Chunkid] = true
+	}
+	var confirmed []*brokenBlock
+	for _, b := range broken {
+		if used[b.chunkid] {
+			confirmed = append(confirmed, b)
+		}
+	}
+	return checked, unverified, confirmed
+}
+
+func scrub(ctx *cli.Context) error {
+	setLoggerLevel(ctx)
+	if ctx.Args().Len() < 1 {
+		return fmt.Errorf("REDIS-URL is needed")
+	}
+	addr := ctx.Args().Get(0)
+	if !strings.Contains(addr, "://") {
+		addr = "redis://" + addr
+	}
+	ratio := ctx.Float64("sample")
+	if ratio <= 0 || ratio > 1 {
+		return fmt.Errorf("sample ratio should be in (0, 1]")
+	}
+	if err := jobs.SetWindows(ctx.String("maintenance-window")); err != nil {
+		return err
+	}
+
+	logger.Infof("Meta address: %s", addr)
+	var rc = meta.RedisConfig{Retries: 10, Strict: true}
+	m, err := meta.NewClient(addr, &rc)
+	if err != nil {
+		logger.Fatalf("Meta: %s", err)
+	}
+	format, err := m.Load()
+	if err != nil {
+		logger.Fatalf("load setting: %s", err)
+	}
+
+	chunkConf := chunk.Config{
+		BlockSize:  format.BlockSize * 1024,
+		Compress:   format.Compression,
+		Partitions: format.Partitions,
+		PackSize:   format.PackSize << 10,
+		PackIndex:  m,
+		Dedup:      format.Dedup,
+		DedupIndex: m,
+
+		ExternalIndex: m,
+
+		GetTimeout: time.Second * 60,
+		PutTimeout: time.Second * 60,
+		MaxUpload:  20,
+		Prefetch:   0,
+		BufferSize: 300,
+		CacheDir:   "memory",
+		CacheSize:  0,
+	}
+
+	blob, err := createStorage(format)
+	if err != nil {
+		logger.Fatalf("object storage: %s", err)
+	}
+	logger.Infof("Data use %s", blob)
+	if chunkConf.ExternalStorage, err = createExternalStorage(format); err != nil {
+		logger.Fatalf("object storage: %s", err)
+	}
+	checker := chunk.NewCachedStore(blob, chunkConf).(chunk.BlockChecker)
+	if format.Compression == "none" || format.Compression == "" {
+		logger.Warnf("The blocks are not compressed, only their existence and sizes are verified, not the content")
+	}
+
+	for {
+		jobs.Start(jobs.Scrub)
+		start := time.Now()
+		checked, unverified, broken := scrubRound(m, checker, chunkConf.BlockSize, ratio, ctx.Int("threads"))
+		jobs.Done(jobs.Scrub)
+		var missing, corrupted int
+		for _, b := range broken {
+			logger.Errorf("%s", b.err)
+			if b.err.Missing {
+				missing++
+				continue
+			}
+			corrupted++
+			if ctx.Bool("quarantine") {
+				if err := checker.QuarantineBlock(b.chunkid, b.length, b.indx); err != nil {
+					logger.Errorf("quarantine %s: %s", b.err.Key, err)
+				}
+			}
+		}
+		logger.Infof("verified %d blocks in %s (only sizes of %d uncompressed ones): %d missing, %d corrupted",
+			checked, time.Since(start), unverified, missing, corrupted)
+
+		interval := ctx.Duration("interval")
+		if interval <= 0 {
+			if len(broken) > 0 {
+				logger.Fatalf("found %d broken blocks", len(broken))
+			}
+			return nil
+		}
+		time.Sleep(interval)
+	}
+}
@@ -0,0 +1,78 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/urfave/cli/v2"
+)
+
+func shrinkFlags() *cli.Command {
+	return &cli.Command{
+		Name:      "shrink",
+		Usage:     "reclaim the memory of meta engine used by long-lived volumes",
+		ArgsUsage: "REDIS-URL",
+		Action:    shrink,
+		Flags: []cli.Flag{
+			&cli.IntFlag{
+				Name:  "min-slices",
+				Value: 2,
+				Usage: "rewrite the chunks with at least this number of slices",
+			},
+		},
+		Description: `
+The slices of a chunk which are totally overwritten by the newer ones are dropped from
+the list of the chunk, without changing the content of files, the unused data of them is
+deleted by the clients later. With Redis, the keys left by the removed files are deleted,
+and the small hashes which are still encoded as hashtable after most of the entries are
+removed, are rewritten to be encoded as ziplist (or listpack).
+
+Examples:
+$ juicefs shrink redis://localhost`,
+	}
+}
+
+func shrink(ctx *cli.Context) error {
+	setLoggerLevel(ctx)
+	if ctx.Args().Len() < 1 {
+		return fmt.Errorf("REDIS-URL is needed")
+	}
+	addr := ctx.Args().Get(0)
+	if !strings.Contains(addr, "://") {
+		addr = "redis://" + addr
+	}
+
+	logger.Infof("Meta address: %s", addr)
+	var rc = meta.RedisConfig{Retries: 10, Strict: true}
+	m, err := meta.NewClient(addr, &rc)
+	if err != nil {
+		logger.Fatalf("Meta: %s", err)
+	}
+	if _, err = m.Load(); err != nil {
+		logger.Fatalf("load setting: %s", err)
+	}
+
+	var stats meta.ShrinkStats
+	if st := m.Shrink(meta.Background, ctx.Int("min-slices"), &stats); st != 0 {
+		return fmt.Errorf("shrink: %s", st)
+	}
+	logger.Infof("Rewrote %d chunks (dropped %d slices), removed %d orphan keys, rewrote %d hashes",
+		stats.Chunks, stats.Slices, stats.Orphans, stats.Hashes)
+	return nil
+}
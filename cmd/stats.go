@@ -0,0 +1,214 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"syscall"
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/juicedata/juicefs/pkg/utils"
+	"github.com/juicedata/juicefs/pkg/vfs"
+	"github.com/urfave/cli/v2"
+)
+
+func statsFlags() *cli.Command {
+	return &cli.Command{
+		Name:      "stats",
+		Usage:     "show the I/O of a mount point and the top processes or containers using it",
+		ArgsUsage: "MOUNTPOINT",
+		Action:    stats,
+		Flags: []cli.Flag{
+			&cli.IntFlag{
+				Name:  "top",
+				Usage: "show the top N consumers by the bytes read and written",
+			},
+			&cli.StringFlag{
+				Name:  "by",
+				Value: "process",
+				Usage: "group the consumers by process or container",
+			},
+			&cli.Float64Flag{
+				Name:  "interval",
+				Value: 1,
+				Usage: "interval in seconds between the reports",
+			},
+			&cli.IntFlag{
+				Name:  "count",
+				Usage: "number of reports, 0 means until interrupted",
+			},
+		},
+		Description: `
+The operations and bytes are attributed to the processes, and their containers which
+are found in the cgroups of them. The processes idle for 10 minutes are forgotten.
+
+Examples:
+$ juicefs stats /jfs
+$ juicefs stats --top 10 /jfs
+$ juicefs stats --top 5 --by container --count 1 /jfs`,
+	}
+}
+
+// consumerRate is the I/O rate of a process or container.
+type consumerRate struct {
+	key        string
+	pid        uint32
+	name       string
+	container  string
+	procs      int
+	ops        float64
+	readBytes  float64
+	writeBytes float64
+}
+
+func getConsumers(mp string) ([]vfs.Consumer, error) {
+	f := openControler(mp)
+	if f == nil {
+		return nil, fmt.Errorf("%s is not inside JuiceFS", mp)
+	}
+	defer f.Close()
+	wb := utils.NewBuffer(8)
+	wb.Put32(meta.Consumers)
+	wb.Put32(0)
+	if _, err := f.Write(wb.Bytes()); err != nil {
+		return nil, fmt.Errorf("write message: %s", err)
+	}
+	data, err := ioutil.ReadAll(f)
+	if err != nil && err != io.EOF || len(data) == 0 {
+		return nil, fmt.Errorf("read message: %d %s", len(data), err)
+	}
+	if data[0] != 0 {
+		return nil, fmt.Errorf("%s: %s", syscall.Errno(data[0]), data[1:])
+	}
+	var cs []vfs.Consumer
+	if err = json.Unmarshal(data[1:], &cs); err != nil {
+		return nil, fmt.Errorf("decode %q: %s", data[1:], err)
+	}
+	return cs, nil
+}
+
+// consumerRates returns the rates of the consumers between two samples, grouped by
+// process or container, and ordered by the bytes read and written.
+func consumerRates(prev, cur []vfs.Consumer, byContainer bool, seconds float64) []*consumerRate {
+	last := make(map[uint32]vfs.Consumer, len(prev))
+	for _, c := range prev {
+		last[c.Pid] = c
+	}
+	groups := make(map[string]*consumerRate)
+	var rates []*consumerRate
+	for _, c := range cur {
+		p := last[c.Pid]
+		if p.Name != c.Name || p.Ops > c.Ops {
+			p = vfs.Consumer{} // pid is reused
+		}
+		key := fmt.Sprint(c.Pid)
+		if byContainer {
+			key = c.Container
+		}
+		r := groups[key]
+		if r == nil {
+			r = &consumerRate{key: key, pid: c.Pid, name: c.Name, container: c.Container}
+			groups[key] = r
+			rates = append(rates, r)
+		}
+		r.procs++
+		r.ops += float64(c.Ops-p.Ops) / seconds
+		r.readBytes += float64(c.ReadBytes-p.ReadBytes) / seconds
+		r.writeBytes += float64(c.WriteBytes-p.WriteBytes) / seconds
+	}
+	sort.SliceStable(rates, func(i, j int) bool {
+		bi, bj := rates[i].readBytes+rates[i].writeBytes, rates[j].readBytes+rates[j].writeBytes
+		if bi != bj {
+			return bi > bj
+		}
+		return rates[i].ops > rates[j].ops
+	})
+	return rates
+}
+
+func printStats(w io.Writer, rates []*consumerRate, top int, byContainer bool) {
+	var total consumerRate
+	for _, r := range rates {
+		total.ops += r.ops
+		total.readBytes += r.readBytes
+		total.writeBytes += r.writeBytes
+	}
+	fmt.Fprintf(w, "%s  ops: %.0f/s  read: %s/s  write: %s/s\n", time.Now().Format("15:04:05"),
+		total.ops, humanizeBytes(uint64(total.readBytes)), humanizeBytes(uint64(total.writeBytes)))
+	if top <= 0 {
+		return
+	}
+	if byContainer {
+		fmt.Fprintf(w, "  %-14s %6s %10s %12s %12s\n", "CONTAINER", "PROCS", "OPS/S", "READ/S", "WRITE/S")
+	} else {
+		fmt.Fprintf(w, "  %-8s %-16s %-14s %10s %12s %12s\n", "PID", "NAME", "CONTAINER", "OPS/S", "READ/S", "WRITE/S")
+	}
+	for i, r := range rates {
+		if i == top || r.ops == 0 {
+			break
+		}
+		container := r.container
+		if container == "" {
+			container = "-"
+		}
+		if byContainer {
+			fmt.Fprintf(w, "  %-14s %6d %10.0f %12s %12s\n", container, r.procs, r.ops, humanizeBytes(uint64(r.readBytes)), humanizeBytes(uint64(r.writeBytes)))
+		} else {
+			fmt.Fprintf(w, "  %-8d %-16s %-14s %10.0f %12s %12s\n", r.pid, r.name, container, r.ops, humanizeBytes(uint64(r.readBytes)), humanizeBytes(uint64(r.writeBytes)))
+		}
+	}
+}
+
+func stats(ctx *cli.Context) error {
+	setLoggerLevel(ctx)
+	if ctx.Args().Len() < 1 {
+		return fmt.Errorf("MOUNTPOINT is needed")
+	}
+	var byContainer bool
+	switch ctx.String("by") {
+	case "process":
+	case "container":
+		byContainer = true
+	default:
+		return fmt.Errorf("invalid value of --by: %q, it should be process or container", ctx.String("by"))
+	}
+	interval := time.Duration(ctx.Float64("interval") * float64(time.Second))
+	if interval <= 0 {
+		return fmt.Errorf("interval should be positive")
+	}
+	mp := ctx.Args().Get(0)
+	prev, err := getConsumers(mp)
+	if err != nil {
+		return err
+	}
+	last := time.Now()
+	for i := 0; ctx.Int("count") == 0 || i < ctx.Int("count"); i++ {
+		time.Sleep(interval)
+		cur, err := getConsumers(mp)
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		printStats(ctx.App.Writer, consumerRates(prev, cur, byContainer, now.Sub(last).Seconds()), ctx.Int("top"), byContainer)
+		prev, last = cur, now
+	}
+	return nil
+}
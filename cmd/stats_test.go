@@ -0,0 +1,56 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/juicedata/juicefs/pkg/vfs"
+)
+
+func TestConsumerRates(t *testing.T) {
+	prev := []vfs.Consumer{
+		{Pid: 1, Name: "cat", Ops: 10, ReadBytes: 1 << 20},
+		{Pid: 2, Name: "dd", Container: "3f2a9c1b0e7d", Ops: 10, WriteBytes: 1 << 20},
+		{Pid: 3, Name: "old", Ops: 100},
+	}
+	cur := []vfs.Consumer{
+		{Pid: 1, Name: "cat", Ops: 30, ReadBytes: 5 << 20},
+		{Pid: 2, Name: "dd", Container: "3f2a9c1b0e7d", Ops: 50, WriteBytes: 9 << 20},
+		{Pid: 3, Name: "new", Ops: 4},
+		{Pid: 4, Name: "ls", Container: "3f2a9c1b0e7d", Ops: 6},
+	}
+	rates := consumerRates(prev, cur, false, 2)
+	if len(rates) != 4 || rates[0].pid != 2 || rates[0].writeBytes != 4<<20 || rates[1].pid != 1 || rates[1].readBytes != 2<<20 {
+		t.Fatalf("rates by process: %+v %+v", rates[0], rates[1])
+	}
+	if rates[2].pid != 4 || rates[2].ops != 3 || rates[3].pid != 3 || rates[3].ops != 2 {
+		t.Fatalf("rates of new processes: %+v %+v", rates[2], rates[3])
+	}
+
+	rates = consumerRates(prev, cur, true, 2)
+	if len(rates) != 2 || rates[0].container != "3f2a9c1b0e7d" || rates[0].procs != 2 || rates[0].ops != 23 || rates[1].procs != 2 {
+		t.Fatalf("rates by container: %+v", rates)
+	}
+	var buf bytes.Buffer
+	printStats(&buf, rates, 1, true)
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 3 || !strings.Contains(lines[0], "ops: 35/s") || !strings.Contains(lines[0], "write: 4.0 MiB/s") || !strings.HasPrefix(strings.TrimSpace(lines[2]), "3f2a9c1b0e7d") {
+		t.Fatalf("stats:\n%s", buf.String())
+	}
+}
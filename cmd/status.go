@@ -0,0 +1,170 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/juicedata/juicefs/pkg/vfs"
+	"github.com/urfave/cli/v2"
+)
+
+func statusFlags() *cli.Command {
+	return &cli.Command{
+		Name:      "status",
+		Usage:     "Show the setting and the client sessions of a volume, or check the health of a mount point",
+		ArgsUsage: "REDIS-URL",
+		Action:    status,
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:  "check",
+				Usage: "check the health of MOUNTPOINT, exit with non-zero if it's unhealthy",
+			},
+			&cli.Float64Flag{
+				Name:  "timeout",
+				Value: 30,
+				Usage: "seconds to wait for the check",
+			},
+		},
+	}
+}
+
+// checkMount reads the health from the mount point, which is checked by the FUSE daemon.
+func checkMount(mp string, timeout time.Duration) *vfs.Health {
+	var data []byte
+	fuse := vfs.RunHealthCheck("fuse", func() error {
+		var err error
+		data, err = ioutil.ReadFile(filepath.Join(mp, ".health"))
+		return err
+	}, timeout)
+	var h vfs.Health
+	if !fuse.OK {
+		return &vfs.Health{Checks: []*vfs.HealthCheck{fuse}}
+	}
+	if err := json.Unmarshal(data, &h); err != nil {
+		fuse.OK, fuse.Error = false, fmt.Sprintf("invalid health: %s", err)
+		return &vfs.Health{Checks: []*vfs.HealthCheck{fuse}}
+	}
+	return &h
+}
+
+// backlogStatus is the data removed but not deleted from the object storage yet, in bytes before compression.
+type backlogStatus struct {
+	RemovedFiles   int
+	RemovedBytes   uint64
+	OpenedFiles    int // removed but still opened
+	OpenedBytes    uint64
+	ReleasedSlices int // released by compaction or deleted files, but failed to be deleted
+	ReleasedBytes  uint64
+}
+
+func newBacklogStatus(b *meta.Backlog) *backlogStatus {
+	var s backlogStatus
+	for _, f := range b.Files {
+		if f.Opened {
+			s.OpenedFiles++
+		} else {
+			s.RemovedFiles++
+		}
+	}
+	s.RemovedBytes, s.OpenedBytes = b.FileBytes()
+	s.ReleasedSlices, s.ReleasedBytes = len(b.Released), b.ReleasedBytes()
+	return &s
+}
+
+// dedupStatus is the number of deduplicated blocks and the objects holding them.
+type dedupStatus struct {
+	Blocks  int64
+	Objects int
+	Ratio   float64 // blocks per object
+}
+
+func newDedupStatus(objs map[string]int64) *dedupStatus {
+	s := dedupStatus{Objects: len(objs), Ratio: 1}
+	for _, refs := range objs {
+		s.Blocks += refs
+	}
+	if s.Objects > 0 {
+		s.Ratio = float64(s.Blocks) / float64(s.Objects)
+	}
+	return &s
+}
+
+func status(ctx *cli.Context) error {
+	setLoggerLevel(ctx)
+	if mp := ctx.String("check"); mp != "" {
+		h := checkMount(mp, time.Duration(ctx.Float64("timeout")*float64(time.Second)))
+		data, _ := json.MarshalIndent(h, "", "  ")
+		fmt.Println(string(data))
+		if !h.OK {
+			os.Exit(1)
+		}
+		return nil
+	}
+	if ctx.Args().Len() < 1 {
+		return fmt.Errorf("REDIS-URL is needed")
+	}
+	addr := ctx.Args().Get(0)
+	if !strings.Contains(addr, "://") {
+		addr = "redis://" + addr
+	}
+
+	logger.Infof("Meta address: %s", addr)
+	var rc = meta.RedisConfig{Retries: 10, Strict: true}
+	m, err := meta.NewClient(addr, &rc)
+	if err != nil {
+		logger.Fatalf("Meta: %s", err)
+	}
+	format, err := m.Load()
+	if err != nil {
+		logger.Fatalf("load setting: %s", err)
+	}
+	format.RemoveSecret()
+	sessions, err := m.ListSessions()
+	if err != nil {
+		logger.Fatalf("list sessions: %s", err)
+	}
+	var backlog meta.Backlog
+	if st := m.ListDeleted(meta.NewContext(0, 0, []uint32{0}), false, &backlog); st != 0 {
+		logger.Fatalf("list deleted files: %s", st)
+	}
+	var dedup *dedupStatus
+	if format.Dedup {
+		objs, err := m.ListDedup()
+		if err != nil {
+			logger.Fatalf("list deduplicated blocks: %s", err)
+		}
+		dedup = newDedupStatus(objs)
+	}
+	data, err := json.MarshalIndent(struct {
+		Setting  *meta.Format
+		Sessions []*meta.SessionInfo
+		Backlog  *backlogStatus
+		Dedup    *dedupStatus `json:",omitempty"`
+	}{format, sessions, newBacklogStatus(&backlog), dedup}, "", "  ")
+	if err != nil {
+		logger.Fatalf("json: %s", err)
+	}
+	fmt.Println(string(data))
+	return nil
+}
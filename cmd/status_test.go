@@ -0,0 +1,73 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/object"
+)
+
+func TestCheckStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "juicefs-health")
+	if err != nil {
+		t.Fatalf("temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"mem", "file"} {
+		blob, _ := object.CreateStorage(name, dir+"/", "", "")
+		if err := checkStorage(blob); err != nil {
+			t.Fatalf("check %s: %s", name, err)
+		}
+	}
+	blob, _ := object.CreateStorage("file", filepath.Join(dir, "missing")+"/", "", "")
+	_ = os.Remove(filepath.Join(dir, "missing"))
+	if err := checkStorage(blob); err == nil {
+		t.Fatalf("check missing storage should fail")
+	}
+}
+
+func TestCheckMount(t *testing.T) {
+	mp, err := ioutil.TempDir("", "juicefs-mp")
+	if err != nil {
+		t.Fatalf("temp dir: %s", err)
+	}
+	defer os.RemoveAll(mp)
+	if h := checkMount(mp, time.Second); h.OK || len(h.Checks) != 1 || h.Checks[0].Name != "fuse" {
+		t.Fatalf("check without .health: %+v", h)
+	}
+	health := `{"OK": false, "Checks": [{"Name": "fuse", "OK": true}, {"Name": "meta", "OK": false, "Error": "EIO"}]}`
+	if err = ioutil.WriteFile(filepath.Join(mp, ".health"), []byte(health), 0644); err != nil {
+		t.Fatalf("write .health: %s", err)
+	}
+	if h := checkMount(mp, time.Second); h.OK || len(h.Checks) != 2 || h.Checks[1].Error != "EIO" {
+		t.Fatalf("check unhealthy mount: %+v", h)
+	}
+}
+
+func TestDedupStatus(t *testing.T) {
+	if s := newDedupStatus(nil); s.Blocks != 0 || s.Objects != 0 || s.Ratio != 1 {
+		t.Fatalf("status of no blocks: %+v", s)
+	}
+	s := newDedupStatus(map[string]int64{"chunks/0/0/1_0_10": 3, "chunks/0/0/2_0_10": 1})
+	if s.Blocks != 4 || s.Objects != 2 || s.Ratio != 2 {
+		t.Fatalf("status of blocks: %+v", s)
+	}
+}
@@ -201,6 +201,11 @@ func syncFlags() *cli.Command {
 				Value:   10,
 				Usage:   "number of concurrent threads",
 			},
+			&cli.IntFlag{
+				Name:  "list-threads",
+				Value: 1,
+				Usage: "number of threads to list the objects in parallel",
+			},
 			&cli.IntFlag{
 				Name:  "http-port",
 				Value: 6070,
@@ -216,6 +221,18 @@ func syncFlags() *cli.Command {
 				Aliases: []string{"f"},
 				Usage:   "always update existing file",
 			},
+			&cli.BoolFlag{
+				Name:  "checksum",
+				Usage: "compare the content (SHA256) of existing file with the same size, using the checksums kept by JuiceFS if available",
+			},
+			&cli.BoolFlag{
+				Name:  "delta",
+				Usage: "update existing file in place by writing the changed blocks only, if the destination is a file system",
+			},
+			&cli.BoolFlag{
+				Name:  "sparse",
+				Usage: "keep the holes of sparse files and skip the zero blocks, if the destination is a file system",
+			},
 			&cli.BoolFlag{
 				Name:  "perms",
 				Usage: "preserve permissions",
@@ -225,8 +242,9 @@ func syncFlags() *cli.Command {
 				Usage: "Sync directories or holders",
 			},
 			&cli.BoolFlag{
-				Name:  "dry",
-				Usage: "don't copy file",
+				Name:    "dry",
+				Aliases: []string{"dry-run"},
+				Usage:   "don't copy or delete anything, but report the changes",
 			},
 			&cli.BoolFlag{
 				Name:    "delete-src",
@@ -246,6 +264,10 @@ func syncFlags() *cli.Command {
 				Name:  "include",
 				Usage: "only include keys containing `PATTERN` (POSIX regular expressions)",
 			},
+			&cli.StringFlag{
+				Name:  "exclude-from",
+				Usage: "exclude keys matching the patterns in `FILE`, which has the same syntax as .gitignore",
+			},
 			&cli.StringFlag{
 				Name:  "manager",
 				Usage: "manager address",
@@ -258,10 +280,35 @@ func syncFlags() *cli.Command {
 				Name:  "bwlimit",
 				Usage: "limit bandwidth in Mbps (0 means unlimited)",
 			},
+			&cli.StringFlag{
+				Name:  "bwlimit-schedule",
+				Usage: "bandwidth limits in Mbps in some windows, e.g. \"00:00-06:00=0; mon-fri 09:00-18:00=80\", --bwlimit applies out of them",
+			},
 			&cli.BoolFlag{
 				Name:  "no-https",
 				Usage: "donot use HTTPS",
 			},
+			&cli.StringFlag{
+				Name:  "checkpoint",
+				Usage: "path of the file to save the progress, the sync is resumed from it if it exists",
+			},
+			&cli.BoolFlag{
+				Name:  "two-way",
+				Usage: "sync the changes since last sync in both directions, including deletions",
+			},
+			&cli.StringFlag{
+				Name:  "baseline",
+				Usage: "path of the file to keep the state of last two-way sync",
+			},
+			&cli.StringFlag{
+				Name:  "conflict",
+				Value: "newer",
+				Usage: "policy for the files changed in both sides in two-way sync: newer (the one modified later wins) or rename-both",
+			},
+			&cli.StringFlag{
+				Name:  "conflict-hook",
+				Usage: "`COMMAND` to resolve the conflicts in two-way sync, it prints src, dst or both (keep both), the key is passed as JFS_SYNC_KEY",
+			},
 		},
 	}
 }
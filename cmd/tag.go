@@ -0,0 +1,129 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/urfave/cli/v2"
+)
+
+func tagFlags() *cli.Command {
+	return &cli.Command{
+		Name:      "tag",
+		Usage:     "Set, list or search the tags of files and directories",
+		ArgsUsage: "REDIS-URL [PATH [KEY=VALUE ...]]",
+		Action:    tag,
+		Flags: []cli.Flag{
+			&cli.BoolFlag{
+				Name:    "remove",
+				Aliases: []string{"r"},
+				Usage:   "remove the tags with given keys instead of setting them",
+			},
+			&cli.StringFlag{
+				Name:  "search",
+				Usage: "print the inodes tagged with KEY or KEY=VALUE",
+			},
+		},
+	}
+}
+
+// resolve returns the inode of a path inside the volume.
+func resolve(m meta.Meta, p string) (meta.Ino, syscall.Errno) {
+	var inode = meta.Ino(1)
+	var attr meta.Attr
+	for _, name := range strings.Split(p, "/") {
+		if name == "" || name == "." {
+			continue
+		}
+		if st := m.Lookup(meta.Background, inode, name, &inode, &attr); st != 0 {
+			return 0, st
+		}
+	}
+	return inode, 0
+}
+
+func tag(ctx *cli.Context) error {
+	setLoggerLevel(ctx)
+	if ctx.Args().Len() < 1 {
+		return fmt.Errorf("REDIS-URL is needed")
+	}
+	addr := ctx.Args().Get(0)
+	if !strings.Contains(addr, "://") {
+		addr = "redis://" + addr
+	}
+
+	logger.Infof("Meta address: %s", addr)
+	var rc = meta.RedisConfig{Retries: 10, Strict: true}
+	m, err := meta.NewClient(addr, &rc)
+	if err != nil {
+		logger.Fatalf("Meta: %s", err)
+	}
+	if _, err = m.Load(); err != nil {
+		logger.Fatalf("load setting: %s", err)
+	}
+	if ctx.IsSet("search") {
+		kv := strings.SplitN(ctx.String("search"), "=", 2)
+		kv = append(kv, "")
+		var inodes []meta.Ino
+		if st := m.SearchTag(meta.Background, kv[0], kv[1], &inodes); st != 0 {
+			logger.Fatalf("search tag %s: %s", ctx.String("search"), st)
+		}
+		for _, ino := range inodes {
+			fmt.Println(ino)
+		}
+		return nil
+	}
+	if ctx.Args().Len() < 2 {
+		return fmt.Errorf("PATH is needed")
+	}
+	p := ctx.Args().Get(1)
+	inode, st := resolve(m, p)
+	if st != 0 {
+		logger.Fatalf("lookup %s: %s", p, st)
+	}
+	if ctx.Args().Len() == 2 {
+		var tags map[string]string
+		if st = m.GetTags(meta.Background, inode, &tags); st != 0 {
+			logger.Fatalf("get tags of %s: %s", p, st)
+		}
+		keys := make([]string, 0, len(tags))
+		for k := range tags {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			fmt.Printf("%s=%s\n", k, tags[k])
+		}
+		return nil
+	}
+	for _, arg := range ctx.Args().Slice()[2:] {
+		if ctx.Bool("remove") {
+			st = m.RemoveTag(meta.Background, inode, strings.SplitN(arg, "=", 2)[0])
+		} else {
+			kv := append(strings.SplitN(arg, "=", 2), "")
+			st = m.SetTag(meta.Background, inode, kv[0], kv[1])
+		}
+		if st != 0 {
+			logger.Fatalf("tag %s with %s: %s", p, arg, st)
+		}
+	}
+	return nil
+}
@@ -46,9 +46,10 @@ func umount(ctx *cli.Context) error {
 	if ctx.Args().Len() < 1 {
 		return fmt.Errorf("MOUNTPOINT is needed")
 	}
-	mp := ctx.Args().Get(0)
-	force := ctx.Bool("force")
+	return doUmount(ctx.Args().Get(0), ctx.Bool("force"))
+}
 
+func doUmount(mp string, force bool) error {
 	var cmd *exec.Cmd
 	switch runtime.GOOS {
 	case "darwin":
@@ -71,6 +72,12 @@ func umount(ctx *cli.Context) error {
 				cmd = exec.Command("umount", mp)
 			}
 		}
+	case "freebsd":
+		if force {
+			cmd = exec.Command("umount", "-f", mp)
+		} else {
+			cmd = exec.Command("umount", mp)
+		}
 	case "windows":
 		if !force {
 			_ = os.Mkdir(filepath.Join(mp, ".UMOUNTIT"), 0755)
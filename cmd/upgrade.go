@@ -0,0 +1,109 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/urfave/cli/v2"
+)
+
+func upgradeMetaFlags() *cli.Command {
+	return &cli.Command{
+		Name:      "upgrade-meta",
+		Usage:     "upgrade the metadata of a volume to the latest version supported by this client",
+		ArgsUsage: "REDIS-URL",
+		Action:    upgradeMeta,
+		Flags: []cli.Flag{
+			&cli.BoolFlag{
+				Name:  "dry-run",
+				Usage: "print the migrations to run without running them",
+			},
+			&cli.BoolFlag{
+				Name:  "force",
+				Usage: "upgrade even if some clients don't support the new version",
+			},
+		},
+		Description: `
+The version of metadata is kept in the setting of volume. A client refuses to mount
+a volume with newer metadata unless it's read-only, and a mounted client becomes
+read-only once the metadata is upgraded by others, so it can't break the metadata
+it doesn't understand. The clients before the version is recorded can't check it,
+so the upgrade is refused if any of them (or other older clients) is still
+connected, upgrade or unmount them first, or use --force.
+
+The migrations are run one by one, the version is updated after each of them, so
+an interrupted upgrade can be resumed by running it again.
+
+Examples:
+$ juicefs upgrade-meta --dry-run redis://localhost
+$ juicefs upgrade-meta redis://localhost`,
+	}
+}
+
+func upgradeMeta(ctx *cli.Context) error {
+	setLoggerLevel(ctx)
+	if ctx.Args().Len() < 1 {
+		return fmt.Errorf("REDIS-URL is needed")
+	}
+	addr := ctx.Args().Get(0)
+	if !strings.Contains(addr, "://") {
+		addr = "redis://" + addr
+	}
+	logger.Infof("Meta address: %s", addr)
+	m, err := meta.NewClient(addr, &meta.RedisConfig{Retries: 10, Strict: true})
+	if err != nil {
+		logger.Fatalf("Meta: %s", err)
+	}
+	format, err := m.Load()
+	if err != nil {
+		logger.Fatalf("load setting: %s", err)
+	}
+	if format.MetaVersion >= meta.MetaVersion {
+		fmt.Fprintf(ctx.App.Writer, "The metadata of volume %s is version %d, no upgrade is needed\n", format.Name, format.MetaVersion)
+		return nil
+	}
+	for _, mg := range meta.PendingMigrations(format.MetaVersion) {
+		fmt.Fprintf(ctx.App.Writer, "Version %d: %s\n", mg.Version, mg.Desc)
+	}
+	if ctx.Bool("dry-run") {
+		return nil
+	}
+
+	sessions, err := m.ListSessions()
+	if err != nil {
+		logger.Fatalf("list sessions: %s", err)
+	}
+	var olds []string
+	for _, s := range sessions {
+		if s.MetaVersion < meta.MetaVersion {
+			olds = append(olds, fmt.Sprintf("%d (%s:%d)", s.Sid, s.Hostname, s.ProcessID))
+		}
+	}
+	if len(olds) > 0 {
+		if !ctx.Bool("force") {
+			logger.Fatalf("The clients of sessions %s don't support version %d, upgrade or unmount them first", strings.Join(olds, ", "), meta.MetaVersion)
+		}
+		logger.Warnf("The clients of sessions %s don't support version %d, the ones before the version is recorded may break the metadata", strings.Join(olds, ", "), meta.MetaVersion)
+	}
+	if err = meta.Upgrade(m); err != nil {
+		logger.Fatalf("upgrade: %s", err)
+	}
+	fmt.Fprintf(ctx.App.Writer, "The metadata of volume %s is upgraded to version %d\n", format.Name, meta.MetaVersion)
+	return nil
+}
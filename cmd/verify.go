@@ -0,0 +1,570 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
+
+func verifyFlags() *cli.Command {
+	return &cli.Command{
+		Name:      "verify",
+		Usage:     "verify data integrity by writing patterned files and reading them back",
+		ArgsUsage: "PATH",
+		Action:    verifyIntegrity,
+		Description: `
+The files are written with a pattern derived from the seed, some blocks of them
+are overwritten, then they are synced and closed. With --crash, the client is
+killed after a random number of files are synced and mounted again, the synced
+files should have the same content, size, mode and mtime, and the files being
+written should only contain zeros or the data which had been written.
+
+Examples:
+$ juicefs verify /jfs
+$ juicefs verify --crash 5 --files 1000 /jfs`,
+		Flags: []cli.Flag{
+			&cli.IntFlag{
+				Name:  "files",
+				Value: 100,
+				Usage: "number of files written in each round",
+			},
+			&cli.Float64Flag{
+				Name:  "file-size",
+				Value: 1,
+				Usage: "size of each file in MiB",
+			},
+			&cli.IntFlag{
+				Name:  "block-size",
+				Value: 128,
+				Usage: "size of each write in KiB (multiple of 4)",
+			},
+			&cli.IntFlag{
+				Name:  "overwrites",
+				Value: 4,
+				Usage: "number of random blocks overwritten in each file",
+			},
+			&cli.IntFlag{
+				Name:  "threads",
+				Value: 4,
+				Usage: "number of concurrent writers",
+			},
+			&cli.IntFlag{
+				Name:  "crash",
+				Usage: "number of rounds to kill the client at random points and mount it again (Linux only)",
+			},
+			&cli.StringFlag{
+				Name:  "mount-cmd",
+				Usage: "shell command to mount the volume again after crash (default: the command line of the killed client)",
+			},
+			&cli.Int64Flag{
+				Name:  "seed",
+				Usage: "seed of the pattern and the crash points (default: random)",
+			},
+			&cli.BoolFlag{
+				Name:  "keep",
+				Usage: "keep the files after verification",
+			},
+		},
+	}
+}
+
+const verifyPageSize = 4096
+
+// verifyFile is the expected state of a file written by verifier.
+type verifyFile struct {
+	path  string
+	key   uint64
+	size  int64
+	mode  os.FileMode
+	mtime time.Time
+	gens  []uint32 // number of writes to every block
+}
+
+type verifier struct {
+	blockSize  int
+	blocks     int
+	overwrites int
+	rand       *rand.Rand
+
+	sync.Mutex
+	committed  map[string]*verifyFile // synced and closed
+	incomplete map[string]*verifyFile // being written when the client crashed
+}
+
+func newVerifier(fileSize int64, blockSize, overwrites int, seed int64) *verifier {
+	return &verifier{
+		blockSize:  blockSize,
+		blocks:     int((fileSize + int64(blockSize) - 1) / int64(blockSize)),
+		overwrites: overwrites,
+		rand:       rand.New(rand.NewSource(seed)),
+		committed:  make(map[string]*verifyFile),
+		incomplete: make(map[string]*verifyFile),
+	}
+}
+
+func mix64(x uint64) uint64 {
+	x += 0x9e3779b97f4a7c15
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	return x ^ (x >> 31)
+}
+
+// fillPattern fills buf with the data of the gen-th write to a block, starting from off in the block.
+func fillPattern(buf []byte, key uint64, block int, gen uint32, off int) {
+	base := mix64(key ^ uint64(block)<<20 ^ uint64(gen)<<48)
+	for i := 0; i+8 <= len(buf); i += 8 {
+		binary.LittleEndian.PutUint64(buf[i:], mix64(base+uint64(off+i)))
+	}
+}
+
+func (v *verifier) newFile(path string) *verifyFile {
+	v.Lock()
+	defer v.Unlock()
+	modes := []os.FileMode{0600, 0640, 0644, 0755}
+	return &verifyFile{
+		path:  path,
+		key:   v.rand.Uint64(),
+		size:  int64(v.blocks) * int64(v.blockSize),
+		mode:  modes[v.rand.Intn(len(modes))],
+		mtime: time.Unix(1500000000+v.rand.Int63n(1e8), v.rand.Int63n(1e9)),
+		gens:  make([]uint32, v.blocks),
+	}
+}
+
+func (v *verifier) writeBlock(f *os.File, vf *verifyFile, buf []byte, block int) error {
+	v.Lock()
+	vf.gens[block]++
+	gen := vf.gens[block]
+	v.Unlock()
+	fillPattern(buf, vf.key, block, gen, 0)
+	_, err := f.WriteAt(buf, int64(block)*int64(v.blockSize))
+	return err
+}
+
+// writeFile writes all the blocks, overwrites some of them, syncs the file, then changes
+// its mode and mtime.
+func (v *verifier) writeFile(vf *verifyFile, pending map[string]*verifyFile) error {
+	v.Lock()
+	pending[vf.path] = vf
+	overwrites := make([]int, v.overwrites)
+	for i := range overwrites {
+		overwrites[i] = v.rand.Intn(v.blocks)
+	}
+	v.Unlock()
+	f, err := os.OpenFile(vf.path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	buf := make([]byte, v.blockSize)
+	for i := 0; i < v.blocks; i++ {
+		if err = v.writeBlock(f, vf, buf, i); err != nil {
+			return err
+		}
+	}
+	for _, i := range overwrites {
+		if err = v.writeBlock(f, vf, buf, i); err != nil {
+			return err
+		}
+	}
+	if err = f.Sync(); err != nil {
+		return err
+	}
+	if err = f.Chmod(vf.mode); err != nil {
+		return err
+	}
+	if err = os.Chtimes(vf.path, vf.mtime, vf.mtime); err != nil {
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	v.Lock()
+	delete(pending, vf.path)
+	v.committed[vf.path] = vf
+	v.Unlock()
+	return nil
+}
+
+// writeFiles writes n files into dir, crash is called once after crashAfter files are committed.
+func (v *verifier) writeFiles(dir string, n, threads, crashAfter int, crash func()) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	pending := make(map[string]*verifyFile)
+	todo := make(chan int, n)
+	for i := 0; i < n; i++ {
+		todo <- i
+	}
+	close(todo)
+	var wg sync.WaitGroup
+	var once sync.Once
+	var crashed bool
+	var done int
+	errs := make(chan error, threads)
+	for t := 0; t < threads; t++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range todo {
+				if err := v.writeFile(v.newFile(filepath.Join(dir, strconv.Itoa(i))), pending); err != nil {
+					v.Lock()
+					c := crashed
+					v.Unlock()
+					if !c {
+						errs <- err
+					}
+					return
+				}
+				v.Lock()
+				done++
+				hit := done == crashAfter
+				v.Unlock()
+				if hit {
+					once.Do(func() {
+						v.Lock()
+						crashed = true
+						v.Unlock()
+						crash()
+					})
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for p, vf := range pending {
+		v.incomplete[p] = vf
+	}
+	return <-errs
+}
+
+func readAll(path string) ([]byte, os.FileInfo, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err := ioutil.ReadAll(f)
+	return data, st, err
+}
+
+// checkCommitted checks the content and attributes of a synced file.
+func (v *verifier) checkCommitted(vf *verifyFile) error {
+	data, st, err := readAll(vf.path)
+	if err != nil {
+		return err
+	}
+	if st.Size() != vf.size || int64(len(data)) != vf.size {
+		return fmt.Errorf("size %d (read %d), expected %d", st.Size(), len(data), vf.size)
+	}
+	if st.Mode().Perm() != vf.mode {
+		return fmt.Errorf("mode %s, expected %s", st.Mode().Perm(), vf.mode)
+	}
+	if !st.ModTime().Equal(vf.mtime) {
+		return fmt.Errorf("mtime %s, expected %s", st.ModTime(), vf.mtime)
+	}
+	expected := make([]byte, v.blockSize)
+	for i := 0; i < v.blocks; i++ {
+		fillPattern(expected, vf.key, i, vf.gens[i], 0)
+		if block := data[i*v.blockSize : (i+1)*v.blockSize]; !bytes.Equal(block, expected) {
+			return fmt.Errorf("block %d is corrupted", i)
+		}
+	}
+	return nil
+}
+
+// checkIncomplete checks that every page of a file which was being written
+// is zero or the data of one of the writes to it.
+func (v *verifier) checkIncomplete(vf *verifyFile) error {
+	data, _, err := readAll(vf.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(data) > v.blocks*v.blockSize {
+		return fmt.Errorf("size %d is larger than written %d", len(data), v.blocks*v.blockSize)
+	}
+	zero := make([]byte, verifyPageSize)
+	expected := make([]byte, verifyPageSize)
+	for off := 0; off < len(data); off += verifyPageSize {
+		end := off + verifyPageSize
+		if end > len(data) {
+			end = len(data)
+		}
+		page := data[off:end]
+		if bytes.Equal(page, zero[:len(page)]) {
+			continue
+		}
+		block := off / v.blockSize
+		var ok bool
+		for gen := uint32(1); gen <= vf.gens[block] && !ok; gen++ {
+			fillPattern(expected, vf.key, block, gen, off%v.blockSize)
+			ok = bytes.Equal(page, expected[:len(page)])
+		}
+		if !ok {
+			return fmt.Errorf("page at %d is corrupted", off)
+		}
+	}
+	return nil
+}
+
+// check verifies all the files written, and there should be no other file in dirs.
+func (v *verifier) check(dirs []string) (errors int) {
+	report := func(path string, err error) {
+		logger.Errorf("verify %s: %s", path, err)
+		errors++
+	}
+	known := make(map[string]bool)
+	for p, vf := range v.committed {
+		known[p] = true
+		if err := v.checkCommitted(vf); err != nil {
+			report(p, err)
+		}
+	}
+	for p, vf := range v.incomplete {
+		known[p] = true
+		if err := v.checkIncomplete(vf); err != nil {
+			report(p, err)
+		}
+	}
+	for _, dir := range dirs {
+		names, err := readDirNames(dir)
+		if err != nil {
+			report(dir, err)
+			continue
+		}
+		for _, name := range names {
+			if p := filepath.Join(dir, name); !known[p] {
+				report(p, fmt.Errorf("unexpected file"))
+			}
+		}
+	}
+	return
+}
+
+func readDirNames(dir string) ([]string, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return f.Readdirnames(-1)
+}
+
+// findMountpoint returns the mount point of JuiceFS which path is in.
+func findMountpoint(path string) string {
+	if _, err := os.Stat(filepath.Join(path, ".control")); err == nil {
+		return path
+	}
+	if path == "/" || path == "." {
+		return ""
+	}
+	return findMountpoint(filepath.Dir(path))
+}
+
+// mountClient is a process which serves a mount point.
+type mountClient struct {
+	pid  int
+	exe  string
+	args []string
+	dir  string
+}
+
+// findClients looks for the processes of `juicefs mount` serving mp in /proc.
+func findClients(mp string) ([]*mountClient, error) {
+	procs, err := readDirNames("/proc")
+	if err != nil {
+		return nil, err
+	}
+	var clients []*mountClient
+	for _, p := range procs {
+		pid, err := strconv.Atoi(p)
+		if err != nil || pid == os.Getpid() {
+			continue
+		}
+		cmdline, err := ioutil.ReadFile(filepath.Join("/proc", p, "cmdline"))
+		if err != nil {
+			continue
+		}
+		args := strings.Split(strings.TrimRight(string(cmdline), "\x00"), "\x00")
+		var isMount, isMp bool
+		for _, a := range args[1:] {
+			isMount = isMount || a == "mount"
+			isMp = isMp || a == mp
+		}
+		if !isMount || !isMp {
+			continue
+		}
+		exe, _ := os.Readlink(filepath.Join("/proc", p, "exe"))
+		dir, _ := os.Readlink(filepath.Join("/proc", p, "cwd"))
+		clients = append(clients, &mountClient{pid, exe, args, dir})
+	}
+	if len(clients) == 0 {
+		return nil, fmt.Errorf("no client is found for %s", mp)
+	}
+	return clients, nil
+}
+
+func waitFor(what string, timeout time.Duration, cond func() bool) error {
+	for deadline := time.Now().Add(timeout); !cond(); time.Sleep(time.Millisecond * 100) {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%s: timeout after %s", what, timeout)
+		}
+	}
+	return nil
+}
+
+// crashClient kills the clients of mp and mounts it again.
+func crashClient(mp, mountCmd string) error {
+	clients, err := findClients(mp)
+	if err != nil {
+		return err
+	}
+	for _, c := range clients {
+		logger.Infof("Kill client %d: %s", c.pid, strings.Join(c.args, " "))
+		if p, err := os.FindProcess(c.pid); err == nil {
+			_ = p.Kill()
+		}
+	}
+	for _, c := range clients {
+		proc := filepath.Join("/proc", strconv.Itoa(c.pid))
+		if err = waitFor("wait client to exit", time.Second*10, func() bool {
+			_, err := os.Stat(proc)
+			return os.IsNotExist(err)
+		}); err != nil {
+			return err
+		}
+	}
+	if err = doUmount(mp, true); err != nil {
+		logger.Warnf("umount %s: %s", mp, err)
+	}
+
+	var cmd *exec.Cmd
+	if mountCmd != "" {
+		cmd = exec.Command("/bin/sh", "-c", mountCmd)
+	} else {
+		c := clients[0]
+		cmd = exec.Command(c.exe, c.args[1:]...)
+		cmd.Dir = c.dir
+	}
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	logger.Infof("Mount again: %s", strings.Join(cmd.Args, " "))
+	if err = cmd.Start(); err != nil {
+		return err
+	}
+	go func() { _ = cmd.Wait() }()
+	return waitFor("wait mount to be ready", time.Second*30, func() bool {
+		_, err := os.Stat(filepath.Join(mp, ".control"))
+		return err == nil
+	})
+}
+
+func dropCaches() {
+	if runtime.GOOS == "linux" && os.Getuid() == 0 {
+		_ = ioutil.WriteFile("/proc/sys/vm/drop_caches", []byte("3"), 0)
+	}
+}
+
+func verifyIntegrity(c *cli.Context) error {
+	setLoggerLevel(c)
+	if c.Args().Len() < 1 {
+		return fmt.Errorf("PATH is needed")
+	}
+	path, err := filepath.Abs(c.Args().Get(0))
+	if err != nil {
+		return err
+	}
+	blockSize := c.Int("block-size") << 10
+	if blockSize <= 0 || blockSize%verifyPageSize != 0 {
+		return fmt.Errorf("invalid block size: %d KiB", c.Int("block-size"))
+	}
+	fileSize := int64(c.Float64("file-size") * (1 << 20))
+	if fileSize <= 0 || c.Int("files") <= 0 || c.Int("threads") <= 0 || c.Int("overwrites") < 0 {
+		return fmt.Errorf("file-size, files and threads should be positive")
+	}
+	rounds := c.Int("crash")
+	var mp string
+	if rounds > 0 {
+		if runtime.GOOS != "linux" {
+			return fmt.Errorf("crash is only supported on Linux")
+		}
+		if mp = findMountpoint(path); mp == "" {
+			return fmt.Errorf("%s is not inside JuiceFS", path)
+		}
+	}
+	seed := c.Int64("seed")
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	logger.Infof("Verify with seed %d", seed)
+
+	v := newVerifier(fileSize, blockSize, c.Int("overwrites"), seed)
+	root := filepath.Join(path, fmt.Sprintf("__juicefs_verify_%d__", time.Now().UnixNano()))
+	files := c.Int("files")
+	var dirs []string
+	for r := 0; r <= rounds; r++ {
+		dir := filepath.Join(root, strconv.Itoa(r))
+		dirs = append(dirs, dir)
+		crashAfter := 0
+		if r < rounds {
+			crashAfter = 1 + v.rand.Intn(files)
+		}
+		var crashErr error
+		crash := func() {
+			fmt.Printf("Round %d: crash the client after %d files are synced\n", r, crashAfter)
+			crashErr = crashClient(mp, c.String("mount-cmd"))
+		}
+		if err = v.writeFiles(dir, files, c.Int("threads"), crashAfter, crash); err != nil {
+			return fmt.Errorf("write files: %s", err)
+		}
+		if crashErr != nil {
+			return fmt.Errorf("crash client: %s", crashErr)
+		}
+		dropCaches()
+		if n := v.check(dirs); n > 0 {
+			return fmt.Errorf("%d errors are found in round %d, files are kept in %s", n, r, root)
+		}
+		fmt.Printf("Round %d: verified %d synced files and %d incomplete files\n", r, len(v.committed), len(v.incomplete))
+	}
+	if !c.Bool("keep") {
+		if err = os.RemoveAll(root); err != nil {
+			logger.Warnf("remove %s: %s", root, err)
+		}
+	}
+	return nil
+}
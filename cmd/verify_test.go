@@ -0,0 +1,89 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestVerifier(t *testing.T) {
+	dir, err := ioutil.TempDir("", "juicefs-verify")
+	if err != nil {
+		t.Fatalf("temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	v := newVerifier(100<<10, 16<<10, 3, 1)
+	var crashed int
+	if err = v.writeFiles(dir, 10, 3, 4, func() { crashed++ }); err != nil {
+		t.Fatalf("write files: %s", err)
+	}
+	if crashed != 1 || len(v.committed) != 10 || v.blocks != 7 {
+		t.Fatalf("crashed %d, committed %d, blocks %d", crashed, len(v.committed), v.blocks)
+	}
+	if n := v.check([]string{dir}); n != 0 {
+		t.Fatalf("%d errors in good files", n)
+	}
+
+	// a file was being written when crashed: it's fine to lose the tail or get zeros
+	p := filepath.Join(dir, "0")
+	vf := v.committed[p]
+	delete(v.committed, p)
+	v.incomplete[p] = vf
+	if err = os.Truncate(p, 40<<10); err != nil {
+		t.Fatalf("truncate: %s", err)
+	}
+	zeros := make([]byte, verifyPageSize)
+	if err = writeAt(p, zeros, 16<<10); err != nil {
+		t.Fatalf("write zeros: %s", err)
+	}
+	if n := v.check([]string{dir}); n != 0 {
+		t.Fatalf("%d errors in incomplete file", n)
+	}
+	garbage := append([]byte{}, zeros...)
+	garbage[100] = 1
+	if err = writeAt(p, garbage, 0); err != nil {
+		t.Fatalf("write garbage: %s", err)
+	}
+	if n := v.check([]string{dir}); n != 1 {
+		t.Fatalf("expect 1 error in corrupted incomplete file, got %d", n)
+	}
+	_ = os.Remove(p)
+
+	p = filepath.Join(dir, "1")
+	if err = writeAt(p, []byte{0}, 20<<10); err != nil {
+		t.Fatalf("write: %s", err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(dir, "unknown"), nil, 0644); err != nil {
+		t.Fatalf("create: %s", err)
+	}
+	if n := v.check([]string{dir}); n != 2 {
+		t.Fatalf("expect 2 errors, got %d", n)
+	}
+}
+
+func writeAt(path string, data []byte, off int64) error {
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.WriteAt(data, off)
+	return err
+}
@@ -0,0 +1,145 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package chunk
+
+// The cached blocks are saved into an index file in the cache directory regularly, so
+// the cache can be used at once after remount, without waiting for scanning all the
+// cached files, which could take minutes for a large cache. The cache is still scanned
+// in background later to find the blocks changed after the index is saved. A line of
+// the index is "KEY SIZE ATIME[ 1]", the last field is 1 for the pinned blocks.
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const indexHeader = "juicefs cache index v1"
+
+var (
+	cacheIndex    = "raw.index"
+	indexInterval = time.Minute     // interval to save the index if it's changed
+	scanInterval  = time.Minute * 5 // interval to scan the cached files
+)
+
+func (cache *cacheStore) indexPath() string {
+	return filepath.Join(cache.dir, cacheIndex)
+}
+
+// saveIndex writes the cached blocks into the index file.
+func (cache *cacheStore) saveIndex() error {
+	cache.Lock()
+	if !cache.scanned {
+		cache.Unlock()
+		return nil
+	}
+	var buf bytes.Buffer
+	buf.Grow(len(cache.keys) * 48)
+	buf.WriteString(indexHeader + "\n")
+	for key, it := range cache.keys {
+		if cache.pinned[key] {
+			fmt.Fprintf(&buf, "%s %d %d 1\n", key, it.size, it.atime)
+		} else {
+			fmt.Fprintf(&buf, "%s %d %d\n", key, it.size, it.atime)
+		}
+	}
+	cache.changed = false
+	cache.Unlock()
+
+	path := cache.indexPath()
+	tmp := path + tmpSuffix
+	if err := ioutil.WriteFile(tmp, buf.Bytes(), cache.mode); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// loadIndex loads the cached blocks from the index file, it returns false if the
+// index is not existed or broken.
+func (cache *cacheStore) loadIndex() bool {
+	f, err := os.Open(cache.indexPath())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Warnf("open cache index: %s", err)
+		}
+		return false
+	}
+	defer f.Close()
+	start := time.Now()
+	keys := make(map[string]cacheItem)
+	var pinned []string
+	var used int64
+	scanner := bufio.NewScanner(f)
+	if !scanner.Scan() || scanner.Text() != indexHeader {
+		logger.Warnf("invalid cache index %s", cache.indexPath())
+		return false
+	}
+	for scanner.Scan() {
+		fs := strings.Fields(scanner.Text())
+		if len(fs) != 3 && (len(fs) != 4 || fs[3] != "1") {
+			logger.Warnf("invalid line in cache index %s: %q", cache.indexPath(), scanner.Text())
+			return false
+		}
+		size, err1 := strconv.ParseInt(fs[1], 10, 32)
+		atime, err2 := strconv.ParseUint(fs[2], 10, 32)
+		if err1 != nil || err2 != nil {
+			logger.Warnf("invalid line in cache index %s: %q", cache.indexPath(), scanner.Text())
+			return false
+		}
+		keys[fs[0]] = cacheItem{size: int32(size), atime: uint32(atime), ctime: uint32(atime)}
+		used += size + 4096
+		if len(fs) == 4 {
+			pinned = append(pinned, fs[0])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		logger.Warnf("read cache index %s: %s", cache.indexPath(), err)
+		return false
+	}
+
+	cache.Lock()
+	defer cache.Unlock()
+	// keep the blocks cached before loaded
+	for key, it := range cache.keys {
+		if old, ok := keys[key]; ok {
+			used -= int64(old.size + 4096)
+		}
+		keys[key] = it
+		used += int64(it.size + 4096)
+	}
+	cache.keys = keys
+	cache.used = used
+	cache.scanned = true
+	for _, key := range pinned {
+		if !cache.pinned[key] {
+			cache.pinned[key] = true
+			cache.pinnedUsed += pinnedSize(key)
+		}
+	}
+	logger.Infof("Loaded %d cached blocks (%d bytes) from index %s in %s", len(keys), used, cache.indexPath(), time.Since(start))
+	return true
+}
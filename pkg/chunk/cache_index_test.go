@@ -0,0 +1,82 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package chunk
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func waitScanned(t *testing.T, s *cacheStore) {
+	for start := time.Now(); ; time.Sleep(time.Millisecond * 10) {
+		s.Lock()
+		scanned := s.scanned
+		s.Unlock()
+		if scanned {
+			return
+		}
+		if time.Since(start) > time.Second*5 {
+			t.Fatalf("cache is not scanned")
+		}
+	}
+}
+
+func TestCacheIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cacheIndex")
+	if err != nil {
+		t.Fatalf("temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	dir += "/"
+	conf := defaultConf
+	s := newCacheStore(dir, 1<<30, 0, 0, 1<<10, 1, &conf)
+	waitScanned(t, s)
+	for i := 0; i < 10; i++ {
+		s.add(fmt.Sprintf("chunks/0/0/%d_0_1024", i), 1024, uint32(time.Now().Unix()))
+	}
+	s.remove("chunks/0/0/0_0_1024")
+	if err := s.saveIndex(); err != nil {
+		t.Fatalf("save index: %s", err)
+	}
+	s.Lock()
+	if s.changed {
+		t.Fatalf("index should be saved")
+	}
+	s.Unlock()
+
+	s2 := newCacheStore(dir, 1<<30, 0, 0, 1<<10, 1, &conf)
+	waitScanned(t, s2)
+	s2.Lock()
+	if len(s2.keys) != 9 || s2.used != 9*(1024+4096) || s2.keys["chunks/0/0/1_0_1024"].size != 1024 {
+		t.Fatalf("loaded index: %d blocks (%d bytes)", len(s2.keys), s2.used)
+	}
+	if _, ok := s2.keys["chunks/0/0/0_0_1024"]; ok {
+		t.Fatalf("removed block should not be loaded")
+	}
+	s2.Unlock()
+
+	_ = ioutil.WriteFile(s.indexPath(), []byte(indexHeader+"\nchunks/0/0/1_0_1024 1024\n"), 0600)
+	if s.loadIndex() {
+		t.Fatalf("broken index should not be loaded")
+	}
+	_ = ioutil.WriteFile(s.indexPath(), []byte("chunks/0/0/1_0_1024 1024 1\n"), 0600)
+	if s.loadIndex() {
+		t.Fatalf("index without header should not be loaded")
+	}
+}
@@ -16,7 +16,6 @@
 package chunk
 
 import (
-	"bytes"
 	"context"
 	"errors"
 	"fmt"
@@ -26,10 +25,13 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/juicedata/juicefs/pkg/compress"
 	"github.com/juicedata/juicefs/pkg/object"
+	"github.com/juicedata/juicefs/pkg/qos"
+	"github.com/juicedata/juicefs/pkg/trace"
 	"github.com/juicedata/juicefs/pkg/utils"
 	"github.com/prometheus/client_golang/prometheus"
 )
@@ -38,6 +40,15 @@ const chunkSize = 1 << 26 // 64M
 const pageSize = 1 << 16  // 64K
 const SlowRequest = time.Second * time.Duration(10)
 
+// ErrUnreachable is returned for the blocks not in cache when the object storage
+// is unreachable in degraded read mode.
+var ErrUnreachable = errors.New("object storage is unreachable")
+
+const (
+	unreachableAfter = 3                // consecutive failed requests to consider the object storage unreachable
+	probeInterval    = time.Second * 10 // interval to try the object storage when it's unreachable
+)
+
 var (
 	logger = utils.GetLogger("juicefs")
 
@@ -57,6 +68,10 @@ var (
 		Name: "blockcache_miss_bytes",
 		Help: "missed bytes from cached block",
 	})
+	degradedMiss = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "blockcache_degraded_miss",
+		Help: "missed read failed because the object storage is unreachable",
+	})
 )
 
 // chunk for read only
@@ -85,6 +100,41 @@ func (c *rChunk) key(indx int) string {
 	return fmt.Sprintf("chunks/%v/%v/%v_%v_%v", c.id/1000/1000, c.id/1000, c.id, indx, c.blockSize(indx))
 }
 
+// ObjectKeys returns the keys of objects which hold the data of a chunk, the packed blocks and
+// the deduplicated ones are resolved by PackIndex and DedupIndex in conf.
+func ObjectKeys(conf *Config, chunkid uint64, length int) ([]string, error) {
+	if length == 0 {
+		return nil, nil
+	}
+	if chunkid&ExternalChunk != 0 {
+		return nil, fmt.Errorf("chunk %d is imported from external object", chunkid)
+	}
+	c := &rChunk{id: chunkid, length: length, store: &cachedStore{conf: *conf}}
+	if conf.PackIndex != nil && conf.PackSize > 0 && length <= conf.PackSize {
+		pack, _, _, err := conf.PackIndex.LookupPack(chunkid)
+		if err != nil {
+			return nil, err
+		}
+		if pack > 0 {
+			return []string{packKey(pack)}, nil
+		}
+	}
+	keys := make([]string, (length-1)/conf.BlockSize+1)
+	for i := range keys {
+		keys[i] = c.key(i)
+		if conf.Dedup && conf.DedupIndex != nil {
+			owner, err := conf.DedupIndex.LookupDedup(chunkid, i)
+			if err != nil {
+				return nil, err
+			}
+			if owner != "" {
+				keys[i] = owner
+			}
+		}
+	}
+	return keys, nil
+}
+
 func (c *rChunk) index(off int) int {
 	return off / c.store.conf.BlockSize
 }
@@ -133,6 +183,7 @@ func (c *rChunk) ReadAt(ctx context.Context, page *Page, off int) (n int, err er
 				cacheHitBytes.Add(float64(n))
 				return n, nil
 			}
+			c.store.bcache.ioFailed(key, err)
 			if f, ok := r.(*os.File); ok {
 				logger.Warnf("remove partial cached block %s: %d %s", f.Name(), n, err)
 				os.Remove(f.Name())
@@ -143,20 +194,38 @@ func (c *rChunk) ReadAt(ctx context.Context, page *Page, off int) (n int, err er
 	cacheMiss.Add(1)
 	cacheMissBytes.Add(float64(len(p)))
 
-	if c.store.seekable && boff > 0 && len(p) <= blockSize/4 {
+	if !c.store.available() {
+		degradedMiss.Add(1)
+		return 0, ErrUnreachable
+	}
+
+	class := qos.ClassOf(ctx)
+	id := trace.IDOf(ctx)
+	defer trace.Bind(key, id)()
+	if (c.store.seekable(c.id) || c.id&ExternalChunk != 0) && boff > 0 && len(p) <= blockSize/4 {
 		// partial read
+		done := qos.Start(class)
 		st := time.Now()
-		in, err := c.store.storage.Get(key, int64(boff), int64(len(p)))
+		var in io.ReadCloser
+		loc, err := c.store.locate(key)
+		if err == nil {
+			in, err = loc.get(int64(boff), int64(len(p)))
+		}
 		used := time.Since(st)
 		logger.Debugf("GET %s RANGE(%d,%d) (%s, %.3fs)", key, boff, len(p), err, used.Seconds())
 		if used > SlowRequest {
-			logger.Infof("slow request: GET %s (%s, %.3fs)", key, err, used.Seconds())
+			logger.Infof("slow request: GET %s (%s, %.3fs, trace %s)", key, err, used.Seconds(), id)
 		}
 		c.store.fetcher.fetch(key)
+		c.store.report(err)
 		if err == nil {
 			defer in.Close()
-			return io.ReadFull(in, p)
+			n, err = io.ReadFull(in, p)
+			qos.Wait(class, n)
+			done()
+			return n, err
 		}
+		done()
 	}
 
 	block, err := c.store.group.Execute(key, func() (*Page, error) {
@@ -169,7 +238,7 @@ func (c *rChunk) ReadAt(ctx context.Context, page *Page, off int) (n int, err er
 		tmp.Acquire()
 		err := withTimeout(func() error {
 			defer tmp.Release()
-			return c.store.load(key, tmp, c.store.shouldCache(blockSize))
+			return c.store.load(key, tmp, c.store.shouldCache(blockSize), class)
 		}, c.store.conf.GetTimeout)
 		return tmp, err
 	})
@@ -183,6 +252,26 @@ func (c *rChunk) ReadAt(ctx context.Context, page *Page, off int) (n int, err er
 	return len(p), nil
 }
 
+// CachedFile returns the file descriptor of cached block and the offset of
+// requested range in it, the range should be inside a single block.
+func (c *rChunk) CachedFile(off, size int) (uintptr, int64, error) {
+	if c.store.conf.CacheSize == 0 || size <= 0 || off+size > c.length {
+		return 0, 0, errNotCached
+	}
+	indx := c.index(off)
+	boff := off % c.store.conf.BlockSize
+	if boff+size > c.blockSize(indx) {
+		return 0, 0, errNotCached
+	}
+	f, err := c.store.files.get(c.key(indx), int64(boff+size))
+	if err != nil {
+		return 0, 0, err
+	}
+	cacheHits.Add(1)
+	cacheHitBytes.Add(float64(size))
+	return f.Fd(), int64(boff), nil
+}
+
 func (c *rChunk) delete(indx int) error {
 	key := c.key(indx)
 	st := time.Now()
@@ -201,6 +290,30 @@ func (c *rChunk) Remove() error {
 		return nil
 	}
 
+	if c.id&ExternalChunk != 0 && c.store.conf.ExternalIndex != nil {
+		// the imported object is owned by others
+		for i := 0; i <= (c.length-1)/c.store.conf.BlockSize; i++ {
+			c.store.bcache.remove(c.key(i))
+		}
+		return c.store.conf.ExternalIndex.RemoveExternal(c.id)
+	}
+
+	if c.store.packer != nil && c.length <= c.store.conf.PackSize {
+		pack, left, err := c.store.packer.index.RemovePack(c.id)
+		if err != nil {
+			return err
+		}
+		if pack > 0 {
+			c.store.bcache.remove(c.key(0))
+			if left <= 0 {
+				key := packKey(pack)
+				err = c.store.storage.Delete(key)
+				logger.Debugf("DELETE %v (%v)", key, err)
+			}
+			return nil
+		}
+	}
+
 	lastIndx := (c.length - 1) / c.store.conf.BlockSize
 	deleted := false
 	for i := 0; i <= lastIndx; i++ {
@@ -211,6 +324,15 @@ func (c *rChunk) Remove() error {
 		delete(c.store.pendingKeys, key)
 		c.store.pendingMutex.Unlock()
 		c.store.bcache.remove(key)
+		if c.store.conf.DedupIndex != nil {
+			// the blocks without records are deleted by gc, they could be used by others
+			ok, err := c.removeDedup(i)
+			if err != nil {
+				return err
+			}
+			deleted = deleted || ok
+			continue
+		}
 		if c.delete(i) == nil {
 			deleted = true
 		}
@@ -251,6 +373,8 @@ func freePage(p *Page) {
 // chunk for write only
 type wChunk struct {
 	rChunk
+	class       qos.Class
+	trace       string
 	pages       [][]*Page
 	uploaded    int
 	errors      chan error
@@ -261,6 +385,7 @@ type wChunk struct {
 func chunkForWrite(id uint64, store *cachedStore) *wChunk {
 	return &wChunk{
 		rChunk: rChunk{id, 0, store},
+		class:  qos.Write,
 		pages:  make([][]*Page, chunkSize/store.conf.BlockSize),
 		errors: make(chan error, chunkSize/store.conf.BlockSize),
 	}
@@ -270,6 +395,14 @@ func (c *wChunk) SetID(id uint64) {
 	c.id = id
 }
 
+func (c *wChunk) SetClass(class qos.Class) {
+	c.class = class
+}
+
+func (c *wChunk) SetTrace(id string) {
+	c.trace = id
+}
+
 func (c *wChunk) WriteAt(p []byte, off int64) (n int, err error) {
 	if int(off)+len(p) > chunkSize {
 		return 0, fmt.Errorf("write out of chunk boudary: %d > %d", int(off)+len(p), chunkSize)
@@ -336,12 +469,17 @@ func (c *wChunk) put(key string, p *Page) error {
 	p.Acquire()
 	return withTimeout(func() error {
 		defer p.Release()
+		done := qos.Start(c.class)
+		defer done()
+		qos.Wait(c.class, len(p.Data))
+		defer trace.Bind(key, c.trace)()
 		st := time.Now()
-		err := c.store.storage.Put(key, bytes.NewReader(p.Data))
+		err := object.PutMultipart(c.store.storage, key, p.Data, c.store.conf.Multipart)
 		used := time.Since(st)
+		c.store.uploads.observe(used, err)
 		logger.Debugf("PUT %s (%s, %.3fs)", key, err, used.Seconds())
 		if used > SlowRequest {
-			logger.Infof("slow request: PUT %v (%s, %.3fs)", key, err, used.Seconds())
+			logger.Infof("slow request: PUT %v (%s, %.3fs, trace %s)", key, err, used.Seconds(), c.trace)
 		}
 		return err
 	}, c.store.conf.PutTimeout)
@@ -349,7 +487,9 @@ func (c *wChunk) put(key string, p *Page) error {
 
 func (c *wChunk) syncUpload(key string, block *Page) {
 	blen := len(block.Data)
-	bufSize := c.store.compressor.CompressBound(blen)
+	hash := c.store.blockHash(c.id, block.Data)
+	compressor := c.store.compressorOf(c.id)
+	bufSize := compressor.CompressBound(blen)
 	var buf *Page
 	if bufSize > blen {
 		buf = NewOffPage(bufSize)
@@ -357,7 +497,7 @@ func (c *wChunk) syncUpload(key string, block *Page) {
 		buf = block
 		buf.Acquire()
 	}
-	n, err := c.store.compressor.Compress(buf.Data, block.Data)
+	n, err := compressor.Compress(buf.Data, block.Data)
 	if err != nil {
 		logger.Fatalf("compress chunk %v: %s", c.id, err)
 		return
@@ -369,15 +509,15 @@ func (c *wChunk) syncUpload(key string, block *Page) {
 	}
 	block.Release()
 
-	c.store.currentUpload <- true
+	c.store.uploads.acquire()
 	defer func() {
 		buf.Release()
-		<-c.store.currentUpload
+		c.store.uploads.release()
 	}()
 
 	try := 0
 	for try <= 10 && c.uploadError == nil {
-		err = c.put(key, buf)
+		err = c.store.putDedup(key, hash, func() error { return c.put(key, buf) })
 		if err == nil {
 			c.errors <- nil
 			return
@@ -389,15 +529,24 @@ func (c *wChunk) syncUpload(key string, block *Page) {
 	c.errors <- fmt.Errorf("upload block %s: %s (after %d tries)", key, err, try)
 }
 
+func (c *wChunk) packUpload(key string, block *Page) {
+	compressor := c.store.compressorOf(c.id)
+	buf := make([]byte, compressor.CompressBound(len(block.Data)))
+	n, err := compressor.Compress(buf, block.Data)
+	if err != nil {
+		logger.Fatalf("compress chunk %v: %s", c.id, err)
+		return
+	}
+	c.store.bcache.cache(key, block)
+	block.Release()
+	c.errors <- c.store.packer.add(c.id, buf[:n])
+}
+
 func (c *wChunk) asyncUpload(key string, block *Page, stagingPath string) {
 	blockSize := len(block.Data)
 	defer c.store.bcache.uploaded(key, blockSize)
-	defer func() {
-		<-c.store.currentUpload
-	}()
-	select {
-	case c.store.currentUpload <- true:
-	default:
+	defer c.store.uploads.release()
+	if !c.store.uploads.tryAcquire() {
 		// release the memory and wait
 		block.Release()
 		c.store.pendingMutex.Lock()
@@ -410,32 +559,25 @@ func (c *wChunk) asyncUpload(key string, block *Page, stagingPath string) {
 		}()
 
 		logger.Debugf("wait to upload %s", key)
-		c.store.currentUpload <- true
+		c.store.uploads.acquire()
 
 		// load from disk
-		f, err := os.Open(stagingPath)
-		if err != nil {
+		block = NewOffPage(blockSize)
+		if err := c.store.bcache.readStaging(stagingPath, block.Data); err != nil {
+			block.Release()
 			c.store.pendingMutex.Lock()
 			ok := c.store.pendingKeys[key]
 			c.store.pendingMutex.Unlock()
-			if ok {
+			if ok || !os.IsNotExist(err) {
 				logger.Errorf("read stagging file %s: %s", stagingPath, err)
 			} else {
 				logger.Debugf("%s is not needed, drop it", key)
 			}
 			return
 		}
-
-		block = NewOffPage(blockSize)
-		_, err = io.ReadFull(f, block.Data)
-		f.Close()
-		if err != nil {
-			logger.Errorf("read stagging file %s: %s", stagingPath, err)
-			block.Release()
-			return
-		}
 	}
-	bufSize := c.store.compressor.CompressBound(blockSize)
+	compressor := c.store.compressorOf(c.id)
+	bufSize := compressor.CompressBound(blockSize)
 	var buf *Page
 	if bufSize > blockSize {
 		buf = NewOffPage(bufSize)
@@ -443,17 +585,18 @@ func (c *wChunk) asyncUpload(key string, block *Page, stagingPath string) {
 		buf = block
 		buf.Acquire()
 	}
-	n, err := c.store.compressor.Compress(buf.Data, block.Data)
+	n, err := compressor.Compress(buf.Data, block.Data)
 	if err != nil {
 		logger.Fatalf("compress chunk %v: %s", c.id, err)
 		return
 	}
 	buf.Data = buf.Data[:n]
+	hash := c.store.blockHash(c.id, block.Data)
 	block.Release()
 
 	try := 0
 	for c.uploadError == nil {
-		err = c.put(key, buf)
+		err = c.store.putDedup(key, hash, func() error { return c.put(key, buf) })
 		if err == nil {
 			break
 		}
@@ -487,7 +630,9 @@ func (c *wChunk) upload(indx int) {
 				logger.Fatalf("block length does not match: %v != %v", off, blen)
 			}
 		}
-		if c.store.conf.Writeback {
+		if c.store.packer != nil && indx == 0 && blen <= c.store.conf.PackSize {
+			c.packUpload(key, block)
+		} else if c.store.conf.Writeback {
 			stagingPath, err := c.store.bcache.stage(key, block.Data, c.store.shouldCache(blen))
 			if err != nil {
 				logger.Warnf("write %s to disk: %s, upload it directly", stagingPath, err)
@@ -560,55 +705,112 @@ func (c *wChunk) Abort() {
 
 // Config contains options for cachedStore
 type Config struct {
-	CacheDir       string
-	CacheMode      os.FileMode
-	CacheSize      int64
-	FreeSpace      float32
-	AutoCreate     bool
-	Compress       string
-	MaxUpload      int
-	Writeback      bool
-	Partitions     int
-	BlockSize      int
-	UploadLimit    int
-	GetTimeout     time.Duration
-	PutTimeout     time.Duration
-	CacheFullBlock bool
-	BufferSize     int
-	Readahead      int
-	Prefetch       int
+	CacheDir        string
+	CacheMode       os.FileMode
+	CacheSize       int64
+	SharedCacheSize int64  // MiB shared by the mounts using the same cache directories, 0 means not shared
+	PinSize         int64  // MiB of the pinned blocks in cache, 0 means pinning is disabled
+	CacheEviction   string // policy to evict the cached blocks, see EvictRandom
+	CacheIO         string // engine to read and write the cache files, see CacheIOPsync
+	CacheDirect     bool   // open the cache files with O_DIRECT to bypass the page cache
+	FreeSpace       float32
+	AutoCreate      bool
+	Compress        string
+	MaxUpload       int
+	Writeback       bool
+	Partitions      int
+	BlockSize       int
+	UploadLimit     int
+	Multipart       object.MultipartConfig // upload the large blocks part by part
+	GetTimeout      time.Duration
+	PutTimeout      time.Duration
+	CacheFullBlock  bool
+	DegradedRead    bool // serve reads only from cache when the object storage is unreachable
+	BufferSize      int
+	Readahead       int
+	Prefetch        int
+	PackSize        int
+	PackIndex       PackIndex
+	Dedup           bool // store the blocks with the same content once, recorded in DedupIndex
+	DedupIndex      DedupIndex
+
+	ExternalIndex   ExternalIndex
+	ExternalStorage object.ObjectStorage
 }
 
 type cachedStore struct {
-	storage       object.ObjectStorage
-	bcache        CacheManager
-	fetcher       *prefetcher
-	conf          Config
-	group         *Controller
-	currentUpload chan bool
-	pendingKeys   map[string]bool
-	pendingMutex  sync.Mutex
-	compressor    compress.Compressor
-	seekable      bool
-}
-
-func (store *cachedStore) load(key string, page *Page, cache bool) (err error) {
+	storage      object.ObjectStorage
+	bcache       CacheManager
+	packer       *packer
+	files        *fileCache
+	fetcher      *prefetcher
+	conf         Config
+	group        *Controller
+	uploads      *uploadLimiter
+	pendingKeys  map[string]bool
+	pendingMutex sync.Mutex
+	compressor   compress.Compressor // of the volume, see compressorOf
+	dedups       *dedupOwners
+
+	failures    int64 // consecutive failed requests
+	unreachable int64 // unix nano since the object storage is unreachable, zero if it's reachable
+	lastProbe   int64 // unix nano of the last request when it's unreachable
+}
+
+// available returns false if the object storage is unreachable in degraded read
+// mode, then only one request is allowed in every probeInterval to check it.
+func (store *cachedStore) available() bool {
+	if !store.conf.DegradedRead || atomic.LoadInt64(&store.unreachable) == 0 {
+		return true
+	}
+	now := time.Now().UnixNano()
+	last := atomic.LoadInt64(&store.lastProbe)
+	return now-last >= int64(probeInterval) && atomic.CompareAndSwapInt64(&store.lastProbe, last, now)
+}
+
+// report records the result of a request to the object storage.
+func (store *cachedStore) report(err error) {
+	if !store.conf.DegradedRead {
+		return
+	}
+	if err == nil {
+		atomic.StoreInt64(&store.failures, 0)
+		if since := atomic.SwapInt64(&store.unreachable, 0); since > 0 {
+			logger.Infof("object storage is reachable again after %s", time.Since(time.Unix(0, since)))
+		}
+		return
+	}
+	if atomic.AddInt64(&store.failures, 1) >= unreachableAfter {
+		now := time.Now().UnixNano()
+		if atomic.CompareAndSwapInt64(&store.unreachable, 0, now) {
+			atomic.StoreInt64(&store.lastProbe, now)
+			logger.Warnf("object storage is unreachable, only cached blocks can be read: %s", err)
+		}
+	}
+}
+
+func (store *cachedStore) load(key string, page *Page, cache bool, class qos.Class) (err error) {
 	defer func() {
 		e := recover()
 		if e != nil {
 			err = fmt.Errorf("recovered from %s", e)
 		}
 	}()
+	done := qos.Start(class)
+	defer done()
 
 	err = errors.New("Not downloaded")
 	var in io.ReadCloser
+	var loc *location
 	tried := 0
 	start := time.Now()
 	// it will be retried outside
 	for err != nil && tried < 2 {
 		time.Sleep(time.Second * time.Duration(tried*tried))
 		st := time.Now()
-		in, err = store.storage.Get(key, 0, -1)
+		if loc, err = store.locate(key); err == nil {
+			in, err = loc.get(0, -1)
+		}
 		used := time.Since(st)
 		logger.Debugf("GET %s (%s, %.3fs)", key, err, used.Seconds())
 		if used > SlowRequest {
@@ -616,23 +818,27 @@ func (store *cachedStore) load(key string, page *Page, cache bool) (err error) {
 		}
 		tried++
 	}
+	store.report(err)
 	if err != nil {
 		return fmt.Errorf("get %s: %s", key, err)
 	}
-	needed := store.compressor.CompressBound(len(page.Data))
+	compressor := store.keyCompressor(key)
+	needed := compressor.CompressBound(len(page.Data))
 	var n int
-	if needed > len(page.Data) {
+	if needed > len(page.Data) && !loc.raw {
 		c := NewOffPage(needed)
 		defer c.Release()
 		var cn int
 		cn, err = io.ReadFull(in, c.Data)
 		in.Close()
+		qos.Wait(class, cn)
 		if err != nil && (cn == 0 || err != io.ErrUnexpectedEOF) {
 			return err
 		}
-		n, err = store.compressor.Decompress(page.Data, c.Data[:cn])
+		n, err = compressor.Decompress(page.Data, c.Data[:cn])
 	} else {
 		n, err = io.ReadFull(in, page.Data)
+		qos.Wait(class, n)
 	}
 	if err != nil || n < len(page.Data) {
 		return fmt.Errorf("read %s fully: %s (%d < %d) after %s (tried %d)", key, err, n, len(page.Data),
@@ -656,32 +862,59 @@ func NewCachedStore(storage object.ObjectStorage, config Config) ChunkStore {
 	if config.PutTimeout == 0 {
 		config.PutTimeout = time.Second * 60
 	}
+	if !config.Dedup {
+		config.DedupIndex = nil
+	}
 	store := &cachedStore{
-		storage:       storage,
-		conf:          config,
-		currentUpload: make(chan bool, config.MaxUpload),
-		compressor:    compressor,
-		seekable:      compressor.CompressBound(0) == 0,
-		bcache:        newCacheManager(&config),
-		pendingKeys:   make(map[string]bool),
-		group:         &Controller{},
+		storage:     storage,
+		conf:        config,
+		uploads:     newUploadLimiter(config.MaxUpload),
+		compressor:  compressor,
+		bcache:      newCacheManager(&config),
+		pendingKeys: make(map[string]bool),
+		group:       &Controller{},
+		dedups:      newDedupOwners(),
+	}
+	store.files = newFileCache(store.bcache.load, store.bcache.usable)
+	if config.PackSize > 0 && config.PackSize < config.BlockSize && config.PackIndex != nil {
+		store.packer = newPacker(store, config.PackIndex)
 	}
 	if config.CacheSize == 0 {
 		config.Prefetch = 0 // disable prefetch if cache is disabled
 	}
 	store.fetcher = newPrefetcher(config.Prefetch, func(key string) {
 		size := parseObjOrigSize(key)
-		if size == 0 || size > store.conf.BlockSize {
+		if size == 0 || size > store.conf.BlockSize || !store.available() {
 			return
 		}
 		p := NewOffPage(size)
 		defer p.Release()
-		_ = store.load(key, p, true)
+		_ = store.load(key, p, true, qos.Prefetch)
 	})
 	_ = prometheus.Register(cacheHits)
 	_ = prometheus.Register(cacheHitBytes)
 	_ = prometheus.Register(cacheMiss)
 	_ = prometheus.Register(cacheMissBytes)
+	_ = prometheus.Register(degradedMiss)
+	_ = prometheus.Register(prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "object_unreachable",
+			Help: "whether the object storage is unreachable in degraded read mode",
+		},
+		func() float64 {
+			if atomic.LoadInt64(&store.unreachable) > 0 {
+				return 1
+			}
+			return 0
+		}))
+	_ = prometheus.Register(prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "object_upload_concurrency",
+			Help: "max number of concurrent uploads, tuned by the latency if it's not fixed",
+		},
+		func() float64 {
+			return float64(store.uploads.current())
+		}))
 	_ = prometheus.Register(prometheus.NewGaugeFunc(
 		prometheus.GaugeOpts{
 			Name: "blockcache_blocks",
@@ -717,18 +950,17 @@ func parseObjOrigSize(key string) int {
 func (store *cachedStore) uploadStaging() {
 	staging := store.bcache.scanStaging()
 	for key, path := range staging {
-		store.currentUpload <- true
+		store.uploads.acquire()
 		go func(key, stagingPath string) {
-			defer func() {
-				<-store.currentUpload
-			}()
+			defer store.uploads.release()
 			block, err := ioutil.ReadFile(stagingPath)
 			if err != nil {
 				logger.Errorf("open %s: %s", stagingPath, err)
 				return
 			}
-			buf := make([]byte, store.compressor.CompressBound(len(block)))
-			n, err := store.compressor.Compress(buf, block)
+			compressor := store.keyCompressor(key)
+			buf := make([]byte, compressor.CompressBound(len(block)))
+			n, err := compressor.Compress(buf, block)
 			if err != nil {
 				logger.Errorf("compress chunk %s: %s", stagingPath, err)
 				return
@@ -739,9 +971,15 @@ func (store *cachedStore) uploadStaging() {
 				// add size at the end
 				key = fmt.Sprintf("%s_%d", key, len(block))
 			}
+			id, _ := parseBlockKey(key)
+			hash := store.blockHash(id, block)
 			try := 0
 			for {
-				err := store.storage.Put(key, bytes.NewReader(compressed))
+				st := time.Now()
+				err := store.putDedup(key, hash, func() error {
+					return object.PutMultipart(store.storage, key, compressed, store.conf.Multipart)
+				})
+				store.uploads.observe(time.Since(st), err)
 				if err == nil {
 					break
 				}
@@ -16,7 +16,12 @@
 package chunk
 
 import (
+	"bytes"
 	"context"
+	"errors"
+	"io"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 
@@ -68,3 +73,115 @@ func BenchmarkUncachedRead(b *testing.B) {
 		}
 	}
 }
+
+func TestCachedFile(t *testing.T) {
+	blob, _ := object.CreateStorage("mem", "", "", "")
+	config := defaultConf
+	config.AutoCreate = true
+	config.CacheMode = 0600
+	config.BufferSize = 10 << 20
+	store := NewCachedStore(blob, config)
+	data := make([]byte, 1000)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	w := store.NewWriter(3)
+	if _, err := w.WriteAt(data, 0); err != nil {
+		t.Fatalf("write fail: %s", err)
+	}
+	if err := w.Finish(len(data)); err != nil {
+		t.Fatalf("write fail: %s", err)
+	}
+	// nolint:errcheck
+	defer store.Remove(3, len(data))
+
+	r := store.NewReader(3, len(data)).(SpliceReader)
+	if _, _, err := r.CachedFile(900, 200); err == nil {
+		t.Fatalf("read beyond the end should fail")
+	}
+	var fd uintptr
+	var off int64
+	var err error
+	for i := 0; i < 100; i++ {
+		if fd, off, err = r.CachedFile(100, 200); err == nil {
+			break
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	if err != nil {
+		t.Fatalf("cached file: %s", err)
+	}
+	buf := make([]byte, 200)
+	if n, err := syscall.Pread(int(fd), buf, off); err != nil || n != 200 {
+		t.Fatalf("pread: %d %s", n, err)
+	}
+	if !bytes.Equal(buf, data[100:300]) {
+		t.Fatalf("unexpected data")
+	}
+}
+
+// brokenStorage fails all the requests to read objects if it's broken.
+type brokenStorage struct {
+	object.ObjectStorage
+	broken bool
+}
+
+func (s *brokenStorage) Get(key string, off, limit int64) (io.ReadCloser, error) {
+	if s.broken {
+		return nil, errors.New("connection refused")
+	}
+	return s.ObjectStorage.Get(key, off, limit)
+}
+
+func TestDegradedRead(t *testing.T) {
+	mem, _ := object.CreateStorage("mem", "", "", "")
+	config := defaultConf
+	config.CacheSize = 0
+	store := NewCachedStore(mem, config)
+	for id := uint64(11); id <= 12; id++ {
+		w := store.NewWriter(id)
+		if _, err := w.WriteAt(make([]byte, 1000), 0); err != nil {
+			t.Fatalf("write fail: %s", err)
+		}
+		if err := w.Finish(1000); err != nil {
+			t.Fatalf("write fail: %s", err)
+		}
+	}
+
+	blob := &brokenStorage{ObjectStorage: mem}
+	config = defaultConf
+	config.CacheDir = "/tmp/diskCacheDegraded"
+	config.AutoCreate = true
+	config.CacheMode = 0600
+	config.DegradedRead = true
+	config.BufferSize = 10 << 20 // room for the pending blocks to be cached
+	store = NewCachedStore(blob, config)
+	cs := store.(*cachedStore)
+	p := NewPage(make([]byte, 1000))
+	if n, err := store.NewReader(11, 1000).ReadAt(context.Background(), p, 0); err != nil || n != 1000 {
+		t.Fatalf("read chunk 11: %d %s", n, err)
+	}
+	time.Sleep(time.Millisecond * 100) // wait for the block to be cached
+
+	blob.broken = true
+	for i := 0; i < unreachableAfter; i++ {
+		if _, err := store.NewReader(12, 1000).ReadAt(context.Background(), p, 0); err == nil || err == ErrUnreachable {
+			t.Fatalf("read chunk 12 should fail with the error from object storage: %v", err)
+		}
+	}
+	if _, err := store.NewReader(12, 1000).ReadAt(context.Background(), p, 0); err != ErrUnreachable {
+		t.Fatalf("read uncached chunk when unreachable: %v", err)
+	}
+	if n, err := store.NewReader(11, 1000).ReadAt(context.Background(), p, 0); err != nil || n != 1000 {
+		t.Fatalf("read cached chunk when unreachable: %d %s", n, err)
+	}
+
+	blob.broken = false
+	atomic.StoreInt64(&cs.lastProbe, 0) // probe now
+	if n, err := store.NewReader(12, 1000).ReadAt(context.Background(), p, 0); err != nil || n != 1000 {
+		t.Fatalf("read chunk 12 after recovered: %d %s", n, err)
+	}
+	if atomic.LoadInt64(&cs.unreachable) != 0 {
+		t.Fatalf("object storage should be reachable")
+	}
+}
@@ -18,12 +18,51 @@ package chunk
 import (
 	"context"
 	"io"
+
+	"github.com/juicedata/juicefs/pkg/qos"
 )
 
 type Reader interface {
 	ReadAt(ctx context.Context, p *Page, off int) (int, error)
 }
 
+// SpliceReader is implemented by readers which can expose cached data as a
+// region of local file, so it can be sent to kernel without copying.
+type SpliceReader interface {
+	CachedFile(off, size int) (fd uintptr, foff int64, err error)
+}
+
+// BlockChecker is implemented by stores which can verify the blocks in object storage.
+type BlockChecker interface {
+	// CheckBlock downloads a block bypassing the cache and verifies it, a *BlockError is
+	// returned if the block is missing or corrupted. The content is verified by decompressing
+	// it, so only the size is checked for the blocks not compressed, then verified is false.
+	CheckBlock(chunkid uint64, length int, indx int) (verified bool, err error)
+	// QuarantineBlock moves a corrupted block aside, so it can be inspected later.
+	QuarantineBlock(chunkid uint64, length int, indx int) error
+}
+
+// Pinner is implemented by stores which can keep the blocks in local cache.
+type Pinner interface {
+	// Pin keeps the blocks of a slice which cover [off, off+size) in cache, they're
+	// not evicted until unpinned.
+	Pin(chunkid uint64, length int, off, size int) (int, error)
+	// Unpin makes the blocks of a slice which cover [off, off+size) evictable again.
+	Unpin(chunkid uint64, length int, off, size int) int
+	PinStats() PinStats
+}
+
+// ClassWriter is implemented by writers which can tag their uploads with an I/O class.
+type ClassWriter interface {
+	SetClass(c qos.Class)
+}
+
+// TracedWriter is implemented by writers which can tag their uploads with the trace id
+// of the operation which wrote the data.
+type TracedWriter interface {
+	SetTrace(id string)
+}
+
 type Writer interface {
 	io.WriterAt
 	ID() uint64
@@ -0,0 +1,90 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package chunk
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/juicedata/juicefs/pkg/compress"
+)
+
+// A chunk can be compressed differently from the volume, the algorithm and level are
+// set in the bits under ExternalChunk of its id (meta.ChunkHints), so the blocks can
+// be decompressed with only the keys of them.
+const (
+	CompressHints  = uint64(0x7f) << levelShift // zero means the compression of the volume
+	levelShift     = 55                         // 5 bits of level
+	algorithmShift = 60                         // 2 bits of algorithm
+)
+
+var algorithms = []string{"", "none", "lz4", "zstd"}
+
+// ParseCompressHint parses a hint of compression in the format of ALGORITHM[:LEVEL],
+// the algorithm is one of none, lz4 and zstd, the level is used only by zstd (1-19).
+func ParseCompressHint(s string) (uint64, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	var level int
+	if p := strings.IndexByte(s, ':'); p > 0 {
+		var err error
+		if level, err = strconv.Atoi(s[p+1:]); err != nil || level < 1 || level > 19 {
+			return 0, fmt.Errorf("invalid level of compression: %q", s[p+1:])
+		}
+		s = s[:p]
+		if s != "zstd" {
+			return 0, fmt.Errorf("level is not supported by %s", s)
+		}
+	}
+	for i, a := range algorithms {
+		if i > 0 && s == a {
+			return uint64(i)<<algorithmShift | uint64(level)<<levelShift, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid algorithm of compression: %q", s)
+}
+
+// FormatCompressHint returns the hint in the id of a chunk, empty if it's not set.
+func FormatCompressHint(id uint64) string {
+	a := algorithms[id>>algorithmShift&3]
+	if level := id >> levelShift & 0x1f; level > 0 {
+		return fmt.Sprintf("%s:%d", a, level)
+	}
+	return a
+}
+
+// compressorOf returns the compressor of the chunk.
+func (store *cachedStore) compressorOf(id uint64) compress.Compressor {
+	if id&ExternalChunk != 0 || id&CompressHints == 0 {
+		return store.compressor
+	}
+	return compress.NewCompressorLevel(algorithms[id>>algorithmShift&3], int(id>>levelShift&0x1f))
+}
+
+// keyCompressor returns the compressor of the block, the key could be without the size.
+func (store *cachedStore) keyCompressor(key string) compress.Compressor {
+	name := key[strings.LastIndexByte(key, '/')+1:]
+	if p := strings.IndexByte(name, '_'); p > 0 {
+		name = name[:p]
+	}
+	id, _ := strconv.ParseUint(name, 10, 64)
+	return store.compressorOf(id)
+}
+
+// seekable returns true if a range of the blocks of the chunk can be read directly.
+func (store *cachedStore) seekable(id uint64) bool {
+	return store.compressorOf(id).CompressBound(0) == 0
+}
@@ -0,0 +1,73 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package chunk
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/juicedata/juicefs/pkg/object"
+)
+
+func TestParseCompressHint(t *testing.T) {
+	for _, s := range []string{"none", "lz4", "zstd", "zstd:19"} {
+		hint, err := ParseCompressHint(s)
+		if err != nil || hint == 0 || hint&^CompressHints != 0 {
+			t.Fatalf("parse %s: %x %s", s, hint, err)
+		}
+		if r := FormatCompressHint(hint | 123); r != s {
+			t.Fatalf("format %s: %s", s, r)
+		}
+	}
+	for _, s := range []string{"", "gzip", "zstd:0", "zstd:20", "lz4:3", "zstd:x"} {
+		if _, err := ParseCompressHint(s); err == nil {
+			t.Fatalf("parse %q should fail", s)
+		}
+	}
+}
+
+func TestCompressHint(t *testing.T) {
+	mem, _ := object.CreateStorage("mem", "", "", "")
+	conf := defaultConf
+	conf.Compress = "lz4"
+	conf.CacheSize = 0
+	store := NewCachedStore(mem, conf)
+	data := bytes.Repeat([]byte("hello world "), 200)
+	for _, s := range []string{"none", "zstd:19"} {
+		hint, _ := ParseCompressHint(s)
+		id := 10 | hint
+		writer := store.NewWriter(id)
+		if _, err := writer.WriteAt(data, 0); err != nil {
+			t.Fatalf("write %s: %s", s, err)
+		}
+		if err := writer.Finish(len(data)); err != nil {
+			t.Fatalf("finish %s: %s", s, err)
+		}
+		key := chunkForRead(id, len(data), store.(*cachedStore)).key(0)
+		obj, err := mem.Head(key)
+		if err != nil {
+			t.Fatalf("head %s: %s", key, err)
+		}
+		if compressed := obj.Size() < int64(conf.BlockSize); compressed != (s != "none") {
+			t.Fatalf("size of %s with %s: %d", key, s, obj.Size())
+		}
+		p := NewPage(make([]byte, 100))
+		if n, err := store.NewReader(id, len(data)).ReadAt(context.Background(), p, 1100); err != nil || !bytes.Equal(p.Data[:n], data[1100:1200]) {
+			t.Fatalf("read %s: %d %s", s, n, err)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package chunk
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sync"
+)
+
+// DedupIndex keeps the blocks with the same content, which are stored in one object, the
+// first uploaded one. The object is deleted after all the blocks in it are removed.
+type DedupIndex interface {
+	AddDedup(hash string, chunkid uint64, indx int, key string) (string, error)
+	LookupDedup(chunkid uint64, indx int) (string, error)
+	DedupRefs(chunkid uint64, indx int) (key string, refs int64, err error)
+	RemoveDedup(chunkid uint64, indx int) (key string, left int64, err error)
+}
+
+// maxDedupOwners is the max number of blocks in dedupOwners.
+const maxDedupOwners = 100000
+
+type dedupBlock struct {
+	id   uint64
+	indx int
+}
+
+// dedupOwners caches the objects holding the deduplicated blocks to read them without
+// looking up meta, the object of a block never changes until the block is removed. The
+// blocks which are not deduplicated are not cached, they could be recorded later.
+type dedupOwners struct {
+	sync.Mutex
+	owners map[dedupBlock]string
+}
+
+func newDedupOwners() *dedupOwners {
+	return &dedupOwners{owners: make(map[dedupBlock]string)}
+}
+
+func (c *dedupOwners) get(id uint64, indx int) string {
+	c.Lock()
+	defer c.Unlock()
+	return c.owners[dedupBlock{id, indx}]
+}
+
+func (c *dedupOwners) add(id uint64, indx int, owner string) {
+	c.Lock()
+	defer c.Unlock()
+	if len(c.owners) >= maxDedupOwners {
+		for b := range c.owners {
+			delete(c.owners, b)
+			break
+		}
+	}
+	c.owners[dedupBlock{id, indx}] = owner
+}
+
+func (c *dedupOwners) remove(id uint64, indx int) {
+	c.Lock()
+	defer c.Unlock()
+	delete(c.owners, dedupBlock{id, indx})
+}
+
+// blockHash returns the fingerprint of a block, the compression algorithm is included
+// since the blocks are read from the shared object in the same way.
+func (store *cachedStore) blockHash(chunkid uint64, data []byte) string {
+	if store.conf.DedupIndex == nil {
+		return ""
+	}
+	h := sha256.New()
+	_, _ = h.Write([]byte(store.compressorOf(chunkid).Name()))
+	_, _ = h.Write(data)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// putDedup uploads a block by put, unless there is an object with the same content already.
+func (store *cachedStore) putDedup(key, hash string, put func() error) error {
+	if hash == "" {
+		return put()
+	}
+	id, indx := parseBlockKey(key)
+	owner, err := store.conf.DedupIndex.AddDedup(hash, id, indx, "")
+	if err != nil {
+		return fmt.Errorf("dedup %s: %s", key, err)
+	}
+	if owner != "" {
+		logger.Debugf("block %s is stored in %s", key, owner)
+		store.dedups.add(id, indx, owner)
+		return nil
+	}
+	if err = put(); err != nil {
+		return err
+	}
+	if owner, err = store.conf.DedupIndex.AddDedup(hash, id, indx, key); err != nil {
+		// the block could be recorded already, it will be deleted by gc if not
+		return fmt.Errorf("dedup %s: %s", key, err)
+	}
+	if owner != key {
+		// the same content is uploaded by others at the same time
+		logger.Debugf("block %s is stored in %s, delete it", key, owner)
+		_ = store.storage.Delete(key)
+	}
+	store.dedups.add(id, indx, owner)
+	return nil
+}
+
+// locateDedup returns the object holding the block, it's the block itself if it's not deduplicated.
+func (store *cachedStore) locateDedup(key string, id uint64, indx int) (string, error) {
+	if owner := store.dedups.get(id, indx); owner != "" {
+		return owner, nil
+	}
+	owner, err := store.conf.DedupIndex.LookupDedup(id, indx)
+	if err != nil || owner == "" {
+		return key, err
+	}
+	store.dedups.add(id, indx, owner)
+	return owner, nil
+}
+
+// removeDedup removes a block from the object holding it, and deletes the object if it's not
+// used by any blocks. It returns false if the block is not deduplicated.
+func (c *rChunk) removeDedup(indx int) (bool, error) {
+	c.store.dedups.remove(c.id, indx)
+	owner, left, err := c.store.conf.DedupIndex.RemoveDedup(c.id, indx)
+	if err != nil || owner == "" {
+		return false, err
+	}
+	if left <= 0 {
+		err = c.store.storage.Delete(owner)
+		logger.Debugf("DELETE %v (%v)", owner, err)
+	}
+	return true, nil
+}
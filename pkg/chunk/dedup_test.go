@@ -0,0 +1,160 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package chunk
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/juicedata/juicefs/pkg/object"
+)
+
+type memDedupIndex struct {
+	sync.Mutex
+	blocks map[string]string // block -> hash
+	keys   map[string]string // hash -> key
+	refs   map[string]int64  // hash -> refs
+
+	lookups int
+}
+
+func newMemDedupIndex() *memDedupIndex {
+	return &memDedupIndex{blocks: make(map[string]string), keys: make(map[string]string), refs: make(map[string]int64)}
+}
+
+func (m *memDedupIndex) AddDedup(hash string, chunkid uint64, indx int, key string) (string, error) {
+	m.Lock()
+	defer m.Unlock()
+	if m.keys[hash] == "" {
+		if key == "" {
+			return "", nil
+		}
+		m.keys[hash] = key
+	}
+	block := fmt.Sprintf("%d_%d", chunkid, indx)
+	if _, ok := m.blocks[block]; !ok {
+		m.blocks[block] = hash
+		m.refs[hash]++
+	}
+	return m.keys[hash], nil
+}
+
+func (m *memDedupIndex) LookupDedup(chunkid uint64, indx int) (string, error) {
+	m.Lock()
+	defer m.Unlock()
+	m.lookups++
+	return m.keys[m.blocks[fmt.Sprintf("%d_%d", chunkid, indx)]], nil
+}
+
+func (m *memDedupIndex) DedupRefs(chunkid uint64, indx int) (string, int64, error) {
+	m.Lock()
+	defer m.Unlock()
+	hash := m.blocks[fmt.Sprintf("%d_%d", chunkid, indx)]
+	return m.keys[hash], m.refs[hash], nil
+}
+
+func (m *memDedupIndex) RemoveDedup(chunkid uint64, indx int) (string, int64, error) {
+	m.Lock()
+	defer m.Unlock()
+	block := fmt.Sprintf("%d_%d", chunkid, indx)
+	hash, ok := m.blocks[block]
+	if !ok {
+		return "", 0, nil
+	}
+	delete(m.blocks, block)
+	key := m.keys[hash]
+	m.refs[hash]--
+	left := m.refs[hash]
+	if left <= 0 {
+		delete(m.keys, hash)
+		delete(m.refs, hash)
+	}
+	return key, left, nil
+}
+
+func TestDedupStore(t *testing.T) {
+	mem, _ := object.CreateStorage("mem", "", "", "")
+	conf := defaultConf
+	conf.CacheSize = 0
+	conf.Dedup = true
+	index := newMemDedupIndex()
+	conf.DedupIndex = index
+	store := NewCachedStore(mem, conf)
+
+	same := bytes.Repeat([]byte("a"), 1024)
+	data := map[uint64][]byte{
+		10: append(append([]byte{}, same...), []byte("tail of 10")...),
+		11: append(append([]byte{}, same...), same...),
+		12: []byte("tail of 10"),
+	}
+	for id, buf := range data {
+		w := store.NewWriter(id)
+		if _, err := w.WriteAt(buf, 0); err != nil {
+			t.Fatalf("write %d: %s", id, err)
+		}
+		if err := w.Finish(len(buf)); err != nil {
+			t.Fatalf("finish %d: %s", id, err)
+		}
+	}
+	if objs, _ := mem.List("", "", 100); len(objs) != 2 {
+		t.Fatalf("expect 2 objects for 5 blocks, but got %d", len(objs))
+	}
+
+	read := func(id uint64) {
+		buf := data[id]
+		p := NewPage(make([]byte, len(buf)))
+		if n, err := store.NewReader(id, len(buf)).ReadAt(context.Background(), p, 0); err != nil || n != len(buf) {
+			t.Fatalf("read %d: %d %s", id, n, err)
+		}
+		if !bytes.Equal(p.Data, buf) {
+			t.Fatalf("read %d: unexpected data", id)
+		}
+	}
+	for id := range data {
+		read(id)
+	}
+	// the objects of the blocks are cached
+	if index.lookups != 0 {
+		t.Fatalf("blocks are looked up %d times", index.lookups)
+	}
+	store.(*cachedStore).dedups = newDedupOwners()
+	read(11)
+	lookups := index.lookups
+	read(11)
+	if lookups == 0 || index.lookups != lookups {
+		t.Fatalf("blocks are looked up %d times after %d", index.lookups, lookups)
+	}
+	if keys, err := ObjectKeys(&conf, 11, 2048); err != nil || len(keys) != 2 || keys[0] != keys[1] {
+		t.Fatalf("keys of deduplicated chunk: %v %s", keys, err)
+	}
+
+	// the objects are kept until all the blocks in them are removed
+	for _, id := range []uint64{10, 11} {
+		if err := store.Remove(id, len(data[id])); err != nil {
+			t.Fatalf("remove %d: %s", id, err)
+		}
+	}
+	read(12)
+	if err := store.Remove(12, len(data[12])); err != nil {
+		t.Fatalf("remove 12: %s", err)
+	}
+	if objs, _ := mem.List("", "", 100); len(objs) != 0 {
+		t.Fatalf("all objects should be removed, but got %d", len(objs))
+	}
+}
@@ -17,6 +17,7 @@ package chunk
 
 import (
 	"errors"
+	"fmt"
 	"hash/fnv"
 	"io"
 	"os"
@@ -26,6 +27,7 @@ import (
 	"strings"
 	"sync"
 	"time"
+	"unsafe"
 
 	"github.com/juicedata/juicefs/pkg/utils"
 )
@@ -38,6 +40,8 @@ var (
 type cacheItem struct {
 	size  int32
 	atime uint32
+	ctime uint32
+	hits  uint32
 }
 
 type pendingFile struct {
@@ -49,18 +53,49 @@ type cacheStore struct {
 	sync.Mutex
 	dir       string
 	mode      os.FileMode
+	policy    evictPolicy
 	capacity  int64
+	shared    int64 // budget shared with the other cache directories next to it, 0 means not shared
 	freeRatio float32
 	limit     int
 	pending   chan pendingFile
 	pages     map[string]*Page
 
 	used    int64
+	others  int64 // bytes used by the other cache directories sharing the budget
+	peers   int   // number of the other cache directories sharing the budget
 	keys    map[string]cacheItem
 	scanned bool
+	changed bool // blocks are added or removed after the index is saved
+
+	pinLimit   int64
+	pinnedUsed int64
+	pinned     map[string]bool // blocks not evictable
+
+	ioErrors int32 // I/O errors in a row
+	down     int32 // taken out because of I/O errors
+
+	uring  *uring // submit the I/O of cache files through io_uring, nil means pread/pwrite
+	direct bool   // open the cache files with O_DIRECT, so they're not in the page cache
 }
 
-func newCacheStore(dir string, cacheSize int64, limit, pendingPages int, config *Config) *cacheStore {
+// The engines to read and write the cache files.
+const (
+	CacheIOPsync = "psync"
+	CacheIOURing = "io_uring"
+)
+
+const uringEntries = 256
+
+// CheckCacheIO returns an error if the engine of cache I/O is unknown.
+func CheckCacheIO(name string) error {
+	if name != "" && name != CacheIOPsync && name != CacheIOURing {
+		return fmt.Errorf("unknown cache I/O engine %q, it should be %s or %s", name, CacheIOPsync, CacheIOURing)
+	}
+	return nil
+}
+
+func newCacheStore(dir string, cacheSize, shared, pinLimit int64, limit, pendingPages int, config *Config) *cacheStore {
 	if config.CacheMode == 0 {
 		config.CacheMode = 0600 // only owner can read/write cache
 	}
@@ -70,14 +105,32 @@ func newCacheStore(dir string, cacheSize int64, limit, pendingPages int, config
 	c := &cacheStore{
 		dir:       dir,
 		mode:      config.CacheMode,
+		policy:    newEvictPolicy(config.CacheEviction),
 		capacity:  cacheSize,
+		shared:    shared,
+		pinLimit:  pinLimit,
+		pinned:    make(map[string]bool),
 		freeRatio: config.FreeSpace,
 		limit:     limit,
 		keys:      make(map[string]cacheItem),
 		pending:   make(chan pendingFile, pendingPages),
 		pages:     make(map[string]*Page),
 	}
+	if config.CacheIO == CacheIOURing {
+		if r, err := newURing(uringEntries); err == nil {
+			c.uring = r
+		} else {
+			logger.Warnf("io_uring is not available for cache %s, use %s: %s", dir, CacheIOPsync, err)
+		}
+	}
 	c.createDir(c.dir)
+	if config.CacheDirect {
+		if err := c.checkDirect(); err == nil {
+			c.direct = true
+		} else {
+			logger.Warnf("direct I/O is not available for cache %s: %s", dir, err)
+		}
+	}
 	br, fr := c.curFreeRatio()
 	if br < c.freeRatio || fr < c.freeRatio {
 		logger.Warnf("not enough space (%d%%) or inodes (%d%%) for caching: free ratio should be >= %d%%", int(br*100), int(fr*100), int(c.freeRatio*100))
@@ -85,6 +138,9 @@ func newCacheStore(dir string, cacheSize int64, limit, pendingPages int, config
 	go c.flush()
 	go c.checkFreeSpace()
 	go c.refreshCacheKeys()
+	if c.shared > 0 {
+		go c.shareUsage()
+	}
 	return c
 }
 
@@ -111,9 +167,31 @@ func (cache *cacheStore) checkFreeSpace() {
 }
 
 func (cache *cacheStore) refreshCacheKeys() {
+	if !cache.loadIndex() {
+		cache.scanCached()
+		cache.writeIndex()
+	}
 	for {
+		for i := time.Duration(0); i < scanInterval; i += indexInterval {
+			time.Sleep(indexInterval)
+			cache.Lock()
+			changed := cache.changed
+			cache.Unlock()
+			if changed {
+				cache.writeIndex()
+			}
+		}
 		cache.scanCached()
-		time.Sleep(time.Minute * 5)
+		cache.writeIndex()
+	}
+}
+
+func (cache *cacheStore) writeIndex() {
+	if !cache.usable() {
+		return
+	}
+	if err := cache.saveIndex(); err != nil {
+		logger.Warnf("save cache index %s: %s", cache.indexPath(), err)
 	}
 }
 
@@ -145,13 +223,13 @@ func (cache *cacheStore) curFreeRatio() (float32, float32) {
 
 func (cache *cacheStore) flushPage(path string, data []byte, sync bool) error {
 	cache.createDir(filepath.Dir(path))
-	tmp := path + ".tmp"
-	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE, cache.mode)
+	tmp := path + tmpSuffix
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|cache.openFlag(), cache.mode)
 	if err != nil {
 		logger.Infof("Can't create cache file %s: %s", tmp, err)
 		return err
 	}
-	_, err = f.Write(data)
+	err = cache.writeFile(f, data)
 	if err != nil {
 		logger.Infof("Write to cache file %s: %s", tmp, err)
 		_ = f.Close()
@@ -159,7 +237,11 @@ func (cache *cacheStore) flushPage(path string, data []byte, sync bool) error {
 		return err
 	}
 	if sync {
-		err = f.Sync()
+		if cache.uring != nil {
+			err = cache.uring.fsync(f)
+		} else {
+			err = f.Sync()
+		}
 		if err != nil {
 			logger.Warnf("sync stagging file %s: %s", tmp, err)
 			_ = f.Close()
@@ -203,6 +285,8 @@ func (cache *cacheStore) remove(key string) {
 	if cache.keys[key].atime > 0 {
 		cache.used -= int64(cache.keys[key].size + 4096)
 		delete(cache.keys, key)
+		cache.unpinLocked(key)
+		cache.changed = true
 	} else if cache.scanned {
 		path = "" // not existed
 	}
@@ -223,15 +307,133 @@ func (cache *cacheStore) load(key string) (ReadCloser, error) {
 		return nil, errors.New("not cached")
 	}
 	cache.Unlock()
-	f, err := os.Open(cache.cachePath(key))
+	f, err := os.OpenFile(cache.cachePath(key), os.O_RDONLY|cache.openFlag(), 0)
+	cache.checkErr(err)
 	cache.Lock()
-	if err == nil {
-		if it, ok := cache.keys[key]; ok {
-			// update atime
-			cache.keys[key] = cacheItem{it.size, uint32(time.Now().Unix())}
+	if err != nil {
+		return f, err
+	}
+	if it, ok := cache.keys[key]; ok {
+		// update atime
+		it.atime = uint32(time.Now().Unix())
+		it.hits++
+		cache.keys[key] = it
+	}
+	if cache.uring != nil || cache.direct {
+		return &cacheFile{File: f, cache: cache}, nil
+	}
+	return f, nil
+}
+
+// cacheFile reads a cache file opened for io_uring or direct I/O.
+type cacheFile struct {
+	*os.File
+	cache *cacheStore
+	off   int64
+}
+
+func (f *cacheFile) Read(buf []byte) (int, error) {
+	n, err := f.ReadAt(buf, f.off)
+	f.off += int64(n)
+	return n, err
+}
+
+func (f *cacheFile) ReadAt(buf []byte, off int64) (int, error) {
+	return f.cache.readAt(f.File, buf, off)
+}
+
+// The buffers, offsets and sizes of direct I/O should be aligned to the logical
+// block size of the disk, 4 KiB is enough for all of them.
+const directAlign = 4096
+
+func (cache *cacheStore) openFlag() int {
+	if cache.direct {
+		return oDirect
+	}
+	return 0
+}
+
+func isAligned(buf []byte, off int64) bool {
+	return len(buf) > 0 && uintptr(unsafe.Pointer(&buf[0]))%directAlign == 0 && len(buf)%directAlign == 0 && off%directAlign == 0
+}
+
+func alignUp(n int) int {
+	return (n + directAlign - 1) &^ (directAlign - 1)
+}
+
+func (cache *cacheStore) pread(f *os.File, buf []byte, off int64) (int, error) {
+	if cache.uring != nil {
+		return cache.uring.pread(f, buf, off)
+	}
+	return f.ReadAt(buf, off)
+}
+
+// readAt reads a cache file like ReadAt, the unaligned reads of direct I/O go through
+// an aligned buffer.
+func (cache *cacheStore) readAt(f *os.File, buf []byte, off int64) (int, error) {
+	if !cache.direct || len(buf) == 0 || isAligned(buf, off) {
+		return cache.pread(f, buf, off)
+	}
+	start := off &^ (directAlign - 1)
+	skip := int(off - start)
+	p := NewOffPage(alignUp(skip + len(buf)))
+	defer p.Release()
+	n, err := cache.pread(f, p.Data, start)
+	if n -= skip; n < 0 {
+		n = 0
+	}
+	if n >= len(buf) {
+		n, err = len(buf), nil
+	} else if err == nil {
+		err = io.EOF
+	}
+	copy(buf, p.Data[skip:skip+n])
+	return n, err
+}
+
+// writeFile writes data into a new cache file, the last block of direct I/O is
+// padded with zeros and truncated later.
+func (cache *cacheStore) writeFile(f *os.File, data []byte) error {
+	buf := data
+	if cache.direct && !isAligned(data, 0) {
+		p := NewOffPage(alignUp(len(data)))
+		defer p.Release()
+		copy(p.Data, data)
+		for i := len(data); i < len(p.Data); i++ {
+			p.Data[i] = 0
 		}
+		buf = p.Data
 	}
-	return f, err
+	var err error
+	if cache.uring != nil {
+		_, err = cache.uring.pwrite(f, buf, 0)
+	} else {
+		_, err = f.Write(buf)
+	}
+	if err == nil && len(buf) > len(data) {
+		err = f.Truncate(int64(len(data)))
+	}
+	return err
+}
+
+// checkDirect checks whether the cache directory supports direct I/O, tmpfs doesn't.
+func (cache *cacheStore) checkDirect() error {
+	if oDirect == 0 {
+		return errors.New("not supported on this platform")
+	}
+	path := filepath.Join(cache.dir, "direct.test")
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC|oDirect, cache.mode)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = f.Close()
+		_ = os.Remove(path)
+	}()
+	p := NewOffPage(directAlign)
+	defer p.Release()
+	_, err = f.WriteAt(p.Data, 0)
+	return err
 }
 
 func (cache *cacheStore) cachePath(key string) string {
@@ -247,8 +449,12 @@ func (cache *cacheStore) flush() {
 	for {
 		w := <-cache.pending
 		path := cache.cachePath(w.key)
-		if cache.capacity > 0 && cache.flushPage(path, w.page.Data, false) == nil {
-			cache.add(w.key, int32(len(w.page.Data)), uint32(time.Now().Unix()))
+		if cache.capacity > 0 && cache.usable() {
+			err := cache.flushPage(path, w.page.Data, false)
+			cache.checkErr(err)
+			if err == nil {
+				cache.add(w.key, int32(len(w.page.Data)), uint32(time.Now().Unix()))
+			}
 		}
 		cache.Lock()
 		delete(cache.pages, w.key)
@@ -264,15 +470,18 @@ func (cache *cacheStore) add(key string, size int32, atime uint32) {
 	if ok {
 		cache.used -= int64(it.size + 4096)
 	}
-	if atime == 0 {
-		// update size of staging block
-		cache.keys[key] = cacheItem{size, it.atime}
-	} else {
-		cache.keys[key] = cacheItem{size, atime}
+	it.size = size
+	if atime > 0 { // zero to update size of staging block
+		it.atime = atime
+	}
+	if !ok {
+		it.ctime = it.atime
 	}
+	cache.keys[key] = it
 	cache.used += int64(size + 4096)
+	cache.changed = true
 
-	if cache.used > cache.capacity || len(cache.keys) > cache.limit {
+	if cache.used > cache.quota() || len(cache.keys) > cache.limit {
 		cache.cleanup()
 	}
 }
@@ -280,6 +489,7 @@ func (cache *cacheStore) add(key string, size int32, atime uint32) {
 func (cache *cacheStore) stage(key string, data []byte, keepCache bool) (string, error) {
 	stagingPath := cache.stagePath(key)
 	err := cache.flushPage(stagingPath, data, true)
+	cache.checkErr(err)
 	if err == nil && cache.capacity > 0 && keepCache {
 		path := cache.cachePath(key)
 		cache.createDir(filepath.Dir(path))
@@ -292,6 +502,17 @@ func (cache *cacheStore) stage(key string, data []byte, keepCache bool) (string,
 	return stagingPath, err
 }
 
+// readStaging reads a staging block into buf, which should be the size of it.
+func (cache *cacheStore) readStaging(path string, buf []byte) error {
+	f, err := os.OpenFile(path, os.O_RDONLY|cache.openFlag(), 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = cache.readAt(f, buf, 0)
+	return err
+}
+
 func (cache *cacheStore) uploaded(key string, size int) {
 	cache.add(key, int32(size), 0)
 }
@@ -301,7 +522,7 @@ func (cache *cacheStore) cleanup() {
 	if !cache.scanned {
 		return
 	}
-	goal := cache.capacity * 95 / 100
+	goal := cache.quota() * 95 / 100
 	num := int(cache.limit * 95 / 100)
 	// make sure we have enough free space after cleanup
 	br, fr := cache.curFreeRatio()
@@ -326,33 +547,26 @@ func (cache *cacheStore) cleanup() {
 
 	var todel []string
 	var freed int64
-	var cnt int
-	var lastKey string
-	var lastValue cacheItem
-	var now = uint32(time.Now().Unix())
-	// for each two random keys, then compare the access time, evict the older one
+	var now = int64(time.Now().Unix())
+	items := make([]evictItem, 0, len(cache.keys))
 	for key, value := range cache.keys {
-		if value.size == 0 {
-			continue // staging
+		if value.size == 0 || cache.pinned[key] {
+			continue // staging or pinned
 		}
-		if cnt == 0 || lastValue.atime > value.atime {
-			lastKey = key
-			lastValue = value
-		}
-		cnt++
-		if cnt > 1 {
-			delete(cache.keys, lastKey)
-			freed += int64(lastValue.size + 4096)
-			cache.used -= int64(lastValue.size + 4096)
-			todel = append(todel, lastKey)
-			logger.Debugf("remove %s from cache, age: %d", lastKey, now-lastValue.atime)
-			cnt = 0
-			if len(cache.keys) < num && cache.used < goal {
-				break
-			}
+		items = append(items, evictItem{key, int64(value.size), int64(value.atime), int64(value.ctime), value.hits})
+	}
+	for _, it := range cache.policy.victims(items) {
+		delete(cache.keys, it.key)
+		freed += it.size + 4096
+		cache.used -= it.size + 4096
+		todel = append(todel, it.key)
+		logger.Debugf("remove %s from cache, age: %d, hits: %d", it.key, now-it.atime, it.hits)
+		if len(cache.keys) < num && cache.used < goal {
+			break
 		}
 	}
 	if len(todel) > 0 {
+		cache.changed = true
 		logger.Debugf("cleanup cache: %d blocks (%d MB), freed %d blocks (%d MB)", len(cache.keys), cache.used>>20, len(todel), freed>>20)
 	}
 	cache.Unlock()
@@ -490,8 +704,14 @@ type CacheManager interface {
 	load(key string) (ReadCloser, error)
 	uploaded(key string, size int)
 	stage(key string, data []byte, keepCache bool) (string, error)
+	readStaging(path string, buf []byte) error
 	scanStaging() map[string]string
 	stats() (int64, int64)
+	pin(key string, p *Page) error
+	unpin(key string) bool
+	pinStats() PinStats
+	usable(key string) bool
+	ioFailed(key string, err error)
 }
 
 func newCacheManager(config *Config) CacheManager {
@@ -519,6 +739,13 @@ func newCacheManager(config *Config) CacheManager {
 	sort.Strings(dirs)
 	dirCacheSize := config.CacheSize << 20
 	dirCacheSize /= int64(len(dirs))
+	dirShared := config.SharedCacheSize << 20
+	dirShared /= int64(len(dirs))
+	dirPinSize := config.PinSize << 20
+	dirPinSize /= int64(len(dirs))
+	if dirPinSize > dirCacheSize {
+		dirPinSize = dirCacheSize
+	}
 	limit := dirCacheSize / int64(config.BlockSize) * 2
 	if limit < 1000000 {
 		limit = 1000000
@@ -529,13 +756,38 @@ func newCacheManager(config *Config) CacheManager {
 	// 20% of buffer could be used for pending pages
 	pendingPages := config.BufferSize * 2 / 10 / config.BlockSize / len(dirs)
 	for i, d := range dirs {
-		m.stores[i] = newCacheStore(strings.TrimSpace(d)+string(filepath.Separator), dirCacheSize, int(limit), pendingPages, config)
+		m.stores[i] = newCacheStore(strings.TrimSpace(d)+string(filepath.Separator), dirCacheSize, dirShared, dirPinSize, int(limit), pendingPages, config)
 	}
 	return m
 }
 
+// getStore returns the cache store of key, or the next one if it's taken out. It
+// returns nil if all of them are taken out.
 func (m *cacheManager) getStore(key string) *cacheStore {
-	return m.stores[keyHash(key)%uint32(len(m.stores))]
+	if len(m.stores) == 0 {
+		return nil
+	}
+	n := uint32(len(m.stores))
+	h := keyHash(key) % n
+	for i := uint32(0); i < n; i++ {
+		if s := m.stores[(h+i)%n]; s.usable() {
+			return s
+		}
+	}
+	return nil
+}
+
+// usable returns false if the cache store of key is taken out, then the opened
+// cache files of it should not be used anymore.
+func (m *cacheManager) usable(key string) bool {
+	return len(m.stores) > 0 && m.stores[keyHash(key)%uint32(len(m.stores))].usable()
+}
+
+// ioFailed reports an error in reading the cached block of key.
+func (m *cacheManager) ioFailed(key string, err error) {
+	if s := m.getStore(key); s != nil {
+		s.checkErr(err)
+	}
 }
 
 func (m *cacheManager) stats() (int64, int64) {
@@ -549,10 +801,9 @@ func (m *cacheManager) stats() (int64, int64) {
 }
 
 func (m *cacheManager) cache(key string, p *Page) {
-	if len(m.stores) == 0 {
-		return
+	if s := m.getStore(key); s != nil {
+		s.cache(key, p)
 	}
-	m.getStore(key).cache(key, p)
 }
 
 type ReadCloser interface {
@@ -562,29 +813,40 @@ type ReadCloser interface {
 }
 
 func (m *cacheManager) load(key string) (ReadCloser, error) {
-	if len(m.stores) == 0 {
+	s := m.getStore(key)
+	if s == nil {
 		return nil, errors.New("no cache dir")
 	}
-	return m.getStore(key).load(key)
+	return s.load(key)
 }
 
 func (m *cacheManager) remove(key string) {
-	if len(m.stores) > 0 {
-		m.getStore(key).remove(key)
+	if s := m.getStore(key); s != nil {
+		s.remove(key)
 	}
 }
 
 func (m *cacheManager) stage(key string, data []byte, keepCache bool) (string, error) {
-	if len(m.stores) == 0 {
+	s := m.getStore(key)
+	if s == nil {
 		return "", errors.New("no cache dir")
 	}
-	return m.getStore(key).stage(key, data, keepCache)
+	return s.stage(key, data, keepCache)
 }
 
 func (m *cacheManager) uploaded(key string, size int) {
-	if len(m.stores) > 0 {
-		m.getStore(key).uploaded(key, size)
+	if s := m.getStore(key); s != nil {
+		s.uploaded(key, size)
+	}
+}
+
+func (m *cacheManager) readStaging(path string, buf []byte) error {
+	for _, s := range m.stores {
+		if strings.HasPrefix(path, s.dir) {
+			return s.readStaging(path, buf)
+		}
 	}
+	return errors.New("no cache dir")
 }
 
 func (m *cacheManager) scanStaging() map[string]string {
@@ -16,7 +16,10 @@
 package chunk
 
 import (
+	"bytes"
+	"fmt"
 	"os"
+	"sync"
 	"testing"
 	"time"
 )
@@ -41,8 +44,92 @@ func TestExpand(t *testing.T) {
 	}
 }
 
+func TestURingCache(t *testing.T) {
+	conf := defaultConf
+	conf.CacheIO = CacheIOURing
+	s := newCacheStore("/tmp/diskCacheURing", 1<<30, 0, 0, 1<<10, 1, &conf)
+	if s.uring == nil {
+		t.Skip("io_uring is not available")
+	}
+	data := make([]byte, 1<<20)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 32; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			key := fmt.Sprintf("/chunks/0/0/%d_0_%d", i+1, len(data))
+			path, err := s.stage(key, data, true)
+			if err != nil {
+				t.Errorf("stage %s: %s", key, err)
+				return
+			}
+			buf := make([]byte, len(data))
+			if err = s.readStaging(path, buf); err != nil || !bytes.Equal(buf, data) {
+				t.Errorf("read staging %s: %v", key, err)
+			}
+			f, err := s.load(key)
+			if err != nil {
+				t.Errorf("load %s: %s", key, err)
+				return
+			}
+			defer f.Close()
+			if n, err := f.ReadAt(buf[:100], int64(len(data)-50)); n != 50 || err == nil || !bytes.Equal(buf[:50], data[len(data)-50:]) {
+				t.Errorf("read at the end of %s: %d %v", key, n, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	_ = os.RemoveAll("/tmp/diskCacheURing")
+}
+
+func TestDirectCache(t *testing.T) {
+	for _, engine := range []string{CacheIOPsync, CacheIOURing} {
+		conf := defaultConf
+		conf.CacheIO = engine
+		conf.CacheDirect = true
+		s := newCacheStore("/tmp/diskCacheDirect", 1<<30, 0, 0, 1<<10, 1, &conf)
+		if !s.direct {
+			t.Skip("direct I/O is not available")
+		}
+		data := make([]byte, 10000) // not aligned
+		for i := range data {
+			data[i] = byte(i % 251)
+		}
+		key := fmt.Sprintf("/chunks/0/0/1_0_%d", len(data))
+		path, err := s.stage(key, data, true)
+		if err != nil {
+			t.Fatalf("stage %s with %s: %s", key, engine, err)
+		}
+		if st, err := os.Stat(path); err != nil || st.Size() != int64(len(data)) {
+			t.Fatalf("size of %s: %+v %v", path, st, err)
+		}
+		buf := make([]byte, len(data))
+		if err = s.readStaging(path, buf); err != nil || !bytes.Equal(buf, data) {
+			t.Fatalf("read staging %s with %s: %v", key, engine, err)
+		}
+		f, err := s.load(key)
+		if err != nil {
+			t.Fatalf("load %s with %s: %s", key, engine, err)
+		}
+		if n, err := f.ReadAt(buf[:100], 4090); n != 100 || err != nil || !bytes.Equal(buf[:100], data[4090:4190]) {
+			t.Fatalf("read at 4090 with %s: %d %v", engine, n, err)
+		}
+		if n, err := f.ReadAt(buf[:100], int64(len(data)-50)); n != 50 || err == nil || !bytes.Equal(buf[:50], data[len(data)-50:]) {
+			t.Fatalf("read at the end with %s: %d %v", engine, n, err)
+		}
+		if n, err := f.Read(buf[:5000]); n != 5000 || err != nil || !bytes.Equal(buf[:5000], data[:5000]) {
+			t.Fatalf("read with %s: %d %v", engine, n, err)
+		}
+		f.Close()
+		_ = os.RemoveAll("/tmp/diskCacheDirect")
+	}
+}
+
 func BenchmarkLoadCached(b *testing.B) {
-	s := newCacheStore("/tmp/diskCache", 1<<30, 1<<10, 1, &defaultConf)
+	s := newCacheStore("/tmp/diskCache", 1<<30, 0, 0, 1<<10, 1, &defaultConf)
 	p := NewPage(make([]byte, 1024))
 	key := "/chunks/1_1024"
 	s.cache(key, p)
@@ -58,7 +145,7 @@ func BenchmarkLoadCached(b *testing.B) {
 }
 
 func BenchmarkLoadUncached(b *testing.B) {
-	s := newCacheStore("/tmp/diskCache", 1<<30, 1<<10, 1, &defaultConf)
+	s := newCacheStore("/tmp/diskCache", 1<<30, 0, 0, 1<<10, 1, &defaultConf)
 	key := "/chunks/222_1024"
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
@@ -0,0 +1,116 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package chunk
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// A cache directory is taken out of rotation after a few I/O errors in a row, then
+// its blocks are served by the other cache directories or the object storage, until
+// it's writable and readable again.
+const (
+	maxIOErrors = 3
+	probeDelay  = time.Second * 30
+)
+
+var (
+	cacheIOErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "blockcache_io_errors",
+		Help: "I/O errors of the cache disks",
+	})
+	cacheDirsDown = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "blockcache_dirs_down",
+		Help: "number of cache directories taken out because of I/O errors",
+	})
+)
+
+func init() {
+	_ = prometheus.Register(cacheIOErrors)
+	_ = prometheus.Register(cacheDirsDown)
+}
+
+// isIOError returns true if err means the disk is broken, rather than the block is missing.
+func isIOError(err error) bool {
+	var errno syscall.Errno
+	if !errors.As(err, &errno) {
+		return false
+	}
+	return errno == syscall.EIO || errno == syscall.EROFS || errno == syscall.ENXIO
+}
+
+func (cache *cacheStore) usable() bool {
+	return atomic.LoadInt32(&cache.down) == 0
+}
+
+// checkErr records the result of an I/O operation on the cache disk.
+func (cache *cacheStore) checkErr(err error) {
+	if err == nil {
+		atomic.StoreInt32(&cache.ioErrors, 0)
+		return
+	}
+	if !isIOError(err) {
+		return
+	}
+	cacheIOErrors.Inc()
+	if atomic.AddInt32(&cache.ioErrors, 1) >= maxIOErrors && atomic.CompareAndSwapInt32(&cache.down, 0, 1) {
+		cacheDirsDown.Inc()
+		logger.Errorf("Take out cache dir %s because of I/O errors (last: %s), the blocks in it will be read from object storage", cache.dir, err)
+		go cache.probe()
+	}
+}
+
+// probe puts the cache directory back after it works again.
+func (cache *cacheStore) probe() {
+	for {
+		time.Sleep(probeDelay)
+		if err := cache.checkDisk(); err != nil {
+			logger.Debugf("Cache dir %s is still broken: %s", cache.dir, err)
+			continue
+		}
+		// some blocks may be lost
+		cache.scanCached()
+		atomic.StoreInt32(&cache.ioErrors, 0)
+		atomic.StoreInt32(&cache.down, 0)
+		cacheDirsDown.Dec()
+		logger.Infof("Cache dir %s works again, put it back", cache.dir)
+		return
+	}
+}
+
+// checkDisk writes a file into the cache directory and reads it back.
+func (cache *cacheStore) checkDisk() error {
+	path := filepath.Join(cache.dir, "probe"+tmpSuffix)
+	defer os.Remove(path)
+	data := []byte(time.Now().String())
+	if err := cache.flushPage(path, data, true); err != nil {
+		return err
+	}
+	got, err := ioutil.ReadFile(path)
+	if err == nil && !bytes.Equal(got, data) {
+		err = errors.New("content mismatch")
+	}
+	return err
+}
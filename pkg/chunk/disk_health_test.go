@@ -0,0 +1,84 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package chunk
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestCacheDiskFailure(t *testing.T) {
+	if !isIOError(&os.PathError{Op: "read", Path: "a", Err: syscall.EIO}) || isIOError(os.ErrNotExist) || isIOError(errors.New("EIO")) {
+		t.Fatalf("isIOError is wrong")
+	}
+	root, err := ioutil.TempDir("", "diskFailure")
+	if err != nil {
+		t.Fatalf("temp dir: %s", err)
+	}
+	defer os.RemoveAll(root)
+	conf := defaultConf
+	conf.CacheDir = filepath.Join(root, "a") + ":" + filepath.Join(root, "b")
+	conf.CacheSize = 100
+	conf.AutoCreate = true
+	m := newCacheManager(&conf).(*cacheManager)
+	bad := m.stores[0]
+	waitScanned(t, bad)
+	var key string
+	for i := 0; ; i++ {
+		key = fmt.Sprintf("chunks/0/0/%d_0_4", i)
+		if m.getStore(key) == bad {
+			break
+		}
+	}
+
+	bad.checkErr(syscall.EIO)
+	bad.checkErr(nil)
+	for i := 0; i < maxIOErrors-1; i++ {
+		bad.checkErr(syscall.EIO)
+	}
+	if !m.usable(key) {
+		t.Fatalf("errors not in a row should not take out the cache dir")
+	}
+	m.ioFailed(key, syscall.EIO)
+	if m.usable(key) || m.getStore(key) != m.stores[1] {
+		t.Fatalf("cache dir should be taken out after %d errors", maxIOErrors)
+	}
+	if _, err := m.stage(key, []byte("data"), true); err != nil {
+		t.Fatalf("stage into the other cache dir: %s", err)
+	}
+	if _, err := os.Stat(m.stores[1].stagePath(key)); err != nil {
+		t.Fatalf("staged block: %s", err)
+	}
+	if err := bad.checkDisk(); err != nil {
+		t.Fatalf("check disk: %s", err)
+	}
+
+	m.stores[1].checkErr(&os.PathError{Op: "write", Path: key, Err: syscall.EROFS})
+	m.stores[1].checkErr(syscall.EROFS)
+	m.stores[1].checkErr(syscall.EROFS)
+	if m.getStore(key) != nil {
+		t.Fatalf("all the cache dirs are taken out")
+	}
+	if _, err := m.load(key); err == nil {
+		t.Fatalf("load should fail without cache dir")
+	}
+	m.cache(key, NewPage([]byte("data")))
+}
@@ -0,0 +1,93 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package chunk
+
+import (
+	"fmt"
+	"sort"
+)
+
+// The policies to choose the cached blocks to evict.
+const (
+	EvictRandom = "2-random" // the older one of every two random blocks
+	EvictLRU    = "lru"      // the least recently used blocks
+	EvictLFU    = "lfu"      // the least frequently used blocks, then the least recently used ones
+	EvictFIFO   = "fifo"     // the earliest cached blocks
+)
+
+// evictItem is a cached block which can be evicted, the times are comparable only in the same cache.
+type evictItem struct {
+	key   string
+	size  int64
+	atime int64 // last accessed
+	ctime int64 // cached
+	hits  uint32
+}
+
+// evictPolicy chooses the cached blocks to evict.
+type evictPolicy interface {
+	// victims returns the blocks in the order to evict, which could be a part of them.
+	// The items are in the random order of iterating a map.
+	victims(items []evictItem) []evictItem
+}
+
+type randomPolicy struct{}
+
+func (randomPolicy) victims(items []evictItem) []evictItem {
+	vs := make([]evictItem, 0, len(items)/2)
+	for i := 0; i+1 < len(items); i += 2 {
+		v := items[i]
+		if items[i+1].atime < v.atime {
+			v = items[i+1]
+		}
+		vs = append(vs, v)
+	}
+	return vs
+}
+
+type sortedPolicy func(a, b *evictItem) bool
+
+func (less sortedPolicy) victims(items []evictItem) []evictItem {
+	sort.Slice(items, func(i, j int) bool { return less(&items[i], &items[j]) })
+	return items
+}
+
+var evictPolicies = map[string]evictPolicy{
+	EvictRandom: randomPolicy{},
+	EvictLRU:    sortedPolicy(func(a, b *evictItem) bool { return a.atime < b.atime }),
+	EvictLFU: sortedPolicy(func(a, b *evictItem) bool {
+		return a.hits < b.hits || a.hits == b.hits && a.atime < b.atime
+	}),
+	EvictFIFO: sortedPolicy(func(a, b *evictItem) bool { return a.ctime < b.ctime }),
+}
+
+// CheckEvictPolicy returns an error if the eviction policy is unknown.
+func CheckEvictPolicy(name string) error {
+	if _, ok := evictPolicies[name]; !ok && name != "" {
+		return fmt.Errorf("unknown eviction policy %q, it should be one of %s, %s, %s and %s", name, EvictRandom, EvictLRU, EvictLFU, EvictFIFO)
+	}
+	return nil
+}
+
+func newEvictPolicy(name string) evictPolicy {
+	if p, ok := evictPolicies[name]; ok {
+		return p
+	}
+	if name != "" {
+		logger.Warnf("unknown eviction policy %q, use %s", name, EvictRandom)
+	}
+	return randomPolicy{}
+}
@@ -0,0 +1,97 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package chunk
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestEvictPolicy(t *testing.T) {
+	items := func() []evictItem {
+		return []evictItem{
+			{key: "a", atime: 30, ctime: 1, hits: 5},
+			{key: "b", atime: 10, ctime: 3, hits: 2},
+			{key: "c", atime: 20, ctime: 2, hits: 2},
+			{key: "d", atime: 40, ctime: 4, hits: 0},
+		}
+	}
+	order := func(vs []evictItem) string {
+		var s string
+		for _, v := range vs {
+			s += v.key
+		}
+		return s
+	}
+	for name, expected := range map[string]string{
+		EvictRandom: "bc",
+		EvictLRU:    "bcad",
+		EvictLFU:    "dbca",
+		EvictFIFO:   "acbd",
+	} {
+		if got := order(newEvictPolicy(name).victims(items())); got != expected {
+			t.Fatalf("victims of %s: expect %s, but got %s", name, expected, got)
+		}
+	}
+	if CheckEvictPolicy("lru") != nil || CheckEvictPolicy("") != nil || CheckEvictPolicy("mru") == nil {
+		t.Fatalf("check eviction policy")
+	}
+}
+
+func TestEvictHotBlocks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "evictCache")
+	if err != nil {
+		t.Fatalf("temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	conf := defaultConf
+	conf.CacheEviction = EvictLFU
+	s := newCacheStore(dir+"/", 10*(1024+4096), 0, 0, 1<<10, 1, &conf)
+	waitScanned(t, s)
+	m := newMemStore(&Config{CacheSize: 1, CacheEviction: EvictLFU})
+	m.capacity = 10 * (1024 + 4096)
+
+	page := NewPage(make([]byte, 1024))
+	for i := 0; i < 30; i++ {
+		key := fmt.Sprintf("chunks/0/0/%d_0_1024", i)
+		if err := s.flushPage(s.cachePath(key), page.Data, false); err != nil {
+			t.Fatalf("flush %s: %s", key, err)
+		}
+		s.add(key, 1024, 1)
+		m.cache(key, page)
+		if i == 0 {
+			// the first block is hot
+			for j := 0; j < 10; j++ {
+				if r, err := s.load(key); err == nil {
+					r.Close()
+				}
+				if r, err := m.load(key); err == nil {
+					r.Close()
+				}
+			}
+		}
+	}
+	if r, err := s.load("chunks/0/0/0_0_1024"); err != nil {
+		t.Fatalf("hot block is evicted from disk cache: %s", err)
+	} else {
+		r.Close()
+	}
+	if _, err := m.load("chunks/0/0/0_0_1024"); err != nil {
+		t.Fatalf("hot block is evicted from memory cache: %s", err)
+	}
+}
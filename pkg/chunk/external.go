@@ -0,0 +1,51 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package chunk
+
+import (
+	"fmt"
+)
+
+// ExternalChunk is set in the id of chunks which are mapped to existing objects,
+// the blocks of them are read from the objects directly (not compressed nor encrypted).
+const ExternalChunk = uint64(1) << 62
+
+// ExternalIndex keeps the objects which are imported as chunks.
+type ExternalIndex interface {
+	AddExternal(chunkid uint64, key string, off uint64) error
+	LookupExternal(chunkid uint64) (key string, off uint64, err error)
+	RemoveExternal(chunkid uint64) error
+}
+
+func (store *cachedStore) locateExternal(key string, chunkid uint64, indx int) (*location, error) {
+	if store.conf.ExternalStorage == nil {
+		return nil, fmt.Errorf("no storage for imported chunk %d", chunkid)
+	}
+	obj, off, err := store.conf.ExternalIndex.LookupExternal(chunkid)
+	if err != nil {
+		return nil, err
+	}
+	if obj == "" {
+		return nil, fmt.Errorf("imported chunk %d is not found", chunkid)
+	}
+	return &location{
+		storage: store.conf.ExternalStorage,
+		key:     obj,
+		off:     int64(off) + int64(indx)*int64(store.conf.BlockSize),
+		size:    int64(parseObjOrigSize(key)),
+		raw:     true,
+	}, nil
+}
@@ -0,0 +1,103 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package chunk
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/juicedata/juicefs/pkg/object"
+)
+
+type memExternalIndex struct {
+	sync.Mutex
+	keys map[uint64]string
+	offs map[uint64]uint64
+}
+
+func (m *memExternalIndex) AddExternal(chunkid uint64, key string, off uint64) error {
+	m.Lock()
+	defer m.Unlock()
+	m.keys[chunkid] = key
+	m.offs[chunkid] = off
+	return nil
+}
+
+func (m *memExternalIndex) LookupExternal(chunkid uint64) (string, uint64, error) {
+	m.Lock()
+	defer m.Unlock()
+	return m.keys[chunkid], m.offs[chunkid], nil
+}
+
+func (m *memExternalIndex) RemoveExternal(chunkid uint64) error {
+	m.Lock()
+	defer m.Unlock()
+	delete(m.keys, chunkid)
+	delete(m.offs, chunkid)
+	return nil
+}
+
+func TestExternalChunk(t *testing.T) {
+	mem, _ := object.CreateStorage("mem", "", "", "")
+	bucket, _ := object.CreateStorage("mem", "", "", "")
+	data := make([]byte, 5000)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	_ = bucket.Put("data/file", bytes.NewReader(data))
+
+	index := &memExternalIndex{keys: make(map[uint64]string), offs: make(map[uint64]uint64)}
+	conf := defaultConf
+	conf.CacheSize = 0
+	conf.Compress = "lz4"
+	conf.ExternalIndex = index
+	conf.ExternalStorage = bucket
+	store := NewCachedStore(mem, conf)
+
+	id := 10 | ExternalChunk
+	_ = index.AddExternal(id, "data/file", 1000)
+	length := len(data) - 1000
+	p := NewPage(make([]byte, length))
+	if n, err := store.NewReader(id, length).ReadAt(context.Background(), p, 0); err != nil || n != length {
+		t.Fatalf("read external chunk: %d %s", n, err)
+	}
+	if !bytes.Equal(p.Data, data[1000:]) {
+		t.Fatalf("read external chunk: unexpected data")
+	}
+	// partial read
+	p = NewPage(make([]byte, 100))
+	if n, err := store.NewReader(id, length).ReadAt(context.Background(), p, 2500); err != nil || n != 100 {
+		t.Fatalf("read external chunk at 2500: %d %s", n, err)
+	}
+	if !bytes.Equal(p.Data, data[3500:3600]) {
+		t.Fatalf("read external chunk at 2500: unexpected data")
+	}
+	if _, err := store.(BlockChecker).CheckBlock(id, length, 3); err != nil {
+		t.Fatalf("check external block: %s", err)
+	}
+
+	if err := store.Remove(id, length); err != nil {
+		t.Fatalf("remove external chunk: %s", err)
+	}
+	if key, _, _ := index.LookupExternal(id); key != "" {
+		t.Fatalf("external chunk should be removed from index")
+	}
+	if _, err := bucket.Head("data/file"); err != nil {
+		t.Fatalf("imported object should be kept: %s", err)
+	}
+}
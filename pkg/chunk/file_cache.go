@@ -0,0 +1,113 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package chunk
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"time"
+)
+
+var errNotCached = errors.New("not cached")
+
+// files are kept open for a while after last use, so the file descriptor
+// will be still valid when the kernel splices data from it.
+const fileIdleTime = time.Second * 10
+
+type openFile struct {
+	f        *os.File
+	size     int64
+	lastUsed time.Time
+}
+
+// fileCache keeps the cached blocks open to serve zero-copy reads.
+type fileCache struct {
+	sync.Mutex
+	files  map[string]*openFile
+	load   func(key string) (ReadCloser, error)
+	usable func(key string) bool
+}
+
+func newFileCache(load func(key string) (ReadCloser, error), usable func(key string) bool) *fileCache {
+	c := &fileCache{
+		files:  make(map[string]*openFile),
+		load:   load,
+		usable: usable,
+	}
+	go c.cleanup()
+	return c
+}
+
+// get returns the opened cache file of key, which should have at least size bytes.
+func (c *fileCache) get(key string, size int64) (*os.File, error) {
+	if !c.usable(key) {
+		// the opened file may be on a broken disk, it's closed after idle
+		return nil, errNotCached
+	}
+	c.Lock()
+	defer c.Unlock()
+	of, ok := c.files[key]
+	if !ok {
+		r, err := c.load(key)
+		if err != nil {
+			return nil, err
+		}
+		var f *os.File
+		switch r := r.(type) {
+		case *os.File:
+			f = r
+		case *cacheFile:
+			if r.cache.direct {
+				// splice doesn't work well with O_DIRECT
+				r.Close()
+				return nil, errNotCached
+			}
+			f = r.File
+		default:
+			// data in memory
+			r.Close()
+			return nil, errNotCached
+		}
+		fi, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		of = &openFile{f: f, size: fi.Size()}
+		c.files[key] = of
+	}
+	if of.size < size {
+		return nil, errNotCached
+	}
+	of.lastUsed = time.Now()
+	return of.f, nil
+}
+
+func (c *fileCache) cleanup() {
+	for {
+		time.Sleep(time.Second)
+		now := time.Now()
+		c.Lock()
+		for key, of := range c.files {
+			if now.Sub(of.lastUsed) > fileIdleTime {
+				of.f.Close()
+				delete(c.files, key)
+			}
+		}
+		c.Unlock()
+	}
+}
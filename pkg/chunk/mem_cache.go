@@ -23,11 +23,14 @@ import (
 
 type memItem struct {
 	atime time.Time
+	ctime time.Time
+	hits  uint32
 	page  *Page
 }
 
 type memcache struct {
 	sync.Mutex
+	policy   evictPolicy
 	capacity int64
 	used     int64
 	pages    map[string]memItem
@@ -35,6 +38,7 @@ type memcache struct {
 
 func newMemStore(config *Config) *memcache {
 	c := &memcache{
+		policy:   newEvictPolicy(config.CacheEviction),
 		capacity: config.CacheSize << 20,
 		pages:    make(map[string]memItem),
 	}
@@ -58,7 +62,8 @@ func (c *memcache) cache(key string, p *Page) {
 	}
 	p.Acquire()
 	size := int64(cap(p.Data))
-	c.pages[key] = memItem{time.Now(), p}
+	now := time.Now()
+	c.pages[key] = memItem{now, now, 0, p}
 	c.used += size + 4096
 	if c.used > c.capacity {
 		c.cleanup()
@@ -85,7 +90,9 @@ func (c *memcache) load(key string) (ReadCloser, error) {
 	c.Lock()
 	defer c.Unlock()
 	if item, ok := c.pages[key]; ok {
-		c.pages[key] = memItem{time.Now(), item.page}
+		item.atime = time.Now()
+		item.hits++
+		c.pages[key] = item
 		return NewPageReader(item.page), nil
 	}
 	return nil, errors.New("not found")
@@ -93,24 +100,16 @@ func (c *memcache) load(key string) (ReadCloser, error) {
 
 // locked
 func (c *memcache) cleanup() {
-	var cnt int
-	var lastKey string
-	var lastValue memItem
 	var now = time.Now()
-	// for each two random keys, then compare the access time, evict the older one
+	items := make([]evictItem, 0, len(c.pages))
 	for k, v := range c.pages {
-		if cnt == 0 || lastValue.atime.After(v.atime) {
-			lastKey = k
-			lastValue = v
-		}
-		cnt++
-		if cnt > 1 {
-			logger.Debugf("remove %s from cache, age: %d", lastKey, now.Sub(lastValue.atime))
-			c.delete(lastKey, lastValue.page)
-			cnt = 0
-			if c.used < c.capacity {
-				break
-			}
+		items = append(items, evictItem{k, int64(cap(v.page.Data)), v.atime.UnixNano(), v.ctime.UnixNano(), v.hits})
+	}
+	for _, it := range c.policy.victims(items) {
+		logger.Debugf("remove %s from cache, age: %d, hits: %d", it.key, now.UnixNano()-it.atime, it.hits)
+		c.delete(it.key, c.pages[it.key].page)
+		if c.used < c.capacity {
+			break
 		}
 	}
 }
@@ -118,5 +117,10 @@ func (c *memcache) cleanup() {
 func (c *memcache) stage(key string, data []byte, keepCache bool) (string, error) {
 	return "", errors.New("not supported")
 }
+func (c *memcache) readStaging(path string, buf []byte) error {
+	return errors.New("not supported")
+}
 func (c *memcache) uploaded(key string, size int)  {}
 func (c *memcache) scanStaging() map[string]string { return nil }
+func (c *memcache) usable(key string) bool         { return true }
+func (c *memcache) ioFailed(key string, err error) {}
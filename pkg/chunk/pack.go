@@ -0,0 +1,203 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package chunk
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/object"
+)
+
+// PackIndex keeps the location of small blocks which are packed into shared objects.
+type PackIndex interface {
+	AddPack(pack uint64, chunks []uint64, offsets []uint32) error
+	LookupPack(chunkid uint64) (pack uint64, off, size uint32, err error)
+	RemovePack(chunkid uint64) (pack uint64, left int64, err error)
+}
+
+const (
+	packLimit = 4 << 20               // max size of a pack
+	packDelay = time.Millisecond * 10 // time to wait for more blocks
+)
+
+type packedBlock struct {
+	chunkid uint64
+	data    []byte // compressed
+	done    chan error
+}
+
+// packer merges small blocks into shared objects, the blocks are committed
+// together to save the number of requests to object store.
+type packer struct {
+	sync.Mutex
+	store   *cachedStore
+	index   PackIndex
+	pending []*packedBlock
+	size    int
+	waiting bool
+}
+
+func newPacker(store *cachedStore, index PackIndex) *packer {
+	return &packer{store: store, index: index}
+}
+
+func packKey(pack uint64) string {
+	return fmt.Sprintf("packs/%d/%d", pack/1000/1000, pack)
+}
+
+// add puts a compressed block into a pack, it returns after the pack is persisted.
+func (p *packer) add(chunkid uint64, data []byte) error {
+	b := &packedBlock{chunkid, data, make(chan error, 1)}
+	p.Lock()
+	p.pending = append(p.pending, b)
+	p.size += len(data)
+	if p.size >= packLimit {
+		p.flush()
+	} else if !p.waiting {
+		p.waiting = true
+		go func() {
+			time.Sleep(packDelay)
+			p.Lock()
+			p.waiting = false
+			p.flush()
+			p.Unlock()
+		}()
+	}
+	p.Unlock()
+	return <-b.done
+}
+
+// protected by p
+func (p *packer) flush() {
+	if len(p.pending) == 0 {
+		return
+	}
+	blocks := p.pending
+	p.pending = nil
+	p.size = 0
+	go p.commit(blocks)
+}
+
+func (p *packer) commit(blocks []*packedBlock) {
+	var buf bytes.Buffer
+	chunks := make([]uint64, len(blocks))
+	offsets := make([]uint32, len(blocks)+1)
+	for i, b := range blocks {
+		chunks[i] = b.chunkid
+		offsets[i] = uint32(buf.Len())
+		buf.Write(b.data)
+	}
+	offsets[len(blocks)] = uint32(buf.Len())
+	pack := chunks[0] // chunk id is unique
+	key := packKey(pack)
+	var err error
+	p.store.uploads.acquire()
+	for try := 0; try < 3; try++ {
+		err = withTimeout(func() error {
+			st := time.Now()
+			err := p.store.storage.Put(key, bytes.NewReader(buf.Bytes()))
+			p.store.uploads.observe(time.Since(st), err)
+			logger.Debugf("PUT %s (%s, %.3fs)", key, err, time.Since(st).Seconds())
+			return err
+		}, p.store.conf.PutTimeout)
+		if err == nil {
+			break
+		}
+		logger.Warnf("upload pack %s: %s (try %d)", key, err, try+1)
+		time.Sleep(time.Second * time.Duration(try+1))
+	}
+	p.store.uploads.release()
+	if err == nil {
+		if err = p.index.AddPack(pack, chunks, offsets); err != nil {
+			err = fmt.Errorf("add pack %d: %s", pack, err)
+			_ = p.store.storage.Delete(key)
+		}
+	} else {
+		err = fmt.Errorf("upload pack %s: %s", key, err)
+	}
+	for _, b := range blocks {
+		b.done <- err
+	}
+}
+
+// parseBlockKey returns the id of chunk and index of block from the key of a block.
+func parseBlockKey(key string) (uint64, int) {
+	parts := strings.Split(key[strings.LastIndexByte(key, '/')+1:], "_")
+	if len(parts) != 3 {
+		return 0, -1
+	}
+	id, _ := strconv.ParseUint(parts[0], 10, 64)
+	indx, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return 0, -1
+	}
+	return id, indx
+}
+
+// location is where a block is stored in object storage.
+type location struct {
+	storage object.ObjectStorage
+	key     string
+	off     int64
+	size    int64 // -1 if the whole object is used
+	raw     bool  // not compressed
+}
+
+// get reads limit bytes at off of the block, limit is -1 to read until the end.
+func (l *location) get(off, limit int64) (io.ReadCloser, error) {
+	if limit < 0 && l.size >= 0 {
+		limit = l.size - off
+	}
+	return l.storage.Get(l.key, l.off+off, limit)
+}
+
+// shared returns whether the object is packed with other blocks, the deduplicated
+// ones are checked by DedupRefs.
+func (l *location) shared() bool {
+	return l.size >= 0
+}
+
+// locate returns the object and the range of a block in it.
+func (store *cachedStore) locate(key string) (*location, error) {
+	id, indx := parseBlockKey(key)
+	if id&ExternalChunk != 0 && store.conf.ExternalIndex != nil {
+		return store.locateExternal(key, id, indx)
+	}
+	loc := &location{storage: store.storage, key: key, size: -1}
+	if store.packer != nil && parseObjOrigSize(key) <= store.conf.PackSize && indx == 0 {
+		pack, off, size, err := store.packer.index.LookupPack(id)
+		if err != nil {
+			return nil, err
+		}
+		if pack > 0 {
+			loc.key, loc.off, loc.size = packKey(pack), int64(off), int64(size)
+			return loc, nil
+		}
+	}
+	if store.conf.DedupIndex != nil {
+		var err error
+		if loc.key, err = store.locateDedup(key, id, indx); err != nil {
+			return nil, err
+		}
+	}
+	return loc, nil
+}
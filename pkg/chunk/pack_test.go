@@ -0,0 +1,134 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package chunk
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/juicedata/juicefs/pkg/object"
+)
+
+type memPackIndex struct {
+	sync.Mutex
+	blocks map[uint64][3]uint64
+	refs   map[uint64]int64
+}
+
+func (m *memPackIndex) AddPack(pack uint64, chunks []uint64, offsets []uint32) error {
+	m.Lock()
+	defer m.Unlock()
+	for i, id := range chunks {
+		m.blocks[id] = [3]uint64{pack, uint64(offsets[i]), uint64(offsets[i+1] - offsets[i])}
+	}
+	m.refs[pack] += int64(len(chunks))
+	return nil
+}
+
+func (m *memPackIndex) LookupPack(chunkid uint64) (uint64, uint32, uint32, error) {
+	m.Lock()
+	defer m.Unlock()
+	b := m.blocks[chunkid]
+	return b[0], uint32(b[1]), uint32(b[2]), nil
+}
+
+func (m *memPackIndex) RemovePack(chunkid uint64) (uint64, int64, error) {
+	m.Lock()
+	defer m.Unlock()
+	b, ok := m.blocks[chunkid]
+	if !ok {
+		return 0, 0, nil
+	}
+	delete(m.blocks, chunkid)
+	m.refs[b[0]]--
+	return b[0], m.refs[b[0]], nil
+}
+
+func TestPackedStore(t *testing.T) {
+	mem, _ := object.CreateStorage("mem", "", "", "")
+	conf := defaultConf
+	conf.CacheSize = 0
+	conf.PackSize = 512
+	conf.PackIndex = &memPackIndex{blocks: make(map[uint64][3]uint64), refs: make(map[uint64]int64)}
+	store := NewCachedStore(mem, conf)
+
+	data := map[uint64][]byte{
+		10: bytes.Repeat([]byte("a"), 100),
+		11: bytes.Repeat([]byte("b"), 200),
+		12: bytes.Repeat([]byte("c"), 800), // too large to be packed
+	}
+	var wg sync.WaitGroup
+	for id, buf := range data {
+		wg.Add(1)
+		go func(id uint64, buf []byte) {
+			defer wg.Done()
+			w := store.NewWriter(id)
+			if _, err := w.WriteAt(buf, 0); err != nil {
+				t.Errorf("write %d: %s", id, err)
+			}
+			if err := w.Finish(len(buf)); err != nil {
+				t.Errorf("finish %d: %s", id, err)
+			}
+		}(id, buf)
+	}
+	wg.Wait()
+
+	objs, _ := mem.List("", "", 100)
+	var packs, blocks int
+	for _, o := range objs {
+		if o.Key()[:6] == "packs/" {
+			packs++
+		} else {
+			blocks++
+		}
+	}
+	if packs != 1 || blocks != 1 {
+		t.Fatalf("expect 1 pack and 1 block, but got %d packs and %d blocks", packs, blocks)
+	}
+
+	for id, buf := range data {
+		p := NewPage(make([]byte, len(buf)))
+		if n, err := store.NewReader(id, len(buf)).ReadAt(context.Background(), p, 0); err != nil || n != len(buf) {
+			t.Fatalf("read %d: %d %s", id, n, err)
+		}
+		if !bytes.Equal(p.Data, buf) {
+			t.Fatalf("read %d: unexpected data", id)
+		}
+	}
+
+	for id, buf := range data {
+		if err := store.Remove(id, len(buf)); err != nil {
+			t.Fatalf("remove %d: %s", id, err)
+		}
+	}
+	if objs, _ := mem.List("", "", 100); len(objs) != 0 {
+		t.Fatalf("all objects should be removed, but got %d", len(objs))
+	}
+}
+
+func TestObjectKeys(t *testing.T) {
+	index := &memPackIndex{blocks: make(map[uint64][3]uint64), refs: make(map[uint64]int64)}
+	_ = index.AddPack(30, []uint64{30}, []uint32{0, 100})
+	conf := Config{BlockSize: 1024, PackSize: 512, PackIndex: index}
+	if keys, err := ObjectKeys(&conf, 30, 100); err != nil || len(keys) != 1 || keys[0] != "packs/0/30" {
+		t.Fatalf("keys of packed chunk: %v %s", keys, err)
+	}
+	if keys, err := ObjectKeys(&conf, 31, 1500); err != nil || len(keys) != 2 || keys[1] != "chunks/0/0/31_1_476" {
+		t.Fatalf("keys of chunk: %v %s", keys, err)
+	}
+}
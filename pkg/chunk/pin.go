@@ -0,0 +1,183 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package chunk
+
+import (
+	"errors"
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/qos"
+)
+
+var (
+	// ErrPinDisabled is returned when pinning blocks in a client without disk cache or pinned size.
+	ErrPinDisabled = errors.New("pinning is disabled")
+	// ErrPinFull is returned when the pinned blocks would exceed the pinned size.
+	ErrPinFull = errors.New("no space for pinned blocks")
+)
+
+// PinStats is the statistics of the pinned blocks in cache.
+type PinStats struct {
+	Blocks int64
+	Bytes  int64
+	Limit  int64
+}
+
+func pinnedSize(key string) int64 {
+	return int64(parseObjOrigSize(key) + 4096)
+}
+
+// pin marks the block as not evictable, and writes the page into cache if it's not cached.
+func (cache *cacheStore) pin(key string, p *Page) error {
+	if cache.capacity == 0 || cache.pinLimit == 0 {
+		return ErrPinDisabled
+	}
+	cache.Lock()
+	if !cache.pinned[key] {
+		if cache.pinnedUsed+pinnedSize(key) > cache.pinLimit {
+			cache.Unlock()
+			return ErrPinFull
+		}
+		cache.pinned[key] = true
+		cache.pinnedUsed += pinnedSize(key)
+		cache.changed = true
+	}
+	cached := cache.keys[key].atime > 0
+	cache.Unlock()
+	if p == nil || cached {
+		return nil
+	}
+	if err := cache.flushPage(cache.cachePath(key), p.Data, false); err != nil {
+		return err
+	}
+	cache.add(key, int32(len(p.Data)), uint32(time.Now().Unix()))
+	return nil
+}
+
+// locked
+func (cache *cacheStore) unpinLocked(key string) bool {
+	if !cache.pinned[key] {
+		return false
+	}
+	delete(cache.pinned, key)
+	cache.pinnedUsed -= pinnedSize(key)
+	cache.changed = true
+	return true
+}
+
+func (cache *cacheStore) unpin(key string) bool {
+	cache.Lock()
+	defer cache.Unlock()
+	return cache.unpinLocked(key)
+}
+
+func (cache *cacheStore) pinStats() PinStats {
+	cache.Lock()
+	defer cache.Unlock()
+	return PinStats{int64(len(cache.pinned)), cache.pinnedUsed, cache.pinLimit}
+}
+
+func (m *cacheManager) pin(key string, p *Page) error {
+	s := m.getStore(key)
+	if s == nil {
+		return ErrPinDisabled
+	}
+	return s.pin(key, p)
+}
+
+func (m *cacheManager) unpin(key string) bool {
+	s := m.getStore(key)
+	if s == nil {
+		return false
+	}
+	return s.unpin(key)
+}
+
+func (m *cacheManager) pinStats() PinStats {
+	var st PinStats
+	for _, s := range m.stores {
+		ps := s.pinStats()
+		st.Blocks += ps.Blocks
+		st.Bytes += ps.Bytes
+		st.Limit += ps.Limit
+	}
+	return st
+}
+
+func (c *memcache) pin(key string, p *Page) error { return ErrPinDisabled }
+func (c *memcache) unpin(key string) bool         { return false }
+func (c *memcache) pinStats() PinStats            { return PinStats{} }
+
+func (store *cachedStore) blocks(chunkid uint64, length int, off, size int) (*rChunk, int, int) {
+	c := chunkForRead(chunkid, length, store)
+	if off+size > length {
+		size = length - off
+	}
+	if size <= 0 {
+		return c, 0, -1
+	}
+	return c, c.index(off), c.index(off + size - 1)
+}
+
+// Pin keeps the blocks of a slice which cover [off, off+size) in cache, the ones not
+// cached are downloaded. It returns the number of blocks pinned before any error.
+func (store *cachedStore) Pin(chunkid uint64, length int, off, size int) (int, error) {
+	c, first, last := store.blocks(chunkid, length, off, size)
+	var n int
+	for indx := first; indx <= last; indx++ {
+		key := c.key(indx)
+		if err := store.bcache.pin(key, nil); err != nil {
+			return n, err
+		}
+		if r, err := store.bcache.load(key); err == nil {
+			r.Close()
+			n++
+			continue
+		}
+		p := NewOffPage(c.blockSize(indx))
+		err := store.load(key, p, false, qos.Prefetch)
+		if err == nil {
+			err = store.bcache.pin(key, p)
+		}
+		p.Release()
+		if err != nil {
+			store.bcache.unpin(key)
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// Unpin makes the blocks of a slice which cover [off, off+size) evictable again, it
+// returns the number of blocks which were pinned.
+func (store *cachedStore) Unpin(chunkid uint64, length int, off, size int) int {
+	c, first, last := store.blocks(chunkid, length, off, size)
+	var n int
+	for indx := first; indx <= last; indx++ {
+		if store.bcache.unpin(c.key(indx)) {
+			n++
+		}
+	}
+	return n
+}
+
+// PinStats returns the statistics of the pinned blocks.
+func (store *cachedStore) PinStats() PinStats {
+	return store.bcache.pinStats()
+}
+
+var _ Pinner = &cachedStore{}
@@ -0,0 +1,114 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package chunk
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/object"
+)
+
+func TestPinBlocks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pinCache")
+	if err != nil {
+		t.Fatalf("temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	blob, _ := object.CreateStorage("mem", "", "", "")
+	config := defaultConf
+	config.CacheDir = dir
+	config.PinSize = 1
+	store := NewCachedStore(blob, config)
+	w := store.NewWriter(1)
+	if _, err := w.WriteAt(make([]byte, 4096), 0); err != nil {
+		t.Fatalf("write: %s", err)
+	}
+	if err := w.Finish(4096); err != nil {
+		t.Fatalf("finish: %s", err)
+	}
+
+	pinner := store.(Pinner)
+	if n, err := pinner.Pin(1, 4096, 1000, 2000); err != nil || n != 3 {
+		t.Fatalf("pin: %d %v", n, err)
+	}
+	if st := pinner.PinStats(); st.Blocks != 3 || st.Bytes != 3*(1024+4096) || st.Limit != 1<<20 {
+		t.Fatalf("pin stats: %+v", st)
+	}
+	for i := 1; i < 4; i++ {
+		_ = blob.Delete(fmt.Sprintf("chunks/0/0/1_%d_1024", i))
+	}
+	p := NewPage(make([]byte, 2000))
+	if n, err := store.NewReader(1, 4096).ReadAt(context.Background(), p, 1000); err != nil || n != 2000 {
+		t.Fatalf("read pinned blocks: %d %v", n, err)
+	}
+	if n := pinner.Unpin(1, 4096, 0, 4096); n != 3 {
+		t.Fatalf("unpin: %d", n)
+	}
+	if st := pinner.PinStats(); st.Blocks != 0 || st.Bytes != 0 {
+		t.Fatalf("pin stats: %+v", st)
+	}
+
+	config.CacheDir = "memory"
+	if _, err := NewCachedStore(blob, config).(Pinner).Pin(1, 4096, 0, 4096); err != ErrPinDisabled {
+		t.Fatalf("pin in memory cache: %v", err)
+	}
+}
+
+func TestPinnedNotEvicted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pinCache")
+	if err != nil {
+		t.Fatalf("temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	conf := defaultConf
+	s := newCacheStore(dir+"/", 4*(1024+4096), 0, 2*(1024+4096), 1<<10, 1, &conf)
+	waitScanned(t, s)
+	page := NewPage(make([]byte, 1024))
+	for i := 0; i < 3; i++ {
+		if err := s.pin(fmt.Sprintf("chunks/0/0/1_%d_1024", i), page); i < 2 && err != nil || i == 2 && err != ErrPinFull {
+			t.Fatalf("pin block %d: %v", i, err)
+		}
+	}
+	now := uint32(time.Now().Unix())
+	for i := 0; i < 10; i++ {
+		s.add(fmt.Sprintf("chunks/0/0/2_%d_1024", i), 1024, now+uint32(i))
+	}
+	for i := 0; i < 2; i++ {
+		if r, err := s.load(fmt.Sprintf("chunks/0/0/1_%d_1024", i)); err != nil {
+			t.Fatalf("pinned block %d is evicted: %s", i, err)
+		} else {
+			r.Close()
+		}
+	}
+
+	if err := s.saveIndex(); err != nil {
+		t.Fatalf("save index: %s", err)
+	}
+	s2 := newCacheStore(dir+"/", 4*(1024+4096), 0, 2*(1024+4096), 1<<10, 1, &conf)
+	waitScanned(t, s2)
+	if st := s2.pinStats(); st.Blocks != 2 {
+		t.Fatalf("pinned blocks should be loaded from index: %+v", st)
+	}
+	s2.remove("chunks/0/0/1_0_1024")
+	if st := s2.pinStats(); st.Blocks != 1 || st.Bytes != 1024+4096 {
+		t.Fatalf("removed block should be unpinned: %+v", st)
+	}
+}
@@ -0,0 +1,128 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package chunk
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"time"
+)
+
+// quarantinePrefix is where the corrupted blocks are moved to.
+const quarantinePrefix = "quarantine/"
+
+// BlockError describes a broken block found by CheckBlock.
+type BlockError struct {
+	Key     string
+	Missing bool
+	Reason  string
+}
+
+func (e *BlockError) Error() string {
+	if e.Missing {
+		return fmt.Sprintf("block %s is missing: %s", e.Key, e.Reason)
+	}
+	return fmt.Sprintf("block %s is corrupted: %s", e.Key, e.Reason)
+}
+
+func (store *cachedStore) CheckBlock(chunkid uint64, length int, indx int) (bool, error) {
+	c := chunkForRead(chunkid, length, store)
+	key := c.key(indx)
+	loc, err := store.locate(key)
+	if err != nil {
+		return false, err
+	}
+	st := time.Now()
+	in, err := loc.get(0, -1)
+	logger.Debugf("GET %s (%s, %.3fs)", key, err, time.Since(st).Seconds())
+	if err != nil {
+		// the error of Get could be temporary, confirm it
+		if _, e := loc.storage.Head(loc.key); e != nil {
+			return false, &BlockError{key, true, e.Error()}
+		}
+		return false, err
+	}
+	data, err := ioutil.ReadAll(in)
+	in.Close()
+	if err != nil {
+		return false, err
+	}
+	if loc.size >= 0 && int64(len(data)) != loc.size {
+		return false, &BlockError{key, false, fmt.Sprintf("got %d bytes from %s, expect %d", len(data), loc.key, loc.size)}
+	}
+	buf := make([]byte, c.blockSize(indx))
+	n := copy(buf, data)
+	// there is no checksum of the blocks, the corruption of uncompressed ones can't be detected
+	var verified bool
+	if compressor := store.compressorOf(chunkid); !loc.raw && compressor.Name() != "Noop" {
+		n, err = compressor.Decompress(buf, data)
+		if err != nil {
+			return false, &BlockError{key, false, err.Error()}
+		}
+		verified = true
+	}
+	if n != len(buf) {
+		return false, &BlockError{key, false, fmt.Sprintf("length %d != %d", n, len(buf))}
+	}
+	return verified, nil
+}
+
+func (store *cachedStore) QuarantineBlock(chunkid uint64, length int, indx int) error {
+	c := chunkForRead(chunkid, length, store)
+	key := c.key(indx)
+	loc, err := store.locate(key)
+	if err != nil {
+		return err
+	}
+	if loc.raw {
+		return fmt.Errorf("block %s is imported from %s, which is not owned by the volume", key, loc.key)
+	}
+	if loc.shared() {
+		return fmt.Errorf("block %s is packed into %s, which is shared by others", key, loc.key)
+	}
+	var dedup bool
+	if store.conf.DedupIndex != nil {
+		owner, refs, err := store.conf.DedupIndex.DedupRefs(chunkid, indx)
+		if err != nil {
+			return err
+		}
+		if refs > 1 {
+			return fmt.Errorf("block %s is stored in %s, which is shared by %d blocks", key, owner, refs)
+		}
+		dedup = refs == 1
+	}
+	in, err := loc.storage.Get(loc.key, 0, -1)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadAll(in)
+	in.Close()
+	if err != nil {
+		return err
+	}
+	if err = loc.storage.Put(quarantinePrefix+loc.key, bytes.NewReader(data)); err != nil {
+		return err
+	}
+	err = loc.storage.Delete(loc.key)
+	logger.Infof("quarantine block %s (%s): %v", key, loc.key, err)
+	if err == nil && dedup {
+		// new blocks with the same content should not refer to it any more
+		store.dedups.remove(chunkid, indx)
+		_, _, err = store.conf.DedupIndex.RemoveDedup(chunkid, indx)
+	}
+	return err
+}
@@ -0,0 +1,140 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package chunk
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/juicedata/juicefs/pkg/object"
+)
+
+func TestCheckBlock(t *testing.T) {
+	mem, _ := object.CreateStorage("mem", "", "", "")
+	conf := defaultConf
+	conf.CacheSize = 0
+	conf.Compress = "lz4"
+	store := NewCachedStore(mem, conf)
+	checker := store.(BlockChecker)
+
+	w := store.NewWriter(20)
+	if _, err := w.WriteAt(bytes.Repeat([]byte("x"), 1500), 0); err != nil {
+		t.Fatalf("write: %s", err)
+	}
+	if err := w.Finish(1500); err != nil {
+		t.Fatalf("finish: %s", err)
+	}
+	for i := 0; i < 2; i++ {
+		if verified, err := checker.CheckBlock(20, 1500, i); err != nil || !verified {
+			t.Fatalf("check block %d: %v %s", i, verified, err)
+		}
+	}
+
+	key := "chunks/0/0/20_1_476"
+	_ = mem.Delete(key)
+	_ = mem.Put(key, bytes.NewReader([]byte("garbage")))
+	if e, ok := checkBlockError(checker, 20, 1500, 1); !ok || e.Missing {
+		t.Fatalf("block should be corrupted: %v", e)
+	}
+	if err := checker.QuarantineBlock(20, 1500, 1); err != nil {
+		t.Fatalf("quarantine: %s", err)
+	}
+	if _, err := mem.Head(quarantinePrefix + key); err != nil {
+		t.Fatalf("block is not quarantined: %s", err)
+	}
+	if e, ok := checkBlockError(checker, 20, 1500, 1); !ok || !e.Missing {
+		t.Fatalf("block should be missing: %v", e)
+	}
+}
+
+func checkBlockError(checker BlockChecker, chunkid uint64, length, indx int) (*BlockError, bool) {
+	_, err := checker.CheckBlock(chunkid, length, indx)
+	e, ok := err.(*BlockError)
+	return e, ok
+}
+
+func TestCheckUncompressedBlock(t *testing.T) {
+	mem, _ := object.CreateStorage("mem", "", "", "")
+	conf := defaultConf
+	conf.CacheSize = 0
+	store := NewCachedStore(mem, conf)
+	checker := store.(BlockChecker)
+
+	w := store.NewWriter(21)
+	if _, err := w.WriteAt(bytes.Repeat([]byte("x"), 100), 0); err != nil {
+		t.Fatalf("write: %s", err)
+	}
+	if err := w.Finish(100); err != nil {
+		t.Fatalf("finish: %s", err)
+	}
+	// the content of uncompressed blocks can't be verified
+	key := "chunks/0/0/21_0_100"
+	_ = mem.Delete(key)
+	_ = mem.Put(key, bytes.NewReader(bytes.Repeat([]byte("y"), 100)))
+	if verified, err := checker.CheckBlock(21, 100, 0); err != nil || verified {
+		t.Fatalf("only the size of uncompressed block is checked: %v %s", verified, err)
+	}
+	_ = mem.Delete(key)
+	_ = mem.Put(key, bytes.NewReader([]byte("short")))
+	if e, ok := checkBlockError(checker, 21, 100, 0); !ok || e.Missing {
+		t.Fatalf("block with wrong size should be corrupted: %v", e)
+	}
+}
+
+func TestQuarantineDedupBlock(t *testing.T) {
+	mem, _ := object.CreateStorage("mem", "", "", "")
+	conf := defaultConf
+	conf.CacheSize = 0
+	conf.Dedup = true
+	index := newMemDedupIndex()
+	conf.DedupIndex = index
+	store := NewCachedStore(mem, conf)
+	checker := store.(BlockChecker)
+
+	data := bytes.Repeat([]byte("d"), 1024)
+	for _, id := range []uint64{30, 31} {
+		w := store.NewWriter(id)
+		if _, err := w.WriteAt(data, 0); err != nil {
+			t.Fatalf("write %d: %s", id, err)
+		}
+		if err := w.Finish(len(data)); err != nil {
+			t.Fatalf("finish %d: %s", id, err)
+		}
+	}
+	owner := "chunks/0/0/30_0_1024"
+	if err := checker.QuarantineBlock(31, len(data), 0); err == nil {
+		t.Fatalf("the block shared by others should not be quarantined")
+	}
+	if _, err := mem.Head(owner); err != nil {
+		t.Fatalf("the shared block is removed: %s", err)
+	}
+
+	if err := store.Remove(30, len(data)); err != nil {
+		t.Fatalf("remove 30: %s", err)
+	}
+	if err := checker.QuarantineBlock(31, len(data), 0); err != nil {
+		t.Fatalf("quarantine: %s", err)
+	}
+	if _, err := mem.Head(quarantinePrefix + owner); err != nil {
+		t.Fatalf("the owner of block is not quarantined: %s", err)
+	}
+	if _, err := mem.Head(owner); err == nil {
+		t.Fatalf("the owner of block is not removed")
+	}
+	if key, refs, _ := index.DedupRefs(31, 0); refs != 0 {
+		t.Fatalf("the quarantined block should not be referred: %s %d", key, refs)
+	}
+}
@@ -0,0 +1,142 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package chunk
+
+// The mounts on a host can share the cache directories, every volume caches the blocks
+// in its own directory named by the UUID of it, so the same volume mounted twice shares
+// the blocks. When a shared budget is set, every mount publishes the usage of its cache
+// directory in a file under the .usage directory next to it, and evicts the blocks when
+// the usage of all the cache directories is over the budget, but it can always keep a
+// fair share. The mounts of the same volume see the same blocks, so only the largest
+// usage of them is counted.
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const usageDir = ".usage"
+
+var (
+	// procID tells the mounts sharing a cache directory apart.
+	procID = fmt.Sprintf("%08x", rand.New(rand.NewSource(time.Now().UnixNano())).Uint32())
+	// tmpSuffix makes the temporary files of the mounts sharing a cache directory different.
+	tmpSuffix = "." + procID + ".tmp"
+
+	shareInterval = time.Second * 10 // interval to publish the usage
+	shareExpire   = time.Minute      // the usage not updated for longer is ignored
+	shareRemove   = time.Hour        // the usage not updated for longer is removed
+)
+
+// usagePath returns the file to publish the usage of the cache directory by this mount.
+func (cache *cacheStore) usagePath() string {
+	dir := filepath.Clean(cache.dir)
+	return filepath.Join(filepath.Dir(dir), usageDir, filepath.Base(dir)+"."+procID)
+}
+
+// quota returns the max bytes of cached blocks, it's locked.
+func (cache *cacheStore) quota() int64 {
+	if cache.shared <= 0 {
+		return cache.capacity
+	}
+	q := cache.shared - cache.others
+	if fair := cache.shared / int64(cache.peers+1); q < fair {
+		q = fair
+	}
+	if q > cache.capacity {
+		q = cache.capacity
+	}
+	return q
+}
+
+func (cache *cacheStore) publishUsage() {
+	cache.Lock()
+	used := cache.used
+	cache.Unlock()
+	path := cache.usagePath()
+	cache.createDir(filepath.Dir(path))
+	tmp := path + tmpSuffix
+	if err := ioutil.WriteFile(tmp, []byte(strconv.FormatInt(used, 10)), cache.mode); err != nil {
+		logger.Warnf("write usage into %s: %s", tmp, err)
+		return
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		logger.Warnf("rename %s to %s: %s", tmp, path, err)
+		_ = os.Remove(tmp)
+	}
+}
+
+// peerUsage returns the bytes used by the other cache directories sharing the budget
+// and the number of them.
+func (cache *cacheStore) peerUsage() (used int64, n int) {
+	dir := filepath.Join(filepath.Dir(filepath.Clean(cache.dir)), usageDir)
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		logger.Warnf("read usage of shared cache: %s", err)
+		return
+	}
+	own := filepath.Base(filepath.Clean(cache.dir))
+	peers := make(map[string]int64)
+	for _, fi := range fis {
+		name := fi.Name()
+		if strings.HasSuffix(name, ".tmp") {
+			continue
+		}
+		if age := time.Since(fi.ModTime()); age > shareRemove {
+			_ = os.Remove(filepath.Join(dir, name))
+			continue
+		} else if age > shareExpire {
+			continue
+		}
+		p := strings.LastIndex(name, ".")
+		if p <= 0 || name[:p] == own {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			continue
+		}
+		if u, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64); err == nil && u >= peers[name[:p]] {
+			peers[name[:p]] = u
+		}
+	}
+	for _, u := range peers {
+		used += u
+	}
+	return used, len(peers)
+}
+
+func (cache *cacheStore) shareUsage() {
+	for {
+		// the parent of a daemon exits soon, it should not publish
+		time.Sleep(shareInterval)
+		cache.publishUsage()
+		others, n := cache.peerUsage()
+		cache.Lock()
+		cache.others, cache.peers = others, n
+		if cache.used > cache.quota() {
+			logger.Debugf("cache %s uses %d MB, others use %d MB of shared %d MB", cache.dir, cache.used>>20, others>>20, cache.shared>>20)
+			cache.cleanup()
+		}
+		cache.Unlock()
+	}
+}
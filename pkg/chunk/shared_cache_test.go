@@ -0,0 +1,81 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package chunk
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSharedCache(t *testing.T) {
+	root, err := ioutil.TempDir("", "sharedCache")
+	if err != nil {
+		t.Fatalf("temp dir: %s", err)
+	}
+	defer os.RemoveAll(root)
+	conf := defaultConf
+	s := newCacheStore(filepath.Join(root, "vol1")+"/", 1<<30, 1<<20, 0, 1<<10, 1, &conf)
+	waitScanned(t, s)
+
+	s.publishUsage()
+	if data, err := ioutil.ReadFile(filepath.Join(root, usageDir, "vol1."+procID)); err != nil || string(data) != "0" {
+		t.Fatalf("published usage: %q %v", data, err)
+	}
+	if used, n := s.peerUsage(); used != 0 || n != 0 {
+		t.Fatalf("usage of peers: %d %d", used, n)
+	}
+	write := func(name, usage string, age time.Duration) {
+		path := filepath.Join(root, usageDir, name)
+		_ = ioutil.WriteFile(path, []byte(usage), 0600)
+		mtime := time.Now().Add(-age)
+		_ = os.Chtimes(path, mtime, mtime)
+	}
+	write("vol1.another", "1000", 0)
+	write("vol2.a", "819200", 0)
+	write("vol2.b", "409600", 0)
+	write("vol3.a", "819200", shareExpire*2)
+	write("vol4.a", "819200", shareRemove*2)
+	used, n := s.peerUsage()
+	if used != 819200 || n != 1 {
+		t.Fatalf("usage of peers: %d %d", used, n)
+	}
+	if _, err := os.Stat(filepath.Join(root, usageDir, "vol4.a")); !os.IsNotExist(err) {
+		t.Fatalf("expired usage should be removed: %v", err)
+	}
+
+	s.Lock()
+	s.others, s.peers = used, n
+	if q := s.quota(); q != 1<<19 {
+		t.Fatalf("quota should be the fair share, but got %d", q)
+	}
+	s.others = 1 << 18
+	if q := s.quota(); q != 3<<18 {
+		t.Fatalf("quota should be the rest of shared budget, but got %d", q)
+	}
+	s.Unlock()
+	for i := 0; i < 10; i++ {
+		s.add(fmt.Sprintf("chunks/0/0/%d_0_102400", i), 102400-4096, uint32(time.Now().Unix())+uint32(i))
+	}
+	s.Lock()
+	defer s.Unlock()
+	if s.used > s.quota() || len(s.keys) == 10 {
+		t.Fatalf("cache should be cleaned up: %d blocks (%d bytes)", len(s.keys), s.used)
+	}
+}
@@ -0,0 +1,139 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package chunk
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	minUploads     = 2
+	maxUploads     = 256
+	initUploads    = 20
+	minWindow      = 20               // min number of PUTs to adjust the limit
+	baselineExpire = time.Minute * 10 // interval to forget the baseline latency
+)
+
+// uploadLimiter limits the number of concurrent uploads. If it's not fixed, the
+// limit is tuned by AIMD with the observed latency of PUT: it grows by one after a
+// window of PUTs if the limit is reached and the p99 latency is healthy, and halves
+// if the p99 latency is over 4 times of the baseline (the lowest median seen
+// recently) or any PUT failed, for example, throttled by the object storage.
+type uploadLimiter struct {
+	sync.Mutex
+	cond    *sync.Cond
+	fixed   bool
+	limit   int
+	running int
+
+	limited  bool // the limit is reached in current window
+	failed   int
+	samples  []time.Duration
+	baseline time.Duration
+	baseAt   time.Time
+}
+
+// newUploadLimiter returns a limiter with fixed limit, or tuned automatically if limit is 0.
+func newUploadLimiter(limit int) *uploadLimiter {
+	l := &uploadLimiter{fixed: limit > 0, limit: limit}
+	if limit <= 0 {
+		l.limit = initUploads
+	}
+	l.cond = sync.NewCond(l)
+	return l
+}
+
+func (l *uploadLimiter) acquire() {
+	l.Lock()
+	defer l.Unlock()
+	for l.running >= l.limit {
+		l.limited = true
+		l.cond.Wait()
+	}
+	l.running++
+}
+
+func (l *uploadLimiter) tryAcquire() bool {
+	l.Lock()
+	defer l.Unlock()
+	if l.running >= l.limit {
+		l.limited = true
+		return false
+	}
+	l.running++
+	return true
+}
+
+func (l *uploadLimiter) release() {
+	l.Lock()
+	l.running--
+	l.Unlock()
+	l.cond.Signal()
+}
+
+// current returns the current limit.
+func (l *uploadLimiter) current() int {
+	l.Lock()
+	defer l.Unlock()
+	return l.limit
+}
+
+// observe records the latency of a PUT, and adjusts the limit after a window.
+func (l *uploadLimiter) observe(used time.Duration, err error) {
+	if l.fixed {
+		return
+	}
+	l.Lock()
+	defer l.Unlock()
+	if err != nil {
+		l.failed++
+	} else {
+		l.samples = append(l.samples, used)
+	}
+	if n := len(l.samples) + l.failed; n < minWindow || n < l.limit {
+		return
+	}
+	old := l.limit
+	if len(l.samples) > 0 {
+		sort.Slice(l.samples, func(i, j int) bool { return l.samples[i] < l.samples[j] })
+		median := l.samples[len(l.samples)/2]
+		p99 := l.samples[len(l.samples)*99/100]
+		if l.baseline == 0 || median < l.baseline || time.Since(l.baseAt) > baselineExpire {
+			l.baseline, l.baseAt = median, time.Now()
+		}
+		if l.failed > 0 || p99 > l.baseline*4 {
+			l.limit /= 2
+		} else if l.limited {
+			l.limit++
+		}
+	} else {
+		l.limit /= 2
+	}
+	if l.limit < minUploads {
+		l.limit = minUploads
+	} else if l.limit > maxUploads {
+		l.limit = maxUploads
+	}
+	if l.limit != old {
+		logger.Debugf("concurrency of uploads: %d -> %d (failed %d, baseline %s)", old, l.limit, l.failed, l.baseline)
+	}
+	l.samples, l.failed, l.limited = l.samples[:0], 0, false
+	if l.limit > old {
+		l.cond.Broadcast()
+	}
+}
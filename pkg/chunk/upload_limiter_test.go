@@ -0,0 +1,86 @@
+/*
+ * JuiceFS, Copyright (C) 2020 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package chunk
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestUploadLimiter(t *testing.T) {
+	l := newUploadLimiter(0)
+	if l.current() != initUploads {
+		t.Fatalf("initial limit: %d", l.current())
+	}
+	window := func(used time.Duration, limited bool) {
+		if limited {
+			for l.tryAcquire() {
+			}
+			for i := 0; i < l.current(); i++ {
+				l.release()
+			}
+		}
+		for i := l.current(); i > 0; i-- {
+			l.observe(used, nil)
+		}
+	}
+	window(time.Millisecond*10, true)
+	if l.current() != initUploads+1 {
+		t.Fatalf("limit should grow with healthy latency: %d", l.current())
+	}
+	window(time.Millisecond*10, false)
+	if l.current() != initUploads+1 {
+		t.Fatalf("limit should not grow if it's not reached: %d", l.current())
+	}
+	window(time.Millisecond*100, true)
+	if l.current() != (initUploads+1)/2 {
+		t.Fatalf("limit should halve with high latency: %d", l.current())
+	}
+	for l.current() > minUploads {
+		for i := 0; i < minWindow; i++ {
+			l.observe(time.Millisecond*10, errors.New("throttled"))
+		}
+	}
+	if l.current() != minUploads {
+		t.Fatalf("limit should not be lower than %d: %d", minUploads, l.current())
+	}
+
+	l = newUploadLimiter(3)
+	for i := 0; i < 3; i++ {
+		l.acquire()
+	}
+	if l.tryAcquire() {
+		t.Fatalf("limit 3 should be reached")
+	}
+	for i := 0; i < 100; i++ {
+		l.observe(time.Second, errors.New("throttled"))
+	}
+	if l.current() != 3 {
+		t.Fatalf("fixed limit should not change: %d", l.current())
+	}
+	done := make(chan bool)
+	go func() {
+		l.acquire()
+		done <- true
+	}()
+	l.release()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("acquire should succeed after release")
+	}
+}
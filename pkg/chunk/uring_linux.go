@@ -0,0 +1,350 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package chunk
+
+import (
+	"io"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	uringOpReadv  = 1
+	uringOpWritev = 2
+	uringOpFsync  = 3
+
+	uringRegisterEventFd = 4
+
+	uringOffSQRing = 0
+	uringOffCQRing = 0x8000000
+	uringOffSQEs   = 0x10000000
+)
+
+// the layout of struct io_uring_params
+type uringParams struct {
+	sqEntries    uint32
+	cqEntries    uint32
+	flags        uint32
+	sqThreadCPU  uint32
+	sqThreadIdle uint32
+	features     uint32
+	wqFd         uint32
+	resv         [3]uint32
+	sqOff        struct {
+		head, tail, ringMask, ringEntries, flags, dropped, array, resv1 uint32
+		resv2                                                           uint64
+	}
+	cqOff struct {
+		head, tail, ringMask, ringEntries, overflow, cqes, flags, resv1 uint32
+		resv2                                                           uint64
+	}
+}
+
+// the layout of struct io_uring_sqe
+type uringSQE struct {
+	opcode      uint8
+	flags       uint8
+	ioprio      uint16
+	fd          int32
+	off         uint64
+	addr        uint64
+	len         uint32
+	rwFlags     uint32
+	userData    uint64
+	bufIndex    uint16
+	personality uint16
+	spliceFdIn  int32
+	pad         [2]uint64
+}
+
+// the layout of struct io_uring_cqe
+type uringCQE struct {
+	userData uint64
+	res      int32
+	flags    uint32
+}
+
+type uringReq struct {
+	op   uint8
+	fd   int
+	off  int64
+	iov  unix.Iovec
+	res  int32
+	done chan struct{}
+}
+
+// uring submits the reads and writes of cache files through io_uring. The requests from
+// all the goroutines are queued and submitted in batch with a single io_uring_enter(), which
+// does not wait for the completions, so the new requests are not delayed by the slow ones.
+// The kernel notifies the completions through an eventfd, they are reaped in batch too,
+// so there are less syscalls than pread/pwrite when there are many concurrent requests.
+type uring struct {
+	fd      int
+	entries uint32
+	sqRing  []byte
+	cqRing  []byte
+	sqeMem  []byte
+
+	sqHead, sqTail, sqMask, sqArray *uint32
+	cqHead, cqTail, cqMask          *uint32
+	sqes, cqes                      unsafe.Pointer
+
+	events    *os.File      // eventfd signaled by the kernel for completions
+	completed chan struct{} // there are completions to reap
+
+	sync.RWMutex
+	closed   bool
+	reqs     chan *uringReq
+	inflight map[uint64]*uringReq
+	seq      uint64
+}
+
+func newURing(entries uint32) (*uring, error) {
+	var p uringParams
+	fd, _, e := syscall.Syscall(unix.SYS_IO_URING_SETUP, uintptr(entries), uintptr(unsafe.Pointer(&p)), 0)
+	if e != 0 {
+		return nil, os.NewSyscallError("io_uring_setup", e)
+	}
+	r := &uring{fd: int(fd), entries: p.sqEntries, completed: make(chan struct{}, 1), reqs: make(chan *uringReq, p.sqEntries), inflight: make(map[uint64]*uringReq)}
+	efd, err := unix.Eventfd(0, unix.EFD_CLOEXEC|unix.EFD_NONBLOCK)
+	if err != nil {
+		r.unmap()
+		return nil, os.NewSyscallError("eventfd", err)
+	}
+	r.events = os.NewFile(uintptr(efd), "io_uring-events") // non-blocking, read through the netpoller
+	if _, _, e := syscall.Syscall6(unix.SYS_IO_URING_REGISTER, fd, uringRegisterEventFd, uintptr(unsafe.Pointer(&efd)), 1, 0, 0); e != 0 {
+		r.unmap()
+		return nil, os.NewSyscallError("io_uring_register", e)
+	}
+	if r.sqRing, err = unix.Mmap(r.fd, uringOffSQRing, int(p.sqOff.array+p.sqEntries*4), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_POPULATE); err != nil {
+		r.unmap()
+		return nil, err
+	}
+	if r.cqRing, err = unix.Mmap(r.fd, uringOffCQRing, int(p.cqOff.cqes+p.cqEntries*uint32(unsafe.Sizeof(uringCQE{}))), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_POPULATE); err != nil {
+		r.unmap()
+		return nil, err
+	}
+	if r.sqeMem, err = unix.Mmap(r.fd, uringOffSQEs, int(p.sqEntries*uint32(unsafe.Sizeof(uringSQE{}))), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_POPULATE); err != nil {
+		r.unmap()
+		return nil, err
+	}
+	sq := unsafe.Pointer(&r.sqRing[0])
+	r.sqHead = (*uint32)(unsafe.Pointer(uintptr(sq) + uintptr(p.sqOff.head)))
+	r.sqTail = (*uint32)(unsafe.Pointer(uintptr(sq) + uintptr(p.sqOff.tail)))
+	r.sqMask = (*uint32)(unsafe.Pointer(uintptr(sq) + uintptr(p.sqOff.ringMask)))
+	r.sqArray = (*uint32)(unsafe.Pointer(uintptr(sq) + uintptr(p.sqOff.array)))
+	cq := unsafe.Pointer(&r.cqRing[0])
+	r.cqHead = (*uint32)(unsafe.Pointer(uintptr(cq) + uintptr(p.cqOff.head)))
+	r.cqTail = (*uint32)(unsafe.Pointer(uintptr(cq) + uintptr(p.cqOff.tail)))
+	r.cqMask = (*uint32)(unsafe.Pointer(uintptr(cq) + uintptr(p.cqOff.ringMask)))
+	r.cqes = unsafe.Pointer(uintptr(cq) + uintptr(p.cqOff.cqes))
+	r.sqes = unsafe.Pointer(&r.sqeMem[0])
+	go r.notify()
+	go r.run()
+	return r, nil
+}
+
+func (r *uring) unmap() {
+	for _, m := range [][]byte{r.sqRing, r.cqRing, r.sqeMem} {
+		if m != nil {
+			_ = unix.Munmap(m)
+		}
+	}
+	if r.events != nil {
+		_ = r.events.Close()
+	}
+	_ = unix.Close(r.fd)
+}
+
+// close stops accepting new requests, the ring is released after the queued ones are completed.
+func (r *uring) close() {
+	r.Lock()
+	defer r.Unlock()
+	if !r.closed {
+		r.closed = true
+		close(r.reqs)
+	}
+}
+
+// notify turns the signals of the eventfd into completed, until it's closed.
+func (r *uring) notify() {
+	var buf [8]byte
+	for {
+		if _, err := r.events.Read(buf[:]); err != nil {
+			return
+		}
+		select {
+		case r.completed <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (r *uring) run() {
+	defer r.unmap()
+	reqs := r.reqs
+	for reqs != nil || len(r.inflight) > 0 {
+		in := reqs
+		if uint32(len(r.inflight)) >= r.entries {
+			in = nil // wait for the completions
+		}
+		select {
+		case req, ok := <-in:
+			if !ok {
+				reqs = nil
+				continue
+			}
+			r.push(req)
+			for uint32(len(r.inflight)) < r.entries && len(reqs) > 0 {
+				r.push(<-reqs)
+			}
+			r.submit()
+		case <-r.completed:
+			r.reap()
+		}
+	}
+}
+
+// push puts a request into the submission queue, which should have a free entry.
+func (r *uring) push(req *uringReq) {
+	r.seq++
+	r.inflight[r.seq] = req
+	tail := atomic.LoadUint32(r.sqTail)
+	idx := tail & *r.sqMask
+	sqe := (*uringSQE)(unsafe.Pointer(uintptr(r.sqes) + uintptr(idx)*unsafe.Sizeof(uringSQE{})))
+	*sqe = uringSQE{opcode: req.op, fd: int32(req.fd), off: uint64(req.off), userData: r.seq}
+	if req.op != uringOpFsync {
+		sqe.addr = uint64(uintptr(unsafe.Pointer(&req.iov)))
+		sqe.len = 1
+	}
+	*(*uint32)(unsafe.Pointer(uintptr(unsafe.Pointer(r.sqArray)) + uintptr(idx)*4)) = idx
+	atomic.StoreUint32(r.sqTail, tail+1)
+}
+
+// submit submits all the queued requests without waiting for the completions.
+func (r *uring) submit() {
+	for {
+		toSubmit := atomic.LoadUint32(r.sqTail) - atomic.LoadUint32(r.sqHead)
+		_, _, e := syscall.Syscall6(unix.SYS_IO_URING_ENTER, uintptr(r.fd), uintptr(toSubmit), 0, 0, 0, 0)
+		switch e {
+		case 0:
+			return
+		case syscall.EINTR, syscall.EAGAIN, syscall.EBUSY:
+			continue
+		default:
+			// fail all the requests not submitted, the submitted ones will be completed later
+			logger.Errorf("io_uring_enter: %s", e)
+			head := atomic.LoadUint32(r.sqHead)
+			for tail := atomic.LoadUint32(r.sqTail); tail != head; tail-- {
+				idx := (tail - 1) & *r.sqMask
+				sqe := (*uringSQE)(unsafe.Pointer(uintptr(r.sqes) + uintptr(idx)*unsafe.Sizeof(uringSQE{})))
+				r.complete(sqe.userData, -int32(e))
+			}
+			atomic.StoreUint32(r.sqTail, head)
+			return
+		}
+	}
+}
+
+func (r *uring) reap() {
+	head := atomic.LoadUint32(r.cqHead)
+	tail := atomic.LoadUint32(r.cqTail)
+	for ; head != tail; head++ {
+		cqe := (*uringCQE)(unsafe.Pointer(uintptr(r.cqes) + uintptr(head&*r.cqMask)*unsafe.Sizeof(uringCQE{})))
+		r.complete(cqe.userData, cqe.res)
+	}
+	atomic.StoreUint32(r.cqHead, head)
+}
+
+func (r *uring) complete(id uint64, res int32) {
+	if req, ok := r.inflight[id]; ok {
+		delete(r.inflight, id)
+		req.res = res
+		close(req.done)
+	}
+}
+
+func (r *uring) do(op uint8, f *os.File, buf []byte, off int64) (int, error) {
+	req := &uringReq{op: op, fd: int(f.Fd()), off: off, done: make(chan struct{})}
+	if len(buf) > 0 {
+		req.iov.Base = &buf[0]
+		req.iov.SetLen(len(buf))
+	}
+	r.RLock()
+	if r.closed {
+		r.RUnlock()
+		return 0, os.ErrClosed
+	}
+	r.reqs <- req
+	r.RUnlock()
+	<-req.done
+	// f and buf are used by the kernel until the completion
+	runtime.KeepAlive(f)
+	runtime.KeepAlive(buf)
+	if req.res < 0 {
+		return 0, syscall.Errno(-req.res)
+	}
+	return int(req.res), nil
+}
+
+func (r *uring) pread(f *os.File, buf []byte, off int64) (int, error) {
+	var got int
+	for got < len(buf) {
+		n, err := r.do(uringOpReadv, f, buf[got:], off+int64(got))
+		if err == syscall.EINTR || err == syscall.EAGAIN {
+			continue
+		}
+		if err != nil {
+			return got, &os.PathError{Op: "read", Path: f.Name(), Err: err}
+		}
+		if n == 0 {
+			return got, io.EOF
+		}
+		got += n
+	}
+	return got, nil
+}
+
+func (r *uring) pwrite(f *os.File, buf []byte, off int64) (int, error) {
+	var done int
+	for done < len(buf) {
+		n, err := r.do(uringOpWritev, f, buf[done:], off+int64(done))
+		if err == syscall.EINTR || err == syscall.EAGAIN {
+			continue
+		}
+		if err != nil {
+			return done, &os.PathError{Op: "write", Path: f.Name(), Err: err}
+		}
+		if n == 0 {
+			return done, io.ErrShortWrite
+		}
+		done += n
+	}
+	return done, nil
+}
+
+func (r *uring) fsync(f *os.File) error {
+	if _, err := r.do(uringOpFsync, f, nil, 0); err != nil {
+		return &os.PathError{Op: "sync", Path: f.Name(), Err: err}
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package chunk
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestURing(t *testing.T) {
+	r, err := newURing(8)
+	if err != nil {
+		t.Skipf("io_uring is not available: %s", err)
+	}
+	var p [2]int
+	if err := syscall.Pipe(p[:]); err != nil {
+		t.Fatalf("pipe: %s", err)
+	}
+	pr, pw := os.NewFile(uintptr(p[0]), "pipe-r"), os.NewFile(uintptr(p[1]), "pipe-w")
+	defer pr.Close()
+	defer pw.Close()
+
+	// a read from an empty pipe never completes until it's written
+	pending := make(chan error, 1)
+	go func() {
+		_, err := r.pread(pr, make([]byte, 1), 0)
+		pending <- err
+	}()
+	time.Sleep(time.Millisecond * 100)
+
+	f, err := os.CreateTemp("", "uring")
+	if err != nil {
+		t.Fatalf("create: %s", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		data := []byte("hello io_uring")
+		if _, err := r.pwrite(f, data, 0); err != nil {
+			t.Errorf("pwrite: %s", err)
+		}
+		buf := make([]byte, len(data))
+		if n, err := r.pread(f, buf, 0); err != nil || !bytes.Equal(buf[:n], data) {
+			t.Errorf("pread: %q %v", buf[:n], err)
+		}
+		if err := r.fsync(f); err != nil {
+			t.Errorf("fsync: %s", err)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second * 5):
+		t.Fatalf("requests are blocked by the pending one")
+	}
+
+	r.close()
+	if _, err := pw.Write([]byte{1}); err != nil {
+		t.Fatalf("write pipe: %s", err)
+	}
+	select {
+	case err := <-pending:
+		if err != nil {
+			t.Fatalf("read pipe: %s", err)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatalf("the pending read is not completed after close")
+	}
+	if _, err := r.pread(f, make([]byte, 1), 0); !errors.Is(err, os.ErrClosed) {
+		t.Fatalf("pread after close: %v", err)
+	}
+}
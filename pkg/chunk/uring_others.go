@@ -0,0 +1,44 @@
+// +build !linux
+
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package chunk
+
+import (
+	"errors"
+	"os"
+)
+
+// io_uring is available only on Linux.
+type uring struct{}
+
+func newURing(entries uint32) (*uring, error) {
+	return nil, errors.New("io_uring is not supported on this platform")
+}
+
+func (r *uring) close() {}
+
+func (r *uring) pread(f *os.File, buf []byte, off int64) (int, error) {
+	return f.ReadAt(buf, off)
+}
+
+func (r *uring) pwrite(f *os.File, buf []byte, off int64) (int, error) {
+	return f.WriteAt(buf, off)
+}
+
+func (r *uring) fsync(f *os.File) error {
+	return f.Sync()
+}
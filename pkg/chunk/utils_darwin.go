@@ -21,6 +21,9 @@ import (
 	"time"
 )
 
+// direct I/O on macOS is done by fcntl(F_NOCACHE), which is not supported yet
+const oDirect = 0
+
 func getAtime(fi os.FileInfo) time.Time {
 	if sst, ok := fi.Sys().(*syscall.Stat_t); ok {
 		return time.Unix(sst.Atimespec.Unix())
@@ -28,3 +31,7 @@ func getAtime(fi os.FileInfo) time.Time {
 		return fi.ModTime()
 	}
 }
+
+func availBlocks(stat *syscall.Statfs_t) uint64 {
+	return stat.Bavail
+}
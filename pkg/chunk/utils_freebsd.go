@@ -0,0 +1,41 @@
+/*
+ * JuiceFS, Copyright (C) 2020 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package chunk
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+const oDirect = syscall.O_DIRECT
+
+func getAtime(fi os.FileInfo) time.Time {
+	if sst, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return time.Unix(sst.Atimespec.Unix())
+	} else {
+		return fi.ModTime()
+	}
+}
+
+// availBlocks returns the free blocks available to unprivileged users, Bavail is
+// signed on FreeBSD, it's negative when the reserved space is used.
+func availBlocks(stat *syscall.Statfs_t) uint64 {
+	if stat.Bavail < 0 {
+		return 0
+	}
+	return uint64(stat.Bavail)
+}
@@ -21,9 +21,15 @@ import (
 	"time"
 )
 
+const oDirect = syscall.O_DIRECT
+
 func getAtime(fi os.FileInfo) time.Time {
 	if sst, ok := fi.Sys().(*syscall.Stat_t); ok {
 		return time.Unix(sst.Atim.Unix())
 	}
 	return fi.ModTime()
 }
+
+func availBlocks(stat *syscall.Statfs_t) uint64 {
+	return stat.Bavail
+}
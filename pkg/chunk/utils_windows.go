@@ -23,6 +23,8 @@ import (
 	sys "golang.org/x/sys/windows"
 )
 
+const oDirect = 0
+
 func getAtime(fi os.FileInfo) time.Time {
 	stat, ok := fi.Sys().(*syscall.Win32FileAttributeData)
 	if ok {
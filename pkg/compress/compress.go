@@ -18,11 +18,12 @@ package compress
 import (
 	"fmt"
 	"strings"
-
-	"github.com/DataDog/zstd"
-	"github.com/hungys/go-lz4"
 )
 
+// The algorithms are implemented by the libraries in C (compress_cgo.go), or the ones in pure Go
+// if it's built without cgo (compress_purego.go), e.g. on RISC-V without a C toolchain. They
+// produce the same formats, so the data can be read by either of them.
+
 // ZSTD_LEVEL compression level used by Zstd
 const ZSTD_LEVEL = 1 // fastest
 
@@ -47,6 +48,15 @@ func NewCompressor(algr string) Compressor {
 	return nil
 }
 
+// NewCompressorLevel returns a Compressor with the level, which is used only by zstd,
+// 0 means the default level. The data can be decompressed by the one of any level.
+func NewCompressorLevel(algr string, level int) Compressor {
+	if level > 0 && strings.ToLower(algr) == "zstd" {
+		return ZStandard{level}
+	}
+	return NewCompressor(algr)
+}
+
 type noOp struct{}
 
 func (n noOp) Name() string            { return "Noop" }
@@ -75,11 +85,11 @@ type ZStandard struct {
 func (n ZStandard) Name() string { return "Zstd" }
 
 // CompressBound max size of compressed data
-func (n ZStandard) CompressBound(l int) int { return zstd.CompressBound(l) }
+func (n ZStandard) CompressBound(l int) int { return zstdBound(l) }
 
 // Compress using Zstd
 func (n ZStandard) Compress(dst, src []byte) (int, error) {
-	d, err := zstd.CompressLevel(dst, src, n.level)
+	d, err := zstdCompress(dst, src, n.level)
 	if err != nil {
 		return 0, err
 	}
@@ -91,7 +101,7 @@ func (n ZStandard) Compress(dst, src []byte) (int, error) {
 
 // Decompress using Zstd
 func (n ZStandard) Decompress(dst, src []byte) (int, error) {
-	d, err := zstd.Decompress(dst, src)
+	d, err := zstdDecompress(dst, src)
 	if err != nil {
 		return 0, err
 	}
@@ -108,14 +118,14 @@ type LZ4 struct{}
 func (l LZ4) Name() string { return "LZ4" }
 
 // CompressBound max size of compressed data
-func (l LZ4) CompressBound(size int) int { return lz4.CompressBound(size) }
+func (l LZ4) CompressBound(size int) int { return lz4Bound(size) }
 
 // Compress using LZ4 algorithm
 func (l LZ4) Compress(dst, src []byte) (int, error) {
-	return lz4.CompressDefault(src, dst)
+	return lz4Compress(dst, src)
 }
 
 // Decompress using LZ4 algorithm
 func (l LZ4) Decompress(dst, src []byte) (int, error) {
-	return lz4.DecompressSafe(src, dst)
+	return lz4Decompress(dst, src)
 }
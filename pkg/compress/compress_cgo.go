@@ -0,0 +1,37 @@
+// +build cgo
+
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package compress
+
+import (
+	"github.com/DataDog/zstd"
+	"github.com/hungys/go-lz4"
+)
+
+func zstdBound(l int) int { return zstd.CompressBound(l) }
+
+func zstdCompress(dst, src []byte, level int) ([]byte, error) {
+	return zstd.CompressLevel(dst, src, level)
+}
+
+func zstdDecompress(dst, src []byte) ([]byte, error) { return zstd.Decompress(dst, src) }
+
+func lz4Bound(l int) int { return lz4.CompressBound(l) }
+
+func lz4Compress(dst, src []byte) (int, error) { return lz4.CompressDefault(src, dst) }
+
+func lz4Decompress(dst, src []byte) (int, error) { return lz4.DecompressSafe(src, dst) }
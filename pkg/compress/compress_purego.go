@@ -0,0 +1,91 @@
+// +build !cgo
+
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package compress
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+)
+
+// The encoders and decoder are shared, EncodeAll and DecodeAll of them can be
+// called by GOMAXPROCS goroutines concurrently. They are not pooled, because
+// the goroutines started by them are not stopped until they are closed.
+var (
+	encoders    sync.Map // level -> *zstd.Encoder
+	decoder     *zstd.Decoder
+	decoderErr  error
+	decoderOnce sync.Once
+)
+
+// zstdBound is ZSTD_COMPRESSBOUND of libzstd.
+func zstdBound(l int) int {
+	bound := l + l>>8
+	if l < 128<<10 {
+		bound += (128<<10 - l) >> 11
+	}
+	return bound
+}
+
+func encoder(level int) (*zstd.Encoder, error) {
+	if e, ok := encoders.Load(level); ok {
+		return e.(*zstd.Encoder), nil
+	}
+	e, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)),
+		zstd.WithEncoderConcurrency(runtime.GOMAXPROCS(0)), zstd.WithEncoderCRC(false), zstd.WithZeroFrames(true))
+	if err != nil {
+		return nil, fmt.Errorf("create zstd encoder: %s", err)
+	}
+	actual, loaded := encoders.LoadOrStore(level, e)
+	if loaded {
+		_ = e.Close()
+	}
+	return actual.(*zstd.Encoder), nil
+}
+
+// zstdCompress compresses src into dst, a new slice is returned if dst is too short.
+func zstdCompress(dst, src []byte, level int) ([]byte, error) {
+	e, err := encoder(level)
+	if err != nil {
+		return nil, err
+	}
+	return e.EncodeAll(src, dst[:0]), nil
+}
+
+// zstdDecompress decompresses src into dst, a new slice is returned if dst is too short.
+func zstdDecompress(dst, src []byte) ([]byte, error) {
+	decoderOnce.Do(func() {
+		decoder, decoderErr = zstd.NewReader(nil, zstd.WithDecoderConcurrency(runtime.GOMAXPROCS(0)))
+		if decoderErr != nil {
+			decoderErr = fmt.Errorf("create zstd decoder: %s", decoderErr)
+		}
+	})
+	if decoderErr != nil {
+		return nil, decoderErr
+	}
+	return decoder.DecodeAll(src, dst[:0])
+}
+
+func lz4Bound(l int) int { return lz4.CompressBlockBound(l) }
+
+func lz4Compress(dst, src []byte) (int, error) { return lz4.CompressBlock(src, dst, nil) }
+
+func lz4Decompress(dst, src []byte) (int, error) { return lz4.UncompressBlock(src, dst) }
@@ -49,6 +49,37 @@ func TestZstd(t *testing.T) {
 	testCompress(t, NewCompressor("zstd"))
 }
 
+func TestZstdLevel(t *testing.T) {
+	testCompress(t, NewCompressorLevel("zstd", 19))
+	if c := NewCompressorLevel("lz4", 19); c.Name() != "LZ4" {
+		t.Fatalf("level of lz4: %s", c.Name())
+	}
+}
+
+// The data compressed by the libraries in C, which should be decompressed by both implementations.
+func TestCompatible(t *testing.T) {
+	src := "JuiceFS is a high-performance POSIX file system. JuiceFS is a high-performance POSIX file system."
+	cases := map[string]string{
+		"zstd": "(\xb5/\xfd a\xcd\x01\x00\x14\x03JuiceFS is a high-performance POSIX file system. \x01\x00\x11\x8d\x14\x14",
+		"lz4":  "\xff\"JuiceFS is a high-performance POSIX file system. 1\x00\x18Pstem.",
+	}
+	for name, compressed := range cases {
+		c := NewCompressor(name)
+		dst := make([]byte, len(src))
+		n, err := c.Decompress(dst, []byte(compressed))
+		if err != nil || string(dst[:n]) != src {
+			t.Fatalf("decompress %s: %q %s", name, dst[:n], err)
+		}
+		buf := make([]byte, c.CompressBound(len(src)))
+		if n, err = c.Compress(buf, []byte(src)); err != nil || n >= len(src) {
+			t.Fatalf("compress %s: %d %s", name, n, err)
+		}
+		if _, err = c.Decompress(make([]byte, 10), buf[:n]); err == nil {
+			t.Fatalf("decompress %s into a short buffer should fail", name)
+		}
+	}
+}
+
 func benchmarkDecompress(b *testing.B, comp Compressor) {
 	f, _ := os.Open(os.Getenv("PAYLOAD"))
 	var c = make([]byte, 5<<20)
@@ -123,3 +154,33 @@ func BenchmarkCompressCLZ4(b *testing.B) {
 func BenchmarkCompressNone(b *testing.B) {
 	benchmarkCompress(b, NewCompressor("none"))
 }
+
+// The blocks are compressed and decompressed by many goroutines concurrently.
+func benchmarkParallel(b *testing.B, comp Compressor) {
+	d := make([]byte, 4<<20)
+	for i := range d {
+		d[i] = byte(i/7%13) + byte(i>>16)
+	}
+	b.SetBytes(int64(len(d)))
+	b.RunParallel(func(pb *testing.PB) {
+		c := make([]byte, comp.CompressBound(len(d)))
+		out := make([]byte, len(d))
+		for pb.Next() {
+			n, err := comp.Compress(c, d)
+			if err != nil {
+				b.Fatalf("compress: %s", err)
+			}
+			if _, err = comp.Decompress(out, c[:n]); err != nil {
+				b.Fatalf("decompress: %s", err)
+			}
+		}
+	})
+}
+
+func BenchmarkParallelZstd(b *testing.B) {
+	benchmarkParallel(b, NewCompressor("zstd"))
+}
+
+func BenchmarkParallelLZ4(b *testing.B) {
+	benchmarkParallel(b, NewCompressor("lz4"))
+}
@@ -0,0 +1,191 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Package event delivers the changes of objects as S3 event notifications, so they can be
+// processed by downstream services. The events are emitted by the gateway for the requests
+// of S3 API, and by the mount points for the changes of files, in the same format as S3:
+//
+//	{"Records":[{"eventVersion":"2.1","eventSource":"juicefs:s3","eventTime":"...",
+//	  "eventName":"ObjectCreated:Put","s3":{"bucket":{"name":"myjfs"},"object":{"key":"a/b","size":5}}}]}
+//
+// A target is one of the URLs:
+//
+//	http(s)://host/path                POST the events to a webhook
+//	kafka://host:port[,host:port]/TOPIC   produce the events into a topic of Kafka
+//	redis://[:password@]host:port[/db][?stream=NAME]   add the events into a stream of Redis
+//
+// The events are sent in background with retries, they're dropped if the targets can't
+// keep up with the changes.
+package event
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/utils"
+)
+
+var logger = utils.GetLogger("juicefs")
+
+// The names of events, the same as S3.
+const (
+	ObjectCreatedPut      = "ObjectCreated:Put"
+	ObjectCreatedCopy     = "ObjectCreated:Copy"
+	ObjectCreatedComplete = "ObjectCreated:CompleteMultipartUpload"
+	ObjectRemovedDelete   = "ObjectRemoved:Delete"
+)
+
+// The sources of events.
+const (
+	SourceGateway = "juicefs:s3"
+	SourcePOSIX   = "juicefs:posix"
+)
+
+const (
+	queueSize  = 10000
+	maxRetries = 3
+)
+
+// Record is an event in the format of S3 notification.
+type Record struct {
+	EventVersion string `json:"eventVersion"`
+	EventSource  string `json:"eventSource"`
+	EventTime    string `json:"eventTime"`
+	EventName    string `json:"eventName"`
+	S3           struct {
+		SchemaVersion string `json:"s3SchemaVersion"`
+		Bucket        struct {
+			Name string `json:"name"`
+			ARN  string `json:"arn"`
+		} `json:"bucket"`
+		Object struct {
+			Key       string `json:"key"`
+			Size      int64  `json:"size,omitempty"`
+			ETag      string `json:"eTag,omitempty"`
+			Sequencer string `json:"sequencer"`
+		} `json:"object"`
+	} `json:"s3"`
+}
+
+// Target is the destination of events.
+type Target interface {
+	String() string
+	// Send delivers a message of events, key is "bucket/key" of the object.
+	Send(key string, msg []byte) error
+	Close() error
+}
+
+// NewTarget creates a target from its URL.
+func NewTarget(uri string) (Target, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, fmt.Errorf("invalid event target %s: %s", uri, err)
+	}
+	switch u.Scheme {
+	case "http", "https":
+		return newWebhook(uri), nil
+	case "kafka":
+		return newKafka(u)
+	case "redis", "rediss":
+		return newRedisStream(u)
+	default:
+		return nil, fmt.Errorf("unknown event target %s", uri)
+	}
+}
+
+// Notifier sends the events of a bucket to the targets.
+type Notifier struct {
+	bucket  string
+	source  string
+	targets []Target
+	queue   chan *Record
+	seq     uint64
+	dropped int64
+	wg      sync.WaitGroup
+}
+
+// NewNotifier creates a notifier with the URLs of targets.
+func NewNotifier(bucket, source string, uris []string) (*Notifier, error) {
+	n := &Notifier{bucket: bucket, source: source, queue: make(chan *Record, queueSize), seq: uint64(time.Now().UnixNano())}
+	for _, uri := range uris {
+		t, err := NewTarget(uri)
+		if err != nil {
+			n.closeTargets()
+			return nil, err
+		}
+		n.targets = append(n.targets, t)
+	}
+	n.wg.Add(1)
+	go n.run()
+	return n, nil
+}
+
+// Notify emits an event of the object in background.
+func (n *Notifier) Notify(name, key string, size int64, etag string) {
+	r := &Record{EventVersion: "2.1", EventSource: n.source, EventTime: time.Now().UTC().Format("2006-01-02T15:04:05.000Z"), EventName: name}
+	r.S3.SchemaVersion = "1.0"
+	r.S3.Bucket.Name = n.bucket
+	r.S3.Bucket.ARN = "arn:aws:s3:::" + n.bucket
+	r.S3.Object.Key = key
+	r.S3.Object.Size = size
+	r.S3.Object.ETag = etag
+	r.S3.Object.Sequencer = fmt.Sprintf("%016X", atomic.AddUint64(&n.seq, 1))
+	select {
+	case n.queue <- r:
+	default:
+		if atomic.AddInt64(&n.dropped, 1)%1000 == 1 {
+			logger.Warnf("Too many events, %s of %s is dropped", name, key)
+		}
+	}
+}
+
+func (n *Notifier) run() {
+	defer n.wg.Done()
+	for r := range n.queue {
+		msg, _ := json.Marshal(map[string][]*Record{"Records": {r}})
+		key := n.bucket + "/" + r.S3.Object.Key
+		for _, t := range n.targets {
+			var err error
+			for i := 0; i < maxRetries; i++ {
+				if err = t.Send(key, msg); err == nil {
+					break
+				}
+				time.Sleep(time.Second * time.Duration(i+1))
+			}
+			if err != nil {
+				logger.Warnf("Send %s of %s to %s: %s", r.EventName, r.S3.Object.Key, t, err)
+			}
+		}
+	}
+}
+
+// Close sends the pending events and closes the targets.
+func (n *Notifier) Close() {
+	close(n.queue)
+	n.wg.Wait()
+	n.closeTargets()
+}
+
+func (n *Notifier) closeTargets() {
+	for _, t := range n.targets {
+		if err := t.Close(); err != nil {
+			logger.Warnf("Close %s: %s", t, err)
+		}
+	}
+}
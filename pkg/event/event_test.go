@@ -0,0 +1,68 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package event
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestWebhook(t *testing.T) {
+	var mu sync.Mutex
+	var records []*Record
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var msg struct {
+			Records []*Record
+		}
+		if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		records = append(records, msg.Records...)
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	n, err := NewNotifier("myjfs", SourceGateway, []string{server.URL})
+	if err != nil {
+		t.Fatalf("create notifier: %s", err)
+	}
+	n.Notify(ObjectCreatedPut, "a/b", 5, "etag")
+	n.Notify(ObjectRemovedDelete, "a/b", 0, "")
+	n.Close()
+
+	if len(records) != 2 {
+		t.Fatalf("expect 2 events, but got %d", len(records))
+	}
+	r := records[0]
+	if r.EventName != ObjectCreatedPut || r.EventSource != SourceGateway || r.S3.Bucket.Name != "myjfs" ||
+		r.S3.Object.Key != "a/b" || r.S3.Object.Size != 5 || r.S3.Object.ETag != "etag" {
+		t.Fatalf("unexpected event: %+v", r)
+	}
+	if records[1].EventName != ObjectRemovedDelete || records[1].S3.Object.Sequencer <= r.S3.Object.Sequencer {
+		t.Fatalf("unexpected event: %+v", records[1])
+	}
+
+	for _, uri := range []string{"ftp://host/x", "kafka://host:9092"} {
+		if _, err := NewTarget(uri); err == nil {
+			t.Fatalf("%s should be invalid", uri)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package event
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/go-redis/redis/v8"
+)
+
+const maxStreamLen = 1000000
+
+type webhook struct {
+	url    string
+	client *http.Client
+}
+
+func newWebhook(uri string) *webhook {
+	return &webhook{uri, &http.Client{Timeout: time.Second * 10}}
+}
+
+func (w *webhook) String() string {
+	return w.url
+}
+
+func (w *webhook) Send(key string, msg []byte) error {
+	resp, err := w.client.Post(w.url, "application/json", bytes.NewReader(msg))
+	if err != nil {
+		return err
+	}
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	_ = resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("status %s", resp.Status)
+	}
+	return nil
+}
+
+func (w *webhook) Close() error {
+	return nil
+}
+
+type kafka struct {
+	uri      string
+	topic    string
+	producer sarama.SyncProducer
+}
+
+func newKafka(u *url.URL) (*kafka, error) {
+	topic := strings.Trim(u.Path, "/")
+	if u.Host == "" || topic == "" {
+		return nil, fmt.Errorf("kafka target should be kafka://host:port[,host:port]/TOPIC")
+	}
+	conf := sarama.NewConfig()
+	conf.Producer.RequiredAcks = sarama.WaitForAll
+	conf.Producer.Return.Successes = true
+	producer, err := sarama.NewSyncProducer(strings.Split(u.Host, ","), conf)
+	if err != nil {
+		return nil, fmt.Errorf("connect to kafka %s: %s", u.Host, err)
+	}
+	return &kafka{u.String(), topic, producer}, nil
+}
+
+func (k *kafka) String() string {
+	return k.uri
+}
+
+// Send produces the events of an object with its key, so they're in the same partition.
+func (k *kafka) Send(key string, msg []byte) error {
+	_, _, err := k.producer.SendMessage(&sarama.ProducerMessage{Topic: k.topic, Key: sarama.StringEncoder(key), Value: sarama.ByteEncoder(msg)})
+	return err
+}
+
+func (k *kafka) Close() error {
+	return k.producer.Close()
+}
+
+type redisStream struct {
+	addr   string
+	stream string
+	rdb    *redis.Client
+}
+
+func newRedisStream(u *url.URL) (*redisStream, error) {
+	stream := u.Query().Get("stream")
+	if stream == "" {
+		stream = "juicefs-events"
+	}
+	u.RawQuery = ""
+	opt, err := redis.ParseURL(u.String())
+	if err != nil {
+		return nil, err
+	}
+	return &redisStream{opt.Addr, stream, redis.NewClient(opt)}, nil
+}
+
+func (r *redisStream) String() string {
+	return fmt.Sprintf("redis://%s?stream=%s", r.addr, r.stream)
+}
+
+func (r *redisStream) Send(key string, msg []byte) error {
+	return r.rdb.XAdd(context.Background(), &redis.XAddArgs{
+		Stream:       r.stream,
+		MaxLenApprox: maxStreamLen,
+		Values:       map[string]interface{}{"key": key, "event": msg},
+	}).Err()
+}
+
+func (r *redisStream) Close() error {
+	return r.rdb.Close()
+}
@@ -0,0 +1,28 @@
+// +build !faultinjection
+
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package fault
+
+import "syscall"
+
+// Enabled is true if the binary is built with tag faultinjection.
+const Enabled = false
+
+// Inject does nothing without tag faultinjection.
+func Inject(op string) syscall.Errno {
+	return 0
+}
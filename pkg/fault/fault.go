@@ -0,0 +1,226 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Package fault injects faults into the operations of meta engine and object
+// storage, so the handling of failures can be reproduced and tested. It's only
+// enabled in the binary built with tag `faultinjection`.
+//
+// A rule is in the format of OP=ACTION[:ARG][,p=PROBABILITY][,n=COUNT], for example:
+//
+//	meta.lookup=error:ENOENT,p=0.1  fail 10% of the lookups with ENOENT
+//	object.get=delay:3s,n=10        delay the next 10 requests to get objects by 3 seconds
+//	object.*=drop:1m                hang all the object requests for a minute, then fail with ETIMEDOUT
+//
+// OP is the name of an operation (meta.<method> in lower case, or object.get,
+// object.put, object.delete, object.head and object.list), a trailing '*' matches
+// any operation with the prefix. The first matched rule is used for an operation.
+package fault
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	actionError = "error"
+	actionDelay = "delay"
+	actionDrop  = "drop"
+)
+
+const defaultDrop = time.Minute
+
+var errnos = map[string]syscall.Errno{
+	"EIO":       syscall.EIO,
+	"ENOENT":    syscall.ENOENT,
+	"EEXIST":    syscall.EEXIST,
+	"EACCES":    syscall.EACCES,
+	"EPERM":     syscall.EPERM,
+	"ENOSPC":    syscall.ENOSPC,
+	"EROFS":     syscall.EROFS,
+	"EAGAIN":    syscall.EAGAIN,
+	"EINTR":     syscall.EINTR,
+	"ETIMEDOUT": syscall.ETIMEDOUT,
+	"ENOTSUP":   syscall.ENOTSUP,
+}
+
+// Rule is a fault injected into the matched operations.
+type Rule struct {
+	Op          string
+	Action      string
+	Errno       syscall.Errno // for error
+	Delay       time.Duration // for delay and drop
+	Probability float64
+	Count       int64 // the number of operations left to inject, negative means unlimited
+	Hits        int64
+}
+
+func errnoName(eno syscall.Errno) string {
+	for name, e := range errnos {
+		if e == eno {
+			return name
+		}
+	}
+	return strconv.Itoa(int(eno))
+}
+
+func (r *Rule) String() string {
+	s := r.Op + "=" + r.Action
+	switch r.Action {
+	case actionError:
+		s += ":" + errnoName(r.Errno)
+	case actionDelay, actionDrop:
+		s += ":" + r.Delay.String()
+	}
+	if r.Probability < 1 {
+		s += fmt.Sprintf(",p=%g", r.Probability)
+	}
+	if r.Count >= 0 {
+		s += fmt.Sprintf(",n=%d", r.Count)
+	}
+	return s + fmt.Sprintf(" (hits: %d)", r.Hits)
+}
+
+func (r *Rule) match(op string) bool {
+	if strings.HasSuffix(r.Op, "*") {
+		return strings.HasPrefix(op, r.Op[:len(r.Op)-1])
+	}
+	return op == r.Op
+}
+
+// Parse parses a rule in the format of OP=ACTION[:ARG][,p=PROBABILITY][,n=COUNT].
+func Parse(s string) (*Rule, error) {
+	parts := strings.Split(strings.TrimSpace(s), ",")
+	p := strings.Index(parts[0], "=")
+	if p <= 0 {
+		return nil, fmt.Errorf("invalid rule %q, it should be OP=ACTION[:ARG][,p=PROBABILITY][,n=COUNT]", s)
+	}
+	r := &Rule{Op: parts[0][:p], Action: parts[0][p+1:], Probability: 1, Count: -1}
+	var arg string
+	if i := strings.Index(r.Action, ":"); i > 0 {
+		r.Action, arg = r.Action[:i], r.Action[i+1:]
+	}
+	var err error
+	switch r.Action {
+	case actionError:
+		r.Errno = syscall.EIO
+		if arg != "" {
+			var ok bool
+			if r.Errno, ok = errnos[strings.ToUpper(arg)]; !ok {
+				n, err := strconv.Atoi(arg)
+				if err != nil || n <= 0 {
+					return nil, fmt.Errorf("invalid errno %q in rule %q", arg, s)
+				}
+				r.Errno = syscall.Errno(n)
+			}
+		}
+	case actionDelay, actionDrop:
+		if arg == "" && r.Action == actionDrop {
+			r.Delay = defaultDrop
+		} else if r.Delay, err = time.ParseDuration(arg); err != nil || r.Delay < 0 {
+			return nil, fmt.Errorf("invalid duration %q in rule %q", arg, s)
+		}
+	default:
+		return nil, fmt.Errorf("unknown action %q in rule %q, it should be error, delay or drop", r.Action, s)
+	}
+	for _, opt := range parts[1:] {
+		kv := strings.SplitN(opt, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid option %q in rule %q", opt, s)
+		}
+		switch kv[0] {
+		case "p":
+			r.Probability, err = strconv.ParseFloat(kv[1], 64)
+			if err != nil || r.Probability <= 0 || r.Probability > 1 {
+				return nil, fmt.Errorf("invalid probability %q in rule %q", kv[1], s)
+			}
+		case "n":
+			r.Count, err = strconv.ParseInt(kv[1], 10, 64)
+			if err != nil || r.Count <= 0 {
+				return nil, fmt.Errorf("invalid count %q in rule %q", kv[1], s)
+			}
+		default:
+			return nil, fmt.Errorf("unknown option %q in rule %q", kv[0], s)
+		}
+	}
+	return r, nil
+}
+
+var (
+	mu    sync.Mutex
+	rules []*Rule
+)
+
+// Set replaces all the rules, they are cleared if specs is empty.
+func Set(specs []string) error {
+	var rs []*Rule
+	for _, s := range specs {
+		if strings.TrimSpace(s) == "" {
+			continue
+		}
+		r, err := Parse(s)
+		if err != nil {
+			return err
+		}
+		rs = append(rs, r)
+	}
+	mu.Lock()
+	rules = rs
+	mu.Unlock()
+	return nil
+}
+
+// List returns the current rules with the number of injected operations.
+func List() []string {
+	mu.Lock()
+	defer mu.Unlock()
+	var specs []string
+	for _, r := range rules {
+		specs = append(specs, r.String())
+	}
+	return specs
+}
+
+// inject applies the first matched rule to the operation, the returned errno
+// should be the result of it if it's not zero.
+func inject(op string) syscall.Errno {
+	mu.Lock()
+	var rule Rule
+	for _, r := range rules {
+		if r.Count != 0 && r.match(op) && (r.Probability >= 1 || rand.Float64() < r.Probability) {
+			if r.Count > 0 {
+				r.Count--
+			}
+			r.Hits++
+			rule = *r
+			break
+		}
+	}
+	mu.Unlock()
+	switch rule.Action {
+	case actionError:
+		return rule.Errno
+	case actionDelay:
+		time.Sleep(rule.Delay)
+	case actionDrop:
+		time.Sleep(rule.Delay)
+		return syscall.ETIMEDOUT
+	}
+	return 0
+}
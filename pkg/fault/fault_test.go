@@ -0,0 +1,84 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package fault
+
+import (
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	cases := []struct {
+		spec, expected string
+	}{
+		{"meta.lookup=error", "meta.lookup=error:EIO (hits: 0)"},
+		{"meta.lookup=error:enoent,p=0.1", "meta.lookup=error:ENOENT,p=0.1 (hits: 0)"},
+		{"meta.*=error:28", "meta.*=error:ENOSPC (hits: 0)"},
+		{"object.get=delay:3s,n=10", "object.get=delay:3s,n=10 (hits: 0)"},
+		{"object.*=drop", "object.*=drop:1m0s (hits: 0)"},
+	}
+	for _, c := range cases {
+		r, err := Parse(c.spec)
+		if err != nil {
+			t.Fatalf("parse %s: %s", c.spec, err)
+		}
+		if r.String() != c.expected {
+			t.Fatalf("expect %s, but got %s", c.expected, r)
+		}
+	}
+	for _, spec := range []string{"meta.lookup", "=error", "meta.lookup=fail", "meta.lookup=error:EFOO",
+		"object.get=delay", "object.get=delay:-1s", "object.get=drop,p=2", "object.get=drop,n=0", "object.get=drop,x=1"} {
+		if _, err := Parse(spec); err == nil {
+			t.Fatalf("invalid rule %s should fail", spec)
+		}
+	}
+}
+
+func TestInject(t *testing.T) {
+	defer func() { _ = Set(nil) }()
+	if err := Set([]string{"meta.lookup=error:ENOENT,n=2", "meta.*=delay:50ms", "object.get=drop:10ms"}); err != nil {
+		t.Fatalf("set: %s", err)
+	}
+	for i := 0; i < 2; i++ {
+		if st := inject("meta.lookup"); st != syscall.ENOENT {
+			t.Fatalf("lookup %d: %s", i, st)
+		}
+	}
+	start := time.Now()
+	if st := inject("meta.lookup"); st != 0 || time.Since(start) < time.Millisecond*50 {
+		t.Fatalf("lookup should be delayed after the count is used up: %s %s", st, time.Since(start))
+	}
+	if st := inject("object.get"); st != syscall.ETIMEDOUT {
+		t.Fatalf("dropped get: %s", st)
+	}
+	if st := inject("object.put"); st != 0 {
+		t.Fatalf("put: %s", st)
+	}
+	expected := []string{"meta.lookup=error:ENOENT,n=0 (hits: 2)", "meta.*=delay:50ms (hits: 1)", "object.get=drop:10ms (hits: 1)"}
+	rules := List()
+	if len(rules) != len(expected) {
+		t.Fatalf("expect rules %v, but got %v", expected, rules)
+	}
+	for i := range rules {
+		if rules[i] != expected[i] {
+			t.Fatalf("expect rule %s, but got %s", expected[i], rules[i])
+		}
+	}
+	if err := Set([]string{"bad"}); err == nil || len(List()) != 3 {
+		t.Fatalf("invalid rules should not replace the existing ones: %v", err)
+	}
+}
@@ -131,6 +131,7 @@ type File struct {
 
 	sync.Mutex
 	offset   int64
+	end      int64 // the end of reads, 0 means the whole file
 	rdata    vfs.FileReader
 	wdata    vfs.FileWriter
 	dircache []os.FileInfo
@@ -316,6 +317,9 @@ func (fs *FileSystem) Mkdir(ctx meta.Context, p string, mode uint16) (err syscal
 	}
 	var inode Ino
 	err = fs.m.Mkdir(ctx, fi.inode, path.Base(p), mode, 0, 0, &inode, nil)
+	if err == 0 {
+		vfs.InheritXattrs(ctx, fs.m, fs.writer, fi.inode, inode)
+	}
 	return
 }
 
@@ -375,7 +379,7 @@ func (fs *FileSystem) Rename(ctx meta.Context, oldpath string, newpath string) (
 	if err != 0 {
 		return
 	}
-	err = fs.m.Rename(ctx, oldfi.inode, path.Base(oldpath), newfi.inode, path.Base(newpath), nil, nil)
+	err = fs.m.Rename(ctx, oldfi.inode, path.Base(oldpath), newfi.inode, path.Base(newpath), 0, nil, nil)
 	return
 }
 
@@ -477,6 +481,10 @@ func (fs *FileSystem) SetXattr(ctx meta.Context, p string, name string, value []
 	if err != 0 {
 		return
 	}
+	if err = vfs.CheckXattr(name, value); err != 0 {
+		return
+	}
+	defer vfs.ForgetXattrs(fs.writer, fi.inode, name)
 	err = fs.m.SetXattr(ctx, fi.inode, name, value)
 	return
 }
@@ -494,9 +502,24 @@ func (fs *FileSystem) GetXattr(ctx meta.Context, p string, name string) (result
 		return
 	}
 	err = fs.m.GetXattr(ctx, fi.inode, name, &result)
+	if err == 0 && name == vfs.ChecksumXattr {
+		result, err = vfs.ReadChecksum(ctx, fs.m, fi.inode, result)
+	}
 	return
 }
 
+// SaveChecksum keeps the SHA256 of a file after it's written and closed, see vfs.ChecksumXattr.
+func (fs *FileSystem) SaveChecksum(ctx meta.Context, p string, sum []byte) (err syscall.Errno) {
+	defer trace.StartRegion(context.TODO(), "fs.SaveChecksum").End()
+	l := vfs.NewLogContext(ctx)
+	defer func() { fs.log(l, "SaveChecksum (%s): %s", p, errstr(err)) }()
+	fi, err := fs.lookup(ctx, p, true)
+	if err != 0 {
+		return
+	}
+	return vfs.SaveChecksum(ctx, fs.m, fi.inode, sum)
+}
+
 func (fs *FileSystem) ListXattr(ctx meta.Context, p string) (names []byte, err syscall.Errno) {
 	defer trace.StartRegion(context.TODO(), "fs.ListXattr").End()
 	l := vfs.NewLogContext(ctx)
@@ -525,6 +548,7 @@ func (fs *FileSystem) RemoveXattr(ctx meta.Context, p string, name string) (err
 	if err != 0 {
 		return
 	}
+	defer vfs.ForgetXattrs(fs.writer, fi.inode, name)
 	err = fs.m.RemoveXattr(ctx, fi.inode, name)
 	return
 }
@@ -749,15 +773,27 @@ func (f *File) Pread(ctx meta.Context, b []byte, offset int64) (n int, err error
 	return
 }
 
+// LimitRead limits the reads of a file before end, so the data after it is not read ahead. It
+// should be called before reading a range of the file.
+func (f *File) LimitRead(end int64) {
+	f.Lock()
+	defer f.Unlock()
+	f.end = end
+}
+
 func (f *File) pread(ctx meta.Context, b []byte, offset int64) (n int, err error) {
-	if offset >= f.info.Size() {
+	size := f.info.Size()
+	if f.end > 0 && f.end < size {
+		size = f.end
+	}
+	if offset >= size {
 		return 0, io.EOF
 	}
-	if int64(len(b))+offset > f.info.Size() {
-		b = b[:f.info.Size()-offset]
+	if int64(len(b))+offset > size {
+		b = b[:size-offset]
 	}
 	if f.rdata == nil {
-		f.rdata = f.fs.reader.Open(f.inode, uint64(f.info.Size()))
+		f.rdata = f.fs.reader.Open(f.inode, uint64(size))
 	}
 
 	got, eno := f.rdata.Read(ctx, uint64(offset), b)
@@ -795,6 +831,7 @@ func (f *File) Pwrite(ctx meta.Context, b []byte, offset int64) (n int, err sysc
 func (f *File) pwrite(ctx meta.Context, b []byte, offset int64) (n int, err syscall.Errno) {
 	if f.wdata == nil {
 		f.wdata = f.fs.writer.Open(f.inode, uint64(f.info.Size()))
+		f.wdata.SetCompression(f.fs.writer.CompressHint(ctx, f.info.attr.Parent))
 	}
 	err = f.wdata.Write(ctx, uint64(offset), b)
 	if err != 0 {
@@ -22,6 +22,7 @@ import (
 	"time"
 
 	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/juicedata/juicefs/pkg/trace"
 	"github.com/juicedata/juicefs/pkg/vfs"
 
 	"github.com/hanwen/go-fuse/v2/fuse"
@@ -80,6 +81,11 @@ func (c *fuseContext) Pid() uint32 {
 	return uint32(c.header.Pid)
 }
 
+// TraceID returns the id of the request to correlate the requests to object storage and metadata with it.
+func (c *fuseContext) TraceID() string {
+	return trace.NewID(c.header.Unique)
+}
+
 func (c *fuseContext) Duration() time.Duration {
 	return time.Since(c.start)
 }
@@ -38,6 +38,7 @@ type fileSystem struct {
 	attrTimeout     time.Duration
 	direntryTimeout time.Duration
 	entryTimeout    time.Duration
+	splice          bool
 }
 
 func newFileSystem() *fileSystem {
@@ -46,14 +47,38 @@ func newFileSystem() *fileSystem {
 	}
 }
 
-func (fs *fileSystem) replyEntry(out *fuse.EntryOut, e *meta.Entry) fuse.Status {
+// eventualTimeout is the min cache timeout of the entries in the directories with eventual consistency.
+const eventualTimeout = time.Minute
+
+// timeouts returns the cache timeouts of the attributes and entries in a directory, by the consistency of it.
+func (fs *fileSystem) timeouts(ctx vfs.Context, parent Ino) (attr, entry, direntry time.Duration) {
+	attr, entry, direntry = fs.attrTimeout, fs.entryTimeout, fs.direntryTimeout
+	switch vfs.Consistency(ctx, parent) {
+	case vfs.ConsistencyStrict:
+		return 0, 0, 0
+	case vfs.ConsistencyEventual:
+		if attr < eventualTimeout {
+			attr = eventualTimeout
+		}
+		if entry < eventualTimeout {
+			entry = eventualTimeout
+		}
+		if direntry < eventualTimeout {
+			direntry = eventualTimeout
+		}
+	}
+	return
+}
+
+func (fs *fileSystem) replyEntry(ctx vfs.Context, parent Ino, out *fuse.EntryOut, e *meta.Entry) fuse.Status {
 	out.NodeId = uint64(e.Inode)
 	out.Generation = 1
-	out.SetAttrTimeout(fs.attrTimeout)
+	attr, entry, direntry := fs.timeouts(ctx, parent)
+	out.SetAttrTimeout(attr)
 	if e.Attr.Typ == meta.TypeDirectory {
-		out.SetEntryTimeout(fs.direntryTimeout)
+		out.SetEntryTimeout(direntry)
 	} else {
-		out.SetEntryTimeout(fs.entryTimeout)
+		out.SetEntryTimeout(entry)
 	}
 	if vfs.IsSpecialNode(e.Inode) {
 		out.SetAttrTimeout(time.Hour)
@@ -69,7 +94,7 @@ func (fs *fileSystem) Lookup(cancel <-chan struct{}, header *fuse.InHeader, name
 	if err != 0 {
 		return fuse.Status(err)
 	}
-	return fs.replyEntry(out, entry)
+	return fs.replyEntry(ctx, Ino(header.NodeId), out, entry)
 }
 
 func (fs *fileSystem) GetAttr(cancel <-chan struct{}, in *fuse.GetAttrIn, out *fuse.AttrOut) (code fuse.Status) {
@@ -84,7 +109,8 @@ func (fs *fileSystem) GetAttr(cancel <-chan struct{}, in *fuse.GetAttrIn, out *f
 		return fuse.Status(err)
 	}
 	attrToStat(entry.Inode, entry.Attr, &out.Attr)
-	out.AttrValid = uint64(fs.attrTimeout.Seconds())
+	attr, _, _ := fs.timeouts(ctx, entry.Attr.Parent)
+	out.AttrValid = uint64(attr.Seconds())
 	if vfs.IsSpecialNode(Ino(in.NodeId)) {
 		out.AttrValid = 3600
 	}
@@ -102,7 +128,8 @@ func (fs *fileSystem) SetAttr(cancel <-chan struct{}, in *fuse.SetAttrIn, out *f
 	if err != 0 {
 		return fuse.Status(err)
 	}
-	out.AttrValid = uint64(fs.attrTimeout.Seconds())
+	attr, _, _ := fs.timeouts(ctx, entry.Attr.Parent)
+	out.AttrValid = uint64(attr.Seconds())
 	if vfs.IsSpecialNode(entry.Inode) {
 		out.AttrValid = 3600
 	}
@@ -117,7 +144,7 @@ func (fs *fileSystem) Mknod(cancel <-chan struct{}, in *fuse.MknodIn, name strin
 	if err != 0 {
 		return fuse.Status(err)
 	}
-	return fs.replyEntry(out, entry)
+	return fs.replyEntry(ctx, Ino(in.NodeId), out, entry)
 }
 
 func (fs *fileSystem) Mkdir(cancel <-chan struct{}, in *fuse.MkdirIn, name string, out *fuse.EntryOut) (code fuse.Status) {
@@ -127,7 +154,7 @@ func (fs *fileSystem) Mkdir(cancel <-chan struct{}, in *fuse.MkdirIn, name strin
 	if err != 0 {
 		return fuse.Status(err)
 	}
-	return fs.replyEntry(out, entry)
+	return fs.replyEntry(ctx, Ino(in.NodeId), out, entry)
 }
 
 func (fs *fileSystem) Unlink(cancel <-chan struct{}, header *fuse.InHeader, name string) (code fuse.Status) {
@@ -147,7 +174,7 @@ func (fs *fileSystem) Rmdir(cancel <-chan struct{}, header *fuse.InHeader, name
 func (fs *fileSystem) Rename(cancel <-chan struct{}, in *fuse.RenameIn, oldName string, newName string) (code fuse.Status) {
 	ctx := newContext(cancel, &in.InHeader)
 	defer releaseContext(ctx)
-	err := vfs.Rename(ctx, Ino(in.NodeId), oldName, Ino(in.Newdir), newName)
+	err := vfs.Rename(ctx, Ino(in.NodeId), oldName, Ino(in.Newdir), newName, in.Flags)
 	return fuse.Status(err)
 }
 
@@ -158,7 +185,7 @@ func (fs *fileSystem) Link(cancel <-chan struct{}, in *fuse.LinkIn, name string,
 	if err != 0 {
 		return fuse.Status(err)
 	}
-	return fs.replyEntry(out, entry)
+	return fs.replyEntry(ctx, Ino(in.NodeId), out, entry)
 }
 
 func (fs *fileSystem) Symlink(cancel <-chan struct{}, header *fuse.InHeader, target string, name string, out *fuse.EntryOut) (code fuse.Status) {
@@ -168,7 +195,7 @@ func (fs *fileSystem) Symlink(cancel <-chan struct{}, header *fuse.InHeader, tar
 	if err != 0 {
 		return fuse.Status(err)
 	}
-	return fs.replyEntry(out, entry)
+	return fs.replyEntry(ctx, Ino(header.NodeId), out, entry)
 }
 
 func (fs *fileSystem) Readlink(cancel <-chan struct{}, header *fuse.InHeader) (out []byte, code fuse.Status) {
@@ -203,7 +230,10 @@ func (fs *fileSystem) ListXAttr(cancel <-chan struct{}, header *fuse.InHeader, d
 func (fs *fileSystem) SetXAttr(cancel <-chan struct{}, in *fuse.SetXAttrIn, attr string, data []byte) fuse.Status {
 	ctx := newContext(cancel, &in.InHeader)
 	defer releaseContext(ctx)
-	err := vfs.SetXattr(ctx, Ino(in.NodeId), attr, data, int(in.Flags))
+	data, err := spliceXattr(ctx, in, attr, data)
+	if err == 0 {
+		err = vfs.SetXattr(ctx, Ino(in.NodeId), attr, data, int(in.Flags))
+	}
 	return fuse.Status(err)
 }
 
@@ -229,19 +259,22 @@ func (fs *fileSystem) Create(cancel <-chan struct{}, in *fuse.CreateIn, name str
 		return fuse.Status(err)
 	}
 	out.Fh = fh
-	return fs.replyEntry(&out.EntryOut, entry)
+	return fs.replyEntry(ctx, Ino(in.NodeId), &out.EntryOut, entry)
 }
 
 func (fs *fileSystem) Open(cancel <-chan struct{}, in *fuse.OpenIn, out *fuse.OpenOut) (status fuse.Status) {
 	ctx := newContext(cancel, &in.InHeader)
 	defer releaseContext(ctx)
-	_, fh, err := vfs.Open(ctx, Ino(in.NodeId), in.Flags)
+	entry, fh, err := vfs.Open(ctx, Ino(in.NodeId), in.Flags)
 	if err != 0 {
 		return fuse.Status(err)
 	}
 	out.Fh = fh
 	if vfs.IsSpecialNode(Ino(in.NodeId)) {
 		out.OpenFlags |= fuse.FOPEN_DIRECT_IO
+	} else if vfs.Consistency(ctx, entry.Attr.Parent) == vfs.ConsistencyEventual {
+		// the data cached by kernel is not invalidated by open
+		out.OpenFlags |= fuse.FOPEN_KEEP_CACHE
 	}
 	return 0
 }
@@ -249,6 +282,11 @@ func (fs *fileSystem) Open(cancel <-chan struct{}, in *fuse.OpenIn, out *fuse.Op
 func (fs *fileSystem) Read(cancel <-chan struct{}, in *fuse.ReadIn, buf []byte) (fuse.ReadResult, fuse.Status) {
 	ctx := newContext(cancel, &in.InHeader)
 	defer releaseContext(ctx)
+	if fs.splice {
+		if fd, off, n, ok := vfs.ReadCached(ctx, Ino(in.NodeId), uint32(len(buf)), in.Offset, in.Fh); ok {
+			return fuse.ReadResultFd(fd, off, n), 0
+		}
+	}
 	n, err := vfs.Read(ctx, Ino(in.NodeId), buf, in.Offset, in.Fh)
 	if err != 0 {
 		return nil, fuse.Status(err)
@@ -379,7 +417,7 @@ func (fs *fileSystem) ReadDirPlus(cancel <-chan struct{}, in *fuse.ReadIn, out *
 		}
 		if e.Attr.Full {
 			vfs.UpdateLength(e.Inode, e.Attr)
-			fs.replyEntry(eo, e)
+			fs.replyEntry(ctx, Ino(in.NodeId), eo, e)
 		} else {
 			eo.Ino = uint64(e.Inode)
 			eo.Generation = 1
@@ -415,7 +453,7 @@ func (fs *fileSystem) StatFs(cancel <-chan struct{}, in *fuse.InHeader, out *fus
 }
 
 // Serve starts a server to serve requests from FUSE.
-func Serve(conf *vfs.Config, options string, attrCacheTo, entryCacheTo, dirEntryCacheTo float64, xattrs bool) error {
+func Serve(conf *vfs.Config, options string, attrCacheTo, entryCacheTo, dirEntryCacheTo float64, xattrs, splice bool) error {
 	if err := syscall.Setpriority(syscall.PRIO_PROCESS, os.Getpid(), -19); err != nil {
 		logger.Warnf("setpriority: %s", err)
 	}
@@ -424,6 +462,7 @@ func Serve(conf *vfs.Config, options string, attrCacheTo, entryCacheTo, dirEntry
 	imp.attrTimeout = time.Millisecond * time.Duration(attrCacheTo*1000)
 	imp.entryTimeout = time.Millisecond * time.Duration(entryCacheTo*1000)
 	imp.direntryTimeout = time.Millisecond * time.Duration(dirEntryCacheTo*1000)
+	imp.splice = splice && conf.Chunk.CacheSize > 0
 
 	var opt fuse.MountOptions
 	opt.FsName = "JuiceFS:" + conf.Format.Name
@@ -452,6 +491,10 @@ func Serve(conf *vfs.Config, options string, attrCacheTo, entryCacheTo, dirEntry
 		opt.Options = append(opt.Options, "fssubtype=juicefs")
 		opt.Options = append(opt.Options, "volname="+conf.Format.Name)
 		opt.Options = append(opt.Options, "daemon_timeout=60", "iosize=65536", "novncache")
+		if xattrs {
+			// the metadata of Finder is kept in xattrs, hide the AppleDouble (._*) and .DS_Store files
+			opt.Options = append(opt.Options, "noappledouble")
+		}
 		imp.cacheMode = 2
 	}
 	fssrv, err := fuse.NewServer(imp, conf.Mountpoint, &opt)
@@ -16,7 +16,10 @@
 package fuse
 
 import (
+	"syscall"
+
 	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/juicedata/juicefs/pkg/vfs"
 )
 
 func getUmask(in *fuse.MknodIn) uint16 {
@@ -25,3 +28,26 @@ func getUmask(in *fuse.MknodIn) uint16 {
 
 func setBlksize(out *fuse.Attr, size uint32) {
 }
+
+// spliceXattr writes the value of an attribute at the position, only the resource fork
+// is written in pieces by macOS.
+func spliceXattr(ctx vfs.Context, in *fuse.SetXAttrIn, name string, data []byte) ([]byte, syscall.Errno) {
+	if in.Position == 0 {
+		return data, 0
+	}
+	if name != vfs.ResourceForkXattr {
+		return nil, syscall.EINVAL
+	}
+	old, err := vfs.GetXattr(ctx, Ino(in.NodeId), name, 0)
+	if err != 0 {
+		return nil, err
+	}
+	if int(in.Position) > len(old) {
+		return nil, syscall.EINVAL
+	}
+	value := append(old[:in.Position:in.Position], data...)
+	if end := int(in.Position) + len(data); end < len(old) {
+		value = append(value, old[end:]...)
+	}
+	return value, 0
+}
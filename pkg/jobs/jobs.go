@@ -0,0 +1,375 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Package jobs schedules the background jobs of a client, such as compaction and
+// deleting the data of removed files. A job can run only when it's not paused, the
+// number of running ones is under its limit, and the current time is inside one of
+// the maintenance windows (if any), and it's not held. The exclusive jobs, which scan the whole volume,
+// run only on the client elected as the leader. All the jobs can be disabled on a
+// latency-sensitive client, then they're left to other clients.
+//
+// A maintenance window is in the format of [DAYS ]HH:MM-HH:MM in local time, DAYS
+// is '*' or a comma-separated list of weekdays or ranges, for example:
+//
+//	01:00-05:00                 every day
+//	mon-fri 22:00-06:00         from the nights of weekdays to the next mornings
+//	sat,sun 00:00-24:00         the whole weekends
+//
+// Multiple windows are separated by ';'.
+package jobs
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The background jobs.
+const (
+	Compaction  = "compaction"  // compact the chunks with too many slices
+	Deletion    = "deletion"    // delete the data of removed files
+	Cleanup     = "cleanup"     // delete the released slices and leaked chunks
+	Replication = "replication" // copy the objects into the replica storage
+	Scrub       = "scrub"       // verify the blocks in object storage
+	Defrag      = "defrag"      // rewrite the fragmented chunks into fresh blocks
+)
+
+// Job is the state of a background job.
+type Job struct {
+	Name      string
+	Limit     int // max number of concurrent runs, 0 means unlimited
+	Running   int
+	Paused    bool
+	Exclusive bool  // run only on the leader
+	Done      int64 // finished runs
+	Skipped   int64 // runs skipped because of paused, outside of windows or limit
+	Last      time.Time
+	HeldUntil time.Time // no run is started before it, see Hold
+}
+
+// Status is the state of all the jobs.
+type Status struct {
+	Windows  string
+	InWindow bool
+	Leader   bool
+	Disabled bool
+	Jobs     []Job
+}
+
+var weekdays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// Window is a maintenance window on some days of a week, the end can be
+// earlier than the start when it crosses midnight.
+type Window struct {
+	Days       uint8 // bit i is set for time.Weekday(i)
+	Start, End int   // minutes of the day
+}
+
+func parseDay(s string) (int, error) {
+	for i, d := range weekdays {
+		if strings.EqualFold(s, d) {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid weekday %q", s)
+}
+
+func parseMinutes(s string) (int, error) {
+	p := strings.Split(s, ":")
+	if len(p) != 2 {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	h, err1 := strconv.Atoi(p[0])
+	m, err2 := strconv.Atoi(p[1])
+	if err1 != nil || err2 != nil || h < 0 || m < 0 || m >= 60 || h*60+m > 24*60 {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	return h*60 + m, nil
+}
+
+// ParseWindow parses a window in the format of [DAYS ]HH:MM-HH:MM.
+func ParseWindow(s string) (*Window, error) {
+	fields := strings.Fields(s)
+	if len(fields) == 0 || len(fields) > 2 {
+		return nil, fmt.Errorf("invalid window %q, it should be [DAYS ]HH:MM-HH:MM", s)
+	}
+	w := &Window{Days: 0x7f}
+	if len(fields) == 2 && fields[0] != "*" {
+		w.Days = 0
+		for _, r := range strings.Split(fields[0], ",") {
+			ds := strings.SplitN(r, "-", 2)
+			first, err := parseDay(ds[0])
+			if err != nil {
+				return nil, fmt.Errorf("%s in window %q", err, s)
+			}
+			last := first
+			if len(ds) == 2 {
+				if last, err = parseDay(ds[1]); err != nil {
+					return nil, fmt.Errorf("%s in window %q", err, s)
+				}
+			}
+			for d := first; ; d = (d + 1) % 7 {
+				w.Days |= 1 << d
+				if d == last {
+					break
+				}
+			}
+		}
+	}
+	ts := strings.Split(fields[len(fields)-1], "-")
+	if len(ts) != 2 {
+		return nil, fmt.Errorf("invalid window %q, it should be [DAYS ]HH:MM-HH:MM", s)
+	}
+	var err error
+	if w.Start, err = parseMinutes(ts[0]); err != nil {
+		return nil, fmt.Errorf("%s in window %q", err, s)
+	}
+	if w.End, err = parseMinutes(ts[1]); err != nil {
+		return nil, fmt.Errorf("%s in window %q", err, s)
+	}
+	if w.Start == w.End || w.Start == 24*60 {
+		return nil, fmt.Errorf("empty window %q", s)
+	}
+	return w, nil
+}
+
+// ParseWindows parses the windows separated by ';'.
+func ParseWindows(spec string) ([]*Window, error) {
+	var ws []*Window
+	for _, s := range strings.Split(spec, ";") {
+		if strings.TrimSpace(s) == "" {
+			continue
+		}
+		w, err := ParseWindow(s)
+		if err != nil {
+			return nil, err
+		}
+		ws = append(ws, w)
+	}
+	return ws, nil
+}
+
+func (w *Window) on(d time.Weekday) bool {
+	return w.Days&(1<<uint(d)) != 0
+}
+
+// Contains returns true if t is inside the window.
+func (w *Window) Contains(t time.Time) bool {
+	m := t.Hour()*60 + t.Minute()
+	d := t.Weekday()
+	if w.Start < w.End {
+		return w.on(d) && m >= w.Start && m < w.End
+	}
+	return w.on(d) && m >= w.Start || w.on((d+6)%7) && m < w.End
+}
+
+var (
+	mu      sync.Mutex
+	windows []*Window
+	spec    string
+	jobs    = map[string]*Job{
+		Compaction:  {Name: Compaction, Limit: 10},
+		Deletion:    {Name: Deletion},
+		Cleanup:     {Name: Cleanup, Limit: 1, Exclusive: true},
+		Replication: {Name: Replication, Limit: 1},
+		Scrub:       {Name: Scrub, Limit: 1},
+		Defrag:      {Name: Defrag, Limit: 1, Exclusive: true},
+	}
+	leader   bool
+	disabled bool
+	now      = time.Now
+
+	// RetryInterval is the interval to check again in Start.
+	RetryInterval = time.Second * 10
+)
+
+// SetWindows sets the maintenance windows, empty spec means any time.
+func SetWindows(s string) error {
+	ws, err := ParseWindows(s)
+	if err != nil {
+		return err
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	windows, spec = ws, strings.TrimSpace(s)
+	return nil
+}
+
+func get(name string) *Job {
+	j := jobs[name]
+	if j == nil {
+		j = &Job{Name: name}
+		jobs[name] = j
+	}
+	return j
+}
+
+// SetLimit sets the max number of concurrent runs of a job, 0 means unlimited.
+func SetLimit(name string, limit int) {
+	mu.Lock()
+	defer mu.Unlock()
+	get(name).Limit = limit
+}
+
+func inWindow() bool {
+	if len(windows) == 0 {
+		return true
+	}
+	t := now()
+	for _, w := range windows {
+		if w.Contains(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// SetLeader sets whether this client is the leader, which runs the exclusive jobs.
+func SetLeader(b bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	leader = b
+}
+
+// IsLeader returns true if this client is the leader.
+func IsLeader() bool {
+	mu.Lock()
+	defer mu.Unlock()
+	return leader
+}
+
+// Disable disables all the jobs of this client, they can't be resumed.
+func Disable() {
+	mu.Lock()
+	defer mu.Unlock()
+	disabled = true
+}
+
+// InWindow returns true if now is inside any of the maintenance windows.
+func InWindow() bool {
+	mu.Lock()
+	defer mu.Unlock()
+	return inWindow()
+}
+
+func start(name string, count bool) bool {
+	mu.Lock()
+	defer mu.Unlock()
+	j := get(name)
+	if disabled || j.Paused || now().Before(j.HeldUntil) || j.Exclusive && !leader || j.Limit > 0 && j.Running >= j.Limit || !inWindow() {
+		if count {
+			j.Skipped++
+		}
+		return false
+	}
+	j.Running++
+	j.Last = now()
+	return true
+}
+
+// TryStart starts a run of the job if it's allowed now, Done should be called after
+// it's finished. The caller should skip the run if it returns false.
+func TryStart(name string) bool {
+	return start(name, true)
+}
+
+// Start waits until the job is allowed to run, Done should be called after it's finished.
+func Start(name string) {
+	for !start(name, false) {
+		time.Sleep(RetryInterval)
+	}
+}
+
+// Done finishes a run of the job.
+func Done(name string) {
+	mu.Lock()
+	defer mu.Unlock()
+	j := get(name)
+	j.Running--
+	j.Done++
+}
+
+// Cancel finishes a run of the job which has nothing to do, it's not counted as done.
+func Cancel(name string) {
+	mu.Lock()
+	defer mu.Unlock()
+	get(name).Running--
+}
+
+func setPaused(names []string, paused bool) error {
+	mu.Lock()
+	defer mu.Unlock()
+	if len(names) == 0 {
+		for _, j := range jobs {
+			j.Paused = paused
+		}
+		return nil
+	}
+	for _, name := range names {
+		if jobs[name] == nil {
+			return fmt.Errorf("unknown job %q", name)
+		}
+	}
+	for _, name := range names {
+		jobs[name].Paused = paused
+	}
+	return nil
+}
+
+// Pause pauses the jobs, or all the jobs if no name is given. The running ones are not interrupted.
+func Pause(names ...string) error {
+	return setPaused(names, true)
+}
+
+// Resume resumes the paused jobs, or all the jobs if no name is given.
+func Resume(names ...string) error {
+	return setPaused(names, false)
+}
+
+// Hold stops the jobs from starting new runs until the time, a zero or past time releases them.
+// It's different from Pause that the hold is set by the volume for all the clients.
+func Hold(until time.Time, names ...string) {
+	mu.Lock()
+	defer mu.Unlock()
+	for _, name := range names {
+		get(name).HeldUntil = until
+	}
+}
+
+// Running returns the number of running runs of the jobs.
+func Running(names ...string) int {
+	mu.Lock()
+	defer mu.Unlock()
+	var n int
+	for _, name := range names {
+		n += get(name).Running
+	}
+	return n
+}
+
+// List returns the state of all the jobs.
+func List() *Status {
+	mu.Lock()
+	defer mu.Unlock()
+	st := &Status{Windows: spec, InWindow: inWindow(), Leader: leader, Disabled: disabled}
+	for _, j := range jobs {
+		st.Jobs = append(st.Jobs, *j)
+	}
+	sort.Slice(st.Jobs, func(i, j int) bool { return st.Jobs[i].Name < st.Jobs[j].Name })
+	return st
+}
@@ -0,0 +1,173 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package jobs
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWindow(t *testing.T) {
+	// 2021-06-07 is Monday
+	at := func(s string) time.Time {
+		t, _ := time.ParseInLocation("2006-01-02 15:04", s, time.Local)
+		return t
+	}
+	cases := []struct {
+		window string
+		time   string
+		inside bool
+	}{
+		{"01:00-05:00", "2021-06-07 01:00", true},
+		{"01:00-05:00", "2021-06-07 05:00", false},
+		{"* 01:00-05:00", "2021-06-13 04:59", true},
+		{"mon-fri 22:00-06:00", "2021-06-07 23:00", true},
+		{"mon-fri 22:00-06:00", "2021-06-08 05:00", true},
+		{"mon-fri 22:00-06:00", "2021-06-07 05:00", false}, // Sunday night
+		{"mon-fri 22:00-06:00", "2021-06-12 05:00", true},  // Friday night
+		{"mon-fri 22:00-06:00", "2021-06-12 23:00", false},
+		{"sat,sun 00:00-24:00", "2021-06-13 23:59", true},
+		{"fri-mon 10:00-11:00", "2021-06-13 10:30", true},
+		{"fri-mon 10:00-11:00", "2021-06-09 10:30", false},
+	}
+	for _, c := range cases {
+		w, err := ParseWindow(c.window)
+		if err != nil {
+			t.Fatalf("parse %q: %s", c.window, err)
+		}
+		if w.Contains(at(c.time)) != c.inside {
+			t.Fatalf("%q contains %s: %v", c.window, c.time, !c.inside)
+		}
+	}
+	for _, s := range []string{"", "01:00", "01:00-01:00", "25:00-01:00", "funday 01:00-02:00", "mon 01:00-02:00 x"} {
+		if _, err := ParseWindow(s); err == nil {
+			t.Fatalf("window %q should be invalid", s)
+		}
+	}
+}
+
+func setNow(f func() time.Time) {
+	mu.Lock()
+	now = f
+	mu.Unlock()
+}
+
+func TestSchedule(t *testing.T) {
+	defer func() {
+		setNow(time.Now)
+		_ = SetWindows("")
+		SetLimit(Compaction, 10)
+		_ = Resume()
+		SetLeader(false)
+		mu.Lock()
+		disabled = false
+		mu.Unlock()
+	}()
+	if TryStart(Cleanup) {
+		t.Fatalf("cleanup should run only on the leader")
+	}
+	SetLeader(true)
+	SetLimit(Compaction, 2)
+	if !TryStart(Compaction) || !TryStart(Compaction) || TryStart(Compaction) {
+		t.Fatalf("limit of compaction is not respected")
+	}
+	Done(Compaction)
+	if !TryStart(Compaction) {
+		t.Fatalf("compaction should start after one is done")
+	}
+	Done(Compaction)
+	Done(Compaction)
+
+	if err := Pause(Deletion); err != nil {
+		t.Fatalf("pause: %s", err)
+	}
+	if TryStart(Deletion) || !TryStart(Cleanup) {
+		t.Fatalf("only deletion should be paused")
+	}
+	Done(Cleanup)
+	if err := Pause("unknown"); err == nil {
+		t.Fatalf("pause unknown job should fail")
+	}
+	_ = Resume()
+
+	if err := SetWindows("01:00-02:00; sat 10:00-12:00"); err != nil {
+		t.Fatalf("set windows: %s", err)
+	}
+	setNow(func() time.Time { return time.Date(2021, 6, 7, 3, 0, 0, 0, time.Local) })
+	if TryStart(Deletion) {
+		t.Fatalf("deletion should not run outside of windows")
+	}
+	done := make(chan bool)
+	RetryInterval = time.Millisecond
+	go func() {
+		Start(Cleanup)
+		done <- true
+	}()
+	time.Sleep(time.Millisecond * 10)
+	setNow(func() time.Time { return time.Date(2021, 6, 12, 11, 0, 0, 0, time.Local) })
+	select {
+	case <-done:
+		Done(Cleanup)
+	case <-time.After(time.Second):
+		t.Fatalf("cleanup should start inside the window")
+	}
+
+	st := List()
+	if !st.InWindow || !st.Leader || st.Windows != "01:00-02:00; sat 10:00-12:00" {
+		t.Fatalf("status: %+v", st)
+	}
+	for _, j := range st.Jobs {
+		if j.Name == Deletion && (j.Skipped != 2 || j.Done != 0) || j.Name == Compaction && (j.Done != 3 || j.Skipped != 1) {
+			t.Fatalf("job: %+v", j)
+		}
+	}
+
+	Disable()
+	_ = Resume()
+	if TryStart(Compaction) || !List().Disabled {
+		t.Fatalf("disabled jobs should not run")
+	}
+}
+
+func TestHold(t *testing.T) {
+	defer func() {
+		setNow(time.Now)
+		Hold(time.Time{}, Deletion, Compaction)
+	}()
+	t0 := time.Date(2021, 6, 7, 3, 0, 0, 0, time.Local)
+	setNow(func() time.Time { return t0 })
+	Hold(t0.Add(time.Minute), Deletion, Compaction)
+	if TryStart(Deletion) || TryStart(Compaction) {
+		t.Fatalf("held jobs should not run")
+	}
+	setNow(func() time.Time { return t0.Add(time.Minute) })
+	if !TryStart(Deletion) {
+		t.Fatalf("deletion should run after the hold")
+	}
+	Done(Deletion)
+	Hold(t0.Add(time.Hour), Deletion)
+	if TryStart(Deletion) {
+		t.Fatalf("deletion is held again")
+	}
+	if Running(Deletion, Compaction) != 0 {
+		t.Fatalf("no run of held jobs")
+	}
+	Hold(time.Time{}, Deletion)
+	if !TryStart(Deletion) {
+		t.Fatalf("deletion should run after released")
+	}
+	Done(Deletion)
+}
@@ -0,0 +1,50 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package meta
+
+// DeletedFile is a file removed from the namespace, whose data is not deleted yet.
+type DeletedFile struct {
+	Inode  Ino
+	Length uint64
+	Opened bool    // still opened by a client, it will be deleted after closed
+	Slices []Slice // filled only when asked
+}
+
+// Backlog is the data removed from the namespace but not deleted from the object storage yet.
+type Backlog struct {
+	Files    []DeletedFile
+	Released []Slice // slices released by compaction or deleted files, but failed to be deleted
+}
+
+// FileBytes returns the length of the removed files, the opened ones are counted separately.
+func (b *Backlog) FileBytes() (removed, opened uint64) {
+	for _, f := range b.Files {
+		if f.Opened {
+			opened += f.Length
+		} else {
+			removed += f.Length
+		}
+	}
+	return
+}
+
+// ReleasedBytes returns the size of the released slices.
+func (b *Backlog) ReleasedBytes() (n uint64) {
+	for _, s := range b.Released {
+		n += uint64(s.Size)
+	}
+	return
+}
@@ -0,0 +1,82 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package meta
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestListDeleted(t *testing.T) {
+	m, err := NewRedisMeta("redis://127.0.0.1/15", &RedisConfig{})
+	if err != nil {
+		t.Logf("redis is not available: %s", err)
+		t.Skip()
+	}
+	m.(*redisMeta).rdb.FlushDB(Background)
+	testListDeleted(t, m)
+}
+
+func testListDeleted(t *testing.T, m Meta) {
+	if err := m.Init(Format{Name: "test"}, false); err != nil {
+		t.Fatalf("init: %s", err)
+	}
+	m.OnMsg(DeleteChunk, func(args ...interface{}) error {
+		return errors.New("object storage is not available")
+	})
+	_ = m.NewSession()
+	ctx := Background
+	var inode Ino
+	var attr Attr
+	if st := m.Create(ctx, 1, "f", 0644, 0, &inode, &attr); st != 0 {
+		t.Fatalf("create: %s", st)
+	}
+	if st := m.Write(ctx, inode, 0, 0, Slice{Chunkid: 10, Size: 100, Len: 100}); st != 0 {
+		t.Fatalf("write: %s", st)
+	}
+	// the file is opened by Create
+	if st := m.Unlink(ctx, 1, "f"); st != 0 {
+		t.Fatalf("unlink: %s", st)
+	}
+	var b Backlog
+	if st := m.ListDeleted(ctx, true, &b); st != 0 {
+		t.Fatalf("list deleted: %s", st)
+	}
+	if len(b.Files) != 1 || !b.Files[0].Opened || b.Files[0].Length != 100 || len(b.Files[0].Slices) != 1 || b.Files[0].Slices[0].Chunkid != 10 {
+		t.Fatalf("opened file: %+v", b)
+	}
+	if removed, opened := b.FileBytes(); removed != 0 || opened != 100 || len(b.Released) != 0 {
+		t.Fatalf("backlog: %+v", b)
+	}
+
+	// the slice is kept after the file is deleted, because it can't be deleted from object storage
+	if st := m.Close(ctx, inode); st != 0 {
+		t.Fatalf("close: %s", st)
+	}
+	for i := 0; i < 50; i++ {
+		if st := m.ListDeleted(ctx, false, &b); st != 0 {
+			t.Fatalf("list deleted: %s", st)
+		}
+		if len(b.Files) == 0 && len(b.Released) == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+	if len(b.Files) != 0 || len(b.Released) != 1 || b.Released[0].Chunkid != 10 || b.ReleasedBytes() != 100 {
+		t.Fatalf("released: %+v", b)
+	}
+}
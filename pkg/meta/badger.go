@@ -0,0 +1,149 @@
+// +build badger
+
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package meta
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+	"runtime"
+
+	"github.com/dgraph-io/badger/v2"
+)
+
+type badgerTxn struct {
+	t *badger.Txn
+}
+
+func (tx *badgerTxn) get(key []byte) []byte {
+	item, err := tx.t.Get(key)
+	if err == badger.ErrKeyNotFound {
+		return nil
+	}
+	if err != nil {
+		panic(err)
+	}
+	value, err := item.ValueCopy(nil)
+	if err != nil {
+		panic(err)
+	}
+	if value == nil {
+		value = []byte{}
+	}
+	return value
+}
+
+func (tx *badgerTxn) gets(keys ...[]byte) [][]byte {
+	values := make([][]byte, len(keys))
+	for i, key := range keys {
+		values[i] = tx.get(key)
+	}
+	return values
+}
+
+func (tx *badgerTxn) scanRange(begin, end []byte, limit int) ([][]byte, [][]byte) {
+	it := tx.t.NewIterator(badger.DefaultIteratorOptions)
+	defer it.Close()
+	var keys, values [][]byte
+	for it.Seek(begin); it.Valid(); it.Next() {
+		item := it.Item()
+		if end != nil && bytes.Compare(item.Key(), end) >= 0 {
+			break
+		}
+		value, err := item.ValueCopy(nil)
+		if err != nil {
+			panic(err)
+		}
+		if value == nil {
+			value = []byte{}
+		}
+		keys = append(keys, item.KeyCopy(nil))
+		values = append(values, value)
+		if limit > 0 && len(keys) >= limit {
+			break
+		}
+	}
+	return keys, values
+}
+
+func (tx *badgerTxn) set(key, value []byte) {
+	if err := tx.t.Set(key, value); err != nil {
+		panic(err)
+	}
+}
+
+func (tx *badgerTxn) dels(keys ...[]byte) {
+	for _, key := range keys {
+		if err := tx.t.Delete(key); err != nil {
+			panic(err)
+		}
+	}
+}
+
+type badgerClient struct {
+	db *badger.DB
+}
+
+func (c *badgerClient) name() string {
+	return "badger"
+}
+
+func (c *badgerClient) txn(f func(kvTxn) error) (err error) {
+	t := c.db.NewTransaction(true)
+	defer t.Discard()
+	defer func() {
+		if r := recover(); r != nil {
+			if _, ok := r.(runtime.Error); ok {
+				panic(r)
+			}
+			fe, ok := r.(error)
+			if !ok {
+				panic(r)
+			}
+			err = fe
+		}
+	}()
+	if err = f(&badgerTxn{t}); err != nil {
+		return err
+	}
+	if err = t.Commit(); err == badger.ErrConflict {
+		err = errTxnConflict
+	}
+	return err
+}
+
+// newBadgerMeta returns a meta store using an embedded BadgerDB, the URL is like
+// badger:///path/to/dir, it can only be used by a single process.
+func newBadgerMeta(addr string, conf *RedisConfig) (Meta, error) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, fmt.Errorf("parse %s: %s", addr, err)
+	}
+	if u.Path == "" {
+		return nil, fmt.Errorf("no directory in %s", addr)
+	}
+	db, err := badger.Open(badger.DefaultOptions(u.Path).WithLogger(logger))
+	if err != nil {
+		return nil, fmt.Errorf("open badger %s: %s", u.Path, err)
+	}
+	return newKVMeta(&badgerClient{db}, conf), nil
+}
+
+func init() {
+	Register("badger", newBadgerMeta)
+}
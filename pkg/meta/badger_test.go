@@ -0,0 +1,43 @@
+// +build badger
+
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package meta
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestBadgerClient(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	if err != nil {
+		t.Fatalf("temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	m, err := NewClient("badger://"+dir, &RedisConfig{})
+	if err != nil {
+		t.Fatalf("open badger: %s", err)
+	}
+	testMetaClient(t, m)
+	testCopyFileRange(t, m)
+	testInlineData(t, m)
+	testPackedBlocks(t, m)
+	testExternalChunks(t, m)
+	testConsistency(t, m)
+	testFragmentation(t, m)
+}
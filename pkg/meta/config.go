@@ -15,6 +15,29 @@
 
 package meta
 
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/jobs"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// passphraseEnv is the environment variable holding the passphrase to encrypt
+// the secret keys in format.
+const passphraseEnv = "JFS_META_PASSPHRASE"
+
 type Config struct {
 	Addr      string
 	Password  string
@@ -32,4 +55,280 @@ type Format struct {
 	Compression string
 	Partitions  int
 	EncryptKey  string
+	PackSize    int
+	InlineSize  int
+	Dedup       bool   // the blocks with the same content are stored once
+	Capacity    uint64 // max bytes of data, 0 means unlimited
+
+	MaxNameLength int  // max bytes of a new name, 0 means 255 (the limit of all volumes)
+	UTF8Names     bool // new names must be valid UTF-8
+	WindowsNames  bool // new names must be valid on Windows
+
+	CaseInsensitive bool // names are case-insensitive but case-preserving
+	NameIndex       bool // maintain an index of all the names to find files
+	DirShards       bool // split the entries of huge directories into shards (Redis only)
+
+	ReplicaStorage   string
+	ReplicaBucket    string
+	ReplicaAccessKey string
+	ReplicaSecretKey string
+
+	KeyEncrypted bool // SecretKey and ReplicaSecretKey are encrypted with passphrase
+
+	TokenHash         string // SHA256 of the token for read-write access
+	ReadOnlyTokenHash string // SHA256 of the token for read-only access
+
+	AllowedNetworks []string // CIDRs of the clients which can create sessions, empty means any
+
+	HoldDeletionUntil int64 // unix time until which no data is deleted, set during backup
+
+	VersionDays int // days to keep the previous versions of files, 0 means not kept
+
+	MetaVersion int // version of the metadata, see MetaVersion
+
+	Features      []string // enabled features needed to access the volume, see SetFeatures
+	WriteFeatures []string // enabled features needed to modify the volume
+}
+
+// HashToken returns the hash of an access token to be stored in format.
+func HashToken(token string) string {
+	if token == "" {
+		return ""
+	}
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:])
+}
+
+// checkToken validates the token of a client, returns whether the client can
+// only read the volume. Any client can access the volume if no token is set.
+// It's checked by the client, so it doesn't stop anyone accessing the metadata
+// engine directly.
+func (f *Format) checkToken(token string) (readOnly bool, err error) {
+	if f.TokenHash == "" && f.ReadOnlyTokenHash == "" {
+		return false, nil
+	}
+	if token == "" {
+		return false, fmt.Errorf("token is required to access volume %s", f.Name)
+	}
+	h := []byte(HashToken(token))
+	if f.TokenHash != "" && subtle.ConstantTimeCompare(h, []byte(f.TokenHash)) == 1 {
+		return false, nil
+	}
+	if f.ReadOnlyTokenHash != "" && subtle.ConstantTimeCompare(h, []byte(f.ReadOnlyTokenHash)) == 1 {
+		return true, nil
+	}
+	return false, fmt.Errorf("invalid token for volume %s", f.Name)
+}
+
+// checkTokenChange returns an error if the tokens are changed from f to n without the read-write
+// token of f, they can be changed by anyone if f has no read-write token.
+func (f *Format) checkTokenChange(n *Format, token string) error {
+	if f.TokenHash == "" || f.TokenHash == n.TokenHash && f.ReadOnlyTokenHash == n.ReadOnlyTokenHash {
+		return nil
+	}
+	if readOnly, err := f.checkToken(token); err != nil || readOnly {
+		return fmt.Errorf("the read-write token of volume %s is required to change its tokens", f.Name)
+	}
+	return nil
+}
+
+// ParseNetworks parses the CIDRs of networks, a single IP is a network of itself.
+func ParseNetworks(cidrs []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, c := range cidrs {
+		if !strings.Contains(c, "/") {
+			ip := net.ParseIP(c)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid network: %s", c)
+			}
+			if ip.To4() != nil {
+				c += "/32"
+			} else {
+				c += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network: %s", c)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// checkNetwork validates the address of a client seen by the metadata engine against
+// the allowed networks, any client is allowed if no network is set.
+func (f *Format) checkNetwork(addr string) error {
+	if len(f.AllowedNetworks) == 0 {
+		return nil
+	}
+	nets, err := ParseNetworks(f.AllowedNetworks)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(addr); ip != nil {
+		for _, n := range nets {
+			if n.Contains(ip) {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("client %s is not in the allowed networks of volume %s", addr, f.Name)
+}
+
+// the jobs which delete data from object storage
+var deletionJobs = []string{jobs.Deletion, jobs.Compaction, jobs.Cleanup, jobs.Defrag}
+
+// holdDeletion holds the jobs which delete data from object storage until the time in format,
+// returns whether none of them is running, then the hold is in effect.
+func (f *Format) holdDeletion() bool {
+	var until time.Time
+	if f.HoldDeletionUntil > 0 {
+		until = time.Unix(f.HoldDeletionUntil, 0)
+	}
+	jobs.Hold(until, deletionJobs...)
+	return jobs.Running(deletionJobs...) == 0
+}
+
+// RemoveSecret hides all the secrets, so the format can be printed.
+func (f *Format) RemoveSecret() {
+	if f.SecretKey != "" {
+		f.SecretKey = "removed"
+	}
+	if f.ReplicaSecretKey != "" {
+		f.ReplicaSecretKey = "removed"
+	}
+	if f.EncryptKey != "" {
+		f.EncryptKey = "removed"
+	}
+	if f.TokenHash != "" {
+		f.TokenHash = "removed"
+	}
+	if f.ReadOnlyTokenHash != "" {
+		f.ReadOnlyTokenHash = "removed"
+	}
+}
+
+// The settings which can be changed for an existing volume, the others can't be changed
+// safely, since the existing files depend on them.
+var (
+	// refreshed by the clients with the session
+	onlineSettings = map[string]bool{"Capacity": true, "MaxNameLength": true, "UTF8Names": true, "WindowsNames": true}
+	// used when the clients are mounted
+	restartSettings = map[string]bool{"AccessKey": true, "SecretKey": true, "KeyEncrypted": true,
+		"TokenHash": true, "ReadOnlyTokenHash": true, "AllowedNetworks": true}
+)
+
+// FormatChange is a setting changed in format.
+type FormatChange struct {
+	Name     string
+	Old, New interface{}
+	Restart  bool // the running clients use the old one until they're restarted
+	Unsafe   bool // it can't be changed for an existing volume
+}
+
+// Diff returns the settings changed from f to n, the secrets are removed.
+func (f *Format) Diff(n *Format) []FormatChange {
+	of, nf := *f, *n
+	of.RemoveSecret()
+	nf.RemoveSecret()
+	oldV, newV := reflect.ValueOf(*f), reflect.ValueOf(*n)
+	var changes []FormatChange
+	for i := 0; i < oldV.NumField(); i++ {
+		a, b := oldV.Field(i), newV.Field(i)
+		if reflect.DeepEqual(a.Interface(), b.Interface()) || a.Kind() == reflect.Slice && a.Len() == 0 && b.Len() == 0 {
+			continue
+		}
+		name := oldV.Type().Field(i).Name
+		changes = append(changes, FormatChange{
+			Name:    name,
+			Old:     reflect.ValueOf(of).Field(i).Interface(),
+			New:     reflect.ValueOf(nf).Field(i).Interface(),
+			Restart: restartSettings[name],
+			Unsafe:  !onlineSettings[name] && !restartSettings[name],
+		})
+	}
+	return changes
+}
+
+func newSecretCipher(passphrase string, salt []byte) (cipher.AEAD, error) {
+	if passphrase == "" {
+		return nil, fmt.Errorf("secret keys are encrypted, but %s is not set", passphraseEnv)
+	}
+	key := pbkdf2.Key([]byte(passphrase), salt, 10000, 32, sha256.New)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func encryptSecret(passphrase, secret string) (string, error) {
+	if secret == "" {
+		return "", nil
+	}
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	aead, err := newSecretCipher(passphrase, salt)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	buf := append(salt, nonce...)
+	return base64.StdEncoding.EncodeToString(aead.Seal(buf, nonce, []byte(secret), nil)), nil
+}
+
+func decryptSecret(passphrase, secret string) (string, error) {
+	if secret == "" {
+		return "", nil
+	}
+	buf, err := base64.StdEncoding.DecodeString(secret)
+	if err != nil || len(buf) < 16 {
+		return "", fmt.Errorf("invalid encrypted secret")
+	}
+	aead, err := newSecretCipher(passphrase, buf[:16])
+	if err != nil {
+		return "", err
+	}
+	buf = buf[16:]
+	if len(buf) < aead.NonceSize() {
+		return "", fmt.Errorf("invalid encrypted secret")
+	}
+	plain, err := aead.Open(nil, buf[:aead.NonceSize()], buf[aead.NonceSize():], nil)
+	if err != nil {
+		return "", fmt.Errorf("decrypt secret: wrong passphrase?")
+	}
+	return string(plain), nil
+}
+
+// encryptSecrets encrypts the secret keys using the passphrase from environment
+// variable if KeyEncrypted is set, before it's stored into meta engine.
+func (f *Format) encryptSecrets() (err error) {
+	if !f.KeyEncrypted {
+		return nil
+	}
+	passphrase := os.Getenv(passphraseEnv)
+	if f.SecretKey, err = encryptSecret(passphrase, f.SecretKey); err != nil {
+		return err
+	}
+	f.ReplicaSecretKey, err = encryptSecret(passphrase, f.ReplicaSecretKey)
+	return err
+}
+
+// decryptSecrets decrypts the secret keys loaded from meta engine.
+func (f *Format) decryptSecrets() (err error) {
+	if !f.KeyEncrypted {
+		return nil
+	}
+	passphrase := os.Getenv(passphraseEnv)
+	if f.SecretKey, err = decryptSecret(passphrase, f.SecretKey); err != nil {
+		return err
+	}
+	f.ReplicaSecretKey, err = decryptSecret(passphrase, f.ReplicaSecretKey)
+	return err
 }
@@ -0,0 +1,326 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package meta
+
+import (
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestEncryptSecrets(t *testing.T) {
+	defer os.Unsetenv(passphraseEnv)
+	os.Setenv(passphraseEnv, "passphrase")
+	m := newMemClient(t)
+	format := Format{Name: "test", SecretKey: "secret", ReplicaSecretKey: "replica", KeyEncrypted: true}
+	if err := m.Init(format, false); err != nil {
+		t.Fatalf("init: %s", err)
+	}
+	body, err := m.(*kvMeta).get(m.(*kvMeta).fmtKey("setting"))
+	if err != nil || strings.Contains(string(body), "secret") || strings.Contains(string(body), "replica") {
+		t.Fatalf("secret keys are not encrypted: %s %s", body, err)
+	}
+	f, err := m.Load()
+	if err != nil || f.SecretKey != "secret" || f.ReplicaSecretKey != "replica" {
+		t.Fatalf("load: %+v %s", f, err)
+	}
+	f.SecretKey = "secret2"
+	if err = m.UpdateFormat(*f); err != nil {
+		t.Fatalf("update format: %s", err)
+	}
+	if f, err = m.Load(); err != nil || f.SecretKey != "secret2" {
+		t.Fatalf("load: %+v %s", f, err)
+	}
+	if err = m.Init(*f, false); err != nil {
+		t.Fatalf("format again: %s", err)
+	}
+
+	os.Setenv(passphraseEnv, "wrong")
+	if _, err = m.Load(); err == nil {
+		t.Fatalf("load with wrong passphrase should fail")
+	}
+	os.Unsetenv(passphraseEnv)
+	if _, err = m.Load(); err == nil {
+		t.Fatalf("load without passphrase should fail")
+	}
+
+	f.RemoveSecret()
+	if f.SecretKey != "removed" || f.ReplicaSecretKey != "removed" || f.EncryptKey != "" {
+		t.Fatalf("remove secret: %+v", f)
+	}
+}
+
+func TestInitKeepRoot(t *testing.T) {
+	m := newMemClient(t)
+	if err := m.Init(Format{Name: "test"}, false); err != nil {
+		t.Fatalf("init: %s", err)
+	}
+	ctx := Background
+	attr := &Attr{Mode: 0750}
+	if st := m.SetAttr(ctx, 1, SetAttrMode, 0, attr); st != 0 {
+		t.Fatalf("setattr: %s", st)
+	}
+	if err := m.Init(Format{Name: "test"}, false); err != nil {
+		t.Fatalf("init again: %s", err)
+	}
+	if st := m.GetAttr(ctx, 1, attr); st != 0 || attr.Mode != 0750 {
+		t.Fatalf("root inode is reset: mode %o %s", attr.Mode, st)
+	}
+}
+
+func TestAccessToken(t *testing.T) {
+	m := newMemClient(t).(*kvMeta)
+	format := Format{Name: "test", TokenHash: HashToken("rw"), ReadOnlyTokenHash: HashToken("ro")}
+	if err := m.Init(format, false); err != nil {
+		t.Fatalf("init: %s", err)
+	}
+	if err := m.NewSession(); err == nil {
+		t.Fatalf("session without token should be rejected")
+	}
+	m.conf.Token = "bad"
+	if err := m.loadSetting(true); err == nil {
+		t.Fatalf("invalid token should be rejected")
+	}
+
+	m.conf.Token = "ro"
+	if err := m.NewSession(); err != nil {
+		t.Fatalf("session with read-only token: %s", err)
+	}
+	ctx := Background
+	var inode Ino
+	var attr = &Attr{}
+	if st := m.Mkdir(ctx, 1, "d", 0755, 0, 0, &inode, attr); st != syscall.EROFS {
+		t.Fatalf("mkdir with read-only token: %s", st)
+	}
+	if st := m.GetAttr(ctx, 1, attr); st != 0 {
+		t.Fatalf("getattr with read-only token: %s", st)
+	}
+	if st := m.Open(ctx, 1, syscall.O_RDWR, attr); st != syscall.EROFS {
+		t.Fatalf("open for write with read-only token: %s", st)
+	}
+
+	m.conf.Token = "rw"
+	if err := m.loadSetting(true); err != nil {
+		t.Fatalf("read-write token: %s", err)
+	}
+	if st := m.Mkdir(ctx, 1, "d", 0755, 0, 0, &inode, attr); st != 0 {
+		t.Fatalf("mkdir with read-write token: %s", st)
+	}
+
+	// the tokens can be changed only with the read-write token
+	format.TokenHash = ""
+	for _, token := range []string{"", "ro"} {
+		m.conf.Token = token
+		if err := m.Init(format, false); err == nil {
+			t.Fatalf("tokens should not be changed with token %q", token)
+		}
+		if err := m.Init(format, true); err == nil {
+			t.Fatalf("tokens should not be overwritten with token %q", token)
+		}
+	}
+	m.conf.Token = "rw"
+	if err := m.Init(format, false); err != nil {
+		t.Fatalf("change tokens with read-write token: %s", err)
+	}
+	if f, err := m.Load(); err != nil || f.TokenHash != "" || f.ReadOnlyTokenHash != HashToken("ro") {
+		t.Fatalf("tokens are not changed: %+v %s", f, err)
+	}
+}
+
+func TestFormatDiff(t *testing.T) {
+	old := Format{Name: "test", BlockSize: 4096, SecretKey: "secret", Capacity: 1 << 30}
+	if changes := old.Diff(&old); len(changes) != 0 {
+		t.Fatalf("no change expected: %+v", changes)
+	}
+	n := old
+	n.BlockSize = 1024
+	n.SecretKey = "secret2"
+	n.Capacity = 2 << 30
+	n.AllowedNetworks = []string{}
+	changes := old.Diff(&n)
+	if len(changes) != 3 {
+		t.Fatalf("expect 3 changes: %+v", changes)
+	}
+	for _, ch := range changes {
+		switch ch.Name {
+		case "BlockSize":
+			if !ch.Unsafe || ch.Restart || ch.Old != 4096 || ch.New != 1024 {
+				t.Fatalf("block size: %+v", ch)
+			}
+		case "SecretKey":
+			if ch.Unsafe || !ch.Restart || ch.Old != "removed" || ch.New != "removed" {
+				t.Fatalf("secret key: %+v", ch)
+			}
+		case "Capacity":
+			if ch.Unsafe || ch.Restart {
+				t.Fatalf("capacity: %+v", ch)
+			}
+		default:
+			t.Fatalf("unexpected change: %+v", ch)
+		}
+	}
+}
+
+func TestMetaVersion(t *testing.T) {
+	m := newMemClient(t).(*kvMeta)
+	if err := m.Init(Format{Name: "test"}, false); err != nil {
+		t.Fatalf("init: %s", err)
+	}
+	if err := Upgrade(m); err != nil {
+		t.Fatalf("upgrade: %s", err)
+	}
+	format, err := m.Load()
+	if err != nil || format.MetaVersion != MetaVersion {
+		t.Fatalf("version after upgrade: %+v %s", format, err)
+	}
+	if len(PendingMigrations(format.MetaVersion)) != 0 || len(PendingMigrations(0)) != MetaVersion {
+		t.Fatalf("pending migrations: %+v", PendingMigrations(0))
+	}
+
+	format.MetaVersion = MetaVersion + 1
+	if err = m.UpdateFormat(*format); err != nil {
+		t.Fatalf("update format: %s", err)
+	}
+	if err = m.NewSession(); err == nil {
+		t.Fatalf("newer metadata should be refused")
+	}
+	if err = Upgrade(m); err == nil {
+		t.Fatalf("newer metadata should not be upgraded")
+	}
+	m.conf.ReadOnly = true
+	if err = m.loadSetting(true); err != nil || !m.readOnly {
+		t.Fatalf("newer metadata can be read: %s", err)
+	}
+
+	// upgraded by others after mounted
+	m.conf.ReadOnly = false
+	format.MetaVersion = MetaVersion
+	_ = m.UpdateFormat(*format)
+	if err = m.loadSetting(true); err != nil || m.readOnly {
+		t.Fatalf("load setting: %s", err)
+	}
+	format.MetaVersion = MetaVersion + 1
+	_ = m.UpdateFormat(*format)
+	if err = m.loadSetting(false); err != nil || !m.readOnly {
+		t.Fatalf("client should become read-only: %s", err)
+	}
+	var inode Ino
+	if st := m.Mkdir(Background, 1, "d", 0755, 0, 0, &inode, &Attr{}); st != syscall.EROFS {
+		t.Fatalf("mkdir with newer metadata: %s", st)
+	}
+}
+
+func TestRecordUsedFeatures(t *testing.T) {
+	m := newMemClient(t).(*kvMeta)
+	if err := m.Init(Format{Name: "test", MetaVersion: 2}, false); err != nil {
+		t.Fatalf("init: %s", err)
+	}
+	ctx := Background
+	var inode Ino
+	if st := m.Mkdir(ctx, 1, "d", 0755, 0, 0, &inode, &Attr{}); st != 0 {
+		t.Fatalf("mkdir: %s", st)
+	}
+	if st := m.SetXattr(ctx, inode, projectXattr, []byte("1")); st != 0 {
+		t.Fatalf("set project: %s", st)
+	}
+	// set by the clients before the features are recorded
+	format, _ := m.Load()
+	format.WriteFeatures = nil
+	_ = m.UpdateFormat(*format)
+	if err := Upgrade(m); err != nil {
+		t.Fatalf("upgrade: %s", err)
+	}
+	format, err := m.Load()
+	if err != nil || format.MetaVersion != 3 || len(format.WriteFeatures) != 1 || format.WriteFeatures[0] != FeatureProjects {
+		t.Fatalf("features after upgrade: %+v %s", format, err)
+	}
+}
+
+func TestFeatures(t *testing.T) {
+	m := newMemClient(t).(*kvMeta)
+	format := Format{Name: "test", Dedup: true, NameIndex: true}
+	if err := m.Init(format, false); err != nil {
+		t.Fatalf("init: %s", err)
+	}
+	if err := Upgrade(m); err != nil {
+		t.Fatalf("upgrade: %s", err)
+	}
+	f, err := m.Load()
+	if err != nil || len(f.Features) != 1 || f.Features[0] != FeatureDedup ||
+		len(f.WriteFeatures) != 1 || f.WriteFeatures[0] != FeatureNameIndex {
+		t.Fatalf("features after upgrade: %+v %s", f, err)
+	}
+	if err = m.NewSession(); err != nil {
+		t.Fatalf("new session: %s", err)
+	}
+	sessions, err := m.ListSessions()
+	if err != nil || len(sessions) != 1 || len(sessions[0].Features) != len(SupportedFeatures) {
+		t.Fatalf("features of session: %+v %s", sessions, err)
+	}
+
+	// unknown features needed to write
+	f.WriteFeatures = append(f.WriteFeatures, "future")
+	_ = m.UpdateFormat(*f)
+	if err = m.loadSetting(true); err == nil {
+		t.Fatalf("unknown write feature should be refused")
+	}
+	m.conf.ReadOnly = true
+	if err = m.loadSetting(true); err != nil {
+		t.Fatalf("unknown write feature can be read: %s", err)
+	}
+	m.conf.ReadOnly = false
+	f.WriteFeatures = f.WriteFeatures[:1]
+	_ = m.UpdateFormat(*f)
+	if err = m.loadSetting(true); err != nil || m.readOnly {
+		t.Fatalf("load setting: %s", err)
+	}
+	f.WriteFeatures = append(f.WriteFeatures, "future")
+	_ = m.UpdateFormat(*f)
+	if err = m.loadSetting(false); err != nil || !m.readOnly {
+		t.Fatalf("client should become read-only: %s", err)
+	}
+
+	// unknown features needed to read
+	f.Features = append(f.Features, "future")
+	_ = m.UpdateFormat(*f)
+	if err = m.loadSetting(true); err == nil {
+		t.Fatalf("unknown feature should be refused even for read-only client")
+	}
+}
+
+func TestDirShardsFeature(t *testing.T) {
+	f := Format{Name: "test", DirShards: true}
+	f.SetFeatures()
+	if len(f.Features) != 1 || f.Features[0] != FeatureDirShards {
+		t.Fatalf("features: %+v", f.Features)
+	}
+	if err := f.checkCompat(false); err != nil {
+		t.Fatalf("check: %s", err)
+	}
+	// a client without sharding can't read the huge directories
+	old := SupportedFeatures
+	defer func() { SupportedFeatures = old }()
+	SupportedFeatures = nil
+	for _, name := range old {
+		if name != FeatureDirShards {
+			SupportedFeatures = append(SupportedFeatures, name)
+		}
+	}
+	if err := f.checkCompat(true); err == nil {
+		t.Fatalf("volume with directory shards should be refused")
+	}
+}
@@ -0,0 +1,276 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package meta
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+)
+
+// The operations are checked against a model of the namespace in a few
+// directories, the history is linearizable if there is an order of the
+// operations, which respects their real time order, and the result of every
+// operation is the same as the model in that order. It catches the bugs like
+// lost updates in the retry loops of transactions.
+
+const (
+	modelDirs  = 2
+	modelNames = 3
+)
+
+var modelNameList = [modelNames]string{"a", "b", "c"}
+
+// fsModel is the inode of every name in the directories, zero if it does not exist.
+type fsModel [modelDirs * modelNames]Ino
+
+type histOp struct {
+	kind     string // create, unlink, rename, lookup or list
+	src, dst int    // index in fsModel, dst is the directory for list
+	inv, res int64  // the logical time when it's invoked and returned
+	st       syscall.Errno
+	inode    Ino
+	entries  map[int]Ino // for list
+}
+
+func (o *histOp) String() string {
+	name := func(k int) string { return fmt.Sprintf("d%d/%s", k/modelNames, modelNameList[k%modelNames]) }
+	var s string
+	switch o.kind {
+	case "rename":
+		s = fmt.Sprintf("rename %s %s", name(o.src), name(o.dst))
+	case "list":
+		s = fmt.Sprintf("list d%d %v", o.dst, o.entries)
+	default:
+		s = fmt.Sprintf("%s %s", o.kind, name(o.src))
+	}
+	return fmt.Sprintf("[%d,%d] %s: %s (%d)", o.inv, o.res, s, o.st, o.inode)
+}
+
+// apply returns the state after the operation if the result is consistent with the model.
+func (s fsModel) apply(o *histOp) (fsModel, bool) {
+	switch o.kind {
+	case "create":
+		if s[o.src] != 0 {
+			return s, o.st == syscall.EEXIST
+		}
+		s[o.src] = o.inode
+		return s, o.st == 0
+	case "unlink":
+		if s[o.src] == 0 {
+			return s, o.st == syscall.ENOENT
+		}
+		s[o.src] = 0
+		return s, o.st == 0
+	case "rename":
+		if s[o.src] == 0 {
+			return s, o.st == syscall.ENOENT
+		}
+		s[o.dst], s[o.src] = s[o.src], 0
+		return s, o.st == 0
+	case "lookup":
+		if s[o.src] == 0 {
+			return s, o.st == syscall.ENOENT
+		}
+		return s, o.st == 0 && o.inode == s[o.src]
+	case "list":
+		n := 0
+		for i := o.dst * modelNames; i < (o.dst+1)*modelNames; i++ {
+			if s[i] != 0 {
+				n++
+				if o.entries[i] != s[i] {
+					return s, false
+				}
+			}
+		}
+		return s, o.st == 0 && n == len(o.entries)
+	}
+	return s, false
+}
+
+// linearizable searches an order of operations (at most 63) which is consistent with the model.
+func linearizable(ops []*histOp) bool {
+	type state struct {
+		done  uint64
+		model fsModel
+	}
+	full := uint64(1)<<uint(len(ops)) - 1
+	failed := make(map[state]bool)
+	var search func(done uint64, s fsModel) bool
+	search = func(done uint64, s fsModel) bool {
+		if done == full {
+			return true
+		}
+		if failed[state{done, s}] {
+			return false
+		}
+		// any operation invoked before the first returned one could take effect first
+		var first int64 = math.MaxInt64
+		for i, o := range ops {
+			if done&(1<<uint(i)) == 0 && o.res < first {
+				first = o.res
+			}
+		}
+		for i, o := range ops {
+			if done&(1<<uint(i)) == 0 && o.inv < first {
+				if ns, ok := s.apply(o); ok && search(done|1<<uint(i), ns) {
+					return true
+				}
+			}
+		}
+		failed[state{done, s}] = true
+		return false
+	}
+	return search(0, fsModel{})
+}
+
+func TestLinearizable(t *testing.T) {
+	ops := []*histOp{
+		{kind: "create", src: 0, inv: 1, res: 4, inode: 10},
+		{kind: "create", src: 0, inv: 2, res: 3, st: syscall.EEXIST},
+		{kind: "rename", src: 0, dst: 4, inv: 5, res: 6},
+		{kind: "lookup", src: 4, inv: 7, res: 9, inode: 10},
+		{kind: "unlink", src: 4, inv: 8, res: 10},
+		{kind: "list", dst: 1, inv: 11, res: 12, entries: map[int]Ino{}},
+	}
+	if !linearizable(ops) {
+		t.Fatalf("history should be linearizable")
+	}
+	// the file is created twice, like a lost update
+	ops[1].st, ops[1].inode = 0, 11
+	if linearizable(ops) {
+		t.Fatalf("history with two successful creates should not be linearizable")
+	}
+	ops[1].st, ops[1].inode = syscall.EEXIST, 0
+	ops[5].entries = map[int]Ino{4: 10}
+	if linearizable(ops) {
+		t.Fatalf("history with an unlinked file in the final listing should not be linearizable")
+	}
+}
+
+// testConsistency runs concurrent create/rename/unlink/lookup in a few directories,
+// then checks that the history is linearizable, every meta engine should pass it.
+func testConsistency(t *testing.T, m Meta) {
+	_ = m.Init(Format{Name: "test"}, true)
+	if err := m.NewSession(); err != nil {
+		t.Fatalf("new session: %s", err)
+	}
+	ctx := Background
+	const workers, opsPerWorker, rounds = 4, 15, 20
+	for round := 0; round < rounds; round++ {
+		var top Ino
+		var attr Attr
+		name := fmt.Sprintf("consistency-%d", round)
+		if st := m.Mkdir(ctx, 1, name, 0755, 0, 0, &top, &attr); st != 0 {
+			t.Fatalf("mkdir %s: %s", name, st)
+		}
+		var dirs [modelDirs]Ino
+		for i := range dirs {
+			if st := m.Mkdir(ctx, top, fmt.Sprintf("d%d", i), 0755, 0, 0, &dirs[i], &attr); st != 0 {
+				t.Fatalf("mkdir d%d: %s", i, st)
+			}
+		}
+		entry := func(k int) (Ino, string) { return dirs[k/modelNames], modelNameList[k%modelNames] }
+
+		var clock int64
+		var mu sync.Mutex
+		var history []*histOp
+		var wg sync.WaitGroup
+		for w := 0; w < workers; w++ {
+			wg.Add(1)
+			go func(seed int64) {
+				defer wg.Done()
+				r := rand.New(rand.NewSource(seed))
+				for i := 0; i < opsPerWorker; i++ {
+					o := &histOp{src: r.Intn(len(fsModel{}))}
+					parent, name := entry(o.src)
+					var inode Ino
+					var attr Attr
+					o.inv = atomic.AddInt64(&clock, 1)
+					switch r.Intn(4) {
+					case 0:
+						o.kind = "create"
+						o.st = m.Create(ctx, parent, name, 0644, 0, &inode, &attr)
+					case 1:
+						o.kind = "unlink"
+						o.st = m.Unlink(ctx, parent, name)
+					case 2:
+						o.kind = "rename"
+						o.dst = (o.src + 1 + r.Intn(len(fsModel{})-1)) % len(fsModel{})
+						dparent, dname := entry(o.dst)
+						o.st = m.Rename(ctx, parent, name, dparent, dname, 0, &inode, &attr)
+					case 3:
+						o.kind = "lookup"
+						o.st = m.Lookup(ctx, parent, name, &inode, &attr)
+					}
+					o.res = atomic.AddInt64(&clock, 1)
+					if o.kind != "rename" && o.st == 0 {
+						o.inode = inode
+					}
+					mu.Lock()
+					history = append(history, o)
+					mu.Unlock()
+				}
+			}(int64(round*workers + w))
+		}
+		wg.Wait()
+
+		for i, dir := range dirs {
+			o := &histOp{kind: "list", dst: i, entries: make(map[int]Ino)}
+			o.inv = atomic.AddInt64(&clock, 1)
+			var entries []*Entry
+			o.st = m.Readdir(ctx, dir, 1, &entries)
+			o.res = atomic.AddInt64(&clock, 1)
+			for _, e := range entries {
+				n := string(e.Name)
+				if n == "." || n == ".." {
+					continue
+				}
+				k := strings.Index("abc", n)
+				if len(n) != 1 || k < 0 {
+					t.Fatalf("unexpected entry %s in d%d", n, i)
+				}
+				if e.Attr.Typ != TypeFile || e.Attr.Nlink != 1 {
+					t.Fatalf("entry %s in d%d: %+v", n, i, e.Attr)
+				}
+				o.entries[i*modelNames+k] = e.Inode
+			}
+			history = append(history, o)
+		}
+		if !linearizable(history) {
+			var lines []string
+			for _, o := range history {
+				lines = append(lines, o.String())
+			}
+			t.Fatalf("history of round %d is not linearizable:\n%s", round, strings.Join(lines, "\n"))
+		}
+	}
+}
+
+func TestConsistency(t *testing.T) {
+	m, err := NewRedisMeta("redis://127.0.0.1/15", &RedisConfig{})
+	if err != nil {
+		t.Logf("redis is not available: %s", err)
+		t.Skip()
+	}
+	m.(*redisMeta).rdb.FlushDB(Background)
+	testConsistency(t, m)
+}
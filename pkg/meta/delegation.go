@@ -0,0 +1,345 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package meta
+
+import (
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/utils"
+)
+
+// A delegation of a file is granted to a session by Delegate, a write delegation is exclusive
+// and a read delegation can be shared by sessions. The holder renews its delegations every
+// delegationInterval, and they expire after delegationTTL if the holder is gone. When a file
+// is opened by another session in a conflicting mode, the delegations are marked as recalled
+// and not renewed anymore, the holder is notified by a Recall message on the next renewal,
+// then it flushes the cached data and returns the delegation, and the opener waits for that
+// or the delegations to expire. If the holder can't renew a delegation, it drops the one
+// which is going to expire in delegationMargin and flushes the data before it expires.
+// A file appended by multiple sessions is delegated to them as DelegateAppend, which is
+// shared and never recalled, since they reserve the ranges to append instead of caching.
+const (
+	delegationInterval = time.Second
+	delegationTTL      = time.Second * 10
+	delegationMargin   = time.Second * 3
+)
+
+type delegation struct {
+	sid      uint64
+	ltype    uint8 // DelegateRead or DelegateWrite
+	recalled bool
+	expire   int64 // unix nano
+}
+
+func loadDelegations(buf []byte) []delegation {
+	var ds []delegation
+	rb := utils.ReadBuffer(buf)
+	for rb.HasMore() {
+		d := delegation{sid: rb.Get64(), ltype: rb.Get8(), recalled: rb.Get8() != 0}
+		d.expire = int64(rb.Get64())
+		ds = append(ds, d)
+	}
+	return ds
+}
+
+func dumpDelegations(ds []delegation) []byte {
+	w := utils.NewBuffer(uint32(len(ds) * 18))
+	for _, d := range ds {
+		w.Put64(d.sid)
+		w.Put8(d.ltype)
+		if d.recalled {
+			w.Put8(1)
+		} else {
+			w.Put8(0)
+		}
+		w.Put64(uint64(d.expire))
+	}
+	return w.Bytes()
+}
+
+// conflicts returns true if the delegation can't be held together with an access by another session.
+func (d *delegation) conflicts(sid uint64, write bool, now int64) bool {
+	return d.sid != sid && d.expire > now && (write || d.ltype != DelegateRead)
+}
+
+// cached returns true if the holder caches the data, which should be recalled before conflicting accesses.
+// The shared appenders (DelegateAppend) don't, they're never recalled.
+func (d *delegation) cached() bool {
+	return d.ltype != DelegateAppend
+}
+
+// delegationStore is implemented by the engines to keep the delegations of files.
+type delegationStore interface {
+	// updateDelegations replaces the delegations of a file with the result of f in a transaction.
+	updateDelegations(inode Ino, f func(ds []delegation) []delegation) error
+	newMsg(mid uint32, args ...interface{}) error
+}
+
+// delegations are the delegations held by the current session.
+type delegations struct {
+	sync.Mutex
+	held      map[Ino]uint8     // ltype
+	expire    map[Ino]time.Time // the last renewal (before the transaction) plus delegationTTL
+	appending map[Ino]bool      // requested with DelegateAppend, downgraded instead of returned after recalled
+	recalling map[Ino]bool
+	started   bool
+}
+
+func newDelegations() *delegations {
+	return &delegations{held: make(map[Ino]uint8), expire: make(map[Ino]time.Time), appending: make(map[Ino]bool),
+		recalling: make(map[Ino]bool)}
+}
+
+// delegate grants, upgrades or returns (DelegateNone) a delegation of the file to session sid.
+// For DelegateAppend, an exclusive write delegation is granted if there is no conflicting one,
+// otherwise the session is recorded as a shared appender after the conflicting ones are recalled,
+// and EAGAIN is returned.
+func (s *delegations) delegate(m delegationStore, sid uint64, inode Ino, ltype uint8) syscall.Errno {
+	if ltype != DelegateRead && ltype != DelegateWrite && ltype != DelegateAppend && ltype != DelegateNone {
+		return syscall.EINVAL
+	}
+	s.Lock()
+	if s.recalling[inode] && ltype != DelegateNone {
+		s.Unlock()
+		return syscall.EAGAIN
+	}
+	s.Unlock()
+	var conflicted bool
+	var granted uint8
+	start := time.Now()
+	err := m.updateDelegations(inode, func(ds []delegation) []delegation {
+		now := time.Now().UnixNano()
+		conflicted = false
+		var left []delegation
+		var own *delegation
+		for i, d := range ds {
+			if d.expire <= now {
+				continue
+			}
+			if d.sid == sid {
+				own = &ds[i]
+				continue
+			}
+			if ltype != DelegateNone && d.conflicts(sid, ltype != DelegateRead, now) {
+				d.recalled = d.cached()
+				conflicted = true
+			}
+			left = append(left, d)
+		}
+		granted = ltype
+		if ltype == DelegateAppend && !conflicted {
+			granted = DelegateWrite
+		}
+		if ltype == DelegateNone || conflicted && ltype != DelegateAppend {
+			if own != nil && ltype != DelegateNone {
+				left = append(left, *own) // keep the current one
+			}
+		} else {
+			left = append(left, delegation{sid: sid, ltype: granted, expire: now + int64(delegationTTL)})
+		}
+		return left
+	})
+	if err != nil {
+		return errno(err)
+	}
+	if conflicted && ltype != DelegateAppend {
+		// the conflicting ones are recalled, it could be granted after they're returned
+		return syscall.EAGAIN
+	}
+	s.Lock()
+	if ltype == DelegateNone {
+		delete(s.held, inode)
+		delete(s.expire, inode)
+		delete(s.appending, inode)
+		delete(s.recalling, inode)
+	} else {
+		s.held[inode] = granted
+		s.expire[inode] = start.Add(delegationTTL)
+		if ltype == DelegateAppend {
+			s.appending[inode] = true
+		}
+		if !s.started {
+			s.started = true
+			go s.renew(m, sid)
+		}
+	}
+	s.Unlock()
+	if conflicted {
+		// appended with others, after the exclusive one is downgraded
+		if st := s.recall(Background, m, sid, inode, true); st != 0 {
+			return st
+		}
+		return syscall.EAGAIN
+	}
+	return 0
+}
+
+// downgrade replaces the exclusive write delegation of an appending file with a shared one after
+// it's recalled and the cached data is flushed, so the file is still appended with the others.
+func (s *delegations) downgrade(m delegationStore, sid uint64, inode Ino) syscall.Errno {
+	start := time.Now()
+	err := m.updateDelegations(inode, func(ds []delegation) []delegation {
+		now := time.Now().UnixNano()
+		var left []delegation
+		for _, d := range ds {
+			if d.expire <= now || d.sid == sid {
+				continue
+			}
+			left = append(left, d)
+		}
+		return append(left, delegation{sid: sid, ltype: DelegateAppend, expire: now + int64(delegationTTL)})
+	})
+	if err != nil {
+		return errno(err)
+	}
+	s.Lock()
+	if s.appending[inode] {
+		s.held[inode] = DelegateAppend
+		s.expire[inode] = start.Add(delegationTTL)
+	}
+	delete(s.recalling, inode)
+	s.Unlock()
+	return 0
+}
+
+// recall recalls the delegations of other sessions conflicting with an open of the file,
+// and waits for them to be returned or expired, which are not renewed after recalled.
+func (s *delegations) recall(ctx Context, m delegationStore, sid uint64, inode Ino, write bool) syscall.Errno {
+	for {
+		var pending bool
+		err := m.updateDelegations(inode, func(ds []delegation) []delegation {
+			now := time.Now().UnixNano()
+			pending = false
+			var left []delegation
+			for _, d := range ds {
+				if d.expire <= now {
+					continue
+				}
+				if d.conflicts(sid, write, now) && d.cached() {
+					d.recalled = true
+					pending = true
+				}
+				left = append(left, d)
+			}
+			return left
+		})
+		if err != nil {
+			return errno(err)
+		}
+		if !pending {
+			return 0
+		}
+		if ctx.Canceled() {
+			return syscall.EINTR
+		}
+		time.Sleep(time.Millisecond * 50)
+	}
+}
+
+// renew extends the delegations held by the session every delegationInterval.
+func (s *delegations) renew(m delegationStore, sid uint64) {
+	for {
+		time.Sleep(delegationInterval)
+		s.renewAll(m, sid)
+	}
+}
+
+// renewAll extends the delegations held by the session, and returns the recalled ones after the
+// cached data is flushed by the callback of Recall message. The ones can't be renewed in time
+// are dropped after the data is flushed, before they expire and the files are opened by others.
+func (s *delegations) renewAll(m delegationStore, sid uint64) {
+	s.Lock()
+	inodes := make([]Ino, 0, len(s.held))
+	for inode := range s.held {
+		inodes = append(inodes, inode)
+	}
+	s.Unlock()
+	for _, inode := range inodes {
+		var recalled, lost bool
+		start := time.Now()
+		err := m.updateDelegations(inode, func(ds []delegation) []delegation {
+			now := time.Now().UnixNano()
+			lost = true
+			for i := range ds {
+				if ds[i].sid == sid && ds[i].expire > now {
+					lost = false
+					recalled = ds[i].recalled
+					if !recalled {
+						ds[i].expire = now + int64(delegationTTL)
+					}
+				}
+			}
+			return ds
+		})
+		s.Lock()
+		if err != nil {
+			logger.Warnf("renew delegation of inode %d: %s", inode, err)
+			expire, ok := s.expire[inode]
+			if !ok || s.recalling[inode] || s.held[inode] == DelegateAppend || time.Until(expire) > delegationMargin {
+				s.Unlock()
+				continue
+			}
+			logger.Warnf("delegation of inode %d is not renewed since %s, drop it", inode, expire.Add(-delegationTTL))
+			appending := s.appending[inode]
+			if appending {
+				s.held[inode] = DelegateAppend // registered again after the renewal works
+			} else {
+				delete(s.held, inode)
+				delete(s.expire, inode)
+			}
+			s.recalling[inode] = true
+			s.Unlock()
+			if err := m.newMsg(Recall, inode); err != nil {
+				logger.Warnf("flush file %d: %s", inode, err)
+			}
+			if appending || s.delegate(m, sid, inode, DelegateNone) != 0 {
+				s.Lock()
+				delete(s.recalling, inode) // it will be expired
+				s.Unlock()
+			}
+			continue
+		}
+		if lost && !s.appending[inode] {
+			logger.Warnf("delegation of inode %d is expired", inode)
+			delete(s.held, inode)
+			delete(s.expire, inode)
+		} else if !recalled && !lost {
+			s.expire[inode] = start.Add(delegationTTL)
+		}
+		if (recalled || lost) && !s.recalling[inode] {
+			s.recalling[inode] = true
+			go func(inode Ino) {
+				if err := m.newMsg(Recall, inode); err != nil {
+					logger.Warnf("recall delegation of inode %d: %s", inode, err)
+				}
+				s.Lock()
+				appending := s.appending[inode]
+				s.Unlock()
+				if !appending {
+					_ = s.delegate(m, sid, inode, DelegateNone)
+				} else if st := s.downgrade(m, sid, inode); st != 0 {
+					logger.Warnf("downgrade delegation of inode %d: %s", inode, st)
+					s.Lock()
+					delete(s.recalling, inode) // try again in the next renewal
+					s.Unlock()
+				}
+			}(inode)
+		}
+		s.Unlock()
+	}
+}
@@ -0,0 +1,226 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package meta
+
+import (
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestDelegation(t *testing.T) {
+	a, err := NewRedisMeta("redis://127.0.0.1/15", &RedisConfig{})
+	if err != nil {
+		t.Logf("redis is not available: %s", err)
+		t.Skip()
+	}
+	a.(*redisMeta).rdb.FlushDB(Background)
+	b, _ := NewRedisMeta("redis://127.0.0.1/15", &RedisConfig{})
+	testDelegation(t, a, b)
+	testAppendDelegation(t, a, b)
+}
+
+func TestKVDelegation(t *testing.T) {
+	a := newMemClient(t).(*kvMeta)
+	b := newKVMeta(a.client, a.conf)
+	testDelegation(t, a, b)
+	testAppendDelegation(t, a, b)
+}
+
+func TestDumpDelegations(t *testing.T) {
+	ds := []delegation{{1, DelegateRead, false, 100}, {2, DelegateWrite, true, 200}}
+	got := loadDelegations(dumpDelegations(ds))
+	if len(got) != 2 || got[0] != ds[0] || got[1] != ds[1] {
+		t.Fatalf("expect %+v, but got %+v", ds, got)
+	}
+	if loadDelegations(nil) != nil {
+		t.Fatalf("no delegations should be loaded from nil")
+	}
+}
+
+func testDelegation(t *testing.T, a, b Meta) {
+	_ = a.Init(Format{Name: "test"}, false)
+	setSid(a, 1)
+	setSid(b, 2)
+	ctx := Background
+	var inode Ino
+	var attr Attr
+	if st := a.Create(ctx, 1, "f", 0644, 0, &inode, &attr); st != 0 {
+		t.Fatalf("create: %s", st)
+	}
+	recalled := make(chan Ino, 1)
+	a.OnMsg(Recall, func(args ...interface{}) error {
+		recalled <- args[0].(Ino)
+		return nil
+	})
+	if st := a.Delegate(ctx, inode, 4); st != syscall.EINVAL {
+		t.Fatalf("invalid delegation: %s", st)
+	}
+	if st := a.Delegate(ctx, inode, DelegateWrite); st != 0 {
+		t.Fatalf("delegate write: %s", st)
+	}
+	if st := a.Delegate(ctx, inode, DelegateWrite); st != 0 {
+		t.Fatalf("delegate write again: %s", st)
+	}
+	if st := b.Delegate(ctx, inode, DelegateRead); st != syscall.EAGAIN {
+		t.Fatalf("delegate read should conflict: %s", st)
+	}
+	start := time.Now()
+	if st := b.Open(ctx, inode, syscall.O_RDONLY, &attr); st != 0 {
+		t.Fatalf("open: %s", st)
+	}
+	select {
+	case ino := <-recalled:
+		if ino != inode {
+			t.Fatalf("recalled inode %d, expect %d", ino, inode)
+		}
+	default:
+		t.Fatalf("open returns without recalling the delegation")
+	}
+	if time.Since(start) > delegationTTL {
+		t.Fatalf("open waits for %s", time.Since(start))
+	}
+	if st := b.Delegate(ctx, inode, DelegateRead); st != 0 {
+		t.Fatalf("delegate read after returned: %s", st)
+	}
+	if st := a.Delegate(ctx, inode, DelegateRead); st != 0 {
+		t.Fatalf("read delegations should be shared: %s", st)
+	}
+	if st := a.Delegate(ctx, inode, DelegateWrite); st != syscall.EAGAIN {
+		t.Fatalf("delegate write should conflict: %s", st)
+	}
+	if st := b.Delegate(ctx, inode, DelegateNone); st != 0 {
+		t.Fatalf("return delegation: %s", st)
+	}
+	_ = b.Close(ctx, inode)
+}
+
+type failingStore struct {
+	ds     []delegation
+	fail   bool
+	flushs int
+}
+
+func (f *failingStore) updateDelegations(inode Ino, fn func(ds []delegation) []delegation) error {
+	if f.fail {
+		return syscall.EIO
+	}
+	f.ds = fn(f.ds)
+	return nil
+}
+
+func (f *failingStore) newMsg(mid uint32, args ...interface{}) error {
+	f.flushs++
+	return nil
+}
+
+func TestDropUnrenewedDelegation(t *testing.T) {
+	m := &failingStore{}
+	s := newDelegations()
+	s.started = true // renewed by hand
+	if st := s.delegate(m, 1, 2, DelegateWrite); st != 0 {
+		t.Fatalf("delegate write: %s", st)
+	}
+	m.fail = true
+	s.renewAll(m, 1)
+	if m.flushs != 0 || s.held[2] == 0 {
+		t.Fatalf("delegation should be kept before it's going to expire")
+	}
+	s.expire[2] = time.Now().Add(delegationMargin - time.Second)
+	s.renewAll(m, 1)
+	if m.flushs != 1 {
+		t.Fatalf("data should be flushed before the delegation expires")
+	}
+	if s.held[2] != 0 || s.recalling[2] {
+		t.Fatalf("delegation should be dropped: %+v", s)
+	}
+
+	m.fail = false
+	if st := s.delegate(m, 1, 2, DelegateWrite); st != 0 {
+		t.Fatalf("delegate write again: %s", st)
+	}
+	m.ds[0].recalled = true
+	expire := m.ds[0].expire
+	s.renewAll(m, 1)
+	if m.ds[0].expire != expire {
+		t.Fatalf("recalled delegation should not be renewed")
+	}
+}
+
+func TestRecallWaitsForExpiration(t *testing.T) {
+	expire := time.Now().Add(time.Millisecond * 300)
+	m := &failingStore{ds: []delegation{{sid: 1, ltype: DelegateWrite, expire: expire.UnixNano()}}}
+	if st := newDelegations().recall(Background, m, 2, 3, false); st != 0 {
+		t.Fatalf("recall: %s", st)
+	}
+	if time.Now().Before(expire) {
+		t.Fatalf("recall returns before the delegation expires")
+	}
+	if len(m.ds) != 0 {
+		t.Fatalf("expired delegation should be removed: %+v", m.ds)
+	}
+}
+
+func testAppendDelegation(t *testing.T, a, b Meta) {
+	ctx := Background
+	var inode Ino
+	var attr Attr
+	if st := a.Create(ctx, 1, "log", 0644, 0, &inode, &attr); st != 0 {
+		t.Fatalf("create: %s", st)
+	}
+	recalled := make(chan Ino, 10)
+	a.OnMsg(Recall, func(args ...interface{}) error {
+		recalled <- args[0].(Ino)
+		return nil
+	})
+	if st := a.Delegate(ctx, inode, DelegateAppend); st != 0 {
+		t.Fatalf("the only appender should be exclusive: %s", st)
+	}
+	if st := b.Delegate(ctx, inode, DelegateAppend); st != syscall.EAGAIN {
+		t.Fatalf("appended by two sessions: %s", st)
+	}
+	select {
+	case <-recalled:
+	default:
+		t.Fatalf("exclusive appender should be recalled before the other appends")
+	}
+	if st := b.Delegate(ctx, inode, DelegateRead); st != syscall.EAGAIN {
+		t.Fatalf("delegate read of an appended file: %s", st)
+	}
+	if st := b.Open(ctx, inode, syscall.O_WRONLY, &attr); st != 0 {
+		t.Fatalf("open: %s", st)
+	}
+	time.Sleep(delegationInterval * 2)
+	select {
+	case <-recalled:
+		t.Fatalf("shared appender should not be recalled")
+	default:
+	}
+	if st := b.Delegate(ctx, inode, DelegateNone); st != 0 {
+		t.Fatalf("return delegation: %s", st)
+	}
+	if st := b.Delegate(ctx, inode, DelegateWrite); st != syscall.EAGAIN {
+		t.Fatalf("delegate write while appended by others: %s", st)
+	}
+	if st := a.Delegate(ctx, inode, DelegateNone); st != 0 {
+		t.Fatalf("return delegation: %s", st)
+	}
+	if st := a.Delegate(ctx, inode, DelegateAppend); st != 0 {
+		t.Fatalf("exclusive after the other appender is gone: %s", st)
+	}
+	_ = a.Delegate(ctx, inode, DelegateNone)
+	_ = b.Close(ctx, inode)
+}
@@ -0,0 +1,437 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package meta
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.etcd.io/etcd/clientv3"
+	"go.etcd.io/etcd/clientv3/namespace"
+	"go.etcd.io/etcd/etcdserver/api/v3rpc/rpctypes"
+)
+
+// etcdTxn implements optimistic transaction on top of etcd: all the reads are
+// from the same revision, the keys and ranges read are checked against the
+// revision when the writes are committed.
+//
+// Every change also updates the guard keys of the prefixes of the changed key
+// (see guardLevels), so a key deleted in a scanned range is detected by the
+// guard covering the range, and the keys read can be checked by their guards
+// when there are too many of them for one transaction of etcd.
+type etcdTxn struct {
+	ctx      context.Context
+	kv       clientv3.KV
+	maxOps   int
+	rev      int64
+	observed map[string]int64 // key -> mod revision
+	scanned  [][2]string      // ranges of keys
+	buffer   map[string][]byte
+}
+
+// guardPrefix is larger than the first byte of all the keys used by kvMeta.
+const guardPrefix = "\xfd"
+
+// guardLevels returns the lengths of the prefixes of keys starting with b that
+// have a guard: the first byte for all of them, the inode and its kind of keys
+// (A + inode + type) for the keys of inodes, or the first two bytes for others.
+func guardLevels(b byte) []int {
+	if b == 'A' {
+		return []int{1, 10}
+	}
+	return []int{1, 2}
+}
+
+// guardRange returns the guard key covering all the keys in [begin, end), or a
+// range of the guards of the first bytes if there is no such one.
+func guardRange(begin, end string) (string, string) {
+	if begin != "" && end != "" {
+		levels := guardLevels(begin[0])
+		for i := len(levels) - 1; i >= 0; i-- {
+			if levels[i] > len(begin) {
+				continue
+			}
+			next := nextKey([]byte(begin[:levels[i]]))
+			if next != nil && end <= string(next) {
+				return guardPrefix + begin[:levels[i]], ""
+			}
+		}
+	}
+	first, last := guardPrefix, string(nextKey([]byte(guardPrefix)))
+	if begin != "" {
+		first += begin[:1]
+	}
+	if end != "" && end[0] < 0xff {
+		last = guardPrefix + string([]byte{end[0] + 1})
+	}
+	return first, last
+}
+
+func (tx *etcdTxn) fetch(key string, opts ...clientv3.OpOption) *clientv3.GetResponse {
+	if tx.rev > 0 {
+		opts = append(opts, clientv3.WithRev(tx.rev))
+	}
+	resp, err := tx.kv.Get(tx.ctx, key, opts...)
+	if err != nil {
+		panic(err)
+	}
+	if tx.rev == 0 {
+		tx.rev = resp.Header.Revision
+	}
+	return resp
+}
+
+func (tx *etcdTxn) get(key []byte) []byte {
+	k := string(key)
+	if v, ok := tx.buffer[k]; ok {
+		return v
+	}
+	resp := tx.fetch(k)
+	if len(resp.Kvs) == 0 {
+		tx.observed[k] = 0
+		return nil
+	}
+	tx.observed[k] = resp.Kvs[0].ModRevision
+	if resp.Kvs[0].Value == nil {
+		return []byte{}
+	}
+	return resp.Kvs[0].Value
+}
+
+func (tx *etcdTxn) gets(keys ...[]byte) [][]byte {
+	values := make([][]byte, len(keys))
+	var ops []clientv3.Op
+	var idx []int
+	for i, key := range keys {
+		if v, ok := tx.buffer[string(key)]; ok {
+			values[i] = v
+			continue
+		}
+		var opts []clientv3.OpOption
+		if tx.rev > 0 {
+			opts = append(opts, clientv3.WithRev(tx.rev))
+		}
+		ops = append(ops, clientv3.OpGet(string(key), opts...))
+		idx = append(idx, i)
+	}
+	if len(ops) > 0 && tx.rev == 0 {
+		// pin the revision with the first key
+		values[idx[0]] = tx.get(keys[idx[0]])
+		ops, idx = ops[1:], idx[1:]
+		for i := range ops {
+			ops[i] = clientv3.OpGet(string(keys[idx[i]]), clientv3.WithRev(tx.rev))
+		}
+	}
+	for len(ops) > 0 {
+		n := len(ops)
+		if n > tx.maxOps {
+			n = tx.maxOps
+		}
+		resp, err := tx.kv.Txn(tx.ctx).Then(ops[:n]...).Commit()
+		if err != nil {
+			panic(err)
+		}
+		for j, r := range resp.Responses {
+			i := idx[j]
+			k := string(keys[i])
+			kvs := r.GetResponseRange().Kvs
+			if len(kvs) == 0 {
+				tx.observed[k] = 0
+				continue
+			}
+			tx.observed[k] = kvs[0].ModRevision
+			values[i] = kvs[0].Value
+			if values[i] == nil {
+				values[i] = []byte{}
+			}
+		}
+		ops, idx = ops[n:], idx[n:]
+	}
+	return values
+}
+
+func (tx *etcdTxn) scanRange(begin, end []byte, limit int) ([][]byte, [][]byte) {
+	if len(end) == 0 || string(end) > guardPrefix {
+		end = []byte(guardPrefix) // skip the guards
+	}
+	opts := []clientv3.OpOption{clientv3.WithRange(string(end))}
+	if limit > 0 {
+		opts = append(opts, clientv3.WithLimit(int64(limit)))
+	}
+	resp := tx.fetch(string(begin), opts...)
+	tx.scanned = append(tx.scanned, [2]string{string(begin), string(end)})
+	var keys, values [][]byte
+	for _, kv := range resp.Kvs {
+		if _, ok := tx.buffer[string(kv.Key)]; ok {
+			continue
+		}
+		keys = append(keys, kv.Key)
+		values = append(values, kv.Value)
+	}
+	// merge the uncommitted changes
+	for k, v := range tx.buffer {
+		if v == nil || k < string(begin) || end != nil && k >= string(end) {
+			continue
+		}
+		var i int
+		for i < len(keys) && string(keys[i]) < k {
+			i++
+		}
+		keys = append(keys[:i], append([][]byte{[]byte(k)}, keys[i:]...)...)
+		values = append(values[:i], append([][]byte{v}, values[i:]...)...)
+	}
+	if limit > 0 && len(keys) > limit {
+		keys, values = keys[:limit], values[:limit]
+	}
+	for i := range values {
+		if values[i] == nil {
+			values[i] = []byte{}
+		}
+	}
+	return keys, values
+}
+
+func (tx *etcdTxn) set(key, value []byte) {
+	if value == nil {
+		value = []byte{}
+	}
+	tx.buffer[string(key)] = value
+}
+
+func (tx *etcdTxn) dels(keys ...[]byte) {
+	for _, key := range keys {
+		tx.buffer[string(key)] = nil
+	}
+}
+
+// conditions returns the comparisons to check that nothing read is changed after
+// the snapshot, the keys read are checked by their guards if there are too many.
+func (tx *etcdTxn) conditions() []clientv3.Cmp {
+	ranges := make(map[[2]string]bool)
+	for _, r := range tx.scanned {
+		first, last := guardRange(r[0], r[1])
+		ranges[[2]string{first, last}] = true
+	}
+	var conds []clientv3.Cmp
+	if len(tx.observed)+len(ranges) <= tx.maxOps {
+		for k, rev := range tx.observed {
+			conds = append(conds, clientv3.Compare(clientv3.ModRevision(k), "=", rev))
+		}
+	} else {
+		for _, longest := range []bool{true, false} {
+			guards := make(map[[2]string]bool, len(ranges))
+			for r := range ranges {
+				guards[r] = true
+			}
+			for k := range tx.observed {
+				guards[[2]string{guardOf(k, longest), ""}] = true
+			}
+			if len(guards) <= tx.maxOps {
+				ranges = guards
+				break
+			}
+		}
+	}
+	if len(conds)+len(ranges) > tx.maxOps {
+		// all the guards
+		ranges = map[[2]string]bool{{guardPrefix, string(nextKey([]byte(guardPrefix)))}: true}
+	}
+	for r := range ranges {
+		cmp := clientv3.Compare(clientv3.ModRevision(r[0]), "<", tx.rev+1)
+		if r[1] != "" {
+			cmp = cmp.WithRange(r[1])
+		}
+		conds = append(conds, cmp)
+	}
+	return conds
+}
+
+// guardOf returns the longest (or shortest) guard of the key.
+func guardOf(key string, longest bool) string {
+	levels := guardLevels(key[0])
+	l := levels[0]
+	if longest {
+		for _, n := range levels {
+			if n <= len(key) {
+				l = n
+			}
+		}
+	}
+	return guardPrefix + key[:l]
+}
+
+// guardOps returns the puts to update the guards of the keys.
+func guardOps(keys []string) []clientv3.Op {
+	guards := make(map[string]bool)
+	for _, k := range keys {
+		for _, l := range guardLevels(k[0]) {
+			if l <= len(k) {
+				guards[guardPrefix+k[:l]] = true
+			}
+		}
+	}
+	ops := make([]clientv3.Op, 0, len(guards))
+	for g := range guards {
+		ops = append(ops, clientv3.OpPut(g, ""))
+	}
+	return ops
+}
+
+func (tx *etcdTxn) commit() error {
+	if len(tx.buffer) == 0 {
+		return nil
+	}
+	var ops []clientv3.Op
+	var keys []string
+	for k, v := range tx.buffer {
+		if v == nil {
+			ops = append(ops, clientv3.OpDelete(k))
+		} else {
+			ops = append(ops, clientv3.OpPut(k, string(v)))
+		}
+		keys = append(keys, k)
+	}
+	ops = append(ops, guardOps(keys)...)
+	if len(ops) > tx.maxOps {
+		return fmt.Errorf("too many operations in a transaction: %d > %d (max-txn-ops)", len(ops), tx.maxOps)
+	}
+	resp, err := tx.kv.Txn(tx.ctx).If(tx.conditions()...).Then(ops...).Commit()
+	if err != nil {
+		return err
+	}
+	if !resp.Succeeded {
+		return errTxnConflict
+	}
+	return nil
+}
+
+type etcdClient struct {
+	client *clientv3.Client
+	kv     clientv3.KV
+
+	maxOps int
+
+	sync.Mutex
+	lease clientv3.LeaseID
+}
+
+func (c *etcdClient) name() string {
+	return "etcd"
+}
+
+func (c *etcdClient) txn(f func(kvTxn) error) (err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	tx := &etcdTxn{
+		ctx:      ctx,
+		kv:       c.kv,
+		maxOps:   c.maxOps,
+		observed: make(map[string]int64),
+		buffer:   make(map[string][]byte),
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			if _, ok := r.(runtime.Error); ok {
+				panic(r)
+			}
+			fe, ok := r.(error)
+			if !ok {
+				panic(r)
+			}
+			err = fe
+		}
+	}()
+	if err = f(tx); err != nil {
+		return err
+	}
+	return tx.commit()
+}
+
+// keepAlive binds the key to a lease of the client, so it will be removed by etcd
+// if the client has not refreshed it within ttl. The guards of the key are
+// updated here, but not when etcd removes it after the lease expired.
+func (c *etcdClient) keepAlive(key, value []byte, ttl time.Duration) error {
+	c.Lock()
+	defer c.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+	if c.lease != 0 {
+		_, err := c.client.KeepAliveOnce(ctx, c.lease)
+		if err == rpctypes.ErrLeaseNotFound {
+			c.lease = 0
+		} else if err != nil {
+			return err
+		}
+	}
+	if c.lease == 0 {
+		resp, err := c.client.Grant(ctx, int64(ttl/time.Second))
+		if err != nil {
+			return err
+		}
+		c.lease = resp.ID
+	}
+	ops := append(guardOps([]string{string(key)}), clientv3.OpPut(string(key), string(value), clientv3.WithLease(c.lease)))
+	_, err := c.kv.Txn(ctx).Then(ops...).Commit()
+	return err
+}
+
+// NewEtcdMeta returns a meta store using etcd, the URL is like
+// etcd://[user:password@]host1:2379,host2:2379/prefix[?max-txn-ops=128]
+// max-txn-ops should be the same as --max-txn-ops of the etcd servers.
+func NewEtcdMeta(addr string, conf *RedisConfig) (Meta, error) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, fmt.Errorf("parse %s: %s", addr, err)
+	}
+	cfg := clientv3.Config{
+		Endpoints:   strings.Split(u.Host, ","),
+		DialTimeout: time.Second * 5,
+	}
+	if u.User != nil {
+		cfg.Username = u.User.Username()
+		cfg.Password, _ = u.User.Password()
+	}
+	if cfg.Password == "" && os.Getenv("ETCD_PASSWORD") != "" {
+		cfg.Password = os.Getenv("ETCD_PASSWORD")
+	}
+	prefix := strings.Trim(u.Path, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	maxOps := 128 // default --max-txn-ops of etcd
+	if v := u.Query().Get("max-txn-ops"); v != "" {
+		if maxOps, err = strconv.Atoi(v); err != nil || maxOps <= 0 {
+			return nil, fmt.Errorf("invalid max-txn-ops: %s", v)
+		}
+	}
+	cli, err := clientv3.New(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("connect to etcd %s: %s", u.Host, err)
+	}
+	c := &etcdClient{client: cli, kv: namespace.NewKV(cli.KV, prefix), maxOps: maxOps}
+	return newKVMeta(c, conf), nil
+}
+
+func init() {
+	Register("etcd", NewEtcdMeta)
+}
@@ -0,0 +1,144 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package meta
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"go.etcd.io/etcd/embed"
+)
+
+func startEtcd(t *testing.T) string {
+	cfg := embed.NewConfig()
+	cfg.Dir = t.TempDir()
+	cfg.Logger = "zap"
+	cfg.LogLevel = "error"
+	e, err := embed.StartEtcd(cfg)
+	if err != nil {
+		t.Skipf("start etcd: %s", err)
+	}
+	t.Cleanup(e.Close)
+	select {
+	case <-e.Server.ReadyNotify():
+	case <-time.After(time.Minute):
+		t.Fatalf("etcd is not ready")
+	}
+	return "etcd://" + cfg.LCUrls[0].Host + "/jfs"
+}
+
+func TestEtcdClient(t *testing.T) {
+	addr := startEtcd(t)
+	var n int
+	newClient := func() Meta {
+		n++
+		m, err := NewClient(fmt.Sprintf("%s%d", addr, n), &RedisConfig{})
+		if err != nil {
+			t.Fatalf("create etcd meta: %s", err)
+		}
+		return m
+	}
+	testMetaClient(t, newClient())
+	testEtcdTxn(t, newClient().(*kvMeta))
+}
+
+func testEtcdTxn(t *testing.T, m *kvMeta) {
+	// more keys than --max-txn-ops
+	var keys [][]byte
+	for i := 0; i < 200; i++ {
+		keys = append(keys, m.inodeKey(Ino(1000+i)))
+	}
+	if err := m.doTxn(func(tx kvTxn) error {
+		for _, v := range tx.gets(keys...) {
+			if v != nil {
+				return fmt.Errorf("unexpected value: %v", v)
+			}
+		}
+		tx.set(m.counterKey("test"), packCounter(1))
+		return nil
+	}); err != nil {
+		t.Fatalf("read %d keys in a txn: %s", len(keys), err)
+	}
+	if err := m.doTxn(func(tx kvTxn) error {
+		for _, k := range keys {
+			tx.set(k, []byte("v"))
+		}
+		return nil
+	}); err == nil {
+		t.Fatalf("write %d keys in a txn should fail", len(keys))
+	}
+	for i := 0; i < 3; i++ {
+		if err := m.doTxn(func(tx kvTxn) error {
+			tx.set(m.xattrKey(1, fmt.Sprintf("k%d", i)), []byte("v"))
+			return nil
+		}); err != nil {
+			t.Fatalf("set xattr: %s", err)
+		}
+	}
+
+	// a key deleted in the scanned range after the snapshot
+	prefix := m.xattrKey(1, "")
+	err := m.client.txn(func(tx kvTxn) error {
+		if ks, _ := scanPrefix(tx, prefix, 0); len(ks) != 3 {
+			return fmt.Errorf("expect 3 keys but got %d", len(ks))
+		}
+		if err := m.client.txn(func(tx2 kvTxn) error {
+			tx2.dels(m.xattrKey(1, "k1"))
+			return nil
+		}); err != nil {
+			return err
+		}
+		tx.set(m.xattrKey(1, "k3"), []byte("v"))
+		return nil
+	})
+	if err != errTxnConflict {
+		t.Fatalf("delete in scanned range should conflict: %v", err)
+	}
+
+	// too many keys read are checked by their guards
+	err = m.client.txn(func(tx kvTxn) error {
+		tx.gets(keys...)
+		if err := m.client.txn(func(tx2 kvTxn) error {
+			tx2.set(keys[len(keys)-1], []byte("v"))
+			return nil
+		}); err != nil {
+			return err
+		}
+		tx.set(m.counterKey("test"), packCounter(2))
+		return nil
+	})
+	if err != errTxnConflict {
+		t.Fatalf("changed key read should conflict: %v", err)
+	}
+	// the unrelated changes are not conflicts
+	err = m.client.txn(func(tx kvTxn) error {
+		if ks, _ := scanPrefix(tx, prefix, 0); len(ks) != 2 {
+			return fmt.Errorf("expect 2 keys but got %d", len(ks))
+		}
+		if err := m.client.txn(func(tx2 kvTxn) error {
+			tx2.set(m.xattrKey(2, "k"), []byte("v"))
+			return nil
+		}); err != nil {
+			return err
+		}
+		tx.set(m.xattrKey(1, "k3"), []byte("v"))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unrelated change: %s", err)
+	}
+}
@@ -0,0 +1,271 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package meta
+
+import (
+	"syscall"
+
+	"github.com/juicedata/juicefs/pkg/fault"
+)
+
+// faultMeta injects faults into the file system operations of a meta engine.
+type faultMeta struct {
+	Meta
+}
+
+// WithFaults returns a meta engine with faults injected by the rules in package fault,
+// it's used only if the binary is built with tag faultinjection.
+func WithFaults(m Meta) Meta {
+	return &faultMeta{m}
+}
+
+func (m *faultMeta) StatFS(ctx Context, totalspace, availspace, iused, iavail *uint64) syscall.Errno {
+	if st := fault.Inject("meta.statfs"); st != 0 {
+		return st
+	}
+	return m.Meta.StatFS(ctx, totalspace, availspace, iused, iavail)
+}
+
+func (m *faultMeta) Access(ctx Context, inode Ino, modemask uint8, attr *Attr) syscall.Errno {
+	if st := fault.Inject("meta.access"); st != 0 {
+		return st
+	}
+	return m.Meta.Access(ctx, inode, modemask, attr)
+}
+
+func (m *faultMeta) Lookup(ctx Context, parent Ino, name string, inode *Ino, attr *Attr) syscall.Errno {
+	if st := fault.Inject("meta.lookup"); st != 0 {
+		return st
+	}
+	return m.Meta.Lookup(ctx, parent, name, inode, attr)
+}
+
+func (m *faultMeta) GetAttr(ctx Context, inode Ino, attr *Attr) syscall.Errno {
+	if st := fault.Inject("meta.getattr"); st != 0 {
+		return st
+	}
+	return m.Meta.GetAttr(ctx, inode, attr)
+}
+
+func (m *faultMeta) SetAttr(ctx Context, inode Ino, set uint16, sggidclearmode uint8, attr *Attr) syscall.Errno {
+	if st := fault.Inject("meta.setattr"); st != 0 {
+		return st
+	}
+	return m.Meta.SetAttr(ctx, inode, set, sggidclearmode, attr)
+}
+
+func (m *faultMeta) Truncate(ctx Context, inode Ino, flags uint8, attrlength uint64, attr *Attr) syscall.Errno {
+	if st := fault.Inject("meta.truncate"); st != 0 {
+		return st
+	}
+	return m.Meta.Truncate(ctx, inode, flags, attrlength, attr)
+}
+
+func (m *faultMeta) Fallocate(ctx Context, inode Ino, mode uint8, off uint64, size uint64) syscall.Errno {
+	if st := fault.Inject("meta.fallocate"); st != 0 {
+		return st
+	}
+	return m.Meta.Fallocate(ctx, inode, mode, off, size)
+}
+
+func (m *faultMeta) Reserve(ctx Context, inode Ino, size uint64, off *uint64) syscall.Errno {
+	if st := fault.Inject("meta.reserve"); st != 0 {
+		return st
+	}
+	return m.Meta.Reserve(ctx, inode, size, off)
+}
+
+func (m *faultMeta) ReadLink(ctx Context, inode Ino, path *[]byte) syscall.Errno {
+	if st := fault.Inject("meta.readlink"); st != 0 {
+		return st
+	}
+	return m.Meta.ReadLink(ctx, inode, path)
+}
+
+func (m *faultMeta) Symlink(ctx Context, parent Ino, name string, path string, inode *Ino, attr *Attr) syscall.Errno {
+	if st := fault.Inject("meta.symlink"); st != 0 {
+		return st
+	}
+	return m.Meta.Symlink(ctx, parent, name, path, inode, attr)
+}
+
+func (m *faultMeta) Mknod(ctx Context, parent Ino, name string, _type uint8, mode uint16, cumask uint16, rdev uint32, inode *Ino, attr *Attr) syscall.Errno {
+	if st := fault.Inject("meta.mknod"); st != 0 {
+		return st
+	}
+	return m.Meta.Mknod(ctx, parent, name, _type, mode, cumask, rdev, inode, attr)
+}
+
+func (m *faultMeta) Mkdir(ctx Context, parent Ino, name string, mode uint16, cumask uint16, copysgid uint8, inode *Ino, attr *Attr) syscall.Errno {
+	if st := fault.Inject("meta.mkdir"); st != 0 {
+		return st
+	}
+	return m.Meta.Mkdir(ctx, parent, name, mode, cumask, copysgid, inode, attr)
+}
+
+func (m *faultMeta) Unlink(ctx Context, parent Ino, name string) syscall.Errno {
+	if st := fault.Inject("meta.unlink"); st != 0 {
+		return st
+	}
+	return m.Meta.Unlink(ctx, parent, name)
+}
+
+func (m *faultMeta) Rmdir(ctx Context, parent Ino, name string) syscall.Errno {
+	if st := fault.Inject("meta.rmdir"); st != 0 {
+		return st
+	}
+	return m.Meta.Rmdir(ctx, parent, name)
+}
+
+func (m *faultMeta) Rename(ctx Context, parentSrc Ino, nameSrc string, parentDst Ino, nameDst string, flags uint32, inode *Ino, attr *Attr) syscall.Errno {
+	if st := fault.Inject("meta.rename"); st != 0 {
+		return st
+	}
+	return m.Meta.Rename(ctx, parentSrc, nameSrc, parentDst, nameDst, flags, inode, attr)
+}
+
+func (m *faultMeta) Link(ctx Context, inodeSrc, parent Ino, name string, attr *Attr) syscall.Errno {
+	if st := fault.Inject("meta.link"); st != 0 {
+		return st
+	}
+	return m.Meta.Link(ctx, inodeSrc, parent, name, attr)
+}
+
+func (m *faultMeta) Readdir(ctx Context, inode Ino, wantattr uint8, entries *[]*Entry) syscall.Errno {
+	if st := fault.Inject("meta.readdir"); st != 0 {
+		return st
+	}
+	return m.Meta.Readdir(ctx, inode, wantattr, entries)
+}
+
+func (m *faultMeta) Create(ctx Context, parent Ino, name string, mode uint16, cumask uint16, inode *Ino, attr *Attr) syscall.Errno {
+	if st := fault.Inject("meta.create"); st != 0 {
+		return st
+	}
+	return m.Meta.Create(ctx, parent, name, mode, cumask, inode, attr)
+}
+
+func (m *faultMeta) Open(ctx Context, inode Ino, flags uint8, attr *Attr) syscall.Errno {
+	if st := fault.Inject("meta.open"); st != 0 {
+		return st
+	}
+	return m.Meta.Open(ctx, inode, flags, attr)
+}
+
+func (m *faultMeta) Close(ctx Context, inode Ino) syscall.Errno {
+	if st := fault.Inject("meta.close"); st != 0 {
+		return st
+	}
+	return m.Meta.Close(ctx, inode)
+}
+
+func (m *faultMeta) Delegate(ctx Context, inode Ino, ltype uint8) syscall.Errno {
+	if st := fault.Inject("meta.delegate"); st != 0 {
+		return st
+	}
+	return m.Meta.Delegate(ctx, inode, ltype)
+}
+
+func (m *faultMeta) Read(ctx Context, inode Ino, indx uint32, chunks *[]Slice) syscall.Errno {
+	if st := fault.Inject("meta.read"); st != 0 {
+		return st
+	}
+	return m.Meta.Read(ctx, inode, indx, chunks)
+}
+
+func (m *faultMeta) NewChunk(ctx Context, inode Ino, indx uint32, offset uint32, chunkid *uint64) syscall.Errno {
+	if st := fault.Inject("meta.newchunk"); st != 0 {
+		return st
+	}
+	return m.Meta.NewChunk(ctx, inode, indx, offset, chunkid)
+}
+
+func (m *faultMeta) Write(ctx Context, inode Ino, indx uint32, off uint32, slice Slice) syscall.Errno {
+	if st := fault.Inject("meta.write"); st != 0 {
+		return st
+	}
+	return m.Meta.Write(ctx, inode, indx, off, slice)
+}
+
+func (m *faultMeta) ReadInline(ctx Context, inode Ino, data *[]byte) syscall.Errno {
+	if st := fault.Inject("meta.readinline"); st != 0 {
+		return st
+	}
+	return m.Meta.ReadInline(ctx, inode, data)
+}
+
+func (m *faultMeta) WriteInline(ctx Context, inode Ino, data []byte) syscall.Errno {
+	if st := fault.Inject("meta.writeinline"); st != 0 {
+		return st
+	}
+	return m.Meta.WriteInline(ctx, inode, data)
+}
+
+func (m *faultMeta) CopyFileRange(ctx Context, fin Ino, offIn uint64, fout Ino, offOut uint64, size uint64, flags uint32, copied *uint64) syscall.Errno {
+	if st := fault.Inject("meta.copyfilerange"); st != 0 {
+		return st
+	}
+	return m.Meta.CopyFileRange(ctx, fin, offIn, fout, offOut, size, flags, copied)
+}
+
+func (m *faultMeta) GetXattr(ctx Context, inode Ino, name string, vbuff *[]byte) syscall.Errno {
+	if st := fault.Inject("meta.getxattr"); st != 0 {
+		return st
+	}
+	return m.Meta.GetXattr(ctx, inode, name, vbuff)
+}
+
+func (m *faultMeta) ListXattr(ctx Context, inode Ino, dbuff *[]byte) syscall.Errno {
+	if st := fault.Inject("meta.listxattr"); st != 0 {
+		return st
+	}
+	return m.Meta.ListXattr(ctx, inode, dbuff)
+}
+
+func (m *faultMeta) SetXattr(ctx Context, inode Ino, name string, value []byte) syscall.Errno {
+	if st := fault.Inject("meta.setxattr"); st != 0 {
+		return st
+	}
+	return m.Meta.SetXattr(ctx, inode, name, value)
+}
+
+func (m *faultMeta) RemoveXattr(ctx Context, inode Ino, name string) syscall.Errno {
+	if st := fault.Inject("meta.removexattr"); st != 0 {
+		return st
+	}
+	return m.Meta.RemoveXattr(ctx, inode, name)
+}
+
+func (m *faultMeta) Flock(ctx Context, inode Ino, owner uint64, ltype uint32, block bool) syscall.Errno {
+	if st := fault.Inject("meta.flock"); st != 0 {
+		return st
+	}
+	return m.Meta.Flock(ctx, inode, owner, ltype, block)
+}
+
+func (m *faultMeta) Getlk(ctx Context, inode Ino, owner uint64, ltype *uint32, start, end *uint64, pid *uint32) syscall.Errno {
+	if st := fault.Inject("meta.getlk"); st != 0 {
+		return st
+	}
+	return m.Meta.Getlk(ctx, inode, owner, ltype, start, end, pid)
+}
+
+func (m *faultMeta) Setlk(ctx Context, inode Ino, owner uint64, block bool, ltype uint32, start, end uint64, pid uint32) syscall.Errno {
+	if st := fault.Inject("meta.setlk"); st != 0 {
+		return st
+	}
+	return m.Meta.Setlk(ctx, inode, owner, block, ltype, start, end, pid)
+}
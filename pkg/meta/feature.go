@@ -0,0 +1,122 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package meta
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// The features which change how the files are stored, a client can't access the volume
+// correctly without the features enabled in it.
+const (
+	FeatureDedup           = "dedup"            // blocks are shared by the index of content
+	FeaturePack            = "pack"             // small files are packed into shared objects
+	FeatureInline          = "inline"           // data of small files is kept in metadata
+	FeatureNameIndex       = "name-index"       // names are indexed for find
+	FeatureCaseInsensitive = "case-insensitive" // names are looked up case-insensitively
+	FeatureVersions        = "versions"         // previous versions of files are kept
+	FeatureDirShards       = "dir-shards"       // entries of huge directories are split into shards
+	FeatureRetention       = "retention"        // files are retained from changing, see RetentionXattr
+	FeatureProjects        = "projects"         // usage of projects is accounted for quotas, see projectXattr
+)
+
+// SupportedFeatures are the features known by this client, they're advertised in the session.
+var SupportedFeatures = []string{FeatureDedup, FeaturePack, FeatureInline, FeatureNameIndex, FeatureCaseInsensitive, FeatureVersions, FeatureDirShards,
+	FeatureRetention, FeatureProjects}
+
+// usedFeatures are enabled by the files (the first retention or project), not by the settings.
+var usedFeatures = map[string]bool{FeatureRetention: true, FeatureProjects: true}
+
+// SetFeatures records the features enabled by the settings. The ones needed to read the files
+// are kept in Features, the others are needed only to modify them, kept in WriteFeatures. The
+// ones enabled by the files are kept.
+func (f *Format) SetFeatures() {
+	var used []string
+	for _, name := range f.WriteFeatures {
+		if usedFeatures[name] {
+			used = append(used, name)
+		}
+	}
+	f.Features, f.WriteFeatures = nil, used
+	if f.Dedup {
+		f.Features = append(f.Features, FeatureDedup)
+	}
+	if f.PackSize > 0 {
+		f.Features = append(f.Features, FeaturePack)
+	}
+	if f.InlineSize > 0 {
+		f.Features = append(f.Features, FeatureInline)
+	}
+	if f.DirShards {
+		f.Features = append(f.Features, FeatureDirShards)
+	}
+	if f.NameIndex {
+		f.WriteFeatures = append(f.WriteFeatures, FeatureNameIndex)
+	}
+	if f.CaseInsensitive {
+		f.WriteFeatures = append(f.WriteFeatures, FeatureCaseInsensitive)
+	}
+	if f.VersionDays > 0 {
+		f.WriteFeatures = append(f.WriteFeatures, FeatureVersions)
+	}
+}
+
+// addFeature returns the setting with a feature needed to modify the volume added, or nil if
+// it's already enabled. The secrets are kept as they're stored.
+func addFeature(setting []byte, name string) ([]byte, error) {
+	var format Format
+	if err := json.Unmarshal(setting, &format); err != nil {
+		return nil, fmt.Errorf("json: %s", err)
+	}
+	for _, n := range format.WriteFeatures {
+		if n == name {
+			return nil, nil
+		}
+	}
+	format.WriteFeatures = append(format.WriteFeatures, name)
+	return json.MarshalIndent(format, "", "")
+}
+
+func unsupported(features []string) []string {
+	var unknown []string
+	for _, name := range features {
+		var found bool
+		for _, s := range SupportedFeatures {
+			if s == name {
+				found = true
+				break
+			}
+		}
+		if !found {
+			unknown = append(unknown, name)
+		}
+	}
+	return unknown
+}
+
+// checkFeatures returns an error if any feature of the volume is not supported by this client,
+// the ones in WriteFeatures are ignored if the client is read-only.
+func (f *Format) checkFeatures(readOnly bool) error {
+	if unknown := unsupported(f.Features); len(unknown) > 0 {
+		return fmt.Errorf("features %s of volume %s are not supported by this client, upgrade it", strings.Join(unknown, ","), f.Name)
+	}
+	if unknown := unsupported(f.WriteFeatures); len(unknown) > 0 && !readOnly {
+		return fmt.Errorf("features %s of volume %s are not supported by this client, upgrade it or access it read-only", strings.Join(unknown, ","), f.Name)
+	}
+	return nil
+}
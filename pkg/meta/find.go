@@ -0,0 +1,89 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package meta
+
+import (
+	"path"
+	"strings"
+	"syscall"
+
+	"github.com/juicedata/juicefs/pkg/utils"
+)
+
+// The name index is an optional suffix index of all the entries in a volume,
+// enabled by format. Every entry is indexed by its reversed name followed by
+// the parent and inode, in a sorted set (Redis) or ordered keys (TKV), so the
+// entries with a given name or suffix (e.g. "*.jpg") are found by a range scan,
+// other patterns are matched by scanning the index instead of walking the tree.
+// The original names are indexed in case-insensitive volumes.
+
+// reverseName reverses the bytes of a name.
+func reverseName(name string) []byte {
+	b := make([]byte, len(name))
+	for i := 0; i < len(name); i++ {
+		b[len(name)-1-i] = name[i]
+	}
+	return b
+}
+
+// packIndexEntry packs an entry of name index as {reversed name, 0, parent, inode}.
+func packIndexEntry(parent Ino, name string, inode Ino) []byte {
+	b := utils.NewBuffer(uint32(len(name)) + 17)
+	b.Put(reverseName(name))
+	b.Put8(0)
+	b.Put64(uint64(parent))
+	b.Put64(uint64(inode))
+	return b.Bytes()
+}
+
+func parseIndexEntry(buf []byte) *IndexEntry {
+	if len(buf) < 18 || buf[len(buf)-17] != 0 {
+		return nil
+	}
+	rb := utils.ReadBuffer(buf[len(buf)-16:])
+	e := &IndexEntry{Parent: Ino(rb.Get64()), Inode: Ino(rb.Get64())}
+	e.Name = reverseName(string(buf[:len(buf)-17]))
+	return e
+}
+
+// checkPattern returns EINVAL if the glob pattern is malformed.
+func checkPattern(pattern string) syscall.Errno {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return syscall.EINVAL
+	}
+	return 0
+}
+
+// indexPrefix returns the prefix of the index entries which may match a glob
+// pattern, that's the reversed literal suffix of the pattern.
+func indexPrefix(pattern string) []byte {
+	i := strings.LastIndexAny(pattern, `*?[\`)
+	if i < 0 {
+		return append(reverseName(pattern), 0)
+	}
+	return reverseName(pattern[i+1:])
+}
+
+// matchIndex returns the entries in buf which match the pattern.
+func matchIndex(pattern string, buf [][]byte, entries *[]*IndexEntry) {
+	for _, b := range buf {
+		if e := parseIndexEntry(b); e != nil {
+			if ok, _ := path.Match(pattern, string(e.Name)); ok {
+				*entries = append(*entries, e)
+			}
+		}
+	}
+}
@@ -0,0 +1,141 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package meta
+
+import (
+	"sort"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestIndexEntry(t *testing.T) {
+	e := parseIndexEntry(packIndexEntry(3, "a.jpg", 5))
+	if e == nil || e.Parent != 3 || e.Inode != 5 || string(e.Name) != "a.jpg" {
+		t.Fatalf("parse index entry: %+v", e)
+	}
+	cases := map[string]string{
+		"a.jpg":   "gpj.a\x00",
+		"*.jpg":   "gpj.",
+		"a?b":     "b",
+		"[ab]c*":  "",
+		`a\*.txt`: "txt.",
+	}
+	for pattern, prefix := range cases {
+		if p := string(indexPrefix(pattern)); p != prefix {
+			t.Fatalf("prefix of %q: expect %q, but got %q", pattern, prefix, p)
+		}
+	}
+}
+
+func TestFindNames(t *testing.T) {
+	m := newMemClient(t)
+	if err := m.Init(Format{Name: "test"}, true); err != nil {
+		t.Fatalf("init: %s", err)
+	}
+	if _, err := m.Load(); err != nil {
+		t.Fatalf("load: %s", err)
+	}
+	var entries []*IndexEntry
+	if st := m.FindNames(Background, "*", &entries); st != syscall.ENOTSUP {
+		t.Fatalf("find without index: %s", st)
+	}
+
+	testFindNames(t, newMemClient(t))
+	m, err := NewRedisMeta("redis://127.0.0.1/15", &RedisConfig{})
+	if err != nil {
+		t.Logf("redis is not available: %s", err)
+		t.Skip()
+	}
+	m.(*redisMeta).rdb.FlushDB(Background)
+	testFindNames(t, m)
+}
+
+func findNames(t *testing.T, m Meta, pattern string) string {
+	var entries []*IndexEntry
+	if st := m.FindNames(Background, pattern, &entries); st != 0 {
+		t.Fatalf("find %s: %s", pattern, st)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Parent.String()+"/"+string(e.Name))
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
+
+func testFindNames(t *testing.T, m Meta) {
+	if err := m.Init(Format{Name: "test", NameIndex: true}, true); err != nil {
+		t.Fatalf("init: %s", err)
+	}
+	if _, err := m.Load(); err != nil {
+		t.Fatalf("load: %s", err)
+	}
+	ctx := Background
+	var dir, inode Ino
+	var attr = &Attr{}
+	if st := m.Mkdir(ctx, 1, "d", 0755, 022, 0, &dir, attr); st != 0 {
+		t.Fatalf("mkdir: %s", st)
+	}
+	for _, name := range []string{"a.jpg", "b.jpg", "c.png"} {
+		if st := m.Create(ctx, dir, name, 0644, 022, &inode, attr); st != 0 {
+			t.Fatalf("create %s: %s", name, st)
+		}
+		_ = m.Close(ctx, inode)
+	}
+	if st := m.Link(ctx, inode, 1, "x.jpg", attr); st != 0 {
+		t.Fatalf("link: %s", st)
+	}
+	d := dir.String()
+	if s := findNames(t, m, "*.jpg"); s != "1/x.jpg,"+d+"/a.jpg,"+d+"/b.jpg" {
+		t.Fatalf("find *.jpg: %s", s)
+	}
+	if s := findNames(t, m, "c.png"); s != d+"/c.png" {
+		t.Fatalf("find c.png: %s", s)
+	}
+	if s := findNames(t, m, "[ab]*"); s != d+"/a.jpg,"+d+"/b.jpg" {
+		t.Fatalf("find [ab]*: %s", s)
+	}
+	var entries []*IndexEntry
+	if st := m.FindNames(ctx, "[", &entries); st != syscall.EINVAL {
+		t.Fatalf("find with bad pattern: %s", st)
+	}
+
+	if st := m.Rename(ctx, dir, "a.jpg", 1, "b.jpg", 0, &inode, attr); st != 0 {
+		t.Fatalf("rename: %s", st)
+	}
+	if st := m.Rename(ctx, dir, "b.jpg", 1, "x.jpg", 0, &inode, attr); st != 0 {
+		t.Fatalf("rename to overwrite: %s", st)
+	}
+	if st := m.Unlink(ctx, dir, "c.png"); st != 0 {
+		t.Fatalf("unlink: %s", st)
+	}
+	if s := findNames(t, m, "*"); s != "1/b.jpg,1/d,1/x.jpg" {
+		t.Fatalf("find * after rename and unlink: %s", s)
+	}
+	if st := m.Unlink(ctx, 1, "x.jpg"); st != 0 {
+		t.Fatalf("unlink: %s", st)
+	}
+	if st := m.Unlink(ctx, 1, "b.jpg"); st != 0 {
+		t.Fatalf("unlink: %s", st)
+	}
+	if st := m.Rmdir(ctx, 1, "d"); st != 0 {
+		t.Fatalf("rmdir: %s", st)
+	}
+	if s := findNames(t, m, "*"); s != "" {
+		t.Fatalf("find * after removing all: %s", s)
+	}
+}
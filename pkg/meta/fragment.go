@@ -0,0 +1,96 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package meta
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	chunkSlices = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "chunk_slices_histogram",
+		Help:    "Number of slices in the chunks read.",
+		Buckets: prometheus.ExponentialBuckets(1, 2, 8),
+	})
+	chunkOverwritten = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "chunk_overwritten_bytes_histogram",
+		Help:    "Bytes overwritten but not reclaimed by compaction in the chunks read.",
+		Buckets: prometheus.ExponentialBuckets(4096, 4, 9),
+	})
+)
+
+// FragmentBuckets are the upper bounds of the number of slices in Fragmentation.Histogram.
+var FragmentBuckets = []uint64{1, 2, 4, 8, 16, 32, 64}
+
+// Fragmentation is the statistics of the slices in chunks. A chunk has more slices
+// when it's written in small pieces or overwritten, until it's compacted.
+type Fragmentation struct {
+	Chunks     uint64
+	Slices     uint64
+	Histogram  [8]uint64 // number of chunks by the number of slices, see FragmentBuckets
+	SliceBytes uint64    // bytes referenced by the slices
+	LiveBytes  uint64    // bytes visible in the files
+}
+
+// Overwritten returns the bytes which are overwritten but still referenced.
+func (f *Fragmentation) Overwritten() uint64 {
+	return f.SliceBytes - f.LiveBytes
+}
+
+// referencedBytes returns the bytes referenced by the slices, it should be called before buildSlice.
+func referencedBytes(ss []*slice) (n uint64) {
+	for _, s := range ss {
+		if s.chunkid > 0 {
+			n += uint64(s.len)
+		}
+	}
+	return
+}
+
+func liveBytes(chunks []Slice) (n uint64) {
+	for _, c := range chunks {
+		if c.Chunkid > 0 {
+			n += uint64(c.Len)
+		}
+	}
+	return
+}
+
+func (f *Fragmentation) add(ss []*slice) {
+	if len(ss) == 0 {
+		return
+	}
+	f.Chunks++
+	f.Slices += uint64(len(ss))
+	i := 0
+	for i < len(FragmentBuckets) && uint64(len(ss)) > FragmentBuckets[i] {
+		i++
+	}
+	f.Histogram[i]++
+	f.SliceBytes += referencedBytes(ss)
+	f.LiveBytes += liveBytes(buildSlice(ss))
+}
+
+// buildObserved builds the slices of a chunk being read, and updates the metrics of fragmentation.
+func buildObserved(a *sliceArena, ss []*slice) []Slice {
+	referenced := referencedBytes(ss)
+	chunks := buildSliceIn(a, ss)
+	if len(ss) > 0 {
+		chunkSlices.Observe(float64(len(ss)))
+		chunkOverwritten.Observe(float64(referenced - liveBytes(chunks)))
+	}
+	return chunks
+}
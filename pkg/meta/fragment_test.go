@@ -0,0 +1,79 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package meta
+
+import "testing"
+
+func TestFragmentation(t *testing.T) {
+	m, err := NewRedisMeta("redis://127.0.0.1/15", &RedisConfig{})
+	if err != nil {
+		t.Logf("redis is not available: %s", err)
+		t.Skip()
+	}
+	m.(*redisMeta).rdb.FlushDB(Background)
+	testFragmentation(t, m)
+}
+
+func testFragmentation(t *testing.T, m Meta) {
+	if err := m.Init(Format{Name: "test"}, false); err != nil {
+		t.Fatalf("init: %s", err)
+	}
+	ctx := Background
+	var dir, f, g Ino
+	var attr Attr
+	if st := m.Mkdir(ctx, 1, "frag", 0755, 0, 0, &dir, &attr); st != 0 {
+		t.Fatalf("mkdir: %s", st)
+	}
+	if st := m.Create(ctx, dir, "f", 0644, 0, &f, &attr); st != 0 {
+		t.Fatalf("create f: %s", st)
+	}
+	if st := m.Create(ctx, dir, "g", 0644, 0, &g, &attr); st != 0 {
+		t.Fatalf("create g: %s", st)
+	}
+	// f: [1 1 2 2 1 ... 1] [hole] [3]
+	writes := []struct {
+		ino  Ino
+		indx uint32
+		off  uint32
+		s    Slice
+	}{
+		{f, 0, 0, Slice{Chunkid: 1, Size: 1000, Len: 1000}},
+		{f, 0, 200, Slice{Chunkid: 2, Size: 400, Len: 400}},
+		{f, 0, 2000, Slice{Chunkid: 3, Size: 100, Len: 100}},
+		{g, 0, 0, Slice{Chunkid: 4, Size: ChunkSize, Len: ChunkSize}},
+		{g, 1, 0, Slice{Chunkid: 5, Size: 100, Len: 100}},
+	}
+	for _, w := range writes {
+		if st := m.Write(ctx, w.ino, w.indx, w.off, w.s); st != 0 {
+			t.Fatalf("write %+v: %s", w, st)
+		}
+	}
+
+	var frag Fragmentation
+	if st := m.Fragmentation(ctx, f, &frag); st != 0 {
+		t.Fatalf("fragmentation of f: %s", st)
+	}
+	if frag.Chunks != 1 || frag.Slices != 3 || frag.Histogram[2] != 1 || frag.SliceBytes != 1500 || frag.LiveBytes != 1100 || frag.Overwritten() != 400 {
+		t.Fatalf("fragmentation of f: %+v", frag)
+	}
+	frag = Fragmentation{}
+	if st := m.Fragmentation(ctx, 1, &frag); st != 0 {
+		t.Fatalf("fragmentation of root: %s", st)
+	}
+	if frag.Chunks != 3 || frag.Slices != 5 || frag.Histogram[0] != 2 || frag.Overwritten() != 400 {
+		t.Fatalf("fragmentation of root: %+v", frag)
+	}
+}
@@ -0,0 +1,168 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package meta
+
+import (
+	"sync"
+	"time"
+)
+
+// A directory is hot if it's read (GetAttr or Lookup in it) more than hotThreshold times in a
+// second by this client, e.g. the root directory stat-ed by every process. The attributes of hot
+// directories and the sub-directories looked up in them are cached for a short time, to reduce
+// the load of meta engine under fan-out workloads. They are dropped once the directory is changed
+// by this client, or by other clients through the changelog (Redis only).
+const hotThreshold = 100
+
+type hotDir struct {
+	expire  int64 // unix nano
+	attr    *Attr
+	entries map[string]Ino // sub-directories
+}
+
+type hotDirs struct {
+	sync.Mutex
+	ttl    time.Duration
+	second int64
+	reads  map[Ino]int
+	dirs   map[Ino]*hotDir
+}
+
+func newHotDirs(ttl time.Duration) *hotDirs {
+	if ttl <= 0 {
+		return nil
+	}
+	return &hotDirs{ttl: ttl, reads: make(map[Ino]int), dirs: make(map[Ino]*hotDir)}
+}
+
+// read counts a read of the directory, and returns the cached one if it's hot.
+func (h *hotDirs) read(inode Ino, now int64) (*hotDir, bool) {
+	if s := now / int64(time.Second); s != h.second {
+		h.second = s
+		h.reads = make(map[Ino]int)
+		for ino, d := range h.dirs {
+			if d.expire < now {
+				delete(h.dirs, ino)
+			}
+		}
+	}
+	h.reads[inode]++
+	d := h.dirs[inode]
+	if d != nil && d.expire < now {
+		delete(h.dirs, inode)
+		d = nil
+	}
+	return d, h.reads[inode] > hotThreshold
+}
+
+func (h *hotDirs) cache(inode Ino, now int64) *hotDir {
+	d := h.dirs[inode]
+	if d == nil {
+		d = &hotDir{expire: now + int64(h.ttl), entries: make(map[string]Ino)}
+		h.dirs[inode] = d
+	}
+	return d
+}
+
+// getAttr returns true if the attributes of a hot directory are cached.
+func (h *hotDirs) getAttr(inode Ino, attr *Attr) bool {
+	h.Lock()
+	defer h.Unlock()
+	d, _ := h.read(inode, time.Now().UnixNano())
+	if d == nil || d.attr == nil {
+		return false
+	}
+	*attr = *d.attr
+	return true
+}
+
+// putAttr caches the attributes of a directory if it's hot, and returns true if it's a new one.
+func (h *hotDirs) putAttr(inode Ino, attr *Attr) bool {
+	if attr.Typ != TypeDirectory {
+		return false
+	}
+	h.Lock()
+	defer h.Unlock()
+	now := time.Now().UnixNano()
+	if h.reads[inode] <= hotThreshold {
+		return false
+	}
+	_, existed := h.dirs[inode]
+	a := *attr
+	h.cache(inode, now).attr = &a
+	return !existed
+}
+
+// lookup returns true if the sub-directory of a hot directory is cached.
+func (h *hotDirs) lookup(parent Ino, name string, inode *Ino, attr *Attr) bool {
+	h.Lock()
+	defer h.Unlock()
+	now := time.Now().UnixNano()
+	d, _ := h.read(parent, now)
+	if d == nil {
+		return false
+	}
+	ino, ok := d.entries[name]
+	if !ok {
+		return false
+	}
+	if attr != nil {
+		c := h.dirs[ino]
+		if c == nil || c.attr == nil || c.expire < now {
+			return false
+		}
+		*attr = *c.attr
+	}
+	if inode != nil {
+		*inode = ino
+	}
+	return true
+}
+
+// putEntry caches a sub-directory of a hot directory, and returns true if the parent is a new one.
+func (h *hotDirs) putEntry(parent Ino, name string, inode Ino, attr *Attr) bool {
+	if attr == nil || attr.Typ != TypeDirectory {
+		return false
+	}
+	h.Lock()
+	defer h.Unlock()
+	if h.reads[parent] <= hotThreshold {
+		return false
+	}
+	now := time.Now().UnixNano()
+	_, existed := h.dirs[parent]
+	h.cache(parent, now).entries[name] = inode
+	a := *attr
+	h.cache(inode, now).attr = &a
+	return !existed
+}
+
+// invalidate drops the cached directories after they are changed.
+func (h *hotDirs) invalidate(inodes ...Ino) {
+	h.Lock()
+	defer h.Unlock()
+	for _, inode := range inodes {
+		delete(h.dirs, inode)
+	}
+}
+
+// isHot returns true if the directory is cached.
+func (h *hotDirs) isHot(inode Ino) bool {
+	h.Lock()
+	defer h.Unlock()
+	_, ok := h.dirs[inode]
+	return ok
+}
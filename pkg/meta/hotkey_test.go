@@ -0,0 +1,96 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package meta
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHotDirs(t *testing.T) {
+	if newHotDirs(0) != nil {
+		t.Fatalf("hot cache should be disabled")
+	}
+	h := newHotDirs(time.Second)
+	dir := &Attr{Typ: TypeDirectory, Mode: 0755}
+	var attr Attr
+	for i := 0; i <= hotThreshold; i++ {
+		if h.getAttr(1, &attr) {
+			t.Fatalf("cold directory is cached")
+		}
+		h.putAttr(1, dir)
+	}
+	// the reads may cross two seconds
+	for i := 0; i <= hotThreshold && !h.isHot(1); i++ {
+		h.getAttr(1, &attr)
+		h.putAttr(1, dir)
+	}
+	if !h.getAttr(1, &attr) || attr.Mode != 0755 {
+		t.Fatalf("hot directory is not cached: %+v", attr)
+	}
+	if !h.putEntry(1, "d", 2, dir) && !h.isHot(1) {
+		t.Fatalf("put entry")
+	}
+	var inode Ino
+	if !h.lookup(1, "d", &inode, &attr) || inode != 2 {
+		t.Fatalf("lookup cached entry: %d", inode)
+	}
+	if h.lookup(1, "f", &inode, &attr) {
+		t.Fatalf("lookup missing entry")
+	}
+	h.putEntry(1, "f", 3, &Attr{Typ: TypeFile})
+	if h.lookup(1, "f", &inode, &attr) {
+		t.Fatalf("files should not be cached")
+	}
+	h.invalidate(1)
+	if h.getAttr(1, &attr) || h.lookup(1, "d", &inode, &attr) {
+		t.Fatalf("invalidated directory is cached")
+	}
+}
+
+func TestKVHotCache(t *testing.T) {
+	m, err := NewClient("memkv://test", &RedisConfig{HotCache: time.Minute})
+	if err != nil {
+		t.Fatalf("create memkv: %s", err)
+	}
+	_ = m.Init(Format{Name: "test"}, false)
+	ctx := Background
+	var dir, inode Ino
+	var attr Attr
+	if st := m.Mkdir(ctx, 1, "d", 0755, 0, 0, &dir, &attr); st != 0 {
+		t.Fatalf("mkdir: %s", st)
+	}
+	for i := 0; i < hotThreshold*3; i++ {
+		if st := m.GetAttr(ctx, dir, &attr); st != 0 {
+			t.Fatalf("getattr: %s", st)
+		}
+	}
+	// changed by another client
+	other := newKVMeta(m.(*kvMeta).client, &RedisConfig{})
+	if st := other.Mkdir(ctx, dir, "a", 0755, 0, 0, &inode, &attr); st != 0 {
+		t.Fatalf("mkdir: %s", st)
+	}
+	if st := m.GetAttr(ctx, dir, &attr); st != 0 || attr.Nlink != 2 {
+		t.Fatalf("cached attributes: %s %+v", st, attr)
+	}
+	// changed by itself
+	if st := m.Mkdir(ctx, dir, "b", 0755, 0, 0, &inode, &attr); st != 0 {
+		t.Fatalf("mkdir: %s", st)
+	}
+	if st := m.GetAttr(ctx, dir, &attr); st != 0 || attr.Nlink != 4 {
+		t.Fatalf("attributes after changed: %s %+v", st, attr)
+	}
+}
@@ -16,18 +16,38 @@
 package meta
 
 import (
+	"errors"
+	"fmt"
+	"strings"
 	"syscall"
+	"time"
 )
 
 const (
 	// ChunkSize is size of a chunk
 	ChunkSize = 1 << 26 // 64M
+	// MaxFileSize is the max size of a file.
+	MaxFileSize = ChunkSize << 31
 	// DeleteChunk is a message to delete a chunk from object store.
 	DeleteChunk = 1000
 	// CompactChunk is a message to compact a chunk in object store.
 	CompactChunk = 1001
 	// Rmr is a message to remove a directory recursively.
 	Rmr = 1002
+	// Fault is a message to list or replace the rules of fault injection.
+	Fault = 1003
+	// Info is a message to get the summary and fragmentation of a file or directory.
+	Info = 1004
+	// Jobs is a message to list, pause or resume the background jobs.
+	Jobs = 1005
+	// Pin is a message to pin or unpin the blocks of a file in local cache.
+	Pin = 1006
+	// Consumers is a message to get the I/O of the processes using the mount point.
+	Consumers = 1007
+	// Freeze is a message to freeze or unfreeze the modifications of the mount point.
+	Freeze = 1008
+	// Recall is a message to flush the cached data of a file and return its delegation, see Delegate.
+	Recall = 1009
 )
 
 const (
@@ -51,6 +71,32 @@ const (
 	SetAttrCtime
 	SetAttrAtimeNow
 	SetAttrMtimeNow
+	SetAttrFlag
+)
+
+const (
+	// FlagReadOnly marks a file whose content can't be changed, e.g. imported from an existing object.
+	FlagReadOnly = 1 << iota
+	// FlagRetention marks a node with a retention policy, see RetentionXattr.
+	FlagRetention
+)
+
+// The flags of Rename, the same as renameat2(2) on Linux, only RenameNoReplace is supported.
+const (
+	RenameNoReplace = 1 << iota
+	RenameExchange
+	RenameWhiteout
+)
+
+const (
+	DelegateNone  = 0 // no delegation, to return the held one
+	DelegateRead  = 1 // the data and attributes can be cached until recalled
+	DelegateWrite = 2 // the dirty data and attributes can be cached until recalled, it's exclusive
+	// DelegateAppend is requested to append a file, an exclusive write delegation is granted if the
+	// file is not appended or delegated by other sessions, then the data can be appended at the end
+	// of cached data, it's downgraded after the Recall message. Otherwise the file is appended
+	// by the session with others (EAGAIN is returned), the ranges should be reserved by Reserve.
+	DelegateAppend = 3
 )
 
 // MsgCallback is a callback for messages from meta service.
@@ -118,6 +164,10 @@ type Slice struct {
 	Len     uint32
 }
 
+// ChunkHints are the bits in the id of a chunk which are set by the writer as hints
+// for the chunk store (e.g. chunk.CompressHints), they're kept by compaction.
+const ChunkHints = uint64(0x7f) << 55
+
 // Summary represents the total number of files/directories and
 // total length of all files inside a directory.
 type Summary struct {
@@ -127,17 +177,55 @@ type Summary struct {
 	Dirs   uint64
 }
 
+// Usage is the space and number of inodes used by a user or group.
+type Usage struct {
+	ID     uint32
+	Space  int64
+	Inodes int64
+}
+
+// Quota is the limits on space and inodes of a project and the usage of it, zero limit means unlimited.
+type Quota struct {
+	MaxSpace   int64
+	MaxInodes  int64
+	UsedSpace  int64
+	UsedInodes int64
+}
+
+// IndexEntry is an entry found in the name index.
+type IndexEntry struct {
+	Parent Ino
+	Inode  Ino
+	Name   []byte
+}
+
+// ErrNoVolume is returned by Load if the meta service is not formatted.
+var ErrNoVolume = errors.New("no volume found")
+
 // Meta is a interface for a meta service for file system.
 type Meta interface {
 	// Init is used to initialize a meta service.
 	Init(format Format, force bool) error
 	// Load loads the existing setting of a formatted volume from meta service.
 	Load() (*Format, error)
+	// UpdateFormat replaces the setting of a formatted volume, the name and UUID can't be changed.
+	UpdateFormat(format Format) error
 	// NewSession create a new client session.
 	NewSession() error
+	// ListSessions returns all the client sessions with their information.
+	ListSessions() ([]*SessionInfo, error)
+	// Lease acquires or renews a lease for the current session, returns true if it's held by the session.
+	// The lease held by the session is released if ttl is zero.
+	Lease(name string, ttl time.Duration) (bool, error)
 
 	// StatFS returns summary statistics of a volume.
 	StatFS(ctx Context, totalspace, availspace, iused, iavail *uint64) syscall.Errno
+	// ListUsage returns the space and inodes used by every user, or every group if group is true.
+	ListUsage(group bool) ([]Usage, error)
+	// SetQuota changes the limits on space and inodes of a project, zero means unlimited.
+	SetQuota(prj uint32, maxSpace, maxInodes int64) error
+	// ListQuotas returns the limits and usage of all the projects.
+	ListQuotas() (map[uint32]*Quota, error)
 	// Access checks the access permission on given inode.
 	Access(ctx Context, inode Ino, modemask uint8, attr *Attr) syscall.Errno
 	// Lookup returns the inode and attributes for the given entry in a directory.
@@ -150,6 +238,10 @@ type Meta interface {
 	Truncate(ctx Context, inode Ino, flags uint8, attrlength uint64, attr *Attr) syscall.Errno
 	// Fallocate preallocate given space for given file.
 	Fallocate(ctx Context, inode Ino, mode uint8, off uint64, size uint64) syscall.Errno
+	// Reserve extends a file by size atomically and returns the previous length in off, which is
+	// the offset to append the data, so the files can be appended by multiple clients concurrently.
+	// EFBIG is returned if the file would be larger than MaxFileSize, it's not extended.
+	Reserve(ctx Context, inode Ino, size uint64, off *uint64) syscall.Errno
 	// ReadLink returns the target of a symlink.
 	ReadLink(ctx Context, inode Ino, path *[]byte) syscall.Errno
 	// Symlink creates a symlink in a directory with given name.
@@ -164,9 +256,9 @@ type Meta interface {
 	// Rmdir removes an empty sub-directory.
 	Rmdir(ctx Context, parent Ino, name string) syscall.Errno
 	// Rename move an entry from a source directory to another with given name.
-	// The targeted entry will be overwrited if it's a file or empty directory.
-	// For Hadoop, the target should not be overwritten.
-	Rename(ctx Context, parentSrc Ino, nameSrc string, parentDst Ino, nameDst string, inode *Ino, attr *Attr) syscall.Errno
+	// The targeted entry will be overwrited if it's a file or empty directory,
+	// unless RenameNoReplace is set in flags. For Hadoop, the target should not be overwritten.
+	Rename(ctx Context, parentSrc Ino, nameSrc string, parentDst Ino, nameDst string, flags uint32, inode *Ino, attr *Attr) syscall.Errno
 	// Link creates an entry for node.
 	Link(ctx Context, inodeSrc, parent Ino, name string, attr *Attr) syscall.Errno
 	// Readdir returns all entries for given directory, which include attributes if plus is true.
@@ -177,12 +269,23 @@ type Meta interface {
 	Open(ctx Context, inode Ino, flags uint8, attr *Attr) syscall.Errno
 	// Close a file.
 	Close(ctx Context, inode Ino) syscall.Errno
+	// Delegate grants a delegation of a file to the session, or returns it with DelegateNone.
+	// EAGAIN is returned if it conflicts with the delegations of other sessions, which are recalled.
+	// The delegations are recalled when the file is opened by other sessions in a conflicting mode,
+	// the holder is notified by a Recall message, and the opener waits for it to be returned.
+	Delegate(ctx Context, inode Ino, ltype uint8) syscall.Errno
 	// Read returns the list of slices on the given chunk.
 	Read(ctx Context, inode Ino, indx uint32, chunks *[]Slice) syscall.Errno
 	// NewChunk returns a new id for new data.
 	NewChunk(ctx Context, inode Ino, indx uint32, offset uint32, chunkid *uint64) syscall.Errno
+	// ReserveChunks makes the ids of new chunks greater than maxid, it's used to restore the chunks of a backup.
+	ReserveChunks(maxid uint64) error
 	// Write put a slice of data on top of the given chunk.
 	Write(ctx Context, inode Ino, indx uint32, off uint32, slice Slice) syscall.Errno
+	// ReadInline returns the data of a small file which is stored in meta, data is nil if it's not inlined.
+	ReadInline(ctx Context, inode Ino, data *[]byte) syscall.Errno
+	// WriteInline replaces the data of a small file which is empty or inlined, the length is extended if needed.
+	WriteInline(ctx Context, inode Ino, data []byte) syscall.Errno
 	// CopyFileRange copies part of a file to another one.
 	CopyFileRange(ctx Context, fin Ino, offIn uint64, fout Ino, offOut uint64, size uint64, flags uint32, copied *uint64) syscall.Errno
 
@@ -194,6 +297,17 @@ type Meta interface {
 	SetXattr(ctx Context, inode Ino, name string, value []byte) syscall.Errno
 	// RemoveXattr removes the extended attribute of a node.
 	RemoveXattr(ctx Context, inode Ino, name string) syscall.Errno
+	// SetTag sets a tag of a node, the old value of the same key is replaced.
+	SetTag(ctx Context, inode Ino, key, value string) syscall.Errno
+	// GetTags returns all the tags of a node.
+	GetTags(ctx Context, inode Ino, tags *map[string]string) syscall.Errno
+	// RemoveTag removes a tag of a node.
+	RemoveTag(ctx Context, inode Ino, key string) syscall.Errno
+	// FindNames returns the entries whose names match a glob pattern from the name index,
+	// ENOTSUP is returned if the index is not enabled.
+	FindNames(ctx Context, pattern string, entries *[]*IndexEntry) syscall.Errno
+	// SearchTag returns the nodes with the tag, any value of the key matches if value is empty.
+	SearchTag(ctx Context, key, value string, inodes *[]Ino) syscall.Errno
 	// Flock tries to put a lock on given file.
 	Flock(ctx Context, inode Ino, owner uint64, ltype uint32, block bool) syscall.Errno
 	// Getlk returns the current lock owner for a range on a file.
@@ -205,10 +319,92 @@ type Meta interface {
 	Summary(ctx Context, inode Ino, summary *Summary) syscall.Errno
 	// Rmr remove all the files and directories recursively.
 	Rmr(ctx Context, inode Ino, name string) syscall.Errno
+	// Fragmentation returns the statistics of slices in the chunks of a file, or all the files in a directory recursively.
+	Fragmentation(ctx Context, inode Ino, frag *Fragmentation) syscall.Errno
 
+	// CompactAll compacts the chunks of all files which have at least minSlices slices.
+	CompactAll(ctx Context, minSlices int) syscall.Errno
+	// Defrag rewrites each chunk which has at least minSlices slices into a single new slice, so it
+	// can be read sequentially from the fresh blocks. The files modified within age are skipped.
+	Defrag(ctx Context, minSlices int, age time.Duration, count *uint64) syscall.Errno
+	// Shrink drops the hidden slices from the chunks with at least minSlices slices, removes the leftover
+	// keys of removed nodes, and rewrites the small structures into compact encodings, to reclaim the
+	// memory of meta engine on long-lived volumes. The unused slices are deleted by the clients later.
+	Shrink(ctx Context, minSlices int, stats *ShrinkStats) syscall.Errno
 	// ListSlices returns all slices used by all files.
 	ListSlices(ctx Context, slices *[]Slice) syscall.Errno
+	// ListDeleted returns the data which is removed but not deleted yet, the slices of files are listed if withSlices is true.
+	ListDeleted(ctx Context, withSlices bool, backlog *Backlog) syscall.Errno
+
+	// AddPack records the blocks packed into a shared object, offsets has one more item than chunks.
+	AddPack(pack uint64, chunks []uint64, offsets []uint32) error
+	// LookupPack returns the location of a packed block, pack is zero if it's not packed.
+	LookupPack(chunkid uint64) (pack uint64, off, size uint32, err error)
+	// RemovePack removes a packed block and returns the number of blocks left in the pack.
+	RemovePack(chunkid uint64) (pack uint64, left int64, err error)
+
+	// AddDedup refers a block to the object with the same content (by hash), which is the block
+	// itself (key) if there is none yet, key is empty to refer it only if the object exists.
+	// It returns the key of the object holding the block, or empty if it's not referred.
+	AddDedup(hash string, chunkid uint64, indx int, key string) (string, error)
+	// LookupDedup returns the key of the object holding a block, or empty if it's not deduplicated.
+	LookupDedup(chunkid uint64, indx int) (string, error)
+	// DedupRefs returns the object holding a block and the number of blocks in it, refs is zero if it's not deduplicated.
+	DedupRefs(chunkid uint64, indx int) (key string, refs int64, err error)
+	// RemoveDedup removes a deduplicated block and returns the object and the number of blocks left in it.
+	RemoveDedup(chunkid uint64, indx int) (key string, left int64, err error)
+	// ListDedup returns the objects holding the deduplicated blocks and the number of blocks in them.
+	ListDedup() (map[string]int64, error)
+
+	// AddReplication adds an operation into the queue of replication.
+	AddReplication(op string) error
+	// ClaimReplications returns up to limit operations which are not claimed by others in last lease.
+	ClaimReplications(limit int, lease time.Duration) ([]string, error)
+	// DoneReplication removes a finished operation from the queue of replication.
+	DoneReplication(op string) error
+	// ReplicationLag returns the number of pending operations and the time when the oldest one is added.
+	ReplicationLag() (int64, time.Time, error)
+
+	// AddExternal maps a chunk to the existing object starting from off.
+	AddExternal(chunkid uint64, key string, off uint64) error
+	// LookupExternal returns the object of an imported chunk, key is empty if it's not found.
+	LookupExternal(chunkid uint64) (key string, off uint64, err error)
+	// RemoveExternal removes the mapping of an imported chunk, the object is kept.
+	RemoveExternal(chunkid uint64) error
+
+	// SetGatewayUser saves a user of the S3 gateway by access key, the user is removed if value is nil.
+	SetGatewayUser(accessKey string, value []byte) error
+	// ListGatewayUsers returns all the users of the S3 gateway.
+	ListGatewayUsers() (map[string][]byte, error)
+
+	// SetCheckpoint saves the progress of a maintenance command by name, it's removed if value is nil.
+	SetCheckpoint(name string, value []byte) error
+	// GetCheckpoint returns the progress of a maintenance command, or nil if there is none.
+	GetCheckpoint(name string) ([]byte, error)
 
 	// OnMsg add a callback for the given message type.
 	OnMsg(mtype uint32, cb MsgCallback)
 }
+
+// Creator creates a meta store with the URL.
+type Creator func(uri string, conf *RedisConfig) (Meta, error)
+
+var engines = make(map[string]Creator)
+
+// Register adds a meta engine for the scheme of URL, it should be called in init().
+func Register(scheme string, create Creator) {
+	engines[scheme] = create
+}
+
+// NewClient creates a meta store using the engine registered for the scheme of the URL.
+func NewClient(uri string, conf *RedisConfig) (Meta, error) {
+	p := strings.Index(uri, "://")
+	if p < 0 {
+		return nil, fmt.Errorf("invalid meta URL: %s", uri)
+	}
+	create, ok := engines[uri[:p]]
+	if !ok {
+		return nil, fmt.Errorf("invalid meta engine: %s", uri[:p])
+	}
+	return create(uri, conf)
+}
@@ -0,0 +1,36 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package meta
+
+import "testing"
+
+func TestRegister(t *testing.T) {
+	var called string
+	Register("fake", func(uri string, conf *RedisConfig) (Meta, error) {
+		called = uri
+		return newMemMeta(uri, conf)
+	})
+	defer delete(engines, "fake")
+	if m, err := NewClient("fake://test", &RedisConfig{}); err != nil || m == nil || called != "fake://test" {
+		t.Fatalf("create fake meta: %v %s %s", m, err, called)
+	}
+	if _, err := NewClient("unknown://test", &RedisConfig{}); err == nil {
+		t.Fatalf("unknown engine should fail")
+	}
+	if _, err := NewClient("127.0.0.1:6379", &RedisConfig{}); err == nil {
+		t.Fatalf("URL without scheme should fail")
+	}
+}
@@ -0,0 +1,48 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package meta
+
+import (
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/jobs"
+)
+
+// leaderLease is held by the client elected to run the exclusive background jobs,
+// so the jobs scanning the whole volume are not repeated by every client.
+const leaderLease = "leader"
+
+// elect tries to acquire the lease of leader, and renews it once acquired. The lease
+// expires after three intervals, then another client will take over. It waits for an
+// interval before the first try, so short-lived processes (e.g. the parent of a daemon)
+// won't hold the lease.
+func elect(m Meta, interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		ok, err := m.Lease(leaderLease, interval*3)
+		if err != nil {
+			logger.Warnf("lease %s: %s", leaderLease, err)
+		}
+		if ok != jobs.IsLeader() {
+			if ok {
+				logger.Infof("This client is elected as the leader to run background jobs")
+			} else {
+				logger.Infof("This client is not the leader anymore")
+			}
+			jobs.SetLeader(ok)
+		}
+	}
+}
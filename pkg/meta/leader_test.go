@@ -0,0 +1,77 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package meta
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLease(t *testing.T) {
+	m, err := NewRedisMeta("redis://127.0.0.1/15", &RedisConfig{})
+	if err != nil {
+		t.Logf("redis is not available: %s", err)
+		t.Skip()
+	}
+	m.(*redisMeta).rdb.FlushDB(Background)
+	testLease(t, m)
+}
+
+// setSid pretends the client to be another session.
+func setSid(m Meta, sid uint64) {
+	switch m := m.(type) {
+	case *redisMeta:
+		m.sid = int64(sid)
+	case *kvMeta:
+		m.sid = sid
+	}
+}
+
+func testLease(t *testing.T, m Meta) {
+	if err := m.Init(Format{Name: "test"}, false); err != nil {
+		t.Fatalf("init: %s", err)
+	}
+	lease := func(sid uint64, ttl time.Duration) bool {
+		setSid(m, sid)
+		ok, err := m.Lease("test", ttl)
+		if err != nil {
+			t.Fatalf("lease by %d: %s", sid, err)
+		}
+		return ok
+	}
+	if !lease(1, time.Second) {
+		t.Fatalf("lease should be acquired by 1")
+	}
+	if lease(2, time.Second) {
+		t.Fatalf("lease should be held by 1")
+	}
+	if !lease(1, time.Second) {
+		t.Fatalf("lease should be renewed by 1")
+	}
+	time.Sleep(time.Millisecond * 1100)
+	if !lease(2, time.Second) {
+		t.Fatalf("lease should be taken over by 2 after expired")
+	}
+	if lease(1, time.Second) {
+		t.Fatalf("lease should be held by 2")
+	}
+	if !lease(2, 0) {
+		t.Fatalf("lease should be released by 2")
+	}
+	if !lease(1, time.Second) {
+		t.Fatalf("lease should be acquired by 1 after released")
+	}
+}
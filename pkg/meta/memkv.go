@@ -0,0 +1,138 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package meta
+
+import (
+	"sort"
+	"sync"
+)
+
+// memKV is a transactional key-value store in memory, the transactions are serialized.
+type memKV struct {
+	sync.Mutex
+	items map[string][]byte
+	keys  []string // sorted
+}
+
+type memTxn struct {
+	store  *memKV
+	buffer map[string][]byte
+}
+
+func (tx *memTxn) get(key []byte) []byte {
+	if v, ok := tx.buffer[string(key)]; ok {
+		return v
+	}
+	return tx.store.items[string(key)]
+}
+
+func (tx *memTxn) gets(keys ...[]byte) [][]byte {
+	values := make([][]byte, len(keys))
+	for i, key := range keys {
+		values[i] = tx.get(key)
+	}
+	return values
+}
+
+func (tx *memTxn) scanRange(begin, end []byte, limit int) ([][]byte, [][]byte) {
+	var pending []string
+	for k, v := range tx.buffer {
+		if v != nil && k >= string(begin) && (end == nil || k < string(end)) {
+			if _, ok := tx.store.items[k]; !ok {
+				pending = append(pending, k)
+			}
+		}
+	}
+	sort.Strings(pending)
+
+	var keys, values [][]byte
+	ks := tx.store.keys
+	i := sort.SearchStrings(ks, string(begin))
+	for limit <= 0 || len(keys) < limit {
+		var k string
+		if i < len(ks) && (len(pending) == 0 || ks[i] < pending[0]) {
+			k = ks[i]
+			i++
+		} else if len(pending) > 0 {
+			k = pending[0]
+			pending = pending[1:]
+		} else {
+			break
+		}
+		if end != nil && k >= string(end) {
+			break
+		}
+		v := tx.get([]byte(k))
+		if v == nil {
+			continue // deleted in this transaction
+		}
+		keys = append(keys, []byte(k))
+		values = append(values, v)
+	}
+	return keys, values
+}
+
+func (tx *memTxn) set(key, value []byte) {
+	tx.buffer[string(key)] = append([]byte{}, value...)
+}
+
+func (tx *memTxn) dels(keys ...[]byte) {
+	for _, key := range keys {
+		tx.buffer[string(key)] = nil
+	}
+}
+
+func (c *memKV) name() string {
+	return "memkv"
+}
+
+func (c *memKV) txn(f func(kvTxn) error) error {
+	c.Lock()
+	defer c.Unlock()
+	tx := &memTxn{c, make(map[string][]byte)}
+	if err := f(tx); err != nil {
+		return err
+	}
+	for k, v := range tx.buffer {
+		_, ok := c.items[k]
+		if v == nil {
+			if ok {
+				delete(c.items, k)
+				i := sort.SearchStrings(c.keys, k)
+				c.keys = append(c.keys[:i], c.keys[i+1:]...)
+			}
+			continue
+		}
+		if !ok {
+			i := sort.SearchStrings(c.keys, k)
+			c.keys = append(c.keys, "")
+			copy(c.keys[i+1:], c.keys[i:])
+			c.keys[i] = k
+		}
+		c.items[k] = v
+	}
+	return nil
+}
+
+// newMemMeta returns a meta store in memory, the URL is like memkv://name.
+// Every client has its own store, which is gone when the process exits.
+func newMemMeta(addr string, conf *RedisConfig) (Meta, error) {
+	return newKVMeta(&memKV{items: make(map[string][]byte)}, conf), nil
+}
+
+func init() {
+	Register("memkv", newMemMeta)
+}
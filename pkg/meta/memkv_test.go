@@ -0,0 +1,51 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package meta
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestMemKVScan(t *testing.T) {
+	c := &memKV{items: make(map[string][]byte)}
+	_ = c.txn(func(tx kvTxn) error {
+		tx.set([]byte("a"), []byte("1"))
+		tx.set([]byte("c"), []byte("3"))
+		tx.set([]byte("e"), []byte("5"))
+		return nil
+	})
+	_ = c.txn(func(tx kvTxn) error {
+		tx.set([]byte("b"), []byte("2"))
+		tx.dels([]byte("c"))
+		tx.set([]byte("e"), []byte("6"))
+		keys, values := tx.scanRange([]byte("a"), []byte("f"), 0)
+		if r := fmt.Sprintf("%s %s", keys, values); r != "[a b e] [1 2 6]" {
+			t.Fatalf("scan with pending changes: %s", r)
+		}
+		keys, _ = tx.scanRange([]byte("b"), nil, 1)
+		if len(keys) != 1 || string(keys[0]) != "b" {
+			t.Fatalf("scan with limit: %s", keys)
+		}
+		return nil
+	})
+	if r := fmt.Sprintf("%s", c.keys); r != "[a b e]" {
+		t.Fatalf("keys after commit: %s", r)
+	}
+	if string(c.items["e"]) != "6" {
+		t.Fatalf("value of e: %s", c.items["e"])
+	}
+}
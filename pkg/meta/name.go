@@ -0,0 +1,108 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package meta
+
+import (
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"unicode/utf8"
+
+	"golang.org/x/text/cases"
+)
+
+// namePolicy restricts the names of new files and directories, so a volume
+// shared with other systems (e.g. Windows over SMB) never gets names which
+// can't be represented there. The existing names are not checked.
+type namePolicy struct {
+	maxLength int  // max bytes of a name, 0 means 255, which is checked by vfs
+	utf8      bool // must be valid UTF-8
+	windows   bool // must be valid on Windows
+}
+
+func (f *Format) namePolicy() namePolicy {
+	return namePolicy{f.MaxNameLength, f.UTF8Names, f.WindowsNames}
+}
+
+// reserved names of devices on Windows, with or without extension.
+var windowsReserved = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+func validWindowsName(name string) bool {
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if c < 32 || strings.IndexByte(`<>:"/\|?*`, c) >= 0 {
+			return false
+		}
+	}
+	if strings.HasSuffix(name, " ") || strings.HasSuffix(name, ".") {
+		return false
+	}
+	base := name
+	if i := strings.IndexByte(name, '.'); i >= 0 {
+		base = name[:i]
+	}
+	return !windowsReserved[strings.ToUpper(strings.TrimRight(base, " "))]
+}
+
+// check returns ENAMETOOLONG if the name is too long, or EINVAL if it's not allowed.
+func (p namePolicy) check(name string) syscall.Errno {
+	if p.maxLength > 0 && len(name) > p.maxLength {
+		return syscall.ENAMETOOLONG
+	}
+	if p.utf8 && !utf8.ValidString(name) {
+		return syscall.EINVAL
+	}
+	if p.windows && !validWindowsName(name) {
+		return syscall.EINVAL
+	}
+	return 0
+}
+
+// checkName validates a new name with the policy loaded from setting.
+func checkName(policy *atomic.Value, name string) syscall.Errno {
+	if p, ok := policy.Load().(namePolicy); ok {
+		return p.check(name)
+	}
+	return 0
+}
+
+// In a case-insensitive volume, the names are case-folded (full Unicode folding,
+// e.g. "Straße" and "STRASSE" are the same) as the keys of entries in directory,
+// and the original names are kept in the entries to be listed, so they are
+// case-preserving.
+
+// foldName returns the key of a name in case-insensitive volume.
+func foldName(name string) string {
+	// a Caser keeps states, so it can't be shared
+	return cases.Fold().String(name)
+}
+
+// packNamedEntry packs an entry followed by the original name.
+func packNamedEntry(_type uint8, inode Ino, name string) []byte {
+	return append(packEntry(_type, inode), name...)
+}
+
+// entryName returns the original name of an entry stored with key.
+func entryName(key, buf []byte) []byte {
+	if len(buf) > 9 {
+		return buf[9:]
+	}
+	return key
+}
@@ -0,0 +1,148 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package meta
+
+import (
+	"syscall"
+	"testing"
+)
+
+func TestNamePolicy(t *testing.T) {
+	p := namePolicy{maxLength: 10, utf8: true, windows: true}
+	cases := map[string]syscall.Errno{
+		"a.txt":       0,
+		"中文":          0,
+		"console.log": syscall.ENAMETOOLONG,
+		"\xff\xfe":    syscall.EINVAL,
+		"a:b":         syscall.EINVAL,
+		"a?":          syscall.EINVAL,
+		"tab\t":       syscall.EINVAL,
+		"dot.":        syscall.EINVAL,
+		"space ":      syscall.EINVAL,
+		"CON":         syscall.EINVAL,
+		"nul.txt":     syscall.EINVAL,
+		"com1":        syscall.EINVAL,
+		"com10":       0,
+		"CONFIG":      0,
+	}
+	for name, expected := range cases {
+		if st := p.check(name); st != expected {
+			t.Fatalf("check %q: expect %s, but got %s", name, expected, st)
+		}
+	}
+	if st := (namePolicy{}).check("\xff:CON."); st != 0 {
+		t.Fatalf("no policy: %s", st)
+	}
+
+	m := newMemClient(t)
+	if err := m.Init(Format{Name: "test", WindowsNames: true}, false); err != nil {
+		t.Fatalf("init: %s", err)
+	}
+	if _, err := m.Load(); err != nil {
+		t.Fatalf("load: %s", err)
+	}
+	ctx := Background
+	var inode Ino
+	var attr = &Attr{}
+	if st := m.Create(ctx, 1, "a|b", 0644, 022, &inode, attr); st != syscall.EINVAL {
+		t.Fatalf("create with invalid name: %s", st)
+	}
+	if st := m.Mkdir(ctx, 1, "d", 0755, 022, 0, &inode, attr); st != 0 {
+		t.Fatalf("mkdir: %s", st)
+	}
+	if st := m.Rename(ctx, 1, "d", 1, "aux", 0, &inode, attr); st != syscall.EINVAL {
+		t.Fatalf("rename to invalid name: %s", st)
+	}
+}
+
+func TestCaseInsensitive(t *testing.T) {
+	testCaseInsensitive(t, newMemClient(t))
+	m, err := NewRedisMeta("redis://127.0.0.1/15", &RedisConfig{})
+	if err != nil {
+		t.Logf("redis is not available: %s", err)
+		t.Skip()
+	}
+	m.(*redisMeta).rdb.FlushDB(Background)
+	testCaseInsensitive(t, m)
+}
+
+func testCaseInsensitive(t *testing.T, m Meta) {
+	if err := m.Init(Format{Name: "test", CaseInsensitive: true, NameIndex: true}, true); err != nil {
+		t.Fatalf("init: %s", err)
+	}
+	if _, err := m.Load(); err != nil {
+		t.Fatalf("load: %s", err)
+	}
+	ctx := Background
+	var inode, found Ino
+	var attr = &Attr{}
+	if st := m.Mkdir(ctx, 1, "Dir", 0755, 022, 0, &inode, attr); st != 0 {
+		t.Fatalf("mkdir: %s", st)
+	}
+	if st := m.Lookup(ctx, 1, "dIR", &found, attr); st != 0 || found != inode {
+		t.Fatalf("lookup: %s %d", st, found)
+	}
+	if st := m.Mkdir(ctx, 1, "DIR", 0755, 022, 0, &found, attr); st != syscall.EEXIST {
+		t.Fatalf("mkdir with another case: %s", st)
+	}
+	var entries []*Entry
+	if st := m.Readdir(ctx, 1, 0, &entries); st != 0 || len(entries) != 3 || string(entries[2].Name) != "Dir" {
+		t.Fatalf("readdir: %s %d", st, len(entries))
+	}
+	if st := m.Rename(ctx, 1, "dir", 1, "DIR", 0, &found, attr); st != 0 {
+		t.Fatalf("rename to another case: %s", st)
+	}
+	entries = nil
+	if st := m.Readdir(ctx, 1, 0, &entries); st != 0 || len(entries) != 3 || string(entries[2].Name) != "DIR" {
+		t.Fatalf("readdir after rename: %s %d", st, len(entries))
+	}
+	if s := findNames(t, m, "*"); s != "1/DIR" {
+		t.Fatalf("find after rename: %s", s)
+	}
+	if st := m.Rmdir(ctx, 1, "dir"); st != 0 {
+		t.Fatalf("rmdir: %s", st)
+	}
+
+	// full case folding
+	if st := m.Mkdir(ctx, 1, "Straße", 0755, 022, 0, &inode, attr); st != 0 {
+		t.Fatalf("mkdir: %s", st)
+	}
+	if st := m.Lookup(ctx, 1, "STRASSE", &found, attr); st != 0 || found != inode {
+		t.Fatalf("lookup with folded name: %s %d", st, found)
+	}
+	if st := m.Rmdir(ctx, 1, "strasse"); st != 0 {
+		t.Fatalf("rmdir: %s", st)
+	}
+}
+
+func TestCaseInsensitiveRefreshed(t *testing.T) {
+	m := newMemClient(t).(*kvMeta)
+	if err := m.Init(Format{Name: "test", CaseInsensitive: true}, false); err != nil {
+		t.Fatalf("init: %s", err)
+	}
+	// refreshed with the session, without Load
+	if err := m.loadSetting(false); err != nil {
+		t.Fatalf("load setting: %s", err)
+	}
+	var inode, found Ino
+	attr := &Attr{}
+	if st := m.Mkdir(Background, 1, "Dir", 0755, 022, 0, &inode, attr); st != 0 {
+		t.Fatalf("mkdir: %s", st)
+	}
+	if st := m.Lookup(Background, 1, "DIR", &found, attr); st != 0 || found != inode {
+		t.Fatalf("lookup: %s %d", st, found)
+	}
+}
@@ -0,0 +1,55 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package meta
+
+import (
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Like the project quota of XFS, a project id is assigned to a directory tree by
+// setting the extended attribute project.id (by root), it's inherited by the
+// files and directories created inside it. The space and inodes used by every
+// project are accounted, and ENOSPC is returned when the quota of it is exceeded.
+// Renaming or linking a file into a directory of another project fails with EXDEV.
+const projectXattr = "project.id"
+
+// parseProject returns the project id in the value of extended attribute, 0 means no project.
+func parseProject(value []byte) (uint32, syscall.Errno) {
+	if len(value) == 0 {
+		return 0, 0
+	}
+	prj, err := strconv.ParseUint(strings.TrimSpace(string(value)), 10, 32)
+	if err != nil {
+		return 0, syscall.EINVAL
+	}
+	return uint32(prj), 0
+}
+
+// checkProjectMove returns EXDEV if a node of project prj can't be moved into a directory of project dprj.
+func checkProjectMove(prj, dprj uint32) syscall.Errno {
+	if dprj != 0 && prj != dprj {
+		return syscall.EXDEV
+	}
+	return 0
+}
+
+// exceeded returns true if the quota can't hold more space and inodes.
+func (q *Quota) exceeded(space, inodes int64) bool {
+	return q.MaxSpace > 0 && space > 0 && q.UsedSpace+space > q.MaxSpace ||
+		q.MaxInodes > 0 && inodes > 0 && q.UsedInodes+inodes > q.MaxInodes
+}
@@ -18,35 +18,55 @@ package meta
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"hash/fnv"
+	"io"
 	"math/rand"
 	"net"
+	"net/url"
 	"os"
+	"reflect"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/go-redis/redis/v8"
 
+	"github.com/juicedata/juicefs/pkg/jobs"
 	"github.com/juicedata/juicefs/pkg/utils"
 )
 
 /*
 	Node: i$inode -> Attribute{type,mode,uid,gid,atime,mtime,ctime,nlink,length,rdev}
-	Dir:   d$inode -> {name -> {inode,type}}
+	Dir:   d$inode -> {name -> {inode,type}}, d$inode_$shard for huge ones (number of shards in field "")
 	File:  c$inode_$indx -> [Slice{pos,id,length,off,len}]
 	Symlink: s$inode -> target
 	Xattr: x$inode -> {name -> value}
+	Tags: t$inode -> {key -> value}, tag:$key -> {inode -> value}
 	Flock: lockf$inode -> { $sid_$owner -> ltype }
 	POSIX lock: lockp$inode -> { $sid_$owner -> Plock(pid,ltype,start,end) }
-	Sessions: sessions -> [ $sid -> heartbeat ]
+	Delegations: deleg$inode -> [{sid,ltype,recalled,expire}]
+	Sessions: sessions -> [ $sid -> heartbeat ], sessionInfos -> {$sid -> info}
+	Leases: lease:$name -> $sid:$expire
 	Removed files: delfiles -> [$inode:$length -> seconds]
 	Slices refs: k$chunkid_$size -> refcount
+	Deduplicated blocks: b$chunkid -> {$indx -> {hash,key}}, dedup$hash -> {refs,key}
+	Name index: nameindex -> [{reversed name,0,parent,inode}]
+	Gateway users: gatewayusers -> {access key -> user}
+	Checkpoints: checkpoints -> {name -> progress}
+	Hot directories: hotdirs -> [$inode -> expire], the changes of them are published to channel changelog
+
+	All the keys are prefixed by "$prefix:" if the URL has a query like ?prefix=vol1,
+	so multiple volumes can share one database.
 
 	Redis features:
 	  Sorted Set: 1.2+
@@ -60,19 +80,40 @@ var logger = utils.GetLogger("juicefs")
 
 const usedSpace = "usedSpace"
 const totalInodes = "totalInodes"
+const userSpace = "userSpace"
+const userInodes = "userInodes"
+const groupSpace = "groupSpace"
+const groupInodes = "groupInodes"
+const projectSpace = "projectSpace"
+const projectInodes = "projectInodes"
+const projectQuotas = "projectQuotas"
 const delfiles = "delfiles"
 const allSessions = "sessions"
+const sessionInfos = "sessionInfos"
+const packedBlocks = "packs"
+const packRefs = "packrefs"
+const replicationQueue = "replication"
+const replicationLeases = "replicating"
+const externalChunks = "externals"
+const nameIndex = "nameindex"
+const gatewayUsers = "gatewayusers"
+const checkpoints = "checkpoints"
+const replicaHeartbeat = "replicaHeartbeat"
 
 const scriptLookup = `
 local parse = function(buf, idx, pos)
 	return bit.lshift(string.byte(buf, idx), pos)
 end
 
-local buf = redis.call('HGET', KEYS[1], KEYS[2])
+local vals = redis.call('HMGET', KEYS[1], KEYS[2], '')
+local buf = vals[1]
 if not buf then
+       if vals[2] then
+              return {0, vals[2]}
+       end
        return false
 end
-if string.len(buf) ~= 9 then
+if string.len(buf) < 9 then
        return {err=string.format("Invalid entry data: %s", buf)}
 end
 buf = string.sub(buf, 2)
@@ -84,29 +125,65 @@ local ino =  parse(buf, 1, 56) +
              parse(buf, 6, 16) +
              parse(buf, 7, 8) +
              parse(buf, 8, 0)
-return {ino, redis.call('GET', "i" .. tostring(ino))}
+return {ino, redis.call('GET', ARGV[1] .. "i" .. tostring(ino))}
 `
 
 // RedisConfig is config for Redis client.
 type RedisConfig struct {
-	Strict  bool // update ctime
-	Retries int
+	Strict       bool // update ctime
+	Retries      int
+	ReadReplica  string        // URL of a replica to serve Lookup, GetAttr and Readdir
+	MaxStaleness time.Duration // max lag of the replica before reads fall back to primary
+	Token        string        // access token checked in NewSession
+	Heartbeat    time.Duration // interval to refresh the session, at most one minute
+	Grace        time.Duration // how long operations wait for Redis to recover from an outage before failing
+	ReadOnly     bool          // the session is read-only even with a read-write token
+	NoBGJob      bool          // leave the background jobs to other clients
+	HotCache     time.Duration // how long to cache the attributes of hot directories, 0 means disabled
+}
+
+// heartbeat returns the interval to refresh session, which should be less than
+// one minute, because other clients consider a session as stale in a few minutes.
+func (c *RedisConfig) heartbeat() time.Duration {
+	if c.Heartbeat <= 0 || c.Heartbeat > time.Minute {
+		return time.Minute
+	}
+	return c.Heartbeat
 }
 
 type redisMeta struct {
 	sync.Mutex
 	conf    *RedisConfig
 	rdb     *redis.Client
+	prefix  string           // prefix of all the keys, empty or "$name:"
 	txlocks [1024]sync.Mutex // Pessimistic locks to reduce conflict on Redis
 
 	sid          int64
+	readOnly     bool         // the session is authorized by a read-only token
+	capacity     uint64       // max bytes of data, refreshed with session
+	names        atomic.Value // namePolicy, refreshed with session
 	openFiles    map[Ino]int
 	removedFiles map[Ino]bool
+	writing      map[Ino]bool // retained files created by this client and not closed yet
 	compacting   map[uint64]bool
+	resharding   map[Ino]bool // directories being split or merged by this client
 	symlinks     *sync.Map
 	msgCallbacks *msgCallbacks
+	delegs       *delegations
+	hot          *hotDirs
+	hotShared    atomic.Value // map[Ino]bool, the directories which are hot in any client
+
+	caseInsensitive bool // set when the format is loaded
+	indexNames      bool // set when the format is loaded
+	dirShards       bool // huge directories are split into shards, set when the format is loaded
+
+	heldUntil int64 // the hold of deletion recorded in the session, see ackHold
 
 	shaLookup string // The SHA returned by Redis for the loaded `scriptLookup`
+
+	replica    *redis.Client
+	replicaLag int64 // nanoseconds, negative if the replica is not usable
+	lastWrite  int64 // unix nano of the last transaction from this client
 }
 
 var _ Meta = &redisMeta{}
@@ -116,11 +193,120 @@ type msgCallbacks struct {
 	callbacks map[uint32]MsgCallback
 }
 
+func init() {
+	Register("redis", NewRedisMeta)
+	Register("rediss", NewRedisMeta)
+	Register("unix", NewRedisMeta)
+}
+
+var validPrefix = regexp.MustCompile(`^[a-zA-Z0-9_.-]+$`)
+
+// splitPrefix removes the prefix from the URL, which is not accepted by Redis client.
+func splitPrefix(uri string) (string, string, error) {
+	p := strings.Index(uri, "?")
+	if p < 0 {
+		return uri, "", nil
+	}
+	q, err := url.ParseQuery(uri[p+1:])
+	if err != nil {
+		return "", "", fmt.Errorf("parse query of %s: %s", uri, err)
+	}
+	prefix := q.Get("prefix")
+	if prefix == "" || len(q) > 1 {
+		return "", "", fmt.Errorf("only prefix is supported in query: %s", uri[p+1:])
+	}
+	if !validPrefix.MatchString(prefix) {
+		return "", "", fmt.Errorf("invalid prefix %q, only letters, digits, '-', '_' and '.' are allowed", prefix)
+	}
+	return uri[:p], prefix + ":", nil
+}
+
+// tlsConfig is the base settings of the TLS connections to Redis (rediss://).
+var tlsConfig *tls.Config
+
+// SetTLSConfig sets the trusted CAs and pinned keys of the TLS connections to Redis,
+// it should be called before any client is created.
+func SetTLSConfig(conf *tls.Config) {
+	tlsConfig = conf
+}
+
+// parseRedisURL parses the URL of Redis like redis.ParseURL, the host could also be a list of
+// sentinels with IPv6 addresses (e.g. redis://master,[::1],[::2]:26379/1) or an IPv6 address
+// without port (e.g. redis://[::1]/1), which can't be handled by redis.ParseURL.
+func parseRedisURL(uri string) (*redis.Options, error) {
+	p := strings.Index(uri, "://")
+	if p < 0 || strings.HasPrefix(uri, "unix://") {
+		return redis.ParseURL(uri)
+	}
+	start, end := p+3, len(uri)
+	if p = strings.Index(uri[start:], "/"); p >= 0 {
+		end = start + p
+	}
+	if p = strings.LastIndex(uri[start:end], "@"); p >= 0 {
+		start += p + 1
+	}
+	host := uri[start:end]
+	opt, err := redis.ParseURL(uri[:start] + "localhost" + uri[end:])
+	if err != nil {
+		return nil, err
+	}
+	if strings.Contains(host, ",") {
+		opt.Addr = host
+	} else {
+		h, p := utils.SplitHostPort(host)
+		if h == "" {
+			h = "localhost"
+		}
+		if p == "" {
+			p = "6379"
+		}
+		opt.Addr = net.JoinHostPort(h, p)
+		if opt.TLSConfig != nil {
+			opt.TLSConfig.ServerName = h
+		}
+	}
+	return opt, nil
+}
+
+// ipDialer connects to the addresses of preferred family first, it's used only when the
+// family is specified, the default dialer connects in the order of resolver.
+func ipDialer(conf *tls.Config) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	if utils.IPFamily == "" {
+		return nil
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := utils.DialContext(ctx, network, addr, time.Second*5)
+		if err == nil && conf != nil {
+			conn = tls.Client(conn, conf)
+		}
+		return conn, err
+	}
+}
+
+func setupTLS(opt *redis.Options) {
+	if opt.TLSConfig != nil && tlsConfig != nil {
+		conf := tlsConfig.Clone()
+		conf.ServerName = opt.TLSConfig.ServerName
+		opt.TLSConfig = conf
+	}
+}
+
 // NewRedisMeta return a meta store using Redis.
-func NewRedisMeta(url string, conf *RedisConfig) (Meta, error) {
-	opt, err := redis.ParseURL(url)
+func NewRedisMeta(addr string, conf *RedisConfig) (Meta, error) {
+	addr, prefix, err := splitPrefix(addr)
+	if err != nil {
+		return nil, err
+	}
+	opt, err := parseRedisURL(addr)
 	if err != nil {
-		return nil, fmt.Errorf("parse %s: %s", url, err)
+		return nil, fmt.Errorf("parse %s: %s", addr, err)
+	}
+	setupTLS(opt)
+	opt.Dialer = ipDialer(opt.TLSConfig)
+	var grace *graceDialer
+	if conf.Grace > 0 {
+		grace = newGraceDialer(opt, conf.Grace)
+		opt.Dialer = grace.Dial
 	}
 	var rdb *redis.Client
 	if strings.Contains(opt.Addr, ",") {
@@ -128,10 +314,10 @@ func NewRedisMeta(url string, conf *RedisConfig) (Meta, error) {
 		ps := strings.Split(opt.Addr, ",")
 		fopt.MasterName = ps[0]
 		fopt.SentinelAddrs = ps[1:]
-		_, port, _ := net.SplitHostPort(fopt.SentinelAddrs[len(fopt.SentinelAddrs)-1])
+		_, port := utils.SplitHostPort(fopt.SentinelAddrs[len(fopt.SentinelAddrs)-1])
 		if port != "" {
 			for i := range fopt.SentinelAddrs {
-				h, p, _ := net.SplitHostPort(fopt.SentinelAddrs[i])
+				h, p := utils.SplitHostPort(fopt.SentinelAddrs[i])
 				if p == "" {
 					fopt.SentinelAddrs[i] = net.JoinHostPort(h, port)
 				}
@@ -149,11 +335,16 @@ func NewRedisMeta(url string, conf *RedisConfig) (Meta, error) {
 		}
 		fopt.DB = opt.DB
 		fopt.TLSConfig = opt.TLSConfig
+		fopt.Dialer = opt.Dialer
 		fopt.MaxRetries = conf.Retries
 		fopt.MinRetryBackoff = time.Millisecond * 100
 		fopt.MaxRetryBackoff = time.Minute * 1
 		fopt.ReadTimeout = time.Second * 30
 		fopt.WriteTimeout = time.Second * 5
+		fopt.PoolTimeout = fopt.ReadTimeout + time.Second + conf.Grace
+		if grace != nil {
+			grace.master = sentinelMaster(&fopt, grace.dial)
+		}
 		rdb = redis.NewFailoverClient(&fopt)
 	} else {
 		if opt.Password == "" && os.Getenv("REDIS_PASSWORD") != "" {
@@ -164,18 +355,45 @@ func NewRedisMeta(url string, conf *RedisConfig) (Meta, error) {
 		opt.MaxRetryBackoff = time.Minute * 1
 		opt.ReadTimeout = time.Second * 30
 		opt.WriteTimeout = time.Second * 5
+		opt.PoolTimeout = opt.ReadTimeout + time.Second + conf.Grace
 		rdb = redis.NewClient(opt)
 	}
 	m := &redisMeta{
 		conf:         conf,
 		rdb:          rdb,
+		prefix:       prefix,
 		openFiles:    make(map[Ino]int),
 		removedFiles: make(map[Ino]bool),
+		writing:      make(map[Ino]bool),
 		compacting:   make(map[uint64]bool),
+		resharding:   make(map[Ino]bool),
 		symlinks:     &sync.Map{},
 		msgCallbacks: &msgCallbacks{
 			callbacks: make(map[uint32]MsgCallback),
 		},
+		delegs:     newDelegations(),
+		hot:        newHotDirs(conf.HotCache),
+		replicaLag: -1,
+	}
+	setupTrace(rdb)
+	if conf.ReadReplica != "" {
+		ropt, err := parseRedisURL(conf.ReadReplica)
+		if err != nil {
+			return nil, fmt.Errorf("parse %s: %s", conf.ReadReplica, err)
+		}
+		setupTLS(ropt)
+		ropt.Dialer = ipDialer(ropt.TLSConfig)
+		if ropt.Password == "" && os.Getenv("REDIS_PASSWORD") != "" {
+			ropt.Password = os.Getenv("REDIS_PASSWORD")
+		}
+		ropt.MaxRetries = 1
+		ropt.ReadTimeout = time.Second * 5
+		ropt.WriteTimeout = time.Second * 5
+		m.replica = redis.NewClient(ropt)
+		setupTrace(m.replica)
+		if m.conf.MaxStaleness <= 0 {
+			m.conf.MaxStaleness = time.Second * 5
+		}
 	}
 
 	m.checkServerConfig()
@@ -183,7 +401,7 @@ func NewRedisMeta(url string, conf *RedisConfig) (Meta, error) {
 }
 
 func (r *redisMeta) Init(format Format, force bool) error {
-	body, err := r.rdb.Get(Background, "setting").Bytes()
+	body, err := r.rdb.Get(Background, r.prefix+"setting").Bytes()
 	if err != nil && err != redis.Nil {
 		return err
 	}
@@ -193,32 +411,53 @@ func (r *redisMeta) Init(format Format, force bool) error {
 		if err != nil {
 			logger.Fatalf("existing format is broken: %s", err)
 		}
+		if err = old.decryptSecrets(); err != nil && !force {
+			return fmt.Errorf("existing format: %s", err)
+		}
+		if r.prefix != "" && old.Name != format.Name {
+			return fmt.Errorf("prefix %q is used by volume %s", strings.TrimSuffix(r.prefix, ":"), old.Name)
+		}
+		if err = old.checkTokenChange(&format, r.conf.Token); err != nil {
+			return err
+		}
 		if force {
-			old.SecretKey = "removed"
+			old.RemoveSecret()
 			logger.Warnf("Existing volume will be overwrited: %+v", old)
 		} else {
-			// only AccessKey and SecretKey can be safely updated.
+			// only the credentials, access tokens, networks, capacity and name policies can be safely updated.
 			format.UUID = old.UUID
+			format.HoldDeletionUntil = old.HoldDeletionUntil // set by backup
 			old.AccessKey = format.AccessKey
 			old.SecretKey = format.SecretKey
-			if format != old {
-				old.SecretKey = ""
-				format.SecretKey = ""
+			old.KeyEncrypted = format.KeyEncrypted
+			old.TokenHash = format.TokenHash
+			old.ReadOnlyTokenHash = format.ReadOnlyTokenHash
+			old.Capacity = format.Capacity
+			old.MaxNameLength = format.MaxNameLength
+			old.UTF8Names = format.UTF8Names
+			old.WindowsNames = format.WindowsNames
+			old.AllowedNetworks = format.AllowedNetworks
+			if !reflect.DeepEqual(format, old) {
+				old.RemoveSecret()
+				format.RemoveSecret()
 				return fmt.Errorf("cannot update format from %+v to %+v", old, format)
 			}
 		}
 	}
 
+	if err = format.encryptSecrets(); err != nil {
+		return err
+	}
 	data, err := json.MarshalIndent(format, "", "")
 	if err != nil {
 		logger.Fatalf("json: %s", err)
 	}
-	err = r.rdb.Set(Background, "setting", data, 0).Err()
+	err = r.rdb.Set(Background, r.prefix+"setting", data, 0).Err()
 	if err != nil {
 		return err
 	}
 
-	// root inode
+	// root inode, the existing one is kept
 	var attr Attr
 	attr.Typ = TypeDirectory
 	attr.Mode = 0777
@@ -229,13 +468,13 @@ func (r *redisMeta) Init(format Format, force bool) error {
 	attr.Nlink = 2
 	attr.Length = 4 << 10
 	attr.Parent = 1
-	return r.rdb.Set(Background, r.inodeKey(1), r.marshal(&attr), 0).Err()
+	return r.rdb.SetNX(Background, r.inodeKey(1), marshalAttr(&attr), 0).Err()
 }
 
 func (r *redisMeta) Load() (*Format, error) {
-	body, err := r.rdb.Get(Background, "setting").Bytes()
+	body, err := r.rdb.Get(Background, r.prefix+"setting").Bytes()
 	if err == redis.Nil {
-		return nil, fmt.Errorf("no volume found")
+		return nil, ErrNoVolume
 	}
 	if err != nil {
 		return nil, err
@@ -245,16 +484,232 @@ func (r *redisMeta) Load() (*Format, error) {
 	if err != nil {
 		return nil, fmt.Errorf("json: %s", err)
 	}
+	if err = format.decryptSecrets(); err != nil {
+		return nil, err
+	}
+	atomic.StoreUint64(&r.capacity, format.Capacity)
+	r.caseInsensitive = format.CaseInsensitive
+	r.indexNames = format.NameIndex
+	r.dirShards = format.DirShards
+	r.names.Store(format.namePolicy())
 	return &format, nil
 }
 
+func (r *redisMeta) UpdateFormat(format Format) error {
+	if err := format.encryptSecrets(); err != nil {
+		return err
+	}
+	ctx := Background
+	return r.rdb.Watch(ctx, func(tx *redis.Tx) error {
+		body, err := tx.Get(ctx, r.prefix+"setting").Bytes()
+		if err == redis.Nil {
+			return ErrNoVolume
+		}
+		if err != nil {
+			return err
+		}
+		var old Format
+		if err = json.Unmarshal(body, &old); err != nil {
+			return fmt.Errorf("json: %s", err)
+		}
+		if old.Name != format.Name || old.UUID != format.UUID {
+			return fmt.Errorf("cannot update format of volume %s (%s) with %s (%s)", old.Name, old.UUID, format.Name, format.UUID)
+		}
+		data, err := json.MarshalIndent(format, "", "")
+		if err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, r.prefix+"setting", data, 0)
+			return nil
+		})
+		return err
+	}, r.prefix+"setting")
+}
+
+// hasXattr returns true if any node has the extended attribute.
+func (r *redisMeta) hasXattr(ctx Context, name string) (bool, error) {
+	var cursor uint64
+	for {
+		keys, c, err := r.rdb.Scan(ctx, cursor, r.prefix+"x*", 10000).Result()
+		if err != nil {
+			return false, err
+		}
+		p := r.rdb.Pipeline()
+		for _, key := range keys {
+			if _, err := strconv.ParseUint(key[len(r.prefix)+1:], 10, 64); err == nil {
+				_ = p.HExists(ctx, key, name)
+			}
+		}
+		cmds, err := p.Exec(ctx)
+		if err != nil {
+			return false, err
+		}
+		for _, cmd := range cmds {
+			if cmd.(*redis.BoolCmd).Val() {
+				return true, nil
+			}
+		}
+		if c == 0 {
+			return false, nil
+		}
+		cursor = c
+	}
+}
+
+// enableFeature records a feature enabled by the files in the setting, so the clients
+// without it can't modify the volume.
+func (r *redisMeta) enableFeature(ctx Context, name string) error {
+	return r.rdb.Watch(ctx, func(tx *redis.Tx) error {
+		body, err := tx.Get(ctx, r.prefix+"setting").Bytes()
+		if err != nil {
+			return err
+		}
+		data, err := addFeature(body, name)
+		if err != nil || data == nil {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, r.prefix+"setting", data, 0)
+			return nil
+		})
+		return err
+	}, r.prefix+"setting")
+}
+
+// loadSetting loads the setting of volume to update the capacity, and validate
+// the token in config and the network of client if asked. The secret keys in
+// it are not decrypted.
+func (r *redisMeta) loadSetting(checkToken bool) error {
+	body, err := r.rdb.Get(Background, r.prefix+"setting").Bytes()
+	if err == redis.Nil {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var format Format
+	if err = json.Unmarshal(body, &format); err != nil {
+		return fmt.Errorf("json: %s", err)
+	}
+	if checkToken {
+		if r.readOnly, err = format.checkToken(r.conf.Token); err != nil {
+			return err
+		}
+		r.readOnly = r.readOnly || r.conf.ReadOnly
+		if len(format.AllowedNetworks) > 0 {
+			addr, err := r.clientAddr()
+			if err != nil {
+				return fmt.Errorf("get the address of client to check allowed networks: %s", err)
+			}
+			if err = format.checkNetwork(addr); err != nil {
+				return err
+			}
+		}
+		if err = format.checkCompat(r.readOnly); err != nil {
+			return err
+		}
+	} else if err = format.checkCompat(r.readOnly); err != nil {
+		// upgraded by a newer client, the reads may fail if it's not compatible
+		logger.Warnf("%s, this client becomes read-only", err)
+		r.readOnly = true
+	}
+	atomic.StoreUint64(&r.capacity, format.Capacity)
+	r.caseInsensitive = format.CaseInsensitive
+	r.dirShards = format.DirShards
+	r.names.Store(format.namePolicy())
+	r.ackHold(format.HoldDeletionUntil, format.holdDeletion())
+	return nil
+}
+
+// ackHold records the hold of deletion in the session once it's in effect (no job deleting
+// data is running), so the backup knows when all the clients have held the deletion.
+func (r *redisMeta) ackHold(until int64, idle bool) {
+	if r.heldUntil == until || until > 0 && !idle {
+		return
+	}
+	if r.sid == 0 {
+		r.heldUntil = until // recorded when the session is created
+		return
+	}
+	key := strconv.FormatInt(r.sid, 10)
+	var s SessionInfo
+	body, err := r.rdb.HGet(Background, r.prefix+sessionInfos, key).Bytes()
+	if err == nil {
+		err = json.Unmarshal(body, &s)
+	}
+	if err == nil {
+		s.HoldDeletionUntil = until
+		body, _ = json.Marshal(&s)
+		err = r.rdb.HSet(Background, r.prefix+sessionInfos, key, body).Err()
+	}
+	if err != nil {
+		logger.Warnf("record the hold of deletion in session %d: %s", r.sid, err)
+		return
+	}
+	r.heldUntil = until
+}
+
+// clientAddr returns the IP of this client seen by Redis, which can't be faked by the
+// client. It's the address of the proxy if the client is connected through one.
+func (r *redisMeta) clientAddr() (string, error) {
+	c := r.rdb.Conn(Background)
+	defer c.Close()
+	id, err := c.ClientID(Background).Result()
+	if err != nil {
+		return "", err
+	}
+	clients, err := c.ClientList(Background).Result()
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(clients, "\n") {
+		var cid, addr string
+		for _, field := range strings.Fields(line) {
+			if strings.HasPrefix(field, "id=") {
+				cid = field[3:]
+			} else if strings.HasPrefix(field, "addr=") {
+				addr = field[5:]
+			}
+		}
+		if cid != strconv.FormatInt(id, 10) {
+			continue
+		}
+		// the path of socket for unix socket, which is not in any network
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return "", fmt.Errorf("invalid address %q: %s", addr, err)
+		}
+		return host, nil
+	}
+	return "", fmt.Errorf("client %d is not found", id)
+}
+
 func (r *redisMeta) NewSession() error {
-	var err error
-	r.sid, err = r.rdb.Incr(Background, "nextsession").Result()
+	err := r.loadSetting(true)
+	if err != nil {
+		return fmt.Errorf("create session: %s", err)
+	}
+	r.sid, err = r.rdb.Incr(Background, r.prefix+"nextsession").Result()
 	if err != nil {
 		return fmt.Errorf("create session: %s", err)
 	}
 	logger.Debugf("session is is %d", r.sid)
+	addr, err := r.clientAddr()
+	if err != nil {
+		logger.Warnf("get the address of client: %s", err)
+	}
+	s := newSessionInfo(uint64(r.sid), addr)
+	s.HoldDeletionUntil = r.heldUntil
+	info, _ := json.Marshal(s)
+	_, err = r.rdb.TxPipelined(Background, func(pipe redis.Pipeliner) error {
+		pipe.HSet(Background, r.prefix+sessionInfos, strconv.Itoa(int(r.sid)), info)
+		pipe.ZAdd(Background, r.prefix+allSessions, &redis.Z{Score: float64(time.Now().Unix()), Member: strconv.Itoa(int(r.sid))})
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("create session: %s", err)
+	}
 
 	r.shaLookup, err = r.rdb.ScriptLoad(Background, scriptLookup).Result()
 	if err != nil {
@@ -263,6 +718,19 @@ func (r *redisMeta) NewSession() error {
 	}
 
 	go r.refreshSession()
+	go r.watchChangelog()
+	if r.replica != nil {
+		go r.checkReplica()
+	}
+	if r.readOnly {
+		logger.Infof("session %d is read-only", r.sid)
+		return nil
+	}
+	if r.conf.NoBGJob {
+		logger.Infof("background jobs are disabled in session %d", r.sid)
+		return nil
+	}
+	go elect(r, r.conf.heartbeat())
 	go r.cleanupDeletedFiles()
 	go r.cleanupSlices()
 	go r.cleanupLeakedChunks()
@@ -286,35 +754,101 @@ func (r *redisMeta) newMsg(mid uint32, args ...interface{}) error {
 }
 
 func (r *redisMeta) sessionKey(sid int64) string {
-	return "session" + strconv.FormatInt(sid, 10)
+	return r.prefix + "session" + strconv.FormatInt(sid, 10)
 }
 
 func (r *redisMeta) symKey(inode Ino) string {
-	return "s" + inode.String()
+	return r.prefix + "s" + inode.String()
 }
 
 func (r *redisMeta) inodeKey(inode Ino) string {
-	return "i" + inode.String()
+	return r.prefix + "i" + inode.String()
 }
 
 func (r *redisMeta) entryKey(parent Ino) string {
-	return "d" + parent.String()
+	return r.prefix + "d" + parent.String()
+}
+
+// entryField returns the field of a name in the hash of directory.
+func (r *redisMeta) entryField(name string) string {
+	if r.caseInsensitive {
+		return foldName(name)
+	}
+	return name
+}
+
+// newEntry packs the entry of a name in directory.
+func (r *redisMeta) newEntry(_type uint8, inode Ino, name string) []byte {
+	if r.caseInsensitive {
+		return packNamedEntry(_type, inode, name)
+	}
+	return packEntry(_type, inode)
+}
+
+// updateIndex adds or removes an entry in the name index if it's enabled.
+func (r *redisMeta) updateIndex(ctx Context, pipe redis.Pipeliner, parent Ino, name string, inode Ino, add bool) {
+	if !r.indexNames {
+		return
+	}
+	member := packIndexEntry(parent, name, inode)
+	if add {
+		pipe.ZAdd(ctx, r.prefix+nameIndex, &redis.Z{Member: member})
+	} else {
+		pipe.ZRem(ctx, r.prefix+nameIndex, member)
+	}
 }
 
 func (r *redisMeta) chunkKey(inode Ino, indx uint32) string {
-	return "c" + inode.String() + "_" + strconv.FormatInt(int64(indx), 10)
+	return r.prefix + "c" + inode.String() + "_" + strconv.FormatInt(int64(indx), 10)
+}
+
+// parseChunkKey returns the inode and index of a chunk key, ok is false if it's not a chunk
+// of this volume (the keys of other prefixes in the same database may match the pattern).
+func (r *redisMeta) parseChunkKey(key string) (inode Ino, indx uint32, ok bool) {
+	if !strings.HasPrefix(key, r.prefix+"c") {
+		return
+	}
+	ps := strings.Split(key[len(r.prefix)+1:], "_")
+	if len(ps) != 2 {
+		return
+	}
+	ino, err := strconv.ParseUint(ps[0], 10, 64)
+	if err != nil {
+		return
+	}
+	idx, err := strconv.ParseUint(ps[1], 10, 32)
+	if err != nil {
+		return
+	}
+	return Ino(ino), uint32(idx), true
 }
 
 func (r *redisMeta) sliceKey(chunkid uint64, size uint32) string {
-	return "k" + strconv.FormatUint(chunkid, 10) + "_" + strconv.FormatUint(uint64(size), 10)
+	return r.prefix + "k" + strconv.FormatUint(chunkid, 10) + "_" + strconv.FormatUint(uint64(size), 10)
+}
+
+func (r *redisMeta) inlineKey(inode Ino) string {
+	return r.prefix + "v" + inode.String()
 }
 
 func (r *redisMeta) xattrKey(inode Ino) string {
-	return "x" + inode.String()
+	return r.prefix + "x" + inode.String()
+}
+
+func (r *redisMeta) tagKey(inode Ino) string {
+	return r.prefix + "t" + inode.String()
+}
+
+func (r *redisMeta) tagIndexKey(key string) string {
+	return r.prefix + "tag:" + key
 }
 
 func (r *redisMeta) flockKey(inode Ino) string {
-	return "lockf" + inode.String()
+	return r.prefix + "lockf" + inode.String()
+}
+
+func (r *redisMeta) delegationKey(inode Ino) string {
+	return r.prefix + "deleg" + inode.String()
 }
 
 func (r *redisMeta) ownerKey(owner uint64) string {
@@ -322,32 +856,32 @@ func (r *redisMeta) ownerKey(owner uint64) string {
 }
 
 func (r *redisMeta) plockKey(inode Ino) string {
-	return "lockp" + inode.String()
+	return r.prefix + "lockp" + inode.String()
 }
 
 func (r *redisMeta) nextInode() (Ino, error) {
-	ino, err := r.rdb.Incr(Background, "nextinode").Uint64()
+	ino, err := r.rdb.Incr(Background, r.prefix+"nextinode").Uint64()
 	if ino == 1 {
-		ino, err = r.rdb.Incr(Background, "nextinode").Uint64()
+		ino, err = r.rdb.Incr(Background, r.prefix+"nextinode").Uint64()
 	}
 	return Ino(ino), err
 }
 
-func (r *redisMeta) packEntry(_type uint8, inode Ino) []byte {
+func packEntry(_type uint8, inode Ino) []byte {
 	wb := utils.NewBuffer(9)
 	wb.Put8(_type)
 	wb.Put64(uint64(inode))
 	return wb.Bytes()
 }
 
-func (r *redisMeta) parseEntry(buf []byte) (uint8, Ino) {
-	if len(buf) != 9 {
+func parseEntry(buf []byte) (uint8, Ino) {
+	if len(buf) < 9 {
 		panic("invalid entry")
 	}
 	return buf[0], Ino(binary.BigEndian.Uint64(buf[1:]))
 }
 
-func (r *redisMeta) parseAttr(buf []byte, attr *Attr) {
+func parseAttr(buf []byte, attr *Attr) {
 	if attr == nil {
 		return
 	}
@@ -374,7 +908,7 @@ func (r *redisMeta) parseAttr(buf []byte, attr *Attr) {
 	logger.Tracef("attr: %+v -> %+v", buf, attr)
 }
 
-func (r *redisMeta) marshal(attr *Attr) []byte {
+func marshalAttr(attr *Attr) []byte {
 	w := utils.NewBuffer(36 + 24 + 4 + 8)
 	w.Put8(attr.Flags)
 	w.Put16((uint16(attr.Typ) << 12) | (attr.Mode & 0xfff))
@@ -401,62 +935,325 @@ func align4K(length uint64) int64 {
 	return int64((((length - 1) >> 12) + 1) << 12)
 }
 
-func (r *redisMeta) StatFS(ctx Context, totalspace, availspace, iused, iavail *uint64) syscall.Errno {
-	*totalspace = 1 << 50
-	c, cancel := context.WithTimeout(ctx, time.Millisecond*300)
-	defer cancel()
-	used, _ := r.rdb.IncrBy(c, usedSpace, 0).Result()
-	used = ((used >> 16) + 1) << 16 // aligned to 64K
-	*availspace = *totalspace - uint64(used)
-	inodes, _ := r.rdb.IncrBy(c, totalInodes, 0).Result()
-	*iused = uint64(inodes)
-	*iavail = 10 << 20
-	return 0
+// updateUsage changes the space and inodes used by the owner, group and project (if not 0) of a file.
+func (r *redisMeta) updateUsage(ctx Context, pipe redis.Pipeliner, uid, gid, prj uint32, space, inodes int64) {
+	u, g := strconv.FormatUint(uint64(uid), 10), strconv.FormatUint(uint64(gid), 10)
+	if space != 0 {
+		pipe.HIncrBy(ctx, r.prefix+userSpace, u, space)
+		pipe.HIncrBy(ctx, r.prefix+groupSpace, g, space)
+	}
+	if inodes != 0 {
+		pipe.HIncrBy(ctx, r.prefix+userInodes, u, inodes)
+		pipe.HIncrBy(ctx, r.prefix+groupInodes, g, inodes)
+	}
+	r.updateProjectUsage(ctx, pipe, prj, space, inodes)
 }
 
-func (r *redisMeta) Summary(ctx Context, inode Ino, summary *Summary) syscall.Errno {
-	var attr Attr
-	if st := r.GetAttr(ctx, inode, &attr); st != 0 {
-		return st
+func (r *redisMeta) updateProjectUsage(ctx Context, pipe redis.Pipeliner, prj uint32, space, inodes int64) {
+	if prj == 0 {
+		return
 	}
-	if attr.Typ == TypeDirectory {
-		var entries []*Entry
-		if st := r.Readdir(ctx, inode, 1, &entries); st != 0 {
-			return st
-		}
-		for _, e := range entries {
-			if e.Inode == inode || len(e.Name) == 2 && bytes.Equal(e.Name, []byte("..")) {
-				continue
-			}
-			if e.Attr.Typ == TypeDirectory {
-				if st := r.Summary(ctx, e.Inode, summary); st != 0 {
-					return st
-				}
-			} else {
-				summary.Files++
-				summary.Length += e.Attr.Length
-				summary.Size += uint64(align4K(e.Attr.Length))
-			}
-		}
-		summary.Dirs++
-		summary.Size += 4096
-	} else {
-		summary.Files++
-		summary.Length += attr.Length
-		summary.Size += uint64(align4K(attr.Length))
+	p := strconv.FormatUint(uint64(prj), 10)
+	if space != 0 {
+		pipe.HIncrBy(ctx, r.prefix+projectSpace, p, space)
+	}
+	if inodes != 0 {
+		pipe.HIncrBy(ctx, r.prefix+projectInodes, p, inodes)
 	}
-	return 0
 }
 
-func (r *redisMeta) Lookup(ctx Context, parent Ino, name string, inode *Ino, attr *Attr) syscall.Errno {
-	var foundIno Ino
-	var encodedAttr []byte
-	var err error
+// getProject returns the project id of a node, 0 means no project.
+func (r *redisMeta) getProject(ctx Context, tx *redis.Tx, inode Ino) (uint32, error) {
+	v, err := tx.HGet(ctx, r.xattrKey(inode), projectXattr).Bytes()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	prj, _ := parseProject(v)
+	return prj, nil
+}
 
-	entryKey := r.entryKey(parent)
-	if len(r.shaLookup) > 0 && attr != nil {
+// getRetention returns the value of the retention of a node if it's still active.
+func (r *redisMeta) getRetention(ctx Context, tx *redis.Tx, inode Ino, attr *Attr) ([]byte, error) {
+	if attr.Flags&FlagRetention == 0 {
+		return nil, nil
+	}
+	v, err := tx.HGet(ctx, r.xattrKey(inode), RetentionXattr).Bytes()
+	if err == redis.Nil || err == nil && !retentionActive(v) {
+		return nil, nil
+	}
+	return v, err
+}
+
+// checkRetained returns EPERM if the node is retained, the content of a file can be
+// changed when write is true and it's still being written by the creator.
+func (r *redisMeta) checkRetained(ctx Context, tx *redis.Tx, inode Ino, attr *Attr, write bool) error {
+	if attr.Flags&FlagRetention == 0 {
+		return nil
+	}
+	if write {
+		r.Lock()
+		writing := r.writing[inode]
+		r.Unlock()
+		if writing {
+			return nil
+		}
+	}
+	v, err := r.getRetention(ctx, tx, inode, attr)
+	if err != nil {
+		return err
+	}
+	if v != nil {
+		return syscall.EPERM
+	}
+	return nil
+}
+
+func (r *redisMeta) getQuota(ctx Context, prj uint32) (*Quota, error) {
+	p := strconv.FormatUint(uint64(prj), 10)
+	var q Quota
+	buf, err := r.rdb.HGet(ctx, r.prefix+projectQuotas, p).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	q.MaxSpace, q.MaxInodes = parseUsage(buf)
+	if q.UsedSpace, err = r.rdb.HGet(ctx, r.prefix+projectSpace, p).Int64(); err != nil && err != redis.Nil {
+		return nil, err
+	}
+	if q.UsedInodes, err = r.rdb.HGet(ctx, r.prefix+projectInodes, p).Int64(); err != nil && err != redis.Nil {
+		return nil, err
+	}
+	return &q, nil
+}
+
+// checkProjectQuota returns true if the quota of project can't hold more space and inodes.
+func (r *redisMeta) checkProjectQuota(ctx Context, prj uint32, space, inodes int64) bool {
+	if prj == 0 {
+		return false
+	}
+	q, err := r.getQuota(ctx, prj)
+	if err != nil {
+		logger.Warnf("get quota of project %d: %s", prj, err)
+		return false
+	}
+	return q != nil && q.exceeded(space, inodes)
+}
+
+func (r *redisMeta) SetQuota(prj uint32, maxSpace, maxInodes int64) error {
+	ctx := Background
+	p := strconv.FormatUint(uint64(prj), 10)
+	if maxSpace == 0 && maxInodes == 0 {
+		return r.rdb.HDel(ctx, r.prefix+projectQuotas, p).Err()
+	}
+	return r.rdb.HSet(ctx, r.prefix+projectQuotas, p, packUsage(maxSpace, maxInodes)).Err()
+}
+
+func (r *redisMeta) ListQuotas() (map[uint32]*Quota, error) {
+	ctx := Background
+	quotas := make(map[uint32]*Quota)
+	get := func(field string) *Quota {
+		prj, err := strconv.ParseUint(field, 10, 32)
+		if err != nil {
+			logger.Warnf("invalid project id: %s", field)
+			return nil
+		}
+		q := quotas[uint32(prj)]
+		if q == nil {
+			q = &Quota{}
+			quotas[uint32(prj)] = q
+		}
+		return q
+	}
+	limits, err := r.rdb.HGetAll(ctx, r.prefix+projectQuotas).Result()
+	if err != nil {
+		return nil, err
+	}
+	for field, v := range limits {
+		if q := get(field); q != nil {
+			q.MaxSpace, q.MaxInodes = parseUsage([]byte(v))
+		}
+	}
+	spaces, err := r.rdb.HGetAll(ctx, r.prefix+projectSpace).Result()
+	if err != nil {
+		return nil, err
+	}
+	for field, v := range spaces {
+		if q := get(field); q != nil {
+			q.UsedSpace, _ = strconv.ParseInt(v, 10, 64)
+		}
+	}
+	inodes, err := r.rdb.HGetAll(ctx, r.prefix+projectInodes).Result()
+	if err != nil {
+		return nil, err
+	}
+	for field, v := range inodes {
+		if q := get(field); q != nil {
+			q.UsedInodes, _ = strconv.ParseInt(v, 10, 64)
+		}
+	}
+	return quotas, nil
+}
+
+func (r *redisMeta) StatFS(ctx Context, totalspace, availspace, iused, iavail *uint64) syscall.Errno {
+	*totalspace = 1 << 50
+	if capacity := atomic.LoadUint64(&r.capacity); capacity > 0 {
+		*totalspace = capacity
+	}
+	c, cancel := context.WithTimeout(ctx, time.Millisecond*300)
+	defer cancel()
+	used, _ := r.rdb.IncrBy(c, r.prefix+usedSpace, 0).Result()
+	used = ((used >> 16) + 1) << 16 // aligned to 64K
+	*availspace = 0
+	if uint64(used) < *totalspace {
+		*availspace = *totalspace - uint64(used)
+	}
+	inodes, _ := r.rdb.IncrBy(c, r.prefix+totalInodes, 0).Result()
+	*iused = uint64(inodes)
+	*iavail = 10 << 20
+	return 0
+}
+
+func (r *redisMeta) ListUsage(group bool) ([]Usage, error) {
+	ctx := Background
+	spaceKey, inodesKey := userSpace, userInodes
+	if group {
+		spaceKey, inodesKey = groupSpace, groupInodes
+	}
+	spaces, err := r.rdb.HGetAll(ctx, r.prefix+spaceKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	inodes, err := r.rdb.HGetAll(ctx, r.prefix+inodesKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	usage := make(map[uint32]*Usage)
+	get := func(field string) *Usage {
+		id, err := strconv.ParseUint(field, 10, 32)
+		if err != nil {
+			logger.Warnf("invalid id of usage: %s", field)
+			return nil
+		}
+		u := usage[uint32(id)]
+		if u == nil {
+			u = &Usage{ID: uint32(id)}
+			usage[uint32(id)] = u
+		}
+		return u
+	}
+	for field, v := range spaces {
+		if u := get(field); u != nil {
+			u.Space, _ = strconv.ParseInt(v, 10, 64)
+		}
+	}
+	for field, v := range inodes {
+		if u := get(field); u != nil {
+			u.Inodes, _ = strconv.ParseInt(v, 10, 64)
+		}
+	}
+	return sortUsage(usage), nil
+}
+
+func sortUsage(usage map[uint32]*Usage) []Usage {
+	list := make([]Usage, 0, len(usage))
+	for _, u := range usage {
+		list = append(list, *u)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+func (r *redisMeta) Summary(ctx Context, inode Ino, summary *Summary) syscall.Errno {
+	var attr Attr
+	if st := r.GetAttr(ctx, inode, &attr); st != 0 {
+		return st
+	}
+	if attr.Typ == TypeDirectory {
+		var entries []*Entry
+		if st := r.Readdir(ctx, inode, 1, &entries); st != 0 {
+			return st
+		}
+		for _, e := range entries {
+			if e.Inode == inode || len(e.Name) == 2 && bytes.Equal(e.Name, []byte("..")) {
+				continue
+			}
+			if e.Attr.Typ == TypeDirectory {
+				if st := r.Summary(ctx, e.Inode, summary); st != 0 {
+					return st
+				}
+			} else {
+				summary.Files++
+				summary.Length += e.Attr.Length
+				summary.Size += uint64(align4K(e.Attr.Length))
+			}
+		}
+		summary.Dirs++
+		summary.Size += 4096
+	} else {
+		summary.Files++
+		summary.Length += attr.Length
+		summary.Size += uint64(align4K(attr.Length))
+	}
+	return 0
+}
+
+func (r *redisMeta) Fragmentation(ctx Context, inode Ino, frag *Fragmentation) syscall.Errno {
+	var attr Attr
+	if st := r.GetAttr(ctx, inode, &attr); st != 0 {
+		return st
+	}
+	if attr.Typ == TypeDirectory {
+		var entries []*Entry
+		if st := r.Readdir(ctx, inode, 1, &entries); st != 0 {
+			return st
+		}
+		for _, e := range entries {
+			if e.Inode == inode || len(e.Name) == 2 && bytes.Equal(e.Name, []byte("..")) {
+				continue
+			}
+			if e.Attr.Typ == TypeDirectory || e.Attr.Typ == TypeFile {
+				if st := r.Fragmentation(ctx, e.Inode, frag); st != 0 {
+					return st
+				}
+			}
+		}
+		return 0
+	}
+	if attr.Typ != TypeFile {
+		return 0
+	}
+	p := r.rdb.Pipeline()
+	for indx := uint64(0); indx*ChunkSize < attr.Length; indx++ {
+		p.LRange(ctx, r.chunkKey(inode, uint32(indx)), 0, 1000000)
+	}
+	cmds, err := p.Exec(ctx)
+	if err != nil {
+		return errno(err)
+	}
+	for _, cmd := range cmds {
+		frag.add(readSlices(cmd.(*redis.StringSliceCmd).Val()))
+	}
+	return 0
+}
+
+func (r *redisMeta) Lookup(ctx Context, parent Ino, name string, inode *Ino, attr *Attr) syscall.Errno {
+	if r.hot != nil && r.hot.lookup(parent, name, inode, attr) {
+		return 0
+	}
+	var foundIno Ino
+	var encodedAttr []byte
+	var err error
+
+	entryKey := r.entryKey(parent)
+	rdb := r.reader()
+	if len(r.shaLookup) > 0 && attr != nil && rdb == r.rdb {
 		var res interface{}
-		res, err = r.rdb.EvalSha(ctx, r.shaLookup, []string{entryKey, name}).Result()
+		res, err = r.rdb.EvalSha(ctx, r.shaLookup, []string{entryKey, r.entryField(name)}, r.prefix).Result()
 		if err != nil {
 			if strings.Contains(err.Error(), "NOSCRIPT") {
 				var err2 error
@@ -489,20 +1286,32 @@ func (r *redisMeta) Lookup(ctx Context, parent Ino, name string, inode *Ino, att
 		}
 		foundIno = Ino(returnedIno)
 		encodedAttr = []byte(returnedAttr)
+		if foundIno == 0 {
+			// the directory is sharded
+			var buf []byte
+			if _, _, buf, err = r.getEntry(ctx, rdb, parent, name); err != nil {
+				return errno(err)
+			}
+			_, foundIno = parseEntry(buf)
+			encodedAttr, err = rdb.Get(ctx, r.inodeKey(foundIno)).Bytes()
+		}
 	} else {
 		var buf []byte
-		buf, err = r.rdb.HGet(ctx, entryKey, name).Bytes()
+		_, _, buf, err = r.getEntry(ctx, rdb, parent, name)
 		if err != nil {
 			return errno(err)
 		}
-		_, foundIno = r.parseEntry(buf)
+		_, foundIno = parseEntry(buf)
 		if attr != nil {
-			encodedAttr, err = r.rdb.Get(ctx, r.inodeKey(foundIno)).Bytes()
+			encodedAttr, err = rdb.Get(ctx, r.inodeKey(foundIno)).Bytes()
 		}
 	}
 
 	if err == nil && attr != nil {
-		r.parseAttr(encodedAttr, attr)
+		parseAttr(encodedAttr, attr)
+		if r.hot != nil && r.hot.putEntry(parent, name, foundIno, attr) {
+			r.shareHot(parent)
+		}
 	}
 	if inode != nil {
 		*inode = foundIno
@@ -510,7 +1319,7 @@ func (r *redisMeta) Lookup(ctx Context, parent Ino, name string, inode *Ino, att
 	return errno(err)
 }
 
-func (r *redisMeta) accessMode(attr *Attr, uid uint32, gid uint32) uint8 {
+func accessMode(attr *Attr, uid uint32, gid uint32) uint8 {
 	if uid == 0 {
 		return 0x7
 	}
@@ -539,7 +1348,7 @@ func (r *redisMeta) Access(ctx Context, inode Ino, mmask uint8, attr *Attr) sysc
 		}
 	}
 
-	mode := r.accessMode(attr, ctx.Uid(), ctx.Gid())
+	mode := accessMode(attr, ctx.Uid(), ctx.Gid())
 	if mode&mmask != mmask {
 		logger.Debugf("Access inode %d %o, mode %o, request mode %o", inode, attr.Mode, mode, mmask)
 		return syscall.EACCES
@@ -548,15 +1357,21 @@ func (r *redisMeta) Access(ctx Context, inode Ino, mmask uint8, attr *Attr) sysc
 }
 
 func (r *redisMeta) GetAttr(ctx Context, inode Ino, attr *Attr) syscall.Errno {
+	if r.hot != nil && r.hot.getAttr(inode, attr) {
+		return 0
+	}
 	var c context.Context = ctx
 	if inode == 1 {
 		var cancel func()
 		c, cancel = context.WithTimeout(ctx, time.Millisecond*300)
 		defer cancel()
 	}
-	a, err := r.rdb.Get(c, r.inodeKey(inode)).Bytes()
+	a, err := r.reader().Get(c, r.inodeKey(inode)).Bytes()
 	if err == nil {
-		r.parseAttr(a, attr)
+		parseAttr(a, attr)
+		if r.hot != nil && r.hot.putAttr(inode, attr) {
+			r.shareHot(inode)
+		}
 	}
 	if err != nil && inode == 1 {
 		err = nil
@@ -582,88 +1397,392 @@ func errno(err error) syscall.Errno {
 	return syscall.EIO
 }
 
-func (r *redisMeta) txn(ctx Context, txf func(tx *redis.Tx) error, keys ...string) syscall.Errno {
-	var err error
-	var khash = fnv.New32()
-	_, _ = khash.Write([]byte(keys[0]))
-	l := &r.txlocks[int(khash.Sum32())%len(r.txlocks)]
-	start := time.Now()
-	defer func() {
-		used := time.Since(start)
-		redisTxDist.Observe(used.Seconds())
-	}()
-	l.Lock()
-	defer l.Unlock()
-	for i := 0; i < 50; i++ {
-		err = r.rdb.Watch(ctx, txf, keys...)
-		if err == redis.TxFailedErr {
-			redisTxRestart.Add(1)
-			time.Sleep(time.Microsecond * 100 * time.Duration(rand.Int()%(i+1)))
-			continue
+// unavailable returns true if the error means Redis is unreachable, not an error of the operation.
+func unavailable(err error) bool {
+	if _, ok := err.(syscall.Errno); ok || err == nil || err == redis.Nil {
+		return false
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	var ne net.Error
+	return errors.As(err, &ne)
+}
+
+// graceDialer retries to connect Redis until it's unreachable for longer than
+// the grace period, so the operations wait for a transient outage (a restart or
+// failover) to be over rather than failing with EIO. Broken connections in pool
+// are retried by the client, which dials with it.
+type graceDialer struct {
+	grace       time.Duration
+	dial        func(ctx context.Context, network, addr string) (net.Conn, error)
+	master      func(ctx context.Context) (string, error) // the address of master from sentinels
+	connected   int32                                     // set after the first connection, outages are tolerated only after it
+	unreachable int64                                     // unix nano since Redis is unreachable, zero if it's reachable
+}
+
+func newGraceDialer(opt *redis.Options, grace time.Duration) *graceDialer {
+	g := &graceDialer{grace: grace, dial: opt.Dialer}
+	if g.dial == nil {
+		// the default one of redis.Options
+		d := &net.Dialer{Timeout: time.Second * 5, KeepAlive: time.Minute * 5}
+		g.dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if opt.TLSConfig == nil {
+				return d.DialContext(ctx, network, addr)
+			}
+			return tls.DialWithDialer(d, network, addr, opt.TLSConfig)
 		}
-		return errno(err)
 	}
-	return errno(err)
+	return g
 }
 
-func (r *redisMeta) Truncate(ctx Context, inode Ino, flags uint8, length uint64, attr *Attr) syscall.Errno {
-	return r.txn(ctx, func(tx *redis.Tx) error {
-		var t Attr
-		a, err := tx.Get(ctx, r.inodeKey(inode)).Bytes()
-		if err != nil {
-			return err
+// sentinelMaster returns the address of the master from the first sentinel answered,
+// the retries dial it rather than the old master after a failover.
+func sentinelMaster(fopt *redis.FailoverOptions, dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context) (string, error) {
+	return func(ctx context.Context) (string, error) {
+		var err error
+		for _, addr := range fopt.SentinelAddrs {
+			sentinel := redis.NewSentinelClient(&redis.Options{
+				Addr:        addr,
+				Dialer:      dial,
+				Password:    fopt.SentinelPassword,
+				TLSConfig:   fopt.TLSConfig,
+				DialTimeout: time.Second * 5,
+				ReadTimeout: time.Second * 5,
+			})
+			var ps []string
+			ps, err = sentinel.GetMasterAddrByName(ctx, fopt.MasterName).Result()
+			_ = sentinel.Close()
+			if err == nil {
+				return net.JoinHostPort(ps[0], ps[1]), nil
+			}
 		}
-		r.parseAttr(a, &t)
-		if t.Typ != TypeFile {
-			return syscall.EPERM
+		return "", err
+	}
+}
+
+func (g *graceDialer) Dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	for {
+		conn, err := g.dial(ctx, network, addr)
+		if err == nil {
+			atomic.StoreInt32(&g.connected, 1)
+			if since := atomic.SwapInt64(&g.unreachable, 0); since > 0 {
+				logger.Infof("Redis is reachable again after %s", time.Since(time.Unix(0, since)))
+			}
+			return conn, nil
 		}
-		old := t.Length
-		var zeroChunks []uint32
-		if length > old {
-			if (length-old)/ChunkSize >= 100 {
-				// super large
-				var cursor uint64
-				var keys []string
-				for {
-					keys, cursor, err = tx.Scan(ctx, cursor, fmt.Sprintf("c%d_*", inode), 10000).Result()
-					if err != nil {
-						return err
-					}
-					for _, key := range keys {
-						indx, err := strconv.Atoi(strings.Split(key, "_")[1])
-						if err != nil {
-							logger.Errorf("parse %s: %s", key, err)
-							continue
-						}
-						if uint64(indx) > old/ChunkSize && uint64(indx) < length/ChunkSize {
-							zeroChunks = append(zeroChunks, uint32(indx))
-						}
-					}
-					if cursor <= 0 {
-						break
-					}
-				}
-			} else {
-				for i := old/ChunkSize + 1; i < length/ChunkSize; i++ {
-					zeroChunks = append(zeroChunks, uint32(i))
-				}
+		if atomic.LoadInt32(&g.connected) == 0 {
+			return nil, err
+		}
+		now := time.Now().UnixNano()
+		if atomic.CompareAndSwapInt64(&g.unreachable, 0, now) {
+			logger.Warnf("Redis is unreachable, operations will wait for %s: %s", g.grace, err)
+		}
+		if !g.inGrace() {
+			// not retried by the client any more
+			return nil, fmt.Errorf("Redis is unreachable for more than %s: %w", g.grace, err)
+		}
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-time.After(time.Millisecond * 200):
+		}
+		if g.master != nil {
+			if a, err := g.master(ctx); err == nil {
+				addr = a
 			}
 		}
-		t.Length = length
-		now := time.Now()
-		t.Mtime = now.Unix()
-		t.Mtimensec = uint32(now.Nanosecond())
-		t.Ctime = now.Unix()
-		t.Ctimensec = uint32(now.Nanosecond())
-		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
-			pipe.Set(ctx, r.inodeKey(inode), r.marshal(&t), 0)
-			if length > old {
-				// zero out from old to length
-				var l = uint32(length - old)
-				if length > (old/ChunkSize+1)*ChunkSize {
-					l = ChunkSize - uint32(old%ChunkSize)
-				}
-				pipe.RPush(ctx, r.chunkKey(inode, uint32(old/ChunkSize)), marshalSlice(uint32(old%ChunkSize), 0, 0, 0, l))
+	}
+}
+
+// inGrace returns true if Redis is unreachable for shorter than the grace period.
+func (g *graceDialer) inGrace() bool {
+	since := atomic.LoadInt64(&g.unreachable)
+	return since > 0 && time.Since(time.Unix(0, since)) < g.grace
+}
+
+// execHook records whether EXEC of a transaction is sent, the transaction may
+// be committed even if an error is returned after it.
+type execHook struct {
+	sent bool
+}
+
+func (h *execHook) BeforeProcess(ctx context.Context, cmd redis.Cmder) (context.Context, error) {
+	return ctx, nil
+}
+
+func (h *execHook) AfterProcess(ctx context.Context, cmd redis.Cmder) error {
+	return nil
+}
+
+func (h *execHook) BeforeProcessPipeline(ctx context.Context, cmds []redis.Cmder) (context.Context, error) {
+	if len(cmds) > 0 && cmds[len(cmds)-1].Name() == "exec" {
+		h.sent = true
+	}
+	return ctx, nil
+}
+
+func (h *execHook) AfterProcessPipeline(ctx context.Context, cmds []redis.Cmder) error {
+	return nil
+}
+
+// reader returns the replica if it's not lagging too much, and also not behind
+// the last write from this client, otherwise the primary.
+func (r *redisMeta) reader() *redis.Client {
+	if r.replica == nil {
+		return r.rdb
+	}
+	lag := atomic.LoadInt64(&r.replicaLag)
+	if lag < 0 || lag > int64(r.conf.MaxStaleness) {
+		return r.rdb
+	}
+	if time.Now().UnixNano()-atomic.LoadInt64(&r.lastWrite) <= lag {
+		return r.rdb
+	}
+	return r.replica
+}
+
+// updateReplicaLag reads the heartbeat from the replica to measure how far it's
+// behind, then writes a new heartbeat into the primary.
+func (r *redisMeta) updateReplicaLag() {
+	ctx := Background
+	now := time.Now().UnixNano()
+	last, err := r.replica.Get(ctx, r.prefix+replicaHeartbeat).Int64()
+	if err != nil {
+		if err != redis.Nil {
+			logger.Warnf("read heartbeat from replica: %s", err)
+		}
+		atomic.StoreInt64(&r.replicaLag, -1)
+	} else {
+		lag := now - last
+		if lag < 0 {
+			lag = 0
+		}
+		atomic.StoreInt64(&r.replicaLag, lag)
+	}
+	if err = r.rdb.Set(ctx, r.prefix+replicaHeartbeat, now, 0).Err(); err != nil {
+		logger.Warnf("write heartbeat: %s", err)
+	}
+}
+
+func (r *redisMeta) checkReplica() {
+	for {
+		r.updateReplicaLag()
+		time.Sleep(time.Second)
+	}
+}
+
+const sharedHotDirs = "hotdirs"
+const changelog = "changelog"
+
+// shareHot adds a hot directory of this client into the shared ones for a minute, then the
+// changes of it by other clients are published into the changelog.
+func (r *redisMeta) shareHot(inode Ino) {
+	go func() {
+		expire := time.Now().Add(time.Minute).Unix()
+		if err := r.rdb.ZAdd(Background, r.prefix+sharedHotDirs, &redis.Z{Score: float64(expire), Member: inode.String()}).Err(); err != nil {
+			logger.Warnf("share hot directory %d: %s", inode, err)
+		}
+	}()
+}
+
+// changed drops the directories changed by a transaction from the cache, and publishes them
+// into the changelog if they're hot in any client.
+func (r *redisMeta) changed(keys []string, err error) {
+	shared, _ := r.hotShared.Load().(map[Ino]bool)
+	if r.hot == nil && len(shared) == 0 {
+		return
+	}
+	var inodes []Ino
+	for _, key := range keys {
+		key = strings.TrimPrefix(key, r.prefix)
+		if len(key) > 1 && (key[0] == 'i' || key[0] == 'd') {
+			if inode, e := strconv.ParseUint(key[1:], 10, 64); e == nil {
+				inodes = append(inodes, Ino(inode))
+			}
+		}
+	}
+	if r.hot != nil {
+		r.hot.invalidate(inodes...)
+	}
+	if err != nil {
+		return
+	}
+	for _, inode := range inodes {
+		if shared[inode] {
+			if e := r.rdb.Publish(Background, r.prefix+changelog, inode.String()).Err(); e != nil {
+				logger.Warnf("publish the change of directory %d: %s", inode, e)
+			}
+		}
+	}
+}
+
+// watchChangelog refreshes the shared hot directories, and drops the cached ones changed by
+// other clients.
+func (r *redisMeta) watchChangelog() {
+	if r.hot != nil {
+		go func() {
+			pubsub := r.rdb.Subscribe(Background, r.prefix+changelog)
+			for msg := range pubsub.Channel() {
+				if inode, err := strconv.ParseUint(msg.Payload, 10, 64); err == nil {
+					r.hot.invalidate(Ino(inode))
+				}
+			}
+		}()
+	}
+	for {
+		now := strconv.FormatInt(time.Now().Unix(), 10)
+		vals, err := r.rdb.ZRangeByScore(Background, r.prefix+sharedHotDirs, &redis.ZRangeBy{Min: now, Max: "+inf"}).Result()
+		if err == nil {
+			shared := make(map[Ino]bool, len(vals))
+			for _, v := range vals {
+				if inode, err := strconv.ParseUint(v, 10, 64); err == nil {
+					shared[Ino(inode)] = true
+				}
+			}
+			r.hotShared.Store(shared)
+			r.rdb.ZRemRangeByScore(Background, r.prefix+sharedHotDirs, "-inf", "("+now)
+		} else {
+			logger.Warnf("load hot directories: %s", err)
+		}
+		time.Sleep(time.Second * 10)
+	}
+}
+
+// checkQuota returns true if there is no space for more data of size.
+func (r *redisMeta) checkQuota(ctx Context, size int64) bool {
+	capacity := atomic.LoadUint64(&r.capacity)
+	if capacity == 0 {
+		return false
+	}
+	used, err := r.rdb.Get(ctx, r.prefix+usedSpace).Int64()
+	if err != nil && err != redis.Nil {
+		logger.Warnf("get used space: %s", err)
+		return false
+	}
+	return used+size > int64(capacity)
+}
+
+func (r *redisMeta) txn(ctx Context, txf func(tx *redis.Tx) error, keys ...string) syscall.Errno {
+	var err error
+	var khash = fnv.New32()
+	_, _ = khash.Write([]byte(keys[0]))
+	l := &r.txlocks[int(khash.Sum32())%len(r.txlocks)]
+	start := time.Now()
+	defer func() {
+		used := time.Since(start)
+		redisTxDist.Observe(used.Seconds())
+	}()
+	l.Lock()
+	defer l.Unlock()
+	if r.replica != nil {
+		defer atomic.StoreInt64(&r.lastWrite, time.Now().UnixNano())
+	}
+	defer func() { r.changed(keys, err) }()
+	for i := 0; i < 50; i++ {
+		var hook execHook
+		err = r.rdb.Watch(ctx, func(tx *redis.Tx) error {
+			tx.AddHook(&hook)
+			return txf(tx)
+		}, keys...)
+		if err == redis.TxFailedErr {
+			redisTxRestart.Add(1)
+			time.Sleep(time.Microsecond * 100 * time.Duration(rand.Int()%(i+1)))
+			continue
+		}
+		// the connection used by the transaction is broken, retry it with a new one,
+		// unless EXEC is sent, which may have been committed
+		if r.conf.Grace > 0 && !hook.sent && unavailable(err) && time.Since(start) < r.conf.Grace {
+			logger.Debugf("retry transaction on %s: %s", keys[0], err)
+			time.Sleep(time.Millisecond * 100)
+			i--
+			continue
+		}
+		return errno(err)
+	}
+	return errno(err)
+}
+
+func (r *redisMeta) Truncate(ctx Context, inode Ino, flags uint8, length uint64, attr *Attr) syscall.Errno {
+	if r.readOnly {
+		return syscall.EROFS
+	}
+	return r.txn(ctx, func(tx *redis.Tx) error {
+		var t Attr
+		a, err := tx.Get(ctx, r.inodeKey(inode)).Bytes()
+		if err != nil {
+			return err
+		}
+		parseAttr(a, &t)
+		if t.Typ != TypeFile || t.Flags&FlagReadOnly != 0 {
+			return syscall.EPERM
+		}
+		if err = r.checkRetained(ctx, tx, inode, &t, true); err != nil {
+			return err
+		}
+		prj, err := r.getProject(ctx, tx, inode)
+		if err != nil {
+			return err
+		}
+		old := t.Length
+		var zeroChunks []uint32
+		if length > old {
+			if (length-old)/ChunkSize >= 100 {
+				// super large
+				var cursor uint64
+				var keys []string
+				for {
+					keys, cursor, err = tx.Scan(ctx, cursor, r.prefix+fmt.Sprintf("c%d_*", inode), 10000).Result()
+					if err != nil {
+						return err
+					}
+					for _, key := range keys {
+						ino, indx, ok := r.parseChunkKey(key)
+						if !ok || ino != inode {
+							continue
+						}
+						if uint64(indx) > old/ChunkSize && uint64(indx) < length/ChunkSize {
+							zeroChunks = append(zeroChunks, indx)
+						}
+					}
+					if cursor <= 0 {
+						break
+					}
+				}
+			} else {
+				for i := old/ChunkSize + 1; i < length/ChunkSize; i++ {
+					zeroChunks = append(zeroChunks, uint32(i))
+				}
+			}
+		}
+		if length > old && (r.checkQuota(ctx, align4K(length)-align4K(old)) || r.checkProjectQuota(ctx, prj, align4K(length)-align4K(old), 0)) {
+			return syscall.ENOSPC
+		}
+		var inline []byte
+		if length < old {
+			inline, err = tx.Get(ctx, r.inlineKey(inode)).Bytes()
+			if err != nil && err != redis.Nil {
+				return err
+			}
+		}
+		t.Length = length
+		now := time.Now()
+		t.Mtime = now.Unix()
+		t.Mtimensec = uint32(now.Nanosecond())
+		t.Ctime = now.Unix()
+		t.Ctimensec = uint32(now.Nanosecond())
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, r.inodeKey(inode), marshalAttr(&t), 0)
+			if uint64(len(inline)) > length {
+				pipe.Set(ctx, r.inlineKey(inode), inline[:length], 0)
+			}
+			if length > old {
+				// zero out from old to length
+				var l = uint32(length - old)
+				if length > (old/ChunkSize+1)*ChunkSize {
+					l = ChunkSize - uint32(old%ChunkSize)
+				}
+				pipe.RPush(ctx, r.chunkKey(inode, uint32(old/ChunkSize)), marshalSlice(uint32(old%ChunkSize), 0, 0, 0, l))
 				buf := marshalSlice(0, 0, 0, 0, ChunkSize)
 				for _, indx := range zeroChunks {
 					pipe.RPushX(ctx, r.chunkKey(inode, indx), buf)
@@ -672,7 +1791,8 @@ func (r *redisMeta) Truncate(ctx Context, inode Ino, flags uint8, length uint64,
 					pipe.RPush(ctx, r.chunkKey(inode, uint32(length/ChunkSize)), marshalSlice(0, 0, 0, 0, uint32(length%ChunkSize)))
 				}
 			}
-			pipe.IncrBy(ctx, usedSpace, align4K(length)-align4K(old))
+			pipe.IncrBy(ctx, r.prefix+usedSpace, align4K(length)-align4K(old))
+			r.updateUsage(ctx, pipe, t.Uid, t.Gid, prj, align4K(length)-align4K(old), 0)
 			return nil
 		})
 		if err == nil {
@@ -681,7 +1801,7 @@ func (r *redisMeta) Truncate(ctx Context, inode Ino, flags uint8, length uint64,
 			}
 		}
 		return err
-	}, r.inodeKey(inode))
+	}, r.inodeKey(inode), r.inlineKey(inode))
 }
 
 const (
@@ -695,6 +1815,9 @@ const (
 )
 
 func (r *redisMeta) Fallocate(ctx Context, inode Ino, mode uint8, off uint64, size uint64) syscall.Errno {
+	if r.readOnly {
+		return syscall.EROFS
+	}
 	if mode&fallocCollapesRange != 0 && mode != fallocCollapesRange {
 		return syscall.EINVAL
 	}
@@ -716,13 +1839,20 @@ func (r *redisMeta) Fallocate(ctx Context, inode Ino, mode uint8, off uint64, si
 		if err != nil {
 			return err
 		}
-		r.parseAttr(a, &t)
+		parseAttr(a, &t)
 		if t.Typ == TypeFIFO {
 			return syscall.EPIPE
 		}
-		if t.Typ != TypeFile {
+		if t.Typ != TypeFile || t.Flags&FlagReadOnly != 0 {
 			return syscall.EPERM
 		}
+		if err = r.checkRetained(ctx, tx, inode, &t, true); err != nil {
+			return err
+		}
+		prj, err := r.getProject(ctx, tx, inode)
+		if err != nil {
+			return err
+		}
 		length := t.Length
 		if off+size > t.Length {
 			if mode&fallocKeepSize == 0 {
@@ -730,13 +1860,33 @@ func (r *redisMeta) Fallocate(ctx Context, inode Ino, mode uint8, off uint64, si
 			}
 		}
 
+		var inline []byte
+		if mode&(fallocZeroRange|fallocPunchHole) != 0 && off < t.Length {
+			inline, err = tx.Get(ctx, r.inlineKey(inode)).Bytes()
+			if err != nil && err != redis.Nil {
+				return err
+			}
+		}
 		old := t.Length
+		if length > old && (r.checkQuota(ctx, align4K(length)-align4K(old)) || r.checkProjectQuota(ctx, prj, align4K(length)-align4K(old), 0)) {
+			return syscall.ENOSPC
+		}
 		t.Length = length
 		now := time.Now()
 		t.Ctime = now.Unix()
 		t.Ctimensec = uint32(now.Nanosecond())
 		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
-			pipe.Set(ctx, r.inodeKey(inode), r.marshal(&t), 0)
+			pipe.Set(ctx, r.inodeKey(inode), marshalAttr(&t), 0)
+			if uint64(len(inline)) > off {
+				end := off + size
+				if end > uint64(len(inline)) {
+					end = uint64(len(inline))
+				}
+				for i := off; i < end; i++ {
+					inline[i] = 0
+				}
+				pipe.Set(ctx, r.inlineKey(inode), inline, 0)
+			}
 			if mode&(fallocZeroRange|fallocPunchHole) != 0 {
 				if off+size > old {
 					size = old - off
@@ -753,21 +1903,77 @@ func (r *redisMeta) Fallocate(ctx Context, inode Ino, mode uint8, off uint64, si
 					size -= l
 				}
 			}
-			pipe.IncrBy(ctx, usedSpace, align4K(length)-align4K(old))
+			pipe.IncrBy(ctx, r.prefix+usedSpace, align4K(length)-align4K(old))
+			r.updateUsage(ctx, pipe, t.Uid, t.Gid, prj, align4K(length)-align4K(old), 0)
+			return nil
+		})
+		return err
+	}, r.inodeKey(inode), r.inlineKey(inode))
+}
+
+func (r *redisMeta) Reserve(ctx Context, inode Ino, size uint64, off *uint64) syscall.Errno {
+	if r.readOnly {
+		return syscall.EROFS
+	}
+	if size == 0 {
+		return syscall.EINVAL
+	}
+	return r.txn(ctx, func(tx *redis.Tx) error {
+		var t Attr
+		a, err := tx.Get(ctx, r.inodeKey(inode)).Bytes()
+		if err != nil {
+			return err
+		}
+		parseAttr(a, &t)
+		if t.Typ != TypeFile || t.Flags&FlagReadOnly != 0 {
+			return syscall.EPERM
+		}
+		if t.Length+size >= MaxFileSize {
+			return syscall.EFBIG
+		}
+		if err = r.checkRetained(ctx, tx, inode, &t, true); err != nil {
+			return err
+		}
+		prj, err := r.getProject(ctx, tx, inode)
+		if err != nil {
+			return err
+		}
+		old, length := t.Length, t.Length+size
+		newSpace := align4K(length) - align4K(old)
+		if r.checkQuota(ctx, newSpace) || r.checkProjectQuota(ctx, prj, newSpace, 0) {
+			return syscall.ENOSPC
+		}
+		t.Length = length
+		now := time.Now()
+		t.Mtime = now.Unix()
+		t.Mtimensec = uint32(now.Nanosecond())
+		t.Ctime = now.Unix()
+		t.Ctimensec = uint32(now.Nanosecond())
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, r.inodeKey(inode), marshalAttr(&t), 0)
+			pipe.IncrBy(ctx, r.prefix+usedSpace, newSpace)
+			r.updateUsage(ctx, pipe, t.Uid, t.Gid, prj, newSpace, 0)
 			return nil
 		})
+		if err == nil {
+			*off = old
+		}
 		return err
 	}, r.inodeKey(inode))
 }
 
 func (r *redisMeta) SetAttr(ctx Context, inode Ino, set uint16, sugidclearmode uint8, attr *Attr) syscall.Errno {
+	if r.readOnly {
+		return syscall.EROFS
+	}
 	return r.txn(ctx, func(tx *redis.Tx) error {
 		var cur Attr
 		a, err := tx.Get(ctx, r.inodeKey(inode)).Bytes()
 		if err != nil {
 			return err
 		}
-		r.parseAttr(a, &cur)
+		parseAttr(a, &cur)
+		uid, gid := cur.Uid, cur.Gid
 		if (set&(SetAttrUID|SetAttrGID)) != 0 && (set&SetAttrMode) != 0 {
 			attr.Mode |= (cur.Mode & 06000)
 		}
@@ -789,6 +1995,12 @@ func (r *redisMeta) SetAttr(ctx Context, inode Ino, set uint16, sugidclearmode u
 			}
 			cur.Mode = attr.Mode
 		}
+		if set&SetAttrFlag != 0 {
+			if ctx.Uid() != 0 {
+				return syscall.EPERM
+			}
+			cur.Flags = attr.Flags&^FlagRetention | cur.Flags&FlagRetention
+		}
 		now := time.Now()
 		if set&SetAttrAtime != 0 {
 			cur.Atime = attr.Atime
@@ -809,7 +2021,15 @@ func (r *redisMeta) SetAttr(ctx Context, inode Ino, set uint16, sugidclearmode u
 		cur.Ctime = now.Unix()
 		cur.Ctimensec = uint32(now.Nanosecond())
 		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
-			pipe.Set(ctx, r.inodeKey(inode), r.marshal(&cur), 0)
+			pipe.Set(ctx, r.inodeKey(inode), marshalAttr(&cur), 0)
+			if cur.Uid != uid || cur.Gid != gid {
+				var space int64
+				if cur.Typ == TypeFile {
+					space = align4K(cur.Length)
+				}
+				r.updateUsage(ctx, pipe, uid, gid, 0, -space, -1)
+				r.updateUsage(ctx, pipe, cur.Uid, cur.Gid, 0, space, 1)
+			}
 			return nil
 		})
 		if err == nil {
@@ -841,6 +2061,12 @@ func (r *redisMeta) Mknod(ctx Context, parent Ino, name string, _type uint8, mod
 }
 
 func (r *redisMeta) mknod(ctx Context, parent Ino, name string, _type uint8, mode, cumask uint16, rdev uint32, path string, inode *Ino, attr *Attr) syscall.Errno {
+	if r.readOnly {
+		return syscall.EROFS
+	}
+	if st := checkName(&r.names, name); st != 0 {
+		return st
+	}
 	ino, err := r.nextInode()
 	if err != nil {
 		return errno(err)
@@ -869,23 +2095,41 @@ func (r *redisMeta) mknod(ctx Context, parent Ino, name string, _type uint8, mod
 		*inode = ino
 	}
 
-	return r.txn(ctx, func(tx *redis.Tx) error {
+	var shards uint32
+	var size *redis.IntCmd
+	st := r.txn(ctx, func(tx *redis.Tx) error {
 		var pattr Attr
 		a, err := tx.Get(ctx, r.inodeKey(parent)).Bytes()
 		if err != nil {
 			return err
 		}
-		r.parseAttr(a, &pattr)
+		parseAttr(a, &pattr)
 		if pattr.Typ != TypeDirectory {
 			return syscall.ENOTDIR
 		}
 
-		err = tx.HGet(ctx, r.entryKey(parent), name).Err()
+		var key string
+		key, shards, _, err = r.getEntry(ctx, tx, parent, name)
 		if err != nil && err != redis.Nil {
 			return err
 		} else if err == nil {
 			return syscall.EEXIST
 		}
+		prj, err := r.getProject(ctx, tx, parent)
+		if err != nil {
+			return err
+		}
+		if r.checkProjectQuota(ctx, prj, 0, 1) {
+			return syscall.ENOSPC
+		}
+		retention, err := r.getRetention(ctx, tx, parent, &pattr)
+		if err != nil {
+			return err
+		}
+		attr.Flags &^= FlagRetention
+		if retention != nil {
+			attr.Flags |= FlagRetention
+		}
 
 		now := time.Now()
 		if _type == TypeDirectory {
@@ -906,19 +2150,32 @@ func (r *redisMeta) mknod(ctx Context, parent Ino, name string, _type uint8, mod
 		}
 
 		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
-			pipe.HSet(ctx, r.entryKey(parent), name, r.packEntry(_type, ino))
-			pipe.Set(ctx, r.inodeKey(parent), r.marshal(&pattr), 0)
-			pipe.Set(ctx, r.inodeKey(ino), r.marshal(attr), 0)
+			pipe.HSet(ctx, key, r.entryField(name), r.newEntry(_type, ino, name))
+			size = pipe.HLen(ctx, key)
+			r.updateIndex(ctx, pipe, parent, name, ino, true)
+			pipe.Set(ctx, r.inodeKey(parent), marshalAttr(&pattr), 0)
+			pipe.Set(ctx, r.inodeKey(ino), marshalAttr(attr), 0)
 			if _type == TypeSymlink {
 				pipe.Set(ctx, r.symKey(ino), path, 0)
 			} else if _type == TypeFile {
-				pipe.IncrBy(ctx, usedSpace, align4K(0))
+				pipe.IncrBy(ctx, r.prefix+usedSpace, align4K(0))
+			}
+			pipe.Incr(ctx, r.prefix+totalInodes)
+			if prj > 0 {
+				pipe.HSet(ctx, r.xattrKey(ino), projectXattr, strconv.FormatUint(uint64(prj), 10))
 			}
-			pipe.Incr(ctx, totalInodes)
+			if retention != nil {
+				pipe.HSet(ctx, r.xattrKey(ino), RetentionXattr, retention)
+			}
+			r.updateUsage(ctx, pipe, attr.Uid, attr.Gid, prj, 0, 1)
 			return nil
 		})
 		return err
 	}, r.inodeKey(parent), r.entryKey(parent))
+	if st == 0 {
+		r.checkShard(parent, shards, size.Val())
+	}
+	return st
 }
 
 func (r *redisMeta) Mkdir(ctx Context, parent Ino, name string, mode uint16, cumask uint16, copysgid uint8, inode *Ino, attr *Attr) syscall.Errno {
@@ -926,52 +2183,92 @@ func (r *redisMeta) Mkdir(ctx Context, parent Ino, name string, mode uint16, cum
 }
 
 func (r *redisMeta) Create(ctx Context, parent Ino, name string, mode uint16, cumask uint16, inode *Ino, attr *Attr) syscall.Errno {
+	if attr == nil {
+		attr = &Attr{}
+	}
 	err := r.Mknod(ctx, parent, name, TypeFile, mode, cumask, 0, inode, attr)
 	if err == 0 && inode != nil {
 		r.Lock()
 		r.openFiles[*inode] = 1
+		if attr.Flags&FlagRetention != 0 {
+			r.writing[*inode] = true
+		}
 		r.Unlock()
 	}
 	return err
 }
 
+// retryOnChange retries the operation if the entry is changed after it's read and
+// before the transaction (EAGAIN), which should not be returned to the caller.
+func retryOnChange(op func() syscall.Errno) syscall.Errno {
+	var st syscall.Errno
+	for i := 0; i < 50; i++ {
+		if st = op(); st != syscall.EAGAIN {
+			break
+		}
+		redisTxRestart.Add(1)
+	}
+	return st
+}
+
 func (r *redisMeta) Unlink(ctx Context, parent Ino, name string) syscall.Errno {
-	buf, err := r.rdb.HGet(ctx, r.entryKey(parent), name).Bytes()
+	return retryOnChange(func() syscall.Errno { return r.doUnlink(ctx, parent, name) })
+}
+
+func (r *redisMeta) doUnlink(ctx Context, parent Ino, name string) syscall.Errno {
+	if r.readOnly {
+		return syscall.EROFS
+	}
+	_, _, buf, err := r.getEntry(ctx, r.rdb, parent, name)
 	if err != nil {
 		return errno(err)
 	}
-	_type, inode := r.parseEntry(buf)
+	_type, inode := parseEntry(buf)
 	if _type == TypeDirectory {
 		return syscall.EPERM
 	}
 
-	return r.txn(ctx, func(tx *redis.Tx) error {
+	var shards uint32
+	var size *redis.IntCmd
+	st := r.txn(ctx, func(tx *redis.Tx) error {
 		rs, _ := tx.MGet(ctx, r.inodeKey(parent), r.inodeKey(inode)).Result()
 		if rs[0] == nil || rs[1] == nil {
 			return redis.Nil
 		}
 		var pattr, attr Attr
-		r.parseAttr([]byte(rs[0].(string)), &pattr)
+		parseAttr([]byte(rs[0].(string)), &pattr)
 		if pattr.Typ != TypeDirectory {
 			return syscall.ENOTDIR
 		}
+		parseAttr([]byte(rs[1].(string)), &attr)
+		if err := r.checkRetained(ctx, tx, parent, &pattr, false); err != nil {
+			return err
+		}
+		if err := r.checkRetained(ctx, tx, inode, &attr, false); err != nil {
+			return err
+		}
 		now := time.Now()
 		pattr.Mtime = now.Unix()
 		pattr.Mtimensec = uint32(now.Nanosecond())
 		pattr.Ctime = now.Unix()
 		pattr.Ctimensec = uint32(now.Nanosecond())
-		r.parseAttr([]byte(rs[1].(string)), &attr)
 		attr.Ctime = now.Unix()
 		attr.Ctimensec = uint32(now.Nanosecond())
 
-		buf, err := tx.HGet(ctx, r.entryKey(parent), name).Bytes()
+		key, n, buf, err := r.getEntry(ctx, tx, parent, name)
 		if err != nil {
 			return err
 		}
-		_type2, inode2 := r.parseEntry(buf)
+		shards = n
+		_type2, inode2 := parseEntry(buf)
 		if _type2 != _type || inode2 != inode {
 			return syscall.EAGAIN
 		}
+		ename := string(entryName([]byte(name), buf))
+		prj, err := r.getProject(ctx, tx, inode)
+		if err != nil {
+			return err
+		}
 
 		attr.Nlink--
 		var opened bool
@@ -982,27 +2279,35 @@ func (r *redisMeta) Unlink(ctx Context, parent Ino, name string) syscall.Errno {
 		}
 
 		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
-			pipe.HDel(ctx, r.entryKey(parent), name)
-			pipe.Set(ctx, r.inodeKey(parent), r.marshal(&pattr), 0)
-			pipe.Del(ctx, r.xattrKey(inode))
+			pipe.HDel(ctx, key, r.entryField(name))
+			size = pipe.HLen(ctx, key)
+			r.updateIndex(ctx, pipe, parent, ename, inode, false)
+			pipe.Set(ctx, r.inodeKey(parent), marshalAttr(&pattr), 0)
 			if attr.Nlink > 0 {
-				pipe.Set(ctx, r.inodeKey(inode), r.marshal(&attr), 0)
+				pipe.Set(ctx, r.inodeKey(inode), marshalAttr(&attr), 0)
 			} else {
+				if !opened {
+					// the project of opened file is needed when it's deleted
+					pipe.Del(ctx, r.xattrKey(inode))
+					pipe.Del(ctx, r.tagKey(inode))
+				}
 				switch _type {
 				case TypeSymlink:
 					pipe.Del(ctx, r.symKey(inode))
 					pipe.Del(ctx, r.inodeKey(inode))
 				case TypeFile:
 					if opened {
-						pipe.Set(ctx, r.inodeKey(inode), r.marshal(&attr), 0)
+						pipe.Set(ctx, r.inodeKey(inode), marshalAttr(&attr), 0)
 						pipe.SAdd(ctx, r.sessionKey(r.sid), strconv.Itoa(int(inode)))
 					} else {
-						pipe.ZAdd(ctx, delfiles, &redis.Z{Score: float64(now.Unix()), Member: r.toDelete(inode, attr.Length)})
+						pipe.ZAdd(ctx, r.prefix+delfiles, &redis.Z{Score: float64(now.Unix()), Member: r.toDelete(inode, attr.Length)})
 						pipe.Del(ctx, r.inodeKey(inode))
-						pipe.IncrBy(ctx, usedSpace, -align4K(attr.Length))
+						pipe.IncrBy(ctx, r.prefix+usedSpace, -align4K(attr.Length))
+						r.updateUsage(ctx, pipe, attr.Uid, attr.Gid, prj, -align4K(attr.Length), 0)
 					}
 				}
-				pipe.IncrBy(ctx, totalInodes, -1)
+				pipe.IncrBy(ctx, r.prefix+totalInodes, -1)
+				r.updateUsage(ctx, pipe, attr.Uid, attr.Gid, prj, 0, -1)
 			}
 			return nil
 		})
@@ -1017,31 +2322,40 @@ func (r *redisMeta) Unlink(ctx Context, parent Ino, name string) syscall.Errno {
 		}
 		return err
 	}, r.entryKey(parent), r.inodeKey(parent), r.inodeKey(inode))
+	if st == 0 {
+		r.checkShard(parent, shards, size.Val())
+	}
+	return st
 }
 
 func (r *redisMeta) Rmdir(ctx Context, parent Ino, name string) syscall.Errno {
+	if r.readOnly {
+		return syscall.EROFS
+	}
 	if name == "." {
 		return syscall.EINVAL
 	}
 	if name == ".." {
 		return syscall.ENOTEMPTY
 	}
-	buf, err := r.rdb.HGet(ctx, r.entryKey(parent), name).Bytes()
+	_, _, buf, err := r.getEntry(ctx, r.rdb, parent, name)
 	if err != nil {
 		return errno(err)
 	}
-	typ, inode := r.parseEntry(buf)
+	typ, inode := parseEntry(buf)
 	if typ != TypeDirectory {
 		return syscall.ENOTDIR
 	}
 
-	return r.txn(ctx, func(tx *redis.Tx) error {
+	var shards uint32
+	var size *redis.IntCmd
+	st := r.txn(ctx, func(tx *redis.Tx) error {
 		a, err := tx.Get(ctx, r.inodeKey(parent)).Bytes()
 		if err != nil {
 			return err
 		}
 		var pattr Attr
-		r.parseAttr(a, &pattr)
+		parseAttr(a, &pattr)
 		if pattr.Typ != TypeDirectory {
 			return syscall.ENOTDIR
 		}
@@ -1052,33 +2366,59 @@ func (r *redisMeta) Rmdir(ctx Context, parent Ino, name string) syscall.Errno {
 		pattr.Ctime = now.Unix()
 		pattr.Ctimensec = uint32(now.Nanosecond())
 
-		buf, err := tx.HGet(ctx, r.entryKey(parent), name).Bytes()
+		key, n, buf, err := r.getEntry(ctx, tx, parent, name)
 		if err != nil {
 			return err
 		}
-		typ, inode = r.parseEntry(buf)
+		shards = n
+		typ, inode = parseEntry(buf)
 		if typ != TypeDirectory {
 			return syscall.ENOTDIR
 		}
+		ename := string(entryName([]byte(name), buf))
 
-		cnt, err := tx.HLen(ctx, r.entryKey(inode)).Result()
+		empty, err := r.isEmptyDir(ctx, tx, inode)
 		if err != nil {
 			return err
 		}
-		if cnt > 0 {
+		if !empty {
 			return syscall.ENOTEMPTY
 		}
+		a, err = tx.Get(ctx, r.inodeKey(inode)).Bytes()
+		if err != nil {
+			return err
+		}
+		var attr Attr
+		parseAttr(a, &attr)
+		if err = r.checkRetained(ctx, tx, parent, &pattr, false); err != nil {
+			return err
+		}
+		if err = r.checkRetained(ctx, tx, inode, &attr, false); err != nil {
+			return err
+		}
+		prj, err := r.getProject(ctx, tx, inode)
+		if err != nil {
+			return err
+		}
 		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
-			pipe.HDel(ctx, r.entryKey(parent), name)
-			pipe.Set(ctx, r.inodeKey(parent), r.marshal(&pattr), 0)
+			pipe.HDel(ctx, key, r.entryField(name))
+			size = pipe.HLen(ctx, key)
+			r.updateIndex(ctx, pipe, parent, ename, inode, false)
+			pipe.Set(ctx, r.inodeKey(parent), marshalAttr(&pattr), 0)
 			pipe.Del(ctx, r.inodeKey(inode))
 			pipe.Del(ctx, r.xattrKey(inode))
-			// pipe.Del(ctx, r.entryKey(inode))
-			pipe.IncrBy(ctx, totalInodes, -1)
+			pipe.Del(ctx, r.tagKey(inode))
+			pipe.Del(ctx, r.entryKey(inode)) // the number of shards
+			pipe.IncrBy(ctx, r.prefix+totalInodes, -1)
+			r.updateUsage(ctx, pipe, attr.Uid, attr.Gid, prj, 0, -1)
 			return nil
 		})
 		return err
 	}, r.inodeKey(parent), r.entryKey(parent), r.inodeKey(inode), r.entryKey(inode))
+	if st == 0 {
+		r.checkShard(parent, shards, size.Val())
+	}
+	return st
 }
 
 func (r *redisMeta) emptyDir(ctx Context, inode Ino, concurrent chan int) syscall.Errno {
@@ -1149,19 +2489,68 @@ func (r *redisMeta) Rmr(ctx Context, parent Ino, name string) syscall.Errno {
 	return r.emptyEntry(ctx, parent, name, inode, concurrent)
 }
 
-func (r *redisMeta) Rename(ctx Context, parentSrc Ino, nameSrc string, parentDst Ino, nameDst string, inode *Ino, attr *Attr) syscall.Errno {
-	buf, err := r.rdb.HGet(ctx, r.entryKey(parentSrc), nameSrc).Bytes()
+func (r *redisMeta) Rename(ctx Context, parentSrc Ino, nameSrc string, parentDst Ino, nameDst string, flags uint32, inode *Ino, attr *Attr) syscall.Errno {
+	if flags&^RenameNoReplace != 0 {
+		return syscall.ENOTSUP // exchange and whiteout are not supported
+	}
+	return retryOnChange(func() syscall.Errno {
+		return r.doRename(ctx, parentSrc, nameSrc, parentDst, nameDst, flags, inode, attr)
+	})
+}
+
+func (r *redisMeta) doRename(ctx Context, parentSrc Ino, nameSrc string, parentDst Ino, nameDst string, flags uint32, inode *Ino, attr *Attr) syscall.Errno {
+	if r.readOnly {
+		return syscall.EROFS
+	}
+	if st := checkName(&r.names, nameDst); st != 0 {
+		return st
+	}
+	_, _, buf, err := r.getEntry(ctx, r.rdb, parentSrc, nameSrc)
 	if err != nil {
 		return errno(err)
 	}
-	typ, ino := r.parseEntry(buf)
+	typ, ino := parseEntry(buf)
 	if parentSrc == parentDst && nameSrc == nameDst {
 		if inode != nil {
 			*inode = ino
 		}
+		if flags&RenameNoReplace != 0 {
+			return syscall.EEXIST
+		}
 		return 0
 	}
-	buf, err = r.rdb.HGet(ctx, r.entryKey(parentDst), nameDst).Bytes()
+	if parentSrc == parentDst && r.entryField(nameSrc) == r.entryField(nameDst) {
+		// only the case of name is changed
+		if inode != nil {
+			*inode = ino
+		}
+		return r.txn(ctx, func(tx *redis.Tx) error {
+			key, _, buf, err := r.getEntry(ctx, tx, parentSrc, nameSrc)
+			if err != nil {
+				return err
+			}
+			if _, ino1 := parseEntry(buf); ino1 != ino {
+				return syscall.EAGAIN
+			}
+			a, err := tx.Get(ctx, r.inodeKey(parentSrc)).Bytes()
+			if err != nil {
+				return err
+			}
+			var pattr Attr
+			parseAttr(a, &pattr)
+			if err = r.checkRetained(ctx, tx, parentSrc, &pattr, false); err != nil {
+				return err
+			}
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				pipe.HSet(ctx, key, r.entryField(nameDst), r.newEntry(typ, ino, nameDst))
+				r.updateIndex(ctx, pipe, parentSrc, string(entryName([]byte(nameSrc), buf)), ino, false)
+				r.updateIndex(ctx, pipe, parentDst, nameDst, ino, true)
+				return nil
+			})
+			return err
+		}, r.entryKey(parentSrc))
+	}
+	_, _, buf, err = r.getEntry(ctx, r.rdb, parentDst, nameDst)
 	if err != nil && err != redis.Nil {
 		return errno(err)
 	}
@@ -1170,42 +2559,52 @@ func (r *redisMeta) Rename(ctx Context, parentSrc Ino, nameSrc string, parentDst
 	var dino Ino
 	var dtyp uint8
 	if err == nil {
-		dtyp, dino = r.parseEntry(buf)
+		dtyp, dino = parseEntry(buf)
 		keys = append(keys, r.inodeKey(dino))
 		if dtyp == TypeDirectory {
 			keys = append(keys, r.entryKey(dino))
 		}
 	}
 
-	return r.txn(ctx, func(tx *redis.Tx) error {
-		buf, err = tx.HGet(ctx, r.entryKey(parentDst), nameDst).Bytes()
+	var skey, dkey string
+	var sshards, dshards uint32
+	var ssize, dsize *redis.IntCmd
+	st := r.txn(ctx, func(tx *redis.Tx) error {
+		dkey, dshards, buf, err = r.getEntry(ctx, tx, parentDst, nameDst)
 		if err != nil && err != redis.Nil {
 			return err
 		}
 		var tattr Attr
 		var opened bool
+		var dname = nameDst
 		if err == nil {
-			if ctx.Value(CtxKey("behavior")) == "Hadoop" {
+			if ctx.Value(CtxKey("behavior")) == "Hadoop" || flags&RenameNoReplace != 0 {
 				return syscall.EEXIST
 			}
-			typ1, dino1 := r.parseEntry(buf)
+			typ1, dino1 := parseEntry(buf)
 			if dino1 != dino || typ1 != dtyp {
 				return syscall.EAGAIN
 			}
+			dname = string(entryName([]byte(nameDst), buf))
 			if typ1 == TypeDirectory {
-				cnt, err := tx.HLen(ctx, r.entryKey(dino)).Result()
+				empty, err := r.isEmptyDir(ctx, tx, dino)
 				if err != nil {
 					return err
 				}
-				if cnt != 0 {
+				if !empty {
 					return syscall.ENOTEMPTY
 				}
+				a, err := tx.Get(ctx, r.inodeKey(dino)).Bytes()
+				if err != nil {
+					return err
+				}
+				parseAttr(a, &tattr)
 			} else {
 				a, err := tx.Get(ctx, r.inodeKey(dino)).Bytes()
 				if err != nil {
 					return err
 				}
-				r.parseAttr(a, &tattr)
+				parseAttr(a, &tattr)
 				tattr.Nlink--
 				if tattr.Nlink > 0 {
 					now := time.Now()
@@ -1221,38 +2620,73 @@ func (r *redisMeta) Rename(ctx Context, parentSrc Ino, nameSrc string, parentDst
 			dino = 0
 		}
 
-		buf, err := tx.HGet(ctx, r.entryKey(parentSrc), nameSrc).Bytes()
+		var buf []byte
+		skey, sshards, buf, err = r.getEntry(ctx, tx, parentSrc, nameSrc)
 		if err != nil {
 			return err
 		}
-		_, ino1 := r.parseEntry(buf)
+		_, ino1 := parseEntry(buf)
 		if ino != ino1 {
 			return syscall.EAGAIN
 		}
+		sname := string(entryName([]byte(nameSrc), buf))
+		var tprj uint32
+		if dino > 0 {
+			if tprj, err = r.getProject(ctx, tx, dino); err != nil {
+				return err
+			}
+		}
+		if parentSrc != parentDst {
+			prj, err := r.getProject(ctx, tx, ino)
+			if err != nil {
+				return err
+			}
+			dprj, err := r.getProject(ctx, tx, parentDst)
+			if err != nil {
+				return err
+			}
+			if st := checkProjectMove(prj, dprj); st != 0 {
+				return st
+			}
+		}
 
 		rs, _ := tx.MGet(ctx, r.inodeKey(parentSrc), r.inodeKey(parentDst), r.inodeKey(ino)).Result()
 		if rs[0] == nil || rs[1] == nil || rs[2] == nil {
 			return redis.Nil
 		}
 		var sattr, dattr, iattr Attr
-		r.parseAttr([]byte(rs[0].(string)), &sattr)
+		parseAttr([]byte(rs[0].(string)), &sattr)
 		if sattr.Typ != TypeDirectory {
 			return syscall.ENOTDIR
 		}
+		parseAttr([]byte(rs[1].(string)), &dattr)
+		if dattr.Typ != TypeDirectory {
+			return syscall.ENOTDIR
+		}
+		parseAttr([]byte(rs[2].(string)), &iattr)
+		if err = r.checkRetained(ctx, tx, parentSrc, &sattr, false); err != nil {
+			return err
+		}
+		if err = r.checkRetained(ctx, tx, ino, &iattr, false); err != nil {
+			return err
+		}
+		if dino > 0 {
+			if err = r.checkRetained(ctx, tx, parentDst, &dattr, false); err != nil {
+				return err
+			}
+			if err = r.checkRetained(ctx, tx, dino, &tattr, false); err != nil {
+				return err
+			}
+		}
 		now := time.Now()
 		sattr.Mtime = now.Unix()
 		sattr.Mtimensec = uint32(now.Nanosecond())
 		sattr.Ctime = now.Unix()
 		sattr.Ctimensec = uint32(now.Nanosecond())
-		r.parseAttr([]byte(rs[1].(string)), &dattr)
-		if dattr.Typ != TypeDirectory {
-			return syscall.ENOTDIR
-		}
 		dattr.Mtime = now.Unix()
 		dattr.Mtimensec = uint32(now.Nanosecond())
 		dattr.Ctime = now.Unix()
 		dattr.Ctimensec = uint32(now.Nanosecond())
-		r.parseAttr([]byte(rs[2].(string)), &iattr)
 		iattr.Parent = parentDst
 		iattr.Ctime = now.Unix()
 		iattr.Ctimensec = uint32(now.Nanosecond())
@@ -1265,38 +2699,49 @@ func (r *redisMeta) Rename(ctx Context, parentSrc Ino, nameSrc string, parentDst
 		}
 
 		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
-			pipe.HDel(ctx, r.entryKey(parentSrc), nameSrc)
-			pipe.Set(ctx, r.inodeKey(parentSrc), r.marshal(&sattr), 0)
+			pipe.HDel(ctx, skey, r.entryField(nameSrc))
+			r.updateIndex(ctx, pipe, parentSrc, sname, ino, false)
+			pipe.Set(ctx, r.inodeKey(parentSrc), marshalAttr(&sattr), 0)
 			if dino > 0 {
 				if dtyp != TypeDirectory && tattr.Nlink > 0 {
-					pipe.Set(ctx, r.inodeKey(dino), r.marshal(&tattr), 0)
+					pipe.Set(ctx, r.inodeKey(dino), marshalAttr(&tattr), 0)
 				} else {
 					if dtyp == TypeDirectory {
 						pipe.Del(ctx, r.inodeKey(dino))
+						pipe.Del(ctx, r.entryKey(dino)) // the number of shards
 						dattr.Nlink--
 					} else if dtyp == TypeSymlink {
 						pipe.Del(ctx, r.symKey(dino))
 						pipe.Del(ctx, r.inodeKey(dino))
 					} else if dtyp == TypeFile {
 						if opened {
-							pipe.Set(ctx, r.inodeKey(dino), r.marshal(&tattr), 0)
+							pipe.Set(ctx, r.inodeKey(dino), marshalAttr(&tattr), 0)
 							pipe.SAdd(ctx, r.sessionKey(r.sid), strconv.Itoa(int(dino)))
 						} else {
-							pipe.ZAdd(ctx, delfiles, &redis.Z{Score: float64(now.Unix()), Member: r.toDelete(dino, dattr.Length)})
+							pipe.ZAdd(ctx, r.prefix+delfiles, &redis.Z{Score: float64(now.Unix()), Member: r.toDelete(dino, dattr.Length)})
 							pipe.Del(ctx, r.inodeKey(dino))
-							pipe.IncrBy(ctx, usedSpace, -align4K(tattr.Length))
+							pipe.IncrBy(ctx, r.prefix+usedSpace, -align4K(tattr.Length))
+							r.updateUsage(ctx, pipe, tattr.Uid, tattr.Gid, tprj, -align4K(tattr.Length), 0)
 						}
 					}
-					pipe.IncrBy(ctx, totalInodes, -1)
-					pipe.Del(ctx, r.xattrKey(dino))
+					pipe.IncrBy(ctx, r.prefix+totalInodes, -1)
+					r.updateUsage(ctx, pipe, tattr.Uid, tattr.Gid, tprj, 0, -1)
+					if !opened {
+						pipe.Del(ctx, r.xattrKey(dino))
+						pipe.Del(ctx, r.tagKey(dino))
+					}
 				}
-				pipe.HDel(ctx, r.entryKey(parentDst), nameDst)
+				pipe.HDel(ctx, dkey, r.entryField(nameDst))
+				r.updateIndex(ctx, pipe, parentDst, dname, dino, false)
 			}
-			pipe.HSet(ctx, r.entryKey(parentDst), nameDst, buf)
+			pipe.HSet(ctx, dkey, r.entryField(nameDst), r.newEntry(typ, ino, nameDst))
+			ssize = pipe.HLen(ctx, skey)
+			dsize = pipe.HLen(ctx, dkey)
+			r.updateIndex(ctx, pipe, parentDst, nameDst, ino, true)
 			if parentDst != parentSrc {
-				pipe.Set(ctx, r.inodeKey(parentDst), r.marshal(&dattr), 0)
+				pipe.Set(ctx, r.inodeKey(parentDst), marshalAttr(&dattr), 0)
 			}
-			pipe.Set(ctx, r.inodeKey(ino), r.marshal(&iattr), 0)
+			pipe.Set(ctx, r.inodeKey(ino), marshalAttr(&iattr), 0)
 			return nil
 		})
 		if err == nil && dino > 0 && dtyp == TypeFile {
@@ -1310,10 +2755,23 @@ func (r *redisMeta) Rename(ctx Context, parentSrc Ino, nameSrc string, parentDst
 		}
 		return err
 	}, keys...)
+	if st == 0 {
+		r.checkShard(parentSrc, sshards, ssize.Val())
+		r.checkShard(parentDst, dshards, dsize.Val())
+	}
+	return st
 }
 
 func (r *redisMeta) Link(ctx Context, inode, parent Ino, name string, attr *Attr) syscall.Errno {
-	return r.txn(ctx, func(tx *redis.Tx) error {
+	if r.readOnly {
+		return syscall.EROFS
+	}
+	if st := checkName(&r.names, name); st != 0 {
+		return st
+	}
+	var shards uint32
+	var size *redis.IntCmd
+	st := r.txn(ctx, func(tx *redis.Tx) error {
 		rs, err := tx.MGet(ctx, r.inodeKey(parent), r.inodeKey(inode)).Result()
 		if err != nil {
 			return err
@@ -1322,7 +2780,7 @@ func (r *redisMeta) Link(ctx Context, inode, parent Ino, name string, attr *Attr
 			return redis.Nil
 		}
 		var pattr, iattr Attr
-		r.parseAttr([]byte(rs[0].(string)), &pattr)
+		parseAttr([]byte(rs[0].(string)), &pattr)
 		if pattr.Typ != TypeDirectory {
 			return syscall.ENOTDIR
 		}
@@ -1331,7 +2789,7 @@ func (r *redisMeta) Link(ctx Context, inode, parent Ino, name string, attr *Attr
 		pattr.Mtimensec = uint32(now.Nanosecond())
 		pattr.Ctime = now.Unix()
 		pattr.Ctimensec = uint32(now.Nanosecond())
-		r.parseAttr([]byte(rs[1].(string)), &iattr)
+		parseAttr([]byte(rs[1].(string)), &iattr)
 		if iattr.Typ == TypeDirectory {
 			return syscall.EPERM
 		}
@@ -1339,17 +2797,31 @@ func (r *redisMeta) Link(ctx Context, inode, parent Ino, name string, attr *Attr
 		iattr.Ctimensec = uint32(now.Nanosecond())
 		iattr.Nlink++
 
-		err = tx.HGet(ctx, r.entryKey(parent), name).Err()
+		var key string
+		key, shards, _, err = r.getEntry(ctx, tx, parent, name)
 		if err != nil && err != redis.Nil {
 			return err
 		} else if err == nil {
 			return syscall.EEXIST
 		}
+		prj, err := r.getProject(ctx, tx, inode)
+		if err != nil {
+			return err
+		}
+		dprj, err := r.getProject(ctx, tx, parent)
+		if err != nil {
+			return err
+		}
+		if st := checkProjectMove(prj, dprj); st != 0 {
+			return st
+		}
 
 		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
-			pipe.HSet(ctx, r.entryKey(parent), name, r.packEntry(iattr.Typ, inode))
-			pipe.Set(ctx, r.inodeKey(parent), r.marshal(&pattr), 0)
-			pipe.Set(ctx, r.inodeKey(inode), r.marshal(&iattr), 0)
+			pipe.HSet(ctx, key, r.entryField(name), r.newEntry(iattr.Typ, inode, name))
+			size = pipe.HLen(ctx, key)
+			r.updateIndex(ctx, pipe, parent, name, inode, true)
+			pipe.Set(ctx, r.inodeKey(parent), marshalAttr(&pattr), 0)
+			pipe.Set(ctx, r.inodeKey(inode), marshalAttr(&iattr), 0)
 			return nil
 		})
 		if err == nil && attr != nil {
@@ -1357,6 +2829,10 @@ func (r *redisMeta) Link(ctx Context, inode, parent Ino, name string, attr *Attr
 		}
 		return err
 	}, r.inodeKey(inode), r.entryKey(parent), r.inodeKey(parent))
+	if st == 0 {
+		r.checkShard(parent, shards, size.Val())
+	}
+	return st
 }
 
 func (r *redisMeta) Readdir(ctx Context, inode Ino, plus uint8, entries *[]*Entry) syscall.Errno {
@@ -1379,28 +2855,22 @@ func (r *redisMeta) Readdir(ctx Context, inode Ino, plus uint8, entries *[]*Entr
 		})
 	}
 
-	var keys []string
-	var cursor uint64
-	var err error
-	for {
-		keys, cursor, err = r.rdb.HScan(ctx, r.entryKey(inode), cursor, "*", 10000).Result()
-		if err != nil {
-			return errno(err)
-		}
+	rdb := r.reader()
+	err := r.scanEntries(ctx, rdb, inode, func(keys []string) {
 		newEntries := make([]Entry, len(keys)/2)
 		newAttrs := make([]Attr, len(keys)/2)
 		for i := 0; i < len(keys); i += 2 {
-			typ, inode := r.parseEntry([]byte(keys[i+1]))
+			typ, inode := parseEntry([]byte(keys[i+1]))
 			ent := &newEntries[i/2]
 			ent.Inode = inode
-			ent.Name = []byte(keys[i])
+			ent.Name = entryName([]byte(keys[i]), []byte(keys[i+1]))
 			ent.Attr = &newAttrs[i/2]
 			ent.Attr.Typ = typ
 			*entries = append(*entries, ent)
 		}
-		if cursor == 0 {
-			break
-		}
+	})
+	if err != nil {
+		return errno(err)
 	}
 
 	if plus != 0 {
@@ -1409,14 +2879,14 @@ func (r *redisMeta) Readdir(ctx Context, inode Ino, plus uint8, entries *[]*Entr
 			for i, e := range es {
 				keys[i] = r.inodeKey(e.Inode)
 			}
-			rs, err := r.rdb.MGet(ctx, keys...).Result()
+			rs, err := rdb.MGet(ctx, keys...).Result()
 			if err != nil {
 				return err
 			}
 			for j, re := range rs {
 				if re != nil {
 					if a, ok := re.(string); ok {
-						r.parseAttr([]byte(a), es[j].Attr)
+						parseAttr([]byte(a), es[j].Attr)
 					}
 				}
 			}
@@ -1473,22 +2943,84 @@ func (r *redisMeta) cleanStaleSession(sid int64) {
 	}
 	if len(inodes) == 0 {
 		r.rdb.Del(ctx, r.sessionKey(sid))
-		r.rdb.ZRem(ctx, allSessions, strconv.Itoa(int(sid)))
+		r.rdb.ZRem(ctx, r.prefix+allSessions, strconv.Itoa(int(sid)))
+		r.rdb.HDel(ctx, r.prefix+sessionInfos, strconv.Itoa(int(sid)))
+	}
+}
+
+func (r *redisMeta) Lease(name string, ttl time.Duration) (bool, error) {
+	ctx := Background
+	key := r.prefix + "lease:" + name
+	sid := strconv.FormatInt(r.sid, 10)
+	var held bool
+	err := r.txn(ctx, func(tx *redis.Tx) error {
+		v, err := tx.Get(ctx, key).Result()
+		if err != nil && err != redis.Nil {
+			return err
+		}
+		now := time.Now()
+		held = true
+		if ps := strings.Split(v, ":"); err == nil && len(ps) == 2 {
+			expire, _ := strconv.ParseInt(ps[1], 10, 64)
+			held = ps[0] == sid || expire < now.UnixNano()
+		}
+		if !held {
+			return nil
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			if ttl == 0 {
+				pipe.Del(ctx, key)
+			} else {
+				pipe.Set(ctx, key, fmt.Sprintf("%s:%d", sid, now.Add(ttl).UnixNano()), ttl)
+			}
+			return nil
+		})
+		return err
+	}, key)
+	if err != 0 {
+		return false, err
+	}
+	return held, nil
+}
+
+func (r *redisMeta) ListSessions() ([]*SessionInfo, error) {
+	ctx := Background
+	zs, err := r.rdb.ZRangeWithScores(ctx, r.prefix+allSessions, 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	infos, err := r.rdb.HGetAll(ctx, r.prefix+sessionInfos).Result()
+	if err != nil {
+		return nil, err
 	}
+	sessions := make([]*SessionInfo, 0, len(zs))
+	for _, z := range zs {
+		sid, _ := strconv.ParseUint(z.Member.(string), 10, 64)
+		s := &SessionInfo{Sid: sid}
+		if info, ok := infos[z.Member.(string)]; ok {
+			if err = json.Unmarshal([]byte(info), s); err != nil {
+				logger.Warnf("invalid info of session %d: %s", sid, err)
+			}
+		}
+		s.Heartbeat = time.Unix(int64(z.Score), 0)
+		sessions = append(sessions, s)
+	}
+	sortSessions(sessions)
+	return sessions, nil
 }
 
 func (r *redisMeta) cleanStaleSessions() {
 	now := time.Now()
 	var ctx = Background
 	rng := &redis.ZRangeBy{Max: strconv.Itoa(int(now.Add(time.Minute * -10).Unix())), Count: 100}
-	staleSessions, _ := r.rdb.ZRangeByScore(ctx, allSessions, rng).Result()
+	staleSessions, _ := r.rdb.ZRangeByScore(ctx, r.prefix+allSessions, rng).Result()
 	for _, ssid := range staleSessions {
 		sid, _ := strconv.Atoi(ssid)
 		r.cleanStaleSession(int64(sid))
 	}
 
 	rng = &redis.ZRangeBy{Max: strconv.Itoa(int(now.Add(time.Minute * -3).Unix())), Count: 100}
-	staleSessions, err := r.rdb.ZRangeByScore(ctx, allSessions, rng).Result()
+	staleSessions, err := r.rdb.ZRangeByScore(ctx, r.prefix+allSessions, rng).Result()
 	if err != nil || len(staleSessions) == 0 {
 		return
 	}
@@ -1499,11 +3031,17 @@ func (r *redisMeta) cleanStaleSessions() {
 	var cursor uint64
 	var keys []string
 	for {
-		keys, cursor, err = r.rdb.Scan(ctx, cursor, "lock*", 1000).Result()
+		keys, cursor, err = r.rdb.Scan(ctx, cursor, r.prefix+"lock*", 1000).Result()
 		if err != nil {
 			break
 		}
 		for _, k := range keys {
+			if len(k) <= len(r.prefix)+5 {
+				continue
+			}
+			if _, err := strconv.ParseUint(k[len(r.prefix)+5:], 10, 64); err != nil {
+				continue // not a lock of this volume
+			}
 			owners, _ := r.rdb.HKeys(ctx, k).Result()
 			for _, o := range owners {
 				p := strings.Split(o, "_")[0]
@@ -1521,10 +3059,15 @@ func (r *redisMeta) cleanStaleSessions() {
 
 func (r *redisMeta) refreshSession() {
 	for {
-		time.Sleep(time.Minute)
+		time.Sleep(r.conf.heartbeat())
 		now := time.Now()
-		r.rdb.ZAdd(Background, allSessions, &redis.Z{Score: float64(now.Unix()), Member: strconv.Itoa(int(r.sid))})
-		go r.cleanStaleSessions()
+		r.rdb.ZAdd(Background, r.prefix+allSessions, &redis.Z{Score: float64(now.Unix()), Member: strconv.Itoa(int(r.sid))})
+		if err := r.loadSetting(false); err != nil {
+			logger.Warnf("reload setting: %s", err)
+		}
+		if !r.readOnly && jobs.IsLeader() {
+			go r.cleanStaleSessions()
+		}
 	}
 }
 
@@ -1538,11 +3081,19 @@ func (r *redisMeta) deleteInode(inode Ino) error {
 	if err != nil {
 		return err
 	}
-	r.parseAttr(a, &attr)
+	parseAttr(a, &attr)
+	var prj uint32
+	if v, err := r.rdb.HGet(ctx, r.xattrKey(inode), projectXattr).Bytes(); err == nil {
+		prj, _ = parseProject(v)
+	}
 	_, err = r.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
-		pipe.ZAdd(ctx, delfiles, &redis.Z{Score: float64(time.Now().Unix()), Member: r.toDelete(inode, attr.Length)})
+		pipe.ZAdd(ctx, r.prefix+delfiles, &redis.Z{Score: float64(time.Now().Unix()), Member: r.toDelete(inode, attr.Length)})
 		pipe.Del(ctx, r.inodeKey(inode))
-		pipe.IncrBy(ctx, usedSpace, -align4K(attr.Length))
+		pipe.Del(ctx, r.xattrKey(inode))
+		pipe.Del(ctx, r.tagKey(inode))
+		pipe.Del(ctx, r.delegationKey(inode))
+		pipe.IncrBy(ctx, r.prefix+usedSpace, -align4K(attr.Length))
+		r.updateUsage(ctx, pipe, attr.Uid, attr.Gid, prj, -align4K(attr.Length), 0)
 		return nil
 	})
 	if err == nil {
@@ -1552,11 +3103,28 @@ func (r *redisMeta) deleteInode(inode Ino) error {
 }
 
 func (r *redisMeta) Open(ctx Context, inode Ino, flags uint8, attr *Attr) syscall.Errno {
+	if r.readOnly && flags&(syscall.O_WRONLY|syscall.O_RDWR) != 0 {
+		return syscall.EROFS
+	}
 	var err syscall.Errno
 	if attr != nil {
 		err = r.GetAttr(ctx, inode, attr)
+		if err == 0 && attr.Flags&FlagReadOnly != 0 && flags&(syscall.O_WRONLY|syscall.O_RDWR) != 0 {
+			return syscall.EPERM
+		}
+		if err == 0 && attr.Flags&FlagRetention != 0 && flags&(syscall.O_WRONLY|syscall.O_RDWR) != 0 {
+			r.Lock()
+			writing := r.writing[inode]
+			r.Unlock()
+			if v, e := r.rdb.HGet(ctx, r.xattrKey(inode), RetentionXattr).Bytes(); !writing && e == nil && retentionActive(v) {
+				return syscall.EPERM
+			}
+		}
 	}
 	if err == 0 {
+		if err = r.delegs.recall(ctx, r, uint64(r.sid), inode, flags&(syscall.O_WRONLY|syscall.O_RDWR) != 0); err != 0 {
+			return err
+		}
 		r.Lock()
 		r.openFiles[inode] = r.openFiles[inode] + 1
 		r.Unlock()
@@ -1564,12 +3132,44 @@ func (r *redisMeta) Open(ctx Context, inode Ino, flags uint8, attr *Attr) syscal
 	return 0
 }
 
+func (r *redisMeta) Delegate(ctx Context, inode Ino, ltype uint8) syscall.Errno {
+	if r.readOnly && (ltype == DelegateWrite || ltype == DelegateAppend) {
+		return syscall.EROFS
+	}
+	return r.delegs.delegate(r, uint64(r.sid), inode, ltype)
+}
+
+func (r *redisMeta) updateDelegations(inode Ino, f func(ds []delegation) []delegation) error {
+	ctx := Background
+	key := r.delegationKey(inode)
+	if st := r.txn(ctx, func(tx *redis.Tx) error {
+		buf, err := tx.Get(ctx, key).Bytes()
+		if err != nil && err != redis.Nil {
+			return err
+		}
+		ds := f(loadDelegations(buf))
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			if len(ds) == 0 {
+				pipe.Del(ctx, key)
+			} else {
+				pipe.Set(ctx, key, dumpDelegations(ds), 0)
+			}
+			return nil
+		})
+		return err
+	}, key); st != 0 {
+		return st
+	}
+	return nil
+}
+
 func (r *redisMeta) Close(ctx Context, inode Ino) syscall.Errno {
 	r.Lock()
 	defer r.Unlock()
 	refs := r.openFiles[inode]
 	if refs <= 1 {
 		delete(r.openFiles, inode)
+		delete(r.writing, inode)
 		if r.removedFiles[inode] {
 			delete(r.removedFiles, inode)
 			go func() {
@@ -1584,64 +3184,82 @@ func (r *redisMeta) Close(ctx Context, inode Ino) syscall.Errno {
 	return 0
 }
 
-func buildSlice(ss []*slice) []Slice {
-	var root *slice
-	for _, s := range ss {
-		if root != nil {
-			var right *slice
-			s.left, right = root.cut(s.pos)
-			_, s.right = right.cut(s.pos + s.len)
-		}
-		root = s
-	}
-	var pos uint32
-	var chunks []Slice
-	root.visit(func(s *slice) {
-		if s.pos > pos {
-			chunks = append(chunks, Slice{Size: s.pos - pos, Len: s.pos - pos})
-			pos = s.pos
-		}
-		chunks = append(chunks, Slice{Chunkid: s.chunkid, Size: s.size, Off: s.off, Len: s.len})
-		pos += s.len
-	})
-	return chunks
-}
-
 func (r *redisMeta) Read(ctx Context, inode Ino, indx uint32, chunks *[]Slice) syscall.Errno {
 	vals, err := r.rdb.LRange(ctx, r.chunkKey(inode, indx), 0, 1000000).Result()
 	if err != nil {
 		return errno(err)
 	}
-	ss := readSlices(vals)
-	*chunks = buildSlice(ss)
+	a := newSliceArena()
+	*chunks = buildObserved(a, a.readSlices(vals))
+	a.release()
 	if len(vals) >= 5 {
-		go r.compactChunk(inode, indx)
+		go r.compactChunk(inode, indx, false)
 	}
 	return 0
 }
 
 func (r *redisMeta) NewChunk(ctx Context, inode Ino, indx uint32, offset uint32, chunkid *uint64) syscall.Errno {
-	cid, err := r.rdb.Incr(ctx, "nextchunk").Uint64()
+	if r.readOnly {
+		return syscall.EROFS
+	}
+	cid, err := r.rdb.Incr(ctx, r.prefix+"nextchunk").Uint64()
 	if err == nil {
 		*chunkid = cid
 	}
 	return errno(err)
 }
 
+func (r *redisMeta) ReserveChunks(maxid uint64) error {
+	ctx := Background
+	key := r.prefix + "nextchunk"
+	return r.rdb.Watch(ctx, func(tx *redis.Tx) error {
+		next, err := tx.Get(ctx, key).Uint64()
+		if err != nil && err != redis.Nil {
+			return err
+		}
+		if next >= maxid {
+			return nil
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, key, maxid, 0)
+			return nil
+		})
+		return err
+	}, key)
+}
+
 func (r *redisMeta) Write(ctx Context, inode Ino, indx uint32, off uint32, slice Slice) syscall.Errno {
+	if r.readOnly {
+		return syscall.EROFS
+	}
 	return r.txn(ctx, func(tx *redis.Tx) error {
 		var attr Attr
 		a, err := tx.Get(ctx, r.inodeKey(inode)).Bytes()
 		if err != nil {
 			return err
 		}
-		r.parseAttr(a, &attr)
+		parseAttr(a, &attr)
+		if attr.Flags&FlagReadOnly != 0 {
+			return syscall.EPERM
+		}
+		if err = r.checkRetained(ctx, tx, inode, &attr, true); err != nil {
+			return err
+		}
 		newleng := uint64(indx)*ChunkSize + uint64(off) + uint64(slice.Len)
 		var added int64
 		if newleng > attr.Length {
 			added = align4K(newleng) - align4K(attr.Length)
 			attr.Length = newleng
 		}
+		var prj uint32
+		if added > 0 {
+			if prj, err = r.getProject(ctx, tx, inode); err != nil {
+				return err
+			}
+		}
+		if added > 0 && (r.checkQuota(ctx, added) || r.checkProjectQuota(ctx, prj, added, 0)) {
+			return syscall.ENOSPC
+		}
 		now := time.Now()
 		attr.Mtime = now.Unix()
 		attr.Mtimensec = uint32(now.Nanosecond())
@@ -1651,22 +3269,101 @@ func (r *redisMeta) Write(ctx Context, inode Ino, indx uint32, off uint32, slice
 		var rpush *redis.IntCmd
 		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
 			rpush = pipe.RPush(ctx, r.chunkKey(inode, indx), marshalSlice(off, slice.Chunkid, slice.Size, slice.Off, slice.Len))
+			if indx == 0 {
+				// the inlined data (if any) should be written as the first slice
+				pipe.Del(ctx, r.inlineKey(inode))
+			}
 			// most of chunk are used by single inode, so use that as the default (1 == not exists)
 			// pipe.Incr(ctx, r.sliceKey(slice.Chunkid, slice.Size))
-			pipe.Set(ctx, r.inodeKey(inode), r.marshal(&attr), 0)
+			pipe.Set(ctx, r.inodeKey(inode), marshalAttr(&attr), 0)
 			if added > 0 {
-				pipe.IncrBy(ctx, usedSpace, added)
+				pipe.IncrBy(ctx, r.prefix+usedSpace, added)
+				r.updateUsage(ctx, pipe, attr.Uid, attr.Gid, prj, added, 0)
 			}
 			return nil
 		})
 		if err == nil && rpush.Val()%20 == 0 {
-			go r.compactChunk(inode, indx)
+			go r.compactChunk(inode, indx, false)
 		}
 		return err
 	}, r.inodeKey(inode))
 }
 
+func (r *redisMeta) ReadInline(ctx Context, inode Ino, data *[]byte) syscall.Errno {
+	buf, err := r.rdb.Get(ctx, r.inlineKey(inode)).Bytes()
+	if err == redis.Nil {
+		*data = nil
+		return 0
+	}
+	if err == nil {
+		*data = buf
+	}
+	return errno(err)
+}
+
+func (r *redisMeta) WriteInline(ctx Context, inode Ino, data []byte) syscall.Errno {
+	if r.readOnly {
+		return syscall.EROFS
+	}
+	return r.txn(ctx, func(tx *redis.Tx) error {
+		var attr Attr
+		a, err := tx.Get(ctx, r.inodeKey(inode)).Bytes()
+		if err != nil {
+			return err
+		}
+		parseAttr(a, &attr)
+		if attr.Typ != TypeFile || attr.Flags&FlagReadOnly != 0 {
+			return syscall.EPERM
+		}
+		if err = r.checkRetained(ctx, tx, inode, &attr, true); err != nil {
+			return err
+		}
+		if attr.Length > 0 {
+			// only the files with inlined data (or empty) can be updated
+			n, err := tx.Exists(ctx, r.inlineKey(inode)).Result()
+			if err != nil {
+				return err
+			}
+			if n == 0 {
+				return syscall.EINVAL
+			}
+		}
+		var added int64
+		if newleng := uint64(len(data)); newleng > attr.Length {
+			added = align4K(newleng) - align4K(attr.Length)
+			attr.Length = newleng
+		}
+		var prj uint32
+		if added > 0 {
+			if prj, err = r.getProject(ctx, tx, inode); err != nil {
+				return err
+			}
+		}
+		if added > 0 && (r.checkQuota(ctx, added) || r.checkProjectQuota(ctx, prj, added, 0)) {
+			return syscall.ENOSPC
+		}
+		now := time.Now()
+		attr.Mtime = now.Unix()
+		attr.Mtimensec = uint32(now.Nanosecond())
+		attr.Ctime = now.Unix()
+		attr.Ctimensec = uint32(now.Nanosecond())
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, r.inlineKey(inode), data, 0)
+			pipe.Set(ctx, r.inodeKey(inode), marshalAttr(&attr), 0)
+			if added > 0 {
+				pipe.IncrBy(ctx, r.prefix+usedSpace, added)
+				r.updateUsage(ctx, pipe, attr.Uid, attr.Gid, prj, added, 0)
+			}
+			return nil
+		})
+		return err
+	}, r.inodeKey(inode), r.inlineKey(inode))
+}
+
 func (r *redisMeta) CopyFileRange(ctx Context, fin Ino, offIn uint64, fout Ino, offOut uint64, size uint64, flags uint32, copied *uint64) syscall.Errno {
+	if r.readOnly {
+		return syscall.EROFS
+	}
 	return r.txn(ctx, func(tx *redis.Tx) error {
 		rs, err := tx.MGet(ctx, r.inodeKey(fin), r.inodeKey(fout)).Result()
 		if err != nil {
@@ -1676,7 +3373,7 @@ func (r *redisMeta) CopyFileRange(ctx Context, fin Ino, offIn uint64, fout Ino,
 			return redis.Nil
 		}
 		var sattr Attr
-		r.parseAttr([]byte(rs[0].(string)), &sattr)
+		parseAttr([]byte(rs[0].(string)), &sattr)
 		if sattr.Typ != TypeFile {
 			return syscall.EINVAL
 		}
@@ -1688,10 +3385,22 @@ func (r *redisMeta) CopyFileRange(ctx Context, fin Ino, offIn uint64, fout Ino,
 			size = sattr.Length - offIn
 		}
 		var attr Attr
-		r.parseAttr([]byte(rs[1].(string)), &attr)
+		parseAttr([]byte(rs[1].(string)), &attr)
 		if attr.Typ != TypeFile {
 			return syscall.EINVAL
 		}
+		if attr.Flags&FlagReadOnly != 0 {
+			return syscall.EPERM
+		}
+		if err := r.checkRetained(ctx, tx, fout, &attr, true); err != nil {
+			return err
+		}
+		if n, err := tx.Exists(ctx, r.inlineKey(fin), r.inlineKey(fout)).Result(); err != nil {
+			return err
+		} else if n > 0 {
+			// the data of small files are stored in meta, let the caller copy them
+			return syscall.ENOTSUP
+		}
 
 		newleng := offOut + size
 		var added int64
@@ -1699,6 +3408,15 @@ func (r *redisMeta) CopyFileRange(ctx Context, fin Ino, offIn uint64, fout Ino,
 			added = align4K(newleng) - align4K(attr.Length)
 			attr.Length = newleng
 		}
+		var prj uint32
+		if added > 0 {
+			if prj, err = r.getProject(ctx, tx, fout); err != nil {
+				return err
+			}
+		}
+		if added > 0 && (r.checkQuota(ctx, added) || r.checkProjectQuota(ctx, prj, added, 0)) {
+			return syscall.ENOSPC
+		}
 		now := time.Now()
 		attr.Mtime = now.Unix()
 		attr.Mtimensec = uint32(now.Nanosecond())
@@ -1760,9 +3478,10 @@ func (r *redisMeta) CopyFileRange(ctx Context, fin Ino, offIn uint64, fout Ino,
 				}
 				coff += ChunkSize
 			}
-			pipe.Set(ctx, r.inodeKey(fout), r.marshal(&attr), 0)
+			pipe.Set(ctx, r.inodeKey(fout), marshalAttr(&attr), 0)
 			if added > 0 {
-				pipe.IncrBy(ctx, usedSpace, added)
+				pipe.IncrBy(ctx, r.prefix+usedSpace, added)
+				r.updateUsage(ctx, pipe, attr.Uid, attr.Gid, prj, added, 0)
 			}
 			return nil
 		})
@@ -1770,14 +3489,17 @@ func (r *redisMeta) CopyFileRange(ctx Context, fin Ino, offIn uint64, fout Ino,
 			*copied = size
 		}
 		return err
-	}, r.inodeKey(fout), r.inodeKey(fin))
+	}, r.inodeKey(fout), r.inodeKey(fin), r.inlineKey(fin), r.inlineKey(fout))
 }
 
 func (r *redisMeta) cleanupDeletedFiles() {
 	for {
 		time.Sleep(time.Minute)
-		now := time.Now()
-		members, _ := r.rdb.ZRangeByScore(Background, delfiles, &redis.ZRangeBy{Min: strconv.Itoa(0), Max: strconv.Itoa(int(now.Add(time.Hour).Unix())), Count: 1000}).Result()
+		if !jobs.IsLeader() {
+			continue
+		}
+		now := time.Now()
+		members, _ := r.rdb.ZRangeByScore(Background, r.prefix+delfiles, &redis.ZRangeBy{Min: strconv.Itoa(0), Max: strconv.Itoa(int(now.Add(time.Hour).Unix())), Count: 1000}).Result()
 		for _, member := range members {
 			ps := strings.Split(member, ":")
 			inode, _ := strconv.ParseInt(ps[0], 10, 0)
@@ -1796,12 +3518,13 @@ func (r *redisMeta) cleanupDeletedFiles() {
 func (r *redisMeta) cleanupSlices() {
 	for {
 		time.Sleep(time.Hour)
+		jobs.Start(jobs.Cleanup)
 		var ctx = Background
 		var ckeys []string
 		var cursor uint64
 		var err error
 		for {
-			ckeys, cursor, err = r.rdb.Scan(ctx, cursor, "k*", 1000).Result()
+			ckeys, cursor, err = r.rdb.Scan(ctx, cursor, r.prefix+"k*", 1000).Result()
 			if err != nil {
 				logger.Errorf("scan slices: %s", err)
 				break
@@ -1819,7 +3542,7 @@ func (r *redisMeta) cleanupSlices() {
 					continue
 				}
 				if strings.HasPrefix(v.(string), "-") { // < 0
-					ps := strings.Split(ckeys[i], "_")
+					ps := strings.Split(ckeys[i][len(r.prefix):], "_")
 					if len(ps) == 2 {
 						chunkid, _ := strconv.Atoi(ps[0][1:])
 						size, _ := strconv.Atoi(ps[1])
@@ -1834,17 +3557,20 @@ func (r *redisMeta) cleanupSlices() {
 				break
 			}
 		}
+		jobs.Done(jobs.Cleanup)
 	}
 }
 
 func (r *redisMeta) cleanupLeakedChunks() {
 	time.Sleep(time.Second * 10)
+	jobs.Start(jobs.Cleanup)
+	defer jobs.Done(jobs.Cleanup)
 	var ctx = Background
 	var ckeys []string
 	var cursor uint64
 	var err error
 	for {
-		ckeys, cursor, err = r.rdb.Scan(ctx, cursor, "c*", 1000).Result()
+		ckeys, cursor, err = r.rdb.Scan(ctx, cursor, r.prefix+"c*", 1000).Result()
 		if err != nil {
 			logger.Errorf("scan all chunks: %s", err)
 			break
@@ -1853,16 +3579,18 @@ func (r *redisMeta) cleanupLeakedChunks() {
 		var rs []*redis.IntCmd
 		p := r.rdb.Pipeline()
 		for _, k := range ckeys {
-			ps := strings.Split(k, "_")
-			if len(ps) != 2 {
+			ino, _, ok := r.parseChunkKey(k)
+			if !ok {
 				continue
 			}
-			ino, _ := strconv.ParseInt(ps[0][1:], 10, 0)
 			ikeys = append(ikeys, k)
-			rs = append(rs, p.Exists(ctx, r.inodeKey(Ino(ino))))
+			rs = append(rs, p.Exists(ctx, r.inodeKey(ino)))
 		}
 		if len(rs) == 0 {
-			break
+			if cursor == 0 {
+				break
+			}
+			continue
 		}
 		_, err = p.Exec(ctx)
 		if err != nil {
@@ -1873,10 +3601,8 @@ func (r *redisMeta) cleanupLeakedChunks() {
 			if rr.Val() == 0 {
 				key := ikeys[i]
 				logger.Debugf("found leaked chunk %s", key)
-				ps := strings.Split(key, "_")
-				ino, _ := strconv.ParseInt(ps[0][1:], 10, 0)
-				indx, _ := strconv.Atoi(ps[1])
-				_ = r.deleteChunk(Ino(ino), uint32(indx))
+				ino, indx, _ := r.parseChunkKey(key)
+				_ = r.deleteChunk(ino, indx)
 			}
 		}
 		if cursor == 0 {
@@ -1940,7 +3666,15 @@ func (r *redisMeta) deleteChunk(inode Ino, indx uint32) error {
 }
 
 func (r *redisMeta) deleteFile(inode Ino, length uint64, tracking string) {
+	if !jobs.TryStart(jobs.Deletion) {
+		return // it will be retried by cleanupDeletedFiles
+	}
+	defer jobs.Done(jobs.Deletion)
 	var ctx = Background
+	if err := r.rdb.Del(ctx, r.inlineKey(inode)).Err(); err != nil {
+		logger.Warnf("delete inline data of inode %d: %s", inode, err)
+		return
+	}
 	var indx uint32
 	p := r.rdb.Pipeline()
 	for uint64(indx)*ChunkSize < length {
@@ -1972,14 +3706,16 @@ func (r *redisMeta) deleteFile(inode Ino, length uint64, tracking string) {
 	if tracking == "" {
 		tracking = inode.String() + ":" + strconv.FormatInt(int64(length), 10)
 	}
-	_ = r.rdb.ZRem(ctx, delfiles, tracking)
+	_ = r.rdb.ZRem(ctx, r.prefix+delfiles, tracking)
 }
 
-func (r *redisMeta) compactChunk(inode Ino, indx uint32) {
+// compactChunk merges the slices of a chunk into a new one, the large slices at the beginning
+// are kept unless force is true, which is used by defrag to rewrite all of them.
+func (r *redisMeta) compactChunk(inode Ino, indx uint32, force bool) {
 	// avoid too many or duplicated compaction
 	r.Lock()
 	k := uint64(inode) + (uint64(indx) << 32)
-	if len(r.compacting) > 10 || r.compacting[k] {
+	if r.compacting[k] || !force && !jobs.TryStart(jobs.Compaction) {
 		r.Unlock()
 		return
 	}
@@ -1989,6 +3725,9 @@ func (r *redisMeta) compactChunk(inode Ino, indx uint32) {
 		r.Lock()
 		delete(r.compacting, k)
 		r.Unlock()
+		if !force {
+			jobs.Done(jobs.Compaction)
+		}
 	}()
 
 	var ctx = Background
@@ -1996,7 +3735,7 @@ func (r *redisMeta) compactChunk(inode Ino, indx uint32) {
 	if err != nil {
 		return
 	}
-	chunkid, err := r.rdb.Incr(ctx, "nextchunk").Uint64()
+	chunkid, err := r.rdb.Incr(ctx, r.prefix+"nextchunk").Uint64()
 	if err != nil {
 		return
 	}
@@ -2018,6 +3757,9 @@ func (r *redisMeta) compactChunk(inode Ino, indx uint32) {
 		for _, s := range chunks {
 			size += s.Len
 		}
+		if force {
+			break
+		}
 		first := ss[0]
 		if first.len < (1<<20) || first.len*5 < size {
 			// it's too small
@@ -2032,9 +3774,10 @@ func (r *redisMeta) compactChunk(inode Ino, indx uint32) {
 		}
 		skipped++
 	}
-	if len(ss) == 0 {
-		return
+	if len(ss) == 0 || skipped == len(vals) {
+		return // all the slices are large enough
 	}
+	chunkid |= ss[len(ss)-1].chunkid & ChunkHints
 
 	logger.Debugf("compact %d %d %d %d %d", inode, indx, pos, len(ss), len(chunks))
 	err = r.newMsg(CompactChunk, chunks, chunkid)
@@ -2095,7 +3838,7 @@ func (r *redisMeta) compactChunk(inode Ino, indx uint32) {
 			go func() {
 				// wait for the current compaction to finish
 				time.Sleep(time.Millisecond * 10)
-				r.compactChunk(inode, indx)
+				r.compactChunk(inode, indx, false)
 			}()
 		}
 	} else {
@@ -2103,18 +3846,245 @@ func (r *redisMeta) compactChunk(inode Ino, indx uint32) {
 	}
 }
 
+// scanChunks calls fn for the chunks which have at least minSlices slices.
+func (r *redisMeta) scanChunks(ctx Context, minSlices int, fn func(inode Ino, indx uint32)) syscall.Errno {
+	var cursor uint64
+	p := r.rdb.Pipeline()
+	for {
+		keys, c, err := r.rdb.Scan(ctx, cursor, r.prefix+"c*_*", 10000).Result()
+		if err != nil {
+			logger.Warnf("scan chunks: %s", err)
+			return errno(err)
+		}
+		var chunks []string
+		for _, key := range keys {
+			if _, _, ok := r.parseChunkKey(key); ok {
+				chunks = append(chunks, key)
+				_ = p.LLen(ctx, key)
+			}
+		}
+		cmds, err := p.Exec(ctx)
+		if err != nil {
+			logger.Warnf("count slices: %s", err)
+			return errno(err)
+		}
+		for i, cmd := range cmds {
+			if cmd.(*redis.IntCmd).Val() < int64(minSlices) {
+				continue
+			}
+			inode, indx, _ := r.parseChunkKey(chunks[i])
+			fn(inode, indx)
+		}
+		if c == 0 {
+			break
+		}
+		cursor = c
+	}
+	return 0
+}
+
+func (r *redisMeta) CompactAll(ctx Context, minSlices int) syscall.Errno {
+	return r.scanChunks(ctx, minSlices, func(inode Ino, indx uint32) {
+		r.compactChunk(inode, indx, false)
+	})
+}
+
+func (r *redisMeta) Defrag(ctx Context, minSlices int, age time.Duration, count *uint64) syscall.Errno {
+	if minSlices < 2 {
+		minSlices = 2
+	}
+	deadline := time.Now().Add(-age).Unix()
+	var attr Attr
+	var last Ino
+	return r.scanChunks(ctx, minSlices, func(inode Ino, indx uint32) {
+		if inode != last {
+			last = inode
+			a, err := r.rdb.Get(ctx, r.inodeKey(inode)).Bytes()
+			if err != nil {
+				attr = Attr{}
+				return
+			}
+			parseAttr(a, &attr)
+		}
+		if attr.Typ != TypeFile || attr.Mtime > deadline {
+			return // removed or still being written
+		}
+		r.compactChunk(inode, indx, true)
+		*count++
+	})
+}
+
+// shrinkChunk rewrites the list of a chunk without the hidden slices, the refs of them are decreased.
+func (r *redisMeta) shrinkChunk(ctx Context, inode Ino, indx uint32, stats *ShrinkStats) syscall.Errno {
+	key := r.chunkKey(inode, indx)
+	var dropped int
+	st := r.txn(ctx, func(tx *redis.Tx) error {
+		vals, err := tx.LRange(ctx, key, 0, -1).Result()
+		if err != nil {
+			return err
+		}
+		hidden := hiddenSlices(vals)
+		dropped = len(hidden)
+		if dropped == 0 {
+			return nil
+		}
+		ss := readSlices(vals)
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			kept := make([]interface{}, 0, len(vals)-len(hidden))
+			for i, val := range vals {
+				if len(hidden) > 0 && hidden[0] == i {
+					hidden = hidden[1:]
+					pipe.Decr(ctx, r.sliceKey(ss[i].chunkid, ss[i].size))
+				} else {
+					kept = append(kept, val)
+				}
+			}
+			// a new list is more compact than the trimmed one
+			pipe.Del(ctx, key)
+			pipe.RPush(ctx, key, kept...)
+			return nil
+		})
+		return err
+	}, key)
+	if st == 0 && dropped > 0 {
+		stats.Chunks++
+		stats.Slices += uint64(dropped)
+	}
+	return st
+}
+
+// hashEntries returns the max number of entries in a hash which is encoded as ziplist (or listpack).
+func (r *redisMeta) hashEntries(ctx Context) int64 {
+	for _, name := range []string{"hash-max-listpack-entries", "hash-max-ziplist-entries"} {
+		vals, err := r.rdb.ConfigGet(ctx, name).Result()
+		if err == nil && len(vals) == 2 {
+			if n, err := strconv.ParseInt(fmt.Sprint(vals[1]), 10, 64); err == nil {
+				return n
+			}
+		}
+	}
+	logger.Warnf("the encoding of hashes is not changed: can't get hash-max-ziplist-entries")
+	return 0
+}
+
+// shrinkHash rewrites a hash which is small enough to be encoded as ziplist, but is kept as
+// hashtable after the entries are removed.
+func (r *redisMeta) shrinkHash(ctx Context, key string, maxEntries int64, stats *ShrinkStats) syscall.Errno {
+	if n, err := r.rdb.HLen(ctx, key).Result(); err != nil || n == 0 || n > maxEntries {
+		return errno(err)
+	}
+	if enc, err := r.rdb.ObjectEncoding(ctx, key).Result(); err != nil || enc != "hashtable" {
+		return errno(err)
+	}
+	st := r.txn(ctx, func(tx *redis.Tx) error {
+		fields, err := tx.HGetAll(ctx, key).Result()
+		if err != nil || len(fields) == 0 {
+			return err
+		}
+		values := make([]interface{}, 0, len(fields)*2)
+		for k, v := range fields {
+			values = append(values, k, v)
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Del(ctx, key)
+			pipe.HSet(ctx, key, values...)
+			return nil
+		})
+		return err
+	}, key)
+	if st == 0 {
+		stats.Hashes++
+	}
+	return st
+}
+
+// shrinkKeys removes the keys of the nodes which don't exist, and rewrites the small hashes.
+func (r *redisMeta) shrinkKeys(ctx Context, stats *ShrinkStats) syscall.Errno {
+	maxEntries := r.hashEntries(ctx)
+	for _, prefix := range []string{"d", "x", "t", "deleg"} {
+		var cursor uint64
+		for {
+			keys, c, err := r.rdb.Scan(ctx, cursor, r.prefix+prefix+"[0-9]*", 10000).Result()
+			if err != nil {
+				logger.Warnf("scan %s*: %s", prefix, err)
+				return errno(err)
+			}
+			var inodes []Ino
+			var exists []*redis.IntCmd
+			_, err = r.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+				for _, key := range keys {
+					inode, _ := strconv.ParseUint(key[len(r.prefix)+len(prefix):], 10, 64)
+					inodes = append(inodes, Ino(inode))
+					exists = append(exists, pipe.Exists(ctx, r.inodeKey(Ino(inode))))
+				}
+				return nil
+			})
+			if err != nil {
+				logger.Warnf("check nodes: %s", err)
+				return errno(err)
+			}
+			for i, key := range keys {
+				if inodes[i] == 0 {
+					continue // not a key of node
+				}
+				if exists[i].Val() == 0 {
+					// the inodes are never reused, so it can't be created again
+					if err = r.rdb.Del(ctx, key).Err(); err != nil {
+						return errno(err)
+					}
+					logger.Debugf("remove orphan key %s", key)
+					stats.Orphans++
+				} else if maxEntries > 0 && prefix != "deleg" {
+					if st := r.shrinkHash(ctx, key, maxEntries, stats); st != 0 {
+						logger.Warnf("shrink %s: %s", key, st)
+					}
+				}
+			}
+			if c == 0 {
+				break
+			}
+			cursor = c
+		}
+	}
+	return 0
+}
+
+func (r *redisMeta) Shrink(ctx Context, minSlices int, stats *ShrinkStats) syscall.Errno {
+	if r.readOnly {
+		return syscall.EROFS
+	}
+	if minSlices < 2 {
+		minSlices = 2
+	}
+	var st syscall.Errno
+	if e := r.scanChunks(ctx, minSlices, func(inode Ino, indx uint32) {
+		if e := r.shrinkChunk(ctx, inode, indx, stats); e != 0 && st == 0 {
+			logger.Warnf("shrink chunk %d_%d: %s", inode, indx, e)
+			st = e
+		}
+	}); e != 0 {
+		return e
+	}
+	if st != 0 {
+		return st
+	}
+	return r.shrinkKeys(ctx, stats)
+}
+
 func (r *redisMeta) ListSlices(ctx Context, slices *[]Slice) syscall.Errno {
 	*slices = nil
 	var cursor uint64
 	p := r.rdb.Pipeline()
 	for {
-		keys, c, err := r.rdb.Scan(ctx, cursor, "c*_*", 10000).Result()
+		keys, c, err := r.rdb.Scan(ctx, cursor, r.prefix+"c*_*", 10000).Result()
 		if err != nil {
 			logger.Warnf("scan chunks: %s", err)
 			return errno(err)
 		}
 		for _, key := range keys {
-			_ = p.LRange(ctx, key, 0, 100000000)
+			if _, _, ok := r.parseChunkKey(key); ok {
+				_ = p.LRange(ctx, key, 0, 100000000)
+			}
 		}
 		cmds, err := p.Exec(ctx)
 		if err != nil {
@@ -2138,6 +4108,494 @@ func (r *redisMeta) ListSlices(ctx Context, slices *[]Slice) syscall.Errno {
 	return 0
 }
 
+func (r *redisMeta) ListDeleted(ctx Context, withSlices bool, backlog *Backlog) syscall.Errno {
+	*backlog = Backlog{}
+	members, err := r.rdb.ZRange(ctx, r.prefix+delfiles, 0, -1).Result()
+	if err != nil {
+		return errno(err)
+	}
+	for _, member := range members {
+		ps := strings.Split(member, ":")
+		inode, _ := strconv.ParseInt(ps[0], 10, 0)
+		var length int64 = 1 << 30
+		if len(ps) == 2 {
+			length, _ = strconv.ParseInt(ps[1], 10, 0)
+		} else if len(ps) > 2 {
+			length, _ = strconv.ParseInt(ps[2], 10, 0)
+		}
+		backlog.Files = append(backlog.Files, DeletedFile{Inode: Ino(inode), Length: uint64(length)})
+	}
+	sids, err := r.rdb.ZRange(ctx, r.prefix+allSessions, 0, -1).Result()
+	if err != nil {
+		return errno(err)
+	}
+	for _, ssid := range sids {
+		sid, _ := strconv.ParseInt(ssid, 10, 64)
+		inodes, err := r.rdb.SMembers(ctx, r.sessionKey(sid)).Result()
+		if err != nil {
+			return errno(err)
+		}
+		for _, sinode := range inodes {
+			inode, _ := strconv.ParseUint(sinode, 10, 64)
+			a, err := r.rdb.Get(ctx, r.inodeKey(Ino(inode))).Bytes()
+			if err == redis.Nil {
+				continue
+			} else if err != nil {
+				return errno(err)
+			}
+			var attr Attr
+			parseAttr(a, &attr)
+			backlog.Files = append(backlog.Files, DeletedFile{Inode: Ino(inode), Length: attr.Length, Opened: true})
+		}
+	}
+	if withSlices {
+		p := r.rdb.Pipeline()
+		for i := range backlog.Files {
+			f := &backlog.Files[i]
+			if f.Length == 0 {
+				continue
+			}
+			for indx := uint32(0); uint64(indx)*ChunkSize < f.Length; indx++ {
+				_ = p.LRange(ctx, r.chunkKey(f.Inode, indx), 0, 100000000)
+			}
+			cmds, err := p.Exec(ctx)
+			if err != nil {
+				return errno(err)
+			}
+			for _, cmd := range cmds {
+				for _, s := range readSlices(cmd.(*redis.StringSliceCmd).Val()) {
+					if s.chunkid > 0 {
+						f.Slices = append(f.Slices, Slice{Chunkid: s.chunkid, Size: s.size})
+					}
+				}
+			}
+		}
+	}
+	var cursor uint64
+	for {
+		keys, c, err := r.rdb.Scan(ctx, cursor, r.prefix+"k*", 10000).Result()
+		if err != nil {
+			return errno(err)
+		}
+		if len(keys) > 0 {
+			values, err := r.rdb.MGet(ctx, keys...).Result()
+			if err != nil {
+				return errno(err)
+			}
+			for i, v := range values {
+				if v == nil || !strings.HasPrefix(v.(string), "-") { // < 0
+					continue
+				}
+				ps := strings.Split(keys[i][len(r.prefix):], "_")
+				if len(ps) == 2 {
+					chunkid, _ := strconv.ParseUint(ps[0][1:], 10, 64)
+					size, _ := strconv.ParseUint(ps[1], 10, 32)
+					if chunkid > 0 && size > 0 {
+						backlog.Released = append(backlog.Released, Slice{Chunkid: chunkid, Size: uint32(size)})
+					}
+				}
+			}
+		}
+		if c == 0 {
+			break
+		}
+		cursor = c
+	}
+	return 0
+}
+
+func (r *redisMeta) AddPack(pack uint64, chunks []uint64, offsets []uint32) error {
+	if len(offsets) != len(chunks)+1 {
+		return fmt.Errorf("invalid offsets of pack %d: %d != %d", pack, len(offsets), len(chunks)+1)
+	}
+	ctx := Background
+	_, err := r.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, id := range chunks {
+			w := utils.NewBuffer(16)
+			w.Put64(pack)
+			w.Put32(offsets[i])
+			w.Put32(offsets[i+1] - offsets[i])
+			pipe.HSet(ctx, r.prefix+packedBlocks, strconv.FormatUint(id, 10), w.Bytes())
+		}
+		pipe.HIncrBy(ctx, r.prefix+packRefs, strconv.FormatUint(pack, 10), int64(len(chunks)))
+		return nil
+	})
+	return err
+}
+
+func (r *redisMeta) LookupPack(chunkid uint64) (pack uint64, off, size uint32, err error) {
+	buf, err := r.rdb.HGet(Background, r.prefix+packedBlocks, strconv.FormatUint(chunkid, 10)).Bytes()
+	if err == redis.Nil {
+		return 0, 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	if len(buf) != 16 {
+		return 0, 0, 0, fmt.Errorf("invalid packed block %d: %v", chunkid, buf)
+	}
+	rb := utils.ReadBuffer(buf)
+	return rb.Get64(), rb.Get32(), rb.Get32(), nil
+}
+
+func (r *redisMeta) RemovePack(chunkid uint64) (pack uint64, left int64, err error) {
+	ctx := Background
+	field := strconv.FormatUint(chunkid, 10)
+	st := r.txn(ctx, func(tx *redis.Tx) error {
+		buf, err := tx.HGet(ctx, r.prefix+packedBlocks, field).Bytes()
+		if err == redis.Nil {
+			pack = 0
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if len(buf) != 16 {
+			return fmt.Errorf("invalid packed block %d: %v", chunkid, buf)
+		}
+		pack = utils.ReadBuffer(buf).Get64()
+		var cmd *redis.IntCmd
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.HDel(ctx, r.prefix+packedBlocks, field)
+			cmd = pipe.HIncrBy(ctx, r.prefix+packRefs, strconv.FormatUint(pack, 10), -1)
+			return nil
+		})
+		if err == nil {
+			left = cmd.Val()
+		}
+		return err
+	}, r.prefix+packedBlocks)
+	if st != 0 {
+		return 0, 0, st
+	}
+	if pack > 0 && left <= 0 {
+		r.rdb.HDel(ctx, r.prefix+packRefs, strconv.FormatUint(pack, 10))
+	}
+	return pack, left, nil
+}
+
+// dedupBlocksKey is the hash of the deduplicated blocks in a chunk, kept next to its slices.
+func (r *redisMeta) dedupBlocksKey(chunkid uint64) string {
+	return r.prefix + "b" + strconv.FormatUint(chunkid, 10)
+}
+
+// dedupKey is the object holding the blocks with the same hash, the hash has no ':', so it
+// can't be mixed up with the keys of other prefixes.
+func (r *redisMeta) dedupKey(hash string) string {
+	return r.prefix + "dedup" + hash
+}
+
+// packDedupObject encodes the number of blocks in an object and its key.
+func packDedupObject(refs uint64, key string) []byte {
+	w := utils.NewBuffer(8 + uint32(len(key)))
+	w.Put64(refs)
+	w.Put([]byte(key))
+	return w.Bytes()
+}
+
+func parseDedupObject(buf []byte) (uint64, string) {
+	if len(buf) <= 8 {
+		return 0, ""
+	}
+	rb := utils.ReadBuffer(buf)
+	refs := rb.Get64()
+	return refs, string(rb.Get(rb.Left()))
+}
+
+// packDedupBlock encodes the hash of a block and the key of the object holding it, which
+// never changes until the block is removed, so it can be looked up in one request.
+func packDedupBlock(hash, key string) []byte {
+	w := utils.NewBuffer(1 + uint32(len(hash)) + uint32(len(key)))
+	w.Put8(uint8(len(hash)))
+	w.Put([]byte(hash))
+	w.Put([]byte(key))
+	return w.Bytes()
+}
+
+func parseDedupBlock(buf []byte) (hash, key string) {
+	if len(buf) < 1 || len(buf) < 1+int(buf[0]) {
+		return "", ""
+	}
+	rb := utils.ReadBuffer(buf)
+	hash = string(rb.Get(int(rb.Get8())))
+	return hash, string(rb.Get(rb.Left()))
+}
+
+func (r *redisMeta) AddDedup(hash string, chunkid uint64, indx int, key string) (string, error) {
+	ctx := Background
+	hkey, bkey, field := r.dedupKey(hash), r.dedupBlocksKey(chunkid), strconv.Itoa(indx)
+	var owner string
+	st := r.txn(ctx, func(tx *redis.Tx) error {
+		buf, err := tx.Get(ctx, hkey).Bytes()
+		if err != nil && err != redis.Nil {
+			return err
+		}
+		var refs uint64
+		refs, owner = parseDedupObject(buf)
+		if owner == "" {
+			if key == "" {
+				return nil
+			}
+			owner = key
+		}
+		existed, err := tx.HExists(ctx, bkey, field).Result()
+		if err != nil {
+			return err
+		}
+		if !existed {
+			refs++
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.HSet(ctx, bkey, field, packDedupBlock(hash, owner))
+			pipe.Set(ctx, hkey, packDedupObject(refs, owner), 0)
+			return nil
+		})
+		return err
+	}, hkey, bkey)
+	if st != 0 {
+		return "", st
+	}
+	return owner, nil
+}
+
+func (r *redisMeta) LookupDedup(chunkid uint64, indx int) (string, error) {
+	buf, err := r.rdb.HGet(Background, r.dedupBlocksKey(chunkid), strconv.Itoa(indx)).Bytes()
+	if err == redis.Nil {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	_, key := parseDedupBlock(buf)
+	return key, nil
+}
+
+func (r *redisMeta) DedupRefs(chunkid uint64, indx int) (string, int64, error) {
+	ctx := Background
+	buf, err := r.rdb.HGet(ctx, r.dedupBlocksKey(chunkid), strconv.Itoa(indx)).Bytes()
+	if err == redis.Nil {
+		return "", 0, nil
+	}
+	if err != nil {
+		return "", 0, err
+	}
+	hash, _ := parseDedupBlock(buf)
+	buf, err = r.rdb.Get(ctx, r.dedupKey(hash)).Bytes()
+	if err == redis.Nil {
+		return "", 0, nil
+	}
+	if err != nil {
+		return "", 0, err
+	}
+	refs, key := parseDedupObject(buf)
+	return key, int64(refs), nil
+}
+
+func (r *redisMeta) RemoveDedup(chunkid uint64, indx int) (key string, left int64, err error) {
+	ctx := Background
+	bkey, field := r.dedupBlocksKey(chunkid), strconv.Itoa(indx)
+	st := r.txn(ctx, func(tx *redis.Tx) error {
+		key, left = "", 0
+		buf, err := tx.HGet(ctx, bkey, field).Bytes()
+		if err == redis.Nil {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		hash, _ := parseDedupBlock(buf)
+		hkey := r.dedupKey(hash)
+		if err = tx.Watch(ctx, hkey).Err(); err != nil {
+			return err
+		}
+		buf, err = tx.Get(ctx, hkey).Bytes()
+		if err != nil && err != redis.Nil {
+			return err
+		}
+		var refs uint64
+		refs, key = parseDedupObject(buf)
+		left = int64(refs) - 1
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.HDel(ctx, bkey, field)
+			if left > 0 {
+				pipe.Set(ctx, hkey, packDedupObject(uint64(left), key), 0)
+			} else {
+				pipe.Del(ctx, hkey)
+			}
+			return nil
+		})
+		return err
+	}, bkey)
+	if st != 0 {
+		return "", 0, st
+	}
+	return key, left, nil
+}
+
+func (r *redisMeta) ListDedup() (map[string]int64, error) {
+	ctx := Background
+	objs := make(map[string]int64)
+	var cursor uint64
+	for {
+		keys, c, err := r.rdb.Scan(ctx, cursor, r.prefix+"dedup*", 10000).Result()
+		if err != nil {
+			return nil, err
+		}
+		var hkeys []string
+		for _, k := range keys {
+			if !strings.Contains(k[len(r.prefix):], ":") {
+				hkeys = append(hkeys, k)
+			}
+		}
+		if len(hkeys) > 0 {
+			vals, err := r.rdb.MGet(ctx, hkeys...).Result()
+			if err != nil {
+				return nil, err
+			}
+			for _, v := range vals {
+				if s, ok := v.(string); ok {
+					if refs, key := parseDedupObject([]byte(s)); key != "" {
+						objs[key] = int64(refs)
+					}
+				}
+			}
+		}
+		if c == 0 {
+			return objs, nil
+		}
+		cursor = c
+	}
+}
+
+func (r *redisMeta) AddReplication(op string) error {
+	return r.rdb.ZAdd(Background, r.prefix+replicationQueue, &redis.Z{Score: float64(time.Now().Unix()), Member: op}).Err()
+}
+
+func (r *redisMeta) ClaimReplications(limit int, lease time.Duration) ([]string, error) {
+	ctx := Background
+	ops, err := r.rdb.ZRange(ctx, r.prefix+replicationQueue, 0, int64(limit)*4).Result()
+	if err != nil || len(ops) == 0 {
+		return nil, err
+	}
+	leases, err := r.rdb.HMGet(ctx, r.prefix+replicationLeases, ops...).Result()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	var claimed []string
+	var values []interface{}
+	for i, op := range ops {
+		if leases[i] != nil {
+			expire, _ := strconv.ParseInt(leases[i].(string), 10, 64)
+			if now.Unix() < expire {
+				continue
+			}
+		}
+		claimed = append(claimed, op)
+		values = append(values, op, now.Add(lease).Unix())
+		if len(claimed) >= limit {
+			break
+		}
+	}
+	if len(claimed) > 0 {
+		// the operations are idempotent, it's fine that they are claimed by multiple clients
+		if err = r.rdb.HSet(ctx, r.prefix+replicationLeases, values...).Err(); err != nil {
+			return nil, err
+		}
+	}
+	return claimed, nil
+}
+
+func (r *redisMeta) DoneReplication(op string) error {
+	ctx := Background
+	_, err := r.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZRem(ctx, r.prefix+replicationQueue, op)
+		pipe.HDel(ctx, r.prefix+replicationLeases, op)
+		return nil
+	})
+	return err
+}
+
+func (r *redisMeta) ReplicationLag() (int64, time.Time, error) {
+	ctx := Background
+	var card *redis.IntCmd
+	var first *redis.ZSliceCmd
+	_, err := r.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		card = pipe.ZCard(ctx, r.prefix+replicationQueue)
+		first = pipe.ZRangeWithScores(ctx, r.prefix+replicationQueue, 0, 0)
+		return nil
+	})
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	var oldest time.Time
+	if zs := first.Val(); len(zs) > 0 {
+		oldest = time.Unix(int64(zs[0].Score), 0)
+	}
+	return card.Val(), oldest, nil
+}
+
+func (r *redisMeta) AddExternal(chunkid uint64, key string, off uint64) error {
+	w := utils.NewBuffer(8 + uint32(len(key)))
+	w.Put64(off)
+	w.Put([]byte(key))
+	return r.rdb.HSet(Background, r.prefix+externalChunks, strconv.FormatUint(chunkid, 10), w.Bytes()).Err()
+}
+
+func (r *redisMeta) LookupExternal(chunkid uint64) (key string, off uint64, err error) {
+	buf, err := r.rdb.HGet(Background, r.prefix+externalChunks, strconv.FormatUint(chunkid, 10)).Bytes()
+	if err == redis.Nil {
+		return "", 0, nil
+	}
+	if err != nil {
+		return "", 0, err
+	}
+	if len(buf) <= 8 {
+		return "", 0, fmt.Errorf("invalid external chunk %d: %v", chunkid, buf)
+	}
+	rb := utils.ReadBuffer(buf)
+	off = rb.Get64()
+	return string(rb.Get(rb.Left())), off, nil
+}
+
+func (r *redisMeta) RemoveExternal(chunkid uint64) error {
+	return r.rdb.HDel(Background, r.prefix+externalChunks, strconv.FormatUint(chunkid, 10)).Err()
+}
+
+func (r *redisMeta) SetGatewayUser(accessKey string, value []byte) error {
+	if value == nil {
+		return r.rdb.HDel(Background, r.prefix+gatewayUsers, accessKey).Err()
+	}
+	return r.rdb.HSet(Background, r.prefix+gatewayUsers, accessKey, value).Err()
+}
+
+func (r *redisMeta) ListGatewayUsers() (map[string][]byte, error) {
+	vals, err := r.rdb.HGetAll(Background, r.prefix+gatewayUsers).Result()
+	if err != nil {
+		return nil, err
+	}
+	users := make(map[string][]byte, len(vals))
+	for k, v := range vals {
+		users[k] = []byte(v)
+	}
+	return users, nil
+}
+
+func (r *redisMeta) SetCheckpoint(name string, value []byte) error {
+	if value == nil {
+		return r.rdb.HDel(Background, r.prefix+checkpoints, name).Err()
+	}
+	return r.rdb.HSet(Background, r.prefix+checkpoints, name, value).Err()
+}
+
+func (r *redisMeta) GetCheckpoint(name string) ([]byte, error) {
+	value, err := r.rdb.HGet(Background, r.prefix+checkpoints, name).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	return value, err
+}
+
 func (r *redisMeta) GetXattr(ctx Context, inode Ino, name string, vbuff *[]byte) syscall.Errno {
 	var err error
 	*vbuff, err = r.rdb.HGet(ctx, r.xattrKey(inode), name).Bytes()
@@ -2161,11 +4619,29 @@ func (r *redisMeta) ListXattr(ctx Context, inode Ino, names *[]byte) syscall.Err
 }
 
 func (r *redisMeta) SetXattr(ctx Context, inode Ino, name string, value []byte) syscall.Errno {
+	if r.readOnly {
+		return syscall.EROFS
+	}
+	if name == projectXattr {
+		return r.setProject(ctx, inode, value)
+	}
+	if name == RetentionXattr {
+		return r.setRetention(ctx, inode, value)
+	}
 	_, err := r.rdb.HSet(ctx, r.xattrKey(inode), name, value).Result()
 	return errno(err)
 }
 
 func (r *redisMeta) RemoveXattr(ctx Context, inode Ino, name string) syscall.Errno {
+	if r.readOnly {
+		return syscall.EROFS
+	}
+	if name == projectXattr {
+		return r.setProject(ctx, inode, nil)
+	}
+	if name == RetentionXattr {
+		return r.setRetention(ctx, inode, nil)
+	}
 	n, err := r.rdb.HDel(ctx, r.xattrKey(inode), name).Result()
 	if n == 0 {
 		err = ENOATTR
@@ -2173,6 +4649,240 @@ func (r *redisMeta) RemoveXattr(ctx Context, inode Ino, name string) syscall.Err
 	return errno(err)
 }
 
+// setProject changes the project of a node and moves its usage into the new project,
+// the project is removed if value is nil.
+func (r *redisMeta) setProject(ctx Context, inode Ino, value []byte) syscall.Errno {
+	if ctx.Uid() != 0 {
+		return syscall.EPERM
+	}
+	prj, st := parseProject(value)
+	if st != 0 {
+		return st
+	}
+	if prj != 0 {
+		if err := r.enableFeature(ctx, FeatureProjects); err != nil {
+			return errno(err)
+		}
+	}
+	return r.txn(ctx, func(tx *redis.Tx) error {
+		a, err := tx.Get(ctx, r.inodeKey(inode)).Bytes()
+		if err != nil {
+			return err
+		}
+		var attr Attr
+		parseAttr(a, &attr)
+		old, err := r.getProject(ctx, tx, inode)
+		if err != nil {
+			return err
+		}
+		if value == nil && old == 0 {
+			return ENOATTR
+		}
+		var space int64
+		if attr.Typ == TypeFile {
+			space = align4K(attr.Length)
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			if prj == 0 {
+				pipe.HDel(ctx, r.xattrKey(inode), projectXattr)
+			} else {
+				pipe.HSet(ctx, r.xattrKey(inode), projectXattr, strconv.FormatUint(uint64(prj), 10))
+			}
+			if prj != old {
+				r.updateProjectUsage(ctx, pipe, old, -space, -1)
+				r.updateProjectUsage(ctx, pipe, prj, space, 1)
+			}
+			return nil
+		})
+		return err
+	}, r.inodeKey(inode), r.xattrKey(inode))
+}
+
+// setRetention sets the retention of a node, or removes it if value is nil.
+func (r *redisMeta) setRetention(ctx Context, inode Ino, value []byte) syscall.Errno {
+	if value != nil {
+		if err := r.enableFeature(ctx, FeatureRetention); err != nil {
+			return errno(err)
+		}
+	}
+	return r.txn(ctx, func(tx *redis.Tx) error {
+		a, err := tx.Get(ctx, r.inodeKey(inode)).Bytes()
+		if err != nil {
+			return err
+		}
+		var attr Attr
+		parseAttr(a, &attr)
+		old, err := tx.HGet(ctx, r.xattrKey(inode), RetentionXattr).Bytes()
+		if err == redis.Nil {
+			old, err = nil, nil
+		}
+		if err != nil {
+			return err
+		}
+		if value == nil {
+			if old == nil {
+				return ENOATTR
+			}
+			if retentionActive(old) {
+				return syscall.EPERM
+			}
+			attr.Flags &^= FlagRetention
+		} else {
+			var st syscall.Errno
+			if value, st = checkRetention(ctx, attr.Uid, old, value); st != 0 {
+				return st
+			}
+			attr.Flags |= FlagRetention
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, r.inodeKey(inode), marshalAttr(&attr), 0)
+			if value == nil {
+				pipe.HDel(ctx, r.xattrKey(inode), RetentionXattr)
+			} else {
+				pipe.HSet(ctx, r.xattrKey(inode), RetentionXattr, value)
+			}
+			return nil
+		})
+		return err
+	}, r.inodeKey(inode), r.xattrKey(inode))
+}
+
+func (r *redisMeta) SetTag(ctx Context, inode Ino, key, value string) syscall.Errno {
+	if r.readOnly {
+		return syscall.EROFS
+	}
+	if st := checkTag(key, value); st != 0 {
+		return st
+	}
+	return r.txn(ctx, func(tx *redis.Tx) error {
+		if err := tx.Get(ctx, r.inodeKey(inode)).Err(); err != nil {
+			return err
+		}
+		_, err := tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.HSet(ctx, r.tagKey(inode), key, value)
+			pipe.HSet(ctx, r.tagIndexKey(key), inode.String(), value)
+			return nil
+		})
+		return err
+	}, r.inodeKey(inode), r.tagKey(inode))
+}
+
+func (r *redisMeta) GetTags(ctx Context, inode Ino, tags *map[string]string) syscall.Errno {
+	vals, err := r.rdb.HGetAll(ctx, r.tagKey(inode)).Result()
+	if err != nil {
+		return errno(err)
+	}
+	if len(vals) == 0 {
+		if err = r.rdb.Get(ctx, r.inodeKey(inode)).Err(); err != nil {
+			return errno(err)
+		}
+	}
+	*tags = vals
+	return 0
+}
+
+func (r *redisMeta) RemoveTag(ctx Context, inode Ino, key string) syscall.Errno {
+	if r.readOnly {
+		return syscall.EROFS
+	}
+	return r.txn(ctx, func(tx *redis.Tx) error {
+		n, err := tx.HExists(ctx, r.tagKey(inode), key).Result()
+		if err != nil {
+			return err
+		}
+		if !n {
+			return ENOATTR
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.HDel(ctx, r.tagKey(inode), key)
+			pipe.HDel(ctx, r.tagIndexKey(key), inode.String())
+			return nil
+		})
+		return err
+	}, r.inodeKey(inode), r.tagKey(inode))
+}
+
+func (r *redisMeta) SearchTag(ctx Context, key, value string, inodes *[]Ino) syscall.Errno {
+	if st := checkTag(key, value); st != 0 {
+		return st
+	}
+	vals, err := r.rdb.HGetAll(ctx, r.tagIndexKey(key)).Result()
+	if err != nil {
+		return errno(err)
+	}
+	var found []Ino
+	for k, v := range vals {
+		if value != "" && v != value {
+			continue
+		}
+		ino, err := strconv.ParseUint(k, 10, 64)
+		if err != nil {
+			logger.Warnf("invalid inode %q in tag index of %s", k, key)
+			continue
+		}
+		found = append(found, Ino(ino))
+	}
+	// drop the entries of removed nodes
+	cmds, err := r.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, ino := range found {
+			pipe.HExists(ctx, r.tagKey(ino), key)
+		}
+		return nil
+	})
+	if err != nil {
+		return errno(err)
+	}
+	*inodes = found[:0]
+	var stale []string
+	for i, cmd := range cmds {
+		if cmd.(*redis.BoolCmd).Val() {
+			*inodes = append(*inodes, found[i])
+		} else {
+			stale = append(stale, found[i].String())
+		}
+	}
+	if len(stale) > 0 && !r.readOnly {
+		if err = r.rdb.HDel(ctx, r.tagIndexKey(key), stale...).Err(); err != nil {
+			logger.Warnf("clean tag index of %s: %s", key, err)
+		}
+	}
+	sortInodes(*inodes)
+	return 0
+}
+
+func (r *redisMeta) FindNames(ctx Context, pattern string, entries *[]*IndexEntry) syscall.Errno {
+	if !r.indexNames {
+		return syscall.ENOTSUP
+	}
+	if st := checkPattern(pattern); st != 0 {
+		return st
+	}
+	prefix := indexPrefix(pattern)
+	min, max := "-", "+"
+	if len(prefix) > 0 {
+		min = "[" + string(prefix)
+		if next := nextKey(prefix); next != nil {
+			max = "(" + string(next)
+		}
+	}
+	*entries = nil
+	for {
+		members, err := r.rdb.ZRangeByLex(ctx, r.prefix+nameIndex, &redis.ZRangeBy{Min: min, Max: max, Count: 10000}).Result()
+		if err != nil {
+			return errno(err)
+		}
+		buf := make([][]byte, len(members))
+		for i, m := range members {
+			buf[i] = []byte(m)
+		}
+		matchIndex(pattern, buf, entries)
+		if len(members) < 10000 {
+			return 0
+		}
+		min = "(" + members[len(members)-1]
+	}
+}
+
 func (r *redisMeta) checkServerConfig() {
 	rawInfo, err := r.rdb.Info(Background).Result()
 	if err != nil {
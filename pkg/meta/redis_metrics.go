@@ -32,4 +32,6 @@ var (
 func InitMetrics() {
 	prometheus.MustRegister(redisTxDist)
 	prometheus.MustRegister(redisTxRestart)
+	prometheus.MustRegister(chunkSlices)
+	prometheus.MustRegister(chunkOverwritten)
 }
@@ -0,0 +1,266 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package meta
+
+import (
+	"hash/fnv"
+	"math/bits"
+	"strconv"
+	"syscall"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// The entries of a huge directory are sharded across hashes by linear hashing, to avoid the
+// latency spikes of Redis on a single huge key. The number of shards is kept in the field ""
+// of the first shard (d$inode), which is watched by all the transactions changing the entries,
+// so a transaction is retried if the directory is split or merged meanwhile. A shard is split
+// when it has more than maxShardEntries entries, and the last shard is merged back when it's
+// small enough, one at a time, so every name is in exactly one shard.
+//
+// The clients without sharding see only the first shard, so the directories are split only if
+// DirShards is enabled in format, which is recorded as a feature needed to read the volume.
+var maxShardEntries int64 = 10000
+
+const shardField = ""
+
+func (r *redisMeta) shardKey(parent Ino, shard uint32) string {
+	if shard == 0 {
+		return r.entryKey(parent)
+	}
+	return r.entryKey(parent) + "_" + strconv.FormatUint(uint64(shard), 10)
+}
+
+// nameShard returns the shard of a field in a directory with n shards.
+func nameShard(field string, n uint32) uint32 {
+	if n <= 1 {
+		return 0
+	}
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(field))
+	level := uint(bits.Len32(n) - 1)
+	s := h.Sum32() & (1<<level - 1)
+	if s < n-1<<level {
+		s = h.Sum32() & (1<<(level+1) - 1)
+	}
+	return s
+}
+
+func parseShards(val interface{}) uint32 {
+	if s, ok := val.(string); ok {
+		if n, err := strconv.ParseUint(s, 10, 32); err == nil && n > 1 {
+			return uint32(n)
+		}
+	}
+	return 1
+}
+
+// getEntry returns the entry of a name in directory parent, the key of the shard it belongs
+// to and the number of shards, in one round trip if the directory is not sharded. The error is
+// redis.Nil if the name does not exist. The shard is watched if c is a transaction.
+func (r *redisMeta) getEntry(ctx Context, c redis.Cmdable, parent Ino, name string) (string, uint32, []byte, error) {
+	key := r.entryKey(parent)
+	field := r.entryField(name)
+	vals, err := c.HMGet(ctx, key, field, shardField).Result()
+	if err != nil {
+		return key, 1, nil, err
+	}
+	n := parseShards(vals[1])
+	if vals[0] != nil {
+		return key, n, []byte(vals[0].(string)), nil
+	}
+	shard := nameShard(field, n)
+	if shard == 0 {
+		return key, n, nil, redis.Nil
+	}
+	key = r.shardKey(parent, shard)
+	if tx, ok := c.(*redis.Tx); ok {
+		if err = tx.Watch(ctx, key).Err(); err != nil {
+			return key, n, nil, err
+		}
+	}
+	buf, err := c.HGet(ctx, key, field).Bytes()
+	return key, n, buf, err
+}
+
+// isEmptyDir returns true if a directory has no entries.
+func (r *redisMeta) isEmptyDir(ctx Context, tx *redis.Tx, inode Ino) (bool, error) {
+	vals, err := tx.HMGet(ctx, r.entryKey(inode), shardField).Result()
+	if err != nil {
+		return false, err
+	}
+	n := parseShards(vals[0])
+	cmds, err := tx.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i := uint32(0); i < n; i++ {
+			pipe.HLen(ctx, r.shardKey(inode, i))
+		}
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	var cnt int64
+	for _, cmd := range cmds {
+		cnt += cmd.(*redis.IntCmd).Val()
+	}
+	if n > 1 {
+		cnt-- // the field of shards
+	}
+	return cnt == 0, nil
+}
+
+// checkShard splits or merges the directory in background after an entry is added or removed,
+// the existing shards are still merged back if DirShards is disabled.
+func (r *redisMeta) checkShard(parent Ino, shards uint32, size int64) {
+	if size > maxShardEntries && r.dirShards || shards > 1 && size < maxShardEntries/8 {
+		r.Lock()
+		if r.resharding[parent] {
+			r.Unlock()
+			return
+		}
+		r.resharding[parent] = true
+		r.Unlock()
+		go func() {
+			if st := r.reshard(Background, parent); st != 0 {
+				logger.Warnf("reshard directory %d: %s", parent, st)
+			}
+			r.Lock()
+			delete(r.resharding, parent)
+			r.Unlock()
+		}()
+	}
+}
+
+// reshard splits the next shard of a directory if any of the shards is too large, or merges
+// the last shard back if the shards are less than a quarter full, until the number of shards
+// fits the entries.
+func (r *redisMeta) reshard(ctx Context, inode Ino) syscall.Errno {
+	for {
+		var changed bool
+		key := r.entryKey(inode)
+		st := r.txn(ctx, func(tx *redis.Tx) error {
+			changed = false
+			vals, err := tx.HMGet(ctx, key, shardField).Result()
+			if err != nil {
+				return err
+			}
+			n := parseShards(vals[0])
+			cmds, err := tx.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+				for i := uint32(0); i < n; i++ {
+					pipe.HLen(ctx, r.shardKey(inode, i))
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			var total, max int64
+			for _, cmd := range cmds {
+				size := cmd.(*redis.IntCmd).Val()
+				total += size
+				if size > max {
+					max = size
+				}
+			}
+			if n > 1 {
+				total-- // the field of shards
+			}
+			level := uint(bits.Len32(n) - 1)
+			if max > maxShardEntries && total > maxShardEntries*int64(n)/2 {
+				// split the shard n-2^level into shard n
+				changed = true
+				return r.moveEntries(ctx, tx, inode, n-1<<level, n, n+1, func(field string) bool {
+					return nameShard(field, n+1) == n
+				})
+			}
+			if n > 1 && total < maxShardEntries*int64(n-1)/4 {
+				// merge the last shard back into the one it's split from
+				last := n - 1
+				level = uint(bits.Len32(last) - 1)
+				changed = true
+				return r.moveEntries(ctx, tx, inode, last, last-1<<level, last, func(string) bool { return true })
+			}
+			return nil
+		}, key)
+		if st != 0 || !changed {
+			return st
+		}
+	}
+}
+
+// moveEntries moves the selected entries from shard src to dst, and sets the number of shards to n.
+func (r *redisMeta) moveEntries(ctx Context, tx *redis.Tx, inode Ino, src, dst, n uint32, selected func(field string) bool) error {
+	srcKey, dstKey := r.shardKey(inode, src), r.shardKey(inode, dst)
+	if err := tx.Watch(ctx, srcKey, dstKey).Err(); err != nil {
+		return err
+	}
+	entries, err := tx.HGetAll(ctx, srcKey).Result()
+	if err != nil {
+		return err
+	}
+	var fields []string
+	var moved = make(map[string]interface{})
+	for field, buf := range entries {
+		if field != shardField && selected(field) {
+			fields = append(fields, field)
+			moved[field] = buf
+		}
+	}
+	_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		if len(fields) > 0 {
+			pipe.HDel(ctx, srcKey, fields...)
+			pipe.HSet(ctx, dstKey, moved)
+		}
+		if n > 1 {
+			pipe.HSet(ctx, r.entryKey(inode), shardField, strconv.FormatUint(uint64(n), 10))
+		} else {
+			pipe.HDel(ctx, r.entryKey(inode), shardField)
+		}
+		return nil
+	})
+	if err == nil {
+		logger.Debugf("moved %d entries of directory %d from shard %d to %d, %d shards", len(fields), inode, src, dst, n)
+	}
+	return err
+}
+
+// scanEntries calls fn for all the entries of a directory, shard by shard.
+func (r *redisMeta) scanEntries(ctx Context, rdb *redis.Client, inode Ino, fn func(keys []string)) error {
+	n := uint32(1)
+	for shard := uint32(0); shard < n; shard++ {
+		var keys []string
+		var cursor uint64
+		var err error
+		for {
+			keys, cursor, err = rdb.HScan(ctx, r.shardKey(inode, shard), cursor, "*", 10000).Result()
+			if err != nil {
+				return err
+			}
+			for i := 0; i < len(keys); i += 2 {
+				if keys[i] == shardField {
+					n = parseShards(keys[i+1])
+					keys = append(keys[:i], keys[i+2:]...)
+					break
+				}
+			}
+			fn(keys)
+			if cursor == 0 {
+				break
+			}
+		}
+	}
+	return nil
+}
@@ -17,11 +17,17 @@ package meta
 
 import (
 	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"testing"
 	"time"
 
+	"github.com/go-redis/redis/v8"
 	"github.com/juicedata/juicefs/pkg/utils"
 )
 
@@ -52,6 +58,7 @@ func BenchmarkReadSlices(b *testing.B) {
 	for _, c := range cases {
 		b.Run(c.desc, func(b *testing.B) {
 			vals := encodeSlices(c.size)
+			b.ReportAllocs()
 			b.ResetTimer()
 			var slices []*slice
 			for i := 0; i < b.N; i++ {
@@ -64,6 +71,70 @@ func BenchmarkReadSlices(b *testing.B) {
 	}
 }
 
+// overlappedSlices returns slices written at increasing offsets, each of them overlaps the previous one.
+func overlappedSlices(size int) []string {
+	vals := make([]string, size)
+	for i := range vals {
+		vals[i] = string(marshalSlice(uint32(i)*100, uint64(i+1), 1<<20, 0, 150))
+	}
+	return vals
+}
+
+func BenchmarkBuildSlice(b *testing.B) {
+	for _, size := range []int{4, 64, 1024} {
+		vals := overlappedSlices(size)
+		b.Run(fmt.Sprintf("heap-%d", size), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				buildSlice(readSlices(vals))
+			}
+		})
+		b.Run(fmt.Sprintf("arena-%d", size), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				a := newSliceArena()
+				buildSliceIn(a, a.readSlices(vals))
+				a.release()
+			}
+		})
+	}
+}
+
+func TestBuildSlice(t *testing.T) {
+	vals := []string{
+		string(marshalSlice(0, 1, 1<<20, 0, 100)),
+		string(marshalSlice(100, 1, 1<<20, 100, 100)),
+		string(marshalSlice(300, 2, 1<<20, 0, 100)),
+		string(marshalSlice(50, 3, 1<<20, 0, 10)),
+	}
+	expected := []Slice{
+		{Chunkid: 1, Size: 1 << 20, Off: 0, Len: 50},
+		{Chunkid: 3, Size: 1 << 20, Off: 0, Len: 10},
+		{Chunkid: 1, Size: 1 << 20, Off: 60, Len: 140},
+		{Chunkid: 0, Size: 0, Off: 0, Len: 100},
+		{Chunkid: 2, Size: 1 << 20, Off: 0, Len: 100},
+	}
+	check := func(chunks []Slice) {
+		if len(chunks) != len(expected) {
+			t.Fatalf("expect %d slices, but got %+v", len(expected), chunks)
+		}
+		for i := range chunks {
+			if chunks[i] != expected[i] {
+				t.Fatalf("slice %d: expect %+v, but got %+v", i, expected[i], chunks[i])
+			}
+		}
+	}
+	check(buildSlice(readSlices(vals)))
+
+	// the slices left in a reused arena should not leak into the next chunk
+	a := &sliceArena{}
+	for _, s := range a.readSlices(overlappedSlices(sliceBlock + 1)) {
+		s.left, s.right = s, s
+	}
+	a.cur, a.used, a.ss = 0, 0, a.ss[:0]
+	check(buildSliceIn(a, a.readSlices(vals)))
+}
+
 // nolint:errcheck
 func TestRedisClient(t *testing.T) {
 	var conf RedisConfig
@@ -72,6 +143,196 @@ func TestRedisClient(t *testing.T) {
 		t.Logf("redis is not available: %s", err)
 		t.Skip()
 	}
+	testMetaClient(t, m)
+}
+
+// nolint:errcheck
+func TestKeyPrefix(t *testing.T) {
+	var conf RedisConfig
+	m, err := NewRedisMeta("redis://127.0.0.1/14?prefix=a", &conf)
+	if err != nil {
+		t.Logf("redis is not available: %s", err)
+		t.Skip()
+	}
+	m.(*redisMeta).rdb.FlushDB(Background)
+	testMetaClient(t, m)
+
+	m2, err := NewRedisMeta("redis://127.0.0.1/14?prefix=b", &conf)
+	if err != nil {
+		t.Fatalf("create meta with prefix b: %s", err)
+	}
+	if _, err := m2.Load(); err == nil {
+		t.Fatalf("volume b should not exist")
+	}
+	if err := m2.Init(Format{Name: "b"}, false); err != nil {
+		t.Fatalf("init volume b: %s", err)
+	}
+	ctx := Background
+	var inode Ino
+	var attr = &Attr{}
+	if st := m.Mkdir(ctx, 1, "d", 0640, 022, 0, &inode, attr); st != 0 {
+		t.Fatalf("mkdir %s", st)
+	}
+	if st := m2.Lookup(ctx, 1, "d", &inode, attr); st != syscall.ENOENT {
+		t.Fatalf("lookup d in volume b: %s", st)
+	}
+	if err := m.Init(Format{Name: "b"}, true); err == nil {
+		t.Fatalf("prefix a should not be reused by volume b")
+	}
+
+	for _, addr := range []string{"redis://127.0.0.1/14?db=1", "redis://127.0.0.1/14?prefix=a:b", "redis://127.0.0.1/14?prefix="} {
+		if _, err := NewRedisMeta(addr, &conf); err == nil {
+			t.Fatalf("%s should be invalid", addr)
+		}
+	}
+}
+
+func TestKeyPrefixSlices(t *testing.T) {
+	var conf RedisConfig
+	ctx := Background
+	var metas []Meta
+	var chunkids []uint64
+	// the chunks of volume c1 ("c1:c1_0") match the patterns of the volume without prefix
+	for i, addr := range []string{"redis://127.0.0.1/13", "redis://127.0.0.1/13?prefix=c1"} {
+		m, err := NewRedisMeta(addr, &conf)
+		if err != nil {
+			t.Logf("redis is not available: %s", err)
+			t.Skip()
+		}
+		if i == 0 {
+			m.(*redisMeta).rdb.FlushDB(ctx)
+		}
+		if err = m.Init(Format{Name: fmt.Sprintf("vol%d", i)}, false); err != nil {
+			t.Fatalf("init: %s", err)
+		}
+		var inode Ino
+		attr := &Attr{}
+		if st := m.Create(ctx, 1, "f", 0644, 022, &inode, attr); st != 0 {
+			t.Fatalf("create f: %s", st)
+		}
+		var chunkid uint64
+		if st := m.NewChunk(ctx, inode, 0, 0, &chunkid); st != 0 {
+			t.Fatalf("new chunk: %s", st)
+		}
+		if st := m.Write(ctx, inode, 0, 0, Slice{Chunkid: chunkid, Size: 100, Len: 100}); st != 0 {
+			t.Fatalf("write: %s", st)
+		}
+		// a large truncate scans the chunks of the file
+		if st := m.Truncate(ctx, inode, 0, 200<<26, attr); st != 0 {
+			t.Fatalf("truncate: %s", st)
+		}
+		metas = append(metas, m)
+		chunkids = append(chunkids, chunkid)
+	}
+	for i, m := range metas {
+		var slices []Slice
+		if st := m.ListSlices(ctx, &slices); st != 0 {
+			t.Fatalf("list slices: %s", st)
+		}
+		if len(slices) != 1 || slices[0].Chunkid != chunkids[i] {
+			t.Fatalf("slices of volume %d: %+v, expect chunk %d", i, slices, chunkids[i])
+		}
+	}
+}
+
+func TestParseChunkKey(t *testing.T) {
+	for prefix, keys := range map[string]map[string]bool{
+		"":    {"c2_0": true, "c1:c2_0": false, "c2_0_1": false, "cx_0": false, "i2": false},
+		"c1:": {"c1:c2_0": true, "c2_0": false, "c1:c2_": false, "c1:k2_0": false},
+	} {
+		r := &redisMeta{prefix: prefix}
+		for key, ok := range keys {
+			inode, indx, got := r.parseChunkKey(key)
+			if got != ok || ok && (inode != 2 || indx != 0) {
+				t.Fatalf("parse chunk key %s with prefix %q: %d %d %v", key, prefix, inode, indx, got)
+			}
+		}
+	}
+}
+
+func TestParseRedisURL(t *testing.T) {
+	for uri, expected := range map[string]string{
+		"redis://127.0.0.1/1":                     "127.0.0.1:6379",
+		"redis://:pass@[::1]/1":                   "[::1]:6379",
+		"rediss://user:p@ss@[2001:db8::1]:6380/2": "[2001:db8::1]:6380",
+		"redis://master,[::1],[::2]:26379/1":      "master,[::1],[::2]:26379",
+		"redis://master,h1,h2:26379/1":            "master,h1,h2:26379",
+	} {
+		opt, err := parseRedisURL(uri)
+		if err != nil {
+			t.Fatalf("parse %s: %s", uri, err)
+		}
+		if opt.Addr != expected {
+			t.Fatalf("address of %s: %s != %s", uri, opt.Addr, expected)
+		}
+		if opt.TLSConfig != nil && opt.TLSConfig.ServerName != "2001:db8::1" {
+			t.Fatalf("server name of %s: %s", uri, opt.TLSConfig.ServerName)
+		}
+	}
+	opt, _ := parseRedisURL("rediss://user:p@ss@[2001:db8::1]:6380/2")
+	if opt.Username != "user" || opt.Password != "p@ss" || opt.DB != 2 {
+		t.Fatalf("options: %+v", opt)
+	}
+}
+
+// nolint:errcheck
+func TestReadReplica(t *testing.T) {
+	// the same database works as a replica without any lag
+	var conf = RedisConfig{ReadReplica: "redis://127.0.0.1/12", MaxStaleness: time.Second * 5}
+	m, err := NewRedisMeta("redis://127.0.0.1/12", &conf)
+	if err != nil {
+		t.Logf("redis is not available: %s", err)
+		t.Skip()
+	}
+	r := m.(*redisMeta)
+	r.rdb.FlushDB(Background)
+	_ = m.Init(Format{Name: "test"}, true)
+	if r.reader() != r.rdb {
+		t.Fatalf("replica should not be used before checked")
+	}
+	r.updateReplicaLag()
+	r.updateReplicaLag()
+	if lag := atomic.LoadInt64(&r.replicaLag); lag < 0 || lag > int64(time.Second) {
+		t.Fatalf("replica lag: %d", lag)
+	}
+	ctx := Background
+	var inode Ino
+	var attr = &Attr{}
+	if st := m.Mkdir(ctx, 1, "d", 0640, 022, 0, &inode, attr); st != 0 {
+		t.Fatalf("mkdir %s", st)
+	}
+	atomic.StoreInt64(&r.replicaLag, int64(time.Second))
+	if r.reader() != r.rdb {
+		t.Fatalf("replica should not be used right after write")
+	}
+	atomic.StoreInt64(&r.lastWrite, time.Now().Add(-time.Second*2).UnixNano())
+	if r.reader() != r.replica {
+		t.Fatalf("replica should be used")
+	}
+	if st := m.Lookup(ctx, 1, "d", &inode, attr); st != 0 || attr.Typ != TypeDirectory {
+		t.Fatalf("lookup from replica: %s", st)
+	}
+	var entries []*Entry
+	if st := m.Readdir(ctx, 1, 1, &entries); st != 0 || len(entries) != 3 {
+		t.Fatalf("readdir from replica: %s %d", st, len(entries))
+	}
+	atomic.StoreInt64(&r.replicaLag, int64(time.Second*10))
+	if r.reader() != r.rdb {
+		t.Fatalf("stale replica should not be used")
+	}
+
+	conf.ReadReplica = "redis://127.0.0.1/13"
+	m2, _ := NewRedisMeta("redis://127.0.0.1/12", &conf)
+	r2 := m2.(*redisMeta)
+	r2.replica.FlushDB(Background)
+	r2.updateReplicaLag()
+	if r2.reader() != r2.rdb {
+		t.Fatalf("replica without heartbeat should not be used")
+	}
+}
+
+// nolint:errcheck
+func testMetaClient(t *testing.T, m Meta) {
 	m.OnMsg(DeleteChunk, func(args ...interface{}) error { return nil })
 	_ = m.Init(Format{Name: "test"}, true)
 	_ = m.NewSession()
@@ -114,7 +375,7 @@ func TestRedisClient(t *testing.T) {
 	} else if string(entries[0].Name) != "." || string(entries[1].Name) != ".." || string(entries[2].Name) != "f" {
 		t.Fatalf("entries: %+v", entries)
 	}
-	if st := m.Rename(ctx, parent, "f", 1, "f2", &inode, attr); st != 0 {
+	if st := m.Rename(ctx, parent, "f", 1, "f2", 0, &inode, attr); st != 0 {
 		t.Fatalf("rename f %s", st)
 	}
 	defer func() {
@@ -123,6 +384,25 @@ func TestRedisClient(t *testing.T) {
 	if st := m.Lookup(ctx, 1, "f2", &inode, attr); st != 0 {
 		t.Fatalf("lookup f2: %s", st)
 	}
+	var f3 Ino
+	if st := m.Mknod(ctx, 1, "f3", TypeFile, 0644, 022, 0, &f3, attr); st != 0 {
+		t.Fatalf("mknod f3: %s", st)
+	}
+	if st := m.Rename(ctx, 1, "f3", 1, "f2", RenameNoReplace, nil, nil); st != syscall.EEXIST {
+		t.Fatalf("rename f3 to existing f2 without replace: %s", st)
+	}
+	if st := m.Rename(ctx, 1, "f3", 1, "f2", RenameExchange, nil, nil); st != syscall.ENOTSUP {
+		t.Fatalf("exchange f3 and f2: %s", st)
+	}
+	if st := m.Rename(ctx, 1, "f3", 1, "f4", RenameNoReplace, nil, nil); st != 0 {
+		t.Fatalf("rename f3 to f4 without replace: %s", st)
+	}
+	if st := m.Unlink(ctx, 1, "f4"); st != 0 {
+		t.Fatalf("unlink f4: %s", st)
+	}
+	if st := m.Lookup(ctx, 1, "f2", &inode, attr); st != 0 {
+		t.Fatalf("lookup f2: %s", st)
+	}
 
 	// data
 	var chunkid uint64
@@ -233,6 +513,7 @@ func TestRedisClient(t *testing.T) {
 	// concurrent locks
 	var g sync.WaitGroup
 	var count int
+	var err syscall.Errno
 	for i := 0; i < 100; i++ {
 		g.Add(1)
 		go func(i int) {
@@ -253,6 +534,9 @@ func TestRedisClient(t *testing.T) {
 		}(i)
 	}
 	g.Wait()
+	if err != 0 {
+		t.Fatalf("plock: %s", err)
+	}
 
 	if st := m.Unlink(ctx, 1, "f2"); st != 0 {
 		t.Fatalf("unlink: %s", st)
@@ -269,6 +553,10 @@ func TestCompaction(t *testing.T) {
 		t.Logf("redis is not available: %s", err)
 		t.Skip()
 	}
+	testCompaction(t, m)
+}
+
+func testCompaction(t *testing.T, m Meta) {
 	_ = m.Init(Format{Name: "test"}, true)
 	done := make(chan bool, 1)
 	var l sync.Mutex
@@ -337,6 +625,204 @@ func TestCompaction(t *testing.T) {
 	}
 }
 
+func TestCompactAll(t *testing.T) {
+	m, err := NewRedisMeta("redis://127.0.0.1/15", &RedisConfig{})
+	if err != nil {
+		t.Logf("redis is not available: %s", err)
+		t.Skip()
+	}
+	m.(*redisMeta).rdb.FlushDB(Background)
+	testCompactAll(t, m)
+}
+
+func testCompactAll(t *testing.T, m Meta) {
+	_ = m.Init(Format{Name: "test"}, false)
+	m.OnMsg(DeleteChunk, func(args ...interface{}) error { return nil })
+	m.OnMsg(CompactChunk, func(args ...interface{}) error { return nil })
+	ctx := Background
+	var f, g Ino
+	var attr Attr
+	if st := m.Create(ctx, 1, "f", 0644, 0, &f, &attr); st != 0 {
+		t.Fatalf("create f: %s", st)
+	}
+	if st := m.Create(ctx, 1, "g", 0644, 0, &g, &attr); st != 0 {
+		t.Fatalf("create g: %s", st)
+	}
+	for i := 0; i < 3; i++ {
+		if st := m.Write(ctx, f, 0, uint32(i)*100, Slice{Chunkid: uint64(i) + 1, Size: 100, Len: 100}); st != 0 {
+			t.Fatalf("write f: %s", st)
+		}
+	}
+	if st := m.Write(ctx, g, 0, 0, Slice{Chunkid: 10, Size: 100, Len: 100}); st != 0 {
+		t.Fatalf("write g: %s", st)
+	}
+	if st := m.CompactAll(ctx, 2); st != 0 {
+		t.Fatalf("compact all: %s", st)
+	}
+	var frag Fragmentation
+	if st := m.Fragmentation(ctx, 1, &frag); st != 0 {
+		t.Fatalf("fragmentation: %s", st)
+	}
+	if frag.Chunks != 2 || frag.Slices != 2 || frag.LiveBytes != 400 {
+		t.Fatalf("chunks should be compacted: %+v", frag)
+	}
+}
+
+func TestDefrag(t *testing.T) {
+	m, err := NewRedisMeta("redis://127.0.0.1/15", &RedisConfig{})
+	if err != nil {
+		t.Logf("redis is not available: %s", err)
+		t.Skip()
+	}
+	m.(*redisMeta).rdb.FlushDB(Background)
+	testDefrag(t, m)
+}
+
+func testDefrag(t *testing.T, m Meta) {
+	_ = m.Init(Format{Name: "test"}, false)
+	m.OnMsg(DeleteChunk, func(args ...interface{}) error { return nil })
+	var compacted [][]Slice
+	m.OnMsg(CompactChunk, func(args ...interface{}) error {
+		compacted = append(compacted, args[0].([]Slice))
+		return nil
+	})
+	ctx := Background
+	var f Ino
+	var attr Attr
+	if st := m.Create(ctx, 1, "f", 0644, 0, &f, &attr); st != 0 {
+		t.Fatalf("create f: %s", st)
+	}
+	// appended in large pieces, they're kept by compaction
+	for i := 0; i < 3; i++ {
+		if st := m.Write(ctx, f, 0, uint32(i)<<21, Slice{Chunkid: uint64(i) + 1, Size: 2 << 20, Len: 2 << 20}); st != 0 {
+			t.Fatalf("write f: %s", st)
+		}
+	}
+	if st := m.CompactAll(ctx, 2); st != 0 {
+		t.Fatalf("compact all: %s", st)
+	}
+	var count uint64
+	if st := m.Defrag(ctx, 2, time.Hour, &count); st != 0 || count != 0 {
+		t.Fatalf("defrag recent file: %s %d", st, count)
+	}
+	var frag Fragmentation
+	if st := m.Fragmentation(ctx, f, &frag); st != 0 || frag.Slices != 3 {
+		t.Fatalf("fragmentation: %s %+v", st, frag)
+	}
+	if st := m.Defrag(ctx, 2, 0, &count); st != 0 || count != 1 {
+		t.Fatalf("defrag: %s %d", st, count)
+	}
+	frag = Fragmentation{}
+	if st := m.Fragmentation(ctx, f, &frag); st != 0 || frag.Slices != 1 || frag.LiveBytes != 6<<20 {
+		t.Fatalf("fragmentation after defrag: %s %+v", st, frag)
+	}
+	if len(compacted) != 1 || len(compacted[0]) != 3 {
+		t.Fatalf("compacted slices: %+v", compacted)
+	}
+}
+
+func TestShrink(t *testing.T) {
+	m, err := NewRedisMeta("redis://127.0.0.1/15", &RedisConfig{})
+	if err != nil {
+		t.Logf("redis is not available: %s", err)
+		t.Skip()
+	}
+	m.(*redisMeta).rdb.FlushDB(Background)
+	testShrink(t, m)
+}
+
+func testShrink(t *testing.T, m Meta) {
+	_ = m.Init(Format{Name: "test"}, false)
+	ctx := Background
+	var f Ino
+	var attr Attr
+	if st := m.Create(ctx, 1, "f", 0644, 0, &f, &attr); st != 0 {
+		t.Fatalf("create f: %s", st)
+	}
+	// the first slice is overwritten by the second one
+	_ = m.Write(ctx, f, 0, 0, Slice{Chunkid: 1, Size: 1 << 20, Len: 1 << 20})
+	_ = m.Write(ctx, f, 0, 0, Slice{Chunkid: 2, Size: 2 << 20, Len: 2 << 20})
+	_ = m.Write(ctx, f, 0, 3<<20, Slice{Chunkid: 3, Size: 1 << 20, Len: 1 << 20})
+	var before []Slice
+	if st := m.Read(ctx, f, 0, &before); st != 0 {
+		t.Fatalf("read f: %s", st)
+	}
+	var stats ShrinkStats
+	if st := m.Shrink(ctx, 2, &stats); st != 0 || stats.Chunks != 1 || stats.Slices != 1 {
+		t.Fatalf("shrink: %s %+v", st, stats)
+	}
+	var after []Slice
+	if st := m.Read(ctx, f, 0, &after); st != 0 || !reflect.DeepEqual(before, after) {
+		t.Fatalf("read after shrink: %s %+v != %+v", st, after, before)
+	}
+	var frag Fragmentation
+	if st := m.Fragmentation(ctx, f, &frag); st != 0 || frag.Slices != 2 {
+		t.Fatalf("fragmentation after shrink: %s %+v", st, frag)
+	}
+	stats = ShrinkStats{}
+	if st := m.Shrink(ctx, 2, &stats); st != 0 || stats.Chunks != 0 {
+		t.Fatalf("shrink again: %s %+v", st, stats)
+	}
+}
+
+func TestReserve(t *testing.T) {
+	m, err := NewRedisMeta("redis://127.0.0.1/15", &RedisConfig{})
+	if err != nil {
+		t.Logf("redis is not available: %s", err)
+		t.Skip()
+	}
+	m.(*redisMeta).rdb.FlushDB(Background)
+	testReserve(t, m)
+}
+
+func testReserve(t *testing.T, m Meta) {
+	_ = m.Init(Format{Name: "test"}, false)
+	ctx := Background
+	var f, d Ino
+	var attr Attr
+	if st := m.Create(ctx, 1, "f", 0644, 0, &f, &attr); st != 0 {
+		t.Fatalf("create f: %s", st)
+	}
+	if st := m.Mkdir(ctx, 1, "d", 0755, 0, 0, &d, &attr); st != 0 {
+		t.Fatalf("mkdir d: %s", st)
+	}
+	var wg sync.WaitGroup
+	offs := make([]uint64, 10)
+	for i := range offs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if st := m.Reserve(ctx, f, 100, &offs[i]); st != 0 {
+				t.Errorf("reserve: %s", st)
+			}
+		}(i)
+	}
+	wg.Wait()
+	seen := make(map[uint64]bool)
+	for _, off := range offs {
+		if off%100 != 0 || off >= 1000 || seen[off] {
+			t.Fatalf("offsets of reserved ranges: %v", offs)
+		}
+		seen[off] = true
+	}
+	if st := m.GetAttr(ctx, f, &attr); st != 0 || attr.Length != 1000 {
+		t.Fatalf("length after reserve: %s %d", st, attr.Length)
+	}
+	var off uint64
+	if st := m.Reserve(ctx, f, 0, &off); st != syscall.EINVAL {
+		t.Fatalf("reserve nothing: %s", st)
+	}
+	if st := m.Reserve(ctx, d, 100, &off); st != syscall.EPERM {
+		t.Fatalf("reserve directory: %s", st)
+	}
+	if st := m.Reserve(ctx, f, MaxFileSize-1000, &off); st != syscall.EFBIG {
+		t.Fatalf("reserve beyond max size: %s", st)
+	}
+	if st := m.GetAttr(ctx, f, &attr); st != 0 || attr.Length != 1000 {
+		t.Fatalf("length after reserve failed: %s %d", st, attr.Length)
+	}
+}
+
 func TestConcurrentWrite(t *testing.T) {
 	var conf RedisConfig
 	m, err := NewRedisMeta("redis://127.0.0.1/9", &conf)
@@ -344,6 +830,10 @@ func TestConcurrentWrite(t *testing.T) {
 		t.Logf("redis is not available: %s", err)
 		t.Skip()
 	}
+	testConcurrentWrite(t, m)
+}
+
+func testConcurrentWrite(t *testing.T, m Meta) {
 	m.OnMsg(DeleteChunk, func(args ...interface{}) error {
 		return nil
 	})
@@ -459,6 +949,11 @@ func TestCopyFileRange(t *testing.T) {
 		t.Logf("redis is not available: %s", err)
 		t.Skip()
 	}
+	testCopyFileRange(t, m)
+}
+
+// nolint:errcheck
+func testCopyFileRange(t *testing.T, m Meta) {
 	m.OnMsg(DeleteChunk, func(args ...interface{}) error {
 		return nil
 	})
@@ -560,3 +1055,849 @@ func BenchmarkReaddir100k(b *testing.B) {
 func BenchmarkReaddir10m(b *testing.B) {
 	benchmarkReaddir(b, 10000000)
 }
+
+// benchmarkRenameDir moves a directory with n entries between two parents, which should
+// take the same time for any n.
+func benchmarkRenameDir(b *testing.B, m Meta, n int) {
+	_ = m.NewSession()
+	ctx := Background
+	var inode, p1, p2 Ino
+	dname := fmt.Sprintf("renamedir%d", n)
+	if m.Lookup(ctx, 1, "rename1", &p1, nil) != 0 {
+		_ = m.Mkdir(ctx, 1, "rename1", 0755, 0, 0, &p1, nil)
+	}
+	if m.Lookup(ctx, 1, "rename2", &p2, nil) != 0 {
+		_ = m.Mkdir(ctx, 1, "rename2", 0755, 0, 0, &p2, nil)
+	}
+	if m.Lookup(ctx, p2, dname, &inode, nil) == 0 && m.Rename(ctx, p2, dname, p1, dname, 0, nil, nil) != 0 {
+		b.Fatalf("rename %s back", dname)
+	}
+	var es []*Entry
+	if m.Lookup(ctx, p1, dname, &inode, nil) == 0 && m.Readdir(ctx, inode, 0, &es) == 0 && len(es) == n+2 {
+	} else {
+		_ = m.Rmr(ctx, p1, dname)
+		_ = m.Mkdir(ctx, p1, dname, 0755, 0, 0, &inode, nil)
+		for j := 0; j < n; j++ {
+			_ = m.Create(ctx, inode, fmt.Sprintf("d%d", j), 0755, 0, nil, nil)
+		}
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		src, dst := p1, p2
+		if i%2 == 1 {
+			src, dst = p2, p1
+		}
+		if e := m.Rename(ctx, src, dname, dst, dname, 0, nil, nil); e != 0 {
+			b.Fatalf("rename: %s", e)
+		}
+	}
+}
+
+func BenchmarkRenameDir10(b *testing.B) {
+	m, err := NewRedisMeta("redis://127.0.0.1/10", &RedisConfig{})
+	if err != nil {
+		b.Skipf("redis is not available: %s", err)
+	}
+	benchmarkRenameDir(b, m, 10)
+}
+
+func BenchmarkRenameDir100k(b *testing.B) {
+	m, err := NewRedisMeta("redis://127.0.0.1/10", &RedisConfig{})
+	if err != nil {
+		b.Skipf("redis is not available: %s", err)
+	}
+	benchmarkRenameDir(b, m, 100000)
+}
+
+func TestPackedBlocks(t *testing.T) {
+	var conf RedisConfig
+	m, err := NewRedisMeta("redis://127.0.0.1:6379/7", &conf)
+	if err != nil {
+		t.Logf("redis is not available: %s", err)
+		t.Skip()
+	}
+	testPackedBlocks(t, m)
+}
+
+func testPackedBlocks(t *testing.T, m Meta) {
+	if err := m.AddPack(100, []uint64{100, 101}, []uint32{0, 10, 30}); err != nil {
+		t.Fatalf("add pack: %s", err)
+	}
+	if pack, off, size, err := m.LookupPack(101); err != nil || pack != 100 || off != 10 || size != 20 {
+		t.Fatalf("lookup pack: %d %d %d %s", pack, off, size, err)
+	}
+	if pack, _, _, err := m.LookupPack(102); err != nil || pack != 0 {
+		t.Fatalf("lookup unpacked block: %d %s", pack, err)
+	}
+	if pack, left, err := m.RemovePack(100); err != nil || pack != 100 || left != 1 {
+		t.Fatalf("remove packed block: %d %d %s", pack, left, err)
+	}
+	if pack, left, err := m.RemovePack(101); err != nil || pack != 100 || left != 0 {
+		t.Fatalf("remove packed block: %d %d %s", pack, left, err)
+	}
+	if pack, _, err := m.RemovePack(101); err != nil || pack != 0 {
+		t.Fatalf("remove packed block again: %d %s", pack, err)
+	}
+}
+
+func TestDedupBlocks(t *testing.T) {
+	var conf RedisConfig
+	m, err := NewRedisMeta("redis://127.0.0.1:6379/7", &conf)
+	if err != nil {
+		t.Logf("redis is not available: %s", err)
+		t.Skip()
+	}
+	testDedupBlocks(t, m)
+}
+
+func testDedupBlocks(t *testing.T, m Meta) {
+	if key, err := m.AddDedup("h1", 100, 0, ""); err != nil || key != "" {
+		t.Fatalf("refer missing object: %q %s", key, err)
+	}
+	if key, err := m.AddDedup("h1", 100, 0, "chunks/0/0/100_0_10"); err != nil || key != "chunks/0/0/100_0_10" {
+		t.Fatalf("add object: %q %s", key, err)
+	}
+	if key, err := m.AddDedup("h1", 101, 1, ""); err != nil || key != "chunks/0/0/100_0_10" {
+		t.Fatalf("refer object: %q %s", key, err)
+	}
+	// uploaded concurrently
+	if key, err := m.AddDedup("h1", 102, 0, "chunks/0/0/102_0_10"); err != nil || key != "chunks/0/0/100_0_10" {
+		t.Fatalf("add existing object: %q %s", key, err)
+	}
+	if key, err := m.AddDedup("h1", 102, 0, ""); err != nil || key != "chunks/0/0/100_0_10" {
+		t.Fatalf("refer object again: %q %s", key, err)
+	}
+	if key, err := m.LookupDedup(101, 1); err != nil || key != "chunks/0/0/100_0_10" {
+		t.Fatalf("lookup block: %q %s", key, err)
+	}
+	if key, err := m.LookupDedup(101, 0); err != nil || key != "" {
+		t.Fatalf("lookup missing block: %q %s", key, err)
+	}
+	if objs, err := m.ListDedup(); err != nil || len(objs) != 1 || objs["chunks/0/0/100_0_10"] != 3 {
+		t.Fatalf("list objects: %v %s", objs, err)
+	}
+	if key, refs, err := m.DedupRefs(102, 0); err != nil || key != "chunks/0/0/100_0_10" || refs != 3 {
+		t.Fatalf("refs of block: %q %d %s", key, refs, err)
+	}
+	if key, refs, err := m.DedupRefs(101, 0); err != nil || key != "" || refs != 0 {
+		t.Fatalf("refs of missing block: %q %d %s", key, refs, err)
+	}
+	for i, id := range []uint64{100, 102} {
+		if key, left, err := m.RemoveDedup(id, 0); err != nil || key != "chunks/0/0/100_0_10" || left != int64(2-i) {
+			t.Fatalf("remove block %d: %q %d %s", id, key, left, err)
+		}
+	}
+	if key, _, err := m.RemoveDedup(100, 0); err != nil || key != "" {
+		t.Fatalf("remove block again: %q %s", key, err)
+	}
+	if key, left, err := m.RemoveDedup(101, 1); err != nil || key != "chunks/0/0/100_0_10" || left != 0 {
+		t.Fatalf("remove last block: %q %d %s", key, left, err)
+	}
+	if objs, err := m.ListDedup(); err != nil || len(objs) != 0 {
+		t.Fatalf("list objects: %v %s", objs, err)
+	}
+}
+
+func TestInlineData(t *testing.T) {
+	var conf RedisConfig
+	m, err := NewRedisMeta("redis://127.0.0.1/10", &conf)
+	if err != nil {
+		t.Logf("redis is not available: %s", err)
+		t.Skip()
+	}
+	testInlineData(t, m)
+}
+
+func testInlineData(t *testing.T, m Meta) {
+	m.OnMsg(DeleteChunk, func(args ...interface{}) error {
+		return nil
+	})
+	_ = m.Init(Format{Name: "test"}, true)
+	_ = m.NewSession()
+
+	ctx := Background
+	var inode Ino
+	var attr = &Attr{}
+	_ = m.Unlink(ctx, 1, "small")
+	if st := m.Create(ctx, 1, "small", 0650, 022, &inode, attr); st != 0 {
+		t.Fatalf("create file %s", st)
+	}
+	defer m.Unlink(ctx, 1, "small")
+	var data []byte
+	if st := m.ReadInline(ctx, inode, &data); st != 0 || data != nil {
+		t.Fatalf("read inline data of empty file: %s %v", st, data)
+	}
+	if st := m.WriteInline(ctx, inode, []byte("hello world")); st != 0 {
+		t.Fatalf("write inline: %s", st)
+	}
+	if st := m.GetAttr(ctx, inode, attr); st != 0 || attr.Length != 11 {
+		t.Fatalf("getattr: %s %d", st, attr.Length)
+	}
+	if st := m.Truncate(ctx, inode, 0, 5, attr); st != 0 {
+		t.Fatalf("truncate: %s", st)
+	}
+	if st := m.ReadInline(ctx, inode, &data); st != 0 || string(data) != "hello" {
+		t.Fatalf("read inline data: %s %q", st, data)
+	}
+	if st := m.Fallocate(ctx, inode, fallocPunchHole|fallocKeepSize, 1, 2); st != 0 {
+		t.Fatalf("fallocate: %s", st)
+	}
+	if st := m.ReadInline(ctx, inode, &data); st != 0 || string(data) != "h\x00\x00lo" {
+		t.Fatalf("read inline data: %s %q", st, data)
+	}
+	var copied uint64
+	if st := m.CopyFileRange(ctx, inode, 0, inode, 10, 5, 0, &copied); st != syscall.ENOTSUP {
+		t.Fatalf("copy inlined file should fail: %s", st)
+	}
+	if st := m.Write(ctx, inode, 0, 0, Slice{20, 5, 0, 5}); st != 0 {
+		t.Fatalf("write slice: %s", st)
+	}
+	if st := m.ReadInline(ctx, inode, &data); st != 0 || data != nil {
+		t.Fatalf("inline data should be removed: %s %q", st, data)
+	}
+	if st := m.WriteInline(ctx, inode, []byte("abc")); st != syscall.EINVAL {
+		t.Fatalf("write inline into file with chunks: %s", st)
+	}
+}
+
+func TestReplicationQueue(t *testing.T) {
+	var conf RedisConfig
+	m, err := NewRedisMeta("redis://127.0.0.1:6379/7", &conf)
+	if err != nil {
+		t.Logf("redis is not available: %s", err)
+		t.Skip()
+	}
+	testReplicationQueue(t, m)
+}
+
+func testReplicationQueue(t *testing.T, m Meta) {
+	if err := m.AddReplication("Pchunks/0/0/1_0_100"); err != nil {
+		t.Fatalf("add replication: %s", err)
+	}
+	ops, err := m.ClaimReplications(10, time.Minute)
+	if err != nil || len(ops) != 1 || ops[0] != "Pchunks/0/0/1_0_100" {
+		t.Fatalf("claim replications: %v %s", ops, err)
+	}
+	if ops, err := m.ClaimReplications(10, time.Minute); err != nil || len(ops) != 0 {
+		t.Fatalf("claimed operations should not be returned again: %v %s", ops, err)
+	}
+	if n, oldest, err := m.ReplicationLag(); err != nil || n != 1 || time.Since(oldest) > time.Minute {
+		t.Fatalf("replication lag: %d %s %s", n, oldest, err)
+	}
+	if err := m.DoneReplication(ops[0]); err != nil {
+		t.Fatalf("done replication: %s", err)
+	}
+	if n, _, err := m.ReplicationLag(); err != nil || n != 0 {
+		t.Fatalf("replication lag: %d %s", n, err)
+	}
+}
+
+func TestGatewayUsers(t *testing.T) {
+	testGatewayUsers(t, newMemClient(t))
+	m, err := NewRedisMeta("redis://127.0.0.1/10", &RedisConfig{})
+	if err != nil {
+		t.Logf("redis is not available: %s", err)
+		t.Skip()
+	}
+	testGatewayUsers(t, m)
+}
+
+func testGatewayUsers(t *testing.T, m Meta) {
+	_ = m.Init(Format{Name: "test"}, true)
+	_ = m.SetGatewayUser("team-a", nil)
+	if err := m.SetGatewayUser("team-a", []byte("v1")); err != nil {
+		t.Fatalf("set gateway user: %s", err)
+	}
+	if err := m.SetGatewayUser("team-a", []byte("v2")); err != nil {
+		t.Fatalf("update gateway user: %s", err)
+	}
+	if users, err := m.ListGatewayUsers(); err != nil || len(users) != 1 || string(users["team-a"]) != "v2" {
+		t.Fatalf("list gateway users: %v %s", users, err)
+	}
+	if err := m.SetGatewayUser("team-a", nil); err != nil {
+		t.Fatalf("remove gateway user: %s", err)
+	}
+	if users, err := m.ListGatewayUsers(); err != nil || len(users) != 0 {
+		t.Fatalf("list removed gateway users: %v %s", users, err)
+	}
+}
+
+func TestCheckpoints(t *testing.T) {
+	testCheckpoints(t, newMemClient(t))
+	m, err := NewRedisMeta("redis://127.0.0.1/10", &RedisConfig{})
+	if err != nil {
+		t.Logf("redis is not available: %s", err)
+		t.Skip()
+	}
+	testCheckpoints(t, m)
+}
+
+func testCheckpoints(t *testing.T, m Meta) {
+	_ = m.Init(Format{Name: "test"}, true)
+	_ = m.SetCheckpoint("gc", nil)
+	if cp, err := m.GetCheckpoint("gc"); err != nil || cp != nil {
+		t.Fatalf("get missing checkpoint: %q %s", cp, err)
+	}
+	if err := m.SetCheckpoint("gc", []byte("v1")); err != nil {
+		t.Fatalf("set checkpoint: %s", err)
+	}
+	if err := m.SetCheckpoint("gc", []byte("v2")); err != nil {
+		t.Fatalf("update checkpoint: %s", err)
+	}
+	if cp, err := m.GetCheckpoint("gc"); err != nil || string(cp) != "v2" {
+		t.Fatalf("get checkpoint: %q %s", cp, err)
+	}
+	if err := m.SetCheckpoint("gc", nil); err != nil {
+		t.Fatalf("remove checkpoint: %s", err)
+	}
+	if cp, err := m.GetCheckpoint("gc"); err != nil || cp != nil {
+		t.Fatalf("get removed checkpoint: %q %s", cp, err)
+	}
+}
+
+func TestExternalChunks(t *testing.T) {
+	var conf RedisConfig
+	m, err := NewRedisMeta("redis://127.0.0.1/10", &conf)
+	if err != nil {
+		t.Logf("redis is not available: %s", err)
+		t.Skip()
+	}
+	testExternalChunks(t, m)
+}
+
+func testExternalChunks(t *testing.T, m Meta) {
+	m.OnMsg(DeleteChunk, func(args ...interface{}) error {
+		return nil
+	})
+	_ = m.Init(Format{Name: "test"}, true)
+
+	if err := m.AddExternal(1<<62|100, "data/file", 1<<26); err != nil {
+		t.Fatalf("add external: %s", err)
+	}
+	if key, off, err := m.LookupExternal(1<<62 | 100); err != nil || key != "data/file" || off != 1<<26 {
+		t.Fatalf("lookup external: %s %d %v", key, off, err)
+	}
+	if err := m.RemoveExternal(1<<62 | 100); err != nil {
+		t.Fatalf("remove external: %s", err)
+	}
+	if key, _, err := m.LookupExternal(1<<62 | 100); err != nil || key != "" {
+		t.Fatalf("lookup removed external: %s %v", key, err)
+	}
+
+	ctx := Background
+	var inode Ino
+	var attr = &Attr{}
+	_ = m.Unlink(ctx, 1, "imported")
+	if st := m.Create(ctx, 1, "imported", 0644, 022, &inode, attr); st != 0 {
+		t.Fatalf("create file %s", st)
+	}
+	defer m.Unlink(ctx, 1, "imported")
+	if st := m.Write(ctx, inode, 0, 0, Slice{1<<62 | 101, 100, 0, 100}); st != 0 {
+		t.Fatalf("write: %s", st)
+	}
+	attr.Flags = FlagReadOnly
+	if st := m.SetAttr(ctx, inode, SetAttrFlag, 0, attr); st != 0 {
+		t.Fatalf("set read-only: %s", st)
+	}
+	if st := m.Open(ctx, inode, syscall.O_RDWR, attr); st != syscall.EPERM {
+		t.Fatalf("open read-only file for write: %s", st)
+	}
+	if st := m.Open(ctx, inode, syscall.O_RDONLY, attr); st != 0 {
+		t.Fatalf("open read-only file: %s", st)
+	}
+	_ = m.Close(ctx, inode)
+	if st := m.Truncate(ctx, inode, 0, 0, attr); st != syscall.EPERM {
+		t.Fatalf("truncate read-only file: %s", st)
+	}
+	if st := m.Write(ctx, inode, 0, 0, Slice{1<<62 | 102, 100, 0, 100}); st != syscall.EPERM {
+		t.Fatalf("write read-only file: %s", st)
+	}
+}
+
+// nolint:errcheck
+func TestUsage(t *testing.T) {
+	var conf RedisConfig
+	m, err := NewRedisMeta("redis://127.0.0.1/15", &conf)
+	if err != nil {
+		t.Logf("redis is not available: %s", err)
+		t.Skip()
+	}
+	m.(*redisMeta).rdb.FlushDB(Background)
+	testUsage(t, m)
+	testProjectQuota(t, m)
+}
+
+func checkUsage(t *testing.T, m Meta, group bool, expected ...Usage) {
+	usage, err := m.ListUsage(group)
+	if err != nil {
+		t.Fatalf("list usage: %s", err)
+	}
+	var used []Usage
+	for _, u := range usage {
+		if u.Space != 0 || u.Inodes != 0 {
+			used = append(used, u)
+		}
+	}
+	if len(used) != len(expected) {
+		t.Fatalf("usage of group %v: expect %+v, but got %+v", group, expected, used)
+	}
+	for i := range used {
+		if used[i] != expected[i] {
+			t.Fatalf("usage of group %v: expect %+v, but got %+v", group, expected, used)
+		}
+	}
+}
+
+func testUsage(t *testing.T, m Meta) {
+	m.OnMsg(DeleteChunk, func(args ...interface{}) error {
+		return nil
+	})
+	_ = m.Init(Format{Name: "test"}, true)
+	ctx := NewContext(1, 1000, []uint32{100})
+	var parent, inode Ino
+	var attr = &Attr{}
+	if st := m.Mkdir(ctx, 1, "usage", 0755, 022, 0, &parent, attr); st != 0 {
+		t.Fatalf("mkdir: %s", st)
+	}
+	if st := m.Create(ctx, parent, "f", 0644, 022, &inode, attr); st != 0 {
+		t.Fatalf("create: %s", st)
+	}
+	_ = m.Close(ctx, inode)
+	if st := m.Write(ctx, inode, 0, 0, Slice{Chunkid: 1, Size: 10000, Len: 10000}); st != 0 {
+		t.Fatalf("write: %s", st)
+	}
+	checkUsage(t, m, false, Usage{1000, 12288, 2})
+	checkUsage(t, m, true, Usage{100, 12288, 2})
+
+	attr.Uid = 1001
+	if st := m.SetAttr(Background, inode, SetAttrUID, 0, attr); st != 0 {
+		t.Fatalf("chown: %s", st)
+	}
+	checkUsage(t, m, false, Usage{1000, 0, 1}, Usage{1001, 12288, 1})
+	checkUsage(t, m, true, Usage{100, 12288, 2})
+	if st := m.Truncate(Background, inode, 0, 4096, attr); st != 0 {
+		t.Fatalf("truncate: %s", st)
+	}
+	checkUsage(t, m, false, Usage{1000, 0, 1}, Usage{1001, 4096, 1})
+
+	if st := m.Unlink(ctx, parent, "f"); st != 0 {
+		t.Fatalf("unlink: %s", st)
+	}
+	if st := m.Rmdir(ctx, 1, "usage"); st != 0 {
+		t.Fatalf("rmdir: %s", st)
+	}
+	checkUsage(t, m, false)
+	checkUsage(t, m, true)
+}
+
+func testProjectQuota(t *testing.T, m Meta) {
+	_ = m.Init(Format{Name: "test"}, true)
+	ctx := Background
+	var dir, sub, inode, other Ino
+	var attr = &Attr{}
+	if st := m.Mkdir(ctx, 1, "prj", 0777, 022, 0, &dir, attr); st != 0 {
+		t.Fatalf("mkdir: %s", st)
+	}
+	if st := m.SetXattr(NewContext(1, 1000, []uint32{100}), dir, "project.id", []byte("42")); st != syscall.EPERM {
+		t.Fatalf("set project by non-root: %s", st)
+	}
+	if st := m.SetXattr(ctx, dir, "project.id", []byte("x")); st != syscall.EINVAL {
+		t.Fatalf("set invalid project: %s", st)
+	}
+	if st := m.SetXattr(ctx, dir, "project.id", []byte("42")); st != 0 {
+		t.Fatalf("set project: %s", st)
+	}
+	if f, err := m.Load(); err != nil || len(f.WriteFeatures) != 1 || f.WriteFeatures[0] != FeatureProjects {
+		t.Fatalf("feature of projects is not recorded: %+v %s", f, err)
+	}
+	if f, _ := m.Load(); f != nil {
+		f.SetFeatures()
+		if len(f.WriteFeatures) != 1 {
+			t.Fatalf("feature of projects is not kept: %+v", f.WriteFeatures)
+		}
+	}
+	if err := m.SetQuota(42, 8192, 3); err != nil {
+		t.Fatalf("set quota: %s", err)
+	}
+	if st := m.Create(ctx, dir, "f", 0644, 022, &inode, attr); st != 0 {
+		t.Fatalf("create: %s", st)
+	}
+	_ = m.Close(ctx, inode)
+	var value []byte
+	if st := m.GetXattr(ctx, inode, "project.id", &value); st != 0 || string(value) != "42" {
+		t.Fatalf("inherited project: %s %q", st, value)
+	}
+	if st := m.Write(ctx, inode, 0, 0, Slice{Chunkid: 1, Size: 4096, Len: 4096}); st != 0 {
+		t.Fatalf("write: %s", st)
+	}
+	if st := m.Write(ctx, inode, 0, 4096, Slice{Chunkid: 2, Size: 8192, Len: 8192}); st != syscall.ENOSPC {
+		t.Fatalf("write over quota: %s", st)
+	}
+	if st := m.Mkdir(ctx, dir, "sub", 0755, 022, 0, &sub, attr); st != 0 {
+		t.Fatalf("mkdir: %s", st)
+	}
+	if st := m.Create(ctx, dir, "g", 0644, 022, &other, attr); st != syscall.ENOSPC {
+		t.Fatalf("create over quota: %s", st)
+	}
+	quotas, err := m.ListQuotas()
+	if err != nil {
+		t.Fatalf("list quotas: %s", err)
+	}
+	if q := quotas[42]; q == nil || *q != (Quota{8192, 3, 4096, 3}) {
+		t.Fatalf("quota of project 42: %+v", q)
+	}
+
+	if st := m.Rename(ctx, dir, "f", 1, "f", 0, &inode, attr); st != 0 {
+		t.Fatalf("rename out of project: %s", st)
+	}
+	if st := m.Rename(ctx, 1, "f", dir, "f", 0, &inode, attr); st != 0 {
+		t.Fatalf("rename back into project: %s", st)
+	}
+	if st := m.Create(ctx, 1, "g", 0644, 022, &other, attr); st != 0 {
+		t.Fatalf("create: %s", st)
+	}
+	_ = m.Close(ctx, other)
+	if st := m.Rename(ctx, 1, "g", dir, "g", 0, &other, attr); st != syscall.EXDEV {
+		t.Fatalf("rename into another project: %s", st)
+	}
+	if st := m.Link(ctx, other, dir, "g", attr); st != syscall.EXDEV {
+		t.Fatalf("link into another project: %s", st)
+	}
+	if st := m.Unlink(ctx, 1, "g"); st != 0 {
+		t.Fatalf("unlink: %s", st)
+	}
+
+	if st := m.Unlink(ctx, dir, "f"); st != 0 {
+		t.Fatalf("unlink: %s", st)
+	}
+	if st := m.Rmdir(ctx, dir, "sub"); st != 0 {
+		t.Fatalf("rmdir: %s", st)
+	}
+	if st := m.RemoveXattr(ctx, dir, "project.id"); st != 0 {
+		t.Fatalf("remove project: %s", st)
+	}
+	if st := m.Rmdir(ctx, 1, "prj"); st != 0 {
+		t.Fatalf("rmdir: %s", st)
+	}
+	if quotas, err = m.ListQuotas(); err != nil {
+		t.Fatalf("list quotas: %s", err)
+	}
+	if q := quotas[42]; q == nil || *q != (Quota{8192, 3, 0, 0}) {
+		t.Fatalf("quota of project 42: %+v", q)
+	}
+	if err := m.SetQuota(42, 0, 0); err != nil {
+		t.Fatalf("remove quota: %s", err)
+	}
+}
+
+// outageProxy forwards connections to Redis, which can be broken to simulate an outage.
+type outageProxy struct {
+	sync.Mutex
+	addr  string
+	ln    net.Listener
+	conns []net.Conn
+}
+
+func (p *outageProxy) start() error {
+	ln, err := net.Listen("tcp", p.addr)
+	if err != nil {
+		return err
+	}
+	p.Lock()
+	p.ln, p.addr = ln, ln.Addr().String()
+	p.Unlock()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			s, err := net.Dial("tcp", "127.0.0.1:6379")
+			if err != nil {
+				_ = c.Close()
+				continue
+			}
+			p.Lock()
+			p.conns = append(p.conns, c, s)
+			p.Unlock()
+			go func() { _, _ = io.Copy(s, c); _ = s.Close() }()
+			go func() { _, _ = io.Copy(c, s); _ = c.Close() }()
+		}
+	}()
+	return nil
+}
+
+func (p *outageProxy) stop() {
+	p.Lock()
+	defer p.Unlock()
+	_ = p.ln.Close()
+	for _, c := range p.conns {
+		_ = c.Close()
+	}
+	p.conns = nil
+}
+
+func TestRedisOutage(t *testing.T) {
+	if c, err := net.Dial("tcp", "127.0.0.1:6379"); err != nil {
+		t.Skipf("redis is not available: %s", err)
+	} else {
+		_ = c.Close()
+	}
+	p := &outageProxy{addr: "127.0.0.1:0"}
+	if err := p.start(); err != nil {
+		t.Fatalf("start proxy: %s", err)
+	}
+	defer p.stop()
+	m, err := NewRedisMeta(fmt.Sprintf("redis://%s/15", p.addr), &RedisConfig{Retries: 10, Grace: time.Second * 3})
+	if err != nil {
+		t.Fatalf("create meta: %s", err)
+	}
+	m.(*redisMeta).rdb.FlushDB(Background)
+	_ = m.Init(Format{Name: "test"}, true)
+	ctx := Background
+	var attr Attr
+	if st := m.GetAttr(ctx, 1, &attr); st != 0 {
+		t.Fatalf("getattr: %s", st)
+	}
+
+	p.stop()
+	go func() {
+		time.Sleep(time.Second)
+		if err := p.start(); err != nil {
+			t.Errorf("restart proxy: %s", err)
+		}
+	}()
+	start := time.Now()
+	var inode Ino
+	if st := m.Mkdir(ctx, 1, "d", 0755, 0, 0, &inode, &attr); st != 0 {
+		t.Fatalf("mkdir during outage: %s", st)
+	}
+	if st := m.GetAttr(ctx, inode, &attr); st != 0 {
+		t.Fatalf("getattr during outage: %s", st)
+	}
+	if used := time.Since(start); used < time.Second {
+		t.Fatalf("operations should wait for the recovery, but finished in %s", used)
+	}
+
+	p.stop()
+	start = time.Now()
+	if st := m.GetAttr(ctx, inode, &attr); st != syscall.EIO {
+		t.Fatalf("getattr after grace period: %s", st)
+	}
+	if used := time.Since(start); used < time.Second*3 || used > time.Second*10 {
+		t.Fatalf("operation should fail after the grace period, but it's %s", used)
+	}
+}
+
+func TestNameShard(t *testing.T) {
+	for n := uint32(1); n < 64; n++ {
+		for i := 0; i < 1000; i++ {
+			field := fmt.Sprintf("file%d", i)
+			s := nameShard(field, n)
+			if s >= n {
+				t.Fatalf("shard of %s in %d shards: %d", field, n, s)
+			}
+			// only the entries in the split shard are moved into the new one
+			if s2 := nameShard(field, n+1); s2 != s && s2 != n {
+				t.Fatalf("shard of %s is changed from %d to %d after split %d shards", field, s, s2, n)
+			}
+		}
+	}
+}
+
+func TestDirShards(t *testing.T) {
+	m, err := NewRedisMeta("redis://127.0.0.1/15", &RedisConfig{})
+	if err != nil {
+		t.Logf("redis is not available: %s", err)
+		t.Skip()
+	}
+	r := m.(*redisMeta)
+	r.rdb.FlushDB(Background)
+	_ = m.Init(Format{Name: "test", DirShards: true}, false)
+	if _, err = m.Load(); err != nil {
+		t.Fatalf("load: %s", err)
+	}
+	old := maxShardEntries
+	maxShardEntries = 10
+	defer func() { maxShardEntries = old }()
+
+	ctx := Background
+	var dir, inode Ino
+	var attr Attr
+	if st := m.Mkdir(ctx, 1, "d", 0755, 0, 0, &dir, &attr); st != 0 {
+		t.Fatalf("mkdir: %s", st)
+	}
+	for i := 0; i < 100; i++ {
+		if st := m.Create(ctx, dir, fmt.Sprintf("f%d", i), 0644, 0, &inode, &attr); st != 0 {
+			t.Fatalf("create: %s", st)
+		}
+	}
+	if st := r.reshard(ctx, dir); st != 0 {
+		t.Fatalf("reshard: %s", st)
+	}
+	if n := parseShards(r.rdb.HGet(ctx, r.entryKey(dir), shardField).Val()); n < 8 {
+		t.Fatalf("number of shards: %d", n)
+	}
+	for i := 0; i < 100; i++ {
+		if st := m.Lookup(ctx, dir, fmt.Sprintf("f%d", i), &inode, &attr); st != 0 {
+			t.Fatalf("lookup f%d: %s", i, st)
+		}
+	}
+	var entries []*Entry
+	if st := m.Readdir(ctx, dir, 0, &entries); st != 0 || len(entries) != 102 {
+		t.Fatalf("readdir: %s %d", st, len(entries))
+	}
+	if st := m.Rmdir(ctx, 1, "d"); st != syscall.ENOTEMPTY {
+		t.Fatalf("rmdir: %s", st)
+	}
+	if st := m.Rename(ctx, dir, "f1", dir, "g1", 0, &inode, &attr); st != 0 {
+		t.Fatalf("rename: %s", st)
+	}
+	if st := m.Rename(ctx, dir, "g1", dir, "f2", 0, &inode, &attr); st != 0 {
+		t.Fatalf("rename over: %s", st)
+	}
+	if st := m.Unlink(ctx, dir, "f2"); st != 0 {
+		t.Fatalf("unlink: %s", st)
+	}
+	for i := 3; i < 100; i++ {
+		if st := m.Unlink(ctx, dir, fmt.Sprintf("f%d", i)); st != 0 {
+			t.Fatalf("unlink f%d: %s", i, st)
+		}
+	}
+	if st := m.Lookup(ctx, dir, "f0", &inode, &attr); st != 0 {
+		t.Fatalf("lookup f0: %s", st)
+	}
+	if st := r.reshard(ctx, dir); st != 0 {
+		t.Fatalf("reshard: %s", st)
+	}
+	if n := parseShards(r.rdb.HGet(ctx, r.entryKey(dir), shardField).Val()); n != 1 {
+		t.Fatalf("number of shards after merged: %d", n)
+	}
+	if st := m.Unlink(ctx, dir, "f0"); st != 0 {
+		t.Fatalf("unlink f0: %s", st)
+	}
+	if st := m.Rmdir(ctx, 1, "d"); st != 0 {
+		t.Fatalf("rmdir: %s", st)
+	}
+}
+
+func TestDirShardsThreshold(t *testing.T) {
+	m, err := NewRedisMeta("redis://127.0.0.1/15", &RedisConfig{})
+	if err != nil {
+		t.Logf("redis is not available: %s", err)
+		t.Skip()
+	}
+	r := m.(*redisMeta)
+	r.rdb.FlushDB(Background)
+	_ = m.Init(Format{Name: "test"}, false)
+	format, err := m.Load()
+	if err != nil {
+		t.Fatalf("load: %s", err)
+	}
+	old := maxShardEntries
+	maxShardEntries = 10
+	defer func() { maxShardEntries = old }()
+
+	ctx := Background
+	var dir, inode Ino
+	var attr Attr
+	if st := m.Mkdir(ctx, 1, "d", 0755, 0, 0, &dir, &attr); st != 0 {
+		t.Fatalf("mkdir: %s", st)
+	}
+	shards := func() uint32 {
+		return parseShards(r.rdb.HGet(ctx, r.entryKey(dir), shardField).Val())
+	}
+	for i := 0; i < 50; i++ {
+		if st := m.Create(ctx, dir, fmt.Sprintf("f%d", i), 0644, 0, &inode, &attr); st != 0 {
+			t.Fatalf("create: %s", st)
+		}
+	}
+	time.Sleep(time.Millisecond * 100)
+	if n := shards(); n != 1 {
+		t.Fatalf("directory is split without DirShards: %d shards", n)
+	}
+
+	format.DirShards = true
+	format.SetFeatures()
+	if err = m.UpdateFormat(*format); err != nil {
+		t.Fatalf("update format: %s", err)
+	}
+	if err = r.loadSetting(false); err != nil || !r.dirShards {
+		t.Fatalf("load setting: %s", err)
+	}
+	for i := 50; i < 100; i++ {
+		if st := m.Create(ctx, dir, fmt.Sprintf("f%d", i), 0644, 0, &inode, &attr); st != 0 {
+			t.Fatalf("create: %s", st)
+		}
+	}
+	for i := 0; shards() < 8; i++ {
+		if i > 50 {
+			t.Fatalf("directory is not split over the threshold: %d shards", shards())
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+	var entries []*Entry
+	if st := m.Readdir(ctx, dir, 0, &entries); st != 0 || len(entries) != 102 {
+		t.Fatalf("readdir: %s %d", st, len(entries))
+	}
+}
+
+func TestRedisTxnRetry(t *testing.T) {
+	// a fake Redis breaks the connection at the first WATCH and at EXEC
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+	defer ln.Close()
+	var watches, execs int32
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				buf := make([]byte, 4096)
+				for {
+					n, err := c.Read(buf)
+					if err != nil {
+						return
+					}
+					req := string(buf[:n])
+					switch {
+					case strings.Contains(req, "exec"):
+						atomic.AddInt32(&execs, 1)
+						return
+					case strings.Contains(req, "watch"):
+						if atomic.AddInt32(&watches, 1) == 1 {
+							return
+						}
+						_, _ = c.Write([]byte("+OK\r\n"))
+					default:
+						_, _ = c.Write([]byte("-ERR unknown command\r\n"))
+					}
+				}
+			}()
+		}
+	}()
+	m, err := NewRedisMeta("redis://"+ln.Addr().String(), &RedisConfig{Grace: time.Second * 3})
+	if err != nil {
+		t.Fatalf("create meta: %s", err)
+	}
+	r := m.(*redisMeta)
+	st := r.txn(Background, func(tx *redis.Tx) error {
+		_, err := tx.TxPipelined(Background, func(pipe redis.Pipeliner) error {
+			pipe.Set(Background, "k", "v", 0)
+			return nil
+		})
+		return err
+	}, "k")
+	if st != syscall.EIO {
+		t.Fatalf("txn should fail after EXEC is sent: %s", st)
+	}
+	if w, e := atomic.LoadInt32(&watches), atomic.LoadInt32(&execs); w != 2 || e != 1 {
+		t.Fatalf("the transaction should be retried before EXEC only: %d watches, %d execs", w, e)
+	}
+}
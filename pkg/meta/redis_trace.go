@@ -0,0 +1,125 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package meta
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/juicedata/juicefs/pkg/trace"
+)
+
+// slowCommand is the latency over which a Redis command is logged with the trace id
+// of the operation, it can be correlated with the SLOWLOG of Redis by the client name.
+const slowCommand = time.Millisecond * 200
+
+type hookState struct {
+	ctx   context.Context
+	start time.Time
+}
+
+type hookKey struct{}
+
+// traceHook logs the slow commands with the trace id of the operation sending them.
+type traceHook struct{}
+
+func (traceHook) before(ctx context.Context) context.Context {
+	return context.WithValue(ctx, hookKey{}, &hookState{ctx, time.Now()})
+}
+
+func (traceHook) after(ctx context.Context, what func() string, err error) {
+	st, ok := ctx.Value(hookKey{}).(*hookState)
+	if !ok {
+		return
+	}
+	if used := time.Since(st.start); used > slowCommand {
+		logger.Infof("slow redis command: %s (%v, %.3fs, trace %s)", what(), err, used.Seconds(), trace.IDOf(st.ctx))
+	}
+}
+
+func cmdString(cmd redis.Cmder) string {
+	args := cmd.Args()
+	if len(args) > 2 {
+		args = args[:2]
+	}
+	s := make([]string, len(args))
+	for i, a := range args {
+		s[i] = fmt.Sprint(a)
+	}
+	return strings.Join(s, " ")
+}
+
+func (h traceHook) BeforeProcess(ctx context.Context, cmd redis.Cmder) (context.Context, error) {
+	return h.before(ctx), nil
+}
+
+func (h traceHook) AfterProcess(ctx context.Context, cmd redis.Cmder) error {
+	h.after(ctx, func() string { return cmdString(cmd) }, cmd.Err())
+	return nil
+}
+
+func (h traceHook) BeforeProcessPipeline(ctx context.Context, cmds []redis.Cmder) (context.Context, error) {
+	return h.before(ctx), nil
+}
+
+func (h traceHook) AfterProcessPipeline(ctx context.Context, cmds []redis.Cmder) error {
+	var err error
+	for _, cmd := range cmds {
+		if cmd.Err() != nil && cmd.Err() != redis.Nil {
+			err = cmd.Err()
+			break
+		}
+	}
+	h.after(ctx, func() string {
+		s := make([]string, 0, len(cmds))
+		for _, cmd := range cmds {
+			s = append(s, cmdString(cmd))
+		}
+		return fmt.Sprintf("pipeline [%s]", strings.Join(s, ", "))
+	}, err)
+	return nil
+}
+
+// clientName is the name of the connections to Redis, which is shown in CLIENT LIST
+// and the entries of SLOWLOG.
+func clientName() string {
+	host, _ := os.Hostname()
+	return fmt.Sprintf("juicefs:%s:%d", strings.Replace(host, " ", "_", -1), os.Getpid())
+}
+
+// setupTrace names the connections and logs the slow commands of the client.
+func setupTrace(rdb *redis.Client) {
+	name := clientName()
+	o := rdb.Options()
+	onConnect := o.OnConnect
+	o.OnConnect = func(ctx context.Context, cn *redis.Conn) error {
+		if onConnect != nil {
+			if err := onConnect(ctx, cn); err != nil {
+				return err
+			}
+		}
+		// it's not supported by some Redis compatible servers
+		if err := cn.ClientSetName(ctx, name).Err(); err != nil {
+			logger.Debugf("set client name %s: %s", name, err)
+		}
+		return nil
+	}
+	rdb.AddHook(traceHook{})
+}
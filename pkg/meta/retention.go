@@ -0,0 +1,68 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package meta
+
+import (
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// A retention policy is set on a directory (or a file) by the extended attribute
+// juicefs.retention, the value is the time until which it's retained, in unix seconds
+// or RFC3339. Before the time, the entries in a retained directory can't be removed
+// or renamed, and the files and directories created inside it inherit the policy.
+// The content of a retained file can't be changed once it's closed by the creator.
+// The retention can be extended, but not shortened or removed before it passes.
+const RetentionXattr = "juicefs.retention"
+
+// parseRetention returns the retention time in unix seconds.
+func parseRetention(value []byte) (int64, syscall.Errno) {
+	s := strings.TrimSpace(string(value))
+	if until, err := strconv.ParseInt(s, 10, 64); err == nil && until >= 0 {
+		return until, 0
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return 0, syscall.EINVAL
+	}
+	return t.Unix(), 0
+}
+
+// retentionActive returns true if the retention in the value of extended attribute has not passed.
+func retentionActive(value []byte) bool {
+	until, st := parseRetention(value)
+	return st == 0 && until > time.Now().Unix()
+}
+
+// checkRetention validates a new retention against the current one (nil if not set),
+// and returns the normalized value to be stored.
+func checkRetention(ctx Context, owner uint32, old, value []byte) ([]byte, syscall.Errno) {
+	if ctx.Uid() != 0 && ctx.Uid() != owner {
+		return nil, syscall.EPERM
+	}
+	until, st := parseRetention(value)
+	if st != 0 {
+		return nil, st
+	}
+	if old != nil && retentionActive(old) {
+		if cur, _ := parseRetention(old); until < cur {
+			return nil, syscall.EPERM
+		}
+	}
+	return []byte(strconv.FormatInt(until, 10)), 0
+}
@@ -0,0 +1,166 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package meta
+
+import (
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestParseRetention(t *testing.T) {
+	if until, st := parseRetention([]byte("1700000000\n")); st != 0 || until != 1700000000 {
+		t.Fatalf("parse unix seconds: %d %s", until, st)
+	}
+	if until, st := parseRetention([]byte("2023-11-14T22:13:20Z")); st != 0 || until != 1700000000 {
+		t.Fatalf("parse RFC3339: %d %s", until, st)
+	}
+	if _, st := parseRetention([]byte("tomorrow")); st != syscall.EINVAL {
+		t.Fatalf("parse invalid retention: %s", st)
+	}
+	if retentionActive([]byte("1700000000")) {
+		t.Fatalf("passed retention should not be active")
+	}
+}
+
+func TestRetention(t *testing.T) {
+	testRetention(t, newMemClient(t))
+	m, err := NewRedisMeta("redis://127.0.0.1/15", &RedisConfig{})
+	if err != nil {
+		t.Logf("redis is not available: %s", err)
+		t.Skip()
+	}
+	m.(*redisMeta).rdb.FlushDB(Background)
+	testRetention(t, m)
+}
+
+func testRetention(t *testing.T, m Meta) {
+	if err := m.Init(Format{Name: "test"}, true); err != nil {
+		t.Fatalf("init: %s", err)
+	}
+	if _, err := m.Load(); err != nil {
+		t.Fatalf("load: %s", err)
+	}
+	ctx := Background
+	var dir, sub, f, old Ino
+	attr := &Attr{}
+	if st := m.Mkdir(ctx, 1, "archive", 0777, 022, 0, &dir, attr); st != 0 {
+		t.Fatalf("mkdir: %s", st)
+	}
+	if st := m.Create(ctx, dir, "old", 0644, 022, &old, attr); st != 0 {
+		t.Fatalf("create old: %s", st)
+	}
+	m.Close(ctx, old)
+
+	until := []byte(strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10))
+	if st := m.SetXattr(NewContext(1, 1000, []uint32{1000}), dir, RetentionXattr, until); st != syscall.EPERM {
+		t.Fatalf("set retention by others: %s", st)
+	}
+	if st := m.SetXattr(ctx, dir, RetentionXattr, []byte("soon")); st != syscall.EINVAL {
+		t.Fatalf("set invalid retention: %s", st)
+	}
+	if st := m.SetXattr(ctx, dir, RetentionXattr, []byte(time.Now().Add(time.Hour).UTC().Format(time.RFC3339))); st != 0 {
+		t.Fatalf("set retention: %s", st)
+	}
+	if f, err := m.Load(); err != nil || len(f.WriteFeatures) != 1 || f.WriteFeatures[0] != FeatureRetention {
+		t.Fatalf("feature of retention is not recorded: %+v %s", f, err)
+	}
+	if st := m.SetXattr(ctx, dir, RetentionXattr, []byte(strconv.FormatInt(time.Now().Unix(), 10))); st != syscall.EPERM {
+		t.Fatalf("shorten retention: %s", st)
+	}
+	if st := m.SetXattr(ctx, dir, RetentionXattr, until); st != 0 {
+		t.Fatalf("extend retention: %s", st)
+	}
+	if st := m.RemoveXattr(ctx, dir, RetentionXattr); st != syscall.EPERM {
+		t.Fatalf("remove active retention: %s", st)
+	}
+
+	// the existing files can't be removed or renamed, but still can be written
+	if st := m.Unlink(ctx, dir, "old"); st != syscall.EPERM {
+		t.Fatalf("unlink old: %s", st)
+	}
+	if st := m.Rename(ctx, dir, "old", 1, "old", 0, nil, attr); st != syscall.EPERM {
+		t.Fatalf("rename old: %s", st)
+	}
+	if st := m.Truncate(ctx, old, 0, 100, attr); st != 0 {
+		t.Fatalf("truncate old: %s", st)
+	}
+
+	// the new files inherit the retention and can be written until closed
+	if st := m.Mkdir(ctx, dir, "sub", 0755, 022, 0, &sub, attr); st != 0 {
+		t.Fatalf("mkdir sub: %s", st)
+	}
+	if attr.Flags&FlagRetention == 0 {
+		t.Fatalf("sub should inherit the retention: %+v", attr)
+	}
+	if st := m.Create(ctx, sub, "f", 0644, 022, &f, attr); st != 0 {
+		t.Fatalf("create f: %s", st)
+	}
+	var value []byte
+	if st := m.GetXattr(ctx, f, RetentionXattr, &value); st != 0 || string(value) != string(until) {
+		t.Fatalf("retention of f: %s %s", value, st)
+	}
+	if st := m.Write(ctx, f, 0, 0, Slice{Chunkid: 1, Size: 100, Len: 100}); st != 0 {
+		t.Fatalf("write f: %s", st)
+	}
+	m.Close(ctx, f)
+	if st := m.Write(ctx, f, 0, 0, Slice{Chunkid: 2, Size: 100, Len: 100}); st != syscall.EPERM {
+		t.Fatalf("write closed f: %s", st)
+	}
+	if st := m.Truncate(ctx, f, 0, 0, attr); st != syscall.EPERM {
+		t.Fatalf("truncate closed f: %s", st)
+	}
+	if st := m.Open(ctx, f, syscall.O_WRONLY, attr); st != syscall.EPERM {
+		t.Fatalf("open closed f for write: %s", st)
+	}
+	if st := m.Open(ctx, f, syscall.O_RDONLY, attr); st != 0 {
+		t.Fatalf("open closed f for read: %s", st)
+	}
+	m.Close(ctx, f)
+	attr.Flags = 0
+	if st := m.SetAttr(ctx, f, SetAttrFlag, 0, attr); st != 0 || attr.Flags&FlagRetention == 0 {
+		t.Fatalf("clear flags of f: %s %+v", st, attr)
+	}
+	if st := m.Unlink(ctx, sub, "f"); st != syscall.EPERM {
+		t.Fatalf("unlink f: %s", st)
+	}
+	var tmp Ino
+	if st := m.Create(ctx, 1, "tmp", 0644, 022, &tmp, attr); st != 0 {
+		t.Fatalf("create tmp: %s", st)
+	}
+	m.Close(ctx, tmp)
+	if st := m.Rename(ctx, 1, "tmp", sub, "f", 0, nil, attr); st != syscall.EPERM {
+		t.Fatalf("overwrite f: %s", st)
+	}
+	if st := m.Rmdir(ctx, sub, "missing"); st != syscall.ENOENT {
+		t.Fatalf("rmdir missing: %s", st)
+	}
+
+	// the retention passed
+	if st := m.SetXattr(ctx, tmp, RetentionXattr, []byte("1700000000")); st != 0 {
+		t.Fatalf("set passed retention: %s", st)
+	}
+	if st := m.Truncate(ctx, tmp, 0, 100, attr); st != 0 {
+		t.Fatalf("truncate tmp after retention: %s", st)
+	}
+	if st := m.RemoveXattr(ctx, tmp, RetentionXattr); st != 0 {
+		t.Fatalf("remove passed retention: %s", st)
+	}
+	if st := m.GetAttr(ctx, tmp, attr); st != 0 || attr.Flags&FlagRetention != 0 {
+		t.Fatalf("flags of tmp: %s %+v", st, attr)
+	}
+}
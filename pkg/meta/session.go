@@ -0,0 +1,73 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package meta
+
+import (
+	"net"
+	"os"
+	"sort"
+	"time"
+)
+
+// SessionInfo is the information of a client recorded with its session for auditing.
+type SessionInfo struct {
+	Sid         uint64
+	Hostname    string
+	IPs         []string // reported by the client
+	Addr        string   // the address of the client seen by the metadata engine, empty if unknown
+	ProcessID   int
+	Started     time.Time
+	MetaVersion int      // the latest version of metadata supported by the client
+	Features    []string // the features supported by the client
+	// the HoldDeletionUntil of format applied by the client, it deletes no data before that
+	HoldDeletionUntil int64
+	Heartbeat         time.Time // filled by ListSessions
+}
+
+// localIPs returns the addresses of this host, the loopback ones are used only
+// if there is no other address.
+func localIPs() []string {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		logger.Warnf("list addresses: %s", err)
+	}
+	var ips, loopback []string
+	for _, a := range addrs {
+		n, ok := a.(*net.IPNet)
+		if !ok || n.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		if n.IP.IsLoopback() {
+			loopback = append(loopback, n.IP.String())
+		} else {
+			ips = append(ips, n.IP.String())
+		}
+	}
+	if len(ips) == 0 {
+		return loopback
+	}
+	return ips
+}
+
+func newSessionInfo(sid uint64, addr string) *SessionInfo {
+	host, _ := os.Hostname()
+	return &SessionInfo{Sid: sid, Hostname: host, IPs: localIPs(), Addr: addr, ProcessID: os.Getpid(), Started: time.Now(),
+		MetaVersion: MetaVersion, Features: SupportedFeatures}
+}
+
+func sortSessions(sessions []*SessionInfo) {
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].Sid < sessions[j].Sid })
+}
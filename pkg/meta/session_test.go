@@ -0,0 +1,134 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package meta
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/jobs"
+)
+
+func TestAllowedNetworks(t *testing.T) {
+	if _, err := ParseNetworks([]string{"10.0.0.0/8", "192.168.1.1", "fd00::/8"}); err != nil {
+		t.Fatalf("parse networks: %s", err)
+	}
+	if _, err := ParseNetworks([]string{"10.0.0.0/33"}); err == nil {
+		t.Fatalf("invalid CIDR should be rejected")
+	}
+	f := Format{Name: "test", AllowedNetworks: []string{"10.0.0.0/8", "192.168.1.1"}}
+	if err := f.checkNetwork("10.1.2.3"); err != nil {
+		t.Fatalf("client in 10.0.0.0/8: %s", err)
+	}
+	if err := f.checkNetwork("192.168.1.2"); err == nil {
+		t.Fatalf("client out of allowed networks should be rejected")
+	}
+	if err := f.checkNetwork("/tmp/redis.sock"); err == nil {
+		t.Fatalf("client through unix socket should be rejected")
+	}
+
+	// the address of client can't be verified
+	if err := newMemClient(t).Init(Format{Name: "test", AllowedNetworks: []string{"127.0.0.1"}}, false); err == nil {
+		t.Fatalf("allowed networks should not be supported by memkv")
+	}
+
+	m, err := NewRedisMeta("redis://127.0.0.1/15", &RedisConfig{})
+	if err != nil {
+		t.Logf("redis is not available: %s", err)
+		t.Skip()
+	}
+	m.(*redisMeta).rdb.FlushDB(Background)
+	if err := m.Init(Format{Name: "test", AllowedNetworks: []string{"240.0.0.1"}}, false); err != nil {
+		t.Fatalf("init: %s", err)
+	}
+	if err := m.NewSession(); err == nil {
+		t.Fatalf("session out of allowed networks should be rejected")
+	}
+	if err := m.Init(Format{Name: "test", AllowedNetworks: []string{"127.0.0.0/8", "::1"}}, false); err != nil {
+		t.Fatalf("update allowed networks: %s", err)
+	}
+	if err := m.NewSession(); err != nil {
+		t.Fatalf("session in allowed networks: %s", err)
+	}
+	sessions, err := m.ListSessions()
+	if err != nil || len(sessions) != 1 || sessions[0].Addr != "127.0.0.1" {
+		t.Fatalf("list sessions: %+v %s", sessions, err)
+	}
+}
+
+func TestListSessions(t *testing.T) {
+	testListSessions(t, newMemClient(t))
+	m, err := NewRedisMeta("redis://127.0.0.1/15", &RedisConfig{})
+	if err != nil {
+		t.Logf("redis is not available: %s", err)
+		t.Skip()
+	}
+	m.(*redisMeta).rdb.FlushDB(Background)
+	testListSessions(t, m)
+}
+
+func testListSessions(t *testing.T, m Meta) {
+	if err := m.Init(Format{Name: "test"}, false); err != nil {
+		t.Fatalf("init: %s", err)
+	}
+	if err := m.NewSession(); err != nil {
+		t.Fatalf("new session: %s", err)
+	}
+	sessions, err := m.ListSessions()
+	if err != nil || len(sessions) != 1 {
+		t.Fatalf("list sessions: %+v %s", sessions, err)
+	}
+	host, _ := os.Hostname()
+	s := sessions[0]
+	if s.Sid == 0 || s.Hostname != host || s.ProcessID != os.Getpid() || len(s.IPs) == 0 || time.Since(s.Started) > time.Minute {
+		t.Fatalf("session info: %+v", s)
+	}
+}
+
+func TestHoldDeletion(t *testing.T) {
+	m := newMemClient(t)
+	until := time.Now().Add(time.Minute).Unix()
+	if err := m.Init(Format{Name: "test", HoldDeletionUntil: until}, true); err != nil {
+		t.Fatalf("init: %s", err)
+	}
+	defer jobs.Hold(time.Time{}, deletionJobs...)
+	if err := m.Init(Format{Name: "test", Capacity: 1 << 30}, false); err != nil {
+		t.Fatalf("update format during backup: %s", err)
+	}
+	if err := m.NewSession(); err != nil {
+		t.Fatalf("new session: %s", err)
+	}
+	sessions, err := m.ListSessions()
+	if err != nil || len(sessions) != 1 || sessions[0].HoldDeletionUntil != until {
+		t.Fatalf("the hold should be acknowledged: %+v %s", sessions, err)
+	}
+
+	format, err := m.Load()
+	if err != nil || format.HoldDeletionUntil != until {
+		t.Fatalf("the hold should be kept: %+v %s", format, err)
+	}
+	format.HoldDeletionUntil = 0
+	if err = m.UpdateFormat(*format); err != nil {
+		t.Fatalf("release the hold: %s", err)
+	}
+	if err = m.(*kvMeta).loadSetting(false); err != nil {
+		t.Fatalf("reload setting: %s", err)
+	}
+	if sessions, err = m.ListSessions(); err != nil || sessions[0].HoldDeletionUntil != 0 {
+		t.Fatalf("the release should be acknowledged: %+v %s", sessions, err)
+	}
+}
@@ -0,0 +1,42 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package meta
+
+// ShrinkStats are the results of Shrink.
+type ShrinkStats struct {
+	Chunks  uint64 // number of chunks rewritten
+	Slices  uint64 // number of hidden slices dropped from the chunks
+	Orphans uint64 // number of leftover keys of removed nodes
+	Hashes  uint64 // number of hashes rewritten into compact encoding (Redis only)
+}
+
+// hiddenSlices returns the indexes of the slices in a chunk which are totally covered by the newer
+// ones, they can be dropped without changing the content of the chunk.
+func hiddenSlices(vals []string) []int {
+	visible := make(map[Slice]bool)
+	for _, s := range buildSlice(readSlices(vals)) {
+		if s.Chunkid > 0 {
+			visible[Slice{Chunkid: s.Chunkid, Size: s.Size}] = true
+		}
+	}
+	var hidden []int
+	for i, s := range readSlices(vals) {
+		if s.chunkid > 0 && !visible[Slice{Chunkid: s.chunkid, Size: s.size}] {
+			hidden = append(hidden, i)
+		}
+	}
+	return hidden
+}
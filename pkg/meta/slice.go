@@ -15,7 +15,11 @@
 
 package meta
 
-import "github.com/juicedata/juicefs/pkg/utils"
+import (
+	"sync"
+
+	"github.com/juicedata/juicefs/pkg/utils"
+)
 
 type slice struct {
 	chunkid uint64
@@ -27,11 +31,11 @@ type slice struct {
 	right   *slice
 }
 
-func newSlice(pos uint32, chunkid uint64, cleng, off, len uint32) *slice {
+func newSlice(a *sliceArena, pos uint32, chunkid uint64, cleng, off, len uint32) *slice {
 	if len == 0 {
 		return nil
 	}
-	s := &slice{}
+	s := a.alloc()
 	s.pos = pos
 	s.chunkid = chunkid
 	s.size = cleng
@@ -42,37 +46,41 @@ func newSlice(pos uint32, chunkid uint64, cleng, off, len uint32) *slice {
 	return s
 }
 
-func (s *slice) read(buf []byte) {
-	rb := utils.ReadBuffer(buf)
-	s.pos = rb.Get32()
-	s.chunkid = rb.Get64()
-	s.size = rb.Get32()
-	s.off = rb.Get32()
-	s.len = rb.Get32()
+// read decodes a slice from the value stored in meta engine without copying it.
+func (s *slice) read(val string) {
+	s.pos = get32(val, 0)
+	s.chunkid = uint64(get32(val, 4))<<32 | uint64(get32(val, 8))
+	s.size = get32(val, 12)
+	s.off = get32(val, 16)
+	s.len = get32(val, 20)
+}
+
+func get32(val string, off int) uint32 {
+	return uint32(val[off])<<24 | uint32(val[off+1])<<16 | uint32(val[off+2])<<8 | uint32(val[off+3])
 }
 
-func (s *slice) cut(pos uint32) (left, right *slice) {
+func (s *slice) cut(a *sliceArena, pos uint32) (left, right *slice) {
 	if s == nil {
 		return nil, nil
 	}
 	if pos <= s.pos {
 		if s.left == nil {
-			s.left = newSlice(pos, 0, 0, 0, s.pos-pos)
+			s.left = newSlice(a, pos, 0, 0, 0, s.pos-pos)
 		}
-		left, s.left = s.left.cut(pos)
+		left, s.left = s.left.cut(a, pos)
 		return left, s
 	} else if pos < s.pos+s.len {
 		l := pos - s.pos
-		right = newSlice(pos, s.chunkid, s.size, s.off+l, s.len-l)
+		right = newSlice(a, pos, s.chunkid, s.size, s.off+l, s.len-l)
 		right.right = s.right
 		s.len = l
 		s.right = nil
 		return s, right
 	} else {
 		if s.right == nil {
-			s.right = newSlice(s.pos+s.len, 0, 0, 0, pos-s.pos-s.len)
+			s.right = newSlice(a, s.pos+s.len, 0, 0, 0, pos-s.pos-s.len)
 		}
-		s.right, right = s.right.cut(pos)
+		s.right, right = s.right.cut(a, pos)
 		return s, right
 	}
 }
@@ -87,8 +95,10 @@ func (s *slice) visit(f func(*slice)) {
 	right.visit(f)
 }
 
+const sliceBytes = 24
+
 func marshalSlice(pos uint32, chunkid uint64, size, off, len uint32) []byte {
-	w := utils.NewBuffer(24)
+	w := utils.NewBuffer(sliceBytes)
 	w.Put32(pos)
 	w.Put64(chunkid)
 	w.Put32(size)
@@ -97,13 +107,125 @@ func marshalSlice(pos uint32, chunkid uint64, size, off, len uint32) []byte {
 	return w.Bytes()
 }
 
+// readSlices decodes all the slices of a chunk, all of them share the same backing array.
 func readSlices(vals []string) []*slice {
 	slices := make([]slice, len(vals))
 	ss := make([]*slice, len(vals))
 	for i, val := range vals {
 		s := &slices[i]
-		s.read([]byte(val))
+		s.read(val)
 		ss[i] = s
 	}
 	return ss
 }
+
+// sliceBlock is the number of slices allocated together in an arena.
+const sliceBlock = 64
+
+// sliceArena allocates the slices of a chunk in blocks, which are reused by the next chunk
+// after release(). The slices and the tree built from them must not be used after that.
+type sliceArena struct {
+	blocks [][]slice
+	cur    int // index of the block in use
+	used   int // slices used in the current block
+	ss     []*slice
+}
+
+var arenaPool = sync.Pool{
+	New: func() interface{} {
+		return &sliceArena{}
+	},
+}
+
+func newSliceArena() *sliceArena {
+	return arenaPool.Get().(*sliceArena)
+}
+
+// alloc returns a zeroed slice, it falls back to the heap for a nil arena.
+func (a *sliceArena) alloc() *slice {
+	if a == nil {
+		return &slice{}
+	}
+	if a.used == sliceBlock {
+		a.cur++
+		a.used = 0
+	}
+	if a.cur == len(a.blocks) {
+		a.blocks = append(a.blocks, make([]slice, sliceBlock))
+	}
+	s := &a.blocks[a.cur][a.used]
+	*s = slice{}
+	a.used++
+	return s
+}
+
+// readSlices decodes all the slices of a chunk into the arena.
+func (a *sliceArena) readSlices(vals []string) []*slice {
+	for _, val := range vals {
+		s := a.alloc()
+		s.read(val)
+		a.ss = append(a.ss, s)
+	}
+	return a.ss
+}
+
+// readSliceBuf decodes all the slices of a chunk stored in a single value into the arena.
+func (a *sliceArena) readSliceBuf(buf []byte) []*slice {
+	str := string(buf)
+	for i := 0; i+sliceBytes <= len(str); i += sliceBytes {
+		s := a.alloc()
+		s.read(str[i : i+sliceBytes])
+		a.ss = append(a.ss, s)
+	}
+	return a.ss
+}
+
+func (a *sliceArena) release() {
+	if len(a.blocks) > 64 {
+		return // too large to be kept
+	}
+	a.cur, a.used = 0, 0
+	a.ss = a.ss[:0]
+	arenaPool.Put(a)
+}
+
+func buildSlice(ss []*slice) []Slice {
+	return buildSliceIn(nil, ss)
+}
+
+// buildSliceIn builds the slices of a chunk, the new slices cut from the overlapped ones
+// are allocated in the arena (or heap if it's nil).
+func buildSliceIn(a *sliceArena, ss []*slice) []Slice {
+	var root *slice
+	for _, s := range ss {
+		if root != nil {
+			var right *slice
+			s.left, right = root.cut(a, s.pos)
+			_, s.right = right.cut(a, s.pos+s.len)
+		}
+		root = s
+	}
+	var pos uint32
+	var chunks []Slice
+	root.visit(func(s *slice) {
+		if s.pos > pos {
+			chunks = appendSlice(chunks, Slice{Size: s.pos - pos, Len: s.pos - pos})
+			pos = s.pos
+		}
+		chunks = appendSlice(chunks, Slice{Chunkid: s.chunkid, Size: s.size, Off: s.off, Len: s.len})
+		pos += s.len
+	})
+	return chunks
+}
+
+// appendSlice merges s into the last one in place if they are adjacent parts of the same chunk.
+func appendSlice(chunks []Slice, s Slice) []Slice {
+	if n := len(chunks); n > 0 {
+		last := &chunks[n-1]
+		if last.Chunkid > 0 && last.Chunkid == s.Chunkid && last.Size == s.Size && last.Off+last.Len == s.Off {
+			last.Len += s.Len
+			return chunks
+		}
+	}
+	return append(chunks, s)
+}
@@ -0,0 +1,45 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package meta
+
+import (
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// Tags are simple key=value labels of files and directories, which are kept
+// apart from extended attributes. Every tag is also indexed by its key, so the
+// nodes with a tag can be found without scanning the tree. The tags of a node
+// are removed together with it, but the index is cleaned lazily: the entries
+// of removed nodes are dropped when they are found by a search.
+
+const (
+	maxTagKey   = 255
+	maxTagValue = 4096
+)
+
+// checkTag returns EINVAL if the key or value can't be used as a tag.
+func checkTag(key, value string) syscall.Errno {
+	if key == "" || len(key) > maxTagKey || strings.ContainsAny(key, "=\x00") || len(value) > maxTagValue {
+		return syscall.EINVAL
+	}
+	return 0
+}
+
+func sortInodes(inodes []Ino) {
+	sort.Slice(inodes, func(i, j int) bool { return inodes[i] < inodes[j] })
+}
@@ -0,0 +1,105 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package meta
+
+import (
+	"reflect"
+	"syscall"
+	"testing"
+)
+
+func TestTags(t *testing.T) {
+	testTags(t, newMemClient(t))
+	m, err := NewRedisMeta("redis://127.0.0.1/15", &RedisConfig{})
+	if err != nil {
+		t.Logf("redis is not available: %s", err)
+		t.Skip()
+	}
+	m.(*redisMeta).rdb.FlushDB(Background)
+	testTags(t, m)
+}
+
+func testTags(t *testing.T, m Meta) {
+	if err := m.Init(Format{Name: "test"}, true); err != nil {
+		t.Fatalf("init: %s", err)
+	}
+	if _, err := m.Load(); err != nil {
+		t.Fatalf("load: %s", err)
+	}
+	ctx := Background
+	var dir, f1, f2 Ino
+	var attr = &Attr{}
+	if st := m.Mkdir(ctx, 1, "d", 0755, 022, 0, &dir, attr); st != 0 {
+		t.Fatalf("mkdir: %s", st)
+	}
+	if st := m.Create(ctx, dir, "f1", 0644, 022, &f1, attr); st != 0 {
+		t.Fatalf("create f1: %s", st)
+	}
+	if st := m.Create(ctx, dir, "f2", 0644, 022, &f2, attr); st != 0 {
+		t.Fatalf("create f2: %s", st)
+	}
+	_ = m.Close(ctx, f1)
+	_ = m.Close(ctx, f2)
+
+	if st := m.SetTag(ctx, f1, "a=b", "c"); st != syscall.EINVAL {
+		t.Fatalf("set invalid tag: %s", st)
+	}
+	if st := m.SetTag(ctx, 1000, "dataset", "imagenet"); st != syscall.ENOENT {
+		t.Fatalf("set tag of missing node: %s", st)
+	}
+	for _, ino := range []Ino{dir, f1, f2} {
+		if st := m.SetTag(ctx, ino, "dataset", "coco"); st != 0 {
+			t.Fatalf("set tag: %s", st)
+		}
+	}
+	if st := m.SetTag(ctx, f1, "dataset", "imagenet"); st != 0 {
+		t.Fatalf("replace tag: %s", st)
+	}
+	if st := m.SetTag(ctx, f1, "split", ""); st != 0 {
+		t.Fatalf("set tag without value: %s", st)
+	}
+	var tags map[string]string
+	if st := m.GetTags(ctx, f1, &tags); st != 0 || !reflect.DeepEqual(tags, map[string]string{"dataset": "imagenet", "split": ""}) {
+		t.Fatalf("get tags: %s %v", st, tags)
+	}
+	var inodes []Ino
+	if st := m.SearchTag(ctx, "dataset", "", &inodes); st != 0 || !reflect.DeepEqual(inodes, []Ino{dir, f1, f2}) {
+		t.Fatalf("search key: %s %v", st, inodes)
+	}
+	if st := m.SearchTag(ctx, "dataset", "coco", &inodes); st != 0 || !reflect.DeepEqual(inodes, []Ino{dir, f2}) {
+		t.Fatalf("search key=value: %s %v", st, inodes)
+	}
+
+	if st := m.RemoveTag(ctx, f1, "split"); st != 0 {
+		t.Fatalf("remove tag: %s", st)
+	}
+	if st := m.RemoveTag(ctx, f1, "split"); st != ENOATTR {
+		t.Fatalf("remove missing tag: %s", st)
+	}
+	if st := m.SearchTag(ctx, "split", "", &inodes); st != 0 || len(inodes) != 0 {
+		t.Fatalf("search removed tag: %s %v", st, inodes)
+	}
+
+	if st := m.Unlink(ctx, dir, "f2"); st != 0 {
+		t.Fatalf("unlink f2: %s", st)
+	}
+	if st := m.SearchTag(ctx, "dataset", "coco", &inodes); st != 0 || !reflect.DeepEqual(inodes, []Ino{dir}) {
+		t.Fatalf("search after unlink: %s %v", st, inodes)
+	}
+	if st := m.GetTags(ctx, f2, &tags); st != syscall.ENOENT {
+		t.Fatalf("get tags of removed node: %s", st)
+	}
+}
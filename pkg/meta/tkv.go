@@ -0,0 +1,3791 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package meta
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"reflect"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/jobs"
+	"github.com/juicedata/juicefs/pkg/utils"
+)
+
+/*
+	All the keys are binary, inodes and ids are encoded in big endian so they are sorted.
+
+	Setting: setting -> json
+	Counters: C$name -> int64
+	Node: A$inode I -> Attribute{type,mode,uid,gid,atime,mtime,ctime,nlink,length,rdev}
+	Dir: A$inode D$name -> {type,inode}
+	File: A$inode C$indx -> [Slice{pos,id,length,off,len}]
+	Symlink: A$inode S -> target
+	Inline data: A$inode V -> data
+	Xattr: A$inode X$name -> value
+	Tags: A$inode T$key -> value, TG$key=$inode -> value
+	Name index: N{reversed name,0,parent,inode} -> 1
+	Flock: F$inode -> [{sid,owner,ltype}]
+	POSIX lock: P$inode -> [{sid,owner,Plock(pid,ltype,start,end)}]
+	Delegations: E$inode -> [{sid,ltype,recalled,expire}]
+	Sessions: SE$sid -> started, SH$sid -> heartbeat, SI$sid -> info
+	Sustained inodes: SS$sid$inode -> 1
+	Leases: L$name -> {sid,expire}
+	Removed files: D$inode$length -> seconds
+	Slices refs: K$chunkid$size -> refcount
+	Packed blocks: BP$chunkid -> {pack,off,size}, BR$pack -> refcount
+	Deduplicated blocks: BD$chunkid$indx -> {hash,key}, BH$hash -> {refs,key}
+	External chunks: BE$chunkid -> {off,key}
+	Replication: R$op -> {added,lease}
+	Gateway users: IU$accesskey -> user
+	Checkpoints: IC$name -> progress
+	Usage: U$uid -> {space,inodes}, G$gid -> {space,inodes}
+	Project quota: QL$prj -> {space,inodes}, QU$prj -> {space,inodes} (limits and usage)
+*/
+
+const (
+	nextInodeKey   = "nextInode"
+	nextChunkKey   = "nextChunk"
+	nextSessionKey = "nextSession"
+)
+
+// errTxnConflict is returned by the engines when a transaction conflicts with others, it will be retried.
+var errTxnConflict = errors.New("transaction conflict")
+
+// kvTxn is a transaction of key-value store, it panics if the operation fails.
+// The writes are visible to the reads in the same transaction.
+type kvTxn interface {
+	get(key []byte) []byte
+	gets(keys ...[]byte) [][]byte
+	// scanRange returns the keys and values in [begin, end) in order, up to limit items if limit > 0.
+	scanRange(begin, end []byte, limit int) (keys [][]byte, values [][]byte)
+	set(key, value []byte)
+	dels(keys ...[]byte)
+}
+
+// tkvClient is a transactional key-value store used as meta engine.
+type tkvClient interface {
+	name() string
+	// txn runs f in a transaction, errTxnConflict is returned if it should be retried.
+	txn(f func(tx kvTxn) error) error
+}
+
+// leaser is implemented by the engines which can bind a key to the liveness of the client,
+// the key is removed by the engine after ttl if the client is gone.
+type leaser interface {
+	keepAlive(key, value []byte, ttl time.Duration) error
+}
+
+const (
+	sessionTTL   = time.Minute * 3 // lifetime of the heartbeat when the engine supports lease
+	staleSession = time.Minute * 5 // a session without heartbeat for longer than this is stale
+)
+
+type freeID struct {
+	next  uint64
+	maxid uint64
+}
+
+type kvMeta struct {
+	sync.Mutex
+	conf    *RedisConfig
+	client  tkvClient
+	txlocks [1024]sync.Mutex // Pessimistic locks to reduce conflict
+
+	sid          uint64
+	readOnly     bool         // the session is authorized by a read-only token
+	capacity     uint64       // max bytes of data, refreshed with session
+	names        atomic.Value // namePolicy, refreshed with session
+	openFiles    map[Ino]int
+	removedFiles map[Ino]bool
+	writing      map[Ino]bool // retained files created by this client and not closed yet
+	compacting   map[uint64]bool
+	symlinks     *sync.Map
+	msgCallbacks *msgCallbacks
+	delegs       *delegations
+	hot          *hotDirs
+
+	caseInsensitive bool // set when the format is loaded
+	indexNames      bool // set when the format is loaded
+
+	heldUntil int64 // the hold of deletion recorded in the session, see ackHold
+
+	freeMu     sync.Mutex
+	freeInodes freeID
+	freeChunks freeID
+
+	// the changes of counters which are not persisted yet, they are updated
+	// outside of the transactions to avoid conflicts on them.
+	newSpace  int64
+	newInodes int64
+	usedSpace int64 // persisted used space, refreshed every second if capacity is set
+	usageMu   sync.Mutex
+	newUsage  map[string]*Usage // keyed by the usage key of user, group or project
+	quotas    map[uint32]*Quota // persisted quotas of projects, refreshed every second
+}
+
+var _ Meta = &kvMeta{}
+
+func newKVMeta(client tkvClient, conf *RedisConfig) *kvMeta {
+	m := &kvMeta{
+		conf:         conf,
+		client:       client,
+		openFiles:    make(map[Ino]int),
+		removedFiles: make(map[Ino]bool),
+		writing:      make(map[Ino]bool),
+		compacting:   make(map[uint64]bool),
+		newUsage:     make(map[string]*Usage),
+		symlinks:     &sync.Map{},
+		msgCallbacks: &msgCallbacks{
+			callbacks: make(map[uint32]MsgCallback),
+		},
+		delegs: newDelegations(),
+		hot:    newHotDirs(conf.HotCache),
+	}
+	go m.flushStats()
+	return m
+}
+
+func (m *kvMeta) fmtKey(args ...interface{}) []byte {
+	b := utils.NewBuffer(uint32(m.keyLen(args...)))
+	for _, a := range args {
+		switch a := a.(type) {
+		case byte:
+			b.Put8(a)
+		case uint32:
+			b.Put32(a)
+		case uint64:
+			b.Put64(a)
+		case Ino:
+			b.Put64(uint64(a))
+		case string:
+			b.Put([]byte(a))
+		default:
+			panic(fmt.Sprintf("invalid type %T, value %v", a, a))
+		}
+	}
+	return b.Bytes()
+}
+
+func (m *kvMeta) keyLen(args ...interface{}) int {
+	var c int
+	for _, a := range args {
+		switch a := a.(type) {
+		case byte:
+			c++
+		case uint32:
+			c += 4
+		case uint64, Ino:
+			c += 8
+		case string:
+			c += len(a)
+		default:
+			panic(fmt.Sprintf("invalid type %T, value %v", a, a))
+		}
+	}
+	return c
+}
+
+func (m *kvMeta) counterKey(name string) []byte {
+	return m.fmtKey("C", name)
+}
+
+func (m *kvMeta) usageKey(group bool, id uint32) []byte {
+	if group {
+		return m.fmtKey("G", id)
+	}
+	return m.fmtKey("U", id)
+}
+
+func (m *kvMeta) projectKey(prj uint32) []byte {
+	return m.fmtKey("QU", prj)
+}
+
+func (m *kvMeta) quotaKey(prj uint32) []byte {
+	return m.fmtKey("QL", prj)
+}
+
+func (m *kvMeta) inodeKey(inode Ino) []byte {
+	return m.fmtKey("A", inode, "I")
+}
+
+func (m *kvMeta) entryKey(parent Ino, name string) []byte {
+	if m.caseInsensitive {
+		name = foldName(name)
+	}
+	return m.fmtKey("A", parent, "D", name)
+}
+
+// newEntry packs the entry of a name in directory.
+func (m *kvMeta) newEntry(_type uint8, inode Ino, name string) []byte {
+	if m.caseInsensitive {
+		return packNamedEntry(_type, inode, name)
+	}
+	return packEntry(_type, inode)
+}
+
+func (m *kvMeta) chunkKey(inode Ino, indx uint32) []byte {
+	return m.fmtKey("A", inode, "C", indx)
+}
+
+func (m *kvMeta) symKey(inode Ino) []byte {
+	return m.fmtKey("A", inode, "S")
+}
+
+func (m *kvMeta) inlineKey(inode Ino) []byte {
+	return m.fmtKey("A", inode, "V")
+}
+
+func (m *kvMeta) xattrKey(inode Ino, name string) []byte {
+	return m.fmtKey("A", inode, "X", name)
+}
+
+func (m *kvMeta) tagKey(inode Ino, key string) []byte {
+	return m.fmtKey("A", inode, "T", key)
+}
+
+func (m *kvMeta) tagIndexKey(key string, inode Ino) []byte {
+	return m.fmtKey("TG", key, "=", inode)
+}
+
+func (m *kvMeta) indexKey(parent Ino, name string, inode Ino) []byte {
+	return append(m.fmtKey("N"), packIndexEntry(parent, name, inode)...)
+}
+
+// updateIndex adds or removes an entry in the name index if it's enabled.
+func (m *kvMeta) updateIndex(tx kvTxn, parent Ino, name string, inode Ino, add bool) {
+	if !m.indexNames {
+		return
+	}
+	if add {
+		tx.set(m.indexKey(parent, name, inode), []byte{1})
+	} else {
+		tx.dels(m.indexKey(parent, name, inode))
+	}
+}
+
+func (m *kvMeta) flockKey(inode Ino) []byte {
+	return m.fmtKey("F", inode)
+}
+
+func (m *kvMeta) plockKey(inode Ino) []byte {
+	return m.fmtKey("P", inode)
+}
+
+func (m *kvMeta) delegationKey(inode Ino) []byte {
+	return m.fmtKey("E", inode)
+}
+
+func (m *kvMeta) sessionKey(sid uint64) []byte {
+	return m.fmtKey("SE", sid)
+}
+
+func (m *kvMeta) heartbeatKey(sid uint64) []byte {
+	return m.fmtKey("SH", sid)
+}
+
+func (m *kvMeta) sessionInfoKey(sid uint64) []byte {
+	return m.fmtKey("SI", sid)
+}
+
+func (m *kvMeta) sustainedKey(sid uint64, inode Ino) []byte {
+	return m.fmtKey("SS", sid, inode)
+}
+
+func (m *kvMeta) delfileKey(inode Ino, length uint64) []byte {
+	return m.fmtKey("D", inode, length)
+}
+
+func (m *kvMeta) sliceKey(chunkid uint64, size uint32) []byte {
+	return m.fmtKey("K", chunkid, size)
+}
+
+func (m *kvMeta) packKey(chunkid uint64) []byte {
+	return m.fmtKey("BP", chunkid)
+}
+
+func (m *kvMeta) packRefKey(pack uint64) []byte {
+	return m.fmtKey("BR", pack)
+}
+
+func (m *kvMeta) dedupKey(chunkid uint64, indx int) []byte {
+	return m.fmtKey("BD", chunkid, uint32(indx))
+}
+
+func (m *kvMeta) dedupObjectKey(hash string) []byte {
+	return m.fmtKey("BH", hash)
+}
+
+func (m *kvMeta) externalKey(chunkid uint64) []byte {
+	return m.fmtKey("BE", chunkid)
+}
+
+func (m *kvMeta) gatewayUserKey(accessKey string) []byte {
+	return m.fmtKey("IU", accessKey)
+}
+
+func (m *kvMeta) checkpointKey(name string) []byte {
+	return m.fmtKey("IC", name)
+}
+
+func (m *kvMeta) replicationKey(op string) []byte {
+	return m.fmtKey("R", op)
+}
+
+// nextKey returns the smallest key which is larger than all the keys with the prefix.
+func nextKey(prefix []byte) []byte {
+	next := make([]byte, len(prefix))
+	copy(next, prefix)
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			return next[:i+1]
+		}
+	}
+	return nil // all 0xFF
+}
+
+func scanPrefix(tx kvTxn, prefix []byte, limit int) ([][]byte, [][]byte) {
+	return tx.scanRange(prefix, nextKey(prefix), limit)
+}
+
+func exist(tx kvTxn, prefix []byte) bool {
+	keys, _ := scanPrefix(tx, prefix, 1)
+	return len(keys) > 0
+}
+
+func packCounter(value int64) []byte {
+	b := utils.NewBuffer(8)
+	b.Put64(uint64(value))
+	return b.Bytes()
+}
+
+func packUsage(space, inodes int64) []byte {
+	b := utils.NewBuffer(16)
+	b.Put64(uint64(space))
+	b.Put64(uint64(inodes))
+	return b.Bytes()
+}
+
+func parseUsage(buf []byte) (space, inodes int64) {
+	if len(buf) != 16 {
+		return 0, 0
+	}
+	rb := utils.ReadBuffer(buf)
+	return int64(rb.Get64()), int64(rb.Get64())
+}
+
+func parseCounter(buf []byte) int64 {
+	if len(buf) != 8 {
+		return 0
+	}
+	return int64(utils.ReadBuffer(buf).Get64())
+}
+
+func incrBy(tx kvTxn, key []byte, value int64) int64 {
+	v := parseCounter(tx.get(key)) + value
+	if value != 0 {
+		tx.set(key, packCounter(v))
+	}
+	return v
+}
+
+// appendValue appends value to the existing one and returns the new value.
+func appendValue(tx kvTxn, key []byte, value []byte) []byte {
+	old := tx.get(key)
+	v := make([]byte, len(old)+len(value))
+	copy(v, old)
+	copy(v[len(old):], value)
+	tx.set(key, v)
+	return v
+}
+
+// readSliceBuf decodes all the slices of a chunk stored in a single value.
+func readSliceBuf(buf []byte) []*slice {
+	vals := make([]string, len(buf)/sliceBytes)
+	s := string(buf)
+	for i := range vals {
+		vals[i] = s[i*sliceBytes : (i+1)*sliceBytes]
+	}
+	return readSlices(vals)
+}
+
+func (m *kvMeta) doTxn(f func(tx kvTxn) error, inodes ...Ino) error {
+	if len(inodes) > 0 {
+		var khash = fnv.New32()
+		_, _ = khash.Write(m.inodeKey(inodes[0]))
+		l := &m.txlocks[int(khash.Sum32())%len(m.txlocks)]
+		l.Lock()
+		defer l.Unlock()
+	}
+	if m.hot != nil {
+		defer m.hot.invalidate(inodes...)
+	}
+	var err error
+	for i := 0; i < 50; i++ {
+		if err = m.client.txn(f); err == errTxnConflict {
+			time.Sleep(time.Microsecond * 100 * time.Duration(rand.Int()%(i+1)))
+			continue
+		}
+		return err
+	}
+	return err
+}
+
+func (m *kvMeta) txn(f func(tx kvTxn) error, inodes ...Ino) syscall.Errno {
+	return errno(m.doTxn(f, inodes...))
+}
+
+func (m *kvMeta) get(key []byte) ([]byte, error) {
+	var value []byte
+	err := m.client.txn(func(tx kvTxn) error {
+		value = tx.get(key)
+		return nil
+	})
+	return value, err
+}
+
+// scan calls f for all the keys with the prefix in batches, it stops if f returns false.
+func (m *kvMeta) scan(prefix []byte, f func(key, value []byte) bool) error {
+	begin, end := prefix, nextKey(prefix)
+	for {
+		var keys, values [][]byte
+		err := m.client.txn(func(tx kvTxn) error {
+			keys, values = tx.scanRange(begin, end, 10000)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for i, k := range keys {
+			if !f(k, values[i]) {
+				return nil
+			}
+		}
+		if len(keys) < 10000 {
+			return nil
+		}
+		begin = append(keys[len(keys)-1], 0)
+	}
+}
+
+func (m *kvMeta) incrCounter(name string, value int64) (int64, error) {
+	var v int64
+	err := m.doTxn(func(tx kvTxn) error {
+		v = incrBy(tx, m.counterKey(name), value)
+		return nil
+	})
+	return v, err
+}
+
+// allocate returns an unused id, the ids are reserved in batch to avoid conflicts on the counter.
+func (m *kvMeta) allocate(free *freeID, name string) (uint64, error) {
+	m.freeMu.Lock()
+	defer m.freeMu.Unlock()
+	if free.next >= free.maxid {
+		v, err := m.incrCounter(name, 100)
+		if err != nil {
+			return 0, err
+		}
+		free.next, free.maxid = uint64(v)-99, uint64(v)+1
+	}
+	id := free.next
+	free.next++
+	return id, nil
+}
+
+func (m *kvMeta) nextInode() (Ino, error) {
+	ino, err := m.allocate(&m.freeInodes, nextInodeKey)
+	if err == nil && ino <= 1 { // reserved for root
+		ino, err = m.allocate(&m.freeInodes, nextInodeKey)
+	}
+	return Ino(ino), err
+}
+
+func (m *kvMeta) updateStats(space int64, inodes int64) {
+	atomic.AddInt64(&m.newSpace, space)
+	atomic.AddInt64(&m.newInodes, inodes)
+}
+
+// updateUsage changes the space and inodes used by the owner, group and project (if not 0)
+// of a file, they are persisted together with the other counters.
+func (m *kvMeta) updateUsage(uid, gid, prj uint32, space int64, inodes int64) {
+	keys := [][]byte{m.usageKey(false, uid), m.usageKey(true, gid)}
+	if prj > 0 {
+		keys = append(keys, m.projectKey(prj))
+	}
+	m.addUsage(space, inodes, keys...)
+}
+
+func (m *kvMeta) updateProjectUsage(prj uint32, space int64, inodes int64) {
+	if prj > 0 {
+		m.addUsage(space, inodes, m.projectKey(prj))
+	}
+}
+
+func (m *kvMeta) addUsage(space int64, inodes int64, keys ...[]byte) {
+	if space == 0 && inodes == 0 {
+		return
+	}
+	m.usageMu.Lock()
+	defer m.usageMu.Unlock()
+	for _, key := range keys {
+		u := m.newUsage[string(key)]
+		if u == nil {
+			u = &Usage{}
+			m.newUsage[string(key)] = u
+		}
+		u.Space += space
+		u.Inodes += inodes
+	}
+}
+
+func (m *kvMeta) flushStats() {
+	for {
+		time.Sleep(time.Second)
+		space := atomic.SwapInt64(&m.newSpace, 0)
+		inodes := atomic.SwapInt64(&m.newInodes, 0)
+		m.usageMu.Lock()
+		usage := m.newUsage
+		m.newUsage = make(map[string]*Usage)
+		m.usageMu.Unlock()
+		if space != 0 || inodes != 0 || len(usage) > 0 {
+			err := m.doTxn(func(tx kvTxn) error {
+				incrBy(tx, m.counterKey(usedSpace), space)
+				incrBy(tx, m.counterKey(totalInodes), inodes)
+				for key, u := range usage {
+					s, i := parseUsage(tx.get([]byte(key)))
+					tx.set([]byte(key), packUsage(s+u.Space, i+u.Inodes))
+				}
+				return nil
+			})
+			if err != nil {
+				logger.Warnf("update stats: %s", err)
+				m.updateStats(space, inodes)
+				m.usageMu.Lock()
+				for key, u := range usage {
+					if n := m.newUsage[key]; n != nil {
+						n.Space += u.Space
+						n.Inodes += u.Inodes
+					} else {
+						m.newUsage[key] = u
+					}
+				}
+				m.usageMu.Unlock()
+			}
+		}
+		if atomic.LoadUint64(&m.capacity) > 0 {
+			if buf, err := m.get(m.counterKey(usedSpace)); err == nil {
+				atomic.StoreInt64(&m.usedSpace, parseCounter(buf))
+			}
+		}
+		if quotas, err := m.loadQuotas(); err == nil {
+			m.usageMu.Lock()
+			m.quotas = quotas
+			m.usageMu.Unlock()
+		} else {
+			logger.Warnf("load quotas: %s", err)
+		}
+	}
+}
+
+func (m *kvMeta) Init(format Format, force bool) error {
+	if len(format.AllowedNetworks) > 0 {
+		return fmt.Errorf("allowed networks are not supported by %s, the address of client can't be verified", m.client.name())
+	}
+	body, err := m.get(m.fmtKey("setting"))
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		var old Format
+		err = json.Unmarshal(body, &old)
+		if err != nil {
+			logger.Fatalf("existing format is broken: %s", err)
+		}
+		if err = old.decryptSecrets(); err != nil && !force {
+			return fmt.Errorf("existing format: %s", err)
+		}
+		if err = old.checkTokenChange(&format, m.conf.Token); err != nil {
+			return err
+		}
+		if force {
+			old.RemoveSecret()
+			logger.Warnf("Existing volume will be overwrited: %+v", old)
+		} else {
+			// only the credentials, access tokens, networks, capacity and name policies can be safely updated.
+			format.UUID = old.UUID
+			format.HoldDeletionUntil = old.HoldDeletionUntil // set by backup
+			old.AccessKey = format.AccessKey
+			old.SecretKey = format.SecretKey
+			old.KeyEncrypted = format.KeyEncrypted
+			old.TokenHash = format.TokenHash
+			old.ReadOnlyTokenHash = format.ReadOnlyTokenHash
+			old.Capacity = format.Capacity
+			old.MaxNameLength = format.MaxNameLength
+			old.UTF8Names = format.UTF8Names
+			old.WindowsNames = format.WindowsNames
+			old.AllowedNetworks = format.AllowedNetworks
+			if !reflect.DeepEqual(format, old) {
+				old.RemoveSecret()
+				format.RemoveSecret()
+				return fmt.Errorf("cannot update format from %+v to %+v", old, format)
+			}
+		}
+	}
+
+	if err = format.encryptSecrets(); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(format, "", "")
+	if err != nil {
+		logger.Fatalf("json: %s", err)
+	}
+
+	// root inode, the existing one is kept
+	var attr Attr
+	attr.Typ = TypeDirectory
+	attr.Mode = 0777
+	ts := time.Now().Unix()
+	attr.Atime = ts
+	attr.Mtime = ts
+	attr.Ctime = ts
+	attr.Nlink = 2
+	attr.Length = 4 << 10
+	attr.Parent = 1
+	return m.doTxn(func(tx kvTxn) error {
+		tx.set(m.fmtKey("setting"), data)
+		if tx.get(m.inodeKey(1)) == nil {
+			tx.set(m.inodeKey(1), marshalAttr(&attr))
+		}
+		return nil
+	})
+}
+
+func (m *kvMeta) Load() (*Format, error) {
+	body, err := m.get(m.fmtKey("setting"))
+	if err != nil {
+		return nil, err
+	}
+	if body == nil {
+		return nil, ErrNoVolume
+	}
+	var format Format
+	err = json.Unmarshal(body, &format)
+	if err != nil {
+		return nil, fmt.Errorf("json: %s", err)
+	}
+	if err = format.decryptSecrets(); err != nil {
+		return nil, err
+	}
+	atomic.StoreUint64(&m.capacity, format.Capacity)
+	m.caseInsensitive = format.CaseInsensitive
+	m.indexNames = format.NameIndex
+	m.names.Store(format.namePolicy())
+	return &format, nil
+}
+
+func (m *kvMeta) UpdateFormat(format Format) error {
+	if err := format.encryptSecrets(); err != nil {
+		return err
+	}
+	return m.doTxn(func(tx kvTxn) error {
+		body := tx.get(m.fmtKey("setting"))
+		if body == nil {
+			return ErrNoVolume
+		}
+		var old Format
+		if err := json.Unmarshal(body, &old); err != nil {
+			return fmt.Errorf("json: %s", err)
+		}
+		if old.Name != format.Name || old.UUID != format.UUID {
+			return fmt.Errorf("cannot update format of volume %s (%s) with %s (%s)", old.Name, old.UUID, format.Name, format.UUID)
+		}
+		data, err := json.MarshalIndent(format, "", "")
+		if err != nil {
+			return err
+		}
+		tx.set(m.fmtKey("setting"), data)
+		return nil
+	})
+}
+
+// hasXattr returns true if any node has the extended attribute.
+func (m *kvMeta) hasXattr(ctx Context, name string) (bool, error) {
+	var found bool
+	err := m.scan(m.fmtKey("A"), func(key, value []byte) bool {
+		found = len(key) == 10+len(name) && key[9] == 'X' && string(key[10:]) == name
+		return !found
+	})
+	return found, err
+}
+
+// enableFeature records a feature enabled by the files in the setting, so the clients
+// without it can't modify the volume.
+func (m *kvMeta) enableFeature(name string) error {
+	return m.doTxn(func(tx kvTxn) error {
+		body := tx.get(m.fmtKey("setting"))
+		if body == nil {
+			return ErrNoVolume
+		}
+		data, err := addFeature(body, name)
+		if err != nil || data == nil {
+			return err
+		}
+		tx.set(m.fmtKey("setting"), data)
+		return nil
+	})
+}
+
+// loadSetting loads the setting of volume to update the capacity, and validate
+// the token in config and the network of client if asked. The secret keys in
+// it are not decrypted.
+func (m *kvMeta) loadSetting(checkToken bool) error {
+	body, err := m.get(m.fmtKey("setting"))
+	if err != nil || body == nil {
+		return err
+	}
+	var format Format
+	if err = json.Unmarshal(body, &format); err != nil {
+		return fmt.Errorf("json: %s", err)
+	}
+	if checkToken {
+		if m.readOnly, err = format.checkToken(m.conf.Token); err != nil {
+			return err
+		}
+		m.readOnly = m.readOnly || m.conf.ReadOnly
+		if len(format.AllowedNetworks) > 0 {
+			return fmt.Errorf("allowed networks are not supported by %s, the address of client can't be verified", m.client.name())
+		}
+		if err = format.checkCompat(m.readOnly); err != nil {
+			return err
+		}
+	} else if err = format.checkCompat(m.readOnly); err != nil {
+		// upgraded by a newer client, the reads may fail if it's not compatible
+		logger.Warnf("%s, this client becomes read-only", err)
+		m.readOnly = true
+	}
+	atomic.StoreUint64(&m.capacity, format.Capacity)
+	m.caseInsensitive = format.CaseInsensitive
+	m.names.Store(format.namePolicy())
+	m.ackHold(format.HoldDeletionUntil, format.holdDeletion())
+	return nil
+}
+
+// ackHold records the hold of deletion in the session once it's in effect (no job deleting
+// data is running), so the backup knows when all the clients have held the deletion.
+func (m *kvMeta) ackHold(until int64, idle bool) {
+	if m.heldUntil == until || until > 0 && !idle {
+		return
+	}
+	if m.sid == 0 {
+		m.heldUntil = until // recorded when the session is created
+		return
+	}
+	err := m.doTxn(func(tx kvTxn) error {
+		body := tx.get(m.sessionInfoKey(m.sid))
+		if body == nil {
+			return fmt.Errorf("no info of session")
+		}
+		var s SessionInfo
+		if err := json.Unmarshal(body, &s); err != nil {
+			return err
+		}
+		s.HoldDeletionUntil = until
+		body, _ = json.Marshal(&s)
+		tx.set(m.sessionInfoKey(m.sid), body)
+		return nil
+	})
+	if err != nil {
+		logger.Warnf("record the hold of deletion in session %d: %s", m.sid, err)
+		return
+	}
+	m.heldUntil = until
+}
+
+// checkQuota returns true if there is no space for more data of size.
+func (m *kvMeta) checkQuota(size int64) bool {
+	capacity := atomic.LoadUint64(&m.capacity)
+	if capacity == 0 {
+		return false
+	}
+	return atomic.LoadInt64(&m.usedSpace)+atomic.LoadInt64(&m.newSpace)+size > int64(capacity)
+}
+
+func (m *kvMeta) NewSession() error {
+	if err := m.loadSetting(true); err != nil {
+		return fmt.Errorf("create session: %s", err)
+	}
+	sid, err := m.incrCounter(nextSessionKey, 1)
+	if err != nil {
+		return fmt.Errorf("create session: %s", err)
+	}
+	m.sid = uint64(sid)
+	logger.Debugf("session is is %d", m.sid)
+	s := newSessionInfo(m.sid, "")
+	s.HoldDeletionUntil = m.heldUntil
+	info, _ := json.Marshal(s)
+	err = m.doTxn(func(tx kvTxn) error {
+		tx.set(m.sessionKey(m.sid), packCounter(time.Now().Unix()))
+		tx.set(m.sessionInfoKey(m.sid), info)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("create session: %s", err)
+	}
+	if err = m.heartbeat(); err != nil {
+		return fmt.Errorf("create session: %s", err)
+	}
+
+	go m.refreshSession()
+	if m.readOnly {
+		logger.Infof("session %d is read-only", m.sid)
+		return nil
+	}
+	if m.conf.NoBGJob {
+		logger.Infof("background jobs are disabled in session %d", m.sid)
+		return nil
+	}
+	go elect(m, m.conf.heartbeat())
+	go m.cleanupDeletedFiles()
+	go m.cleanupSlices()
+	return nil
+}
+
+func (m *kvMeta) OnMsg(mtype uint32, cb MsgCallback) {
+	m.msgCallbacks.Lock()
+	defer m.msgCallbacks.Unlock()
+	m.msgCallbacks.callbacks[mtype] = cb
+}
+
+func (m *kvMeta) newMsg(mid uint32, args ...interface{}) error {
+	m.msgCallbacks.Lock()
+	cb, ok := m.msgCallbacks.callbacks[mid]
+	m.msgCallbacks.Unlock()
+	if ok {
+		return cb(args...)
+	}
+	return fmt.Errorf("message %d is not supported", mid)
+}
+
+func (m *kvMeta) StatFS(ctx Context, totalspace, availspace, iused, iavail *uint64) syscall.Errno {
+	*totalspace = 1 << 50
+	if capacity := atomic.LoadUint64(&m.capacity); capacity > 0 {
+		*totalspace = capacity
+	}
+	var used, inodes int64
+	err := m.client.txn(func(tx kvTxn) error {
+		rs := tx.gets(m.counterKey(usedSpace), m.counterKey(totalInodes))
+		used, inodes = parseCounter(rs[0]), parseCounter(rs[1])
+		return nil
+	})
+	if err != nil {
+		logger.Warnf("get stats: %s", err)
+	}
+	used += atomic.LoadInt64(&m.newSpace)
+	inodes += atomic.LoadInt64(&m.newInodes)
+	if used < 0 {
+		used = 0
+	}
+	used = ((used >> 16) + 1) << 16 // aligned to 64K
+	*availspace = 0
+	if uint64(used) < *totalspace {
+		*availspace = *totalspace - uint64(used)
+	}
+	if inodes < 0 {
+		inodes = 0
+	}
+	*iused = uint64(inodes)
+	*iavail = 10 << 20
+	return 0
+}
+
+func (m *kvMeta) ListUsage(group bool) ([]Usage, error) {
+	prefix := m.fmtKey("U")
+	if group {
+		prefix = m.fmtKey("G")
+	}
+	var keys, values [][]byte
+	err := m.client.txn(func(tx kvTxn) error {
+		keys, values = tx.scanRange(prefix, nextKey(prefix), 0)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	usage := make(map[uint32]*Usage)
+	for i, key := range keys {
+		if len(key) != len(prefix)+4 {
+			continue
+		}
+		u := &Usage{ID: utils.ReadBuffer(key[len(prefix):]).Get32()}
+		u.Space, u.Inodes = parseUsage(values[i])
+		usage[u.ID] = u
+	}
+	m.usageMu.Lock()
+	for key, n := range m.newUsage {
+		if len(key) != len(prefix)+4 || !bytes.HasPrefix([]byte(key), prefix) {
+			continue
+		}
+		id := utils.ReadBuffer([]byte(key[len(prefix):])).Get32()
+		u := usage[id]
+		if u == nil {
+			u = &Usage{ID: id}
+			usage[id] = u
+		}
+		u.Space += n.Space
+		u.Inodes += n.Inodes
+	}
+	m.usageMu.Unlock()
+	return sortUsage(usage), nil
+}
+
+// loadQuotas returns the persisted limits and usage of projects which have a quota.
+func (m *kvMeta) loadQuotas() (map[uint32]*Quota, error) {
+	prefix := m.fmtKey("QL")
+	quotas := make(map[uint32]*Quota)
+	err := m.client.txn(func(tx kvTxn) error {
+		keys, values := tx.scanRange(prefix, nextKey(prefix), 0)
+		for i, key := range keys {
+			if len(key) != len(prefix)+4 {
+				continue
+			}
+			prj := utils.ReadBuffer(key[len(prefix):]).Get32()
+			q := &Quota{}
+			q.MaxSpace, q.MaxInodes = parseUsage(values[i])
+			q.UsedSpace, q.UsedInodes = parseUsage(tx.get(m.projectKey(prj)))
+			quotas[prj] = q
+		}
+		return nil
+	})
+	return quotas, err
+}
+
+// checkProjectQuota returns true if the quota of project can't hold more space and inodes.
+func (m *kvMeta) checkProjectQuota(prj uint32, space, inodes int64) bool {
+	if prj == 0 {
+		return false
+	}
+	m.usageMu.Lock()
+	defer m.usageMu.Unlock()
+	q := m.quotas[prj]
+	if q == nil {
+		return false
+	}
+	c := *q
+	if u := m.newUsage[string(m.projectKey(prj))]; u != nil {
+		c.UsedSpace += u.Space
+		c.UsedInodes += u.Inodes
+	}
+	return c.exceeded(space, inodes)
+}
+
+func (m *kvMeta) SetQuota(prj uint32, maxSpace, maxInodes int64) error {
+	err := m.doTxn(func(tx kvTxn) error {
+		if maxSpace == 0 && maxInodes == 0 {
+			tx.dels(m.quotaKey(prj))
+		} else {
+			tx.set(m.quotaKey(prj), packUsage(maxSpace, maxInodes))
+		}
+		return nil
+	})
+	if err == nil {
+		if quotas, err := m.loadQuotas(); err == nil {
+			m.usageMu.Lock()
+			m.quotas = quotas
+			m.usageMu.Unlock()
+		}
+	}
+	return err
+}
+
+func (m *kvMeta) ListQuotas() (map[uint32]*Quota, error) {
+	quotas, err := m.loadQuotas()
+	if err != nil {
+		return nil, err
+	}
+	prefix := m.fmtKey("QU")
+	err = m.client.txn(func(tx kvTxn) error {
+		keys, values := tx.scanRange(prefix, nextKey(prefix), 0)
+		for i, key := range keys {
+			if len(key) != len(prefix)+4 {
+				continue
+			}
+			prj := utils.ReadBuffer(key[len(prefix):]).Get32()
+			if quotas[prj] == nil {
+				q := &Quota{}
+				q.UsedSpace, q.UsedInodes = parseUsage(values[i])
+				quotas[prj] = q
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	m.usageMu.Lock()
+	for key, u := range m.newUsage {
+		if len(key) != len(prefix)+4 || !bytes.HasPrefix([]byte(key), prefix) {
+			continue
+		}
+		prj := utils.ReadBuffer([]byte(key[len(prefix):])).Get32()
+		q := quotas[prj]
+		if q == nil {
+			q = &Quota{}
+			quotas[prj] = q
+		}
+		q.UsedSpace += u.Space
+		q.UsedInodes += u.Inodes
+	}
+	m.usageMu.Unlock()
+	return quotas, nil
+}
+
+// getProject returns the project id of a node, 0 means no project.
+func (m *kvMeta) getProject(tx kvTxn, inode Ino) uint32 {
+	prj, _ := parseProject(tx.get(m.xattrKey(inode, projectXattr)))
+	return prj
+}
+
+// getRetention returns the value of the retention of a node if it's still active.
+func (m *kvMeta) getRetention(tx kvTxn, inode Ino, attr *Attr) []byte {
+	if attr.Flags&FlagRetention == 0 {
+		return nil
+	}
+	if v := tx.get(m.xattrKey(inode, RetentionXattr)); v != nil && retentionActive(v) {
+		return v
+	}
+	return nil
+}
+
+// isRetained returns true if the node is retained, the content of a file can be
+// changed when write is true and it's still being written by the creator.
+func (m *kvMeta) isRetained(tx kvTxn, inode Ino, attr *Attr, write bool) bool {
+	if attr.Flags&FlagRetention == 0 {
+		return false
+	}
+	if write {
+		m.Lock()
+		writing := m.writing[inode]
+		m.Unlock()
+		if writing {
+			return false
+		}
+	}
+	return m.getRetention(tx, inode, attr) != nil
+}
+
+func (m *kvMeta) Summary(ctx Context, inode Ino, summary *Summary) syscall.Errno {
+	var attr Attr
+	if st := m.GetAttr(ctx, inode, &attr); st != 0 {
+		return st
+	}
+	if attr.Typ == TypeDirectory {
+		var entries []*Entry
+		if st := m.Readdir(ctx, inode, 1, &entries); st != 0 {
+			return st
+		}
+		for _, e := range entries {
+			if e.Inode == inode || len(e.Name) == 2 && bytes.Equal(e.Name, []byte("..")) {
+				continue
+			}
+			if e.Attr.Typ == TypeDirectory {
+				if st := m.Summary(ctx, e.Inode, summary); st != 0 {
+					return st
+				}
+			} else {
+				summary.Files++
+				summary.Length += e.Attr.Length
+				summary.Size += uint64(align4K(e.Attr.Length))
+			}
+		}
+		summary.Dirs++
+		summary.Size += 4096
+	} else {
+		summary.Files++
+		summary.Length += attr.Length
+		summary.Size += uint64(align4K(attr.Length))
+	}
+	return 0
+}
+
+func (m *kvMeta) Fragmentation(ctx Context, inode Ino, frag *Fragmentation) syscall.Errno {
+	var attr Attr
+	if st := m.GetAttr(ctx, inode, &attr); st != 0 {
+		return st
+	}
+	if attr.Typ == TypeDirectory {
+		var entries []*Entry
+		if st := m.Readdir(ctx, inode, 1, &entries); st != 0 {
+			return st
+		}
+		for _, e := range entries {
+			if e.Inode == inode || len(e.Name) == 2 && bytes.Equal(e.Name, []byte("..")) {
+				continue
+			}
+			if e.Attr.Typ == TypeDirectory || e.Attr.Typ == TypeFile {
+				if st := m.Fragmentation(ctx, e.Inode, frag); st != 0 {
+					return st
+				}
+			}
+		}
+		return 0
+	}
+	if attr.Typ != TypeFile {
+		return 0
+	}
+	err := m.scan(m.fmtKey("A", inode, "C"), func(key, value []byte) bool {
+		frag.add(readSliceBuf(value))
+		return true
+	})
+	return errno(err)
+}
+
+func (m *kvMeta) Lookup(ctx Context, parent Ino, name string, inode *Ino, attr *Attr) syscall.Errno {
+	if m.hot != nil && m.hot.lookup(parent, name, inode, attr) {
+		return 0
+	}
+	var foundIno Ino
+	st := m.txn(func(tx kvTxn) error {
+		buf := tx.get(m.entryKey(parent, name))
+		if buf == nil {
+			return syscall.ENOENT
+		}
+		_, foundIno = parseEntry(buf)
+		if attr != nil {
+			a := tx.get(m.inodeKey(foundIno))
+			if a == nil {
+				return syscall.ENOENT
+			}
+			parseAttr(a, attr)
+		}
+		if inode != nil {
+			*inode = foundIno
+		}
+		return nil
+	})
+	if st == 0 && m.hot != nil {
+		m.hot.putEntry(parent, name, foundIno, attr)
+	}
+	return st
+}
+
+func (m *kvMeta) Access(ctx Context, inode Ino, mmask uint8, attr *Attr) syscall.Errno {
+	if ctx.Uid() == 0 {
+		return 0
+	}
+
+	if attr == nil || !attr.Full {
+		if attr == nil {
+			attr = &Attr{}
+		}
+		err := m.GetAttr(ctx, inode, attr)
+		if err != 0 {
+			return err
+		}
+	}
+
+	mode := accessMode(attr, ctx.Uid(), ctx.Gid())
+	if mode&mmask != mmask {
+		logger.Debugf("Access inode %d %o, mode %o, request mode %o", inode, attr.Mode, mode, mmask)
+		return syscall.EACCES
+	}
+	return 0
+}
+
+func (m *kvMeta) GetAttr(ctx Context, inode Ino, attr *Attr) syscall.Errno {
+	if m.hot != nil && m.hot.getAttr(inode, attr) {
+		return 0
+	}
+	a, err := m.get(m.inodeKey(inode))
+	if err == nil && a == nil {
+		err = syscall.ENOENT
+	}
+	if err == nil {
+		parseAttr(a, attr)
+		if m.hot != nil {
+			m.hot.putAttr(inode, attr)
+		}
+	}
+	if err != nil && inode == 1 {
+		err = nil
+		attr.Typ = TypeDirectory
+		attr.Mode = 0777
+		attr.Nlink = 2
+		attr.Length = 4 << 10
+	}
+	return errno(err)
+}
+
+func (m *kvMeta) Truncate(ctx Context, inode Ino, flags uint8, length uint64, attr *Attr) syscall.Errno {
+	if m.readOnly {
+		return syscall.EROFS
+	}
+	var newSpace int64
+	var t Attr
+	var prj uint32
+	st := m.txn(func(tx kvTxn) error {
+		a := tx.get(m.inodeKey(inode))
+		if a == nil {
+			return syscall.ENOENT
+		}
+		parseAttr(a, &t)
+		if t.Typ != TypeFile || t.Flags&FlagReadOnly != 0 || m.isRetained(tx, inode, &t, true) {
+			return syscall.EPERM
+		}
+		old := t.Length
+		var zeroChunks [][]byte
+		if length > old && old/ChunkSize+1 < length/ChunkSize {
+			// the existing chunks between them should be zeroed
+			zeroChunks, _ = tx.scanRange(m.chunkKey(inode, uint32(old/ChunkSize)+1), m.chunkKey(inode, uint32(length/ChunkSize)), 0)
+		}
+		prj = m.getProject(tx, inode)
+		if length > old && (m.checkQuota(align4K(length)-align4K(old)) || m.checkProjectQuota(prj, align4K(length)-align4K(old), 0)) {
+			return syscall.ENOSPC
+		}
+		var inline []byte
+		if length < old {
+			inline = tx.get(m.inlineKey(inode))
+		}
+		t.Length = length
+		now := time.Now()
+		t.Mtime = now.Unix()
+		t.Mtimensec = uint32(now.Nanosecond())
+		t.Ctime = now.Unix()
+		t.Ctimensec = uint32(now.Nanosecond())
+		tx.set(m.inodeKey(inode), marshalAttr(&t))
+		if uint64(len(inline)) > length {
+			tx.set(m.inlineKey(inode), inline[:length])
+		}
+		if length > old {
+			// zero out from old to length
+			var l = uint32(length - old)
+			if length > (old/ChunkSize+1)*ChunkSize {
+				l = ChunkSize - uint32(old%ChunkSize)
+			}
+			appendValue(tx, m.chunkKey(inode, uint32(old/ChunkSize)), marshalSlice(uint32(old%ChunkSize), 0, 0, 0, l))
+			buf := marshalSlice(0, 0, 0, 0, ChunkSize)
+			for _, key := range zeroChunks {
+				appendValue(tx, key, buf)
+			}
+			if length > (old/ChunkSize+1)*ChunkSize && length%ChunkSize > 0 {
+				appendValue(tx, m.chunkKey(inode, uint32(length/ChunkSize)), marshalSlice(0, 0, 0, 0, uint32(length%ChunkSize)))
+			}
+		}
+		newSpace = align4K(length) - align4K(old)
+		if attr != nil {
+			*attr = t
+		}
+		return nil
+	}, inode)
+	if st == 0 {
+		m.updateStats(newSpace, 0)
+		m.updateUsage(t.Uid, t.Gid, prj, newSpace, 0)
+	}
+	return st
+}
+
+func (m *kvMeta) Fallocate(ctx Context, inode Ino, mode uint8, off uint64, size uint64) syscall.Errno {
+	if m.readOnly {
+		return syscall.EROFS
+	}
+	if mode&fallocCollapesRange != 0 && mode != fallocCollapesRange {
+		return syscall.EINVAL
+	}
+	if mode&fallocInsertRange != 0 && mode != fallocInsertRange {
+		return syscall.EINVAL
+	}
+	if mode == fallocInsertRange || mode == fallocCollapesRange {
+		return syscall.ENOTSUP
+	}
+	if mode&fallocPunchHole != 0 && mode&fallocKeepSize == 0 {
+		return syscall.EINVAL
+	}
+	if size == 0 {
+		return syscall.EINVAL
+	}
+	var newSpace int64
+	var t Attr
+	var prj uint32
+	st := m.txn(func(tx kvTxn) error {
+		a := tx.get(m.inodeKey(inode))
+		if a == nil {
+			return syscall.ENOENT
+		}
+		parseAttr(a, &t)
+		if t.Typ == TypeFIFO {
+			return syscall.EPIPE
+		}
+		if t.Typ != TypeFile || t.Flags&FlagReadOnly != 0 || m.isRetained(tx, inode, &t, true) {
+			return syscall.EPERM
+		}
+		length := t.Length
+		if off+size > t.Length {
+			if mode&fallocKeepSize == 0 {
+				length = off + size
+			}
+		}
+
+		old := t.Length
+		prj = m.getProject(tx, inode)
+		if length > old && (m.checkQuota(align4K(length)-align4K(old)) || m.checkProjectQuota(prj, align4K(length)-align4K(old), 0)) {
+			return syscall.ENOSPC
+		}
+		t.Length = length
+		now := time.Now()
+		t.Ctime = now.Unix()
+		t.Ctimensec = uint32(now.Nanosecond())
+		tx.set(m.inodeKey(inode), marshalAttr(&t))
+		if mode&(fallocZeroRange|fallocPunchHole) != 0 && off < old {
+			if inline := tx.get(m.inlineKey(inode)); uint64(len(inline)) > off {
+				inline = append([]byte{}, inline...)
+				end := off + size
+				if end > uint64(len(inline)) {
+					end = uint64(len(inline))
+				}
+				for i := off; i < end; i++ {
+					inline[i] = 0
+				}
+				tx.set(m.inlineKey(inode), inline)
+			}
+			off, size := off, size
+			if off+size > old {
+				size = old - off
+			}
+			for size > 0 {
+				indx := uint32(off / ChunkSize)
+				coff := off % ChunkSize
+				l := size
+				if coff+size > ChunkSize {
+					l = ChunkSize - coff
+				}
+				appendValue(tx, m.chunkKey(inode, indx), marshalSlice(uint32(coff), 0, 0, 0, uint32(l)))
+				off += l
+				size -= l
+			}
+		}
+		newSpace = align4K(length) - align4K(old)
+		return nil
+	}, inode)
+	if st == 0 {
+		m.updateStats(newSpace, 0)
+		m.updateUsage(t.Uid, t.Gid, prj, newSpace, 0)
+	}
+	return st
+}
+
+func (m *kvMeta) Reserve(ctx Context, inode Ino, size uint64, off *uint64) syscall.Errno {
+	if m.readOnly {
+		return syscall.EROFS
+	}
+	if size == 0 {
+		return syscall.EINVAL
+	}
+	var newSpace int64
+	var t Attr
+	var prj uint32
+	var old uint64
+	st := m.txn(func(tx kvTxn) error {
+		a := tx.get(m.inodeKey(inode))
+		if a == nil {
+			return syscall.ENOENT
+		}
+		parseAttr(a, &t)
+		if t.Typ != TypeFile || t.Flags&FlagReadOnly != 0 || m.isRetained(tx, inode, &t, true) {
+			return syscall.EPERM
+		}
+		old = t.Length
+		if old+size >= MaxFileSize {
+			return syscall.EFBIG
+		}
+		newSpace = align4K(old+size) - align4K(old)
+		prj = m.getProject(tx, inode)
+		if m.checkQuota(newSpace) || m.checkProjectQuota(prj, newSpace, 0) {
+			return syscall.ENOSPC
+		}
+		t.Length = old + size
+		now := time.Now()
+		t.Mtime = now.Unix()
+		t.Mtimensec = uint32(now.Nanosecond())
+		t.Ctime = now.Unix()
+		t.Ctimensec = uint32(now.Nanosecond())
+		tx.set(m.inodeKey(inode), marshalAttr(&t))
+		return nil
+	}, inode)
+	if st == 0 {
+		*off = old
+		m.updateStats(newSpace, 0)
+		m.updateUsage(t.Uid, t.Gid, prj, newSpace, 0)
+	}
+	return st
+}
+
+func (m *kvMeta) SetAttr(ctx Context, inode Ino, set uint16, sugidclearmode uint8, attr *Attr) syscall.Errno {
+	if m.readOnly {
+		return syscall.EROFS
+	}
+	var uid, gid uint32
+	st := m.txn(func(tx kvTxn) error {
+		var cur Attr
+		a := tx.get(m.inodeKey(inode))
+		if a == nil {
+			return syscall.ENOENT
+		}
+		parseAttr(a, &cur)
+		uid, gid = cur.Uid, cur.Gid
+		if (set&(SetAttrUID|SetAttrGID)) != 0 && (set&SetAttrMode) != 0 {
+			attr.Mode |= (cur.Mode & 06000)
+		}
+		if (cur.Mode&06000) != 0 && (set&(SetAttrUID|SetAttrGID)) != 0 {
+			cur.Mode &= 01777
+			attr.Mode &= 01777
+		}
+		if set&SetAttrUID != 0 {
+			cur.Uid = attr.Uid
+		}
+		if set&SetAttrGID != 0 {
+			cur.Gid = attr.Gid
+		}
+		if set&SetAttrMode != 0 {
+			if ctx.Uid() != 0 && (attr.Mode&02000) != 0 {
+				if ctx.Gid() != cur.Gid {
+					attr.Mode &= 05777
+				}
+			}
+			cur.Mode = attr.Mode
+		}
+		if set&SetAttrFlag != 0 {
+			if ctx.Uid() != 0 {
+				return syscall.EPERM
+			}
+			cur.Flags = attr.Flags&^FlagRetention | cur.Flags&FlagRetention
+		}
+		now := time.Now()
+		if set&SetAttrAtime != 0 {
+			cur.Atime = attr.Atime
+			cur.Atimensec = attr.Atimensec
+		}
+		if set&SetAttrAtimeNow != 0 {
+			cur.Atime = now.Unix()
+			cur.Atimensec = uint32(now.Nanosecond())
+		}
+		if set&SetAttrMtime != 0 {
+			cur.Mtime = attr.Mtime
+			cur.Mtimensec = attr.Mtimensec
+		}
+		if set&SetAttrMtimeNow != 0 {
+			cur.Mtime = now.Unix()
+			cur.Mtimensec = uint32(now.Nanosecond())
+		}
+		cur.Ctime = now.Unix()
+		cur.Ctimensec = uint32(now.Nanosecond())
+		tx.set(m.inodeKey(inode), marshalAttr(&cur))
+		*attr = cur
+		return nil
+	}, inode)
+	if st == 0 && (attr.Uid != uid || attr.Gid != gid) {
+		var space int64
+		if attr.Typ == TypeFile {
+			space = align4K(attr.Length)
+		}
+		m.updateUsage(uid, gid, 0, -space, -1)
+		m.updateUsage(attr.Uid, attr.Gid, 0, space, 1)
+	}
+	return st
+}
+
+func (m *kvMeta) ReadLink(ctx Context, inode Ino, path *[]byte) syscall.Errno {
+	if target, ok := m.symlinks.Load(inode); ok {
+		*path = target.([]byte)
+		return 0
+	}
+	target, err := m.get(m.symKey(inode))
+	if err == nil && target == nil {
+		err = syscall.ENOENT
+	}
+	if err == nil {
+		*path = target
+		m.symlinks.Store(inode, target)
+	}
+	return errno(err)
+}
+
+func (m *kvMeta) Symlink(ctx Context, parent Ino, name string, path string, inode *Ino, attr *Attr) syscall.Errno {
+	return m.mknod(ctx, parent, name, TypeSymlink, 0644, 022, 0, path, inode, attr)
+}
+
+func (m *kvMeta) Mknod(ctx Context, parent Ino, name string, _type uint8, mode, cumask uint16, rdev uint32, inode *Ino, attr *Attr) syscall.Errno {
+	return m.mknod(ctx, parent, name, _type, mode, cumask, rdev, "", inode, attr)
+}
+
+func (m *kvMeta) mknod(ctx Context, parent Ino, name string, _type uint8, mode, cumask uint16, rdev uint32, path string, inode *Ino, attr *Attr) syscall.Errno {
+	if m.readOnly {
+		return syscall.EROFS
+	}
+	if st := checkName(&m.names, name); st != 0 {
+		return st
+	}
+	ino, err := m.nextInode()
+	if err != nil {
+		return errno(err)
+	}
+	if attr == nil {
+		attr = &Attr{}
+	}
+	attr.Typ = _type
+	attr.Mode = mode & ^cumask
+	attr.Uid = ctx.Uid()
+	attr.Gid = ctx.Gid()
+	if _type == TypeDirectory {
+		attr.Nlink = 2
+		attr.Length = 4 << 10
+	} else {
+		attr.Nlink = 1
+		if _type == TypeSymlink {
+			attr.Length = uint64(len(path))
+		} else {
+			attr.Length = 0
+			attr.Rdev = rdev
+		}
+	}
+	attr.Parent = parent
+	if inode != nil {
+		*inode = ino
+	}
+
+	var prj uint32
+	st := m.txn(func(tx kvTxn) error {
+		var pattr Attr
+		a := tx.get(m.inodeKey(parent))
+		if a == nil {
+			return syscall.ENOENT
+		}
+		parseAttr(a, &pattr)
+		if pattr.Typ != TypeDirectory {
+			return syscall.ENOTDIR
+		}
+		if tx.get(m.entryKey(parent, name)) != nil {
+			return syscall.EEXIST
+		}
+		prj = m.getProject(tx, parent)
+		if m.checkProjectQuota(prj, 0, 1) {
+			return syscall.ENOSPC
+		}
+		retention := m.getRetention(tx, parent, &pattr)
+		attr.Flags &^= FlagRetention
+		if retention != nil {
+			attr.Flags |= FlagRetention
+		}
+
+		now := time.Now()
+		if _type == TypeDirectory {
+			pattr.Nlink++
+		}
+		pattr.Mtime = now.Unix()
+		pattr.Mtimensec = uint32(now.Nanosecond())
+		pattr.Ctime = now.Unix()
+		pattr.Ctimensec = uint32(now.Nanosecond())
+		attr.Atime = now.Unix()
+		attr.Atimensec = uint32(now.Nanosecond())
+		attr.Mtime = now.Unix()
+		attr.Mtimensec = uint32(now.Nanosecond())
+		attr.Ctime = now.Unix()
+		attr.Ctimensec = uint32(now.Nanosecond())
+		if ctx.Value(CtxKey("behavior")) == "Hadoop" {
+			attr.Gid = pattr.Gid
+		}
+
+		tx.set(m.entryKey(parent, name), m.newEntry(_type, ino, name))
+		m.updateIndex(tx, parent, name, ino, true)
+		tx.set(m.inodeKey(parent), marshalAttr(&pattr))
+		tx.set(m.inodeKey(ino), marshalAttr(attr))
+		if _type == TypeSymlink {
+			tx.set(m.symKey(ino), []byte(path))
+		}
+		if prj > 0 {
+			tx.set(m.xattrKey(ino, projectXattr), []byte(strconv.FormatUint(uint64(prj), 10)))
+		}
+		if retention != nil {
+			tx.set(m.xattrKey(ino, RetentionXattr), retention)
+		}
+		return nil
+	}, parent)
+	if st == 0 {
+		m.updateStats(align4K(0), 1)
+		m.updateUsage(attr.Uid, attr.Gid, prj, align4K(0), 1)
+	}
+	return st
+}
+
+func (m *kvMeta) Mkdir(ctx Context, parent Ino, name string, mode uint16, cumask uint16, copysgid uint8, inode *Ino, attr *Attr) syscall.Errno {
+	return m.Mknod(ctx, parent, name, TypeDirectory, mode, cumask, 0, inode, attr)
+}
+
+func (m *kvMeta) Create(ctx Context, parent Ino, name string, mode uint16, cumask uint16, inode *Ino, attr *Attr) syscall.Errno {
+	if attr == nil {
+		attr = &Attr{}
+	}
+	err := m.Mknod(ctx, parent, name, TypeFile, mode, cumask, 0, inode, attr)
+	if err == 0 && inode != nil {
+		m.Lock()
+		m.openFiles[*inode] = 1
+		if attr.Flags&FlagRetention != 0 {
+			m.writing[*inode] = true
+		}
+		m.Unlock()
+	}
+	return err
+}
+
+// removeXattrs deletes all the extended attributes of a node.
+func (m *kvMeta) removeXattrs(tx kvTxn, inode Ino) {
+	keys, _ := scanPrefix(tx, m.xattrKey(inode, ""), 0)
+	if len(keys) > 0 {
+		tx.dels(keys...)
+	}
+}
+
+// removeTags deletes all the tags of a node, the index is cleaned by SearchTag.
+func (m *kvMeta) removeTags(tx kvTxn, inode Ino) {
+	keys, _ := scanPrefix(tx, m.tagKey(inode, ""), 0)
+	if len(keys) > 0 {
+		tx.dels(keys...)
+	}
+}
+
+func (m *kvMeta) Unlink(ctx Context, parent Ino, name string) syscall.Errno {
+	if m.readOnly {
+		return syscall.EROFS
+	}
+	var _type uint8
+	var inode Ino
+	var attr Attr
+	var opened bool
+	var prj uint32
+	st := m.txn(func(tx kvTxn) error {
+		buf := tx.get(m.entryKey(parent, name))
+		if buf == nil {
+			return syscall.ENOENT
+		}
+		_type, inode = parseEntry(buf)
+		if _type == TypeDirectory {
+			return syscall.EPERM
+		}
+		rs := tx.gets(m.inodeKey(parent), m.inodeKey(inode))
+		if rs[0] == nil || rs[1] == nil {
+			return syscall.ENOENT
+		}
+		var pattr Attr
+		parseAttr(rs[0], &pattr)
+		if pattr.Typ != TypeDirectory {
+			return syscall.ENOTDIR
+		}
+		attr = Attr{}
+		parseAttr(rs[1], &attr)
+		if m.isRetained(tx, parent, &pattr, false) || m.isRetained(tx, inode, &attr, false) {
+			return syscall.EPERM
+		}
+		now := time.Now()
+		pattr.Mtime = now.Unix()
+		pattr.Mtimensec = uint32(now.Nanosecond())
+		pattr.Ctime = now.Unix()
+		pattr.Ctimensec = uint32(now.Nanosecond())
+		attr.Ctime = now.Unix()
+		attr.Ctimensec = uint32(now.Nanosecond())
+		attr.Nlink--
+		opened = false
+		if _type == TypeFile && attr.Nlink == 0 {
+			m.Lock()
+			opened = m.openFiles[inode] > 0
+			m.Unlock()
+		}
+
+		tx.dels(m.entryKey(parent, name))
+		m.updateIndex(tx, parent, string(entryName([]byte(name), buf)), inode, false)
+		tx.set(m.inodeKey(parent), marshalAttr(&pattr))
+		if attr.Nlink > 0 {
+			tx.set(m.inodeKey(inode), marshalAttr(&attr))
+			return nil
+		}
+		prj = m.getProject(tx, inode)
+		if !opened {
+			// the project of opened file is needed when it's deleted
+			m.removeXattrs(tx, inode)
+			m.removeTags(tx, inode)
+		}
+		switch _type {
+		case TypeSymlink:
+			tx.dels(m.symKey(inode), m.inodeKey(inode))
+		case TypeFile:
+			if opened {
+				tx.set(m.inodeKey(inode), marshalAttr(&attr))
+				tx.set(m.sustainedKey(m.sid, inode), []byte{1})
+			} else {
+				tx.set(m.delfileKey(inode, attr.Length), packCounter(now.Unix()))
+				tx.dels(m.inodeKey(inode))
+			}
+		default:
+			tx.dels(m.inodeKey(inode))
+		}
+		return nil
+	}, parent)
+	if st == 0 && attr.Nlink == 0 {
+		var newSpace int64
+		if _type == TypeFile {
+			if opened {
+				m.Lock()
+				m.removedFiles[inode] = true
+				m.Unlock()
+			} else {
+				newSpace = -align4K(attr.Length)
+				go m.deleteFile(inode, attr.Length)
+			}
+		}
+		m.updateStats(newSpace, -1)
+		m.updateUsage(attr.Uid, attr.Gid, prj, newSpace, -1)
+	}
+	return st
+}
+
+func (m *kvMeta) Rmdir(ctx Context, parent Ino, name string) syscall.Errno {
+	if m.readOnly {
+		return syscall.EROFS
+	}
+	if name == "." {
+		return syscall.EINVAL
+	}
+	if name == ".." {
+		return syscall.ENOTEMPTY
+	}
+	var attr Attr
+	var prj uint32
+	st := m.txn(func(tx kvTxn) error {
+		buf := tx.get(m.entryKey(parent, name))
+		if buf == nil {
+			return syscall.ENOENT
+		}
+		typ, inode := parseEntry(buf)
+		if typ != TypeDirectory {
+			return syscall.ENOTDIR
+		}
+		rs := tx.gets(m.inodeKey(parent), m.inodeKey(inode))
+		if rs[0] == nil {
+			return syscall.ENOENT
+		}
+		var pattr Attr
+		parseAttr(rs[0], &pattr)
+		if pattr.Typ != TypeDirectory {
+			return syscall.ENOTDIR
+		}
+		if exist(tx, m.entryKey(inode, "")) {
+			return syscall.ENOTEMPTY
+		}
+		if rs[1] != nil {
+			parseAttr(rs[1], &attr)
+		}
+		if m.isRetained(tx, parent, &pattr, false) || m.isRetained(tx, inode, &attr, false) {
+			return syscall.EPERM
+		}
+		prj = m.getProject(tx, inode)
+		now := time.Now()
+		pattr.Nlink--
+		pattr.Mtime = now.Unix()
+		pattr.Mtimensec = uint32(now.Nanosecond())
+		pattr.Ctime = now.Unix()
+		pattr.Ctimensec = uint32(now.Nanosecond())
+
+		tx.dels(m.entryKey(parent, name), m.inodeKey(inode))
+		m.updateIndex(tx, parent, string(entryName([]byte(name), buf)), inode, false)
+		tx.set(m.inodeKey(parent), marshalAttr(&pattr))
+		m.removeXattrs(tx, inode)
+		m.removeTags(tx, inode)
+		return nil
+	}, parent)
+	if st == 0 {
+		m.updateStats(0, -1)
+		m.updateUsage(attr.Uid, attr.Gid, prj, 0, -1)
+	}
+	return st
+}
+
+func (m *kvMeta) emptyDir(ctx Context, inode Ino, concurrent chan int) syscall.Errno {
+	if st := m.Access(ctx, inode, 3, nil); st != 0 {
+		return st
+	}
+	var entries []*Entry
+	if st := m.Readdir(ctx, inode, 0, &entries); st != 0 {
+		return st
+	}
+	var wg sync.WaitGroup
+	var status syscall.Errno
+	for _, e := range entries {
+		if e.Inode == inode || len(e.Name) == 2 && string(e.Name) == ".." {
+			continue
+		}
+		if e.Attr.Typ == TypeDirectory {
+			select {
+			case concurrent <- 1:
+				wg.Add(1)
+				go func(child Ino, name string) {
+					defer wg.Done()
+					e := m.emptyEntry(ctx, inode, name, child, concurrent)
+					if e != 0 {
+						status = e
+					}
+					<-concurrent
+				}(e.Inode, string(e.Name))
+			default:
+				if st := m.emptyEntry(ctx, inode, string(e.Name), e.Inode, concurrent); st != 0 {
+					return st
+				}
+			}
+		} else {
+			if st := m.Unlink(ctx, inode, string(e.Name)); st != 0 {
+				return st
+			}
+		}
+	}
+	wg.Wait()
+	return status
+}
+
+func (m *kvMeta) emptyEntry(ctx Context, parent Ino, name string, inode Ino, concurrent chan int) syscall.Errno {
+	st := m.emptyDir(ctx, inode, concurrent)
+	if st == 0 {
+		st = m.Rmdir(ctx, parent, name)
+		if st == syscall.ENOTEMPTY {
+			st = m.emptyEntry(ctx, parent, name, inode, concurrent)
+		}
+	}
+	return st
+}
+
+func (m *kvMeta) Rmr(ctx Context, parent Ino, name string) syscall.Errno {
+	if st := m.Access(ctx, parent, 3, nil); st != 0 {
+		return st
+	}
+	var inode Ino
+	var attr Attr
+	if st := m.Lookup(ctx, parent, name, &inode, &attr); st != 0 {
+		return st
+	}
+	if attr.Typ != TypeDirectory {
+		return m.Unlink(ctx, parent, name)
+	}
+	concurrent := make(chan int, 50)
+	return m.emptyEntry(ctx, parent, name, inode, concurrent)
+}
+
+func (m *kvMeta) Rename(ctx Context, parentSrc Ino, nameSrc string, parentDst Ino, nameDst string, flags uint32, inode *Ino, attr *Attr) syscall.Errno {
+	if m.readOnly {
+		return syscall.EROFS
+	}
+	if flags&^RenameNoReplace != 0 {
+		return syscall.ENOTSUP // exchange and whiteout are not supported
+	}
+	if st := checkName(&m.names, nameDst); st != 0 {
+		return st
+	}
+	var dino Ino
+	var dtyp uint8
+	var tattr Attr
+	var opened bool
+	var newSpace, newInodes int64
+	var tprj uint32
+	st := m.txn(func(tx kvTxn) error {
+		dino, dtyp, tattr, opened, tprj = 0, 0, Attr{}, false, 0
+		newSpace, newInodes = 0, 0
+		buf := tx.get(m.entryKey(parentSrc, nameSrc))
+		if buf == nil {
+			return syscall.ENOENT
+		}
+		typ, ino := parseEntry(buf)
+		if inode != nil {
+			*inode = ino
+		}
+		if parentSrc == parentDst && nameSrc == nameDst {
+			if flags&RenameNoReplace != 0 {
+				return syscall.EEXIST
+			}
+			return nil
+		}
+		if parentSrc == parentDst && m.caseInsensitive && foldName(nameSrc) == foldName(nameDst) {
+			// only the case of name is changed
+			var pattr Attr
+			if a := tx.get(m.inodeKey(parentSrc)); a != nil {
+				parseAttr(a, &pattr)
+			}
+			if m.isRetained(tx, parentSrc, &pattr, false) {
+				return syscall.EPERM
+			}
+			tx.set(m.entryKey(parentDst, nameDst), m.newEntry(typ, ino, nameDst))
+			m.updateIndex(tx, parentSrc, string(entryName([]byte(nameSrc), buf)), ino, false)
+			m.updateIndex(tx, parentDst, nameDst, ino, true)
+			return nil
+		}
+		rs := tx.gets(m.inodeKey(parentSrc), m.inodeKey(parentDst), m.inodeKey(ino))
+		if rs[0] == nil || rs[1] == nil || rs[2] == nil {
+			return syscall.ENOENT
+		}
+		var sattr, dattr, iattr Attr
+		parseAttr(rs[0], &sattr)
+		if sattr.Typ != TypeDirectory {
+			return syscall.ENOTDIR
+		}
+		parseAttr(rs[1], &dattr)
+		if dattr.Typ != TypeDirectory {
+			return syscall.ENOTDIR
+		}
+		parseAttr(rs[2], &iattr)
+		if m.isRetained(tx, parentSrc, &sattr, false) || m.isRetained(tx, ino, &iattr, false) {
+			return syscall.EPERM
+		}
+		if parentSrc != parentDst {
+			if st := checkProjectMove(m.getProject(tx, ino), m.getProject(tx, parentDst)); st != 0 {
+				return st
+			}
+		}
+
+		dbuf := tx.get(m.entryKey(parentDst, nameDst))
+		if dbuf != nil {
+			if ctx.Value(CtxKey("behavior")) == "Hadoop" || flags&RenameNoReplace != 0 {
+				return syscall.EEXIST
+			}
+			dtyp, dino = parseEntry(dbuf)
+			tprj = m.getProject(tx, dino)
+			if dtyp == TypeDirectory {
+				if exist(tx, m.entryKey(dino, "")) {
+					return syscall.ENOTEMPTY
+				}
+				if a := tx.get(m.inodeKey(dino)); a != nil {
+					parseAttr(a, &tattr)
+				}
+				if m.isRetained(tx, parentDst, &dattr, false) || m.isRetained(tx, dino, &tattr, false) {
+					return syscall.EPERM
+				}
+			} else {
+				a := tx.get(m.inodeKey(dino))
+				if a == nil {
+					return syscall.ENOENT
+				}
+				parseAttr(a, &tattr)
+				if m.isRetained(tx, parentDst, &dattr, false) || m.isRetained(tx, dino, &tattr, false) {
+					return syscall.EPERM
+				}
+				tattr.Nlink--
+				if tattr.Nlink > 0 {
+					now := time.Now()
+					tattr.Ctime = now.Unix()
+					tattr.Ctimensec = uint32(now.Nanosecond())
+				} else if dtyp == TypeFile {
+					m.Lock()
+					opened = m.openFiles[dino] > 0
+					m.Unlock()
+				}
+			}
+		}
+
+		now := time.Now()
+		sattr.Mtime = now.Unix()
+		sattr.Mtimensec = uint32(now.Nanosecond())
+		sattr.Ctime = now.Unix()
+		sattr.Ctimensec = uint32(now.Nanosecond())
+		dattr.Mtime = now.Unix()
+		dattr.Mtimensec = uint32(now.Nanosecond())
+		dattr.Ctime = now.Unix()
+		dattr.Ctimensec = uint32(now.Nanosecond())
+		iattr.Parent = parentDst
+		iattr.Ctime = now.Unix()
+		iattr.Ctimensec = uint32(now.Nanosecond())
+		if typ == TypeDirectory && parentSrc != parentDst {
+			sattr.Nlink--
+			dattr.Nlink++
+		}
+		if attr != nil {
+			*attr = iattr
+		}
+
+		tx.dels(m.entryKey(parentSrc, nameSrc))
+		m.updateIndex(tx, parentSrc, string(entryName([]byte(nameSrc), buf)), ino, false)
+		if dino > 0 {
+			m.updateIndex(tx, parentDst, string(entryName([]byte(nameDst), dbuf)), dino, false)
+			if dtyp != TypeDirectory && tattr.Nlink > 0 {
+				tx.set(m.inodeKey(dino), marshalAttr(&tattr))
+			} else {
+				if dtyp == TypeDirectory {
+					tx.dels(m.inodeKey(dino))
+					dattr.Nlink--
+				} else if dtyp == TypeSymlink {
+					tx.dels(m.symKey(dino), m.inodeKey(dino))
+				} else if dtyp == TypeFile {
+					if opened {
+						tx.set(m.inodeKey(dino), marshalAttr(&tattr))
+						tx.set(m.sustainedKey(m.sid, dino), []byte{1})
+					} else {
+						tx.set(m.delfileKey(dino, tattr.Length), packCounter(now.Unix()))
+						tx.dels(m.inodeKey(dino))
+						newSpace = -align4K(tattr.Length)
+					}
+				} else {
+					tx.dels(m.inodeKey(dino))
+				}
+				if !opened {
+					m.removeXattrs(tx, dino)
+					m.removeTags(tx, dino)
+				}
+				newInodes = -1
+			}
+		}
+		tx.set(m.entryKey(parentDst, nameDst), m.newEntry(typ, ino, nameDst))
+		m.updateIndex(tx, parentDst, nameDst, ino, true)
+		if parentDst != parentSrc {
+			tx.set(m.inodeKey(parentSrc), marshalAttr(&sattr))
+		}
+		tx.set(m.inodeKey(parentDst), marshalAttr(&dattr))
+		tx.set(m.inodeKey(ino), marshalAttr(&iattr))
+		return nil
+	}, parentSrc, parentDst)
+	if st == 0 && dino > 0 {
+		if dtyp == TypeFile && tattr.Nlink == 0 {
+			if opened {
+				m.Lock()
+				m.removedFiles[dino] = true
+				m.Unlock()
+			} else {
+				go m.deleteFile(dino, tattr.Length)
+			}
+		}
+		m.updateStats(newSpace, newInodes)
+		m.updateUsage(tattr.Uid, tattr.Gid, tprj, newSpace, newInodes)
+	}
+	return st
+}
+
+func (m *kvMeta) Link(ctx Context, inode, parent Ino, name string, attr *Attr) syscall.Errno {
+	if m.readOnly {
+		return syscall.EROFS
+	}
+	if st := checkName(&m.names, name); st != 0 {
+		return st
+	}
+	return m.txn(func(tx kvTxn) error {
+		rs := tx.gets(m.inodeKey(parent), m.inodeKey(inode))
+		if rs[0] == nil || rs[1] == nil {
+			return syscall.ENOENT
+		}
+		var pattr, iattr Attr
+		parseAttr(rs[0], &pattr)
+		if pattr.Typ != TypeDirectory {
+			return syscall.ENOTDIR
+		}
+		now := time.Now()
+		pattr.Mtime = now.Unix()
+		pattr.Mtimensec = uint32(now.Nanosecond())
+		pattr.Ctime = now.Unix()
+		pattr.Ctimensec = uint32(now.Nanosecond())
+		parseAttr(rs[1], &iattr)
+		if iattr.Typ == TypeDirectory {
+			return syscall.EPERM
+		}
+		iattr.Ctime = now.Unix()
+		iattr.Ctimensec = uint32(now.Nanosecond())
+		iattr.Nlink++
+		if tx.get(m.entryKey(parent, name)) != nil {
+			return syscall.EEXIST
+		}
+		if st := checkProjectMove(m.getProject(tx, inode), m.getProject(tx, parent)); st != 0 {
+			return st
+		}
+
+		tx.set(m.entryKey(parent, name), m.newEntry(iattr.Typ, inode, name))
+		m.updateIndex(tx, parent, name, inode, true)
+		tx.set(m.inodeKey(parent), marshalAttr(&pattr))
+		tx.set(m.inodeKey(inode), marshalAttr(&iattr))
+		if attr != nil {
+			*attr = iattr
+		}
+		return nil
+	}, inode, parent)
+}
+
+func (m *kvMeta) Readdir(ctx Context, inode Ino, plus uint8, entries *[]*Entry) syscall.Errno {
+	var attr Attr
+	if err := m.GetAttr(ctx, inode, &attr); err != 0 {
+		return err
+	}
+	*entries = []*Entry{
+		{
+			Inode: inode,
+			Name:  []byte("."),
+			Attr:  &Attr{Typ: TypeDirectory},
+		},
+	}
+	if attr.Parent > 0 {
+		*entries = append(*entries, &Entry{
+			Inode: attr.Parent,
+			Name:  []byte(".."),
+			Attr:  &Attr{Typ: TypeDirectory},
+		})
+	}
+
+	prefix := m.entryKey(inode, "")
+	var children []*Entry
+	err := m.scan(prefix, func(key, value []byte) bool {
+		typ, ino := parseEntry(value)
+		children = append(children, &Entry{
+			Inode: ino,
+			Name:  entryName(key[len(prefix):], value),
+			Attr:  &Attr{Typ: typ},
+		})
+		return true
+	})
+	if err != nil {
+		return errno(err)
+	}
+
+	if plus != 0 {
+		batchSize := 4096
+		for i := 0; i < len(children); i += batchSize {
+			es := children[i:]
+			if len(es) > batchSize {
+				es = es[:batchSize]
+			}
+			keys := make([][]byte, len(es))
+			for j, e := range es {
+				keys[j] = m.inodeKey(e.Inode)
+			}
+			err = m.client.txn(func(tx kvTxn) error {
+				for j, a := range tx.gets(keys...) {
+					if a != nil {
+						parseAttr(a, es[j].Attr)
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				return errno(err)
+			}
+		}
+	}
+	*entries = append(*entries, children...)
+	return 0
+}
+
+func (m *kvMeta) heartbeat() error {
+	key := m.heartbeatKey(m.sid)
+	value := packCounter(time.Now().Unix())
+	if l, ok := m.client.(leaser); ok {
+		return l.keepAlive(key, value, sessionTTL)
+	}
+	return m.doTxn(func(tx kvTxn) error {
+		tx.set(key, value)
+		return nil
+	})
+}
+
+func (m *kvMeta) refreshSession() {
+	for {
+		time.Sleep(m.conf.heartbeat())
+		if err := m.heartbeat(); err != nil {
+			logger.Warnf("refresh session %d: %s", m.sid, err)
+		}
+		if err := m.loadSetting(false); err != nil {
+			logger.Warnf("reload setting: %s", err)
+		}
+		if !m.readOnly && jobs.IsLeader() {
+			go m.cleanStaleSessions()
+		}
+	}
+}
+
+func (m *kvMeta) cleanStaleSessions() {
+	var sids []uint64
+	_ = m.scan(m.fmtKey("SE"), func(key, value []byte) bool {
+		sids = append(sids, utils.ReadBuffer(key[2:]).Get64())
+		return true
+	})
+	deadline := time.Now().Add(-staleSession).Unix()
+	for _, sid := range sids {
+		if sid == m.sid {
+			continue
+		}
+		hb, err := m.get(m.heartbeatKey(sid))
+		if err != nil {
+			logger.Warnf("get heartbeat of session %d: %s", sid, err)
+			continue
+		}
+		if hb == nil || parseCounter(hb) < deadline {
+			m.cleanStaleSession(sid)
+		}
+	}
+}
+
+func (m *kvMeta) cleanStaleSession(sid uint64) {
+	m.cleanStaleLocks(sid)
+	var inodes []Ino
+	_ = m.scan(m.fmtKey("SS", sid), func(key, value []byte) bool {
+		inodes = append(inodes, Ino(utils.ReadBuffer(key[10:]).Get64()))
+		return true
+	})
+	var failed bool
+	for _, inode := range inodes {
+		if err := m.deleteInode(inode); err != nil {
+			logger.Errorf("Failed to delete inode %d: %s", inode, err)
+			failed = true
+			continue
+		}
+		_ = m.doTxn(func(tx kvTxn) error {
+			tx.dels(m.sustainedKey(sid, inode))
+			return nil
+		})
+	}
+	if !failed {
+		err := m.doTxn(func(tx kvTxn) error {
+			tx.dels(m.sessionKey(sid), m.heartbeatKey(sid), m.sessionInfoKey(sid))
+			return nil
+		})
+		logger.Infof("cleanup stale session %d: %v", sid, err)
+	}
+}
+
+func (m *kvMeta) Lease(name string, ttl time.Duration) (bool, error) {
+	var held bool
+	err := m.doTxn(func(tx kvTxn) error {
+		now := time.Now()
+		held = true
+		if buf := tx.get(m.fmtKey("L", name)); len(buf) == 16 {
+			rb := utils.ReadBuffer(buf)
+			sid, expire := rb.Get64(), rb.Get64()
+			held = sid == m.sid || int64(expire) < now.UnixNano()
+		}
+		if held && ttl == 0 {
+			tx.dels(m.fmtKey("L", name))
+		} else if held {
+			w := utils.NewBuffer(16)
+			w.Put64(m.sid)
+			w.Put64(uint64(now.Add(ttl).UnixNano()))
+			tx.set(m.fmtKey("L", name), w.Bytes())
+		}
+		return nil
+	})
+	return held && err == nil, err
+}
+
+func (m *kvMeta) ListSessions() ([]*SessionInfo, error) {
+	var sessions []*SessionInfo
+	err := m.scan(m.fmtKey("SE"), func(key, value []byte) bool {
+		sessions = append(sessions, &SessionInfo{Sid: utils.ReadBuffer(key[2:]).Get64()})
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range sessions {
+		sid := s.Sid
+		info, err := m.get(m.sessionInfoKey(sid))
+		if err != nil {
+			return nil, err
+		}
+		if info != nil {
+			if err = json.Unmarshal(info, s); err != nil {
+				logger.Warnf("invalid info of session %d: %s", sid, err)
+			}
+		}
+		hb, err := m.get(m.heartbeatKey(sid))
+		if err != nil {
+			return nil, err
+		}
+		if hb != nil {
+			s.Heartbeat = time.Unix(parseCounter(hb), 0)
+		}
+	}
+	return sessions, nil
+}
+
+func (m *kvMeta) deleteInode(inode Ino) error {
+	var attr Attr
+	var found bool
+	var prj uint32
+	err := m.doTxn(func(tx kvTxn) error {
+		a := tx.get(m.inodeKey(inode))
+		if a == nil {
+			found = false
+			return nil
+		}
+		found = true
+		parseAttr(a, &attr)
+		prj = m.getProject(tx, inode)
+		tx.set(m.delfileKey(inode, attr.Length), packCounter(time.Now().Unix()))
+		tx.dels(m.inodeKey(inode), m.delegationKey(inode))
+		m.removeXattrs(tx, inode)
+		m.removeTags(tx, inode)
+		return nil
+	})
+	if err == nil && found {
+		m.updateStats(-align4K(attr.Length), 0)
+		m.updateUsage(attr.Uid, attr.Gid, prj, -align4K(attr.Length), 0)
+		go m.deleteFile(inode, attr.Length)
+	}
+	return err
+}
+
+func (m *kvMeta) Open(ctx Context, inode Ino, flags uint8, attr *Attr) syscall.Errno {
+	if m.readOnly && flags&(syscall.O_WRONLY|syscall.O_RDWR) != 0 {
+		return syscall.EROFS
+	}
+	var err syscall.Errno
+	if attr != nil {
+		err = m.GetAttr(ctx, inode, attr)
+		if err == 0 && attr.Flags&FlagReadOnly != 0 && flags&(syscall.O_WRONLY|syscall.O_RDWR) != 0 {
+			return syscall.EPERM
+		}
+		if err == 0 && attr.Flags&FlagRetention != 0 && flags&(syscall.O_WRONLY|syscall.O_RDWR) != 0 {
+			m.Lock()
+			writing := m.writing[inode]
+			m.Unlock()
+			if v, e := m.get(m.xattrKey(inode, RetentionXattr)); !writing && e == nil && v != nil && retentionActive(v) {
+				return syscall.EPERM
+			}
+		}
+	}
+	if err == 0 {
+		if err = m.delegs.recall(ctx, m, m.sid, inode, flags&(syscall.O_WRONLY|syscall.O_RDWR) != 0); err != 0 {
+			return err
+		}
+		m.Lock()
+		m.openFiles[inode] = m.openFiles[inode] + 1
+		m.Unlock()
+	}
+	return 0
+}
+
+func (m *kvMeta) Delegate(ctx Context, inode Ino, ltype uint8) syscall.Errno {
+	if m.readOnly && (ltype == DelegateWrite || ltype == DelegateAppend) {
+		return syscall.EROFS
+	}
+	return m.delegs.delegate(m, m.sid, inode, ltype)
+}
+
+func (m *kvMeta) updateDelegations(inode Ino, f func(ds []delegation) []delegation) error {
+	return m.doTxn(func(tx kvTxn) error {
+		key := m.delegationKey(inode)
+		ds := f(loadDelegations(tx.get(key)))
+		if len(ds) == 0 {
+			tx.dels(key)
+		} else {
+			tx.set(key, dumpDelegations(ds))
+		}
+		return nil
+	}, inode)
+}
+
+func (m *kvMeta) Close(ctx Context, inode Ino) syscall.Errno {
+	m.Lock()
+	defer m.Unlock()
+	refs := m.openFiles[inode]
+	if refs <= 1 {
+		delete(m.openFiles, inode)
+		delete(m.writing, inode)
+		if m.removedFiles[inode] {
+			delete(m.removedFiles, inode)
+			go func() {
+				if err := m.deleteInode(inode); err == nil {
+					_ = m.doTxn(func(tx kvTxn) error {
+						tx.dels(m.sustainedKey(m.sid, inode))
+						return nil
+					})
+				}
+			}()
+		}
+	} else {
+		m.openFiles[inode] = refs - 1
+	}
+	return 0
+}
+
+func (m *kvMeta) Read(ctx Context, inode Ino, indx uint32, chunks *[]Slice) syscall.Errno {
+	buf, err := m.get(m.chunkKey(inode, indx))
+	if err != nil {
+		return errno(err)
+	}
+	a := newSliceArena()
+	*chunks = buildObserved(a, a.readSliceBuf(buf))
+	a.release()
+	if len(buf) >= 5*sliceBytes {
+		go m.compactChunk(inode, indx, false)
+	}
+	return 0
+}
+
+func (m *kvMeta) NewChunk(ctx Context, inode Ino, indx uint32, offset uint32, chunkid *uint64) syscall.Errno {
+	if m.readOnly {
+		return syscall.EROFS
+	}
+	cid, err := m.allocate(&m.freeChunks, nextChunkKey)
+	if err == nil {
+		*chunkid = cid
+	}
+	return errno(err)
+}
+
+func (m *kvMeta) ReserveChunks(maxid uint64) error {
+	m.freeMu.Lock()
+	defer m.freeMu.Unlock()
+	err := m.doTxn(func(tx kvTxn) error {
+		if next := incrBy(tx, m.counterKey(nextChunkKey), 0); next < int64(maxid) {
+			incrBy(tx, m.counterKey(nextChunkKey), int64(maxid)-next)
+		}
+		return nil
+	})
+	if err == nil && m.freeChunks.next <= maxid {
+		m.freeChunks.next, m.freeChunks.maxid = 0, 0
+	}
+	return err
+}
+
+func (m *kvMeta) Write(ctx Context, inode Ino, indx uint32, off uint32, slice Slice) syscall.Errno {
+	if m.readOnly {
+		return syscall.EROFS
+	}
+	var added int64
+	var needCompact bool
+	var attr Attr
+	var prj uint32
+	st := m.txn(func(tx kvTxn) error {
+		a := tx.get(m.inodeKey(inode))
+		if a == nil {
+			return syscall.ENOENT
+		}
+		parseAttr(a, &attr)
+		if attr.Flags&FlagReadOnly != 0 || m.isRetained(tx, inode, &attr, true) {
+			return syscall.EPERM
+		}
+		newleng := uint64(indx)*ChunkSize + uint64(off) + uint64(slice.Len)
+		added = 0
+		if newleng > attr.Length {
+			added = align4K(newleng) - align4K(attr.Length)
+			attr.Length = newleng
+		}
+		if added > 0 {
+			prj = m.getProject(tx, inode)
+		}
+		if added > 0 && (m.checkQuota(added) || m.checkProjectQuota(prj, added, 0)) {
+			return syscall.ENOSPC
+		}
+		now := time.Now()
+		attr.Mtime = now.Unix()
+		attr.Mtimensec = uint32(now.Nanosecond())
+		attr.Ctime = now.Unix()
+		attr.Ctimensec = uint32(now.Nanosecond())
+
+		val := appendValue(tx, m.chunkKey(inode, indx), marshalSlice(off, slice.Chunkid, slice.Size, slice.Off, slice.Len))
+		if indx == 0 {
+			// the inlined data (if any) should be written as the first slice
+			tx.dels(m.inlineKey(inode))
+		}
+		tx.set(m.inodeKey(inode), marshalAttr(&attr))
+		needCompact = (len(val)/sliceBytes)%20 == 0
+		return nil
+	}, inode)
+	if st == 0 {
+		m.updateStats(added, 0)
+		m.updateUsage(attr.Uid, attr.Gid, prj, added, 0)
+		if needCompact {
+			go m.compactChunk(inode, indx, false)
+		}
+	}
+	return st
+}
+
+func (m *kvMeta) ReadInline(ctx Context, inode Ino, data *[]byte) syscall.Errno {
+	buf, err := m.get(m.inlineKey(inode))
+	if err == nil {
+		*data = buf
+	}
+	return errno(err)
+}
+
+func (m *kvMeta) WriteInline(ctx Context, inode Ino, data []byte) syscall.Errno {
+	if m.readOnly {
+		return syscall.EROFS
+	}
+	var added int64
+	var attr Attr
+	var prj uint32
+	st := m.txn(func(tx kvTxn) error {
+		a := tx.get(m.inodeKey(inode))
+		if a == nil {
+			return syscall.ENOENT
+		}
+		parseAttr(a, &attr)
+		if attr.Typ != TypeFile || attr.Flags&FlagReadOnly != 0 || m.isRetained(tx, inode, &attr, true) {
+			return syscall.EPERM
+		}
+		if attr.Length > 0 && tx.get(m.inlineKey(inode)) == nil {
+			// only the files with inlined data (or empty) can be updated
+			return syscall.EINVAL
+		}
+		added = 0
+		if newleng := uint64(len(data)); newleng > attr.Length {
+			added = align4K(newleng) - align4K(attr.Length)
+			attr.Length = newleng
+		}
+		if added > 0 {
+			prj = m.getProject(tx, inode)
+		}
+		if added > 0 && (m.checkQuota(added) || m.checkProjectQuota(prj, added, 0)) {
+			return syscall.ENOSPC
+		}
+		now := time.Now()
+		attr.Mtime = now.Unix()
+		attr.Mtimensec = uint32(now.Nanosecond())
+		attr.Ctime = now.Unix()
+		attr.Ctimensec = uint32(now.Nanosecond())
+		tx.set(m.inlineKey(inode), data)
+		tx.set(m.inodeKey(inode), marshalAttr(&attr))
+		return nil
+	}, inode)
+	if st == 0 {
+		m.updateStats(added, 0)
+		m.updateUsage(attr.Uid, attr.Gid, prj, added, 0)
+	}
+	return st
+}
+
+func (m *kvMeta) CopyFileRange(ctx Context, fin Ino, offIn uint64, fout Ino, offOut uint64, size uint64, flags uint32, copied *uint64) syscall.Errno {
+	if m.readOnly {
+		return syscall.EROFS
+	}
+	var added int64
+	var attr Attr
+	var prj uint32
+	st := m.txn(func(tx kvTxn) error {
+		size := size
+		added = 0
+		rs := tx.gets(m.inodeKey(fin), m.inodeKey(fout))
+		if rs[0] == nil || rs[1] == nil {
+			return syscall.ENOENT
+		}
+		var sattr Attr
+		parseAttr(rs[0], &sattr)
+		if sattr.Typ != TypeFile {
+			return syscall.EINVAL
+		}
+		if offIn >= sattr.Length {
+			*copied = 0
+			return nil
+		}
+		if offIn+size > sattr.Length {
+			size = sattr.Length - offIn
+		}
+		parseAttr(rs[1], &attr)
+		if attr.Typ != TypeFile {
+			return syscall.EINVAL
+		}
+		if attr.Flags&FlagReadOnly != 0 || m.isRetained(tx, fout, &attr, true) {
+			return syscall.EPERM
+		}
+		if vs := tx.gets(m.inlineKey(fin), m.inlineKey(fout)); vs[0] != nil || vs[1] != nil {
+			// the data of small files are stored in meta, let the caller copy them
+			return syscall.ENOTSUP
+		}
+
+		newleng := offOut + size
+		if newleng > attr.Length {
+			added = align4K(newleng) - align4K(attr.Length)
+			attr.Length = newleng
+		}
+		if added > 0 {
+			prj = m.getProject(tx, fout)
+		}
+		if added > 0 && (m.checkQuota(added) || m.checkProjectQuota(prj, added, 0)) {
+			return syscall.ENOSPC
+		}
+		now := time.Now()
+		attr.Mtime = now.Unix()
+		attr.Mtimensec = uint32(now.Nanosecond())
+		attr.Ctime = now.Unix()
+		attr.Ctimensec = uint32(now.Nanosecond())
+
+		var vals [][]byte
+		for i := offIn / ChunkSize; i <= (offIn+size)/ChunkSize; i++ {
+			vals = append(vals, tx.get(m.chunkKey(fin, uint32(i))))
+		}
+		coff := offIn / ChunkSize * ChunkSize
+		for _, sv := range vals {
+			// Add a zero chunk for hole
+			ss := append([]*slice{{len: ChunkSize}}, readSliceBuf(sv)...)
+			cs := buildSlice(ss)
+			var tpos uint32
+			for _, s := range cs {
+				pos := tpos
+				tpos += s.Len
+				if coff+uint64(pos) < offIn+size && coff+uint64(pos)+uint64(s.Len) > offIn {
+					if coff+uint64(pos) < offIn {
+						dec := uint32(offIn - coff - uint64(pos))
+						s.Off += dec
+						pos += dec
+						s.Len -= dec
+					}
+					if coff+uint64(pos)+uint64(s.Len) > offIn+size {
+						dec := uint32(offIn + size - (coff + uint64(pos) + uint64(s.Len)))
+						s.Len -= dec
+					}
+					doff := coff + uint64(pos) - offIn + offOut
+					indx := uint32(doff / ChunkSize)
+					dpos := uint32(doff % ChunkSize)
+					if dpos+s.Len > ChunkSize {
+						appendValue(tx, m.chunkKey(fout, indx), marshalSlice(dpos, s.Chunkid, s.Size, s.Off, ChunkSize-dpos))
+						if s.Chunkid > 0 {
+							incrBy(tx, m.sliceKey(s.Chunkid, s.Size), 1)
+						}
+
+						skip := ChunkSize - dpos
+						appendValue(tx, m.chunkKey(fout, indx+1), marshalSlice(0, s.Chunkid, s.Size, s.Off+skip, s.Len-skip))
+						if s.Chunkid > 0 {
+							incrBy(tx, m.sliceKey(s.Chunkid, s.Size), 1)
+						}
+					} else {
+						appendValue(tx, m.chunkKey(fout, indx), marshalSlice(dpos, s.Chunkid, s.Size, s.Off, s.Len))
+						if s.Chunkid > 0 {
+							incrBy(tx, m.sliceKey(s.Chunkid, s.Size), 1)
+						}
+					}
+				}
+			}
+			coff += ChunkSize
+		}
+		tx.set(m.inodeKey(fout), marshalAttr(&attr))
+		*copied = size
+		return nil
+	}, fout)
+	if st == 0 {
+		m.updateStats(added, 0)
+		m.updateUsage(attr.Uid, attr.Gid, prj, added, 0)
+	}
+	return st
+}
+
+func (m *kvMeta) cleanupDeletedFiles() {
+	for {
+		time.Sleep(time.Minute)
+		if !jobs.IsLeader() {
+			continue
+		}
+		type delfile struct {
+			inode  Ino
+			length uint64
+		}
+		var files []delfile
+		_ = m.scan(m.fmtKey("D"), func(key, value []byte) bool {
+			if len(key) != 17 {
+				return true
+			}
+			rb := utils.ReadBuffer(key[1:])
+			files = append(files, delfile{Ino(rb.Get64()), rb.Get64()})
+			return len(files) < 1000
+		})
+		for _, f := range files {
+			logger.Debugf("cleanup chunks of inode %d with %d bytes", f.inode, f.length)
+			m.deleteFile(f.inode, f.length)
+		}
+	}
+}
+
+func (m *kvMeta) cleanupSlices() {
+	for {
+		time.Sleep(time.Hour)
+		jobs.Start(jobs.Cleanup)
+		type sliceRef struct {
+			chunkid uint64
+			size    uint32
+		}
+		var slices []sliceRef
+		err := m.scan(m.fmtKey("K"), func(key, value []byte) bool {
+			if len(key) == 13 && parseCounter(value) < 0 {
+				rb := utils.ReadBuffer(key[1:])
+				slices = append(slices, sliceRef{rb.Get64(), rb.Get32()})
+			}
+			return true
+		})
+		if err != nil {
+			logger.Errorf("scan slices: %s", err)
+		}
+		for _, s := range slices {
+			if s.chunkid > 0 && s.size > 0 {
+				m.deleteSlice(s.chunkid, s.size)
+			}
+		}
+		jobs.Done(jobs.Cleanup)
+	}
+}
+
+func (m *kvMeta) deleteSlice(chunkid uint64, size uint32) {
+	err := m.newMsg(DeleteChunk, chunkid, size)
+	if err != nil {
+		logger.Warnf("delete chunk %d (%d bytes): %s", chunkid, size, err)
+	} else {
+		_ = m.doTxn(func(tx kvTxn) error {
+			tx.dels(m.sliceKey(chunkid, size))
+			return nil
+		})
+	}
+}
+
+func (m *kvMeta) deleteChunk(inode Ino, indx uint32) error {
+	key := m.chunkKey(inode, indx)
+	for {
+		var slices []*slice
+		var refs []int64
+		err := m.doTxn(func(tx kvTxn) error {
+			slices, refs = nil, nil
+			buf := tx.get(key)
+			if len(buf) <= 100*sliceBytes {
+				tx.dels(key)
+			} else {
+				tx.set(key, buf[100*sliceBytes:])
+				buf = buf[:100*sliceBytes]
+			}
+			for _, s := range readSliceBuf(buf) {
+				if s.chunkid > 0 {
+					slices = append(slices, s)
+					refs = append(refs, incrBy(tx, m.sliceKey(s.chunkid, s.size), -1))
+				}
+			}
+			return nil
+		}, inode)
+		if err != nil {
+			return fmt.Errorf("delete slice from chunk %d_%d fail: %s, retry later", inode, indx, err)
+		}
+		for i, s := range slices {
+			if refs[i] < 0 {
+				m.deleteSlice(s.chunkid, s.size)
+			}
+		}
+		if len(slices) < 100 {
+			break
+		}
+	}
+	return nil
+}
+
+func (m *kvMeta) deleteFile(inode Ino, length uint64) {
+	if !jobs.TryStart(jobs.Deletion) {
+		return // it will be retried by cleanupDeletedFiles
+	}
+	defer jobs.Done(jobs.Deletion)
+	err := m.doTxn(func(tx kvTxn) error {
+		tx.dels(m.inlineKey(inode))
+		return nil
+	})
+	if err != nil {
+		logger.Warnf("delete inline data of inode %d: %s", inode, err)
+		return
+	}
+	var indexes []uint32
+	prefix := m.fmtKey("A", inode, "C")
+	err = m.scan(prefix, func(key, value []byte) bool {
+		if len(key) == len(prefix)+4 {
+			indexes = append(indexes, utils.ReadBuffer(key[len(prefix):]).Get32())
+		}
+		return true
+	})
+	if err != nil {
+		logger.Warnf("delete chunks of inode %d: %s", inode, err)
+		return
+	}
+	for _, indx := range indexes {
+		if err = m.deleteChunk(inode, indx); err != nil {
+			logger.Warnf("delete chunk %d_%d: %s", inode, indx, err)
+			return
+		}
+	}
+	_ = m.doTxn(func(tx kvTxn) error {
+		tx.dels(m.delfileKey(inode, length))
+		return nil
+	})
+}
+
+// compactChunk merges the slices of a chunk into a new one, the large slices at the beginning
+// are kept unless force is true, which is used by defrag to rewrite all of them.
+func (m *kvMeta) compactChunk(inode Ino, indx uint32, force bool) {
+	// avoid too many or duplicated compaction
+	m.Lock()
+	k := uint64(inode) + (uint64(indx) << 32)
+	if m.compacting[k] || !force && !jobs.TryStart(jobs.Compaction) {
+		m.Unlock()
+		return
+	}
+	m.compacting[k] = true
+	m.Unlock()
+	defer func() {
+		m.Lock()
+		delete(m.compacting, k)
+		m.Unlock()
+		if !force {
+			jobs.Done(jobs.Compaction)
+		}
+	}()
+
+	key := m.chunkKey(inode, indx)
+	buf, err := m.get(key)
+	if err != nil {
+		return
+	}
+	if len(buf) > 200*sliceBytes {
+		buf = buf[:200*sliceBytes]
+	}
+	chunkid, err := m.allocate(&m.freeChunks, nextChunkKey)
+	if err != nil {
+		return
+	}
+
+	var ss []*slice
+	var chunks []Slice
+	var skipped int
+	var pos, size uint32
+	for skipped*sliceBytes < len(buf) {
+		// the slices will be formed as a tree after buildSlice(),
+		// we should create new one (or remove the link in tree)
+		ss = readSliceBuf(buf[skipped*sliceBytes:])
+		chunks = buildSlice(ss)
+		pos, size = 0, 0
+		if chunks[0].Chunkid == 0 {
+			pos = chunks[0].Len
+			chunks = chunks[1:]
+		}
+		for _, s := range chunks {
+			size += s.Len
+		}
+		if force {
+			break
+		}
+		first := ss[0]
+		if first.len < (1<<20) || first.len*5 < size {
+			// it's too small
+			break
+		}
+		isFirst := func(pos uint32, s Slice) bool {
+			return pos == first.pos && s.Chunkid == first.chunkid && s.Off == first.off && s.Len == first.len
+		}
+		if !isFirst(pos, chunks[0]) {
+			// it's not the first slice, compact it
+			break
+		}
+		skipped++
+	}
+	if len(ss) == 0 || skipped*sliceBytes >= len(buf) {
+		return // all the slices are large enough
+	}
+	chunkid |= ss[len(ss)-1].chunkid & ChunkHints
+
+	logger.Debugf("compact %d %d %d %d %d", inode, indx, pos, len(ss), len(chunks))
+	err = m.newMsg(CompactChunk, chunks, chunkid)
+	if err != nil {
+		logger.Warnf("compact %d %d with %d slices: %s", inode, indx, len(ss), err)
+		return
+	}
+	var refs []int64
+	st := m.txn(func(tx kvTxn) error {
+		refs = nil
+		buf2 := tx.get(key)
+		if len(buf2) < len(buf) || !bytes.Equal(buf, buf2[:len(buf)]) {
+			return syscall.EINVAL
+		}
+		nv := make([]byte, 0, len(buf2)-len(ss)*sliceBytes+sliceBytes)
+		nv = append(nv, buf[:skipped*sliceBytes]...)
+		nv = append(nv, marshalSlice(pos, chunkid, size, 0, size)...)
+		nv = append(nv, buf2[len(buf):]...)
+		tx.set(key, nv)
+		tx.set(m.sliceKey(chunkid, size), packCounter(0)) // create the key to tracking it
+		for _, s := range ss {
+			if s.chunkid > 0 {
+				refs = append(refs, incrBy(tx, m.sliceKey(s.chunkid, s.size), -1))
+			} else {
+				refs = append(refs, 0)
+			}
+		}
+		return nil
+	}, inode)
+	// there could be false-negative that the compaction is successful, double-check
+	if st != 0 && st != syscall.EINVAL {
+		if v, e := m.get(m.sliceKey(chunkid, size)); e == nil {
+			if v == nil {
+				st = syscall.EINVAL // failed
+			} else {
+				st = 0 // successful
+			}
+		}
+	}
+
+	if st == syscall.EINVAL {
+		m.deleteSlice(chunkid, size)
+	} else if st == 0 {
+		for i, s := range ss {
+			if refs[i] < 0 {
+				m.deleteSlice(s.chunkid, s.size)
+			}
+		}
+		if v, err := m.get(key); err == nil && len(v) > 5*sliceBytes {
+			go func() {
+				// wait for the current compaction to finish
+				time.Sleep(time.Millisecond * 10)
+				m.compactChunk(inode, indx, false)
+			}()
+		}
+	} else {
+		logger.Warnf("compact %d_%d: %s", inode, indx, st)
+	}
+}
+
+type chunkIndex struct {
+	inode Ino
+	indx  uint32
+}
+
+// scanChunks returns the chunks which have at least minSlices slices.
+func (m *kvMeta) scanChunks(minSlices int) ([]chunkIndex, error) {
+	var chunks []chunkIndex
+	err := m.scan(m.fmtKey("A"), func(key, value []byte) bool {
+		if len(key) != 14 || key[9] != 'C' || len(value) < minSlices*sliceBytes {
+			return true
+		}
+		rb := utils.ReadBuffer(key[1:])
+		inode := Ino(rb.Get64())
+		rb.Get8()
+		chunks = append(chunks, chunkIndex{inode, rb.Get32()})
+		return true
+	})
+	if err != nil {
+		logger.Warnf("scan chunks: %s", err)
+	}
+	return chunks, err
+}
+
+func (m *kvMeta) CompactAll(ctx Context, minSlices int) syscall.Errno {
+	chunks, err := m.scanChunks(minSlices)
+	if err != nil {
+		return errno(err)
+	}
+	for _, c := range chunks {
+		m.compactChunk(c.inode, c.indx, false)
+	}
+	return 0
+}
+
+func (m *kvMeta) Defrag(ctx Context, minSlices int, age time.Duration, count *uint64) syscall.Errno {
+	if minSlices < 2 {
+		minSlices = 2
+	}
+	chunks, err := m.scanChunks(minSlices)
+	if err != nil {
+		return errno(err)
+	}
+	deadline := time.Now().Add(-age).Unix()
+	var attr Attr
+	var last Ino
+	for _, c := range chunks {
+		if c.inode != last {
+			last = c.inode
+			attr = Attr{}
+			if a, err := m.get(m.inodeKey(c.inode)); err == nil && a != nil {
+				parseAttr(a, &attr)
+			}
+		}
+		if attr.Typ != TypeFile || attr.Mtime > deadline {
+			continue // removed or still being written
+		}
+		m.compactChunk(c.inode, c.indx, true)
+		*count++
+	}
+	return 0
+}
+
+// Shrink only drops the hidden slices, the values of KV stores are compact already.
+func (m *kvMeta) Shrink(ctx Context, minSlices int, stats *ShrinkStats) syscall.Errno {
+	if m.readOnly {
+		return syscall.EROFS
+	}
+	if minSlices < 2 {
+		minSlices = 2
+	}
+	chunks, err := m.scanChunks(minSlices)
+	if err != nil {
+		return errno(err)
+	}
+	for _, c := range chunks {
+		var dropped int
+		st := m.txn(func(tx kvTxn) error {
+			dropped = 0
+			key := m.chunkKey(c.inode, c.indx)
+			buf := tx.get(key)
+			vals := make([]string, len(buf)/sliceBytes)
+			for i := range vals {
+				vals[i] = string(buf[i*sliceBytes : (i+1)*sliceBytes])
+			}
+			hidden := hiddenSlices(vals)
+			if len(hidden) == 0 {
+				return nil
+			}
+			ss := readSlices(vals)
+			kept := make([]byte, 0, len(buf)-len(hidden)*sliceBytes)
+			for i, val := range vals {
+				if len(hidden) > 0 && hidden[0] == i {
+					hidden = hidden[1:]
+					incrBy(tx, m.sliceKey(ss[i].chunkid, ss[i].size), -1)
+					dropped++
+				} else {
+					kept = append(kept, val...)
+				}
+			}
+			tx.set(key, kept)
+			return nil
+		}, c.inode)
+		if st != 0 {
+			logger.Warnf("shrink chunk %d_%d: %s", c.inode, c.indx, st)
+			return st
+		}
+		if dropped > 0 {
+			stats.Chunks++
+			stats.Slices += uint64(dropped)
+		}
+	}
+	return 0
+}
+
+func (m *kvMeta) ListSlices(ctx Context, slices *[]Slice) syscall.Errno {
+	*slices = nil
+	err := m.scan(m.fmtKey("A"), func(key, value []byte) bool {
+		if len(key) != 14 || key[9] != 'C' {
+			return true
+		}
+		for _, s := range readSliceBuf(value) {
+			if s.chunkid > 0 {
+				*slices = append(*slices, Slice{Chunkid: s.chunkid, Size: s.size})
+			}
+		}
+		return true
+	})
+	if err != nil {
+		logger.Warnf("list slices: %s", err)
+	}
+	return errno(err)
+}
+
+func (m *kvMeta) ListDeleted(ctx Context, withSlices bool, backlog *Backlog) syscall.Errno {
+	*backlog = Backlog{}
+	err := m.scan(m.fmtKey("D"), func(key, value []byte) bool {
+		if len(key) == 17 {
+			rb := utils.ReadBuffer(key[1:])
+			backlog.Files = append(backlog.Files, DeletedFile{Inode: Ino(rb.Get64()), Length: rb.Get64()})
+		}
+		return true
+	})
+	if err != nil {
+		return errno(err)
+	}
+	var sustained []Ino
+	err = m.scan(m.fmtKey("SS"), func(key, value []byte) bool {
+		if len(key) == 18 {
+			sustained = append(sustained, Ino(utils.ReadBuffer(key[10:]).Get64()))
+		}
+		return true
+	})
+	if err != nil {
+		return errno(err)
+	}
+	for _, inode := range sustained {
+		a, err := m.get(m.inodeKey(inode))
+		if err != nil {
+			return errno(err)
+		}
+		if a == nil {
+			continue
+		}
+		var attr Attr
+		parseAttr(a, &attr)
+		backlog.Files = append(backlog.Files, DeletedFile{Inode: inode, Length: attr.Length, Opened: true})
+	}
+	if withSlices {
+		for i := range backlog.Files {
+			f := &backlog.Files[i]
+			err = m.scan(m.fmtKey("A", f.Inode, "C"), func(key, value []byte) bool {
+				for _, s := range readSliceBuf(value) {
+					if s.chunkid > 0 {
+						f.Slices = append(f.Slices, Slice{Chunkid: s.chunkid, Size: s.size})
+					}
+				}
+				return true
+			})
+			if err != nil {
+				return errno(err)
+			}
+		}
+	}
+	err = m.scan(m.fmtKey("K"), func(key, value []byte) bool {
+		if len(key) == 13 && parseCounter(value) < 0 {
+			rb := utils.ReadBuffer(key[1:])
+			if chunkid, size := rb.Get64(), rb.Get32(); chunkid > 0 && size > 0 {
+				backlog.Released = append(backlog.Released, Slice{Chunkid: chunkid, Size: size})
+			}
+		}
+		return true
+	})
+	return errno(err)
+}
+
+func (m *kvMeta) AddPack(pack uint64, chunks []uint64, offsets []uint32) error {
+	if len(offsets) != len(chunks)+1 {
+		return fmt.Errorf("invalid offsets of pack %d: %d != %d", pack, len(offsets), len(chunks)+1)
+	}
+	return m.doTxn(func(tx kvTxn) error {
+		for i, id := range chunks {
+			w := utils.NewBuffer(16)
+			w.Put64(pack)
+			w.Put32(offsets[i])
+			w.Put32(offsets[i+1] - offsets[i])
+			tx.set(m.packKey(id), w.Bytes())
+		}
+		incrBy(tx, m.packRefKey(pack), int64(len(chunks)))
+		return nil
+	})
+}
+
+func (m *kvMeta) LookupPack(chunkid uint64) (pack uint64, off, size uint32, err error) {
+	buf, err := m.get(m.packKey(chunkid))
+	if err != nil || buf == nil {
+		return 0, 0, 0, err
+	}
+	if len(buf) != 16 {
+		return 0, 0, 0, fmt.Errorf("invalid packed block %d: %v", chunkid, buf)
+	}
+	rb := utils.ReadBuffer(buf)
+	return rb.Get64(), rb.Get32(), rb.Get32(), nil
+}
+
+func (m *kvMeta) RemovePack(chunkid uint64) (pack uint64, left int64, err error) {
+	err = m.doTxn(func(tx kvTxn) error {
+		pack, left = 0, 0
+		buf := tx.get(m.packKey(chunkid))
+		if buf == nil {
+			return nil
+		}
+		if len(buf) != 16 {
+			return fmt.Errorf("invalid packed block %d: %v", chunkid, buf)
+		}
+		pack = utils.ReadBuffer(buf).Get64()
+		tx.dels(m.packKey(chunkid))
+		left = incrBy(tx, m.packRefKey(pack), -1)
+		if left <= 0 {
+			tx.dels(m.packRefKey(pack))
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	return pack, left, nil
+}
+
+func (m *kvMeta) AddDedup(hash string, chunkid uint64, indx int, key string) (string, error) {
+	var owner string
+	err := m.doTxn(func(tx kvTxn) error {
+		var refs uint64
+		refs, owner = parseDedupObject(tx.get(m.dedupObjectKey(hash)))
+		if owner == "" {
+			if key == "" {
+				return nil
+			}
+			owner = key
+		}
+		if tx.get(m.dedupKey(chunkid, indx)) == nil {
+			refs++
+			tx.set(m.dedupKey(chunkid, indx), packDedupBlock(hash, owner))
+		}
+		tx.set(m.dedupObjectKey(hash), packDedupObject(refs, owner))
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return owner, nil
+}
+
+func (m *kvMeta) LookupDedup(chunkid uint64, indx int) (string, error) {
+	var key string
+	err := m.client.txn(func(tx kvTxn) error {
+		_, key = parseDedupBlock(tx.get(m.dedupKey(chunkid, indx)))
+		return nil
+	})
+	return key, err
+}
+
+func (m *kvMeta) DedupRefs(chunkid uint64, indx int) (key string, refs int64, err error) {
+	err = m.client.txn(func(tx kvTxn) error {
+		key, refs = "", 0
+		buf := tx.get(m.dedupKey(chunkid, indx))
+		if buf == nil {
+			return nil
+		}
+		hash, _ := parseDedupBlock(buf)
+		var n uint64
+		n, key = parseDedupObject(tx.get(m.dedupObjectKey(hash)))
+		refs = int64(n)
+		return nil
+	})
+	return key, refs, err
+}
+
+func (m *kvMeta) RemoveDedup(chunkid uint64, indx int) (key string, left int64, err error) {
+	err = m.doTxn(func(tx kvTxn) error {
+		key, left = "", 0
+		buf := tx.get(m.dedupKey(chunkid, indx))
+		if buf == nil {
+			return nil
+		}
+		tx.dels(m.dedupKey(chunkid, indx))
+		hash, _ := parseDedupBlock(buf)
+		var refs uint64
+		refs, key = parseDedupObject(tx.get(m.dedupObjectKey(hash)))
+		left = int64(refs) - 1
+		if left > 0 {
+			tx.set(m.dedupObjectKey(hash), packDedupObject(uint64(left), key))
+		} else {
+			tx.dels(m.dedupObjectKey(hash))
+		}
+		return nil
+	})
+	if err != nil {
+		return "", 0, err
+	}
+	return key, left, nil
+}
+
+func (m *kvMeta) ListDedup() (map[string]int64, error) {
+	objs := make(map[string]int64)
+	err := m.scan(m.fmtKey("BH"), func(_, value []byte) bool {
+		if refs, key := parseDedupObject(value); key != "" {
+			objs[key] = int64(refs)
+		}
+		return true
+	})
+	return objs, err
+}
+
+func (m *kvMeta) AddReplication(op string) error {
+	return m.doTxn(func(tx kvTxn) error {
+		key := m.replicationKey(op)
+		w := utils.NewBuffer(16)
+		w.Put64(uint64(time.Now().Unix()))
+		if v := tx.get(key); len(v) == 16 {
+			w.Put(v[8:]) // keep the lease
+		} else {
+			w.Put64(0)
+		}
+		tx.set(key, w.Bytes())
+		return nil
+	})
+}
+
+func (m *kvMeta) ClaimReplications(limit int, lease time.Duration) ([]string, error) {
+	var claimed []string
+	err := m.doTxn(func(tx kvTxn) error {
+		claimed = nil
+		now := time.Now()
+		keys, values := scanPrefix(tx, m.fmtKey("R"), limit*4)
+		for i, key := range keys {
+			if len(values[i]) != 16 {
+				continue
+			}
+			rb := utils.ReadBuffer(values[i])
+			added, expire := rb.Get64(), int64(rb.Get64())
+			if now.Unix() < expire {
+				continue
+			}
+			claimed = append(claimed, string(key[1:]))
+			w := utils.NewBuffer(16)
+			w.Put64(added)
+			w.Put64(uint64(now.Add(lease).Unix()))
+			tx.set(key, w.Bytes())
+			if len(claimed) >= limit {
+				break
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return claimed, nil
+}
+
+func (m *kvMeta) DoneReplication(op string) error {
+	return m.doTxn(func(tx kvTxn) error {
+		tx.dels(m.replicationKey(op))
+		return nil
+	})
+}
+
+func (m *kvMeta) ReplicationLag() (int64, time.Time, error) {
+	var count int64
+	var oldest int64
+	err := m.scan(m.fmtKey("R"), func(key, value []byte) bool {
+		if len(value) == 16 {
+			count++
+			added := int64(utils.ReadBuffer(value).Get64())
+			if oldest == 0 || added < oldest {
+				oldest = added
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	var t time.Time
+	if oldest > 0 {
+		t = time.Unix(oldest, 0)
+	}
+	return count, t, nil
+}
+
+func (m *kvMeta) AddExternal(chunkid uint64, key string, off uint64) error {
+	w := utils.NewBuffer(8 + uint32(len(key)))
+	w.Put64(off)
+	w.Put([]byte(key))
+	return m.doTxn(func(tx kvTxn) error {
+		tx.set(m.externalKey(chunkid), w.Bytes())
+		return nil
+	})
+}
+
+func (m *kvMeta) LookupExternal(chunkid uint64) (key string, off uint64, err error) {
+	buf, err := m.get(m.externalKey(chunkid))
+	if err != nil || buf == nil {
+		return "", 0, err
+	}
+	if len(buf) <= 8 {
+		return "", 0, fmt.Errorf("invalid external chunk %d: %v", chunkid, buf)
+	}
+	rb := utils.ReadBuffer(buf)
+	off = rb.Get64()
+	return string(rb.Get(rb.Left())), off, nil
+}
+
+func (m *kvMeta) RemoveExternal(chunkid uint64) error {
+	return m.doTxn(func(tx kvTxn) error {
+		tx.dels(m.externalKey(chunkid))
+		return nil
+	})
+}
+
+func (m *kvMeta) SetGatewayUser(accessKey string, value []byte) error {
+	return m.doTxn(func(tx kvTxn) error {
+		if value == nil {
+			tx.dels(m.gatewayUserKey(accessKey))
+		} else {
+			tx.set(m.gatewayUserKey(accessKey), value)
+		}
+		return nil
+	})
+}
+
+func (m *kvMeta) ListGatewayUsers() (map[string][]byte, error) {
+	users := make(map[string][]byte)
+	err := m.scan(m.fmtKey("IU"), func(key, value []byte) bool {
+		users[string(key[2:])] = value
+		return true
+	})
+	return users, err
+}
+
+func (m *kvMeta) SetCheckpoint(name string, value []byte) error {
+	return m.doTxn(func(tx kvTxn) error {
+		if value == nil {
+			tx.dels(m.checkpointKey(name))
+		} else {
+			tx.set(m.checkpointKey(name), value)
+		}
+		return nil
+	})
+}
+
+func (m *kvMeta) GetCheckpoint(name string) ([]byte, error) {
+	return m.get(m.checkpointKey(name))
+}
+
+type lockOwner struct {
+	sid   uint64
+	owner uint64
+}
+
+func marshalFlock(ls map[lockOwner]byte) []byte {
+	b := utils.NewBuffer(uint32(len(ls) * 17))
+	for o, l := range ls {
+		b.Put64(o.sid)
+		b.Put64(o.owner)
+		b.Put8(l)
+	}
+	return b.Bytes()
+}
+
+func unmarshalFlock(buf []byte) map[lockOwner]byte {
+	ls := make(map[lockOwner]byte)
+	rb := utils.FromBuffer(buf)
+	for rb.Left() >= 17 {
+		ls[lockOwner{rb.Get64(), rb.Get64()}] = rb.Get8()
+	}
+	return ls
+}
+
+func marshalPlock(ls map[lockOwner][]byte) []byte {
+	var size uint32
+	for _, l := range ls {
+		size += 20 + uint32(len(l))
+	}
+	b := utils.NewBuffer(size)
+	for o, l := range ls {
+		b.Put64(o.sid)
+		b.Put64(o.owner)
+		b.Put32(uint32(len(l)))
+		b.Put(l)
+	}
+	return b.Bytes()
+}
+
+func unmarshalPlock(buf []byte) map[lockOwner][]byte {
+	ls := make(map[lockOwner][]byte)
+	rb := utils.FromBuffer(buf)
+	for rb.Left() >= 20 {
+		o := lockOwner{rb.Get64(), rb.Get64()}
+		size := int(rb.Get32())
+		if rb.Left() < size {
+			break
+		}
+		ls[o] = rb.Get(size)
+	}
+	return ls
+}
+
+// cleanStaleLocks removes all the locks held by the session.
+func (m *kvMeta) cleanStaleLocks(sid uint64) {
+	for _, prefix := range []string{"F", "P"} {
+		var keys [][]byte
+		_ = m.scan(m.fmtKey(prefix), func(key, value []byte) bool {
+			if len(key) == 9 {
+				keys = append(keys, key)
+			}
+			return true
+		})
+		for _, key := range keys {
+			err := m.doTxn(func(tx kvTxn) error {
+				v := tx.get(key)
+				var changed bool
+				var nv []byte
+				if prefix == "F" {
+					ls := unmarshalFlock(v)
+					for o := range ls {
+						if o.sid == sid {
+							delete(ls, o)
+							changed = true
+						}
+					}
+					nv = marshalFlock(ls)
+				} else {
+					ls := unmarshalPlock(v)
+					for o := range ls {
+						if o.sid == sid {
+							delete(ls, o)
+							changed = true
+						}
+					}
+					nv = marshalPlock(ls)
+				}
+				if !changed {
+					return nil
+				}
+				if len(nv) == 0 {
+					tx.dels(key)
+				} else {
+					tx.set(key, nv)
+				}
+				return nil
+			})
+			if err != nil {
+				logger.Warnf("cleanup locks of session %d on %v: %s", sid, key, err)
+			}
+		}
+	}
+}
+
+func (m *kvMeta) GetXattr(ctx Context, inode Ino, name string, vbuff *[]byte) syscall.Errno {
+	value, err := m.get(m.xattrKey(inode, name))
+	if err == nil && value == nil {
+		err = ENOATTR
+	}
+	if err == nil {
+		*vbuff = value
+	}
+	return errno(err)
+}
+
+func (m *kvMeta) ListXattr(ctx Context, inode Ino, names *[]byte) syscall.Errno {
+	prefix := m.xattrKey(inode, "")
+	*names = nil
+	err := m.scan(prefix, func(key, value []byte) bool {
+		*names = append(*names, key[len(prefix):]...)
+		*names = append(*names, 0)
+		return true
+	})
+	return errno(err)
+}
+
+func (m *kvMeta) SetXattr(ctx Context, inode Ino, name string, value []byte) syscall.Errno {
+	if m.readOnly {
+		return syscall.EROFS
+	}
+	if name == projectXattr {
+		return m.setProject(ctx, inode, value)
+	}
+	if name == RetentionXattr {
+		return m.setRetention(ctx, inode, value)
+	}
+	return m.txn(func(tx kvTxn) error {
+		tx.set(m.xattrKey(inode, name), value)
+		return nil
+	}, inode)
+}
+
+func (m *kvMeta) RemoveXattr(ctx Context, inode Ino, name string) syscall.Errno {
+	if m.readOnly {
+		return syscall.EROFS
+	}
+	if name == projectXattr {
+		return m.setProject(ctx, inode, nil)
+	}
+	if name == RetentionXattr {
+		return m.setRetention(ctx, inode, nil)
+	}
+	return m.txn(func(tx kvTxn) error {
+		key := m.xattrKey(inode, name)
+		if tx.get(key) == nil {
+			return ENOATTR
+		}
+		tx.dels(key)
+		return nil
+	}, inode)
+}
+
+// setProject changes the project of a node and moves its usage into the new project,
+// the project is removed if value is nil.
+func (m *kvMeta) setProject(ctx Context, inode Ino, value []byte) syscall.Errno {
+	if ctx.Uid() != 0 {
+		return syscall.EPERM
+	}
+	prj, st := parseProject(value)
+	if st != 0 {
+		return st
+	}
+	if prj != 0 {
+		if err := m.enableFeature(FeatureProjects); err != nil {
+			return errno(err)
+		}
+	}
+	var old uint32
+	var space int64
+	st = m.txn(func(tx kvTxn) error {
+		a := tx.get(m.inodeKey(inode))
+		if a == nil {
+			return syscall.ENOENT
+		}
+		var attr Attr
+		parseAttr(a, &attr)
+		old = m.getProject(tx, inode)
+		if value == nil && old == 0 {
+			return ENOATTR
+		}
+		space = 0
+		if attr.Typ == TypeFile {
+			space = align4K(attr.Length)
+		}
+		if prj == 0 {
+			tx.dels(m.xattrKey(inode, projectXattr))
+		} else {
+			tx.set(m.xattrKey(inode, projectXattr), []byte(strconv.FormatUint(uint64(prj), 10)))
+		}
+		return nil
+	}, inode)
+	if st == 0 && prj != old {
+		m.updateProjectUsage(old, -space, -1)
+		m.updateProjectUsage(prj, space, 1)
+	}
+	return st
+}
+
+// setRetention sets the retention of a node, or removes it if value is nil.
+func (m *kvMeta) setRetention(ctx Context, inode Ino, value []byte) syscall.Errno {
+	if value != nil {
+		if err := m.enableFeature(FeatureRetention); err != nil {
+			return errno(err)
+		}
+	}
+	return m.txn(func(tx kvTxn) error {
+		a := tx.get(m.inodeKey(inode))
+		if a == nil {
+			return syscall.ENOENT
+		}
+		var attr Attr
+		parseAttr(a, &attr)
+		key := m.xattrKey(inode, RetentionXattr)
+		old := tx.get(key)
+		if value == nil {
+			if old == nil {
+				return ENOATTR
+			}
+			if retentionActive(old) {
+				return syscall.EPERM
+			}
+			attr.Flags &^= FlagRetention
+			tx.dels(key)
+		} else {
+			v, st := checkRetention(ctx, attr.Uid, old, value)
+			if st != 0 {
+				return st
+			}
+			attr.Flags |= FlagRetention
+			tx.set(key, v)
+		}
+		tx.set(m.inodeKey(inode), marshalAttr(&attr))
+		return nil
+	}, inode)
+}
+
+func (m *kvMeta) SetTag(ctx Context, inode Ino, key, value string) syscall.Errno {
+	if m.readOnly {
+		return syscall.EROFS
+	}
+	if st := checkTag(key, value); st != 0 {
+		return st
+	}
+	return m.txn(func(tx kvTxn) error {
+		if tx.get(m.inodeKey(inode)) == nil {
+			return syscall.ENOENT
+		}
+		tx.set(m.tagKey(inode, key), []byte(value))
+		tx.set(m.tagIndexKey(key, inode), []byte(value))
+		return nil
+	}, inode)
+}
+
+func (m *kvMeta) GetTags(ctx Context, inode Ino, tags *map[string]string) syscall.Errno {
+	prefix := m.tagKey(inode, "")
+	vals := make(map[string]string)
+	err := m.client.txn(func(tx kvTxn) error {
+		if tx.get(m.inodeKey(inode)) == nil {
+			return syscall.ENOENT
+		}
+		keys, values := scanPrefix(tx, prefix, 0)
+		for i, key := range keys {
+			vals[string(key[len(prefix):])] = string(values[i])
+		}
+		return nil
+	})
+	if err == nil {
+		*tags = vals
+	}
+	return errno(err)
+}
+
+func (m *kvMeta) RemoveTag(ctx Context, inode Ino, key string) syscall.Errno {
+	if m.readOnly {
+		return syscall.EROFS
+	}
+	return m.txn(func(tx kvTxn) error {
+		k := m.tagKey(inode, key)
+		if tx.get(k) == nil {
+			return ENOATTR
+		}
+		tx.dels(k, m.tagIndexKey(key, inode))
+		return nil
+	}, inode)
+}
+
+func (m *kvMeta) SearchTag(ctx Context, key, value string, inodes *[]Ino) syscall.Errno {
+	if st := checkTag(key, value); st != 0 {
+		return st
+	}
+	prefix := m.fmtKey("TG", key, "=")
+	var found []Ino
+	err := m.scan(prefix, func(k, v []byte) bool {
+		if len(k) == len(prefix)+8 && (value == "" || string(v) == value) {
+			found = append(found, Ino(utils.ReadBuffer(k[len(prefix):]).Get64()))
+		}
+		return true
+	})
+	if err != nil {
+		return errno(err)
+	}
+	// drop the entries of removed nodes
+	var stale []Ino
+	err = m.client.txn(func(tx kvTxn) error {
+		stale = stale[:0]
+		for _, ino := range found {
+			if tx.get(m.tagKey(ino, key)) == nil {
+				stale = append(stale, ino)
+				if !m.readOnly {
+					tx.dels(m.tagIndexKey(key, ino))
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return errno(err)
+	}
+	*inodes = found[:0]
+	for i, j := 0, 0; i < len(found); i++ {
+		if j < len(stale) && stale[j] == found[i] {
+			j++
+			continue
+		}
+		*inodes = append(*inodes, found[i])
+	}
+	return 0
+}
+
+func (m *kvMeta) FindNames(ctx Context, pattern string, entries *[]*IndexEntry) syscall.Errno {
+	if !m.indexNames {
+		return syscall.ENOTSUP
+	}
+	if st := checkPattern(pattern); st != 0 {
+		return st
+	}
+	prefix := m.fmtKey("N")
+	*entries = nil
+	err := m.scan(append(prefix, indexPrefix(pattern)...), func(key, value []byte) bool {
+		matchIndex(pattern, [][]byte{key[len(prefix):]}, entries)
+		return true
+	})
+	return errno(err)
+}
@@ -0,0 +1,144 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package meta
+
+import (
+	"bytes"
+	"fmt"
+	"syscall"
+	"testing"
+)
+
+func newMemClient(t *testing.T) Meta {
+	m, err := NewClient("memkv://test", &RedisConfig{})
+	if err != nil {
+		t.Fatalf("create memkv: %s", err)
+	}
+	return m
+}
+
+func TestKVClient(t *testing.T) {
+	testMetaClient(t, newMemClient(t))
+	testCompaction(t, newMemClient(t))
+	testConcurrentWrite(t, newMemClient(t))
+	testCopyFileRange(t, newMemClient(t))
+	testPackedBlocks(t, newMemClient(t))
+	testDedupBlocks(t, newMemClient(t))
+	testInlineData(t, newMemClient(t))
+	testReplicationQueue(t, newMemClient(t))
+	testExternalChunks(t, newMemClient(t))
+	testUsage(t, newMemClient(t))
+	testProjectQuota(t, newMemClient(t))
+	testConsistency(t, newMemClient(t))
+	testFragmentation(t, newMemClient(t))
+	testListDeleted(t, newMemClient(t))
+	testLease(t, newMemClient(t))
+	testCompactAll(t, newMemClient(t))
+	testDefrag(t, newMemClient(t))
+	testReserve(t, newMemClient(t))
+	testShrink(t, newMemClient(t))
+}
+
+func TestKVKeys(t *testing.T) {
+	m := newMemClient(t).(*kvMeta)
+	if k := m.chunkKey(1, 2); !bytes.Equal(k, []byte("A\x00\x00\x00\x00\x00\x00\x00\x01C\x00\x00\x00\x02")) {
+		t.Fatalf("chunk key: %v", k)
+	}
+	if k := nextKey([]byte("A\x01\xff")); !bytes.Equal(k, []byte("A\x02")) {
+		t.Fatalf("next key: %v", k)
+	}
+	if nextKey([]byte{0xff}) != nil {
+		t.Fatalf("next key of 0xff should be nil")
+	}
+}
+
+func TestKVCapacity(t *testing.T) {
+	m := newMemClient(t)
+	if err := m.Init(Format{Name: "test", Capacity: 1 << 20}, false); err != nil {
+		t.Fatalf("init: %s", err)
+	}
+	if _, err := m.Load(); err != nil {
+		t.Fatalf("load: %s", err)
+	}
+	ctx := Background
+	var totalspace, availspace, iused, iavail uint64
+	if st := m.StatFS(ctx, &totalspace, &availspace, &iused, &iavail); st != 0 || totalspace != 1<<20 {
+		t.Fatalf("statfs: %s %d", st, totalspace)
+	}
+	var inode Ino
+	var attr = &Attr{}
+	if st := m.Create(ctx, 1, "f", 0644, 0, &inode, attr); st != 0 {
+		t.Fatalf("create: %s", st)
+	}
+	if st := m.Write(ctx, inode, 0, 0, Slice{Chunkid: 1, Size: 512 << 10, Len: 512 << 10}); st != 0 {
+		t.Fatalf("write: %s", st)
+	}
+	if st := m.Write(ctx, inode, 0, 512<<10, Slice{Chunkid: 2, Size: 1 << 20, Len: 1 << 20}); st != syscall.ENOSPC {
+		t.Fatalf("write over capacity: %s", st)
+	}
+	if st := m.Truncate(ctx, inode, 0, 2<<20, attr); st != syscall.ENOSPC {
+		t.Fatalf("truncate over capacity: %s", st)
+	}
+	if st := m.Truncate(ctx, inode, 0, 100, attr); st != 0 {
+		t.Fatalf("truncate: %s", st)
+	}
+	if st := m.Write(ctx, inode, 0, 100, Slice{Chunkid: 2, Size: 512 << 10, Len: 512 << 10}); st != 0 {
+		t.Fatalf("write after truncate: %s", st)
+	}
+}
+
+// Renaming a directory moves only its entry, the entries of children are keyed by the
+// inode of the directory, which is not changed.
+func TestKVRenameLargeDir(t *testing.T) {
+	m := newMemClient(t).(*kvMeta)
+	_ = m.Init(Format{Name: "test"}, false)
+	ctx := Background
+	var dir, dst Ino
+	if st := m.Mkdir(ctx, 1, "big", 0755, 0, 0, &dir, nil); st != 0 {
+		t.Fatalf("mkdir: %s", st)
+	}
+	if st := m.Mkdir(ctx, 1, "dst", 0755, 0, 0, &dst, nil); st != 0 {
+		t.Fatalf("mkdir: %s", st)
+	}
+	for i := 0; i < 1000; i++ {
+		if st := m.Create(ctx, dir, fmt.Sprintf("f%d", i), 0644, 0, nil, nil); st != 0 {
+			t.Fatalf("create: %s", st)
+		}
+	}
+	store := m.client.(*memKV)
+	before := make(map[string]string, len(store.items))
+	for k, v := range store.items {
+		before[k] = string(v)
+	}
+	if st := m.Rename(ctx, 1, "big", dst, "big", 0, nil, nil); st != 0 {
+		t.Fatalf("rename: %s", st)
+	}
+	var changed int
+	for k, v := range store.items {
+		if old, ok := before[k]; !ok || old != string(v) {
+			changed++
+		}
+		delete(before, k)
+	}
+	changed += len(before) // removed
+	if changed > 8 {
+		t.Fatalf("rename a directory with 1000 entries changed %d keys", changed)
+	}
+	var inode Ino
+	if st := m.Lookup(ctx, dir, "f999", &inode, nil); st != 0 {
+		t.Fatalf("lookup after rename: %s", st)
+	}
+}
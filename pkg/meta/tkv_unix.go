@@ -0,0 +1,166 @@
+// +build !windows
+
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package meta
+
+import (
+	"syscall"
+	"time"
+)
+
+func (m *kvMeta) Flock(ctx Context, inode Ino, owner uint64, ltype uint32, block bool) syscall.Errno {
+	ikey := m.flockKey(inode)
+	lkey := lockOwner{m.sid, owner}
+	var err syscall.Errno
+	for {
+		err = m.txn(func(tx kvTxn) error {
+			ls := unmarshalFlock(tx.get(ikey))
+			switch ltype {
+			case syscall.F_UNLCK:
+				delete(ls, lkey)
+			case syscall.F_RDLCK:
+				for _, l := range ls {
+					if l == 'W' {
+						return syscall.EAGAIN
+					}
+				}
+				ls[lkey] = 'R'
+			case syscall.F_WRLCK:
+				delete(ls, lkey)
+				if len(ls) > 0 {
+					return syscall.EAGAIN
+				}
+				ls[lkey] = 'W'
+			default:
+				return syscall.EINVAL
+			}
+			if len(ls) == 0 {
+				tx.dels(ikey)
+			} else {
+				tx.set(ikey, marshalFlock(ls))
+			}
+			return nil
+		}, inode)
+
+		if !block || err != syscall.EAGAIN {
+			break
+		}
+		if ltype == syscall.F_WRLCK {
+			time.Sleep(time.Millisecond * 1)
+		} else {
+			time.Sleep(time.Millisecond * 10)
+		}
+		if ctx.Canceled() {
+			return syscall.EINTR
+		}
+	}
+	return err
+}
+
+func (m *kvMeta) Getlk(ctx Context, inode Ino, owner uint64, ltype *uint32, start, end *uint64, pid *uint32) syscall.Errno {
+	if *ltype == syscall.F_UNLCK {
+		*start = 0
+		*end = 0
+		*pid = 0
+		return 0
+	}
+	v, err := m.get(m.plockKey(inode))
+	if err != nil {
+		return errno(err)
+	}
+	owners := unmarshalPlock(v)
+	delete(owners, lockOwner{m.sid, owner}) // exclude itself
+	for o, d := range owners {
+		ls := loadLocks(d)
+		for _, l := range ls {
+			// find conflicted locks
+			if (*ltype == syscall.F_WRLCK || l.ltype == syscall.F_WRLCK) && *end > l.start && *start < l.end {
+				*ltype = l.ltype
+				*start = l.start
+				*end = l.end
+				if o.sid == m.sid {
+					*pid = l.pid
+				} else {
+					*pid = 0
+				}
+				return 0
+			}
+		}
+	}
+	*ltype = syscall.F_UNLCK
+	*start = 0
+	*end = 0
+	*pid = 0
+	return 0
+}
+
+func (m *kvMeta) Setlk(ctx Context, inode Ino, owner uint64, block bool, ltype uint32, start, end uint64, pid uint32) syscall.Errno {
+	ikey := m.plockKey(inode)
+	lkey := lockOwner{m.sid, owner}
+	var err syscall.Errno
+	lock := plock{ltype, pid, start, end}
+	for {
+		err = m.txn(func(tx kvTxn) error {
+			owners := unmarshalPlock(tx.get(ikey))
+			if ltype == syscall.F_UNLCK {
+				ls := loadLocks(owners[lkey])
+				if len(ls) == 0 {
+					return nil
+				}
+				ls = updateLocks(ls, lock)
+				if len(ls) == 0 {
+					delete(owners, lkey)
+				} else {
+					owners[lkey] = dumpLocks(ls)
+				}
+			} else {
+				ls := loadLocks(owners[lkey])
+				for o, d := range owners {
+					if o == lkey {
+						continue
+					}
+					for _, l := range loadLocks(d) {
+						// find conflicted locks
+						if (ltype == syscall.F_WRLCK || l.ltype == syscall.F_WRLCK) && end > l.start && start < l.end {
+							return syscall.EAGAIN
+						}
+					}
+				}
+				owners[lkey] = dumpLocks(updateLocks(ls, lock))
+			}
+			if len(owners) == 0 {
+				tx.dels(ikey)
+			} else {
+				tx.set(ikey, marshalPlock(owners))
+			}
+			return nil
+		}, inode)
+
+		if !block || err != syscall.EAGAIN {
+			break
+		}
+		if ltype == syscall.F_WRLCK {
+			time.Sleep(time.Millisecond * 1)
+		} else {
+			time.Sleep(time.Millisecond * 10)
+		}
+		if ctx.Canceled() {
+			return syscall.EINTR
+		}
+	}
+	return err
+}
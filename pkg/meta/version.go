@@ -0,0 +1,118 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package meta
+
+import "fmt"
+
+// MetaVersion is the latest version of metadata supported by this client. The volumes
+// formatted before the version is recorded are version 0.
+const MetaVersion = 3
+
+// ShardsVersion is the version of metadata since which the huge directories can be split
+// into shards, the older clients don't know the feature dir-shards.
+const ShardsVersion = 3
+
+// Migration upgrades the metadata to Version from the previous one. It should be
+// idempotent, since it's run again if the upgrade is interrupted.
+type Migration struct {
+	Version int
+	Desc    string
+	run     func(m Meta, format *Format) error
+}
+
+// the migrations in the order of versions, the last one is MetaVersion
+var migrations = []Migration{
+	{Version: 1, Desc: "record the version of metadata in format"},
+	{Version: 2, Desc: "record the enabled features in format", run: func(m Meta, format *Format) error {
+		format.SetFeatures()
+		return nil
+	}},
+	{Version: 3, Desc: "record the retention and projects used by the existing files, allow directory shards", run: recordUsedFeatures},
+}
+
+// xattrScanner is implemented by the engines to find the features used by the existing files.
+type xattrScanner interface {
+	// hasXattr returns true if any node has the extended attribute.
+	hasXattr(ctx Context, name string) (bool, error)
+}
+
+// recordUsedFeatures records the features enabled by the files before they're recorded.
+func recordUsedFeatures(m Meta, format *Format) error {
+	s, ok := m.(xattrScanner)
+	if !ok {
+		return fmt.Errorf("the extended attributes of %T can't be scanned", m)
+	}
+	for _, u := range []struct{ xattr, feature string }{{RetentionXattr, FeatureRetention}, {projectXattr, FeatureProjects}} {
+		used, err := s.hasXattr(Background, u.xattr)
+		if err != nil {
+			return fmt.Errorf("scan %s: %s", u.xattr, err)
+		}
+		var found bool
+		for _, name := range format.WriteFeatures {
+			found = found || name == u.feature
+		}
+		if used && !found {
+			format.WriteFeatures = append(format.WriteFeatures, u.feature)
+		}
+	}
+	return nil
+}
+
+// checkCompat returns an error if the metadata is newer than this client or the volume has
+// features unknown by it, which should not be written by it since the changes are not known.
+func (f *Format) checkCompat(readOnly bool) error {
+	if f.MetaVersion > MetaVersion && !readOnly {
+		return fmt.Errorf("the metadata of volume %s is version %d, newer than %d supported by this client, upgrade the client or access it read-only",
+			f.Name, f.MetaVersion, MetaVersion)
+	}
+	return f.checkFeatures(readOnly)
+}
+
+// PendingMigrations returns the migrations to upgrade the metadata from version to MetaVersion.
+func PendingMigrations(version int) []Migration {
+	var pending []Migration
+	for _, mg := range migrations {
+		if mg.Version > version {
+			pending = append(pending, mg)
+		}
+	}
+	return pending
+}
+
+// Upgrade runs the pending migrations one by one, the version in format is updated after
+// each of them (with the changes of format by it), so it can be resumed if it's interrupted.
+func Upgrade(m Meta) error {
+	format, err := m.Load()
+	if err != nil {
+		return err
+	}
+	if format.MetaVersion > MetaVersion {
+		return fmt.Errorf("the metadata is version %d, newer than %d supported by this client", format.MetaVersion, MetaVersion)
+	}
+	for _, mg := range PendingMigrations(format.MetaVersion) {
+		logger.Infof("Upgrade metadata to version %d: %s", mg.Version, mg.Desc)
+		if mg.run != nil {
+			if err = mg.run(m, format); err != nil {
+				return fmt.Errorf("upgrade to version %d: %s", mg.Version, err)
+			}
+		}
+		format.MetaVersion = mg.Version
+		if err = m.UpdateFormat(*format); err != nil {
+			return fmt.Errorf("update version to %d: %s", mg.Version, err)
+		}
+	}
+	return nil
+}
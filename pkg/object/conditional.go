@@ -0,0 +1,89 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package object
+
+import (
+	"errors"
+	"io"
+)
+
+// ErrPreconditionFailed is returned if If-Match is not met.
+var ErrPreconditionFailed = errors.New("precondition failed")
+
+// ErrNotModified is returned if If-None-Match is not met.
+var ErrNotModified = errors.New("not modified")
+
+// ListV2 lists the objects like ListObjectsV2 of S3, the token is the last key of the previous
+// page for the object storages which don't support it.
+func ListV2(store ObjectStorage, prefix, startAfter, token string, limit int64) ([]Object, string, error) {
+	if l, ok := store.(ListerV2); ok {
+		objs, next, err := l.ListV2(prefix, startAfter, token, limit)
+		if err != notSupported {
+			return objs, next, err
+		}
+	}
+	marker := startAfter
+	if token != "" {
+		marker = token
+	}
+	objs, err := store.List(prefix, marker, limit)
+	if err != nil || int64(len(objs)) < limit || len(objs) == 0 {
+		return objs, "", err
+	}
+	return objs, objs[len(objs)-1].Key(), nil
+}
+
+// GetIf reads an object if cond is met, it returns notSupported if the object storage doesn't
+// support conditional requests.
+func GetIf(store ObjectStorage, key string, off, limit int64, cond Condition) (io.ReadCloser, error) {
+	if c, ok := store.(ConditionalStorage); ok {
+		r, err := c.GetIf(key, off, limit, cond)
+		if err != notSupported {
+			return r, err
+		}
+	}
+	if cond == (Condition{}) {
+		return store.Get(key, off, limit)
+	}
+	return nil, notSupported
+}
+
+// HeadObject returns the information of an object, ETag is empty if the object storage doesn't
+// support it.
+func HeadObject(store ObjectStorage, key string) (*ObjectInfo, error) {
+	if c, ok := store.(ConditionalStorage); ok {
+		info, err := c.HeadObject(key)
+		if err != notSupported {
+			return info, err
+		}
+	}
+	o, err := store.Head(key)
+	if err != nil {
+		return nil, err
+	}
+	return &ObjectInfo{Object: o}, nil
+}
+
+// checkCondition returns the error if cond is not met by the object with etag.
+func checkCondition(etag string, cond Condition) error {
+	if cond.IfMatch != "" && cond.IfMatch != "*" && cond.IfMatch != etag {
+		return ErrPreconditionFailed
+	}
+	if cond.IfNoneMatch != "" && (cond.IfNoneMatch == "*" || cond.IfNoneMatch == etag) {
+		return ErrNotModified
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package object
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"testing"
+)
+
+func TestConditional(t *testing.T) {
+	m, _ := newMem("", "", "")
+	_ = m.Put("dir/a", bytes.NewReader([]byte("hello")))
+	s := WithPrefix(m, "dir/")
+
+	info, err := HeadObject(s, "a")
+	if err != nil || info.Key() != "a" || info.Size() != 5 || info.ETag == "" {
+		t.Fatalf("head object: %+v %s", info, err)
+	}
+	if _, err = GetIf(s, "a", 0, -1, Condition{IfMatch: `"bad"`}); err != ErrPreconditionFailed {
+		t.Fatalf("get with mismatched etag: %s", err)
+	}
+	if _, err = GetIf(s, "a", 0, -1, Condition{IfNoneMatch: info.ETag}); err != ErrNotModified {
+		t.Fatalf("get with the same etag: %s", err)
+	}
+	r, err := GetIf(s, "a", 1, 3, Condition{IfMatch: info.ETag})
+	if err != nil {
+		t.Fatalf("get with matched etag: %s", err)
+	}
+	if data, _ := ioutil.ReadAll(r); string(data) != "ell" {
+		t.Fatalf("read %q, expect %q", data, "ell")
+	}
+	d, _ := CreateStorage("file", t.TempDir()+"/", "", "")
+	if _, err = GetIf(WithPrefix(d, "dir/"), "a", 0, -1, Condition{IfMatch: info.ETag}); err != notSupported {
+		t.Fatalf("get from storage without conditional requests: %s", err)
+	}
+}
+
+func TestListV2(t *testing.T) {
+	m, _ := newMem("", "", "")
+	for i := 0; i < 10; i++ {
+		_ = m.Put(fmt.Sprintf("k%d", i), bytes.NewReader(nil))
+	}
+	var keys []string
+	var token string
+	for {
+		objs, next, err := ListV2(m, "k", "k2", token, 3)
+		if err != nil {
+			t.Fatalf("list: %s", err)
+		}
+		for _, o := range objs {
+			keys = append(keys, o.Key())
+		}
+		if next == "" {
+			break
+		}
+		token = next
+	}
+	if fmt.Sprint(keys) != "[k3 k4 k5 k6 k7 k8 k9]" {
+		t.Fatalf("listed %v", keys)
+	}
+}
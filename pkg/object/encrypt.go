@@ -235,4 +235,9 @@ func (e *encrypted) Put(key string, in io.Reader) error {
 	return e.ObjectStorage.Put(key, bytes.NewReader(ciphertext))
 }
 
+// CreateMultipartUpload is not supported because the parts can't be decrypted as a whole.
+func (e *encrypted) CreateMultipartUpload(key string) (*MultipartUpload, error) {
+	return nil, notSupported
+}
+
 var _ ObjectStorage = &encrypted{}
@@ -0,0 +1,188 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package object
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	failoverErrors = 10               // consecutive errors to switch to mirror
+	failoverProbes = 3                // consecutive successful probes to switch back
+	probeInterval  = time.Second * 10 // interval to probe the primary
+)
+
+var (
+	failoverState = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "object_failover_state",
+		Help: "whether the requests are served by mirror (1) or primary (0).",
+	})
+	failoverSwitches = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "object_failover_switches",
+		Help: "number of switches between primary and mirror.",
+	})
+)
+
+type failover struct {
+	ObjectStorage
+	mirror   ObjectStorage
+	queue    ReplicationQueue
+	writable bool
+
+	sync.Mutex
+	failed bool // served by mirror
+	errors int  // consecutive errors of primary
+	since  time.Time
+}
+
+// WithFailover returns a object storage that serves requests from the mirror when
+// the primary is unhealthy. If writable is true, new objects are written into
+// the mirror and restored back to primary (by replication) after it's recovered.
+func WithFailover(primary, mirror ObjectStorage, queue ReplicationQueue, writable bool) ObjectStorage {
+	_ = prometheus.Register(failoverState)
+	_ = prometheus.Register(failoverSwitches)
+	f := &failover{ObjectStorage: primary, mirror: mirror, queue: queue, writable: writable}
+	go f.probe()
+	return f
+}
+
+func (f *failover) String() string {
+	return fmt.Sprintf("%s(failover to %s)", f.ObjectStorage, f.mirror)
+}
+
+func (f *failover) switchTo(failed bool, reason string) {
+	if f.failed == failed {
+		return
+	}
+	if failed {
+		logger.Warnf("switch to mirror %s after %d errors: %s", f.mirror, f.errors, reason)
+		failoverState.Set(1)
+	} else {
+		logger.Infof("switch back to primary %s after %s", f.ObjectStorage, time.Since(f.since))
+		failoverState.Set(0)
+	}
+	f.failed = failed
+	f.since = time.Now()
+	f.errors = 0
+	failoverSwitches.Inc()
+}
+
+// track records the result of a request to primary.
+func (f *failover) track(err error) {
+	f.Lock()
+	defer f.Unlock()
+	if err == nil {
+		f.errors = 0
+		return
+	}
+	f.errors++
+	if f.errors >= failoverErrors {
+		f.switchTo(true, err.Error())
+	}
+}
+
+func (f *failover) useMirror() bool {
+	f.Lock()
+	defer f.Unlock()
+	return f.failed
+}
+
+// check probes the primary with a light request which will not change anything.
+func (f *failover) check() error {
+	_, err := f.ObjectStorage.List("", "", 1)
+	return err
+}
+
+func (f *failover) probe() {
+	var succeed int
+	for {
+		time.Sleep(probeInterval)
+		if !f.useMirror() {
+			succeed = 0
+			continue
+		}
+		if err := f.check(); err != nil {
+			logger.Debugf("probe %s: %s", f.ObjectStorage, err)
+			succeed = 0
+			continue
+		}
+		succeed++
+		if succeed >= failoverProbes {
+			f.Lock()
+			f.switchTo(false, "")
+			f.Unlock()
+		}
+	}
+}
+
+func (f *failover) Get(key string, off, limit int64) (io.ReadCloser, error) {
+	if f.useMirror() {
+		if r, err := f.mirror.Get(key, off, limit); err == nil {
+			return r, nil
+		}
+		// it's not replicated yet
+		return f.ObjectStorage.Get(key, off, limit)
+	}
+	r, err := f.ObjectStorage.Get(key, off, limit)
+	if err == nil {
+		f.track(nil)
+		return r, nil
+	}
+	if r2, e := f.mirror.Get(key, off, limit); e == nil {
+		f.track(err) // missing object in primary does not count
+		return r2, nil
+	}
+	return nil, err
+}
+
+func (f *failover) Put(key string, in io.Reader) error {
+	if f.writable && f.useMirror() {
+		if err := f.mirror.Put(key, in); err != nil {
+			return err
+		}
+		return f.queue.AddReplication(string(replicaRestore) + key)
+	}
+	err := f.ObjectStorage.Put(key, in)
+	f.track(err)
+	return err
+}
+
+// CreateMultipartUpload is not supported when the mirror is written, the object is put as a whole.
+func (f *failover) CreateMultipartUpload(key string) (*MultipartUpload, error) {
+	if f.writable && f.useMirror() {
+		return nil, notSupported
+	}
+	return f.ObjectStorage.CreateMultipartUpload(key)
+}
+
+func (f *failover) Delete(key string) error {
+	if f.writable && f.useMirror() {
+		if err := f.mirror.Delete(key); err != nil {
+			return err
+		}
+		return f.queue.AddReplication(string(replicaErase) + key)
+	}
+	err := f.ObjectStorage.Delete(key)
+	f.track(err)
+	return err
+}
+
+var _ ObjectStorage = &failover{}
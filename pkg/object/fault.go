@@ -0,0 +1,77 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package object
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/juicedata/juicefs/pkg/fault"
+)
+
+type withFaults struct {
+	ObjectStorage
+}
+
+// WithFaults returns a object storage with faults injected by the rules in package fault,
+// it's used only if the binary is built with tag faultinjection.
+func WithFaults(os ObjectStorage) ObjectStorage {
+	return &withFaults{os}
+}
+
+func inject(op string) error {
+	if st := fault.Inject(op); st != 0 {
+		return fmt.Errorf("injected fault in %s: %w", op, st)
+	}
+	return nil
+}
+
+func (p *withFaults) Head(key string) (Object, error) {
+	if err := inject("object.head"); err != nil {
+		return nil, err
+	}
+	return p.ObjectStorage.Head(key)
+}
+
+func (p *withFaults) Get(key string, off, limit int64) (io.ReadCloser, error) {
+	if err := inject("object.get"); err != nil {
+		return nil, err
+	}
+	return p.ObjectStorage.Get(key, off, limit)
+}
+
+func (p *withFaults) Put(key string, in io.Reader) error {
+	if err := inject("object.put"); err != nil {
+		return err
+	}
+	return p.ObjectStorage.Put(key, in)
+}
+
+func (p *withFaults) Delete(key string) error {
+	if err := inject("object.delete"); err != nil {
+		return err
+	}
+	return p.ObjectStorage.Delete(key)
+}
+
+func (p *withFaults) List(prefix, marker string, limit int64) ([]Object, error) {
+	if err := inject("object.list"); err != nil {
+		return nil, err
+	}
+	return p.ObjectStorage.List(prefix, marker, limit)
+}
+
+var _ ObjectStorage = &withFaults{}
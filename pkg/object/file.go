@@ -308,6 +308,22 @@ func (d *filestore) ListAll(prefix, marker string) (<-chan Object, error) {
 	return listed, nil
 }
 
+func (d *filestore) WriteAt(key string, off int64, data []byte) error {
+	f, err := os.OpenFile(d.path(key), os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteAt(data, off)
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
+func (d *filestore) Truncate(key string, size int64) error {
+	return os.Truncate(d.path(key), size)
+}
+
 func (d *filestore) Chtimes(path string, mtime time.Time) error {
 	p := d.path(path)
 	return os.Chtimes(p, mtime, mtime)
@@ -25,8 +25,12 @@ import (
 	"syscall"
 
 	"github.com/pkg/sftp"
+	"golang.org/x/sys/unix"
 )
 
+// the checksum of a file kept by JuiceFS
+const checksumXattr = "juicefs.checksum"
+
 var uids = make(map[int]string)
 var gids = make(map[int]string)
 var users = make(map[string]int)
@@ -97,3 +101,47 @@ func lookupGroup(name string) int {
 	groups[name] = gid
 	return gid
 }
+
+// Extents returns the ranges of a file which have data, found by SEEK_DATA and SEEK_HOLE.
+// The whole file is data if the file system doesn't know the holes.
+func (d *filestore) Extents(key string) ([]Extent, error) {
+	f, err := os.Open(d.path(key))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	fd := int(f.Fd())
+	var exts []Extent
+	for off := int64(0); off < fi.Size(); {
+		start, err := unix.Seek(fd, off, unix.SEEK_DATA)
+		if err == syscall.ENXIO {
+			break // a hole at the end
+		} else if err != nil {
+			return nil, err
+		}
+		end, err := unix.Seek(fd, start, unix.SEEK_HOLE)
+		if err != nil {
+			return nil, err
+		}
+		if end > fi.Size() {
+			end = fi.Size()
+		}
+		exts = append(exts, Extent{start, end - start})
+		off = end
+	}
+	return exts, nil
+}
+
+// Checksum returns the checksum of a file in JuiceFS, or empty if it's not available.
+func (d *filestore) Checksum(key string) (string, error) {
+	buf := make([]byte, 128)
+	n, err := unix.Getxattr(d.path(key), checksumXattr, buf)
+	if err != nil {
+		return "", nil
+	}
+	return string(buf[:n]), nil
+}
@@ -0,0 +1,131 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package object
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// httpStorage reads the objects from a plain HTTP(S) server without credentials, e.g. the
+// blocks of a volume published as a dataset. It's read-only and can't list the objects.
+type httpStorage struct {
+	RestfulStorage
+}
+
+func (s *httpStorage) Create() error {
+	return nil
+}
+
+func (s *httpStorage) Head(key string) (Object, error) {
+	resp, err := s.request("HEAD", key, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup(resp)
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, os.ErrNotExist
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status: %v", resp.StatusCode)
+	}
+	// Last-Modified is optional for static files
+	mtime, _ := time.Parse(time.RFC1123, resp.Header.Get("Last-Modified"))
+	return &obj{key, resp.ContentLength, mtime, strings.HasSuffix(key, "/")}, nil
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+func (s *httpStorage) Get(key string, off, limit int64) (io.ReadCloser, error) {
+	headers := make(map[string]string)
+	if off > 0 || limit > 0 {
+		if limit > 0 {
+			headers["Range"] = fmt.Sprintf("bytes=%d-%d", off, off+limit-1)
+		} else {
+			headers["Range"] = fmt.Sprintf("bytes=%d-", off)
+		}
+	}
+	resp, err := s.request("GET", key, nil, headers)
+	if err != nil {
+		return nil, err
+	}
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		return resp.Body, nil
+	case http.StatusOK:
+		// the range is ignored by some servers
+		if off > 0 {
+			if _, err = io.CopyN(ioutil.Discard, resp.Body, off); err != nil {
+				cleanup(resp)
+				return nil, err
+			}
+		}
+		if limit > 0 {
+			return &readCloser{io.LimitReader(resp.Body, limit), resp.Body}, nil
+		}
+		return resp.Body, nil
+	case http.StatusNotFound:
+		cleanup(resp)
+		return nil, os.ErrNotExist
+	default:
+		defer cleanup(resp)
+		return nil, parseError(resp)
+	}
+}
+
+func (s *httpStorage) Put(key string, in io.Reader) error {
+	return ErrReadOnly
+}
+
+func (s *httpStorage) Copy(dst, src string) error {
+	return ErrReadOnly
+}
+
+func (s *httpStorage) Delete(key string) error {
+	return ErrReadOnly
+}
+
+func (s *httpStorage) List(prefix, marker string, limit int64) ([]Object, error) {
+	return nil, notSupported
+}
+
+func newHTTP(endpoint, accessKey, secretKey string) (ObjectStorage, error) {
+	if !strings.Contains(endpoint, "://") {
+		endpoint = fmt.Sprintf("https://%s", endpoint)
+	}
+	uri, err := url.ParseRequestURI(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid endpoint %s: %s", endpoint, err)
+	}
+	if uri.Scheme != "http" && uri.Scheme != "https" {
+		return nil, fmt.Errorf("Invalid scheme %s of endpoint %s", uri.Scheme, endpoint)
+	}
+	// the requests are never signed
+	return &httpStorage{RestfulStorage{endpoint: strings.TrimSuffix(endpoint, "/"), signer: sign}}, nil
+}
+
+func init() {
+	Register("http", newHTTP)
+}
@@ -0,0 +1,104 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package object
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+)
+
+func TestHTTPStorage(t *testing.T) {
+	content := []byte("0123456789")
+	var noRange bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "" {
+			t.Errorf("request should not be signed")
+		}
+		if r.URL.Path != "/data/vol/chunks/1_0_10" {
+			http.NotFound(w, r)
+			return
+		}
+		if noRange {
+			r.Header.Del("Range")
+		}
+		http.ServeContent(w, r, "", time.Now(), bytes.NewReader(content))
+	}))
+	defer srv.Close()
+
+	s, err := CreateStorage("http", srv.URL+"/data/", "", "")
+	if err != nil {
+		t.Fatalf("create: %s", err)
+	}
+	s = WithPrefix(s, "vol/")
+	get := func(off, limit int64) string {
+		r, err := s.Get("chunks/1_0_10", off, limit)
+		if err != nil {
+			t.Fatalf("get (%d,%d): %s", off, limit, err)
+		}
+		defer r.Close()
+		d, _ := ioutil.ReadAll(r)
+		return string(d)
+	}
+	for _, noRange = range []bool{false, true} {
+		if d := get(0, -1); d != string(content) {
+			t.Fatalf("get all: %q", d)
+		}
+		if d := get(2, 3); d != "234" {
+			t.Fatalf("get range: %q", d)
+		}
+		if d := get(8, -1); d != "89" {
+			t.Fatalf("get tail: %q", d)
+		}
+	}
+	if o, err := s.Head("chunks/1_0_10"); err != nil || o.Size() != 10 || o.Key() != "chunks/1_0_10" {
+		t.Fatalf("head: %+v %s", o, err)
+	}
+	if _, err := s.Head("chunks/2_0_10"); err != os.ErrNotExist {
+		t.Fatalf("head missing object: %v", err)
+	}
+	if _, err := s.Get("chunks/2_0_10", 0, -1); err != os.ErrNotExist {
+		t.Fatalf("get missing object: %v", err)
+	}
+	if err := s.Put("chunks/2_0_10", strings.NewReader("hello")); err != ErrReadOnly {
+		t.Fatalf("put should fail: %v", err)
+	}
+	if err := s.Delete("chunks/1_0_10"); err != ErrReadOnly {
+		t.Fatalf("delete should fail: %v", err)
+	}
+	if _, err := CreateStorage("http", "ftp://host/data", "", ""); err == nil {
+		t.Fatalf("ftp should be rejected")
+	}
+}
+
+func TestS3Credentials(t *testing.T) {
+	if s3Credentials("", "") != nil {
+		t.Fatalf("default credentials chain should be used without access key")
+	}
+	if s3Credentials(AnonymousKey, "") != credentials.AnonymousCredentials {
+		t.Fatalf("anonymous credentials should be used for public buckets")
+	}
+	if v, err := s3Credentials("ak", "sk").Get(); err != nil || v.AccessKeyID != "ak" || v.SecretAccessKey != "sk" {
+		t.Fatalf("static credentials: %+v %s", v, err)
+	}
+}
@@ -89,3 +89,38 @@ type ObjectStorage interface {
 	// ListUploads lists existing multipart uploads.
 	ListUploads(marker string) ([]*PendingPart, string, error)
 }
+
+// ObjectInfo is the detailed information of an object.
+type ObjectInfo struct {
+	Object
+	ETag  string
+	Parts int // number of parts if it's uploaded by multipart upload, or 0
+}
+
+// Condition of the conditional requests, the empty fields are ignored.
+type Condition struct {
+	IfMatch     string // ETag of the object
+	IfNoneMatch string // ETag of the object, or "*" for any object
+}
+
+// ListerV2 is implemented by the object storages which list objects with continuation tokens,
+// like ListObjectsV2 of S3.
+type ListerV2 interface {
+	// ListV2 returns the objects with prefix after startAfter, or after the position of token which
+	// is returned by the previous call, and the token of the next page, which is empty at the end.
+	ListV2(prefix, startAfter, token string, limit int64) ([]Object, string, error)
+}
+
+// ConditionalStorage is implemented by the object storages which support conditional requests.
+type ConditionalStorage interface {
+	// GetIf is like Get, but returns ErrPreconditionFailed or ErrNotModified if cond is not met.
+	GetIf(key string, off, limit int64, cond Condition) (io.ReadCloser, error)
+	// HeadObject returns the information of an object including ETag and the number of parts.
+	HeadObject(key string) (*ObjectInfo, error)
+}
+
+// Checksummer is implemented by the object storages which keep the checksums of objects.
+type Checksummer interface {
+	// Checksum returns the SHA256 of an object as "sha256:HEX", or empty if it's unknown.
+	Checksum(key string) (string, error)
+}
@@ -0,0 +1,66 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package object
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"testing"
+)
+
+func TestListAllParallel(t *testing.T) {
+	s, _ := newMem("", "", "")
+	var keys []string
+	for i := 0; i < 5000; i++ {
+		key := fmt.Sprintf("chunks/%02X/%d/%d_0_4", i%256, i/1000, i)
+		if i%100 == 0 {
+			key = fmt.Sprintf("chunks/%d_~", i) // out of keyChars
+		}
+		keys = append(keys, key)
+		_ = s.Put(key, bytes.NewReader(nil))
+	}
+	_ = s.Put("other", bytes.NewReader(nil))
+	sort.Strings(keys)
+
+	check := func(marker, end string, threads int, expected []string) {
+		ch, err := ListAllParallel(s, "chunks/", marker, end, threads)
+		if err != nil {
+			t.Fatalf("list: %s", err)
+		}
+		var listed []string
+		for o := range ch {
+			if o == nil {
+				t.Fatalf("listing failed")
+			}
+			listed = append(listed, o.Key())
+		}
+		if len(listed) != len(expected) {
+			t.Fatalf("listed %d objects with %d threads from %q to %q, expect %d", len(listed), threads, marker, end, len(expected))
+		}
+		for i := range listed {
+			if listed[i] != expected[i] {
+				t.Fatalf("listed %q at %d with %d threads, expect %q", listed[i], i, threads, expected[i])
+			}
+		}
+	}
+	for _, threads := range []int{1, 3, 10} {
+		check("", "", threads, keys)
+		check(keys[1234], "", threads, keys[1235:])
+		check(keys[100], keys[4000], threads, keys[101:4001])
+		check(keys[4990], "", threads, keys[4991:])
+	}
+}
@@ -17,6 +17,7 @@ package object
 
 import (
 	"bytes"
+	"crypto/md5"
 	"errors"
 	"fmt"
 	"io"
@@ -90,6 +91,36 @@ func (m *memStore) Get(key string, off, limit int64) (io.ReadCloser, error) {
 	return ioutil.NopCloser(bytes.NewBuffer(data)), nil
 }
 
+func etag(data []byte) string {
+	return fmt.Sprintf("%q", fmt.Sprintf("%x", md5.Sum(data)))
+}
+
+func (m *memStore) GetIf(key string, off, limit int64, cond Condition) (io.ReadCloser, error) {
+	m.Lock()
+	d, ok := m.objects[key]
+	m.Unlock()
+	if ok {
+		if err := checkCondition(etag(d.data), cond); err != nil {
+			return nil, err
+		}
+	}
+	return m.Get(key, off, limit)
+}
+
+func (m *memStore) HeadObject(key string) (*ObjectInfo, error) {
+	o, err := m.Head(key)
+	if err != nil {
+		return nil, err
+	}
+	m.Lock()
+	d, ok := m.objects[key]
+	m.Unlock()
+	if !ok {
+		return nil, errors.New("not exists")
+	}
+	return &ObjectInfo{Object: o, ETag: etag(d.data)}, nil
+}
+
 func (m *memStore) Put(key string, in io.Reader) error {
 	m.Lock()
 	defer m.Unlock()
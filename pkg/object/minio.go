@@ -22,7 +22,6 @@ import (
 	"strings"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 )
@@ -58,9 +57,7 @@ func newMinio(endpoint, accessKey, secretKey string) (ObjectStorage, error) {
 	if secretKey == "" {
 		secretKey = os.Getenv("MINIO_SECRET_KEY")
 	}
-	if accessKey != "" {
-		awsConfig.Credentials = credentials.NewStaticCredentials(accessKey, secretKey, "")
-	}
+	awsConfig.Credentials = s3Credentials(accessKey, secretKey)
 
 	ses, err := session.NewSession(awsConfig)
 	if err != nil {
@@ -0,0 +1,105 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package object
+
+import (
+	"bytes"
+	"fmt"
+	"sync/atomic"
+)
+
+// MultipartConfig controls how the large objects are uploaded part by part.
+type MultipartConfig struct {
+	Threshold int // the objects larger than it are uploaded by multipart upload, 0 means disabled
+	PartSize  int // size of parts, adjusted by the limits of the object storage
+	Threads   int // number of parts uploaded concurrently
+}
+
+// DefaultMultipartConfig is used by the clients without explicit settings.
+var DefaultMultipartConfig = MultipartConfig{Threshold: 32 << 20, PartSize: 8 << 20, Threads: 4}
+
+// PutMultipart uploads data as an object, part by part if it's larger than the threshold and
+// the object storage supports multipart upload. The upload is aborted if any part is failed,
+// so no parts are left in the object storage.
+func PutMultipart(store ObjectStorage, key string, data []byte, conf MultipartConfig) error {
+	if conf.Threshold <= 0 || len(data) <= conf.Threshold {
+		return store.Put(key, bytes.NewReader(data))
+	}
+	upload, err := store.CreateMultipartUpload(key)
+	if err != nil {
+		if err == notSupported {
+			return store.Put(key, bytes.NewReader(data))
+		}
+		return err
+	}
+	partSize := conf.PartSize
+	if partSize < upload.MinPartSize {
+		partSize = upload.MinPartSize
+	}
+	if upload.MaxCount > 0 && (len(data)-1)/partSize+1 > upload.MaxCount {
+		partSize = (len(data)-1)/upload.MaxCount + 1
+	}
+	n := (len(data)-1)/partSize + 1
+	threads := conf.Threads
+	if threads <= 0 {
+		threads = 1
+	}
+
+	parts := make([]*Part, n)
+	errs := make(chan error, n)
+	tokens := make(chan struct{}, threads)
+	var failed int32
+	for i := 0; i < n; i++ {
+		tokens <- struct{}{}
+		go func(num int) {
+			defer func() { <-tokens }()
+			if atomic.LoadInt32(&failed) == 1 {
+				errs <- nil // aborted
+				return
+			}
+			end := (num + 1) * partSize
+			if end > len(data) {
+				end = len(data)
+			}
+			var err error
+			for try := 0; try < 3; try++ {
+				// PartNumber starts from 1
+				if parts[num], err = store.UploadPart(key, upload.UploadID, num+1, data[num*partSize:end]); err == nil {
+					break
+				}
+			}
+			if err != nil {
+				atomic.StoreInt32(&failed, 1)
+				err = fmt.Errorf("part %d: %s", num+1, err)
+			}
+			errs <- err
+		}(i)
+	}
+	for i := 0; i < n; i++ {
+		if e := <-errs; e != nil && err == nil {
+			err = e
+		}
+	}
+	if err == nil {
+		err = store.CompleteUpload(key, upload.UploadID, parts)
+	}
+	if err != nil {
+		store.AbortUpload(key, upload.UploadID)
+		return fmt.Errorf("multipart upload %s: %s", key, err)
+	}
+	logger.Debugf("Uploaded %s (%d bytes) in %d parts", key, len(data), n)
+	return nil
+}
@@ -0,0 +1,117 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package object
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"sort"
+	"sync"
+	"testing"
+)
+
+// partStore keeps the uploaded parts in memory, and fails the part failPart.
+type partStore struct {
+	ObjectStorage
+	sync.Mutex
+	parts    map[int][]byte
+	failPart int
+	aborted  bool
+}
+
+func (s *partStore) CreateMultipartUpload(key string) (*MultipartUpload, error) {
+	s.parts = make(map[int][]byte)
+	return &MultipartUpload{MinPartSize: 2, MaxCount: 10, UploadID: "1"}, nil
+}
+
+func (s *partStore) UploadPart(key string, uploadID string, num int, body []byte) (*Part, error) {
+	if num == s.failPart {
+		return nil, errors.New("injected error")
+	}
+	s.Lock()
+	defer s.Unlock()
+	s.parts[num] = append([]byte{}, body...)
+	return &Part{Num: num, Size: len(body)}, nil
+}
+
+func (s *partStore) AbortUpload(key string, uploadID string) {
+	s.aborted = true
+}
+
+func (s *partStore) CompleteUpload(key string, uploadID string, parts []*Part) error {
+	var nums []int
+	for _, p := range parts {
+		nums = append(nums, p.Num)
+	}
+	if !sort.IntsAreSorted(nums) {
+		return errors.New("parts are not in order")
+	}
+	var data []byte
+	for _, n := range nums {
+		data = append(data, s.parts[n]...)
+	}
+	return s.ObjectStorage.Put(key, bytes.NewReader(data))
+}
+
+func TestPutMultipart(t *testing.T) {
+	m, _ := newMem("", "", "")
+	s := &partStore{ObjectStorage: m}
+	data := []byte("0123456789abcdefghijklmnopqrstuvwxyz")
+	get := func(key string) string {
+		r, err := s.Get(key, 0, -1)
+		if err != nil {
+			t.Fatalf("get %s: %s", key, err)
+		}
+		d, _ := ioutil.ReadAll(r)
+		return string(d)
+	}
+
+	conf := MultipartConfig{Threshold: 8, PartSize: 3, Threads: 3}
+	if err := PutMultipart(s, "a", data, conf); err != nil {
+		t.Fatalf("put multipart: %s", err)
+	}
+	if len(s.parts) != 9 { // part size is raised to 4 by MaxCount
+		t.Fatalf("expect 9 parts, but got %d", len(s.parts))
+	}
+	if get("a") != string(data) {
+		t.Fatalf("content of a: %q", get("a"))
+	}
+
+	s.parts = nil
+	if err := PutMultipart(s, "b", data[:8], conf); err != nil || s.parts != nil {
+		t.Fatalf("small object should be uploaded in one request: %v", err)
+	}
+	if get("b") != string(data[:8]) {
+		t.Fatalf("content of b: %q", get("b"))
+	}
+
+	s.failPart = 2
+	if err := PutMultipart(s, "c", data, conf); err == nil {
+		t.Fatalf("put multipart should fail")
+	}
+	if !s.aborted {
+		t.Fatalf("failed upload should be aborted")
+	}
+	if _, err := s.Head("c"); err == nil {
+		t.Fatalf("c should not exist")
+	}
+
+	// not supported by mem
+	if err := PutMultipart(m, "d", data, conf); err != nil {
+		t.Fatalf("put d: %s", err)
+	}
+}
@@ -19,6 +19,8 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
@@ -80,7 +82,31 @@ type FileSystem interface {
 	Chown(path string, owner, group string) error
 }
 
-var notSupported = errors.New("not supported")
+// RangeWriter is implemented by the storages which can update part of an existing object in place.
+type RangeWriter interface {
+	WriteAt(key string, off int64, data []byte) error
+	Truncate(key string, size int64) error
+}
+
+// Extent is a range of an object.
+type Extent struct {
+	Off, Len int64
+}
+
+// SparseReader is implemented by the storages which know the holes of objects, the holes are read as zeros.
+type SparseReader interface {
+	// Extents returns the ranges which have data in an object, in the order of offset.
+	Extents(key string) ([]Extent, error)
+}
+
+// ErrNotSupported is returned for the optional operations which are not supported by the object
+// storage, e.g. multipart upload, the drivers could embed DefaultObjectStorage to return it.
+var ErrNotSupported = errors.New("not supported")
+
+var notSupported = ErrNotSupported
+
+// ErrReadOnly is returned for the writes to a read-only object storage, e.g. a public dataset.
+var ErrReadOnly = errors.New("read-only object storage")
 
 type DefaultObjectStorage struct{}
 
@@ -118,21 +144,37 @@ func (s DefaultObjectStorage) ListAll(prefix, marker string) (<-chan Object, err
 	return nil, notSupported
 }
 
-type Creator func(bucket, accessKey, secretKey string) (ObjectStorage, error)
+// Creator creates an object storage with the endpoint (bucket of volume) and credentials.
+type Creator func(endpoint, accessKey, secretKey string) (ObjectStorage, error)
 
 var storages = make(map[string]Creator)
 
+// Register adds a driver of object storage for the name (the value of --storage), it should be
+// called in init(). The drivers out of this package (e.g. the internal blob services) could be
+// compiled into juicefs by importing their packages in cmd, the existing driver is replaced if
+// the name is registered again.
 func Register(name string, register Creator) {
-	storages[name] = register
+	storages[strings.ToLower(name)] = register
+}
+
+// Storages returns the names of the registered object storages in order.
+func Storages() []string {
+	names := make([]string, 0, len(storages))
+	for name := range storages {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
 }
 
+// CreateStorage creates the object storage using the driver registered for name.
 func CreateStorage(name, endpoint, accessKey, secretKey string) (ObjectStorage, error) {
-	f, ok := storages[name]
+	f, ok := storages[strings.ToLower(name)]
 	if ok {
 		logger.Debugf("Creating %s storage at endpoint %s", name, endpoint)
 		return f(endpoint, accessKey, secretKey)
 	}
-	return nil, fmt.Errorf("invalid storage: %s", name)
+	return nil, fmt.Errorf("invalid storage: %s, supported ones: %s", name, strings.Join(Storages(), ", "))
 }
 
 var bufPool = sync.Pool{
@@ -197,6 +197,32 @@ func testStorage(t *testing.T, s ObjectStorage) {
 	}
 }
 
+func TestRegister(t *testing.T) {
+	var called string
+	Register("Blob", func(endpoint, accessKey, secretKey string) (ObjectStorage, error) {
+		called = endpoint
+		return newMem(endpoint, accessKey, secretKey)
+	})
+	defer delete(storages, "blob")
+	found := false
+	for _, name := range Storages() {
+		found = found || name == "blob"
+	}
+	if !found {
+		t.Fatalf("blob is not registered: %v", Storages())
+	}
+	s, err := CreateStorage("blob", "blob://test", "", "")
+	if err != nil || called != "blob://test" {
+		t.Fatalf("create blob: %s %s", err, called)
+	}
+	if err = s.Put("a", bytes.NewReader([]byte("a"))); err != nil {
+		t.Fatalf("put: %s", err)
+	}
+	if _, err := CreateStorage("unknown", "", "", ""); err == nil || !strings.Contains(err.Error(), "blob") {
+		t.Fatalf("unknown storage should fail with the supported ones: %v", err)
+	}
+}
+
 func TestMem(t *testing.T) {
 	m, _ := newMem("", "", "")
 	testStorage(t, m)
@@ -109,6 +109,59 @@ func (p *withPrefix) ListAll(prefix, marker string) (<-chan Object, error) {
 	return r2, nil
 }
 
+func (p *withPrefix) ListV2(prefix, startAfter, token string, limit int64) ([]Object, string, error) {
+	l, ok := p.os.(ListerV2)
+	if !ok {
+		return nil, "", notSupported
+	}
+	if startAfter != "" {
+		startAfter = p.prefix + startAfter
+	}
+	objs, next, err := l.ListV2(p.prefix+prefix, startAfter, token, limit)
+	ln := len(p.prefix)
+	for _, o := range objs {
+		switch p := o.(type) {
+		case *obj:
+			p.key = p.key[ln:]
+		case *file:
+			p.key = p.key[ln:]
+		}
+	}
+	return objs, next, err
+}
+
+func (p *withPrefix) GetIf(key string, off, limit int64, cond Condition) (io.ReadCloser, error) {
+	if c, ok := p.os.(ConditionalStorage); ok {
+		return c.GetIf(p.prefix+key, off, limit, cond)
+	}
+	return nil, notSupported
+}
+
+func (p *withPrefix) HeadObject(key string) (*ObjectInfo, error) {
+	c, ok := p.os.(ConditionalStorage)
+	if !ok {
+		return nil, notSupported
+	}
+	info, err := c.HeadObject(p.prefix + key)
+	if err != nil {
+		return nil, err
+	}
+	switch po := info.Object.(type) {
+	case *obj:
+		po.key = po.key[len(p.prefix):]
+	case *file:
+		po.key = po.key[len(p.prefix):]
+	}
+	return info, nil
+}
+
+func (p *withPrefix) Checksum(key string) (string, error) {
+	if c, ok := p.os.(Checksummer); ok {
+		return c.Checksum(p.prefix + key)
+	}
+	return "", nil
+}
+
 func (p *withPrefix) Chmod(path string, mode os.FileMode) error {
 	if fs, ok := p.os.(FileSystem); ok {
 		return fs.Chmod(p.prefix+path, mode)
@@ -0,0 +1,203 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package object
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/jobs"
+	"github.com/juicedata/juicefs/pkg/qos"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ReplicationQueue is a persisted queue of the changes to be replicated.
+type ReplicationQueue interface {
+	AddReplication(op string) error
+	ClaimReplications(limit int, lease time.Duration) ([]string, error)
+	DoneReplication(op string) error
+	ReplicationLag() (int64, time.Time, error)
+}
+
+const (
+	replicaPut     = 'P' // copy into replica
+	replicaDelete  = 'D' // delete from replica
+	replicaRestore = 'R' // copy back into primary
+	replicaErase   = 'E' // delete from primary
+
+	replicationLease = time.Minute * 5
+)
+
+var (
+	replicationPending = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "object_replication_pending",
+		Help: "number of objects waiting to be replicated.",
+	})
+	replicationLag = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "object_replication_lag_seconds",
+		Help: "age of the oldest object waiting to be replicated.",
+	})
+	replicationErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "object_replication_errors",
+		Help: "failed requests to replicate objects",
+	})
+)
+
+type replicated struct {
+	ObjectStorage
+	replica ObjectStorage
+	queue   ReplicationQueue
+	threads int
+}
+
+// WithReplica returns a object storage that replicates all the changes into
+// another one asynchronously, the pending changes are persisted in queue.
+func WithReplica(primary, replica ObjectStorage, queue ReplicationQueue, threads int) ObjectStorage {
+	_ = prometheus.Register(replicationPending)
+	_ = prometheus.Register(replicationLag)
+	_ = prometheus.Register(replicationErrors)
+	if threads <= 0 {
+		threads = 10
+	}
+	r := &replicated{primary, replica, queue, threads}
+	go r.run()
+	go r.updateLag()
+	return r
+}
+
+func (r *replicated) String() string {
+	return fmt.Sprintf("%s(replicated to %s)", r.ObjectStorage, r.replica)
+}
+
+// Put adds the object into queue after it's persisted, so it will be replicated
+// even if the client crashed.
+func (r *replicated) Put(key string, in io.Reader) error {
+	if err := r.ObjectStorage.Put(key, in); err != nil {
+		return err
+	}
+	return r.queue.AddReplication(string(replicaPut) + key)
+}
+
+// CompleteUpload adds the object into queue after all the parts are uploaded.
+func (r *replicated) CompleteUpload(key string, uploadID string, parts []*Part) error {
+	if err := r.ObjectStorage.CompleteUpload(key, uploadID, parts); err != nil {
+		return err
+	}
+	return r.queue.AddReplication(string(replicaPut) + key)
+}
+
+func (r *replicated) Delete(key string) error {
+	if err := r.ObjectStorage.Delete(key); err != nil {
+		return err
+	}
+	return r.queue.AddReplication(string(replicaDelete) + key)
+}
+
+func (r *replicated) replicate(op string) error {
+	key := op[1:]
+	switch op[0] {
+	case replicaPut:
+		in, err := r.ObjectStorage.Get(key, 0, -1)
+		if err != nil {
+			if _, e := r.ObjectStorage.Head(key); e != nil {
+				logger.Debugf("skip replicating %s: %s", key, e)
+				return nil // deleted
+			}
+			return err
+		}
+		defer in.Close()
+		return r.replica.Put(key, qos.NewReader(qos.Replication, in))
+	case replicaDelete:
+		return r.replica.Delete(key)
+	case replicaRestore:
+		in, err := r.replica.Get(key, 0, -1)
+		if err != nil {
+			if _, e := r.replica.Head(key); e != nil {
+				logger.Debugf("skip restoring %s: %s", key, e)
+				return nil // deleted
+			}
+			return err
+		}
+		defer in.Close()
+		return r.ObjectStorage.Put(key, qos.NewReader(qos.Replication, in))
+	case replicaErase:
+		return r.ObjectStorage.Delete(key)
+	default:
+		logger.Warnf("unknown replication: %s", op)
+		return nil
+	}
+}
+
+func (r *replicated) run() {
+	for {
+		jobs.Start(jobs.Replication)
+		ops, err := r.queue.ClaimReplications(r.threads*10, replicationLease)
+		if err != nil {
+			logger.Warnf("claim replications: %s", err)
+		}
+		if len(ops) == 0 {
+			jobs.Cancel(jobs.Replication)
+			time.Sleep(time.Second)
+			continue
+		}
+		var wg sync.WaitGroup
+		todo := make(chan string, len(ops))
+		for _, op := range ops {
+			todo <- op
+		}
+		close(todo)
+		for i := 0; i < r.threads; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for op := range todo {
+					done := qos.Start(qos.Replication)
+					err := r.replicate(op)
+					done()
+					if err != nil {
+						replicationErrors.Inc()
+						logger.Warnf("replicate %s: %s", op, err)
+						continue // retry after the lease is expired
+					}
+					if err := r.queue.DoneReplication(op); err != nil {
+						logger.Warnf("finish replication %s: %s", op, err)
+					}
+				}
+			}()
+		}
+		wg.Wait()
+		jobs.Done(jobs.Replication)
+	}
+}
+
+func (r *replicated) updateLag() {
+	for {
+		pending, oldest, err := r.queue.ReplicationLag()
+		if err == nil {
+			replicationPending.Set(float64(pending))
+			if pending > 0 {
+				replicationLag.Set(time.Since(oldest).Seconds())
+			} else {
+				replicationLag.Set(0)
+			}
+		}
+		time.Sleep(time.Second * 10)
+	}
+}
+
+var _ ObjectStorage = &replicated{}
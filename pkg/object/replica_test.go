@@ -0,0 +1,156 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package object
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+)
+
+type memQueue struct {
+	sync.Mutex
+	ops    map[string]time.Time
+	leases map[string]time.Time
+}
+
+func (q *memQueue) AddReplication(op string) error {
+	q.Lock()
+	defer q.Unlock()
+	q.ops[op] = time.Now()
+	return nil
+}
+
+func (q *memQueue) ClaimReplications(limit int, lease time.Duration) ([]string, error) {
+	q.Lock()
+	defer q.Unlock()
+	var ops []string
+	for op := range q.ops {
+		if time.Now().After(q.leases[op]) && len(ops) < limit {
+			ops = append(ops, op)
+			q.leases[op] = time.Now().Add(lease)
+		}
+	}
+	return ops, nil
+}
+
+func (q *memQueue) DoneReplication(op string) error {
+	q.Lock()
+	defer q.Unlock()
+	delete(q.ops, op)
+	delete(q.leases, op)
+	return nil
+}
+
+func (q *memQueue) ReplicationLag() (int64, time.Time, error) {
+	q.Lock()
+	defer q.Unlock()
+	var oldest time.Time
+	for _, t := range q.ops {
+		if oldest.IsZero() || t.Before(oldest) {
+			oldest = t
+		}
+	}
+	return int64(len(q.ops)), oldest, nil
+}
+
+func TestReplica(t *testing.T) {
+	primary, _ := CreateStorage("mem", "", "", "")
+	replica, _ := CreateStorage("mem", "", "", "")
+	queue := &memQueue{ops: make(map[string]time.Time), leases: make(map[string]time.Time)}
+	s := WithReplica(primary, replica, queue, 2)
+
+	waitReplicated := func() {
+		for i := 0; i < 50; i++ {
+			if n, _, _ := queue.ReplicationLag(); n == 0 {
+				return
+			}
+			time.Sleep(time.Millisecond * 100)
+		}
+		t.Fatalf("not replicated in time")
+	}
+	if err := s.Put("a", bytes.NewReader([]byte("data"))); err != nil {
+		t.Fatalf("put: %s", err)
+	}
+	waitReplicated()
+	r, err := replica.Get("a", 0, -1)
+	if err != nil {
+		t.Fatalf("get from replica: %s", err)
+	}
+	if d, _ := ioutil.ReadAll(r); string(d) != "data" {
+		t.Fatalf("unexpected data in replica: %s", d)
+	}
+	if err := s.Delete("a"); err != nil {
+		t.Fatalf("delete: %s", err)
+	}
+	waitReplicated()
+	if _, err := replica.Head("a"); err == nil {
+		t.Fatalf("a should be deleted from replica")
+	}
+}
+
+type brokenStore struct {
+	ObjectStorage
+	broken bool
+}
+
+func (s *brokenStore) Get(key string, off, limit int64) (io.ReadCloser, error) {
+	if s.broken {
+		return nil, errors.New("broken")
+	}
+	return s.ObjectStorage.Get(key, off, limit)
+}
+
+func (s *brokenStore) Put(key string, in io.Reader) error {
+	if s.broken {
+		return errors.New("broken")
+	}
+	return s.ObjectStorage.Put(key, in)
+}
+
+func TestFailover(t *testing.T) {
+	mem, _ := CreateStorage("mem", "", "", "")
+	primary := &brokenStore{ObjectStorage: mem}
+	mirror, _ := CreateStorage("mem", "", "", "")
+	queue := &memQueue{ops: make(map[string]time.Time), leases: make(map[string]time.Time)}
+	s := WithFailover(primary, mirror, queue, true)
+
+	_ = mirror.Put("a", bytes.NewReader([]byte("mirror")))
+	primary.broken = true
+	for i := 0; i < failoverErrors; i++ {
+		if r, err := s.Get("a", 0, -1); err != nil {
+			t.Fatalf("get from mirror: %s", err)
+		} else if d, _ := ioutil.ReadAll(r); string(d) != "mirror" {
+			t.Fatalf("unexpected data: %s", d)
+		}
+	}
+	if !s.(*failover).useMirror() {
+		t.Fatalf("should switch to mirror")
+	}
+	if err := s.Put("b", bytes.NewReader([]byte("b"))); err != nil {
+		t.Fatalf("put into mirror: %s", err)
+	}
+	if _, err := mirror.Head("b"); err != nil {
+		t.Fatalf("b should be written into mirror: %s", err)
+	}
+	if ops, _ := queue.ClaimReplications(10, time.Minute); len(ops) != 1 || ops[0] != "Rb" {
+		t.Fatalf("b should be restored into primary later: %v", ops)
+	}
+}
@@ -17,8 +17,10 @@ package object
 
 import (
 	"bytes"
+	"context"
 	"crypto/hmac"
 	"crypto/sha1"
+	"crypto/tls"
 	"encoding/base64"
 	"errors"
 	"fmt"
@@ -31,55 +33,120 @@ import (
 	"strings"
 	"time"
 
+	"github.com/juicedata/juicefs/pkg/trace"
+	"github.com/juicedata/juicefs/pkg/utils"
 	"github.com/viki-org/dnscache"
 )
 
 var resolver = dnscache.New(time.Minute)
 var httpClient *http.Client
 
+// HTTPConfig is the settings of the HTTP client shared by the object storages.
+type HTTPConfig struct {
+	MaxIdleConnsPerHost int           // max idle connections kept for each host
+	MaxConnsPerHost     int           // max connections to each host, 0 means unlimited
+	IdleConnTimeout     time.Duration // how long an idle connection is kept
+	HTTP2               bool          // try HTTP/2 for HTTPS endpoints
+	TLSSessionCache     int           // number of TLS sessions cached for resumption, 0 means disabled
+	TLS                 *tls.Config   // trusted CAs and pinned keys of servers, nil means system defaults
+}
+
+// DefaultHTTPConfig is used by the shared HTTP client unless SetHTTPConfig is called.
+var DefaultHTTPConfig = HTTPConfig{
+	MaxIdleConnsPerHost: 500,
+	IdleConnTimeout:     time.Second * 300,
+	TLSSessionCache:     256,
+}
+
+func dial(network string, address string) (net.Conn, error) {
+	host, port := utils.SplitHostPort(address)
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	} else {
+		var err error
+		if ips, err = resolver.Fetch(host); err != nil {
+			return nil, err
+		}
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("No such host: %s", host)
+	}
+	// spread the connections over the addresses
+	first := rand.Intn(len(ips))
+	ips = append(append([]net.IP{}, ips[first:]...), ips[:first]...)
+	dialer := &net.Dialer{Timeout: time.Second * 10}
+	return utils.DialIPs(context.Background(), dialer, network, utils.SortIPs(ips), port)
+}
+
+// newTransport returns the transport with conf, the requests go through the proxy in
+// HTTP_PROXY or HTTPS_PROXY unless the host is excluded by NO_PROXY.
+func newTransport(conf *HTTPConfig) *http.Transport {
+	tr := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		TLSHandshakeTimeout:   time.Second * 20,
+		ResponseHeaderTimeout: time.Second * 30,
+		IdleConnTimeout:       conf.IdleConnTimeout,
+		MaxIdleConnsPerHost:   conf.MaxIdleConnsPerHost,
+		MaxConnsPerHost:       conf.MaxConnsPerHost,
+		Dial:                  dial,
+		DisableCompression:    true,
+		ForceAttemptHTTP2:     conf.HTTP2,
+	}
+	if conf.TLS != nil {
+		tr.TLSClientConfig = conf.TLS.Clone()
+	}
+	if conf.TLSSessionCache > 0 {
+		if tr.TLSClientConfig == nil {
+			tr.TLSClientConfig = &tls.Config{}
+		}
+		tr.TLSClientConfig.ClientSessionCache = tls.NewLRUClientSessionCache(conf.TLSSessionCache)
+	}
+	if !conf.HTTP2 {
+		// a non-nil empty map disables HTTP/2
+		tr.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	}
+	return tr
+}
+
+// TraceHeader is the header carrying the trace id of the operation which sends the request.
+const TraceHeader = "X-JuiceFS-Trace"
+
+// tracedTransport tags the requests of the objects bound to a trace id, so they can
+// be found in the access logs of object storage.
+type tracedTransport struct {
+	http.RoundTripper
+}
+
+func (t *tracedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if id := trace.Lookup(req.URL.Path); id != "" {
+		req = req.Clone(req.Context())
+		req.Header.Set(TraceHeader, id)
+		req.Header.Set("User-Agent", req.UserAgent()+" juicefs-trace/"+id)
+	}
+	return t.RoundTripper.RoundTrip(req)
+}
+
 func init() {
 	rand.Seed(time.Now().Unix())
 	httpClient = &http.Client{
-		Transport: &http.Transport{
-			Proxy:                 http.ProxyFromEnvironment,
-			TLSHandshakeTimeout:   time.Second * 20,
-			ResponseHeaderTimeout: time.Second * 30,
-			IdleConnTimeout:       time.Second * 300,
-			MaxIdleConnsPerHost:   500,
-			Dial: func(network string, address string) (net.Conn, error) {
-				separator := strings.LastIndex(address, ":")
-				host := address[:separator]
-				port := address[separator:]
-				ips, err := resolver.Fetch(host)
-				if err != nil {
-					return nil, err
-				}
-				if len(ips) == 0 {
-					return nil, fmt.Errorf("No such host: %s", host)
-				}
-				var conn net.Conn
-				n := len(ips)
-				first := rand.Intn(n)
-				dialer := &net.Dialer{Timeout: time.Second * 10}
-				for i := 0; i < n; i++ {
-					ip := ips[(first+i)%n]
-					address = ip.String()
-					if port != "" {
-						address = net.JoinHostPort(address, port[1:])
-					}
-					conn, err = dialer.Dial(network, address)
-					if err == nil {
-						return conn, nil
-					}
-				}
-				return nil, err
-			},
-			DisableCompression: true,
-		},
-		Timeout: time.Hour,
+		Transport: &tracedTransport{newTransport(&DefaultHTTPConfig)},
+		Timeout:   time.Hour,
 	}
 }
 
+// HTTPClient returns the HTTP client shared by the object storages, with the settings of proxy
+// and TLS, it could be used by the drivers registered out of this package.
+func HTTPClient() *http.Client {
+	return httpClient
+}
+
+// SetHTTPConfig replaces the transport of the shared HTTP client, it should be called
+// before any object storage is created, because some of them copy the transport.
+func SetHTTPConfig(conf *HTTPConfig) {
+	httpClient.Transport = &tracedTransport{newTransport(conf)}
+}
+
 func cleanup(response *http.Response) {
 	if response != nil && response.Body != nil {
 		_, _ = ioutil.ReadAll(response.Body)
@@ -0,0 +1,94 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package object
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/trace"
+)
+
+func TestHTTPConfig(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+	defer SetHTTPConfig(&DefaultHTTPConfig)
+
+	get := func() *http.Response {
+		resp, err := httpClient.Get(srv.URL)
+		if err != nil {
+			t.Fatalf("get: %s", err)
+		}
+		cleanup(resp)
+		return resp
+	}
+	for _, h2 := range []bool{false, true} {
+		SetHTTPConfig(&HTTPConfig{MaxIdleConnsPerHost: 10, MaxConnsPerHost: 5, IdleConnTimeout: time.Second, HTTP2: h2, TLSSessionCache: 10})
+		tr := httpClient.Transport.(*tracedTransport).RoundTripper.(*http.Transport)
+		if tr.MaxIdleConnsPerHost != 10 || tr.MaxConnsPerHost != 5 || tr.IdleConnTimeout != time.Second {
+			t.Fatalf("transport: %+v", tr)
+		}
+		tr.TLSClientConfig.RootCAs = srv.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+		tr.CloseIdleConnections()
+		if resp := get(); resp.ProtoMajor != 1 && !h2 || resp.ProtoMajor != 2 && h2 {
+			t.Fatalf("protocol should be HTTP/2 %v, but got %s", h2, resp.Proto)
+		}
+		tr.CloseIdleConnections()
+		if resp := get(); !resp.TLS.DidResume {
+			t.Fatalf("TLS session should be resumed")
+		}
+	}
+	SetHTTPConfig(&HTTPConfig{})
+	if httpClient.Transport.(*tracedTransport).RoundTripper.(*http.Transport).TLSClientConfig != nil {
+		t.Fatalf("TLS session cache should be disabled")
+	}
+}
+
+func TestTracedTransport(t *testing.T) {
+	var id, ua string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, ua = r.Header.Get(TraceHeader), r.UserAgent()
+	}))
+	defer srv.Close()
+
+	get := func(key string) {
+		req, _ := http.NewRequest("GET", srv.URL+"/bucket/"+key, nil)
+		req.Header.Set("User-Agent", UserAgent)
+		resp, err := httpClient.Do(req)
+		if err != nil {
+			t.Fatalf("get: %s", err)
+		}
+		cleanup(resp)
+	}
+	unbind := trace.Bind("test/chunks/0/0/1_0_4", "abc-1")
+	get("test/chunks/0/0/1_0_4")
+	if id != "abc-1" || ua != UserAgent+" juicefs-trace/abc-1" {
+		t.Fatalf("traced request: id %q, user agent %q", id, ua)
+	}
+	get("test/chunks/0/0/2_0_4")
+	if id != "" || ua != UserAgent {
+		t.Fatalf("untraced request: id %q, user agent %q", id, ua)
+	}
+	unbind()
+	get("test/chunks/0/0/1_0_4")
+	if id != "" {
+		t.Fatalf("unbound request: id %q", id)
+	}
+}
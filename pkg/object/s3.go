@@ -20,6 +20,7 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net/http"
 	"net/url"
 	"os"
 	"strings"
@@ -33,6 +34,23 @@ import (
 
 const awsDefaultRegion = "us-east-1"
 
+// AnonymousKey is used as the access key to read public buckets without credentials,
+// the requests are not signed.
+const AnonymousKey = "anonymous"
+
+// s3Credentials returns the static credentials, or nil to use the default chain
+// (environment, shared files and instance roles) if accessKey is empty.
+func s3Credentials(accessKey, secretKey string) *credentials.Credentials {
+	switch accessKey {
+	case "":
+		return nil
+	case AnonymousKey:
+		return credentials.AnonymousCredentials
+	default:
+		return credentials.NewStaticCredentials(accessKey, secretKey, "")
+	}
+}
+
 type s3client struct {
 	bucket string
 	s3     *s3.S3
@@ -99,6 +117,65 @@ func (s *s3client) Get(key string, off, limit int64) (io.ReadCloser, error) {
 	return resp.Body, nil
 }
 
+func (s *s3client) GetIf(key string, off, limit int64, cond Condition) (io.ReadCloser, error) {
+	params := &s3.GetObjectInput{Bucket: &s.bucket, Key: &key}
+	if off > 0 || limit > 0 {
+		var r string
+		if limit > 0 {
+			r = fmt.Sprintf("bytes=%d-%d", off, off+limit-1)
+		} else {
+			r = fmt.Sprintf("bytes=%d-", off)
+		}
+		params.Range = &r
+	}
+	if cond.IfMatch != "" {
+		params.IfMatch = &cond.IfMatch
+	}
+	if cond.IfNoneMatch != "" {
+		params.IfNoneMatch = &cond.IfNoneMatch
+	}
+	resp, err := s.s3.GetObject(params)
+	if err != nil {
+		if e, ok := err.(awserr.RequestFailure); ok {
+			switch e.StatusCode() {
+			case http.StatusPreconditionFailed:
+				return nil, ErrPreconditionFailed
+			case http.StatusNotModified:
+				return nil, ErrNotModified
+			}
+		}
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (s *s3client) HeadObject(key string) (*ObjectInfo, error) {
+	var part int64 = 1
+	param := s3.HeadObjectInput{
+		Bucket:     &s.bucket,
+		Key:        &key,
+		PartNumber: &part, // to get the number of parts
+	}
+	r, err := s.s3.HeadObject(&param)
+	if err != nil {
+		return nil, err
+	}
+	info := &ObjectInfo{Object: &obj{key, *r.ContentLength, *r.LastModified, strings.HasSuffix(key, "/")}}
+	if r.ETag != nil {
+		info.ETag = *r.ETag
+	}
+	if r.PartsCount != nil {
+		info.Parts = int(*r.PartsCount)
+	}
+	if info.Parts > 0 {
+		// the size of the first part is returned with PartNumber
+		if o, err := s.Head(key); err == nil {
+			info.Object = o
+		}
+	}
+	return info, nil
+}
+
 func (s *s3client) Put(key string, in io.Reader) error {
 	var body io.ReadSeeker
 	if b, ok := in.(io.ReadSeeker); ok {
@@ -166,6 +243,39 @@ func (s *s3client) List(prefix, marker string, limit int64) ([]Object, error) {
 	return objs, nil
 }
 
+func (s *s3client) ListV2(prefix, startAfter, token string, limit int64) ([]Object, string, error) {
+	param := s3.ListObjectsV2Input{
+		Bucket:  &s.bucket,
+		Prefix:  &prefix,
+		MaxKeys: &limit,
+	}
+	if token != "" {
+		param.ContinuationToken = &token
+	} else if startAfter != "" {
+		param.StartAfter = &startAfter
+	}
+	resp, err := s.s3.ListObjectsV2(&param)
+	if err != nil {
+		return nil, "", err
+	}
+	n := len(resp.Contents)
+	objs := make([]Object, n)
+	for i := 0; i < n; i++ {
+		o := resp.Contents[i]
+		objs[i] = &obj{
+			*o.Key,
+			*o.Size,
+			*o.LastModified,
+			strings.HasSuffix(*o.Key, "/"),
+		}
+	}
+	var next string
+	if resp.IsTruncated != nil && *resp.IsTruncated && resp.NextContinuationToken != nil {
+		next = *resp.NextContinuationToken
+	}
+	return objs, next, nil
+}
+
 func (s *s3client) ListAll(prefix, marker string) (<-chan Object, error) {
 	return nil, notSupported
 }
@@ -249,9 +359,7 @@ func autoS3Region(bucketName, accessKey, secretKey string) (string, error) {
 	awsConfig := &aws.Config{
 		HTTPClient: httpClient,
 	}
-	if accessKey != "" {
-		awsConfig.Credentials = credentials.NewStaticCredentials(accessKey, secretKey, "")
-	}
+	awsConfig.Credentials = s3Credentials(accessKey, secretKey)
 
 	var regions []string
 	if r := os.Getenv("AWS_DEFAULT_REGION"); r != "" {
@@ -372,9 +480,7 @@ func newS3(endpoint, accessKey, secretKey string) (ObjectStorage, error) {
 		DisableSSL: aws.Bool(!ssl),
 		HTTPClient: httpClient,
 	}
-	if accessKey != "" {
-		awsConfig.Credentials = credentials.NewStaticCredentials(accessKey, secretKey, "")
-	}
+	awsConfig.Credentials = s3Credentials(accessKey, secretKey)
 	if ep != "" {
 		awsConfig.Endpoint = aws.String(ep)
 		awsConfig.S3ForcePathStyle = aws.Bool(true)
@@ -0,0 +1,237 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Package qos schedules the requests to object storage by their classes, so the
+// background traffic (prefetch, compaction and replication) doesn't add latency to
+// the requests of users. A request waits until there is no request of a class with
+// higher priority in flight, for at most MaxDelay, then for the bandwidth budget of
+// its class (if any).
+package qos
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/juju/ratelimit"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Class is the origin of requests to object storage.
+type Class int
+
+// The classes of requests, in the order of priority.
+const (
+	Read        Class = iota // read by users
+	Write                    // written by users
+	Prefetch                 // read ahead into cache
+	Compaction               // read and written by compaction
+	Replication              // copied into the replica storage
+	numClasses
+)
+
+var (
+	classNames = []string{"read", "write", "prefetch", "compaction", "replication"}
+	priorities = []int{0, 0, 1, 2, 3} // smaller is higher
+)
+
+func (c Class) String() string {
+	if c < 0 || c >= numClasses {
+		return fmt.Sprintf("class-%d", int(c))
+	}
+	return classNames[c]
+}
+
+// ParseClass returns the class of the name.
+func ParseClass(name string) (Class, error) {
+	for i, n := range classNames {
+		if strings.EqualFold(name, n) {
+			return Class(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown I/O class %q", name)
+}
+
+type classKey struct{}
+
+// WithClass returns a context to tag the requests with the class.
+func WithClass(ctx context.Context, c Class) context.Context {
+	return context.WithValue(ctx, classKey{}, c)
+}
+
+// ClassOf returns the class of requests in the context, Read if it's not tagged.
+func ClassOf(ctx context.Context) Class {
+	if c, ok := ctx.Value(classKey{}).(Class); ok {
+		return c
+	}
+	return Read
+}
+
+var (
+	mu       sync.Mutex
+	inflight [numClasses]int
+	bases    [numClasses]int64 // bytes per second set by SetLimit, 0 means unlimited
+	limits   [numClasses]int64 // the current ones, which could be changed by schedule
+	buckets  [numClasses]*ratelimit.Bucket
+
+	// MaxDelay is the max time a request waits for the ones with higher priority.
+	MaxDelay = time.Second
+
+	requests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "object_class_requests",
+		Help: "Number of requests to object storage by class.",
+	}, []string{"class"})
+	requestBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "object_class_bytes",
+		Help: "Bytes transferred with object storage by class.",
+	}, []string{"class"})
+	waitSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "object_class_wait_seconds",
+		Help:    "Time waited for requests with higher priority or the bandwidth budget by class.",
+		Buckets: prometheus.ExponentialBuckets(0.001, 4, 8),
+	}, []string{"class"})
+)
+
+// InitMetrics registers the metrics of classes.
+func InitMetrics() {
+	prometheus.MustRegister(requests)
+	prometheus.MustRegister(requestBytes)
+	prometheus.MustRegister(waitSeconds)
+}
+
+// SetLimit sets the bandwidth budget of a class in bytes per second, 0 means unlimited.
+func SetLimit(c Class, bps int64) {
+	mu.Lock()
+	defer mu.Unlock()
+	bases[c] = bps
+	update(c)
+}
+
+// update applies the current limit of a class, mu should be held.
+func update(c Class) {
+	bps := schedules[c].LimitAt(now(), bases[c])
+	if bps == limits[c] {
+		return
+	}
+	limits[c] = bps
+	if bps > 0 {
+		buckets[c] = ratelimit.NewBucketWithRate(float64(bps), bps)
+	} else {
+		buckets[c] = nil
+	}
+}
+
+// SetLimits sets the bandwidth budgets in Mbps, in the format of CLASS=LIMIT separated
+// by ',', for example: prefetch=100,compaction=50.
+func SetLimits(spec string) error {
+	parsed := make(map[Class]int64)
+	for _, s := range strings.Split(spec, ",") {
+		if strings.TrimSpace(s) == "" {
+			continue
+		}
+		kv := strings.SplitN(s, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("invalid limit %q, it should be CLASS=Mbps", s)
+		}
+		c, err := ParseClass(strings.TrimSpace(kv[0]))
+		if err != nil {
+			return err
+		}
+		v, err := strconv.ParseInt(strings.TrimSpace(kv[1]), 10, 64)
+		if err != nil || v < 0 {
+			return fmt.Errorf("invalid limit %q, it should be CLASS=Mbps", s)
+		}
+		parsed[c] = v * (1 << 20) / 8
+	}
+	for c, bps := range parsed {
+		SetLimit(c, bps)
+	}
+	return nil
+}
+
+// Limit returns the current bandwidth budget of a class in bytes per second.
+func Limit(c Class) int64 {
+	mu.Lock()
+	defer mu.Unlock()
+	return limits[c]
+}
+
+// busy returns true if there are requests with higher priority than c in flight.
+func busy(c Class) bool {
+	for h := Class(0); h < numClasses; h++ {
+		if priorities[h] < priorities[c] && inflight[h] > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Start waits until a request of the class can be sent, the returned function
+// should be called after it's finished.
+func Start(c Class) (done func()) {
+	start := time.Now()
+	deadline := start.Add(MaxDelay)
+	mu.Lock()
+	for busy(c) && time.Now().Before(deadline) {
+		mu.Unlock()
+		time.Sleep(time.Millisecond)
+		mu.Lock()
+	}
+	inflight[c]++
+	mu.Unlock()
+	requests.WithLabelValues(c.String()).Inc()
+	if used := time.Since(start); used > time.Millisecond {
+		waitSeconds.WithLabelValues(c.String()).Observe(used.Seconds())
+	}
+	return func() {
+		mu.Lock()
+		inflight[c]--
+		mu.Unlock()
+	}
+}
+
+// Wait waits for the budget of the class to transfer n bytes.
+func Wait(c Class, n int) {
+	requestBytes.WithLabelValues(c.String()).Add(float64(n))
+	mu.Lock()
+	b := buckets[c]
+	mu.Unlock()
+	if b != nil && n > 0 {
+		if d := b.Take(int64(n)); d > 0 {
+			waitSeconds.WithLabelValues(c.String()).Observe(d.Seconds())
+			time.Sleep(d)
+		}
+	}
+}
+
+type reader struct {
+	io.ReadCloser
+	class Class
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	Wait(r.class, n)
+	return n, err
+}
+
+// NewReader returns a reader which waits for the budget of the class while reading.
+func NewReader(c Class, in io.ReadCloser) io.ReadCloser {
+	return &reader{in, c}
+}
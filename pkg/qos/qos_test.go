@@ -0,0 +1,138 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package qos
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestClass(t *testing.T) {
+	if ClassOf(context.Background()) != Read {
+		t.Fatalf("requests should be reads by default")
+	}
+	if c := ClassOf(WithClass(context.Background(), Compaction)); c != Compaction || c.String() != "compaction" {
+		t.Fatalf("class: %s", c)
+	}
+	defer func() {
+		SetLimit(Prefetch, 0)
+		SetLimit(Replication, 0)
+	}()
+	if err := SetLimits("prefetch=8, replication=16"); err != nil {
+		t.Fatalf("set limits: %s", err)
+	}
+	if Limit(Prefetch) != 1<<20 || Limit(Replication) != 2<<20 || Limit(Read) != 0 {
+		t.Fatalf("limits: %d %d %d", Limit(Prefetch), Limit(Replication), Limit(Read))
+	}
+	for _, s := range []string{"backup=1", "prefetch", "prefetch=-1", "prefetch=x"} {
+		if err := SetLimits(s); err == nil {
+			t.Fatalf("limits %q should be invalid", s)
+		}
+	}
+}
+
+func TestPriority(t *testing.T) {
+	done := Start(Read)
+	started := make(chan Class, 3)
+	for _, c := range []Class{Write, Prefetch, Replication} {
+		go func(c Class) {
+			d := Start(c)
+			started <- c
+			d()
+		}(c)
+	}
+	if c := <-started; c != Write {
+		t.Fatalf("write should not wait for read, but %s started", c)
+	}
+	select {
+	case c := <-started:
+		t.Fatalf("%s should wait for read", c)
+	case <-time.After(time.Millisecond * 50):
+	}
+	done()
+	for i := 0; i < 2; i++ {
+		select {
+		case <-started:
+		case <-time.After(time.Second):
+			t.Fatalf("background requests should start after read is done")
+		}
+	}
+
+	old := MaxDelay
+	MaxDelay = time.Millisecond * 20
+	defer func() { MaxDelay = old }()
+	done = Start(Read)
+	defer done()
+	start := time.Now()
+	Start(Compaction)()
+	if used := time.Since(start); used < MaxDelay || used > time.Second {
+		t.Fatalf("compaction should wait for %s, but waited %s", MaxDelay, used)
+	}
+}
+
+func TestBandwidth(t *testing.T) {
+	SetLimit(Compaction, 1<<20)
+	defer SetLimit(Compaction, 0)
+	start := time.Now()
+	Wait(Compaction, 1<<20) // the burst
+	Wait(Compaction, 1<<18)
+	if used := time.Since(start); used < time.Millisecond*200 || used > time.Second {
+		t.Fatalf("1.25 MiB at 1 MiB/s should take about 250ms, but %s", used)
+	}
+}
+
+func TestSchedule(t *testing.T) {
+	s, err := ParseSchedule("00:00-06:00=0; mon-fri 09:00-18:00=8")
+	if err != nil {
+		t.Fatalf("parse schedule: %s", err)
+	}
+	base := int64(100 << 20)
+	for ts, expected := range map[string]int64{
+		"2021-06-07 03:00": 0,       // monday night
+		"2021-06-07 10:00": 1 << 20, // monday morning
+		"2021-06-06 10:00": base,    // sunday
+		"2021-06-07 20:00": base,
+	} {
+		tm, _ := time.ParseInLocation("2006-01-02 15:04", ts, time.Local)
+		if l := s.LimitAt(tm, base); l != expected {
+			t.Fatalf("limit at %s should be %d, but got %d", ts, expected, l)
+		}
+	}
+	for _, spec := range []string{"00:00-06:00", "00:00-06:00=x", "replication@00:00-06:00"} {
+		if _, err := ParseSchedule(spec); err == nil {
+			t.Fatalf("schedule %q should be invalid", spec)
+		}
+	}
+
+	now = func() time.Time {
+		tm, _ := time.ParseInLocation("2006-01-02 15:04", "2021-06-07 10:00", time.Local)
+		return tm
+	}
+	defer func() { now = time.Now }()
+	SetLimit(Replication, base)
+	defer SetLimit(Replication, 0)
+	if err := SetSchedules("replication@mon-fri 09:00-18:00=8"); err != nil {
+		t.Fatalf("set schedules: %s", err)
+	}
+	defer SetSchedules("") // nolint:errcheck
+	if l := Limit(Replication); l != 1<<20 {
+		t.Fatalf("limit of replication should be 1 MiB/s, but got %d", l)
+	}
+	if err := SetSchedules("unknown@00:00-06:00=1"); err == nil {
+		t.Fatalf("unknown class should be invalid")
+	}
+}
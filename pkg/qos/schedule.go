@@ -0,0 +1,123 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package qos
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/jobs"
+)
+
+// Schedule is the bandwidth limits in some windows of a week, the base limit applies out of
+// them. It's in the format of "[DAYS ]HH:MM-HH:MM=Mbps" separated by ';', the windows are the
+// same as maintenance windows, and 0 means unlimited, for example:
+//
+//	00:00-06:00=0                 unlimited at night
+//	mon-fri 09:00-18:00=80        80 Mbps in the business hours
+type Schedule []scheduled
+
+type scheduled struct {
+	window *jobs.Window
+	limit  int64 // bytes per second
+}
+
+// ParseSchedule parses the windows with limits separated by ';'.
+func ParseSchedule(spec string) (Schedule, error) {
+	var s Schedule
+	for _, w := range strings.Split(spec, ";") {
+		if strings.TrimSpace(w) == "" {
+			continue
+		}
+		kv := strings.SplitN(w, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid schedule %q, it should be [DAYS ]HH:MM-HH:MM=Mbps", w)
+		}
+		window, err := jobs.ParseWindow(kv[0])
+		if err != nil {
+			return nil, err
+		}
+		v, err := strconv.ParseInt(strings.TrimSpace(kv[1]), 10, 64)
+		if err != nil || v < 0 {
+			return nil, fmt.Errorf("invalid limit in schedule %q", w)
+		}
+		s = append(s, scheduled{window, v * (1 << 20) / 8})
+	}
+	return s, nil
+}
+
+// LimitAt returns the limit in the first window containing t, or base if there is none.
+func (s Schedule) LimitAt(t time.Time, base int64) int64 {
+	for _, w := range s {
+		if w.window.Contains(t) {
+			return w.limit
+		}
+	}
+	return base
+}
+
+var (
+	schedules [numClasses]Schedule
+	keeping   sync.Once
+	now       = time.Now
+)
+
+// SetSchedules sets the schedules of classes, in the format of CLASS@SCHEDULE separated by ';',
+// for example: replication@mon-fri 09:00-18:00=10; replication@00:00-06:00=0. The limits set
+// by SetLimits apply out of the windows.
+func SetSchedules(spec string) error {
+	var parsed [numClasses]Schedule
+	for _, s := range strings.Split(spec, ";") {
+		if strings.TrimSpace(s) == "" {
+			continue
+		}
+		kv := strings.SplitN(s, "@", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("invalid schedule %q, it should be CLASS@[DAYS ]HH:MM-HH:MM=Mbps", s)
+		}
+		c, err := ParseClass(strings.TrimSpace(kv[0]))
+		if err != nil {
+			return err
+		}
+		sc, err := ParseSchedule(kv[1])
+		if err != nil {
+			return err
+		}
+		parsed[c] = append(parsed[c], sc...)
+	}
+	mu.Lock()
+	schedules = parsed
+	for c := Class(0); c < numClasses; c++ {
+		update(c)
+	}
+	mu.Unlock()
+	keeping.Do(func() { go keepSchedules() })
+	return nil
+}
+
+// keepSchedules updates the limits of classes when they enter or leave the windows.
+func keepSchedules() {
+	for range time.Tick(time.Minute) {
+		mu.Lock()
+		for c := Class(0); c < numClasses; c++ {
+			update(c)
+		}
+		mu.Unlock()
+	}
+}
@@ -0,0 +1,173 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package sync
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/object"
+)
+
+// checkpoint is saved into a file periodically, so an interrupted sync is resumed from Cursor,
+// all the keys up to it are synced.
+type checkpoint struct {
+	Src    string
+	Dst    string
+	End    string
+	Cursor string
+}
+
+// progress tracks the keys in flight, the sync can be resumed after the last key which all the
+// keys before it are done.
+type progress struct {
+	sync.Mutex
+	resumed string            // the cursor of checkpoint, it's synced already
+	last    string            // the last key handled by producer
+	pending map[string]string // the keys in flight -> the last key before them
+}
+
+var tracker *progress
+
+func newProgress(start string) *progress {
+	return &progress{last: start, pending: make(map[string]string)}
+}
+
+// add is called before the task of key is sent to workers.
+func (p *progress) add(key string) {
+	if p == nil {
+		return
+	}
+	p.Lock()
+	defer p.Unlock()
+	p.pending[key] = p.last
+	if key > p.last {
+		p.last = key
+	}
+}
+
+// handled is called after the producer decides what to do with key.
+func (p *progress) handled(key string) {
+	if p == nil {
+		return
+	}
+	p.Lock()
+	defer p.Unlock()
+	if key > p.last {
+		p.last = key
+	}
+}
+
+// done is called after the task of key is finished by worker.
+func (p *progress) done(key string) {
+	if p == nil {
+		return
+	}
+	p.Lock()
+	defer p.Unlock()
+	delete(p.pending, key)
+}
+
+func (p *progress) cursor() string {
+	p.Lock()
+	defer p.Unlock()
+	var first string
+	var found bool
+	for key := range p.pending {
+		if !found || key < first {
+			first, found = key, true
+		}
+	}
+	if found {
+		return p.pending[first]
+	}
+	return p.last
+}
+
+// loadCheckpoint starts the sync from the cursor of checkpoint, which is returned.
+func loadCheckpoint(path string, src, dst object.ObjectStorage, config *Config) string {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Warnf("read checkpoint %s: %s", path, err)
+		}
+		return ""
+	}
+	var cp checkpoint
+	if err = json.Unmarshal(data, &cp); err != nil {
+		logger.Warnf("invalid checkpoint %s: %s", path, err)
+		return ""
+	}
+	if cp.Src != src.String() || cp.Dst != dst.String() || cp.End != config.End {
+		logger.Warnf("checkpoint %s is not for syncing from %s to %s, ignore it", path, src, dst)
+		return ""
+	}
+	if cp.Cursor <= config.Start {
+		return ""
+	}
+	logger.Infof("Resume syncing after %q from checkpoint %s", cp.Cursor, path)
+	config.Start = cp.Cursor
+	return cp.Cursor
+}
+
+// skipResumed drops the object at the cursor of checkpoint, which is listed as the start key.
+func skipResumed(keys <-chan object.Object, cursor string) <-chan object.Object {
+	r := make(chan object.Object, maxResults)
+	go func() {
+		for o := range keys {
+			if o != nil && o.Key() == cursor {
+				continue
+			}
+			r <- o
+		}
+		close(r)
+	}()
+	return r
+}
+
+func saveCheckpoint(path string, src, dst object.ObjectStorage, config *Config) error {
+	data, err := json.Marshal(checkpoint{src.String(), dst.String(), config.End, tracker.cursor()})
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// keepCheckpoint saves the progress every interval until finished is closed, it stops saving after
+// any object is failed, so the failed ones are synced again when resumed.
+func keepCheckpoint(path string, src, dst object.ObjectStorage, config *Config, interval time.Duration, finished <-chan struct{}) {
+	for {
+		select {
+		case <-finished:
+			return
+		case <-time.After(interval):
+		}
+		if atomic.LoadInt64(&failed) > 0 {
+			continue
+		}
+		if err := saveCheckpoint(path, src, dst, config); err != nil {
+			logger.Warnf("save checkpoint %s: %s", path, err)
+		}
+	}
+}
@@ -23,9 +23,13 @@ type Config struct {
 	Start       string
 	End         string
 	Threads     int
+	ListThreads int
 	HTTPPort    int
 	Update      bool
 	ForceUpdate bool
+	Checksum    bool
+	Delta       bool
+	Sparse      bool
 	Perms       bool
 	Dry         bool
 	DeleteSrc   bool
@@ -33,12 +37,20 @@ type Config struct {
 	Dirs        bool
 	Exclude     []string
 	Include     []string
+	ExcludeFrom string
 	Manager     string
 	Workers     []string
 	BWLimit     int
+	BWSchedule  string
 	NoHTTPS     bool
 	Verbose     bool
 	Quiet       bool
+	Checkpoint  string
+
+	TwoWay       bool
+	Baseline     string
+	Conflict     string
+	ConflictHook string
 }
 
 func NewConfigFromCli(c *cli.Context) *Config {
@@ -46,8 +58,12 @@ func NewConfigFromCli(c *cli.Context) *Config {
 		Start:       c.String("start"),
 		End:         c.String("end"),
 		Threads:     c.Int("threads"),
+		ListThreads: c.Int("list-threads"),
 		Update:      c.Bool("update"),
 		ForceUpdate: c.Bool("force-update"),
+		Checksum:    c.Bool("checksum"),
+		Delta:       c.Bool("delta"),
+		Sparse:      c.Bool("sparse"),
 		Perms:       c.Bool("perms"),
 		Dirs:        c.Bool("dirs"),
 		Dry:         c.Bool("dry"),
@@ -55,11 +71,19 @@ func NewConfigFromCli(c *cli.Context) *Config {
 		DeleteDst:   c.Bool("delete-dst"),
 		Exclude:     c.StringSlice("exclude"),
 		Include:     c.StringSlice("include"),
+		ExcludeFrom: c.String("exclude-from"),
 		Workers:     c.StringSlice("worker"),
 		Manager:     c.String("manager"),
 		BWLimit:     c.Int("bwlimit"),
+		BWSchedule:  c.String("bwlimit-schedule"),
 		NoHTTPS:     c.Bool("no-https"),
 		Verbose:     c.Bool("verbose"),
 		Quiet:       c.Bool("quiet"),
+		Checkpoint:  c.String("checkpoint"),
+
+		TwoWay:       c.Bool("two-way"),
+		Baseline:     c.String("baseline"),
+		Conflict:     c.String("conflict"),
+		ConflictHook: c.String("conflict-hook"),
 	}
 }
@@ -0,0 +1,151 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package sync
+
+import (
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+)
+
+// ignoreRule is a pattern in the file of --exclude-from, which has the same semantics as .gitignore:
+//
+//	# comment          blank lines and the ones starting with '#' are skipped
+//	*.log              matched at any level, '*' and '?' don't match '/'
+//	/build             anchored to the root, so are the ones with '/' in the middle
+//	tmp/               matches directories only, the keys under them are excluded
+//	logs/**/debug      '**' matches any number of directories
+//	!important.log     re-includes the keys excluded by previous patterns
+//
+// The last matched pattern wins, and a key can't be re-included if its parent directory is excluded.
+type ignoreRule struct {
+	re      *regexp.Regexp
+	negate  bool
+	dirOnly bool
+}
+
+type ignoreRules []*ignoreRule
+
+var ignores ignoreRules
+
+func loadIgnoreFile(path string) (ignoreRules, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseIgnore(strings.Split(string(data), "\n"))
+}
+
+func parseIgnore(lines []string) (ignoreRules, error) {
+	var rs ignoreRules
+	for i, line := range lines {
+		line = strings.TrimRight(line, " \t\r")
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		r := &ignoreRule{}
+		if line[0] == '!' {
+			r.negate = true
+			line = line[1:]
+		} else if strings.HasPrefix(line, `\#`) || strings.HasPrefix(line, `\!`) {
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			r.dirOnly = true
+			line = strings.TrimRight(line, "/")
+		}
+		if line == "" {
+			continue
+		}
+		re, err := regexp.Compile(ignoreRegexp(line))
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %q at line %d: %s", lines[i], i+1, err)
+		}
+		r.re = re
+		rs = append(rs, r)
+	}
+	return rs, nil
+}
+
+// ignoreRegexp translates a pattern into regular expression, which matches the whole path.
+func ignoreRegexp(p string) string {
+	var b strings.Builder
+	b.WriteString("^")
+	if !strings.Contains(p, "/") {
+		b.WriteString("(.*/)?")
+	}
+	p = strings.TrimPrefix(p, "/")
+	for i := 0; i < len(p); i++ {
+		switch c := p[i]; {
+		case strings.HasPrefix(p[i:], "**/"):
+			b.WriteString("(.*/)?")
+			i += 2
+		case strings.HasPrefix(p[i:], "**"):
+			b.WriteString(".*")
+			i++
+		case c == '*':
+			b.WriteString("[^/]*")
+		case c == '?':
+			b.WriteString("[^/]")
+		case c == '[':
+			j := strings.IndexByte(p[i+1:], ']')
+			if j < 0 {
+				b.WriteString(`\[`)
+				continue
+			}
+			class := p[i+1 : i+1+j]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + class + "]")
+			i += j + 1
+		case c == '\\' && i+1 < len(p):
+			b.WriteString(regexp.QuoteMeta(p[i+1 : i+2]))
+			i++
+		default:
+			b.WriteString(regexp.QuoteMeta(p[i : i+1]))
+		}
+	}
+	b.WriteString("$")
+	return b.String()
+}
+
+// match returns whether the path is excluded by the last matched rule.
+func (rs ignoreRules) match(path string, isDir bool) bool {
+	for i := len(rs) - 1; i >= 0; i-- {
+		r := rs[i]
+		if r.dirOnly && !isDir {
+			continue
+		}
+		if r.re.MatchString(path) {
+			return !r.negate
+		}
+	}
+	return false
+}
+
+// ignored returns whether a key (directories end with '/') or any of its parents is excluded.
+func (rs ignoreRules) ignored(key string) bool {
+	for i := 0; i < len(key)-1; i++ {
+		if key[i] == '/' {
+			if rs.match(key[:i], true) {
+				return true
+			}
+		}
+	}
+	return rs.match(strings.TrimSuffix(key, "/"), strings.HasSuffix(key, "/"))
+}
@@ -0,0 +1,52 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package sync
+
+import (
+	"sync/atomic"
+
+	"github.com/juicedata/juicefs/pkg/object"
+)
+
+// plan summarizes the changes to be made, which is reported in dry run.
+type plan struct {
+	added, addedBytes     int64 // the keys not in destination
+	updated, updatedBytes int64 // the keys in destination but different
+	deleteSrc, deleteDst  int64
+	perms                 int64
+}
+
+var planned plan
+
+func (p *plan) add(size int64) {
+	atomic.AddInt64(&p.added, 1)
+	atomic.AddInt64(&p.addedBytes, size)
+}
+
+func (p *plan) update(size int64) {
+	atomic.AddInt64(&p.updated, 1)
+	atomic.AddInt64(&p.updatedBytes, size)
+}
+
+func (p *plan) report(src, dst object.ObjectStorage) {
+	logger.Infof("Changes from %s to %s:", src, dst)
+	logger.Infof("  add:    %d (%s)", atomic.LoadInt64(&p.added), formatSize(uint64(atomic.LoadInt64(&p.addedBytes))))
+	logger.Infof("  update: %d (%s)", atomic.LoadInt64(&p.updated), formatSize(uint64(atomic.LoadInt64(&p.updatedBytes))))
+	logger.Infof("  delete: %d from %s, %d from %s", atomic.LoadInt64(&p.deleteSrc), src, atomic.LoadInt64(&p.deleteDst), dst)
+	if n := atomic.LoadInt64(&p.perms); n > 0 {
+		logger.Infof("  permissions: %d", n)
+	}
+}
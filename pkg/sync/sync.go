@@ -17,6 +17,8 @@ package sync
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -28,6 +30,7 @@ import (
 	"time"
 
 	"github.com/juicedata/juicefs/pkg/object"
+	"github.com/juicedata/juicefs/pkg/qos"
 	"github.com/juicedata/juicefs/pkg/utils"
 	"github.com/juju/ratelimit"
 	"github.com/mattn/go-isatty"
@@ -38,8 +41,11 @@ const (
 	maxResults      = 10240
 	defaultPartSize = 5 << 20
 	maxBlock        = defaultPartSize * 2
-	markDelete      = -1
-	markCopyPerms   = -2
+	markDeleteSrc   = -1
+	markDeleteDst   = -2
+	markCopyPerms   = -3
+	markChecksum    = -4
+	deltaBlock      = 4 << 20 // the block size of JuiceFS
 )
 
 var (
@@ -164,6 +170,32 @@ func ListAll(store object.ObjectStorage, start, end string) (<-chan object.Objec
 	return out, nil
 }
 
+// ListAllParallel is like ListAll, but lists the partitions of the keyspace by `threads` concurrently.
+func ListAllParallel(store object.ObjectStorage, start, end string, threads int) (<-chan object.Object, error) {
+	if threads <= 1 {
+		return ListAll(store, start, end)
+	}
+	ch, err := object.ListAllParallel(store, "", start, end, threads)
+	if err != nil {
+		logger.Debugf("Can't list %s in parallel: %s", store, err)
+		return ListAll(store, start, end)
+	}
+	if start == "" {
+		return ch, nil
+	}
+	out := make(chan object.Object, maxResults)
+	if obj, err := store.Head(start); err == nil {
+		out <- obj
+	}
+	go func() {
+		for obj := range ch {
+			out <- obj
+		}
+		close(out)
+	}()
+	return out, nil
+}
+
 var bufPool = sync.Pool{
 	New: func() interface{} {
 		buf := make([]byte, 32<<10)
@@ -171,9 +203,41 @@ var bufPool = sync.Pool{
 	},
 }
 
+var limiterMu sync.Mutex
+
+func getLimiter() *ratelimit.Bucket {
+	limiterMu.Lock()
+	defer limiterMu.Unlock()
+	return limiter
+}
+
+// setBandwidth limits the bandwidth in bytes per second, 0 means unlimited.
+func setBandwidth(bps int64) {
+	limiterMu.Lock()
+	defer limiterMu.Unlock()
+	if bps > 0 {
+		rate := float64(bps) * 0.85 // 15% overhead
+		limiter = ratelimit.NewBucketWithRate(rate, int64(rate)*3)
+	} else {
+		limiter = nil
+	}
+}
+
+// keepBandwidth changes the bandwidth limit when it enters or leaves the windows of schedule.
+func keepBandwidth(schedule qos.Schedule, base int64) {
+	last := schedule.LimitAt(time.Now(), base)
+	for range time.Tick(time.Minute) {
+		if bps := schedule.LimitAt(time.Now(), base); bps != last {
+			logger.Infof("Bandwidth limit is changed to %s/s", formatSize(uint64(bps)))
+			setBandwidth(bps)
+			last = bps
+		}
+	}
+}
+
 func copyObject(src, dst object.ObjectStorage, obj object.Object) error {
-	if limiter != nil {
-		limiter.Wait(obj.Size())
+	if l := getLimiter(); l != nil {
+		l.Wait(obj.Size())
 	}
 	concurrent <- 1
 	defer func() {
@@ -281,8 +345,8 @@ func copyInParallel(src, dst object.ObjectStorage, obj object.Object) error {
 				sz = obj.Size() - int64(num)*partSize
 			}
 			var err error
-			if limiter != nil {
-				limiter.Wait(sz)
+			if l := getLimiter(); l != nil {
+				l.Wait(sz)
 			}
 			concurrent <- 1
 			defer func() {
@@ -330,46 +394,56 @@ func copyInParallel(src, dst object.ObjectStorage, obj object.Object) error {
 	return nil
 }
 
-func worker(todo chan object.Object, src, dst object.ObjectStorage, config *Config) {
+func worker(tasks chan object.Object, src, dst object.ObjectStorage, config *Config) {
+	var last object.Object
 	for {
-		obj, ok := <-todo
+		if last != nil {
+			tracker.done(last.Key())
+		}
+		obj, ok := <-tasks
 		if !ok {
 			break
 		}
+		last = obj
 		start := time.Now()
 		var err error
-		if obj.Size() == markDelete {
-			if config.DeleteSrc {
-				if config.Dry {
-					logger.Debugf("Will delete %s from %s", obj.Key(), src)
-					continue
-				}
-				if err = try(3, func() error {
-					return src.Delete(obj.Key())
-				}); err == nil {
-					logger.Debugf("Deleted %s from %s", obj.Key(), src)
-					atomic.AddInt64(&deleted, 1)
-				} else {
-					logger.Errorf("Failed to delete %s from %s: %s", obj.Key(), src, err.Error())
-					atomic.AddInt64(&failed, 1)
-				}
+		switch obj.Size() {
+		case markDeleteSrc:
+			deleteObject(src, obj.Key(), config.Dry)
+			continue
+		case markDeleteDst:
+			deleteObject(dst, obj.Key(), config.Dry)
+			continue
+		}
+		if obj.Size() == markChecksum {
+			if o, ok := obj.(*withSize); ok {
+				obj = o.Object
+			} else if obj, err = src.Head(obj.Key()); err != nil { // from manager
+				atomic.AddInt64(&failed, 1)
+				logger.Errorf("Failed to head %s: %s", last.Key(), err)
+				continue
 			}
-			if config.DeleteDst {
-				if config.Dry {
-					logger.Debugf("Will delete %s from %s", obj.Key(), dst)
-					continue
-				}
-				if err = try(3, func() error {
-					return dst.Delete(obj.Key())
-				}); err == nil {
-					logger.Debugf("Deleted %s from %s", obj.Key(), dst)
-					atomic.AddInt64(&deleted, 1)
-				} else {
-					logger.Errorf("Failed to delete %s from %s: %s", obj.Key(), dst, err.Error())
-					atomic.AddInt64(&failed, 1)
+			same, err := sameContent(src, dst, obj.Key())
+			if err != nil {
+				atomic.AddInt64(&failed, 1)
+				logger.Errorf("Failed to compare %s: %s", obj.Key(), err)
+				continue
+			}
+			if same {
+				atomic.AddInt64(&todo, -1)
+				logger.Debugf("%s is not changed", obj.Key())
+				if config.DeleteSrc {
+					atomic.AddInt64(&planned.deleteSrc, 1)
+					deleteObject(src, obj.Key(), config.Dry)
+				} else if config.Perms && !config.Dry {
+					copyPerms(dst, obj)
 				}
+				continue
+			}
+			planned.update(obj.Size())
+			if config.DeleteSrc {
+				atomic.AddInt64(&planned.deleteSrc, 1)
 			}
-			continue
 		}
 
 		if config.Dry {
@@ -378,17 +452,19 @@ func worker(todo chan object.Object, src, dst object.ObjectStorage, config *Conf
 		}
 		if config.Perms && obj.Size() == markCopyPerms {
 			fi := obj.(object.File)
-			if err := dst.(object.FileSystem).Chmod(obj.Key(), fi.Mode()); err != nil {
-				logger.Warnf("Chmod %s to %d: %s", obj.Key(), fi.Mode(), err)
-			}
-			if err := dst.(object.FileSystem).Chown(obj.Key(), fi.Owner(), fi.Group()); err != nil {
-				logger.Warnf("Chown %s to (%s,%s): %s", obj.Key(), fi.Owner(), fi.Group(), err)
-			}
+			copyPerms(dst, fi)
 			atomic.AddInt64(&copied, 1)
 			logger.Debugf("Copied permissions (%s:%s:%s) for %s in %s", fi.Owner(), fi.Group(), fi.Mode(), obj.Key(), time.Since(start))
 			continue
 		}
-		err = copyInParallel(src, dst, obj)
+		written := obj.Size()
+		if dsize := deltaSize(dst, obj, config); dsize >= 0 {
+			written, err = copyDelta(src, dst, obj, dsize)
+		} else if exts, ok := sparseExtents(src, dst, obj, config); ok {
+			written, err = copySparse(src, dst, obj, exts)
+		} else {
+			err = copyInParallel(src, dst, obj)
+		}
 		if err != nil {
 			atomic.AddInt64(&failed, 1)
 			logger.Errorf("Failed to copy %s: %s", obj.Key(), err.Error())
@@ -400,19 +476,223 @@ func worker(todo chan object.Object, src, dst object.ObjectStorage, config *Conf
 				}
 			}
 			if config.Perms {
-				fi := obj.(object.File)
-				if err := dst.(object.FileSystem).Chmod(obj.Key(), fi.Mode()); err != nil {
-					logger.Warnf("Chmod %s to %o: %s", obj.Key(), fi.Mode(), err)
-				}
-				if err := dst.(object.FileSystem).Chown(obj.Key(), fi.Owner(), fi.Group()); err != nil {
-					logger.Warnf("Chown %s to (%s,%s): %s", obj.Key(), fi.Owner(), fi.Group(), err)
-				}
+				copyPerms(dst, obj)
 			}
 			atomic.AddInt64(&copied, 1)
-			atomic.AddInt64(&copiedBytes, int64(obj.Size()))
-			logger.Debugf("Copied %s (%d bytes) in %s", obj.Key(), obj.Size(), time.Since(start))
+			atomic.AddInt64(&copiedBytes, written)
+			logger.Debugf("Copied %s (%d bytes, %d written) in %s", obj.Key(), obj.Size(), written, time.Since(start))
+			if config.DeleteSrc && !obj.IsDir() {
+				deleteObject(src, obj.Key(), false)
+			}
+		}
+	}
+}
+
+// deltaSize returns the size of the existing object in destination, which could be updated in place,
+// or -1 if it should be copied as a whole.
+func deltaSize(dst object.ObjectStorage, obj object.Object, config *Config) int64 {
+	if !config.Delta || obj.IsDir() {
+		return -1
+	}
+	if _, ok := dst.(object.RangeWriter); !ok {
+		return -1
+	}
+	dobj, err := dst.Head(obj.Key())
+	if err != nil || dobj.IsDir() {
+		return -1
+	}
+	return dobj.Size()
+}
+
+// copyDelta compares an object with the existing one in destination block by block, only the changed
+// blocks are written. It returns the number of bytes written.
+func copyDelta(src, dst object.ObjectStorage, obj object.Object, dsize int64) (int64, error) {
+	concurrent <- 1
+	defer func() {
+		<-concurrent
+	}()
+	key := obj.Key()
+	in, err := src.Get(key, 0, -1)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+	old, err := dst.Get(key, 0, -1)
+	if err != nil {
+		return 0, err
+	}
+	defer old.Close()
+
+	rw := dst.(object.RangeWriter)
+	size := obj.Size()
+	buf := make([]byte, deltaBlock)
+	obuf := make([]byte, deltaBlock)
+	var written int64
+	for off := int64(0); off < size; off += deltaBlock {
+		n := size - off
+		if n > deltaBlock {
+			n = deltaBlock
+		}
+		if _, err = io.ReadFull(in, buf[:n]); err != nil {
+			return written, fmt.Errorf("read %s at %d: %s", key, off, err)
+		}
+		if off+n <= dsize {
+			if _, err = io.ReadFull(old, obuf[:n]); err != nil {
+				return written, fmt.Errorf("read %s from %s at %d: %s", key, dst, off, err)
+			}
+			if bytes.Equal(buf[:n], obuf[:n]) {
+				continue
+			}
+		}
+		if l := getLimiter(); l != nil {
+			l.Wait(n)
+		}
+		if err = rw.WriteAt(key, off, buf[:n]); err != nil {
+			return written, err
+		}
+		written += n
+	}
+	if dsize != size {
+		err = rw.Truncate(key, size)
+	}
+	return written, err
+}
+
+// sparseExtents returns the ranges which have data in a sparse object, it returns false if the
+// object has no holes or it can't be copied as a sparse file.
+func sparseExtents(src, dst object.ObjectStorage, obj object.Object, config *Config) ([]object.Extent, bool) {
+	if !config.Sparse || obj.IsDir() || obj.Size() == 0 {
+		return nil, false
+	}
+	sr, ok := src.(object.SparseReader)
+	if !ok {
+		return nil, false
+	}
+	if _, ok = dst.(object.RangeWriter); !ok {
+		return nil, false
+	}
+	exts, err := sr.Extents(obj.Key())
+	if err != nil {
+		logger.Debugf("Find the holes of %s: %s", obj.Key(), err)
+		return nil, false
+	}
+	var n int64
+	for _, e := range exts {
+		n += e.Len
+	}
+	return exts, n < obj.Size()
+}
+
+// copySparse creates a sparse file in destination with the ranges which have data, and the zero
+// blocks in them are skipped too. It returns the number of bytes written.
+func copySparse(src, dst object.ObjectStorage, obj object.Object, exts []object.Extent) (int64, error) {
+	concurrent <- 1
+	defer func() {
+		<-concurrent
+	}()
+	key := obj.Key()
+	if err := dst.Put(key, bytes.NewReader(nil)); err != nil {
+		return 0, err
+	}
+	rw := dst.(object.RangeWriter)
+	size := obj.Size()
+	if err := rw.Truncate(key, size); err != nil {
+		return 0, err
+	}
+	buf := make([]byte, deltaBlock)
+	var written int64
+	for _, e := range exts {
+		end := e.Off + e.Len
+		if end > size {
+			end = size
+		}
+		if e.Off >= end {
+			continue
+		}
+		in, err := src.Get(key, e.Off, end-e.Off)
+		if err != nil {
+			return written, err
+		}
+		for off := e.Off; off < end; off += deltaBlock {
+			n := end - off
+			if n > deltaBlock {
+				n = deltaBlock
+			}
+			if _, err = io.ReadFull(in, buf[:n]); err != nil {
+				err = fmt.Errorf("read %s at %d: %s", key, off, err)
+				break
+			}
+			if isZero(buf[:n]) {
+				continue
+			}
+			if l := getLimiter(); l != nil {
+				l.Wait(n)
+			}
+			if err = rw.WriteAt(key, off, buf[:n]); err != nil {
+				break
+			}
+			written += n
+		}
+		in.Close()
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+func isZero(buf []byte) bool {
+	for _, b := range buf {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func copyPerms(dst object.ObjectStorage, obj object.Object) {
+	fi := obj.(object.File)
+	if err := dst.(object.FileSystem).Chmod(obj.Key(), fi.Mode()); err != nil {
+		logger.Warnf("Chmod %s to %o: %s", obj.Key(), fi.Mode(), err)
+	}
+	if err := dst.(object.FileSystem).Chown(obj.Key(), fi.Owner(), fi.Group()); err != nil {
+		logger.Warnf("Chown %s to (%s,%s): %s", obj.Key(), fi.Owner(), fi.Group(), err)
+	}
+}
+
+// checksum returns the SHA256 of an object, which is kept by the storage or computed from the content.
+func checksum(store object.ObjectStorage, key string) (string, error) {
+	if c, ok := store.(object.Checksummer); ok {
+		if sum, err := c.Checksum(key); err == nil && sum != "" {
+			return sum, nil
 		}
 	}
+	in, err := store.Get(key, 0, -1)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+	var r io.Reader = in
+	if l := getLimiter(); l != nil {
+		r = ratelimit.Reader(in, l)
+	}
+	h := sha256.New()
+	if _, err = io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return "sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func sameContent(src, dst object.ObjectStorage, key string) (bool, error) {
+	sum1, err := checksum(src, key)
+	if err != nil {
+		return false, fmt.Errorf("checksum of %s in %s: %s", key, src, err)
+	}
+	sum2, err := checksum(dst, key)
+	if err != nil {
+		return false, fmt.Errorf("checksum of %s in %s: %s", key, dst, err)
+	}
+	return sum1 == sum2, nil
 }
 
 type withSize struct {
@@ -433,8 +713,25 @@ func (o *withFSize) Size() int64 {
 	return o.nsize
 }
 
+// deleteObject deletes a key from store, or just logs it in dry run.
+func deleteObject(store object.ObjectStorage, key string, dry bool) {
+	if dry {
+		logger.Debugf("Will delete %s from %s", key, store)
+		return
+	}
+	if err := try(3, func() error { return store.Delete(key) }); err == nil {
+		logger.Debugf("Deleted %s from %s", key, store)
+		atomic.AddInt64(&deleted, 1)
+	} else {
+		logger.Errorf("Failed to delete %s from %s: %s", key, store, err.Error())
+		atomic.AddInt64(&failed, 1)
+	}
+}
+
 func deleteFromDst(tasks chan object.Object, dstobj object.Object) {
-	tasks <- &withSize{dstobj, markDelete}
+	tracker.add(dstobj.Key())
+	atomic.AddInt64(&planned.deleteDst, 1)
+	tasks <- &withSize{dstobj, markDeleteDst}
 	atomic.AddInt64(&found, 1)
 	atomic.AddInt64(&todo, 1)
 }
@@ -450,16 +747,20 @@ func producer(tasks chan object.Object, src, dst object.ObjectStorage, config *C
 	}
 	logger.Debugf("maxResults: %d, defaultPartSize: %d, maxBlock: %d", maxResults, defaultPartSize, maxBlock)
 
-	srckeys, err := ListAll(src, start, end)
+	srckeys, err := ListAllParallel(src, start, end, config.ListThreads)
 	if err != nil {
 		logger.Fatal(err)
 	}
 
-	dstkeys, err := ListAll(dst, start, end)
+	dstkeys, err := ListAllParallel(dst, start, end, config.ListThreads)
 	if err != nil {
 		logger.Fatal(err)
 	}
-	if config.Exclude != nil {
+	if tracker != nil && tracker.resumed != "" {
+		srckeys = skipResumed(srckeys, tracker.resumed)
+		dstkeys = skipResumed(dstkeys, tracker.resumed)
+	}
+	if config.Exclude != nil || ignores != nil {
 		srckeys = filter(srckeys, config.Include, config.Exclude)
 		dstkeys = filter(dstkeys, config.Include, config.Exclude)
 	}
@@ -503,19 +804,37 @@ OUT:
 		if !hasMore || obj.Key() < dstobj.Key() ||
 			obj.Key() == dstobj.Key() && (config.ForceUpdate || obj.Size() != dstobj.Size() ||
 				config.Update && obj.Mtime().After(dstobj.Mtime())) {
+			tracker.add(obj.Key())
+			if !hasMore || obj.Key() < dstobj.Key() {
+				planned.add(obj.Size())
+			} else {
+				planned.update(obj.Size())
+			}
+			if config.DeleteSrc {
+				atomic.AddInt64(&planned.deleteSrc, 1)
+			}
 			tasks <- obj
 			atomic.AddInt64(&todo, 1)
+		} else if config.Checksum && obj.Key() == dstobj.Key() && !obj.IsDir() {
+			tracker.add(obj.Key())
+			tasks <- &withSize{obj, markChecksum}
+			atomic.AddInt64(&todo, 1)
 		} else if config.DeleteSrc && dstobj != nil && obj.Key() == dstobj.Key() && obj.Size() == dstobj.Size() {
-			tasks <- &withSize{obj, markDelete}
+			tracker.add(obj.Key())
+			atomic.AddInt64(&planned.deleteSrc, 1)
+			tasks <- &withSize{obj, markDeleteSrc}
 			atomic.AddInt64(&todo, 1)
 		} else if config.Perms {
 			f1 := obj.(object.File)
 			f2 := dstobj.(object.File)
 			if f2.Mode() != f1.Mode() || f2.Owner() != f1.Owner() || f2.Group() != f1.Group() {
+				tracker.add(obj.Key())
+				atomic.AddInt64(&planned.perms, 1)
 				tasks <- &withFSize{f1, markCopyPerms}
 				atomic.AddInt64(&todo, 1)
 			}
 		}
+		tracker.handled(obj.Key())
 		if dstobj != nil && dstobj.Key() == obj.Key() {
 			dstobj = nil
 		}
@@ -606,7 +925,7 @@ func filter(keys <-chan object.Object, include, exclude []string) <-chan object.
 			if o == nil {
 				break
 			}
-			if findAny(o.Key(), exc) {
+			if findAny(o.Key(), exc) || ignores.ignored(o.Key()) {
 				logger.Debugf("exclude %s", o.Key())
 				continue
 			}
@@ -630,9 +949,26 @@ func Sync(src, dst object.ObjectStorage, config *Config) error {
 	todo := make(chan object.Object, bufferSize)
 	wg := sync.WaitGroup{}
 	concurrent = make(chan int, config.Threads)
-	if config.BWLimit > 0 {
-		bps := float64(config.BWLimit*(1<<20)/8) * 0.85 // 15% overhead
-		limiter = ratelimit.NewBucketWithRate(bps, int64(bps)*3)
+	planned = plan{}
+	ignores = nil
+	if config.ExcludeFrom != "" {
+		var err error
+		if ignores, err = loadIgnoreFile(config.ExcludeFrom); err != nil {
+			return fmt.Errorf("load patterns from %s: %s", config.ExcludeFrom, err)
+		}
+	}
+	base := int64(config.BWLimit) * (1 << 20) / 8
+	setBandwidth(base)
+	if config.BWSchedule != "" {
+		schedule, err := qos.ParseSchedule(config.BWSchedule)
+		if err != nil {
+			return fmt.Errorf("bandwidth schedule: %s", err)
+		}
+		setBandwidth(schedule.LimitAt(time.Now(), base))
+		go keepBandwidth(schedule, base)
+	}
+	if config.TwoWay {
+		return syncTwoWay(src, dst, config)
 	}
 	for i := 0; i < config.Threads; i++ {
 		wg.Add(1)
@@ -642,6 +978,23 @@ func Sync(src, dst object.ObjectStorage, config *Config) error {
 		}()
 	}
 
+	tracker = nil
+	var finished, saved chan struct{}
+	if config.Checkpoint != "" {
+		if config.Manager != "" || config.Workers != nil {
+			logger.Warnf("Checkpoint is not supported in distributed mode")
+		} else {
+			resumed := loadCheckpoint(config.Checkpoint, src, dst, config)
+			tracker = newProgress(config.Start)
+			tracker.resumed = resumed
+			finished, saved = make(chan struct{}), make(chan struct{})
+			go func() {
+				keepCheckpoint(config.Checkpoint, src, dst, config, time.Second*10, finished)
+				close(saved)
+			}()
+		}
+	}
+
 	if config.Manager == "" {
 		go producer(todo, src, dst, config)
 		tty := isatty.IsTerminal(os.Stdout.Fd())
@@ -667,10 +1020,22 @@ func Sync(src, dst object.ObjectStorage, config *Config) error {
 	}
 
 	wg.Wait()
+	if finished != nil {
+		close(finished)
+		<-saved
+		if failed == 0 {
+			_ = os.Remove(config.Checkpoint)
+		} else {
+			logger.Infof("Run it again to resume from checkpoint %s", config.Checkpoint)
+		}
+	}
 
 	if failed > 0 {
 		return fmt.Errorf("Failed to copy %d objects", failed)
 	}
+	if config.Dry && config.Manager == "" {
+		planned.report(src, dst)
+	}
 	if config.Manager == "" {
 		logger.Infof("Found: %d, copied: %d, deleted: %d, failed: %d, transferred: %s", found, copied, deleted, failed, formatSize(uint64(copiedBytes)))
 	} else {
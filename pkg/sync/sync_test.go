@@ -16,8 +16,13 @@ package sync
 
 import (
 	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/juicedata/juicefs/pkg/object"
 )
@@ -161,3 +166,283 @@ func TestSync(t *testing.T) {
 		t.FailNow()
 	}
 }
+
+func TestProgress(t *testing.T) {
+	p := newProgress("")
+	p.add("a")
+	p.handled("a")
+	p.handled("b")
+	p.add("c")
+	p.handled("c")
+	if c := p.cursor(); c != "" {
+		t.Fatalf("cursor should be empty, but got %q", c)
+	}
+	p.done("a")
+	if c := p.cursor(); c != "b" {
+		t.Fatalf("cursor should be b, but got %q", c)
+	}
+	p.done("c")
+	if c := p.cursor(); c != "c" {
+		t.Fatalf("cursor should be c, but got %q", c)
+	}
+}
+
+// nolint:errcheck
+func TestSyncCheckpoint(t *testing.T) {
+	a, _ := object.CreateStorage("mem", "ck-a", "", "")
+	a.Put("a", bytes.NewReader([]byte("a")))
+	a.Put("b", bytes.NewReader([]byte("b")))
+	a.Put("c", bytes.NewReader([]byte("c")))
+	b, _ := object.CreateStorage("mem", "ck-b", "", "")
+
+	path := filepath.Join(t.TempDir(), "sync.json")
+	config := &Config{Threads: 10, Checkpoint: path}
+	tracker = newProgress("a")
+	failed = 0 // left by other tests
+	if err := saveCheckpoint(path, a, b, config); err != nil {
+		t.Fatalf("save checkpoint: %s", err)
+	}
+	if err := Sync(a, b, config); err != nil {
+		t.Fatalf("sync: %s", err)
+	}
+	if keys := collectAll(mustList(t, b)); !reflect.DeepEqual(keys, []string{"b", "c"}) {
+		t.Fatalf("should resume after a, but got %v", keys)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("checkpoint should be removed after finished: %s", err)
+	}
+}
+
+func mustList(t *testing.T, s object.ObjectStorage) <-chan object.Object {
+	ch, err := ListAll(s, "", "")
+	if err != nil {
+		t.Fatalf("list %s: %s", s, err)
+	}
+	return ch
+}
+
+// nolint:errcheck
+func TestSyncChecksum(t *testing.T) {
+	a, _ := object.CreateStorage("file", t.TempDir()+"/", "", "")
+	a.Put("x", bytes.NewReader([]byte("abc")))
+	a.Put("y", bytes.NewReader([]byte("abc")))
+	b, _ := object.CreateStorage("file", t.TempDir()+"/", "", "")
+	b.Put("x", bytes.NewReader([]byte("abc")))
+	b.Put("y", bytes.NewReader([]byte("abd")))
+
+	config := &Config{Threads: 10, Checksum: true}
+	failed = 0 // left by other tests
+	before := copied
+	if err := Sync(a, b, config); err != nil {
+		t.Fatalf("sync: %s", err)
+	}
+	if copied-before != 1 {
+		t.Fatalf("should copy 1 key with different content, but got %d", copied-before)
+	}
+	in, err := b.Get("y", 0, -1)
+	if err != nil {
+		t.Fatalf("get y: %s", err)
+	}
+	defer in.Close()
+	if data, _ := ioutil.ReadAll(in); string(data) != "abc" {
+		t.Fatalf("y should be updated, but got %q", data)
+	}
+}
+
+// nolint:errcheck
+func TestSyncDelta(t *testing.T) {
+	data := make([]byte, 9<<20)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	a, _ := object.CreateStorage("file", t.TempDir()+"/", "", "")
+	a.Put("x", bytes.NewReader(data))
+	a.Put("y", bytes.NewReader(data))
+	b, _ := object.CreateStorage("file", t.TempDir()+"/", "", "")
+	changed := append([]byte{}, data...)
+	changed[5<<20] = 0xFF
+	b.Put("x", bytes.NewReader(changed))
+	b.Put("y", bytes.NewReader(data[:6<<20]))
+
+	config := &Config{Threads: 10, ForceUpdate: true, Delta: true}
+	failed = 0 // left by other tests
+	before := copiedBytes
+	if err := Sync(a, b, config); err != nil {
+		t.Fatalf("sync: %s", err)
+	}
+	// x: the second block, y: the second and third blocks
+	if written := copiedBytes - before; written != 4<<20+5<<20 {
+		t.Fatalf("should write %d bytes, but got %d", 9<<20, written)
+	}
+	for _, key := range []string{"x", "y"} {
+		in, err := b.Get(key, 0, -1)
+		if err != nil {
+			t.Fatalf("get %s: %s", key, err)
+		}
+		if d, _ := ioutil.ReadAll(in); !bytes.Equal(d, data) {
+			t.Fatalf("%s is not synced", key)
+		}
+		in.Close()
+	}
+}
+
+func TestSyncSparse(t *testing.T) {
+	adir := t.TempDir()
+	f, err := os.Create(filepath.Join(adir, "x"))
+	if err != nil {
+		t.Fatalf("create: %s", err)
+	}
+	data := make([]byte, 1<<20)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	_, _ = f.Write(make([]byte, 4<<20)) // zeros
+	_, _ = f.WriteAt(data, 8<<20)
+	_ = f.Truncate(20 << 20)
+	f.Close()
+	a, _ := object.CreateStorage("file", adir+"/", "", "")
+	b, _ := object.CreateStorage("file", t.TempDir()+"/", "", "")
+
+	failed = 0 // left by other tests
+	before := copiedBytes
+	if err := Sync(a, b, &Config{Threads: 10, Update: true, Sparse: true}); err != nil {
+		t.Fatalf("sync: %s", err)
+	}
+	if written := copiedBytes - before; written != 1<<20 {
+		t.Fatalf("should write %d bytes, but got %d", 1<<20, written)
+	}
+	in, err := b.Get("x", 0, -1)
+	if err != nil {
+		t.Fatalf("get x: %s", err)
+	}
+	defer in.Close()
+	expected := make([]byte, 20<<20)
+	copy(expected[8<<20:], data)
+	if d, _ := ioutil.ReadAll(in); !bytes.Equal(d, expected) {
+		t.Fatalf("x is not synced")
+	}
+}
+
+// nolint:errcheck
+func TestSyncTwoWay(t *testing.T) {
+	a, _ := object.CreateStorage("file", t.TempDir()+"/", "", "")
+	b, _ := object.CreateStorage("file", t.TempDir()+"/", "", "")
+	a.Put("x", bytes.NewReader([]byte("x")))
+	a.Put("w", bytes.NewReader([]byte("w")))
+	b.Put("y", bytes.NewReader([]byte("y")))
+
+	path := filepath.Join(t.TempDir(), "baseline.json")
+	config := &Config{Threads: 10, TwoWay: true, Baseline: path, Conflict: ConflictNewer}
+	failed = 0 // left by other tests
+	if err := Sync(a, b, config); err != nil {
+		t.Fatalf("sync: %s", err)
+	}
+	for _, s := range []object.ObjectStorage{a, b} {
+		if keys := collectAll(mustList(t, s)); !reflect.DeepEqual(keys, []string{"", "w", "x", "y"}) {
+			t.Fatalf("keys in %s: %v", s, keys)
+		}
+	}
+
+	a.Put("x", bytes.NewReader([]byte("xx")))
+	b.Delete("y")
+	b.Put("z", bytes.NewReader([]byte("z")))
+	a.Put("w", bytes.NewReader([]byte("w1")))
+	b.Put("w", bytes.NewReader([]byte("w22")))
+	now := time.Now()
+	a.(object.MtimeChanger).Chtimes("w", now.Add(-time.Minute))
+	b.(object.MtimeChanger).Chtimes("w", now)
+	if err := Sync(a, b, config); err != nil {
+		t.Fatalf("sync: %s", err)
+	}
+	expected := map[string]string{"w": "w22", "x": "xx", "z": "z"}
+	for _, s := range []object.ObjectStorage{a, b} {
+		if keys := collectAll(mustList(t, s)); !reflect.DeepEqual(keys, []string{"", "w", "x", "z"}) {
+			t.Fatalf("keys in %s: %v", s, keys)
+		}
+		for key, value := range expected {
+			in, _ := s.Get(key, 0, -1)
+			if d, _ := ioutil.ReadAll(in); string(d) != value {
+				t.Fatalf("%s in %s should be %q, but got %q", key, s, value, d)
+			}
+			in.Close()
+		}
+	}
+}
+
+func TestIgnore(t *testing.T) {
+	rules, err := parseIgnore(strings.Split(`
+# logs
+*.log
+!important.log
+/build
+tmp/
+docs/**/draft
+\#notes
+`, "\n"))
+	if err != nil {
+		t.Fatalf("parse: %s", err)
+	}
+	for key, expected := range map[string]bool{
+		"a.log":             true,
+		"x/y/b.log":         true,
+		"x/important.log":   false,
+		"build":             true,
+		"build/a":           true,
+		"x/build":           false,
+		"tmp":               false, // not a directory
+		"tmp/":              true,
+		"x/tmp/a":           true,
+		"docs/draft":        true,
+		"docs/a/b/draft/c":  true,
+		"docs/a/drafts":     false,
+		"#notes":            true,
+		"notes":             false,
+		"tmp/important.log": true, // parent is excluded
+		"x/y/z":             false,
+		"x/y/z.log/":        true,
+	} {
+		if got := rules.ignored(key); got != expected {
+			t.Fatalf("%s should be ignored: %v, but got %v", key, expected, got)
+		}
+	}
+	if _, err := parseIgnore([]string{"a[b-a]"}); err == nil {
+		t.Fatalf("invalid pattern should fail")
+	}
+}
+
+// nolint:errcheck
+func TestSyncDryRun(t *testing.T) {
+	a, _ := object.CreateStorage("mem", "dry-a", "", "")
+	a.Put("x", bytes.NewReader([]byte("x")))
+	a.Put("y", bytes.NewReader([]byte("yy")))
+	a.Put("z", bytes.NewReader([]byte("z")))
+	b, _ := object.CreateStorage("mem", "dry-b", "", "")
+	b.Put("w", bytes.NewReader([]byte("w")))
+	b.Put("y", bytes.NewReader([]byte("y")))
+	b.Put("z", bytes.NewReader([]byte("z")))
+
+	config := &Config{Threads: 10, Dry: true, DeleteSrc: true, DeleteDst: true}
+	failed = 0 // left by other tests
+	if err := Sync(a, b, config); err != nil {
+		t.Fatalf("sync: %s", err)
+	}
+	expected := plan{added: 1, addedBytes: 1, updated: 1, updatedBytes: 2, deleteSrc: 3, deleteDst: 1}
+	if planned != expected {
+		t.Fatalf("expect %+v, but got %+v", expected, planned)
+	}
+	if keys := collectAll(mustList(t, b)); !reflect.DeepEqual(keys, []string{"w", "y", "z"}) {
+		t.Fatalf("nothing should be changed in dry run, but got %v", keys)
+	}
+
+	// the synced keys are deleted from source only
+	config.Dry = false
+	if err := Sync(a, b, config); err == nil {
+		t.Fatalf("y can't be overwritten in mem")
+	}
+	if keys := collectAll(mustList(t, a)); !reflect.DeepEqual(keys, []string{"y"}) {
+		t.Fatalf("keys in source: %v", keys)
+	}
+	if keys := collectAll(mustList(t, b)); !reflect.DeepEqual(keys, []string{"x", "y", "z"}) {
+		t.Fatalf("keys in destination: %v", keys)
+	}
+}
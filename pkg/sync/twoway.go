@@ -0,0 +1,352 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package sync
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/juicedata/juicefs/pkg/object"
+)
+
+// The policies to resolve the conflicts in two-way sync, when an object is changed in both sides.
+const (
+	ConflictNewer      = "newer"       // the one modified later wins
+	ConflictRenameBoth = "rename-both" // both are kept as KEY.conflict-src and KEY.conflict-dst
+)
+
+// baseline is the state of the objects after last two-way sync, which are the same in both sides.
+// An object is changed since then if its size or mtime is different from the baseline.
+type baseline struct {
+	Src  string
+	Dst  string
+	Keys map[string]*baseEntry
+}
+
+type baseEntry struct {
+	Size     int64
+	SrcMtime int64 // in nanoseconds
+	DstMtime int64
+}
+
+func loadBaseline(path string, src, dst object.ObjectStorage) (*baseline, error) {
+	b := &baseline{Src: src.String(), Dst: dst.String(), Keys: make(map[string]*baseEntry)}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			logger.Infof("No baseline in %s, it's the first two-way sync", path)
+			return b, nil
+		}
+		return nil, err
+	}
+	var old baseline
+	if err = json.Unmarshal(data, &old); err != nil {
+		return nil, fmt.Errorf("invalid baseline %s: %s", path, err)
+	}
+	if old.Src != b.Src || old.Dst != b.Dst {
+		return nil, fmt.Errorf("baseline %s is for syncing between %s and %s", path, old.Src, old.Dst)
+	}
+	if old.Keys != nil {
+		b.Keys = old.Keys
+	}
+	return b, nil
+}
+
+// saveBaseline records the objects which are the same in both sides after sync, the ones deleted
+// from both sides are dropped.
+func saveBaseline(path string, src, dst object.ObjectStorage, config *Config) error {
+	srcs, err := listTwoWay(src, config)
+	if err != nil {
+		return err
+	}
+	dsts, err := listTwoWay(dst, config)
+	if err != nil {
+		return err
+	}
+	b := &baseline{Src: src.String(), Dst: dst.String(), Keys: make(map[string]*baseEntry)}
+	for key, s := range srcs {
+		if d := dsts[key]; d != nil && d.Size() == s.Size() {
+			b.Keys[key] = &baseEntry{s.Size(), s.Mtime().UnixNano(), d.Mtime().UnixNano()}
+		}
+	}
+	data, err := json.Marshal(b)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func listTwoWay(store object.ObjectStorage, config *Config) (map[string]object.Object, error) {
+	keys, err := ListAllParallel(store, config.Start, config.End, config.ListThreads)
+	if err != nil {
+		return nil, err
+	}
+	if config.Exclude != nil || ignores != nil {
+		keys = filter(keys, config.Include, config.Exclude)
+	}
+	objs := make(map[string]object.Object)
+	for o := range keys {
+		if o == nil {
+			return nil, fmt.Errorf("list %s failed", store)
+		}
+		if !o.IsDir() {
+			objs[o.Key()] = o
+		}
+	}
+	return objs, nil
+}
+
+// changed returns whether an object in source (or destination) is changed since last sync.
+func changed(o object.Object, e *baseEntry, src bool) bool {
+	if e == nil {
+		return true
+	}
+	mtime := e.DstMtime
+	if src {
+		mtime = e.SrcMtime
+	}
+	return o.Size() != e.Size || o.Mtime().UnixNano() != mtime
+}
+
+type twoWay struct {
+	src, dst object.ObjectStorage
+	config   *Config
+	tasks    chan func()
+}
+
+func (t *twoWay) copy(from, to object.ObjectStorage, obj object.Object) {
+	t.tasks <- func() {
+		if t.config.Dry {
+			logger.Debugf("Will copy %s from %s to %s", obj.Key(), from, to)
+			return
+		}
+		if err := copyInParallel(from, to, obj); err != nil {
+			atomic.AddInt64(&failed, 1)
+			logger.Errorf("Failed to copy %s from %s to %s: %s", obj.Key(), from, to, err)
+			return
+		}
+		if mc, ok := to.(object.MtimeChanger); ok {
+			if err := mc.Chtimes(obj.Key(), obj.Mtime()); err != nil {
+				logger.Warnf("Update mtime of %s: %s", obj.Key(), err)
+			}
+		}
+		atomic.AddInt64(&copied, 1)
+		atomic.AddInt64(&copiedBytes, obj.Size())
+		logger.Debugf("Copied %s from %s to %s", obj.Key(), from, to)
+	}
+}
+
+func (t *twoWay) delete(store object.ObjectStorage, key string) {
+	t.tasks <- func() {
+		if t.config.Dry {
+			logger.Debugf("Will delete %s from %s", key, store)
+			return
+		}
+		if err := try(3, func() error { return store.Delete(key) }); err != nil {
+			atomic.AddInt64(&failed, 1)
+			logger.Errorf("Failed to delete %s from %s: %s", key, store, err)
+			return
+		}
+		atomic.AddInt64(&deleted, 1)
+		logger.Debugf("Deleted %s from %s", key, store)
+	}
+}
+
+// renameBoth keeps both versions in both sides with the suffixes, the original one is deleted.
+func (t *twoWay) renameBoth(s, d object.Object) {
+	t.tasks <- func() {
+		key := s.Key()
+		if t.config.Dry {
+			logger.Debugf("Will rename %s to %s.conflict-src and %s.conflict-dst", key, key, key)
+			return
+		}
+		err := try(3, func() error {
+			for _, c := range []struct {
+				from, to object.ObjectStorage
+				name     string
+			}{
+				{t.src, t.src, key + ".conflict-src"}, {t.src, t.dst, key + ".conflict-src"},
+				{t.dst, t.dst, key + ".conflict-dst"}, {t.dst, t.src, key + ".conflict-dst"},
+			} {
+				in, err := c.from.Get(key, 0, -1)
+				if err != nil {
+					return err
+				}
+				err = c.to.Put(c.name, in)
+				in.Close()
+				if err != nil {
+					return err
+				}
+			}
+			if err := t.src.Delete(key); err != nil {
+				return err
+			}
+			return t.dst.Delete(key)
+		})
+		if err != nil {
+			atomic.AddInt64(&failed, 1)
+			logger.Errorf("Failed to rename %s: %s", key, err)
+			return
+		}
+		atomic.AddInt64(&copied, 4)
+		atomic.AddInt64(&copiedBytes, 2*(s.Size()+d.Size()))
+		logger.Infof("Conflict of %s is kept as %s.conflict-src and %s.conflict-dst", key, key, key)
+	}
+}
+
+// runHook asks the hook which one wins: "src", "dst" or "both" to keep both of them.
+func (t *twoWay) runHook(key string) (string, error) {
+	cmd := exec.Command("/bin/sh", "-c", t.config.ConflictHook)
+	cmd.Env = append(os.Environ(), "JFS_SYNC_KEY="+key, "JFS_SYNC_SRC="+t.src.String(), "JFS_SYNC_DST="+t.dst.String())
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", err
+	}
+	switch r := strings.TrimSpace(string(out)); r {
+	case "src", "dst", "both":
+		return r, nil
+	default:
+		return "", fmt.Errorf("unknown answer %q", r)
+	}
+}
+
+func (t *twoWay) resolve(s, d object.Object) {
+	key := s.Key()
+	var winner string
+	if t.config.ConflictHook != "" {
+		var err error
+		if winner, err = t.runHook(key); err != nil {
+			atomic.AddInt64(&failed, 1)
+			logger.Errorf("Conflict hook for %s: %s", key, err)
+			return
+		}
+	} else if t.config.Conflict == ConflictRenameBoth {
+		winner = "both"
+	} else if d.Mtime().After(s.Mtime()) {
+		winner = "dst"
+	} else {
+		winner = "src"
+	}
+	logger.Infof("%s is changed in both sides, resolved as %s", key, winner)
+	switch winner {
+	case "src":
+		t.copy(t.src, t.dst, s)
+	case "dst":
+		t.copy(t.dst, t.src, d)
+	case "both":
+		t.renameBoth(s, d)
+	}
+}
+
+// handle decides what to do with a key, s or d is nil if it's not in source or destination.
+func (t *twoWay) handle(key string, s, d object.Object, e *baseEntry) {
+	switch {
+	case s != nil && d != nil:
+		if s.Size() == d.Size() && s.Mtime().Equal(d.Mtime()) {
+			return
+		}
+		sc := changed(s, e, true)
+		dc := changed(d, e, false)
+		if sc && dc {
+			t.resolve(s, d)
+		} else if sc {
+			t.copy(t.src, t.dst, s)
+		} else if dc {
+			t.copy(t.dst, t.src, d)
+		}
+	case s != nil:
+		if e != nil && !changed(s, e, true) {
+			t.delete(t.src, key) // deleted from destination
+		} else {
+			t.copy(t.src, t.dst, s)
+		}
+	case d != nil:
+		if e != nil && !changed(d, e, false) {
+			t.delete(t.dst, key) // deleted from source
+		} else {
+			t.copy(t.dst, t.src, d)
+		}
+	}
+}
+
+// syncTwoWay syncs the changes since last sync in both directions, including deletions.
+func syncTwoWay(src, dst object.ObjectStorage, config *Config) error {
+	if config.Baseline == "" {
+		return fmt.Errorf("baseline is required for two-way sync")
+	}
+	if config.Conflict != "" && config.Conflict != ConflictNewer && config.Conflict != ConflictRenameBoth {
+		return fmt.Errorf("unknown conflict policy: %s", config.Conflict)
+	}
+	base, err := loadBaseline(config.Baseline, src, dst)
+	if err != nil {
+		return err
+	}
+	logger.Infof("Syncing between %s and %s", src, dst)
+	srcs, err := listTwoWay(src, config)
+	if err != nil {
+		return err
+	}
+	dsts, err := listTwoWay(dst, config)
+	if err != nil {
+		return err
+	}
+
+	t := &twoWay{src: src, dst: dst, config: config, tasks: make(chan func(), config.Threads)}
+	var wg sync.WaitGroup
+	for i := 0; i < config.Threads; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for f := range t.tasks {
+				f()
+			}
+		}()
+	}
+	for key, s := range srcs {
+		found++
+		t.handle(key, s, dsts[key], base.Keys[key])
+	}
+	for key, d := range dsts {
+		if srcs[key] == nil {
+			found++
+			t.handle(key, nil, d, base.Keys[key])
+		}
+	}
+	close(t.tasks)
+	wg.Wait()
+
+	if failed > 0 {
+		return fmt.Errorf("Failed to sync %d objects, the baseline is not updated", failed)
+	}
+	if !config.Dry {
+		if err = saveBaseline(config.Baseline, src, dst, config); err != nil {
+			return fmt.Errorf("save baseline %s: %s", config.Baseline, err)
+		}
+	}
+	logger.Infof("Found: %d, copied: %d, deleted: %d, transferred: %s", found, copied, deleted, formatSize(uint64(copiedBytes)))
+	return nil
+}
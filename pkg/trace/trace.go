@@ -0,0 +1,113 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Package trace identifies the operations of a client, so the requests to object
+// storage and metadata engine can be correlated with them. The id of a FUSE operation
+// is made of a random prefix of the process and the unique number of the request.
+package trace
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"path"
+	"sync"
+	"time"
+)
+
+// Traced is implemented by the contexts of operations which have a trace id.
+type Traced interface {
+	TraceID() string
+}
+
+var prefix string
+
+func init() {
+	prefix = fmt.Sprintf("%06x", rand.New(rand.NewSource(time.Now().UnixNano())).Intn(1<<24))
+}
+
+// NewID returns the trace id of a request with the unique number.
+func NewID(unique uint64) string {
+	return fmt.Sprintf("%s-%x", prefix, unique)
+}
+
+type idKey struct{}
+
+// WithID returns a context carrying the trace id.
+func WithID(ctx context.Context, id string) context.Context {
+	if id == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, idKey{}, id)
+}
+
+// IDOf returns the trace id of the context, or empty if it's not traced.
+func IDOf(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	if id, ok := ctx.Value(idKey{}).(string); ok {
+		return id
+	}
+	if t, ok := ctx.(Traced); ok {
+		return t.TraceID()
+	}
+	return ""
+}
+
+type binding struct {
+	id   string
+	refs int
+}
+
+var (
+	mu      sync.Mutex
+	objects = make(map[string]*binding)
+)
+
+// Bind binds the trace id to the requests of an object until the returned function is
+// called, the object is identified by the base name of its key, which is unique for
+// the blocks.
+func Bind(key, id string) (unbind func()) {
+	if id == "" {
+		return func() {}
+	}
+	name := path.Base(key)
+	mu.Lock()
+	b := objects[name]
+	if b == nil {
+		b = &binding{id: id}
+		objects[name] = b
+	}
+	b.refs++
+	mu.Unlock()
+	return func() {
+		mu.Lock()
+		if b.refs--; b.refs == 0 {
+			delete(objects, name)
+		}
+		mu.Unlock()
+	}
+}
+
+// Lookup returns the trace id bound to the object with the path.
+func Lookup(p string) string {
+	mu.Lock()
+	defer mu.Unlock()
+	if b := objects[path.Base(p)]; b != nil {
+		return b.id
+	}
+	return ""
+}
@@ -0,0 +1,70 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package trace
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+type tracedContext struct {
+	context.Context
+	id string
+}
+
+func (c *tracedContext) TraceID() string { return c.id }
+
+func TestIDOf(t *testing.T) {
+	if id := IDOf(context.Background()); id != "" {
+		t.Fatalf("untraced context has id %q", id)
+	}
+	if id := IDOf(&tracedContext{context.Background(), "a-1"}); id != "a-1" {
+		t.Fatalf("traced context has id %q", id)
+	}
+	if id := IDOf(WithID(context.Background(), "a-2")); id != "a-2" {
+		t.Fatalf("context with id has id %q", id)
+	}
+	if ctx := context.Background(); WithID(ctx, "") != ctx {
+		t.Fatalf("empty id should not be attached")
+	}
+	if id := NewID(255); !strings.HasPrefix(id, prefix+"-") || !strings.HasSuffix(id, "-ff") {
+		t.Fatalf("new id %q", id)
+	}
+}
+
+func TestBind(t *testing.T) {
+	unbind := Bind("vol/chunks/0/0/1_0_4194304", "a-1")
+	unbind2 := Bind("vol/chunks/0/0/1_0_4194304", "a-2")
+	if id := Lookup("/bucket/vol/chunks/0/0/1_0_4194304"); id != "a-1" {
+		t.Fatalf("bound object has id %q", id)
+	}
+	if id := Lookup("/bucket/vol/chunks/0/0/2_0_4194304"); id != "" {
+		t.Fatalf("unbound object has id %q", id)
+	}
+	unbind()
+	if id := Lookup("1_0_4194304"); id != "a-1" {
+		t.Fatalf("object should be bound until all are unbound, but got %q", id)
+	}
+	unbind2()
+	if id := Lookup("1_0_4194304"); id != "" {
+		t.Fatalf("unbound object has id %q", id)
+	}
+	Bind("1_0_4194304", "")()
+	if len(objects) != 0 {
+		t.Fatalf("empty id should not be bound: %+v", objects)
+	}
+}
@@ -25,10 +25,23 @@ import (
 var slabs = make(map[uintptr][]byte)
 var used int64
 var slabsMutex sync.Mutex
+var freed = sync.NewCond(&slabsMutex)
 
-// Alloc returns size bytes memory from Go heap.
+const pageSize = 4096
+
+// Alloc returns size bytes memory from Go heap, a buffer larger than a page
+// is aligned to page boundary.
 func Alloc(size int) []byte {
-	b := make([]byte, size)
+	var b []byte
+	if size >= pageSize {
+		b = make([]byte, size+pageSize)
+		if off := int(uintptr(unsafe.Pointer(&b[0])) & (pageSize - 1)); off > 0 {
+			b = b[pageSize-off:]
+		}
+		b = b[:size:size]
+	} else {
+		b = make([]byte, size)
+	}
 	ptr := unsafe.Pointer(&b[0])
 	slabsMutex.Lock()
 	slabs[uintptr(ptr)] = b
@@ -48,6 +61,7 @@ func Free(buf []byte) {
 		used -= int64(len(b))
 	}
 	delete(slabs, uintptr(p))
+	freed.Broadcast()
 	slabsMutex.Unlock()
 }
 
@@ -59,6 +73,31 @@ func UsedMemory() int64 {
 	return used
 }
 
+// WaitMemory blocks until ok returns true with the used memory, which is checked
+// again after some memory is freed, or timeout. It returns the last result of ok.
+func WaitMemory(ok func(used int64) bool, timeout time.Duration) bool {
+	slabsMutex.Lock()
+	defer slabsMutex.Unlock()
+	if ok(used) {
+		return true
+	}
+	var expired bool
+	t := time.AfterFunc(timeout, func() {
+		slabsMutex.Lock()
+		expired = true
+		freed.Broadcast()
+		slabsMutex.Unlock()
+	})
+	defer t.Stop()
+	for !expired {
+		freed.Wait()
+		if ok(used) {
+			return true
+		}
+	}
+	return false
+}
+
 func init() {
 	go func() {
 		for {
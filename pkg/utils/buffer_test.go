@@ -18,6 +18,8 @@ package utils
 import (
 	"fmt"
 	"testing"
+	"time"
+	"unsafe"
 )
 
 func assertEqual(t *testing.T, a interface{}, b interface{}) {
@@ -69,3 +71,34 @@ func TestNativeBuffer(t *testing.T) {
 	assertEqual(t, r.Get64(), uint64(4))
 	assertEqual(t, string(r.Get(5)), "hello")
 }
+
+func TestAlignedAlloc(t *testing.T) {
+	for _, size := range []int{1, 4095, 4096, 5000, 1 << 20} {
+		b := Alloc(size)
+		assertEqual(t, len(b), size)
+		if size >= pageSize {
+			assertEqual(t, uintptr(unsafe.Pointer(&b[0]))%pageSize, uintptr(0))
+		}
+		Free(b)
+	}
+	assertEqual(t, UsedMemory(), int64(0))
+}
+
+func TestWaitMemory(t *testing.T) {
+	b := Alloc(1 << 20)
+	below := func(used int64) bool { return used < 1<<20 }
+	start := time.Now()
+	assertEqual(t, WaitMemory(below, time.Millisecond*50), false)
+	if time.Since(start) < time.Millisecond*50 {
+		t.Fatalf("it should wait for the timeout")
+	}
+	go func() {
+		time.Sleep(time.Millisecond * 50)
+		Free(b)
+	}()
+	start = time.Now()
+	assertEqual(t, WaitMemory(below, time.Minute), true)
+	if time.Since(start) > time.Second*10 {
+		t.Fatalf("it should be waked up after the buffer is freed")
+	}
+}
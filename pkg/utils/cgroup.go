@@ -0,0 +1,172 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package utils
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	procCgroup = "/proc/self/cgroup"
+	cgroupRoot = "/sys/fs/cgroup"
+)
+
+// CgroupLimits are the resource limits of the cgroup of current process, which
+// include the limits of its ancestors.
+type CgroupLimits struct {
+	CPUs   float64 // CPU quota in number of CPUs, 0 means unlimited
+	Memory int64   // in bytes, 0 means unlimited
+}
+
+// cgroupDir returns the root of the hierarchy and the directory of the cgroup of
+// current process in it. The empty controller means cgroup v2.
+func cgroupDir(controller string) (string, string) {
+	data, err := ioutil.ReadFile(procCgroup)
+	if err != nil {
+		return "", ""
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		ps := strings.SplitN(line, ":", 3)
+		if len(ps) != 3 {
+			continue
+		}
+		var root string
+		if controller == "" && ps[0] == "0" && ps[1] == "" {
+			root = cgroupRoot
+		} else if controller != "" {
+			for _, c := range strings.Split(ps[1], ",") {
+				if c == controller {
+					root = filepath.Join(cgroupRoot, ps[1])
+				}
+			}
+		}
+		if root == "" {
+			continue
+		}
+		dir := filepath.Join(root, ps[2])
+		if _, err := os.Stat(dir); err != nil {
+			// inside a container, its cgroup is mounted as the root
+			dir = root
+		}
+		return root, dir
+	}
+	return "", ""
+}
+
+// walkCgroup calls fn with the directory of the cgroup and the ones of its ancestors.
+func walkCgroup(root, dir string, fn func(dir string)) {
+	if root == "" {
+		return
+	}
+	for {
+		fn(dir)
+		if len(dir) <= len(root) {
+			return
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+func readCgroupFile(dir, name string) []string {
+	data, err := ioutil.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return nil
+	}
+	return strings.Fields(string(data))
+}
+
+func parseInt(s string) int64 {
+	v, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0
+	}
+	return v
+}
+
+func minLimit(cur, v float64) float64 {
+	if v > 0 && (cur == 0 || v < cur) {
+		return v
+	}
+	return cur
+}
+
+// GetCgroupLimits returns the CPU quota and memory limit of current process, they're
+// zero if not limited or cgroup is not supported.
+func GetCgroupLimits() CgroupLimits {
+	var cpus, memory float64
+	root, dir := cgroupDir("")
+	walkCgroup(root, dir, func(d string) {
+		if fs := readCgroupFile(d, "cpu.max"); len(fs) == 2 && fs[0] != "max" {
+			if period := parseInt(fs[1]); period > 0 {
+				cpus = minLimit(cpus, float64(parseInt(fs[0]))/float64(period))
+			}
+		}
+		if fs := readCgroupFile(d, "memory.max"); len(fs) == 1 && fs[0] != "max" {
+			memory = minLimit(memory, float64(parseInt(fs[0])))
+		}
+	})
+	if cpus == 0 {
+		root, dir = cgroupDir("cpu")
+		walkCgroup(root, dir, func(d string) {
+			quota, period := readCgroupFile(d, "cpu.cfs_quota_us"), readCgroupFile(d, "cpu.cfs_period_us")
+			if len(quota) == 1 && len(period) == 1 && parseInt(period[0]) > 0 {
+				cpus = minLimit(cpus, float64(parseInt(quota[0]))/float64(parseInt(period[0])))
+			}
+		})
+	}
+	if memory == 0 {
+		root, dir = cgroupDir("memory")
+		walkCgroup(root, dir, func(d string) {
+			// unlimited is the max int64 aligned to page size
+			if fs := readCgroupFile(d, "memory.limit_in_bytes"); len(fs) == 1 && parseInt(fs[0]) < math.MaxInt64/2 {
+				memory = minLimit(memory, float64(parseInt(fs[0])))
+			}
+		})
+	}
+	return CgroupLimits{CPUs: cpus, Memory: int64(memory)}
+}
+
+// CgroupThrottled returns the time that current process is throttled because of the
+// CPU quota of its cgroup.
+func CgroupThrottled() time.Duration {
+	if root, dir := cgroupDir(""); root != "" {
+		if v, ok := readStat(dir, "throttled_usec"); ok {
+			return time.Duration(v) * time.Microsecond
+		}
+	}
+	if root, dir := cgroupDir("cpu"); root != "" {
+		if v, ok := readStat(dir, "throttled_time"); ok {
+			return time.Duration(v)
+		}
+	}
+	return 0
+}
+
+func readStat(dir, name string) (int64, bool) {
+	fs := readCgroupFile(dir, "cpu.stat")
+	for i := 0; i+1 < len(fs); i += 2 {
+		if fs[i] == name {
+			return parseInt(fs[i+1]), true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,83 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package utils
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeCgroupFiles(t *testing.T, root string, files map[string]string) {
+	for name, content := range files {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("mkdir: %s", err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("write %s: %s", name, err)
+		}
+	}
+}
+
+func TestCgroup(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "cgroup")
+	if err != nil {
+		t.Fatalf("temp dir: %s", err)
+	}
+	defer os.RemoveAll(tmp)
+	defer func(p, r string) { procCgroup, cgroupRoot = p, r }(procCgroup, cgroupRoot)
+	procCgroup = filepath.Join(tmp, "cgroup")
+	cgroupRoot = filepath.Join(tmp, "v2")
+
+	writeCgroupFiles(t, tmp, map[string]string{
+		"cgroup":                         "0::/kubepods/pod1/c1\n",
+		"v2/cpu.max":                     "max 100000\n",
+		"v2/kubepods/pod1/cpu.max":       "150000 100000\n",
+		"v2/kubepods/pod1/c1/cpu.max":    "400000 100000\n",
+		"v2/kubepods/memory.max":         "1073741824\n",
+		"v2/kubepods/pod1/c1/memory.max": "max\n",
+		"v2/kubepods/pod1/c1/cpu.stat":   "usage_usec 100\nnr_throttled 3\nthrottled_usec 2500000\n",
+	})
+	if l := GetCgroupLimits(); l.CPUs != 1.5 || l.Memory != 1<<30 {
+		t.Fatalf("limits of cgroup v2: %+v", l)
+	}
+	if d := CgroupThrottled(); d != time.Millisecond*2500 {
+		t.Fatalf("throttled: %s", d)
+	}
+
+	cgroupRoot = filepath.Join(tmp, "v1")
+	writeCgroupFiles(t, tmp, map[string]string{
+		"cgroup":                           "5:memory:/docker/abc\n4:cpu,cpuacct:/docker/abc\n1:name=systemd:/init.scope\n",
+		"v1/cpu,cpuacct/cpu.cfs_quota_us":  "50000\n",
+		"v1/cpu,cpuacct/cpu.cfs_period_us": "100000\n",
+		"v1/cpu,cpuacct/cpu.stat":          "nr_periods 10\nnr_throttled 2\nthrottled_time 3000000000\n",
+		"v1/memory/memory.limit_in_bytes":  "9223372036854771712\n",
+	})
+	if l := GetCgroupLimits(); l.CPUs != 0.5 || l.Memory != 0 {
+		t.Fatalf("limits of cgroup v1: %+v", l)
+	}
+	if d := CgroupThrottled(); d != time.Second*3 {
+		t.Fatalf("throttled: %s", d)
+	}
+
+	procCgroup = filepath.Join(tmp, "missing")
+	if l := GetCgroupLimits(); l.CPUs != 0 || l.Memory != 0 || CgroupThrottled() != 0 {
+		t.Fatalf("no cgroup: %+v", l)
+	}
+}
@@ -0,0 +1,148 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package utils
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// IPFamily is the preferred family of addresses to connect, "ipv4", "ipv6" or empty
+// to follow the order of resolver.
+var IPFamily string
+
+// fallbackDelay is how long to wait before connecting to the next address (Happy Eyeballs).
+const fallbackDelay = time.Millisecond * 300
+
+// SplitHostPort splits an address with optional port, the IPv6 address could be bracketed or not,
+// e.g. [::1]:6379, [::1] or ::1.
+func SplitHostPort(addr string) (string, string) {
+	if host, port, err := net.SplitHostPort(addr); err == nil {
+		return host, port
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]"), ""
+}
+
+// SortIPs orders the addresses to connect as RFC 8305, the two families are interleaved starting
+// with the preferred one (or the family of the first address), keeping the order in each family.
+func SortIPs(ips []net.IP) []net.IP {
+	var v4, v6 []net.IP
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+	first, second := v4, v6
+	if IPFamily == "ipv6" || IPFamily == "" && len(ips) > 0 && ips[0].To4() == nil {
+		first, second = v6, v4
+	}
+	sorted := make([]net.IP, 0, len(ips))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			sorted = append(sorted, first[i])
+		}
+		if i < len(second) {
+			sorted = append(sorted, second[i])
+		}
+	}
+	return sorted
+}
+
+// DialIPs connects to port of the addresses in order, the next attempt is started once the previous
+// one is failed or not finished in fallbackDelay, and the first established connection is returned,
+// so an unreachable family (e.g. IPv4 in IPv6-only clusters) does not delay the connection much.
+func DialIPs(ctx context.Context, dialer *net.Dialer, network string, ips []net.IP, port string) (net.Conn, error) {
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("no address to connect")
+	}
+	if len(ips) == 1 {
+		return dialer.DialContext(ctx, network, net.JoinHostPort(ips[0].String(), port))
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan result, len(ips))
+	var started, failed int
+	start := func() {
+		addr := net.JoinHostPort(ips[started].String(), port)
+		started++
+		go func() {
+			conn, err := dialer.DialContext(ctx, network, addr)
+			results <- result{conn, err}
+		}()
+	}
+	start()
+	var err error
+	for {
+		var next <-chan time.Time
+		if started < len(ips) {
+			next = time.After(fallbackDelay)
+		}
+		select {
+		case r := <-results:
+			if r.err == nil {
+				// close the connections established later
+				go func(pending int) {
+					for i := 0; i < pending; i++ {
+						if r := <-results; r.conn != nil {
+							r.conn.Close()
+						}
+					}
+				}(started - failed - 1)
+				return r.conn, nil
+			}
+			failed++
+			err = r.err
+			if failed == len(ips) {
+				return nil, err
+			}
+			if failed == started {
+				start()
+			}
+		case <-next:
+			start()
+		}
+	}
+}
+
+// DialContext resolves the host of address and connects to it with DialIPs.
+func DialContext(ctx context.Context, network, address string, timeout time.Duration) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	dialer := &net.Dialer{Timeout: timeout, KeepAlive: 5 * time.Minute}
+	if ip := net.ParseIP(host); ip != nil {
+		return dialer.DialContext(ctx, network, address)
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]net.IP, len(addrs))
+	for i, a := range addrs {
+		ips[i] = a.IP
+	}
+	return DialIPs(ctx, dialer, network, SortIPs(ips), port)
+}
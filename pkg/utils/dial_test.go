@@ -0,0 +1,101 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package utils
+
+import (
+	"context"
+	"net"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestSplitHostPort(t *testing.T) {
+	for addr, expected := range map[string][2]string{
+		"host:6379":    {"host", "6379"},
+		"host":         {"host", ""},
+		"[::1]:6379":   {"::1", "6379"},
+		"[::1]":        {"::1", ""},
+		"::1":          {"::1", ""},
+		"1.2.3.4:9000": {"1.2.3.4", "9000"},
+	} {
+		if h, p := SplitHostPort(addr); h != expected[0] || p != expected[1] {
+			t.Fatalf("split %s: %s %s", addr, h, p)
+		}
+	}
+}
+
+func TestSortIPs(t *testing.T) {
+	defer func() { IPFamily = "" }()
+	ips := []net.IP{net.ParseIP("1.1.1.1"), net.ParseIP("1.1.1.2"), net.ParseIP("::1"), net.ParseIP("1.1.1.3"), net.ParseIP("::2")}
+	str := func(ips []net.IP) string {
+		var ss []string
+		for _, ip := range ips {
+			ss = append(ss, ip.String())
+		}
+		return strings.Join(ss, ",")
+	}
+	for family, expected := range map[string]string{
+		"":     "1.1.1.1,::1,1.1.1.2,::2,1.1.1.3",
+		"ipv4": "1.1.1.1,::1,1.1.1.2,::2,1.1.1.3",
+		"ipv6": "::1,1.1.1.1,::2,1.1.1.2,1.1.1.3",
+	} {
+		IPFamily = family
+		if s := str(SortIPs(ips)); s != expected {
+			t.Fatalf("sorted ips with %q: %s", family, s)
+		}
+	}
+}
+
+func TestDialIPs(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	// 127.0.0.2 is a black hole, which can't be connected in time
+	dialer := &net.Dialer{Timeout: time.Second * 5, Control: func(network, address string, c syscall.RawConn) error {
+		if strings.HasPrefix(address, "127.0.0.2:") {
+			time.Sleep(time.Second * 3)
+		}
+		return nil
+	}}
+	ips := []net.IP{net.ParseIP("127.0.0.2"), net.ParseIP("127.0.0.1")}
+	start := time.Now()
+	conn, err := DialIPs(context.Background(), dialer, "tcp", ips, port)
+	if err != nil {
+		t.Fatalf("dial: %s", err)
+	}
+	conn.Close()
+	if used := time.Since(start); used > time.Second {
+		t.Fatalf("dial should fall back to the next address in %s, but used %s", fallbackDelay, used)
+	}
+	l.Close()
+	if _, err = DialIPs(context.Background(), &net.Dialer{}, "tcp", []net.IP{ips[1], ips[1]}, port); err == nil {
+		t.Fatalf("dial closed port should fail")
+	}
+}
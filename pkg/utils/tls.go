@@ -0,0 +1,75 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package utils
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// NewTLSConfig returns the TLS settings which trust the CA certificates in caFile (PEM) besides
+// the system ones, and accept only the servers with one of the pinned public keys in their chains.
+// A pin is the base64 encoded SHA256 of SubjectPublicKeyInfo, optionally prefixed by "sha256//"
+// (the format of curl --pinnedpubkey). It returns nil if neither is given.
+func NewTLSConfig(caFile string, pins []string) (*tls.Config, error) {
+	if caFile == "" && len(pins) == 0 {
+		return nil, nil
+	}
+	conf := &tls.Config{}
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("read CA file: %s", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", caFile)
+		}
+		conf.RootCAs = pool
+	}
+	if len(pins) > 0 {
+		hashes := make(map[string]bool)
+		for _, p := range pins {
+			p = strings.TrimPrefix(strings.TrimSpace(p), "sha256//")
+			if h, err := base64.StdEncoding.DecodeString(p); err != nil || len(h) != sha256.Size {
+				return nil, fmt.Errorf("invalid pin %q: base64 of SHA256 is expected", p)
+			}
+			hashes[p] = true
+		}
+		// called after the chain is verified
+		conf.VerifyPeerCertificate = func(raw [][]byte, chains [][]*x509.Certificate) error {
+			for _, chain := range chains {
+				for _, cert := range chain {
+					h := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+					if hashes[base64.StdEncoding.EncodeToString(h[:])] {
+						return nil
+					}
+				}
+			}
+			return errors.New("public key of server does not match any pin")
+		}
+	}
+	return conf, nil
+}
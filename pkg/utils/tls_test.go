@@ -0,0 +1,85 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package utils
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTLSConfig(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	dir, err := ioutil.TempDir("", "tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	caFile := filepath.Join(dir, "ca.pem")
+	cert := srv.Certificate()
+	_ = ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}), 0600)
+	h := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	pin := base64.StdEncoding.EncodeToString(h[:])
+
+	get := func(conf *tls.Config) error {
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: conf}}
+		resp, err := client.Get(srv.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+	if conf, err := NewTLSConfig("", nil); conf != nil || err != nil {
+		t.Fatalf("no TLS config is expected: %v %s", conf, err)
+	}
+	if err := get(&tls.Config{}); err == nil {
+		t.Fatalf("the certificate of test server should not be trusted")
+	}
+	conf, err := NewTLSConfig(caFile, nil)
+	if err != nil {
+		t.Fatalf("load CA: %s", err)
+	}
+	if err := get(conf); err != nil {
+		t.Fatalf("get with custom CA: %s", err)
+	}
+	if conf, err = NewTLSConfig(caFile, []string{"sha256//" + pin}); err != nil {
+		t.Fatalf("pin: %s", err)
+	}
+	if err := get(conf); err != nil {
+		t.Fatalf("get with pinned key: %s", err)
+	}
+	other := sha256.Sum256([]byte("other"))
+	if conf, err = NewTLSConfig(caFile, []string{base64.StdEncoding.EncodeToString(other[:])}); err != nil {
+		t.Fatalf("pin: %s", err)
+	}
+	if err := get(conf); err == nil {
+		t.Fatalf("server with other key should be rejected")
+	}
+	if _, err = NewTLSConfig("", []string{"abc"}); err == nil {
+		t.Fatalf("invalid pin should be rejected")
+	}
+	if _, err = NewTLSConfig(filepath.Join(dir, "none.pem"), nil); err == nil {
+		t.Fatalf("missing CA file should be rejected")
+	}
+}
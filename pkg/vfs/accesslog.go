@@ -20,6 +20,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/juicedata/juicefs/pkg/trace"
 	"github.com/juicedata/juicefs/pkg/utils"
 	"github.com/prometheus/client_golang/prometheus"
 )
@@ -50,6 +51,7 @@ func init() {
 func logit(ctx Context, format string, args ...interface{}) {
 	used := ctx.Duration()
 	opsDurationsHistogram.Observe(used.Seconds())
+	account(ctx.Pid(), 1, 0, 0)
 	readerLock.Lock()
 	defer readerLock.Unlock()
 	if len(readers) == 0 && used < time.Second*10 {
@@ -60,10 +62,15 @@ func logit(ctx Context, format string, args ...interface{}) {
 	t := utils.Now()
 	ts := t.Format("2006.01.02 15:04:05.000000")
 	cmd += fmt.Sprintf(" <%.6f>", used.Seconds())
+	id := trace.IDOf(ctx)
 	if ctx.Pid() != 0 && used >= time.Second*10 {
-		logger.Infof("slow operation: %s", cmd)
+		logger.Infof("slow operation (trace %s): %s", id, cmd)
 	}
-	line := []byte(fmt.Sprintf("%s [uid:%d,gid:%d,pid:%d] %s\n", ts, ctx.Uid(), ctx.Gid(), ctx.Pid(), cmd))
+	var tid string
+	if id != "" {
+		tid = ",trace:" + id
+	}
+	line := []byte(fmt.Sprintf("%s [uid:%d,gid:%d,pid:%d%s] %s\n", ts, ctx.Uid(), ctx.Gid(), ctx.Pid(), tid, cmd))
 
 	for _, r := range readers {
 		select {
@@ -0,0 +1,108 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package vfs
+
+import (
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/juicedata/juicefs/pkg/utils"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	usedBufferGauge = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "used_buffer_size_bytes",
+		Help: "size of currently used buffer.",
+	}, func() float64 {
+		return float64(utils.UsedMemory())
+	})
+	writeThrottled = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "buffer_write_throttled",
+		Help: "number of writes delayed because of buffer limit.",
+	})
+)
+
+// bufferPool is shared by all the readers and writers of a VFS, the memory used
+// by them (allocated from utils.Alloc, counted for the whole process) is bounded
+// by limit.
+type bufferPool struct {
+	limit   int64
+	starved int64 // the last time (unix nano) when a reader can't get buffer
+}
+
+var bufferPoolLock sync.Mutex
+
+// getBufferPool returns the buffer pool of the VFS created with conf.
+func getBufferPool(conf *Config) *bufferPool {
+	bufferPoolLock.Lock()
+	defer bufferPoolLock.Unlock()
+	if conf.buffer == nil {
+		limit := int64(conf.Chunk.BufferSize)
+		if limit <= 0 {
+			limit = 300 << 20
+		}
+		conf.buffer = &bufferPool{limit: limit}
+	}
+	return conf.buffer
+}
+
+// readerStarved marks that a reader can't get buffer for readahead.
+func (b *bufferPool) readerStarved() {
+	atomic.StoreInt64(&b.starved, time.Now().UnixNano())
+}
+
+// readAvailable returns whether a reader can allocate size bytes for readahead.
+func (b *bufferPool) readAvailable(size uint64) bool {
+	if utils.UsedMemory()+int64(size) > b.limit {
+		b.readerStarved()
+		return false
+	}
+	return true
+}
+
+// writeLimit leaves some room for readers if they are starving.
+func (b *bufferPool) writeLimit() int64 {
+	if time.Since(time.Unix(0, atomic.LoadInt64(&b.starved))) < time.Second*5 {
+		return b.limit * 8 / 10
+	}
+	return b.limit
+}
+
+// waitForWrite slows down a writer when the buffer is full, a file which has
+// buffered more than its fair share will be throttled first. The writer is
+// blocked until some buffer is freed if twice of the limit is used.
+func (b *bufferPool) waitForWrite(ctx meta.Context, buffered int64, files int) syscall.Errno {
+	if files < 1 {
+		files = 1
+	}
+	used := utils.UsedMemory()
+	limit := b.writeLimit()
+	if used < limit*8/10 || used < limit && buffered <= limit/int64(files) {
+		return 0
+	}
+	writeThrottled.Inc()
+	time.Sleep(time.Millisecond * 10)
+	for !utils.WaitMemory(func(used int64) bool { return used < b.writeLimit()*2 }, time.Millisecond*100) {
+		if ctx.Canceled() {
+			return syscall.EINTR
+		}
+	}
+	return 0
+}
@@ -0,0 +1,156 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package vfs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"syscall"
+
+	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/juicedata/juicefs/pkg/utils"
+)
+
+// ChecksumXattr is the SHA256 of the content of a file as "sha256:HEX", so it can be compared
+// (e.g. by sync --checksum) without reading the data. If Checksum is enabled, it's computed in
+// background after the file is written and closed. It's saved with the length and mtime of the
+// file, so it's not seen after the file is changed, until it's computed again.
+const ChecksumXattr = "juicefs.checksum"
+
+const (
+	checksumPrefix = "sha256:"
+	checksumLen    = 20 + sha256.Size
+	checksumQueue  = 1000
+)
+
+type checksummer struct {
+	queue chan Ino
+}
+
+var checksums *checksummer
+
+func newChecksummer() *checksummer {
+	c := &checksummer{queue: make(chan Ino, checksumQueue)}
+	go c.run()
+	return c
+}
+
+// add computes the checksum of a closed file later, it's dropped if too many files are waiting.
+func (c *checksummer) add(ino Ino) {
+	select {
+	case c.queue <- ino:
+	default:
+		logger.Debugf("too many files to checksum, skip %d", ino)
+	}
+}
+
+func (c *checksummer) run() {
+	for ino := range c.queue {
+		// the files closed many times are computed once
+		pending := map[Ino]bool{ino: true}
+		for len(c.queue) > 0 {
+			pending[<-c.queue] = true
+		}
+		for ino := range pending {
+			if st := c.update(ino); st != 0 {
+				logger.Debugf("checksum of %d: %s", ino, st)
+			}
+		}
+	}
+}
+
+// update computes the checksum of a file if it's changed since last time.
+func (c *checksummer) update(ino Ino) syscall.Errno {
+	ctx := meta.Background
+	var attr Attr
+	if st := m.GetAttr(ctx, ino, &attr); st != 0 || attr.Typ != meta.TypeFile {
+		return st
+	}
+	var old []byte
+	if m.GetXattr(ctx, ino, ChecksumXattr, &old) == 0 && parseChecksum(old, &attr) != "" {
+		return 0
+	}
+	h := sha256.New()
+	r := reader.Open(ino, attr.Length)
+	defer r.Close(ctx)
+	buf := make([]byte, 1<<20)
+	for off := uint64(0); off < attr.Length; {
+		n, st := r.Read(ctx, off, buf)
+		if st != 0 {
+			return st
+		}
+		if n == 0 {
+			return syscall.EIO
+		}
+		if off+uint64(n) > attr.Length {
+			n = int(attr.Length - off)
+		}
+		_, _ = h.Write(buf[:n])
+		off += uint64(n)
+	}
+	var now Attr
+	if st := m.GetAttr(ctx, ino, &now); st != 0 {
+		return st
+	}
+	if now.Length != attr.Length || now.Mtime != attr.Mtime || now.Mtimensec != attr.Mtimensec {
+		return 0 // changed during computing, it will be done after it's closed again
+	}
+	return m.SetXattr(ctx, ino, ChecksumXattr, packChecksum(&attr, h.Sum(nil)))
+}
+
+func packChecksum(attr *Attr, sum []byte) []byte {
+	w := utils.NewBuffer(checksumLen)
+	w.Put64(attr.Length)
+	w.Put64(uint64(attr.Mtime))
+	w.Put32(attr.Mtimensec)
+	w.Put(sum)
+	return w.Bytes()
+}
+
+// parseChecksum returns the checksum saved in xattr, or empty if it's outdated.
+func parseChecksum(value []byte, attr *Attr) string {
+	if len(value) != checksumLen {
+		return ""
+	}
+	rb := utils.ReadBuffer(value)
+	if rb.Get64() != attr.Length || int64(rb.Get64()) != attr.Mtime || rb.Get32() != attr.Mtimensec {
+		return ""
+	}
+	return checksumPrefix + hex.EncodeToString(rb.Get(sha256.Size))
+}
+
+// ReadChecksum returns the value of ChecksumXattr of a file, ENOATTR if it's not computed yet.
+func ReadChecksum(ctx meta.Context, m meta.Meta, ino Ino, value []byte) ([]byte, syscall.Errno) {
+	var attr Attr
+	if st := m.GetAttr(ctx, ino, &attr); st != 0 {
+		return nil, st
+	}
+	sum := parseChecksum(value, &attr)
+	if sum == "" {
+		return nil, meta.ENOATTR
+	}
+	return []byte(sum), 0
+}
+
+// SaveChecksum keeps the SHA256 of a file computed by the writer, which is the same as the one
+// computed in background.
+func SaveChecksum(ctx meta.Context, m meta.Meta, ino Ino, sum []byte) syscall.Errno {
+	var attr Attr
+	if st := m.GetAttr(ctx, ino, &attr); st != 0 {
+		return st
+	}
+	return m.SetXattr(ctx, ino, ChecksumXattr, packChecksum(&attr, sum))
+}
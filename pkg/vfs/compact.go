@@ -20,6 +20,7 @@ import (
 
 	"github.com/juicedata/juicefs/pkg/chunk"
 	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/juicedata/juicefs/pkg/qos"
 	"github.com/juicedata/juicefs/pkg/utils"
 	"github.com/prometheus/client_golang/prometheus"
 )
@@ -38,7 +39,7 @@ func readSlice(store chunk.ChunkStore, s *meta.Slice, page *chunk.Page, off int)
 	reader := store.NewReader(s.Chunkid, int(s.Size))
 	for read < len(buf) {
 		p := page.Slice(read, len(buf)-read)
-		n, err := reader.ReadAt(context.Background(), p, off+int(s.Off))
+		n, err := reader.ReadAt(qos.WithClass(context.Background(), qos.Compaction), p, off+int(s.Off))
 		p.Release()
 		if n == 0 && err != nil {
 			return err
@@ -58,6 +59,9 @@ func Compact(conf chunk.Config, store chunk.ChunkStore, slices []meta.Slice, chu
 	logger.Debugf("compact %d slices (%d bytes) to chunk %d", len(slices), size, chunkid)
 
 	writer := store.NewWriter(chunkid)
+	if w, ok := writer.(chunk.ClassWriter); ok {
+		w.SetClass(qos.Compaction)
+	}
 
 	var pos int
 	for i, s := range slices {
@@ -0,0 +1,34 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package vfs
+
+import (
+	"github.com/juicedata/juicefs/pkg/chunk"
+	"github.com/juicedata/juicefs/pkg/meta"
+)
+
+// CompressXattr is the extended attribute of a directory to set the compression of the
+// files in it, in the format of ALGORITHM[:LEVEL] (see chunk.ParseCompressHint), such as
+// none for the media files which are compressed already, or zstd:19 for the logs. It's
+// used for the data written after it's set, and inherited by the new sub-directories.
+const CompressXattr = "juicefs.compress"
+
+// CompressHint returns the bits of the compression of a directory to be set in the ids of chunks,
+// 0 means the compression of the volume.
+func (w *dataWriter) CompressHint(ctx meta.Context, dir Ino) uint64 {
+	bits, _ := chunk.ParseCompressHint(w.dirs.get(ctx, dir, CompressXattr))
+	return bits
+}
@@ -0,0 +1,62 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package vfs
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ConsistencyXattr is the extended attribute of a directory to change the consistency of the
+// entries in it, the value is one of:
+//
+//	strict    close-to-open, the attributes and entries are not cached by kernel, so the
+//	          changes by other clients are seen immediately, for the shared directories
+//	eventual  the attributes, entries and data are cached longer, and close() does not
+//	          wait for the data to be uploaded, it's seen by other clients later, for the
+//	          scratch or temporary data
+//
+// The entries use the cache timeouts of the mount point if it's not set.
+const ConsistencyXattr = "juicefs.consistency"
+
+// Consistency levels of directories.
+const (
+	ConsistencyDefault uint8 = iota
+	ConsistencyStrict
+	ConsistencyEventual
+)
+
+var consistencies = []string{"", "strict", "eventual"}
+
+// ParseConsistency parses the value of ConsistencyXattr.
+func ParseConsistency(s string) (uint8, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	for i, c := range consistencies {
+		if i > 0 && s == c {
+			return uint8(i), nil
+		}
+	}
+	return 0, fmt.Errorf("invalid consistency %q, it should be strict or eventual", s)
+}
+
+// Consistency returns the consistency level of the entries in a directory.
+func Consistency(ctx Context, dir Ino) uint8 {
+	if dw, ok := writer.(*dataWriter); ok {
+		c, _ := ParseConsistency(dw.dirs.get(ctx, dir, ConsistencyXattr))
+		return c
+	}
+	return ConsistencyDefault
+}
@@ -0,0 +1,181 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package vfs
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// The operations and bytes are attributed to the processes and their containers,
+// so the noisy neighbors on a shared node can be found with `juicefs stats --top`.
+// The processes idle for a while are forgotten, because the pid could be reused.
+const consumerIdle = time.Minute * 10
+
+// Consumer is the I/O of a process since it's seen.
+type Consumer struct {
+	Pid        uint32
+	Name       string // command of the process
+	Container  string `json:",omitempty"` // short ID of the container
+	Ops        uint64
+	ReadBytes  uint64
+	WriteBytes uint64
+}
+
+// consumer is updated by atomic operations, the counters are placed first to be
+// aligned on 32-bit platforms.
+type consumer struct {
+	ops     uint64
+	read    uint64
+	written uint64
+	last    int64 // unix nano
+
+	pid       uint32
+	name      string
+	container string
+	label     string
+	metrics   [3]prometheus.Counter
+}
+
+var (
+	procRoot    = "/proc"
+	containerRE = regexp.MustCompile(`[0-9a-f]{64}`)
+
+	consumers  sync.Map // pid -> *consumer
+	sweepOnce  sync.Once
+	labelLock  sync.Mutex
+	labelUsers = make(map[string]int) // label -> number of consumers
+
+	containerOps = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "container_ops",
+		Help: "Number of operations by the processes in a container.",
+	}, []string{"container"})
+	containerReadBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "container_read_bytes",
+		Help: "Bytes read by the processes in a container.",
+	}, []string{"container"})
+	containerWriteBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "container_write_bytes",
+		Help: "Bytes written by the processes in a container.",
+	}, []string{"container"})
+)
+
+// lookupProc returns the command of a process and the ID of its container, which
+// is found in the path of its cgroup.
+func lookupProc(pid uint32) (name, container string) {
+	dir := filepath.Join(procRoot, fmt.Sprint(pid))
+	if data, err := ioutil.ReadFile(filepath.Join(dir, "comm")); err == nil {
+		name = strings.TrimSpace(string(data))
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(dir, "cgroup")); err == nil {
+		if id := containerRE.Find(data); id != nil {
+			container = string(id[:12])
+		}
+	}
+	return
+}
+
+func newConsumer(pid uint32) *consumer {
+	name, container := lookupProc(pid)
+	c := &consumer{pid: pid, name: name, container: container, label: container}
+	if c.label == "" {
+		c.label = "host"
+	}
+	labelLock.Lock()
+	labelUsers[c.label]++
+	c.metrics[0] = containerOps.WithLabelValues(c.label)
+	c.metrics[1] = containerReadBytes.WithLabelValues(c.label)
+	c.metrics[2] = containerWriteBytes.WithLabelValues(c.label)
+	labelLock.Unlock()
+	return c
+}
+
+// release removes the metrics of the container if there is no consumer in it.
+func (c *consumer) release() {
+	labelLock.Lock()
+	defer labelLock.Unlock()
+	if labelUsers[c.label]--; labelUsers[c.label] <= 0 {
+		delete(labelUsers, c.label)
+		containerOps.DeleteLabelValues(c.label)
+		containerReadBytes.DeleteLabelValues(c.label)
+		containerWriteBytes.DeleteLabelValues(c.label)
+	}
+}
+
+// sweepConsumers forgets the idle processes periodically.
+func sweepConsumers() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		sweepIdle(now)
+	}
+}
+
+func sweepIdle(now time.Time) {
+	consumers.Range(func(key, value interface{}) bool {
+		c := value.(*consumer)
+		if now.UnixNano()-atomic.LoadInt64(&c.last) > int64(consumerIdle) {
+			consumers.Delete(key)
+			c.release()
+		}
+		return true
+	})
+}
+
+// account attributes the operations and bytes to a process.
+func account(pid uint32, ops, read, written uint64) {
+	if pid == 0 {
+		return // internal operations
+	}
+	v, ok := consumers.Load(pid)
+	if !ok {
+		sweepOnce.Do(func() { go sweepConsumers() })
+		nc := newConsumer(pid)
+		if v, ok = consumers.LoadOrStore(pid, nc); ok {
+			nc.release()
+		}
+	}
+	c := v.(*consumer)
+	atomic.AddUint64(&c.ops, ops)
+	atomic.AddUint64(&c.read, read)
+	atomic.AddUint64(&c.written, written)
+	atomic.StoreInt64(&c.last, time.Now().UnixNano())
+	c.metrics[0].Add(float64(ops))
+	c.metrics[1].Add(float64(read))
+	c.metrics[2].Add(float64(written))
+}
+
+// Consumers returns the I/O of the processes, ordered by pid.
+func Consumers() []Consumer {
+	cs := make([]Consumer, 0)
+	consumers.Range(func(_, value interface{}) bool {
+		c := value.(*consumer)
+		cs = append(cs, Consumer{Pid: c.pid, Name: c.name, Container: c.container, Ops: atomic.LoadUint64(&c.ops),
+			ReadBytes: atomic.LoadUint64(&c.read), WriteBytes: atomic.LoadUint64(&c.written)})
+		return true
+	})
+	sort.Slice(cs, func(i, j int) bool { return cs[i].Pid < cs[j].Pid })
+	return cs
+}
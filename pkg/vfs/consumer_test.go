@@ -0,0 +1,78 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package vfs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func countMetrics(c prometheus.Collector) int {
+	ch := make(chan prometheus.Metric, 100)
+	c.Collect(ch)
+	close(ch)
+	return len(ch)
+}
+
+func TestConsumers(t *testing.T) {
+	root := t.TempDir()
+	defer func(old string) { procRoot = old }(procRoot)
+	procRoot = root
+	dir := filepath.Join(root, "1234")
+	_ = os.MkdirAll(dir, 0755)
+	_ = ioutil.WriteFile(filepath.Join(dir, "comm"), []byte("fio\n"), 0644)
+	_ = ioutil.WriteFile(filepath.Join(dir, "cgroup"), []byte("0::/docker/"+strings.Repeat("ab", 32)+"\n"), 0644)
+
+	account(1234, 1, 100, 0)
+	account(1234, 1, 0, 10)
+	account(1235, 1, 0, 0)
+	cs := Consumers()
+	if len(cs) != 2 || cs[0] != (Consumer{Pid: 1234, Name: "fio", Container: "abababababab", Ops: 2, ReadBytes: 100, WriteBytes: 10}) {
+		t.Fatalf("consumers: %+v", cs)
+	}
+	if n := countMetrics(containerOps); n != 2 {
+		t.Fatalf("expect 2 containers, but got %d", n)
+	}
+
+	sweepIdle(time.Now())
+	if cs = Consumers(); len(cs) != 2 {
+		t.Fatalf("active consumers are removed: %+v", cs)
+	}
+	sweepIdle(time.Now().Add(consumerIdle * 2))
+	if cs = Consumers(); len(cs) != 0 {
+		t.Fatalf("idle consumers are not removed: %+v", cs)
+	}
+	if n := countMetrics(containerOps); n != 0 {
+		t.Fatalf("the metrics of idle containers are not removed: %d", n)
+	}
+}
+
+func BenchmarkAccount(b *testing.B) {
+	defer func(old string) { procRoot = old }(procRoot)
+	procRoot = b.TempDir()
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			account(4321, 1, 4096, 0)
+		}
+	})
+}
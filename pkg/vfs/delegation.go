@@ -0,0 +1,193 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package vfs
+
+import (
+	"sync"
+	"syscall"
+
+	"github.com/juicedata/juicefs/pkg/meta"
+)
+
+type delegated struct {
+	refs    int // number of handles
+	appends int // number of handles appending the file
+	writer  FileWriter
+
+	sync.Mutex      // the appending writes are serialized with recall
+	recalled   bool // protected by delegator
+	shared     bool // the file is appended by other clients too, the ranges should be reserved
+}
+
+// delegator holds the write delegations of the files opened by this client. The dirty data of
+// a delegated file is buffered longer and close() does not wait for it to be uploaded, because
+// the delegation is recalled before the file is opened by other clients, which flushes the data.
+// The files opened with O_APPEND are always delegated (without caching if it's not enabled), so
+// the data is appended at the end of the buffered data, unless they are appended by other clients.
+type delegator struct {
+	sync.Mutex
+	acquiring sync.Mutex
+	cache     bool // cache the data of delegated files
+	files     map[Ino]*delegated
+}
+
+var delegs *delegator
+
+func newDelegator(cache bool) *delegator {
+	d := &delegator{cache: cache, files: make(map[Ino]*delegated)}
+	m.OnMsg(meta.Recall, func(args ...interface{}) error {
+		return d.recall(args[0].(Ino))
+	})
+	return d
+}
+
+// acquire tries to get the write delegation of a file for a handle, returns nil if it's not granted.
+func (d *delegator) acquire(ctx Context, inode Ino, w FileWriter, append bool) *delegated {
+	// the recalls by others are not blocked while waiting for them
+	d.acquiring.Lock()
+	defer d.acquiring.Unlock()
+	d.Lock()
+	if f, ok := d.files[inode]; ok {
+		f.refs++
+		if append {
+			f.appends++
+		}
+		upgrade := append && f.appends == 1 && !f.recalled
+		d.Unlock()
+		// keep it when recalled
+		if upgrade && m.Delegate(ctx, inode, meta.DelegateAppend) != 0 {
+			d.Lock()
+			d.stopCaching(f)
+			d.Unlock()
+			_ = f.writer.Flush(ctx)
+		}
+		return f
+	}
+	d.Unlock()
+	if !append && !d.cache {
+		return nil
+	}
+	ltype := uint8(meta.DelegateWrite)
+	if append {
+		ltype = meta.DelegateAppend
+	}
+	st := m.Delegate(ctx, inode, ltype)
+	if st != 0 && (!append || st != syscall.EAGAIN) {
+		return nil
+	}
+	f := &delegated{refs: 1, writer: w}
+	if append {
+		f.appends = 1
+	}
+	if st != 0 {
+		f.recalled, f.shared = true, true
+	} else if d.cache {
+		w.SetDelegated(true)
+	}
+	if st == 0 && append {
+		// appended by others before it's granted
+		var attr Attr
+		if m.GetAttr(ctx, inode, &attr) == 0 && attr.Length > w.GetLength() {
+			w.Truncate(attr.Length)
+		}
+	}
+	d.Lock()
+	d.files[inode] = f
+	d.Unlock()
+	return f
+}
+
+// stopCaching marks the delegation as recalled, so the data is not cached anymore.
+// protected by delegator
+func (d *delegator) stopCaching(f *delegated) {
+	f.recalled = true
+	f.Lock()
+	f.shared = true
+	f.Unlock()
+	f.writer.SetDelegated(false)
+}
+
+// held returns true if the delegation is not recalled, or dropped because it can't be renewed.
+func (d *delegator) held(inode Ino, f *delegated) bool {
+	d.Lock()
+	defer d.Unlock()
+	return d.cache && f != nil && d.files[inode] == f && !f.recalled
+}
+
+// release returns the delegation after the data is flushed by the last handle.
+func (d *delegator) release(inode Ino, f *delegated, append bool) {
+	d.Lock()
+	defer d.Unlock()
+	if f == nil || d.files[inode] != f {
+		return // recalled
+	}
+	if append {
+		f.appends--
+	}
+	if f.refs--; f.refs == 0 {
+		delete(d.files, inode)
+		_ = m.Delegate(meta.Background, inode, meta.DelegateNone)
+	}
+}
+
+// recall flushes the buffered data of a file when its delegation is recalled by other clients,
+// or is going to expire. It returns after the data is flushed. The delegation of an appending
+// file is kept (downgraded by meta), its ranges are reserved after that.
+func (d *delegator) recall(inode Ino) error {
+	d.Lock()
+	f, ok := d.files[inode]
+	if ok {
+		if f.appends == 0 {
+			delete(d.files, inode)
+		}
+		d.stopCaching(f)
+	}
+	d.Unlock()
+	if !ok {
+		return nil
+	}
+	logger.Debugf("delegation of inode %d is recalled", inode)
+	if st := f.writer.Flush(meta.Background); st != 0 {
+		return st
+	}
+	return nil
+}
+
+// appendWrite appends the data at the end of a file opened with O_APPEND, since the offset from kernel
+// could be stale when the file is appended by other clients. If the file is delegated to this client
+// exclusively, the data is appended after the buffered data, and the length is updated after it's
+// flushed. Otherwise the range is reserved in meta, and the data is flushed before it returns, so the
+// reserved range is not read as zeros by others for long.
+func appendWrite(ctx Context, h *handle, buf []byte, off *uint64) syscall.Errno {
+	size := uint64(len(buf))
+	if f := h.delegation; f != nil {
+		f.Lock()
+		defer f.Unlock()
+		if !f.shared {
+			if *off = h.writer.GetLength(); *off+size >= maxFileSize {
+				return syscall.EFBIG
+			}
+			return h.writer.Write(ctx, *off, buf)
+		}
+	}
+	if st := m.Reserve(ctx, h.inode, size, off); st != 0 {
+		return st
+	}
+	if st := h.writer.Write(ctx, *off, buf); st != 0 {
+		return st
+	}
+	return h.writer.Flush(ctx)
+}
@@ -0,0 +1,85 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package vfs
+
+import (
+	"syscall"
+	"testing"
+
+	"github.com/juicedata/juicefs/pkg/meta"
+)
+
+func TestAppendWrite(t *testing.T) {
+	initVFS(t, meta.Format{Name: "test", BlockSize: 4})
+	ctx := NewLogContext(meta.Background)
+	f, fh, err := Create(ctx, rootID, "log", 0644, 0, syscall.O_WRONLY)
+	if err != 0 {
+		t.Fatalf("create: %s", err)
+	}
+	_ = Write(ctx, f.Inode, []byte("abc"), 0, fh)
+	_ = Release(ctx, f.Inode, fh)
+
+	_, fh, err = Open(ctx, f.Inode, syscall.O_WRONLY|syscall.O_APPEND)
+	if err != 0 {
+		t.Fatalf("open: %s", err)
+	}
+	h := findHandle(f.Inode, fh)
+	if h.delegation == nil || h.delegation.shared {
+		t.Fatalf("the only appender should be delegated exclusively")
+	}
+	length := func() uint64 {
+		var attr Attr
+		if st := m.GetAttr(ctx, f.Inode, &attr); st != 0 {
+			t.Fatalf("getattr: %s", st)
+		}
+		return attr.Length
+	}
+	if err = Write(ctx, f.Inode, []byte("de"), 0, fh); err != 0 { // stale offset
+		t.Fatalf("append: %s", err)
+	}
+	if l := length(); l != 3 {
+		t.Fatalf("length should not be extended before the data is flushed: %d", l)
+	}
+	if err = Fsync(ctx, f.Inode, 0, fh); err != 0 {
+		t.Fatalf("fsync: %s", err)
+	}
+	if l := length(); l != 5 {
+		t.Fatalf("length after flushed: %d", l)
+	}
+
+	h.delegation.shared = true // appended by others
+	if err = Write(ctx, f.Inode, []byte("f"), 0, fh); err != 0 {
+		t.Fatalf("append with others: %s", err)
+	}
+	if l := length(); l != 6 {
+		t.Fatalf("length after appended with others: %d", l)
+	}
+	if err = Write(ctx, f.Inode, []byte("g"), maxFileSize-1, fh); err != syscall.EFBIG {
+		t.Fatalf("append beyond max size: %s", err)
+	}
+	_ = Release(ctx, f.Inode, fh)
+
+	_, fh, err = Open(ctx, f.Inode, syscall.O_RDONLY)
+	if err != 0 {
+		t.Fatalf("open: %s", err)
+	}
+	buf := make([]byte, 10)
+	n, err := Read(ctx, f.Inode, buf, 0, fh)
+	if err != 0 || string(buf[:n]) != "abcdef" {
+		t.Fatalf("read: %s %q", err, buf[:n])
+	}
+	_ = Release(ctx, f.Inode, fh)
+}
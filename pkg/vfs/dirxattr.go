@@ -0,0 +1,147 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package vfs
+
+import (
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/chunk"
+	"github.com/juicedata/juicefs/pkg/meta"
+)
+
+const (
+	xattrTTL     = time.Minute // the changes by other clients are seen after it
+	maxDirXattrs = 100000
+)
+
+// dirXattrs are the extended attributes of directories which change the behavior of the files
+// in them, they're inherited by the new sub-directories.
+var dirXattrs = []string{CompressXattr, ConsistencyXattr, SerializeXattr}
+
+func isDirXattr(name string) bool {
+	for _, n := range dirXattrs {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckXattr validates the value of the extended attributes used by JuiceFS.
+func CheckXattr(name string, value []byte) syscall.Errno {
+	var err error
+	switch name {
+	case CompressXattr:
+		_, err = chunk.ParseCompressHint(string(value))
+	case ConsistencyXattr:
+		_, err = ParseConsistency(string(value))
+	case SerializeXattr:
+		_, err = strconv.ParseBool(string(value))
+	case ChecksumXattr:
+		return syscall.EPERM // computed by JuiceFS only
+	}
+	if err != nil {
+		return syscall.EINVAL
+	}
+	return 0
+}
+
+type dirXattrKey struct {
+	dir  Ino
+	name string
+}
+
+type dirXattrValue struct {
+	value  string
+	expire time.Time
+}
+
+// dirXattrCache caches the extended attributes of directories in dirXattrs.
+type dirXattrCache struct {
+	sync.Mutex
+	m      meta.Meta
+	values map[dirXattrKey]dirXattrValue
+}
+
+func newDirXattrCache(m meta.Meta) *dirXattrCache {
+	return &dirXattrCache{m: m, values: make(map[dirXattrKey]dirXattrValue)}
+}
+
+// get returns the value of an extended attribute of a directory, or an empty string if it's not set or invalid.
+func (c *dirXattrCache) get(ctx meta.Context, dir Ino, name string) string {
+	if dir == 0 {
+		return ""
+	}
+	key := dirXattrKey{dir, name}
+	c.Lock()
+	v, ok := c.values[key]
+	c.Unlock()
+	if !ok || time.Now().After(v.expire) {
+		var value []byte
+		if st := c.m.GetXattr(ctx, dir, name, &value); st == 0 {
+			v.value = string(value)
+			if CheckXattr(name, value) != 0 {
+				logger.Warnf("invalid %s of directory %d: %q", name, dir, value)
+				v.value = ""
+			}
+		} else if st == meta.ENOATTR {
+			v.value = ""
+		} else {
+			return ""
+		}
+		v.expire = time.Now().Add(xattrTTL)
+		c.Lock()
+		if len(c.values) >= maxDirXattrs {
+			c.values = make(map[dirXattrKey]dirXattrValue)
+		}
+		c.values[key] = v
+		c.Unlock()
+	}
+	return v.value
+}
+
+func (c *dirXattrCache) forget(dir Ino) {
+	c.Lock()
+	for _, name := range dirXattrs {
+		delete(c.values, dirXattrKey{dir, name})
+	}
+	c.Unlock()
+}
+
+// InheritXattrs copies the extended attributes in dirXattrs of the parent to a new directory.
+func InheritXattrs(ctx meta.Context, m meta.Meta, w DataWriter, parent, inode Ino) {
+	dw, ok := w.(*dataWriter)
+	if !ok {
+		return
+	}
+	for _, name := range dirXattrs {
+		if v := dw.dirs.get(ctx, parent, name); v != "" {
+			if st := m.SetXattr(ctx, inode, name, []byte(v)); st != 0 {
+				logger.Warnf("inherit %s of directory %d: %s", name, inode, st)
+			}
+		}
+	}
+}
+
+// ForgetXattrs drops the cached extended attributes of a directory after one of them is changed.
+func ForgetXattrs(w DataWriter, dir Ino, name string) {
+	if dw, ok := w.(*dataWriter); ok && isDirXattr(name) {
+		dw.dirs.forget(dir)
+	}
+}
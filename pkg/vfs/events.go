@@ -0,0 +1,144 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package vfs
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/juicedata/juicefs/pkg/event"
+	"github.com/juicedata/juicefs/pkg/meta"
+)
+
+// The changes of files made by this client are reported as S3 events if Config.Events is set,
+// the keys are the paths relative to the root. The paths are resolved by the names seen in
+// lookup, create and rename, and the parents of directories, so a file is skipped if its name
+// is not known (e.g. it's opened long after the lookup).
+type eventer struct {
+	sync.Mutex
+	*event.Notifier
+	names map[Ino]dentry
+}
+
+type dentry struct {
+	parent Ino
+	name   string
+}
+
+var events *eventer
+
+func newEventer(n *event.Notifier) *eventer {
+	return &eventer{Notifier: n, names: make(map[Ino]dentry)}
+}
+
+// remember remembers the name of a node to resolve its path later.
+func (e *eventer) remember(ino, parent Ino, name string) {
+	e.Lock()
+	defer e.Unlock()
+	if _, ok := e.names[ino]; !ok && len(e.names) >= maxNames {
+		for i := range e.names {
+			delete(e.names, i)
+			break
+		}
+	}
+	e.names[ino] = dentry{parent, name}
+}
+
+// path returns the path of a node, the directories are found in their parents if they're not seen.
+func (e *eventer) path(ino Ino) (string, bool) {
+	var names []string
+	for ino != rootID && len(names) < 1000 {
+		e.Lock()
+		d, ok := e.names[ino]
+		e.Unlock()
+		if !ok {
+			if d, ok = e.findDir(ino); !ok {
+				return "", false
+			}
+			e.remember(ino, d.parent, d.name)
+		}
+		names = append(names, d.name)
+		ino = d.parent
+	}
+	if ino != rootID {
+		return "", false
+	}
+	for i, j := 0, len(names)-1; i < j; i, j = i+1, j-1 {
+		names[i], names[j] = names[j], names[i]
+	}
+	return strings.Join(names, "/"), true
+}
+
+func (e *eventer) findDir(ino Ino) (dentry, bool) {
+	var attr Attr
+	if m.GetAttr(meta.Background, ino, &attr) != 0 || attr.Typ != meta.TypeDirectory {
+		return dentry{}, false
+	}
+	var entries []*meta.Entry
+	if m.Readdir(meta.Background, attr.Parent, 0, &entries) != 0 {
+		return dentry{}, false
+	}
+	for _, en := range entries {
+		if en.Inode == ino {
+			return dentry{attr.Parent, string(en.Name)}, true
+		}
+	}
+	return dentry{}, false
+}
+
+// entryPath returns the path of an entry in a directory.
+func (e *eventer) entryPath(parent Ino, name string) (string, bool) {
+	p, ok := e.path(parent)
+	if !ok || p == "" {
+		return name, ok
+	}
+	return p + "/" + name, true
+}
+
+// written reports a file which is written and closed.
+func (e *eventer) written(ino Ino) {
+	var attr Attr
+	if m.GetAttr(meta.Background, ino, &attr) != 0 || attr.Typ != meta.TypeFile {
+		return
+	}
+	if p, ok := e.path(ino); ok {
+		e.Notify(event.ObjectCreatedPut, p, int64(attr.Length), "")
+	} else {
+		logger.Debugf("skip the event of %d: unknown path", ino)
+	}
+}
+
+func (e *eventer) removed(p string) {
+	e.Notify(event.ObjectRemovedDelete, p, 0, "")
+}
+
+// renamed reports a renamed node as copied to the new path and removed from the old one,
+// the directories end with '/'.
+func (e *eventer) renamed(oldPath string, ino, parent Ino, name string, attr *Attr) {
+	e.remember(ino, parent, name)
+	newPath, ok := e.entryPath(parent, name)
+	if !ok {
+		return
+	}
+	var size int64
+	if attr.Typ == meta.TypeDirectory {
+		oldPath, newPath = oldPath+"/", newPath+"/"
+	} else {
+		size = int64(attr.Length)
+	}
+	e.Notify(event.ObjectCreatedCopy, newPath, size, "")
+	e.Notify(event.ObjectRemovedDelete, oldPath, 0, "")
+}
@@ -0,0 +1,125 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package vfs
+
+import (
+	"sync"
+	"syscall"
+	"time"
+)
+
+// The mount point can be frozen like fsfreeze, so consistent backups or snapshots of
+// the applications on it can be taken. The modifications wait until it's unfrozen, or
+// the timeout passes in case the one froze it is gone.
+
+// FreezeState is the state of freezing.
+type FreezeState struct {
+	Frozen   bool
+	Since    time.Time
+	Deadline time.Time `json:",omitempty"` // zero means no timeout
+}
+
+var freezer struct {
+	sync.Mutex
+	FreezeState
+	cond   *sync.Cond
+	active int    // modifications in progress
+	gen    uint64 // increased for every freezing
+}
+
+func init() {
+	freezer.cond = sync.NewCond(&freezer)
+}
+
+// beginModify waits until the mount point is not frozen, the returned function should
+// be called after the modification is done. It must not be nested.
+func beginModify() func() {
+	freezer.Lock()
+	for freezer.Frozen {
+		freezer.cond.Wait()
+	}
+	freezer.active++
+	freezer.Unlock()
+	return func() {
+		freezer.Lock()
+		freezer.active--
+		if freezer.active == 0 {
+			freezer.cond.Broadcast()
+		}
+		freezer.Unlock()
+	}
+}
+
+// Freeze blocks the new modifications, waits for the ones in progress and flushes the
+// buffered data of all files. It's unfrozen automatically after timeout if it's not 0.
+func Freeze(ctx Context, timeout time.Duration) syscall.Errno {
+	freezer.Lock()
+	if freezer.Frozen {
+		freezer.Unlock()
+		return syscall.EBUSY
+	}
+	freezer.Frozen = true
+	freezer.Since = time.Now()
+	freezer.Deadline = time.Time{}
+	freezer.gen++
+	gen := freezer.gen
+	for freezer.active > 0 {
+		freezer.cond.Wait()
+	}
+	freezer.Unlock()
+
+	if err := writer.FlushAll(ctx); err != 0 {
+		logger.Warnf("flush buffered data for freezing: %s", err)
+		unfreeze(gen)
+		return err
+	}
+	if timeout > 0 {
+		freezer.Lock()
+		freezer.Deadline = time.Now().Add(timeout)
+		freezer.Unlock()
+		time.AfterFunc(timeout, func() {
+			if unfreeze(gen) {
+				logger.Warnf("unfrozen after timeout %s", timeout)
+			}
+		})
+	}
+	logger.Infof("frozen, modifications are blocked")
+	return 0
+}
+
+// Unfreeze resumes the modifications, it returns false if it's not frozen.
+func Unfreeze() bool {
+	return unfreeze(0)
+}
+
+// unfreeze resumes the modifications if it's frozen by the freezing gen, or any if gen is 0.
+func unfreeze(gen uint64) bool {
+	freezer.Lock()
+	defer freezer.Unlock()
+	if !freezer.Frozen || gen > 0 && gen != freezer.gen {
+		return false
+	}
+	freezer.FreezeState = FreezeState{}
+	freezer.cond.Broadcast()
+	return true
+}
+
+// GetFreezeState returns the state of freezing.
+func GetFreezeState() FreezeState {
+	freezer.Lock()
+	defer freezer.Unlock()
+	return freezer.FreezeState
+}
@@ -49,6 +49,11 @@ type handle struct {
 	flockOwner uint64 // kernel 3.1- does not pass lock_owner in release()
 	reader     FileReader
 	writer     FileWriter
+	append     bool // opened with O_APPEND
+	writeback  bool // don't wait for the data to be uploaded in flush, see ConsistencyEventual
+	delegation *delegated
+	serial     bool // the writes are serialized with other clients, see SerializeXattr
+	versioned  bool // the previous version is kept before overwritten, see versioner
 	ops        []Context
 
 	// rwlock
@@ -140,6 +145,11 @@ func (h *handle) Wunlock() {
 	h.Unlock()
 }
 
+// cached returns true if the data can be flushed in background, see ConsistencyEventual and delegator.
+func (h *handle) cached() bool {
+	return h.writeback || h.delegation != nil && delegs.held(h.inode, h.delegation)
+}
+
 func (h *handle) Close() {
 	if h.reader != nil {
 		h.reader.Close(meta.Background)
@@ -198,7 +208,7 @@ func releaseHandle(inode Ino, fh uint64) {
 	}
 }
 
-func newFileHandle(inode Ino, length uint64, flags uint32) uint64 {
+func newFileHandle(ctx Context, inode Ino, length uint64, flags uint32, parent Ino) uint64 {
 	h := newHandle(inode)
 	h.Lock()
 	defer h.Unlock()
@@ -211,6 +221,16 @@ func newFileHandle(inode Ino, length uint64, flags uint32) uint64 {
 		h.reader = reader.Open(inode, length)
 		h.writer = writer.Open(inode, length)
 	}
+	if h.writer != nil {
+		h.writer.SetCompression(writer.CompressHint(ctx, parent))
+		h.append = flags&syscall.O_APPEND != 0
+		h.writeback = Consistency(ctx, parent) == ConsistencyEventual
+		h.serial = Serialized(ctx, parent)
+		h.versioned = length == 0 // nothing to keep
+		if delegs != nil && !h.serial {
+			h.delegation = delegs.acquire(ctx, inode, h.writer, h.append)
+		}
+	}
 	return h.fh
 }
 
@@ -225,6 +245,9 @@ func releaseFileHandle(ino Ino, fh uint64) {
 		h.writing = 1 // for remove
 		h.Unlock()
 		h.Close()
+		if h.delegation != nil {
+			delegs.release(ino, h.delegation, h.append)
+		}
 		releaseHandle(ino, fh)
 	}
 }
@@ -0,0 +1,114 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package vfs
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/meta"
+)
+
+// HealthCheck is the result of checking a component of the mount.
+type HealthCheck struct {
+	Name    string
+	OK      bool
+	Latency float64 // seconds
+	Error   string  `json:",omitempty"`
+}
+
+// Health is the results of all the checks, it's healthy only if all of them are OK.
+type Health struct {
+	OK     bool
+	Checks []*HealthCheck
+}
+
+type namedCheck struct {
+	name  string
+	check func() error
+}
+
+var (
+	checkersMu sync.Mutex
+	checkers   = []namedCheck{{"meta", checkMeta}}
+)
+
+// RegisterHealthCheck adds a check which is run by CheckHealth, e.g. for the object storage.
+func RegisterHealthCheck(name string, check func() error) {
+	checkersMu.Lock()
+	defer checkersMu.Unlock()
+	checkers = append(checkers, namedCheck{name, check})
+}
+
+func checkMeta() error {
+	var attr Attr
+	if st := m.GetAttr(meta.Background, 1, &attr); st != 0 {
+		return st
+	}
+	return nil
+}
+
+// RunHealthCheck runs a check with timeout, the check keeps running in background after timeout.
+func RunHealthCheck(name string, check func() error, timeout time.Duration) *HealthCheck {
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() { done <- check() }()
+	var err error
+	select {
+	case err = <-done:
+	case <-time.After(timeout):
+		err = fmt.Errorf("timeout after %s", timeout)
+	}
+	c := &HealthCheck{Name: name, OK: err == nil, Latency: time.Since(start).Seconds()}
+	if err != nil {
+		c.Error = err.Error()
+	}
+	return c
+}
+
+// CheckHealth runs all the registered checks in parallel.
+func CheckHealth(timeout time.Duration) *Health {
+	checkersMu.Lock()
+	cs := append([]namedCheck{}, checkers...)
+	checkersMu.Unlock()
+	h := &Health{OK: true, Checks: make([]*HealthCheck, len(cs))}
+	var wg sync.WaitGroup
+	for i, c := range cs {
+		wg.Add(1)
+		go func(i int, c namedCheck) {
+			defer wg.Done()
+			h.Checks[i] = RunHealthCheck(c.name, c.check, timeout)
+		}(i, c)
+	}
+	wg.Wait()
+	for _, c := range h.Checks {
+		h.OK = h.OK && c.OK
+	}
+	return h
+}
+
+// healthTimeout is the timeout of checks when .health is read.
+const healthTimeout = time.Second * 10
+
+// healthReport returns the health in JSON for .health, the FUSE loop is OK if it's read.
+func healthReport() []byte {
+	h := CheckHealth(healthTimeout)
+	h.Checks = append([]*HealthCheck{{Name: "fuse", OK: true}}, h.Checks...)
+	data, _ := json.MarshalIndent(h, "", "  ")
+	return append(data, '\n')
+}
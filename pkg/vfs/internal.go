@@ -16,10 +16,15 @@
 package vfs
 
 import (
+	"encoding/json"
 	"os"
+	"strings"
 	"syscall"
 	"time"
 
+	"github.com/juicedata/juicefs/pkg/chunk"
+	"github.com/juicedata/juicefs/pkg/fault"
+	"github.com/juicedata/juicefs/pkg/jobs"
 	"github.com/juicedata/juicefs/pkg/meta"
 	"github.com/juicedata/juicefs/pkg/utils"
 )
@@ -28,6 +33,7 @@ const (
 	minInternalNode = 0x7FFFFFFFFFFFF0
 	logInode        = minInternalNode + 1
 	controlInode    = minInternalNode + 2
+	healthInode     = minInternalNode + 3
 )
 
 type internalNode struct {
@@ -39,6 +45,7 @@ type internalNode struct {
 var internalNodes = []*internalNode{
 	{logInode, ".accesslog", &Attr{Mode: 0400}},
 	{controlInode, ".control", &Attr{Mode: 0666}},
+	{healthInode, ".health", &Attr{Mode: 0444}},
 }
 
 func init() {
@@ -64,6 +71,9 @@ func isSpecialName(name string) bool {
 	if name[0] != '.' {
 		return false
 	}
+	if name == versionsName {
+		return true
+	}
 	for _, n := range internalNodes {
 		if name == n.name {
 			return true
@@ -93,6 +103,59 @@ func getInternalNodeByName(name string) *internalNode {
 	return nil
 }
 
+// FileInfo is the response of meta.Info.
+type FileInfo struct {
+	Summary       meta.Summary
+	Fragmentation meta.Fragmentation
+}
+
+// PinResult is the response of meta.Pin.
+type PinResult struct {
+	Blocks int // blocks pinned or unpinned
+	Stats  chunk.PinStats
+}
+
+func pinFile(ctx Context, inode Ino, pin bool, res *PinResult) (syscall.Errno, error) {
+	if pinner == nil {
+		return syscall.ENOTSUP, chunk.ErrPinDisabled
+	}
+	var attr Attr
+	if st := m.GetAttr(ctx, inode, &attr); st != 0 {
+		return st, nil
+	}
+	if attr.Typ != meta.TypeFile {
+		return 0, nil
+	}
+	for indx := uint32(0); uint64(indx)*meta.ChunkSize < attr.Length; indx++ {
+		var slices []meta.Slice
+		if st := m.Read(ctx, inode, indx, &slices); st != 0 {
+			return st, nil
+		}
+		for _, s := range slices {
+			if s.Chunkid == 0 {
+				continue
+			}
+			if !pin {
+				res.Blocks += pinner.Unpin(s.Chunkid, int(s.Size), int(s.Off), int(s.Len))
+				continue
+			}
+			n, err := pinner.Pin(s.Chunkid, int(s.Size), int(s.Off), int(s.Len))
+			res.Blocks += n
+			switch err {
+			case nil:
+			case chunk.ErrPinFull:
+				return syscall.ENOSPC, err
+			case chunk.ErrPinDisabled:
+				return syscall.ENOTSUP, err
+			default:
+				logger.Warnf("pin blocks of chunk %d: %s", s.Chunkid, err)
+				return syscall.EIO, err
+			}
+		}
+	}
+	return 0, nil
+}
+
 func handleInternalMsg(ctx Context, msg []byte) []byte {
 	r := utils.ReadBuffer(msg)
 	cmd := r.Get32()
@@ -107,6 +170,86 @@ func handleInternalMsg(ctx Context, msg []byte) []byte {
 		name := string(r.Get(int(r.Get8())))
 		r := m.Rmr(ctx, inode, name)
 		return []byte{uint8(r)}
+	case meta.Fault:
+		// set (1) or list (0) the rules, which are separated by newline
+		set := r.Get8() == 1
+		specs := string(r.Get(r.Left()))
+		if !fault.Enabled {
+			return []byte{uint8(syscall.ENOTSUP & 0xff)}
+		}
+		if set {
+			if err := fault.Set(strings.Split(specs, "\n")); err != nil {
+				logger.Warnf("set faults: %s", err)
+				return append([]byte{uint8(syscall.EINVAL & 0xff)}, err.Error()...)
+			}
+			logger.Infof("faults are injected: %q", specs)
+		}
+		return append([]byte{0}, strings.Join(fault.List(), "\n")...)
+	case meta.Info:
+		inode := Ino(r.Get64())
+		var info FileInfo
+		if st := m.Summary(ctx, inode, &info.Summary); st != 0 {
+			return []byte{uint8(st)}
+		}
+		if st := m.Fragmentation(ctx, inode, &info.Fragmentation); st != 0 {
+			return []byte{uint8(st)}
+		}
+		data, _ := json.Marshal(&info)
+		return append([]byte{0}, data...)
+	case meta.Jobs:
+		// list (0), pause (1) or resume (2) the jobs, which are separated by newline, empty means all
+		op := r.Get8()
+		var names []string
+		if r.Left() > 0 {
+			names = strings.Split(string(r.Get(r.Left())), "\n")
+		}
+		var err error
+		switch op {
+		case 1:
+			logger.Infof("pause background jobs: %v", names)
+			err = jobs.Pause(names...)
+		case 2:
+			logger.Infof("resume background jobs: %v", names)
+			err = jobs.Resume(names...)
+		}
+		if err != nil {
+			return append([]byte{uint8(syscall.EINVAL & 0xff)}, err.Error()...)
+		}
+		data, _ := json.Marshal(jobs.List())
+		return append([]byte{0}, data...)
+	case meta.Pin:
+		// unpin (0) or pin (1) the blocks of a file
+		inode := Ino(r.Get64())
+		pin := r.Get8() == 1
+		var res PinResult
+		st, err := pinFile(ctx, inode, pin, &res)
+		if st != 0 {
+			if err != nil {
+				return append([]byte{uint8(st)}, err.Error()...)
+			}
+			return []byte{uint8(st)}
+		}
+		res.Stats = pinner.PinStats()
+		data, _ := json.Marshal(&res)
+		return append([]byte{0}, data...)
+	case meta.Consumers:
+		data, _ := json.Marshal(Consumers())
+		return append([]byte{0}, data...)
+	case meta.Freeze:
+		// unfreeze (0) or freeze (1) with the timeout in seconds
+		freeze := r.Get8() == 1
+		timeout := time.Duration(r.Get32()) * time.Second
+		if freeze {
+			if st := Freeze(ctx, timeout); st != 0 {
+				return []byte{uint8(st)}
+			}
+		} else if Unfreeze() {
+			logger.Infof("unfrozen")
+		} else {
+			return append([]byte{uint8(syscall.EINVAL & 0xff)}, "not frozen"...)
+		}
+		data, _ := json.Marshal(GetFreezeState())
+		return append([]byte{0}, data...)
 	default:
 		logger.Warnf("unknown message type: %d", cmd)
 		return []byte{uint8(syscall.EINVAL & 0xff)}
@@ -27,6 +27,7 @@ import (
 
 	"github.com/juicedata/juicefs/pkg/chunk"
 	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/juicedata/juicefs/pkg/trace"
 	"github.com/juicedata/juicefs/pkg/utils"
 )
 
@@ -98,6 +99,7 @@ type sliceReader struct {
 	currentPos uint32
 	lastAccess time.Time
 	refs       uint16
+	trace      string // trace id of the read which started it
 	cond       *utils.Cond
 	next       *sliceReader
 	prev       **sliceReader
@@ -172,7 +174,14 @@ func (s *sliceReader) run() {
 	length := f.length
 	f.Unlock()
 	var chunks []meta.Slice
-	err := f.r.m.Read(meta.Background, inode, indx, &chunks)
+	var inline []byte
+	var err syscall.Errno
+	if f.r.isInline(indx, s.block.off) {
+		err = f.r.m.ReadInline(meta.Background, inode, &inline)
+	}
+	if err == 0 && inline == nil {
+		err = f.r.m.Read(meta.Background, inode, indx, &chunks)
+	}
 	f.Lock()
 	if s.state != BUSY || f.err != 0 || f.closing {
 		s.done(0, 0)
@@ -205,8 +214,13 @@ func (s *sliceReader) run() {
 	p := s.page.Slice(0, int(need))
 	defer p.Release()
 	var n int
-	ctx := context.TODO()
-	n = f.r.Read(ctx, p, chunks, (uint32(s.block.off))%meta.ChunkSize)
+	var rerr error
+	ctx := trace.WithID(context.TODO(), s.trace)
+	if inline != nil {
+		n = readInline(p, inline, s.block.off)
+	} else {
+		n, rerr = f.r.Read(ctx, p, chunks, (uint32(s.block.off))%meta.ChunkSize)
+	}
 
 	f.Lock()
 	if s.state != BUSY || f.shouldStop() {
@@ -223,7 +237,7 @@ func (s *sliceReader) run() {
 		err = syscall.EIO
 		f.tried++
 		// ind.r.m.InvalidateChunkCache(inode, chindx)
-		if f.tried >= f.r.maxRetries {
+		if f.tried >= f.r.maxRetries || rerr == chunk.ErrUnreachable {
 			s.done(err, 0)
 		} else {
 			s.done(0, retry_time(f.tried))
@@ -290,6 +304,10 @@ type fileReader struct {
 	sessions [readSessions]session
 	slices   *sliceReader
 	last     **sliceReader
+	cindx    uint32       // index of chunk in cslices
+	cslices  []meta.Slice // slices of recently spliced chunk
+	cgen     uint32       // bumped when cslices is invalidated
+	trace    string       // trace id of the current read
 
 	sync.Mutex
 	closing bool
@@ -304,6 +322,7 @@ type fileReader struct {
 func (f *fileReader) newSlice(block *frange) *sliceReader {
 	s := &sliceReader{}
 	s.file = f
+	s.trace = f.trace
 	s.lastAccess = time.Now()
 	s.indx = uint32(block.off / meta.ChunkSize)
 	s.block = &frange{block.off, block.len} // random read
@@ -534,7 +553,7 @@ func (f *fileReader) readAhead(block *frange) {
 			block.off = r.block.end()
 		}
 	})
-	if block.len > 0 && block.off < f.length && uint64(atomic.LoadInt64(&readBufferUsed)) < f.r.readAheadTotal {
+	if block.len > 0 && block.off < f.length && uint64(atomic.LoadInt64(&readBufferUsed)) < f.r.readAheadTotal && f.r.buffer.readAvailable(block.len) {
 		if block.len < f.r.blockSize {
 			block.len += f.r.blockSize - block.end()%f.r.blockSize // align to end of a block
 		}
@@ -637,6 +656,7 @@ func (f *fileReader) Read(ctx meta.Context, offset uint64, buf []byte) (int, sys
 		block.len = f.length - block.off
 	}
 
+	f.trace = trace.IDOf(ctx)
 	f.cleanupRequests(block)
 	var lastBS uint64 = 32 << 10
 	if block.off+lastBS > f.length {
@@ -661,9 +681,75 @@ func (f *fileReader) Read(ctx meta.Context, offset uint64, buf []byte) (int, sys
 	return f.waitForIO(ctx, reqs, buf)
 }
 
+// readCached returns the cached file region which contains the data of
+// requested range, n is zero if it's not fully cached.
+func (f *fileReader) readCached(ctx meta.Context, offset uint64, size uint32) (fd uintptr, foff int64, n int) {
+	f.Lock()
+	defer f.Unlock()
+	if f.err != 0 || f.closing || offset >= f.length || size == 0 {
+		return
+	}
+	if offset+uint64(size) > f.length {
+		size = uint32(f.length - offset)
+	}
+	indx := uint32(offset / meta.ChunkSize)
+	pos := uint32(offset % meta.ChunkSize)
+	if pos+size > meta.ChunkSize || f.r.isInline(indx, offset) {
+		return
+	}
+	if f.cslices == nil || f.cindx != indx {
+		var slices []meta.Slice
+		gen := f.cgen
+		f.Unlock()
+		err := f.r.m.Read(ctx, f.inode, indx, &slices)
+		f.Lock()
+		if err != 0 || f.closing || gen != f.cgen {
+			return
+		}
+		f.cindx, f.cslices = indx, slices
+	}
+	var start uint32
+	for _, s := range f.cslices {
+		if pos < start+s.Len {
+			if s.Chunkid == 0 || pos+size > start+s.Len {
+				return
+			}
+			r := f.r.store.NewReader(s.Chunkid, int(s.Size))
+			if sr, ok := r.(chunk.SpliceReader); ok {
+				var err error
+				if fd, foff, err = sr.CachedFile(int(s.Off+pos-start), int(size)); err == nil {
+					n = int(size)
+				}
+			}
+			return
+		}
+		start += s.Len
+	}
+	return
+}
+
+// readInline fills the page with the data of a small file which is stored in meta.
+func readInline(p *chunk.Page, data []byte, off uint64) int {
+	var n int
+	if off < uint64(len(data)) {
+		n = copy(p.Data, data[off:])
+	}
+	for i := n; i < len(p.Data); i++ {
+		p.Data[i] = 0
+	}
+	return len(p.Data)
+}
+
+// protected by f
+func (f *fileReader) invalidateCached() {
+	f.cslices = nil
+	f.cgen++
+}
+
 func (f *fileReader) Truncate(length uint64) {
 	f.Lock()
 	f.length = length
+	f.invalidateCached()
 	f.Unlock()
 }
 
@@ -693,8 +779,15 @@ type dataReader struct {
 	blockSize      uint64
 	readAheadMax   uint64
 	readAheadTotal uint64
+	buffer         *bufferPool
 	maxRequests    int
 	maxRetries     uint32
+	inlineSize     uint64
+}
+
+// isInline returns whether the data at off could be stored in meta.
+func (r *dataReader) isInline(indx uint32, off uint64) bool {
+	return indx == 0 && off < r.inlineSize
 }
 
 func NewDataReader(conf *Config, m meta.Meta, store chunk.ChunkStore) DataReader {
@@ -712,10 +805,14 @@ func NewDataReader(conf *Config, m meta.Meta, store chunk.ChunkStore) DataReader
 		files:          make(map[Ino]*fileReader),
 		blockSize:      uint64(conf.Chunk.BlockSize),
 		readAheadTotal: uint64(readAheadTotal),
+		buffer:         getBufferPool(conf),
 		readAheadMax:   uint64(readAheadMax),
 		maxRequests:    readAheadMax/conf.Chunk.BlockSize*readSessions + 1,
 		maxRetries:     uint32(conf.Meta.IORetries),
 	}
+	if conf.Format != nil {
+		r.inlineSize = uint64(conf.Format.InlineSize)
+	}
 	go r.checkReadBuffer()
 	return r
 }
@@ -772,6 +869,7 @@ func (r *dataReader) visit(inode Ino, fn func(*fileReader)) {
 func (r *dataReader) Truncate(inode Ino, length uint64) {
 	r.visit(inode, func(f *fileReader) {
 		f.length = length
+		f.invalidateCached()
 	})
 }
 
@@ -781,6 +879,7 @@ func (r *dataReader) Invalidate(inode Ino, off, length uint64) {
 		if off+length > f.length {
 			f.length = off + length
 		}
+		f.invalidateCached()
 		f.visit(func(s *sliceReader) {
 			if b.overlap(s.block) {
 				s.invalidate()
@@ -816,7 +915,7 @@ func (r *dataReader) readSlice(ctx context.Context, s *meta.Slice, page *chunk.P
 	return nil
 }
 
-func (r *dataReader) Read(ctx context.Context, page *chunk.Page, chunks []meta.Slice, offset uint32) int {
+func (r *dataReader) Read(ctx context.Context, page *chunk.Page, chunks []meta.Slice, offset uint32) (int, error) {
 	if len(chunks) > 16 {
 		return r.readManyChunks(ctx, page, chunks, offset)
 	}
@@ -852,12 +951,12 @@ func (r *dataReader) Read(ctx context.Context, page *chunk.Page, chunks []meta.S
 		waits--
 	}
 	if err != nil {
-		return 0
+		return 0, err
 	}
-	return read
+	return read, nil
 }
 
-func (r *dataReader) readManyChunks(ctx context.Context, page *chunk.Page, chunks []meta.Slice, offset uint32) int {
+func (r *dataReader) readManyChunks(ctx context.Context, page *chunk.Page, chunks []meta.Slice, offset uint32) (int, error) {
 	read := 0
 	var pos uint32
 	var err error
@@ -904,11 +1003,11 @@ CHUNKS:
 		waits--
 	}
 	if err != nil {
-		return 0
+		return 0, err
 	}
 	for read < size {
 		buf[read] = 0
 		read++
 	}
-	return read
+	return read, nil
 }
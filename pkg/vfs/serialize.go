@@ -0,0 +1,130 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package vfs
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// SerializeXattr is the extended attribute of a directory to serialize the writes to the files
+// in it across clients, the value is true or false. Every write acquires the write token of the
+// file from the meta service, and the data is committed before the token is released, so the
+// writes by different clients (e.g. many pods appending to one CSV) are never interleaved, at
+// the cost of latency. It's inherited by the new sub-directories.
+const SerializeXattr = "juicefs.serialize"
+
+const tokenTTL = time.Second * 30 // the token of a client which is gone is taken over after it
+
+// Serialized returns true if the writes to the files in a directory should be serialized.
+func Serialized(ctx Context, dir Ino) bool {
+	if dw, ok := writer.(*dataWriter); ok {
+		serial, _ := strconv.ParseBool(dw.dirs.get(ctx, dir, SerializeXattr))
+		return serial
+	}
+	return false
+}
+
+type writeToken struct {
+	sync.Mutex
+	refs int
+}
+
+// writeTokens serializes the writes to the same file from this client, and acquires the token
+// of the file from the meta service to serialize them with other clients.
+type writeTokens struct {
+	sync.Mutex
+	files map[Ino]*writeToken
+}
+
+var tokens = &writeTokens{files: make(map[Ino]*writeToken)}
+
+func tokenName(inode Ino) string {
+	return fmt.Sprintf("write:%d", inode)
+}
+
+// acquire waits for the write token of a file, the returned function releases it.
+func (t *writeTokens) acquire(ctx Context, inode Ino) (func(), syscall.Errno) {
+	t.Lock()
+	tk := t.files[inode]
+	if tk == nil {
+		tk = &writeToken{}
+		t.files[inode] = tk
+	}
+	tk.refs++
+	t.Unlock()
+	done := func() {
+		t.Lock()
+		if tk.refs--; tk.refs == 0 {
+			delete(t.files, inode)
+		}
+		t.Unlock()
+	}
+
+	tk.Lock()
+	wait := time.Millisecond
+	for {
+		ok, err := m.Lease(tokenName(inode), tokenTTL)
+		if err != nil {
+			logger.Warnf("acquire write token of inode %d: %s", inode, err)
+		}
+		if ok {
+			break
+		}
+		if ctx.Canceled() {
+			tk.Unlock()
+			done()
+			return nil, syscall.EINTR
+		}
+		time.Sleep(wait)
+		if wait < time.Millisecond*100 {
+			wait *= 2
+		}
+	}
+	return func() {
+		if _, err := m.Lease(tokenName(inode), 0); err != nil {
+			logger.Warnf("release write token of inode %d: %s", inode, err)
+		}
+		tk.Unlock()
+		done()
+	}, 0
+}
+
+// serialWrite writes the data while the write token of the file is held, and commits it before
+// the token is released, the offset of O_APPEND writes is reserved at the end of the file.
+func serialWrite(ctx Context, h *handle, ino Ino, buf []byte, off *uint64) syscall.Errno {
+	release, err := tokens.acquire(ctx, ino)
+	if err != 0 {
+		return err
+	}
+	defer release()
+	size := uint64(len(buf))
+	if h.append {
+		if err = m.Reserve(ctx, ino, size, off); err != 0 {
+			return err
+		}
+		if *off+size >= maxFileSize {
+			return syscall.EFBIG
+		}
+	}
+	if err = h.writer.Write(ctx, *off, buf); err != 0 {
+		return err
+	}
+	return h.writer.Flush(ctx)
+}
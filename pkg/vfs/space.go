@@ -0,0 +1,73 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package vfs
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	spaceFullSeconds = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "space_full_seconds",
+		Help: "Seconds when the available space is below the grace buffer.",
+	})
+)
+
+// spaceChecker rejects new writes early when the available space of the volume
+// is less than the grace buffer, so the data already buffered can still be
+// committed before the capacity is reached, which is checked by meta.
+type spaceChecker struct {
+	grace uint64
+	full  int32
+}
+
+func newSpaceChecker(grace uint64) *spaceChecker {
+	s := &spaceChecker{grace: grace}
+	s.refresh()
+	go func() {
+		for {
+			time.Sleep(time.Second)
+			if s.refresh() {
+				spaceFullSeconds.Add(1)
+			}
+		}
+	}()
+	return s
+}
+
+// refresh updates the cached state from meta, returns whether it's full.
+func (s *spaceChecker) refresh() bool {
+	var totalspace, availspace, iused, iavail uint64
+	if st := m.StatFS(meta.Background, &totalspace, &availspace, &iused, &iavail); st != 0 {
+		return atomic.LoadInt32(&s.full) == 1
+	}
+	var full int32
+	if availspace <= s.grace {
+		full = 1
+	}
+	if atomic.SwapInt32(&s.full, full) != full {
+		logger.Infof("available space %d, grace %d: full = %v", availspace, s.grace, full == 1)
+	}
+	return full == 1
+}
+
+func (s *spaceChecker) isFull() bool {
+	return s != nil && atomic.LoadInt32(&s.full) == 1
+}
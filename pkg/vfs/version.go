@@ -0,0 +1,251 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package vfs
+
+import (
+	"fmt"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/jobs"
+	"github.com/juicedata/juicefs/pkg/meta"
+)
+
+// The previous versions of files are kept if VersionDays is set in format. Before a
+// file is truncated, overwritten in place (the first time by a handle), replaced by rename
+// or unlinked (the last link), it's cloned into /.jfs-versions/YYYYMMDD-HH/UID/NAME@HHMMSS.mmm-INODE,
+// which shares the slices with the original file, so the old data is kept after it's
+// overwritten or deleted. The directory of UID is only accessible by the owner of files,
+// since the directories of the original ones are not checked. The versions are read-only
+// and removed by the leader after the days. The files opened by inode (e.g. through NFS)
+// are named by inode if their names are not seen.
+
+const (
+	versionsName = ".jfs-versions"
+	maxNames     = 10000
+)
+
+type versioner struct {
+	sync.Mutex
+	days  int
+	root  Ino            // inode of .jfs-versions
+	dirs  map[string]Ino // the directories of owners in hours, as "HOUR/UID"
+	names map[Ino]string // the names of files seen in lookup or create
+}
+
+var versions *versioner
+
+func newVersioner(days int) *versioner {
+	return &versioner{days: days, dirs: make(map[string]Ino), names: make(map[Ino]string)}
+}
+
+// remember remembers the name of a file for its versions.
+func (v *versioner) remember(ino Ino, name string) {
+	v.Lock()
+	defer v.Unlock()
+	if len(v.names) >= maxNames {
+		for i := range v.names {
+			delete(v.names, i)
+			break
+		}
+	}
+	v.names[ino] = name
+}
+
+func (v *versioner) lookupDir(parent Ino, name string, mode uint16) (Ino, *Attr, syscall.Errno) {
+	var ino Ino
+	var attr Attr
+	st := m.Mkdir(meta.Background, parent, name, mode, 0, 0, &ino, &attr)
+	if st == syscall.EEXIST {
+		st = m.Lookup(meta.Background, parent, name, &ino, &attr)
+	}
+	return ino, &attr, st
+}
+
+// dir returns the directory to keep the versions of files owned by uid in the hour of t.
+func (v *versioner) dir(t time.Time, uid, gid uint32) (Ino, syscall.Errno) {
+	v.Lock()
+	defer v.Unlock()
+	var st syscall.Errno
+	if v.root == 0 {
+		if v.root, _, st = v.lookupDir(rootID, versionsName, 0555); st != 0 {
+			v.root = 0
+			return 0, st
+		}
+	}
+	hour := t.Format("20060102-15")
+	key := fmt.Sprintf("%s/%d", hour, uid)
+	if ino, ok := v.dirs[key]; ok {
+		return ino, 0
+	}
+	hdir, _, st := v.lookupDir(v.root, hour, 0555)
+	if st != 0 {
+		return 0, st
+	}
+	ino, attr, st := v.lookupDir(hdir, fmt.Sprint(uid), 0700)
+	if st != 0 {
+		return 0, st
+	}
+	if attr.Uid != uid || attr.Gid != gid {
+		attr.Uid, attr.Gid = uid, gid
+		if st = m.SetAttr(meta.Background, ino, meta.SetAttrUID|meta.SetAttrGID, 0, attr); st != 0 {
+			return 0, st
+		}
+	}
+	if len(v.dirs) > 1000 {
+		v.dirs = make(map[string]Ino)
+	}
+	v.dirs[key] = ino
+	return ino, 0
+}
+
+func (v *versioner) clone(ino, vino Ino, attr *Attr) syscall.Errno {
+	ctx := meta.Background
+	var copied uint64
+	st := m.CopyFileRange(ctx, ino, 0, vino, 0, attr.Length, 0, &copied)
+	if st == syscall.ENOTSUP {
+		var data []byte
+		if st = m.ReadInline(ctx, ino, &data); st == 0 {
+			st = m.WriteInline(ctx, vino, data)
+		}
+	}
+	if st != 0 {
+		return st
+	}
+	a := *attr
+	if st = m.SetAttr(ctx, vino, meta.SetAttrUID|meta.SetAttrGID, 0, &a); st != 0 {
+		return st
+	}
+	a = *attr
+	a.Flags |= meta.FlagReadOnly
+	return m.SetAttr(ctx, vino, meta.SetAttrMode|meta.SetAttrMtime|meta.SetAttrFlag, 0, &a)
+}
+
+func noop() {}
+
+// save keeps the current version of a file if it has any data, name is empty if it's unknown.
+// The returned function removes the version, it should be called if the file is not changed.
+func (v *versioner) save(ctx Context, ino Ino, name string) (discard func()) {
+	writer.Flush(ctx, ino)
+	var attr Attr
+	if m.GetAttr(ctx, ino, &attr) != 0 || attr.Typ != meta.TypeFile || attr.Length == 0 || attr.Flags&meta.FlagReadOnly != 0 {
+		return noop
+	}
+	v.Lock()
+	if name == "" {
+		name = v.names[ino]
+	} else {
+		v.names[ino] = name
+	}
+	v.Unlock()
+	if name == "" {
+		name = fmt.Sprint(ino)
+	}
+	now := time.Now()
+	dir, st := v.dir(now, attr.Uid, attr.Gid)
+	if st != 0 {
+		logger.Warnf("create directory of versions: %s", st)
+		return noop
+	}
+	var vname string
+	var vino Ino
+	var vattr Attr
+	for i := 0; ; i++ {
+		suffix := fmt.Sprintf("@%s-%d", now.Format("150405.000"), ino)
+		if i > 0 {
+			suffix += fmt.Sprintf("-%d", i) // saved in the same millisecond
+		}
+		if len(name)+len(suffix) > maxName {
+			name = name[:maxName-len(suffix)]
+		}
+		vname = name + suffix
+		if st = m.Mknod(meta.Background, dir, vname, meta.TypeFile, attr.Mode, 0, 0, &vino, &vattr); st != syscall.EEXIST || i >= 10 {
+			break
+		}
+	}
+	if st != 0 {
+		logger.Warnf("create version %s of inode %d: %s", vname, ino, st)
+		return noop
+	}
+	discard = func() { _ = m.Unlink(meta.Background, dir, vname) }
+	if st = v.clone(ino, vino, &attr); st != 0 {
+		logger.Warnf("clone inode %d into version %s: %s", ino, vname, st)
+		discard()
+		return noop
+	}
+	return discard
+}
+
+// saveOverwrite keeps the current version of a file before it's overwritten in place by a handle
+// for the first time, the handle should be locked for writing.
+func (v *versioner) saveOverwrite(ctx Context, h *handle, off uint64) {
+	if h.versioned || off >= writer.GetLength(h.inode) {
+		return
+	}
+	h.versioned = true
+	v.save(ctx, h.inode, "")
+}
+
+// saveEntry keeps the current version of the file in a directory, if it's the last link.
+func (v *versioner) saveEntry(ctx Context, parent Ino, name string) (discard func()) {
+	var ino Ino
+	var attr Attr
+	if m.Lookup(ctx, parent, name, &ino, &attr) == 0 && attr.Typ == meta.TypeFile && attr.Nlink == 1 {
+		return v.save(ctx, ino, name)
+	}
+	return noop
+}
+
+// expire removes the directories of versions older than the days.
+func (v *versioner) expire() {
+	ctx := meta.Background
+	var root Ino
+	var attr Attr
+	if m.Lookup(ctx, rootID, versionsName, &root, &attr) != 0 {
+		return
+	}
+	var entries []*meta.Entry
+	if st := m.Readdir(ctx, root, 0, &entries); st != 0 {
+		logger.Warnf("readdir of %s: %s", versionsName, st)
+		return
+	}
+	deadline := time.Now().Add(-time.Hour * 24 * time.Duration(v.days))
+	for _, e := range entries {
+		hour, err := time.ParseInLocation("20060102-15", string(e.Name), time.Local)
+		if err != nil || !hour.Add(time.Hour).Before(deadline) {
+			continue
+		}
+		if st := m.Rmr(ctx, root, string(e.Name)); st != 0 {
+			logger.Warnf("remove versions in %s: %s", e.Name, st)
+			continue
+		}
+		v.Lock()
+		v.dirs = make(map[string]Ino)
+		v.Unlock()
+		logger.Infof("Removed the versions in %s, which are older than %d days", e.Name, v.days)
+	}
+}
+
+func (v *versioner) expireVersions() {
+	for {
+		time.Sleep(time.Minute * 10)
+		if jobs.TryStart(jobs.Cleanup) {
+			v.expire()
+			jobs.Done(jobs.Cleanup)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package vfs
+
+import (
+	"syscall"
+	"testing"
+
+	"github.com/juicedata/juicefs/pkg/chunk"
+	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/juicedata/juicefs/pkg/object"
+)
+
+// listVersions returns the versions of files owned by uid 1000.
+func listVersions(t *testing.T) []*meta.Entry {
+	ctx := meta.Background
+	var root Ino
+	var attr Attr
+	if st := m.Lookup(ctx, rootID, versionsName, &root, &attr); st != 0 {
+		return nil
+	}
+	var hours, versions []*meta.Entry
+	if st := m.Readdir(ctx, root, 1, &hours); st != 0 {
+		t.Fatalf("readdir of versions: %s", st)
+	}
+	for _, h := range hours {
+		if string(h.Name) == "." || string(h.Name) == ".." {
+			continue
+		}
+		var dir Ino
+		if st := m.Lookup(ctx, h.Inode, "1000", &dir, &attr); st != 0 {
+			t.Fatalf("lookup owner in %s: %s", h.Name, st)
+		}
+		if attr.Mode&0777 != 0700 || attr.Uid != 1000 || attr.Gid != 1000 {
+			t.Fatalf("directory of owner should only be accessible by it: mode %o, uid %d, gid %d", attr.Mode&0777, attr.Uid, attr.Gid)
+		}
+		var entries []*meta.Entry
+		if st := m.Readdir(ctx, dir, 1, &entries); st != 0 {
+			t.Fatalf("readdir of owner: %s", st)
+		}
+		for _, e := range entries {
+			if string(e.Name) != "." && string(e.Name) != ".." {
+				versions = append(versions, e)
+			}
+		}
+	}
+	return versions
+}
+
+// initVFS initializes the VFS with a volume in memory.
+func initVFS(t *testing.T, format meta.Format) {
+	mc, err := meta.NewClient("memkv://test", &meta.RedisConfig{})
+	if err != nil {
+		t.Fatalf("create meta: %s", err)
+	}
+	_ = mc.Init(format, true)
+	blob, _ := object.CreateStorage("mem", "", "", "")
+	chunkConf := chunk.Config{BlockSize: format.BlockSize << 10, MaxUpload: 1, CacheDir: "memory", BufferSize: 100 << 20}
+	Init(&Config{Meta: &meta.Config{}, Format: &format, Chunk: &chunkConf}, mc, chunk.NewCachedStore(blob, chunkConf))
+}
+
+func TestVersions(t *testing.T) {
+	initVFS(t, meta.Format{Name: "test", BlockSize: 4, VersionDays: 1})
+	defer func() { versions = nil }()
+
+	ctx := NewLogContext(meta.NewContext(1, 1000, []uint32{1000}))
+	dir, err := Mkdir(ctx, rootID, "private", 0700, 0)
+	if err != 0 {
+		t.Fatalf("mkdir: %s", err)
+	}
+	f, fh, err := Create(ctx, dir.Inode, "f", 0644, 0, syscall.O_RDWR)
+	if err != 0 {
+		t.Fatalf("create: %s", err)
+	}
+	if err = Write(ctx, f.Inode, []byte("hello"), 0, fh); err != 0 {
+		t.Fatalf("write: %s", err)
+	}
+	if err = Write(ctx, f.Inode, []byte("HE"), 0, fh); err != 0 {
+		t.Fatalf("overwrite: %s", err)
+	}
+	_ = Flush(ctx, f.Inode, fh, 0)
+	_ = Release(ctx, f.Inode, fh)
+	if vs := listVersions(t); len(vs) != 0 {
+		t.Fatalf("a new file should not be versioned: %d", len(vs))
+	}
+
+	// overwritten in place
+	_, fh, err = Open(ctx, f.Inode, syscall.O_RDWR)
+	if err != 0 {
+		t.Fatalf("open: %s", err)
+	}
+	if err = Write(ctx, f.Inode, []byte("!"), 5, fh); err != 0 {
+		t.Fatalf("append: %s", err)
+	}
+	if vs := listVersions(t); len(vs) != 0 {
+		t.Fatalf("appending should not be versioned: %d", len(vs))
+	}
+	for i := 0; i < 2; i++ {
+		if err = Write(ctx, f.Inode, []byte("J"), 0, fh); err != 0 {
+			t.Fatalf("overwrite: %s", err)
+		}
+	}
+	_ = Flush(ctx, f.Inode, fh, 0)
+	_ = Release(ctx, f.Inode, fh)
+	vs := listVersions(t)
+	if len(vs) != 1 {
+		t.Fatalf("expect 1 version after overwritten, but got %d", len(vs))
+	}
+	if a := vs[0].Attr; a.Length != 6 || a.Uid != 1000 || a.Flags&meta.FlagReadOnly == 0 {
+		t.Fatalf("unexpected version: length %d, uid %d, flags %d", a.Length, a.Uid, a.Flags)
+	}
+
+	// renamed with flags
+	g, fh, err := Create(ctx, dir.Inode, "g", 0644, 0, syscall.O_RDWR)
+	if err != 0 {
+		t.Fatalf("create: %s", err)
+	}
+	_ = Release(ctx, g.Inode, fh)
+	if err = Rename(ctx, dir.Inode, "g", dir.Inode, "f", RenameExchange); err != syscall.ENOTSUP {
+		t.Fatalf("rename exchange: %s", err)
+	}
+	if err = Rename(ctx, dir.Inode, "g", dir.Inode, "f", RenameNoReplace); err != syscall.EEXIST {
+		t.Fatalf("rename noreplace: %s", err)
+	}
+	if vs := listVersions(t); len(vs) != 1 {
+		t.Fatalf("rename with flags should not be versioned: %d", len(vs))
+	}
+	if err = Rename(ctx, dir.Inode, "g", dir.Inode, "h", RenameNoReplace); err != 0 {
+		t.Fatalf("rename noreplace to new name: %s", err)
+	}
+
+	if err = Unlink(ctx, dir.Inode, "f"); err != 0 {
+		t.Fatalf("unlink: %s", err)
+	}
+	if vs := listVersions(t); len(vs) != 2 {
+		t.Fatalf("expect 2 versions after unlinked, but got %d", len(vs))
+	}
+}
@@ -21,6 +21,7 @@ import (
 	"time"
 
 	"github.com/juicedata/juicefs/pkg/chunk"
+	"github.com/juicedata/juicefs/pkg/event"
 	"github.com/juicedata/juicefs/pkg/meta"
 	"github.com/juicedata/juicefs/pkg/utils"
 	"github.com/prometheus/client_golang/prometheus"
@@ -34,7 +35,14 @@ const (
 	rootID      = 1
 	maxName     = 255
 	maxSymlink  = 4096
-	maxFileSize = meta.ChunkSize << 31
+	maxFileSize = meta.MaxFileSize
+)
+
+// The flags of Rename, the same as renameat2(2) on Linux.
+const (
+	RenameNoReplace = meta.RenameNoReplace
+	RenameExchange  = meta.RenameExchange
+	RenameWhiteout  = meta.RenameWhiteout
 )
 
 type Config struct {
@@ -44,12 +52,21 @@ type Config struct {
 	Version    string
 	Mountpoint string
 	AccessLog  string
+
+	CapacityGrace uint64   // reject writes when the available space is less than this
+	Delegation    bool     // acquire write delegations of the opened files to cache the data longer
+	Checksum      bool     // compute the SHA256 of files after they're written and closed
+	Events        []string // send the changes of files as S3 events to these targets
+
+	buffer *bufferPool // shared by the readers and writers
 }
 
 var (
 	m      meta.Meta
 	reader DataReader
 	writer DataWriter
+	space  *spaceChecker
+	pinner chunk.Pinner
 )
 
 var (
@@ -91,6 +108,12 @@ func Lookup(ctx Context, parent Ino, name string) (entry *meta.Entry, err syscal
 	if err != 0 {
 		return
 	}
+	if versions != nil && attr.Typ == meta.TypeFile {
+		versions.remember(inode, name)
+	}
+	if events != nil {
+		events.remember(inode, parent, name)
+	}
 	UpdateLength(inode, attr)
 	entry = &meta.Entry{Inode: inode, Attr: attr}
 	return
@@ -138,6 +161,7 @@ func Mknod(ctx Context, parent Ino, name string, mode uint16, cumask uint16, rde
 	defer func() {
 		logit(ctx, "mknod (%d,%s,%s:0%04o,0x%08X): %s%s", parent, name, smode(mode), mode, rdev, strerr(err), (*Entry)(entry))
 	}()
+	defer beginModify()()
 	if parent == rootID && isSpecialName(name) {
 		err = syscall.EACCES
 		return
@@ -163,6 +187,7 @@ func Mknod(ctx Context, parent Ino, name string, mode uint16, cumask uint16, rde
 
 func Unlink(ctx Context, parent Ino, name string) (err syscall.Errno) {
 	defer func() { logit(ctx, "unlink (%d,%s): %s", parent, name, strerr(err)) }()
+	defer beginModify()()
 	nleng := uint8(len(name))
 	if parent == rootID && isSpecialName(name) {
 		err = syscall.EACCES
@@ -172,7 +197,20 @@ func Unlink(ctx Context, parent Ino, name string) (err syscall.Errno) {
 		err = syscall.ENAMETOOLONG
 		return
 	}
+	if versions != nil {
+		discard := versions.saveEntry(ctx, parent, name)
+		defer func() {
+			if err != 0 {
+				discard()
+			}
+		}()
+	}
 	err = m.Unlink(ctx, parent, name)
+	if err == 0 && events != nil {
+		if p, ok := events.entryPath(parent, name); ok {
+			events.removed(p)
+		}
+	}
 	return
 }
 
@@ -180,6 +218,7 @@ func Mkdir(ctx Context, parent Ino, name string, mode uint16, cumask uint16) (en
 	defer func() {
 		logit(ctx, "mkdir (%d,%s,%s:0%04o): %s%s", parent, name, smode(mode), mode, strerr(err), (*Entry)(entry))
 	}()
+	defer beginModify()()
 	nleng := uint8(len(name))
 	if parent == rootID && isSpecialName(name) {
 		err = syscall.EEXIST
@@ -194,6 +233,10 @@ func Mkdir(ctx Context, parent Ino, name string, mode uint16, cumask uint16) (en
 	var attr = &Attr{}
 	err = m.Mkdir(ctx, parent, name, mode, cumask, 0, &inode, attr)
 	if err == 0 {
+		InheritXattrs(ctx, m, writer, parent, inode)
+		if events != nil {
+			events.remember(inode, parent, name)
+		}
 		entry = &meta.Entry{Inode: inode, Attr: attr}
 	}
 	return
@@ -202,6 +245,7 @@ func Mkdir(ctx Context, parent Ino, name string, mode uint16, cumask uint16) (en
 func Rmdir(ctx Context, parent Ino, name string) (err syscall.Errno) {
 	nleng := uint8(len(name))
 	defer func() { logit(ctx, "rmdir (%d,%s): %s", parent, name, strerr(err)) }()
+	defer beginModify()()
 	if parent == rootID && isSpecialName(name) {
 		err = syscall.EACCES
 		return
@@ -219,6 +263,7 @@ func Symlink(ctx Context, path string, parent Ino, name string) (entry *meta.Ent
 	defer func() {
 		logit(ctx, "symlink (%d,%s,%s): %s%s", parent, name, path, strerr(err), (*Entry)(entry))
 	}()
+	defer beginModify()()
 	if parent == rootID && isSpecialName(name) {
 		err = syscall.EEXIST
 		return
@@ -243,8 +288,11 @@ func Readlink(ctx Context, ino Ino) (path []byte, err syscall.Errno) {
 	return
 }
 
-func Rename(ctx Context, parent Ino, name string, newparent Ino, newname string) (err syscall.Errno) {
-	defer func() { logit(ctx, "rename (%d,%s,%d,%s): %s", parent, name, newparent, newname, strerr(err)) }()
+func Rename(ctx Context, parent Ino, name string, newparent Ino, newname string, flags uint32) (err syscall.Errno) {
+	defer func() {
+		logit(ctx, "rename (%d,%s,%d,%s,%d): %s", parent, name, newparent, newname, flags, strerr(err))
+	}()
+	defer beginModify()()
 	if parent == rootID && isSpecialName(name) {
 		err = syscall.EACCES
 		return
@@ -257,8 +305,30 @@ func Rename(ctx Context, parent Ino, name string, newparent Ino, newname string)
 		err = syscall.ENAMETOOLONG
 		return
 	}
+	if flags&^RenameNoReplace != 0 {
+		err = syscall.ENOTSUP // exchange and whiteout are not supported
+		return
+	}
 
-	err = m.Rename(ctx, parent, name, newparent, newname, nil, nil)
+	if versions != nil {
+		discard := versions.saveEntry(ctx, newparent, newname)
+		defer func() {
+			if err != 0 {
+				discard()
+			}
+		}()
+	}
+	if events != nil {
+		oldPath, ok := events.entryPath(parent, name)
+		var inode Ino
+		var attr Attr
+		err = m.Rename(ctx, parent, name, newparent, newname, flags, &inode, &attr)
+		if err == 0 && ok {
+			events.renamed(oldPath, inode, newparent, newname, &attr)
+		}
+		return
+	}
+	err = m.Rename(ctx, parent, name, newparent, newname, flags, nil, nil)
 	return
 }
 
@@ -266,6 +336,7 @@ func Link(ctx Context, ino Ino, newparent Ino, newname string) (entry *meta.Entr
 	defer func() {
 		logit(ctx, "link (%d,%d,%s): %s%s", ino, newparent, newname, strerr(err), (*Entry)(entry))
 	}()
+	defer beginModify()()
 	if IsSpecialNode(ino) {
 		err = syscall.EACCES
 		return
@@ -359,6 +430,7 @@ func Create(ctx Context, parent Ino, name string, mode uint16, cumask uint16, fl
 	defer func() {
 		logit(ctx, "create (%d,%s,%s:0%04o): %s%s [fh:%d]", parent, name, smode(mode), mode, strerr(err), (*Entry)(entry), fh)
 	}()
+	defer beginModify()()
 	if parent == rootID && isSpecialName(name) {
 		err = syscall.EEXIST
 		return
@@ -378,7 +450,13 @@ func Create(ctx Context, parent Ino, name string, mode uint16, cumask uint16, fl
 		return
 	}
 
-	fh = newFileHandle(inode, 0, flags)
+	if versions != nil {
+		versions.remember(inode, name)
+	}
+	if events != nil {
+		events.remember(inode, parent, name)
+	}
+	fh = newFileHandle(ctx, inode, 0, flags, parent)
 	entry = &meta.Entry{Inode: inode, Attr: attr}
 	return
 }
@@ -402,6 +480,8 @@ func Open(ctx Context, ino Ino, flags uint32) (entry *meta.Entry, fh uint64, err
 		switch ino {
 		case logInode:
 			openAccessLog(fh)
+		case healthInode:
+			h.data = healthReport()
 		}
 		n := getInternalNode(ino)
 		entry = &meta.Entry{Inode: ino, Attr: n.attr}
@@ -414,13 +494,18 @@ func Open(ctx Context, ino Ino, flags uint32) (entry *meta.Entry, fh uint64, err
 	}
 
 	UpdateLength(ino, attr)
-	fh = newFileHandle(ino, attr.Length, flags)
+	fh = newFileHandle(ctx, ino, attr.Length, flags, attr.Parent)
 	entry = &meta.Entry{Inode: ino, Attr: attr}
 	return
 }
 
 func Truncate(ctx Context, ino Ino, size int64, opened uint8, attr *Attr) (err syscall.Errno) {
 	defer func() { logit(ctx, "truncate (%d,%d): %s", ino, size, strerr(err)) }()
+	defer beginModify()()
+	return truncate(ctx, ino, size, opened, attr)
+}
+
+func truncate(ctx Context, ino Ino, size int64, opened uint8, attr *Attr) (err syscall.Errno) {
 	if IsSpecialNode(ino) {
 		err = syscall.EPERM
 		return
@@ -434,6 +519,17 @@ func Truncate(ctx Context, ino Ino, size int64, opened uint8, attr *Attr) (err s
 		return
 	}
 	writer.Flush(ctx, ino)
+	if versions != nil {
+		var cur Attr
+		if m.GetAttr(ctx, ino, &cur) == 0 && uint64(size) < cur.Length {
+			discard := versions.save(ctx, ino, "")
+			defer func() {
+				if err != 0 {
+					discard()
+				}
+			}()
+		}
+	}
 	err = m.Truncate(ctx, ino, 0, uint64(size), attr)
 	if err != 0 {
 		return
@@ -471,9 +567,17 @@ func Release(ctx Context, ino Ino, fh uint64) (err syscall.Errno) {
 			locks := f.locks
 			owner := f.flockOwner
 			f.Unlock()
-			if f.writer != nil {
+			if f.writer != nil && f.cached() {
+				f.writer.Writeback(ctx)
+			} else if f.writer != nil {
 				f.writer.Flush(ctx)
 			}
+			if f.writer != nil && checksums != nil {
+				checksums.add(ino)
+			}
+			if f.writer != nil && events != nil {
+				go events.written(ino)
+			}
 			if locks&1 != 0 {
 				_ = m.Flock(ctx, ino, owner, F_UNLCK, false)
 			}
@@ -520,6 +624,7 @@ func Read(ctx Context, ino Ino, buf []byte, off uint64, fh uint64) (n int, err s
 
 	defer func() {
 		readSizeHistogram.Observe(float64(n))
+		account(ctx.Pid(), 0, uint64(n), 0)
 		logit(ctx, "read (%d,%d,%d): %s (%d)", ino, size, off, strerr(err), n)
 	}()
 	h := findHandle(ino, fh)
@@ -550,6 +655,37 @@ func Read(ctx Context, ino Ino, buf []byte, off uint64, fh uint64) (n int, err s
 	return
 }
 
+// ReadCached returns a region of local cache file which has the data of
+// requested range, so it can be spliced without copying. ok is false when
+// the data is not fully cached, Read() should be used instead.
+func ReadCached(ctx Context, ino Ino, size uint32, off uint64, fh uint64) (fd uintptr, foff int64, n int, ok bool) {
+	if IsSpecialNode(ino) {
+		return
+	}
+	h := findHandle(ino, fh)
+	if h == nil || h.reader == nil {
+		return
+	}
+	fr, isFile := h.reader.(*fileReader)
+	if !isFile || off >= maxFileSize || off+uint64(size) >= maxFileSize {
+		return
+	}
+	if !h.Rlock(ctx) {
+		return
+	}
+	defer h.Runlock()
+
+	writer.Flush(ctx, ino)
+	fd, foff, n = fr.readCached(ctx, off, size)
+	h.removeOp(ctx)
+	if ok = n > 0; ok {
+		readSizeHistogram.Observe(float64(n))
+		account(ctx.Pid(), 0, uint64(n), 0)
+		logit(ctx, "read (%d,%d,%d): OK (%d) spliced", ino, size, off, n)
+	}
+	return
+}
+
 func Write(ctx Context, ino Ino, buf []byte, off, fh uint64) (err syscall.Errno) {
 	size := uint64(len(buf))
 	defer func() { logit(ctx, "write (%d,%d,%d): %s", ino, size, off, strerr(err)) }()
@@ -568,11 +704,16 @@ func Write(ctx Context, ino Ino, buf []byte, off, fh uint64) (err syscall.Errno)
 		h.data = append(h.data, handleInternalMsg(ctx, buf)...)
 		return
 	}
+	defer beginModify()()
 
 	if h.writer == nil {
 		err = syscall.EACCES
 		return
 	}
+	if space.isFull() {
+		err = syscall.ENOSPC
+		return
+	}
 
 	if !h.Wlock(ctx) {
 		err = syscall.EINTR
@@ -580,7 +721,18 @@ func Write(ctx Context, ino Ino, buf []byte, off, fh uint64) (err syscall.Errno)
 	}
 	defer h.Wunlock()
 
-	err = h.writer.Write(ctx, off, buf)
+	if versions != nil && !h.append {
+		versions.saveOverwrite(ctx, h, off)
+	}
+	if h.serial {
+		err = serialWrite(ctx, h, ino, buf, &off)
+	} else {
+		if h.append {
+			err = appendWrite(ctx, h, buf, &off)
+		} else {
+			err = h.writer.Write(ctx, off, buf)
+		}
+	}
 	if err == syscall.ENOENT || err == syscall.EPERM || err == syscall.EINVAL {
 		err = syscall.EBADF
 	}
@@ -590,6 +742,7 @@ func Write(ctx Context, ino Ino, buf []byte, off, fh uint64) (err syscall.Errno)
 		return
 	}
 	writtenSizeHistogram.Observe(float64(len(buf)))
+	account(ctx.Pid(), 0, 0, uint64(len(buf)))
 	reader.Truncate(ino, writer.GetLength(ino))
 	reader.Invalidate(ino, off, uint64(len(buf)))
 	return
@@ -597,6 +750,7 @@ func Write(ctx Context, ino Ino, buf []byte, off, fh uint64) (err syscall.Errno)
 
 func Fallocate(ctx Context, ino Ino, mode uint8, off, length int64, fh uint64) (err syscall.Errno) {
 	defer func() { logit(ctx, "fallocate (%d,%d,%d,%d): %s", ino, mode, off, length, strerr(err)) }()
+	defer beginModify()()
 	if off < 0 || length <= 0 {
 		err = syscall.EINVAL
 		return
@@ -618,6 +772,10 @@ func Fallocate(ctx Context, ino Ino, mode uint8, off, length int64, fh uint64) (
 		err = syscall.EACCES
 		return
 	}
+	if mode&0x01 == 0 && space.isFull() { // without FALLOC_FL_KEEP_SIZE
+		err = syscall.ENOSPC
+		return
+	}
 	if !h.Wlock(ctx) {
 		err = syscall.EINTR
 		return
@@ -625,6 +783,10 @@ func Fallocate(ctx Context, ino Ino, mode uint8, off, length int64, fh uint64) (
 	defer h.Wunlock()
 	defer h.removeOp(ctx)
 
+	// the data of small files are buffered before stored in meta
+	if err = writer.Flush(ctx, ino); err != 0 {
+		return
+	}
 	err = m.Fallocate(ctx, ino, mode, uint64(off), uint64(length))
 	return
 }
@@ -633,6 +795,7 @@ func CopyFileRange(ctx Context, nodeIn Ino, fhIn, offIn uint64, nodeOut Ino, fhO
 	defer func() {
 		logit(ctx, "copy_file_range (%d,%d,%d,%d,%d,%d): %s", nodeIn, offIn, nodeOut, offOut, size, flags, strerr(err))
 	}()
+	defer beginModify()()
 	if IsSpecialNode(nodeIn) {
 		err = syscall.ENOTSUP
 		return
@@ -689,6 +852,9 @@ func CopyFileRange(ctx Context, nodeIn Ino, fhIn, offIn uint64, nodeOut Ino, fhO
 	if err != 0 {
 		return
 	}
+	if versions != nil {
+		versions.saveOverwrite(ctx, ho, offOut)
+	}
 	err = m.CopyFileRange(ctx, nodeIn, offIn, nodeOut, offOut, size, flags, &copied)
 	if err == 0 {
 		reader.Invalidate(nodeOut, offOut, uint64(size))
@@ -730,7 +896,11 @@ func Flush(ctx Context, ino Ino, fh uint64, lockOwner uint64) (err syscall.Errno
 			return
 		}
 
-		err = h.writer.Flush(ctx)
+		if h.cached() {
+			err = h.writer.Writeback(ctx)
+		} else {
+			err = h.writer.Flush(ctx)
+		}
 		if err == syscall.ENOENT || err == syscall.EPERM || err == syscall.EINVAL {
 			err = syscall.EBADF
 		}
@@ -759,6 +929,11 @@ func Fsync(ctx Context, ino Ino, datasync int, fh uint64) (err syscall.Errno) {
 		err = syscall.EBADF
 		return
 	}
+	if h.writer == nil {
+		// the data written by other handles, e.g. F_FULLFSYNC on a read-only descriptor of macOS
+		err = writer.Flush(ctx, ino)
+		return
+	}
 	err = doFsync(ctx, h)
 	return
 }
@@ -766,15 +941,20 @@ func Fsync(ctx Context, ino Ino, datasync int, fh uint64) (err syscall.Errno) {
 const (
 	xattrMaxName = 255
 	xattrMaxSize = 65536
+	forkMaxSize  = 1 << 20 // the resource fork of macOS
 )
 
+// ResourceForkXattr is the resource fork of a file on macOS, which is written in pieces by position.
+const ResourceForkXattr = "com.apple.ResourceFork"
+
 func SetXattr(ctx Context, ino Ino, name string, value []byte, flags int) (err syscall.Errno) {
 	defer func() { logit(ctx, "setxattr (%d,%s,%d,%d): %s", ino, name, len(value), flags, strerr(err)) }()
+	defer beginModify()()
 	if IsSpecialNode(ino) {
 		err = syscall.EPERM
 		return
 	}
-	if len(value) > xattrMaxSize {
+	if len(value) > xattrMaxSize && (name != ResourceForkXattr || len(value) > forkMaxSize) {
 		if runtime.GOOS == "darwin" {
 			err = syscall.E2BIG
 		} else {
@@ -798,6 +978,10 @@ func SetXattr(ctx Context, ino Ino, name string, value []byte, flags int) (err s
 		err = syscall.ENOTSUP
 		return
 	}
+	if err = CheckXattr(name, value); err != 0 {
+		return
+	}
+	defer ForgetXattrs(writer, ino, name)
 	err = m.SetXattr(ctx, ino, name, value)
 	return
 }
@@ -826,6 +1010,9 @@ func GetXattr(ctx Context, ino Ino, name string, size uint32) (value []byte, err
 		return
 	}
 	err = m.GetXattr(ctx, ino, name, &value)
+	if err == 0 && name == ChecksumXattr {
+		value, err = ReadChecksum(ctx, m, ino, value)
+	}
 	if size > 0 && len(value) > int(size) {
 		err = syscall.ERANGE
 	}
@@ -847,6 +1034,7 @@ func ListXattr(ctx Context, ino Ino, size int) (data []byte, err syscall.Errno)
 
 func RemoveXattr(ctx Context, ino Ino, name string) (err syscall.Errno) {
 	defer func() { logit(ctx, "removexattr (%d,%s): %s", ino, name, strerr(err)) }()
+	defer beginModify()()
 	if IsSpecialNode(ino) {
 		err = syscall.EPERM
 		return
@@ -866,6 +1054,7 @@ func RemoveXattr(ctx Context, ino Ino, name string) (err syscall.Errno) {
 		err = syscall.EINVAL
 		return
 	}
+	defer ForgetXattrs(writer, ino, name)
 	err = m.RemoveXattr(ctx, ino, name)
 	return
 }
@@ -876,7 +1065,30 @@ func Init(conf *Config, m_ meta.Meta, store chunk.ChunkStore) {
 	m = m_
 	reader = NewDataReader(conf, m, store)
 	writer = NewDataWriter(conf, m, store)
+	pinner, _ = store.(chunk.Pinner)
 	handles = make(map[Ino][]*handle)
+	delegs = newDelegator(conf.Delegation)
+	if conf.Checksum {
+		checksums = newChecksummer()
+	}
+	if len(conf.Events) > 0 {
+		var name string
+		if conf.Format != nil {
+			name = conf.Format.Name
+		}
+		n, err := event.NewNotifier(name, event.SourcePOSIX, conf.Events)
+		if err != nil {
+			logger.Fatalf("event target: %s", err)
+		}
+		events = newEventer(n)
+	}
+	if conf.Format != nil && conf.Format.Capacity > 0 {
+		space = newSpaceChecker(conf.CapacityGrace)
+	}
+	if conf.Format != nil && conf.Format.VersionDays > 0 {
+		versions = newVersioner(conf.Format.VersionDays)
+		go versions.expireVersions()
+	}
 }
 
 func InitMetrics() {
@@ -885,4 +1097,10 @@ func InitMetrics() {
 	prometheus.MustRegister(handlersGause)
 	prometheus.MustRegister(opsDurationsHistogram)
 	prometheus.MustRegister(compactSizeHistogram)
+	prometheus.MustRegister(usedBufferGauge)
+	prometheus.MustRegister(writeThrottled)
+	prometheus.MustRegister(spaceFullSeconds)
+	prometheus.MustRegister(containerOps)
+	prometheus.MustRegister(containerReadBytes)
+	prometheus.MustRegister(containerWriteBytes)
 }
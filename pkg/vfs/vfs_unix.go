@@ -50,7 +50,10 @@ func StatFS(ctx Context, ino Ino) (st *Statfs, err int) {
 	_ = m.StatFS(ctx, &totalspace, &availspace, &iused, &iavail)
 	var bsize uint64 = 0x10000
 	blocks := totalspace / bsize
-	bavail := blocks - (totalspace-availspace+bsize-1)/bsize
+	var bavail uint64
+	if used := (totalspace - availspace + bsize - 1) / bsize; used < blocks {
+		bavail = blocks - used
+	}
 
 	st = new(Statfs)
 	st.Bsize = uint32(bsize)
@@ -149,6 +152,7 @@ func SetAttr(ctx Context, ino Ino, set int, opened uint8, mode, uid, gid uint32,
 		entry = &meta.Entry{Inode: ino, Attr: n.attr}
 		return
 	}
+	defer beginModify()()
 	err = syscall.EINVAL
 	var attr = &Attr{}
 	if (set & (meta.SetAttrMode | meta.SetAttrUID | meta.SetAttrGID | meta.SetAttrAtime | meta.SetAttrMtime | meta.SetAttrSize)) == 0 {
@@ -176,13 +180,16 @@ func SetAttr(ctx Context, ino Ino, set int, opened uint8, mode, uid, gid uint32,
 			attr.Mtime = mtime
 			attr.Mtimensec = mtimensec
 		}
-		err = m.SetAttr(ctx, ino, uint16(set), 0, attr)
+		// FATTR_LOCKOWNER shares the bit with SetAttrFlag, which can't be changed by FUSE
+		err = m.SetAttr(ctx, ino, uint16(set&^meta.SetAttrFlag), 0, attr)
 		if err != 0 {
 			return
 		}
 	}
 	if set&meta.SetAttrSize != 0 {
-		err = Truncate(ctx, ino, int64(size), opened, attr)
+		err = truncate(ctx, ino, int64(size), opened, attr)
+	} else if err == 0 {
+		UpdateLength(ino, attr)
 	}
 	entry = &meta.Entry{Inode: ino, Attr: attr}
 	return
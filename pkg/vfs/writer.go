@@ -23,26 +23,35 @@ import (
 
 	"github.com/juicedata/juicefs/pkg/chunk"
 	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/juicedata/juicefs/pkg/trace"
 	"github.com/juicedata/juicefs/pkg/utils"
 )
 
 const (
-	flushDuration = time.Second * 5
+	flushDuration  = time.Second * 5
+	appendDuration = time.Second * 30      // max duration to buffer the data of appending files
+	appendWrites   = 3                     // number of continuous appending writes to detect appending files
+	fsyncInterval  = time.Millisecond * 10 // the fsyncs of appending files in it are grouped
 )
 
 type FileWriter interface {
 	Write(ctx meta.Context, offset uint64, data []byte) syscall.Errno
 	Flush(ctx meta.Context) syscall.Errno
+	Writeback(ctx meta.Context) syscall.Errno // start to flush the data without waiting for it
 	Close(ctx meta.Context) syscall.Errno
 	GetLength() uint64
 	Truncate(length uint64)
+	SetCompression(hint uint64)  // the bits of chunk.CompressHints set in the new chunks
+	SetDelegated(delegated bool) // buffer the data longer while the file is delegated to this client
 }
 
 type DataWriter interface {
 	Open(inode Ino, fleng uint64) FileWriter
 	Flush(ctx meta.Context, inode Ino) syscall.Errno
+	FlushAll(ctx meta.Context) syscall.Errno
 	GetLength(inode Ino) uint64
 	Truncate(inode Ino, length uint64)
+	CompressHint(ctx meta.Context, dir Ino) uint64 // the compression of the files in a directory
 }
 
 type sliceWriter struct {
@@ -75,7 +84,7 @@ func (s *sliceWriter) prepareID(ctx meta.Context, retry bool) {
 		}
 		if !retry || st == 0 {
 			if s.id == 0 {
-				s.id = id
+				s.id = id | f.compress
 			}
 			break
 		}
@@ -186,7 +195,7 @@ func (c *chunkWriter) commitThread() {
 	for len(c.slices) > 0 {
 		s := c.slices[0]
 		for !s.done {
-			if s.notify.WaitWithTimeout(time.Millisecond*100) && !s.freezed && time.Since(s.started) > flushDuration*2 {
+			if s.notify.WaitWithTimeout(time.Millisecond*100) && !s.freezed && time.Since(s.started) > f.flushDuration()*2 {
 				s.freezed = true
 				go s.flushData()
 			}
@@ -223,10 +232,41 @@ type fileWriter struct {
 	flushwaiting uint16
 	writewaiting uint16
 	refs         uint16
+	compress     uint64
+	appends      uint32 // number of continuous appending writes
+	delegated    bool   // see SetDelegated
+	flushed      time.Time
 	chunks       map[uint32]*chunkWriter
 
 	flushcond *utils.Cond // wait for chunks==nil (flush)
 	writecond *utils.Cond // wait for flushwaiting==0 (write)
+
+	inlineState uint8
+	inline      []byte // data of small file, which will be stored in meta
+	inlineDirty bool
+	inlineMod   time.Time
+}
+
+const (
+	inlineUnknown = iota // should be loaded from meta before writing
+	inlineEnabled
+	inlineDisabled
+)
+
+// appending returns true if the file is written by appending only (such as logs), then the data
+// is buffered longer to be uploaded in full blocks, so there are less slices in the chunks.
+// protected by file
+func (f *fileWriter) appending() bool {
+	return f.appends >= appendWrites
+}
+
+// flushDuration returns the max duration of a slice before it's flushed.
+// protected by file
+func (f *fileWriter) flushDuration() time.Duration {
+	if f.appending() || f.delegated {
+		return appendDuration
+	}
+	return flushDuration
 }
 
 // protected by file
@@ -259,6 +299,9 @@ func (f *fileWriter) writeChunk(ctx meta.Context, indx uint32, off uint32, data
 			notify:  utils.NewCond(&f.Mutex),
 			started: time.Now(),
 		}
+		if w, ok := s.writer.(chunk.TracedWriter); ok {
+			w.SetTrace(trace.IDOf(ctx))
+		}
 		c.slices = append(c.slices, s)
 		if len(c.slices) == 1 {
 			f.w.Lock()
@@ -270,12 +313,104 @@ func (f *fileWriter) writeChunk(ctx meta.Context, indx uint32, off uint32, data
 	return s.write(ctx, off-s.off, data)
 }
 
+// loadInline checks whether the file is stored in meta (or empty), the existing data is
+// loaded so it can be updated in place.
+func (f *fileWriter) loadInline(ctx meta.Context) syscall.Errno {
+	f.Lock()
+	state, length := f.inlineState, f.length
+	f.Unlock()
+	if state != inlineUnknown {
+		return 0
+	}
+	var data []byte
+	if length > 0 {
+		if st := f.w.m.ReadInline(ctx, f.inode, &data); st != 0 {
+			return st
+		}
+	}
+	f.Lock()
+	if f.inlineState == inlineUnknown {
+		if length == 0 || data != nil {
+			f.inline = data
+			f.inlineState = inlineEnabled
+		} else {
+			f.inlineState = inlineDisabled
+		}
+	}
+	f.Unlock()
+	return 0
+}
+
+// writeInline updates the data of small file in memory, it returns false if the
+// data should be written into chunks.
+// protected by file
+func (f *fileWriter) writeInline(ctx meta.Context, off uint64, data []byte) (bool, syscall.Errno) {
+	if f.inlineState != inlineEnabled {
+		return false, 0
+	}
+	end := off + uint64(len(data))
+	if end <= uint64(f.w.inlineSize) {
+		if end > uint64(len(f.inline)) {
+			f.inline = append(f.inline, make([]byte, end-uint64(len(f.inline)))...)
+		}
+		copy(f.inline[off:], data)
+		f.inlineDirty = true
+		f.inlineMod = time.Now()
+		return true, 0
+	}
+	// too large to be stored in meta, move existing data as the first slice
+	inline := f.inline
+	f.inlineState = inlineDisabled
+	f.inline = nil
+	f.inlineDirty = false
+	if len(inline) > 0 {
+		return false, f.writeChunk(ctx, 0, 0, inline)
+	}
+	return false, 0
+}
+
+// persistInline saves the data of small file into meta, it will be loaded again for next write,
+// since it could be changed by others (truncate, fallocate).
+// protected by file
+func (f *fileWriter) persistInline(ctx meta.Context) syscall.Errno {
+	if !f.inlineDirty {
+		return 0
+	}
+	if st := f.w.m.WriteInline(ctx, f.inode, f.inline); st != 0 {
+		logger.Warnf("write inline data of inode %d: %s", f.inode, st)
+		return st
+	}
+	f.inlineState = inlineUnknown
+	f.inline = nil
+	f.inlineDirty = false
+	return 0
+}
+
+// buffered returns the size of data not uploaded yet.
+func (f *fileWriter) buffered() int64 {
+	f.Lock()
+	defer f.Unlock()
+	var size int64
+	for _, c := range f.chunks {
+		for _, s := range c.slices {
+			if !s.done {
+				size += int64(s.slen)
+			}
+		}
+	}
+	return size
+}
+
 func (f *fileWriter) Write(ctx meta.Context, off uint64, data []byte) syscall.Errno {
-	if utils.UsedMemory() > f.w.bufferSize {
-		// slow down
-		time.Sleep(time.Millisecond * 10)
-		for utils.UsedMemory() > f.w.bufferSize*2 {
-			time.Sleep(time.Millisecond * 100)
+	f.w.Lock()
+	files := len(f.w.files)
+	f.w.Unlock()
+	if st := f.w.buffer.waitForWrite(ctx, f.buffered(), files); st != 0 {
+		return st
+	}
+	if f.w.inlineSize > 0 {
+		if st := f.loadInline(ctx); st != 0 {
+			return st
 		}
 	}
 	f.Lock()
@@ -290,6 +425,19 @@ func (f *fileWriter) Write(ctx meta.Context, off uint64, data []byte) syscall.Er
 	}
 	f.writewaiting--
 
+	if off == f.length {
+		f.appends++
+	} else {
+		f.appends = 0
+	}
+	if done, st := f.writeInline(ctx, off, data); st != 0 {
+		return st
+	} else if done {
+		if off+size > f.length {
+			f.length = off + size
+		}
+		return f.err
+	}
 	indx := uint32(off / meta.ChunkSize)
 	pos := uint32(off % meta.ChunkSize)
 	for len(data) > 0 {
@@ -315,7 +463,7 @@ func (f *fileWriter) flush(ctx meta.Context, writeback bool) syscall.Errno {
 	defer f.Unlock()
 	f.flushwaiting++
 
-	var err syscall.Errno
+	var err = f.persistInline(ctx)
 	var wait = time.Second * time.Duration((f.w.maxRetries+1)*(f.w.maxRetries+1)/2)
 	if wait < time.Minute*5 {
 		wait = time.Minute * 5
@@ -330,6 +478,9 @@ func (f *fileWriter) flush(ctx meta.Context, writeback bool) syscall.Errno {
 				}
 			}
 		}
+		if writeback {
+			break
+		}
 		if f.flushcond.WaitWithTimeout(time.Second) && ctx.Canceled() {
 			err = syscall.EINTR
 			break
@@ -352,6 +503,7 @@ func (f *fileWriter) flush(ctx meta.Context, writeback bool) syscall.Errno {
 	if f.flushwaiting == 0 && f.writewaiting > 0 {
 		f.writecond.Broadcast()
 	}
+	f.flushed = time.Now()
 	if err == 0 {
 		err = f.err
 	}
@@ -359,12 +511,26 @@ func (f *fileWriter) flush(ctx meta.Context, writeback bool) syscall.Errno {
 }
 
 func (f *fileWriter) Flush(ctx meta.Context) syscall.Errno {
+	f.Lock()
+	var wait time.Duration
+	if f.appending() {
+		// the fsyncs right after the previous one wait for the data appended by others, to be flushed together
+		wait = time.Until(f.flushed.Add(fsyncInterval))
+	}
+	f.Unlock()
+	if wait > 0 {
+		time.Sleep(wait)
+	}
 	return f.flush(ctx, false)
 }
 
+func (f *fileWriter) Writeback(ctx meta.Context) syscall.Errno {
+	return f.flush(ctx, true)
+}
+
 func (f *fileWriter) Close(ctx meta.Context) syscall.Errno {
 	defer f.w.free(f)
-	return f.Flush(ctx)
+	return f.flush(ctx, false)
 }
 
 func (f *fileWriter) GetLength() uint64 {
@@ -373,11 +539,31 @@ func (f *fileWriter) GetLength() uint64 {
 	return f.length
 }
 
+func (f *fileWriter) SetCompression(hint uint64) {
+	f.Lock()
+	defer f.Unlock()
+	f.compress = hint
+}
+
+func (f *fileWriter) SetDelegated(delegated bool) {
+	f.Lock()
+	defer f.Unlock()
+	f.delegated = delegated
+}
+
 func (f *fileWriter) Truncate(length uint64) {
 	f.Lock()
 	defer f.Unlock()
 	// TODO: truncate write buffer if length < f.length
 	f.length = length
+	if f.inlineDirty {
+		if length < uint64(len(f.inline)) {
+			f.inline = f.inline[:length]
+		}
+	} else if len(f.chunks) == 0 {
+		f.inlineState = inlineUnknown
+		f.inline = nil
+	}
 }
 
 type dataWriter struct {
@@ -385,9 +571,11 @@ type dataWriter struct {
 	m          meta.Meta
 	store      chunk.ChunkStore
 	blockSize  int
-	bufferSize int64
+	buffer     *bufferPool
 	files      map[Ino]*fileWriter
 	maxRetries uint32
+	inlineSize int
+	dirs       *dirXattrCache
 }
 
 func NewDataWriter(conf *Config, m meta.Meta, store chunk.ChunkStore) DataWriter {
@@ -395,9 +583,13 @@ func NewDataWriter(conf *Config, m meta.Meta, store chunk.ChunkStore) DataWriter
 		m:          m,
 		store:      store,
 		blockSize:  conf.Chunk.BlockSize,
-		bufferSize: int64(conf.Chunk.BufferSize),
+		buffer:     getBufferPool(conf),
 		files:      make(map[Ino]*fileWriter),
 		maxRetries: uint32(conf.Meta.IORetries),
+		dirs:       newDirXattrCache(m),
+	}
+	if conf.Format != nil {
+		w.inlineSize = conf.Format.InlineSize
 	}
 	go w.flushAll()
 	return w
@@ -412,14 +604,19 @@ func (w *dataWriter) flushAll() {
 			w.Unlock()
 			f.Lock()
 
+			// the slices of appending or delegated files are not flushed when they're idle
+			appending, duration := f.appending() || f.delegated, f.flushDuration()
 			for _, c := range f.chunks {
 				for _, s := range c.slices {
-					if !s.freezed && (now.Sub(s.started) > flushDuration || now.Sub(s.lastMod) > time.Second) {
+					if !s.freezed && (now.Sub(s.started) > duration || !appending && now.Sub(s.lastMod) > time.Second) {
 						s.freezed = true
 						go s.flushData()
 					}
 				}
 			}
+			if f.inlineDirty && now.Sub(f.inlineMod) > time.Second {
+				_ = f.persistInline(meta.Background)
+			}
 			f.Unlock()
 			w.free(f)
 			w.Lock()
@@ -471,6 +668,25 @@ func (w *dataWriter) Flush(ctx meta.Context, inode Ino) syscall.Errno {
 	return 0
 }
 
+// FlushAll flushes the buffered data of all the files, it returns the first error.
+func (w *dataWriter) FlushAll(ctx meta.Context) syscall.Errno {
+	w.Lock()
+	files := make([]*fileWriter, 0, len(w.files))
+	for _, f := range w.files {
+		f.refs++
+		files = append(files, f)
+	}
+	w.Unlock()
+	var err syscall.Errno
+	for _, f := range files {
+		if e := f.Flush(ctx); e != 0 && err == 0 {
+			err = e
+		}
+		w.free(f)
+	}
+	return err
+}
+
 func (w *dataWriter) GetLength(inode Ino) uint64 {
 	f := w.find(inode)
 	if f != nil {
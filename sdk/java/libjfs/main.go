@@ -175,6 +175,7 @@ type javaConf struct {
 	Debug          bool   `json:"debug"`
 	NoUsageReport  bool   `json:"noUsageReport"`
 	AccessLog      string `json:"accessLog"`
+	Token          string `json:"token"`
 }
 
 func getOrCreate(name, user, group, superuser, supergroup string, f func() *fs.FileSystem) uintptr {
@@ -206,12 +207,20 @@ func getOrCreate(name, user, group, superuser, supergroup string, f func() *fs.F
 	return h
 }
 
-func createStorage(format *meta.Format) (object.ObjectStorage, error) {
+func createStorage(format *meta.Format, queue object.ReplicationQueue) (object.ObjectStorage, error) {
 	blob, err := object.CreateStorage(strings.ToLower(format.Storage), format.Bucket, format.AccessKey, format.SecretKey)
 	if err != nil {
 		return nil, err
 	}
-	return object.WithPrefix(blob, format.Name+"/"), nil
+	blob = object.WithPrefix(blob, format.Name+"/")
+	if format.ReplicaStorage != "" {
+		replica, err := object.CreateStorage(strings.ToLower(format.ReplicaStorage), format.ReplicaBucket, format.ReplicaAccessKey, format.ReplicaSecretKey)
+		if err != nil {
+			return nil, fmt.Errorf("replica: %s", err)
+		}
+		blob = object.WithReplica(blob, object.WithPrefix(replica, format.Name+"/"), queue, 10)
+	}
+	return blob, nil
 }
 
 //export jfs_init
@@ -251,8 +260,8 @@ func jfs_init(cname, jsonConf, user, group, superuser, supergroup *C.char) uintp
 			addr = "redis://" + addr
 		}
 		logger.Infof("Meta address: %s", addr)
-		var rc = meta.RedisConfig{Retries: 10, Strict: true}
-		m, err := meta.NewRedisMeta(addr, &rc)
+		var rc = meta.RedisConfig{Retries: 10, Strict: true, Token: jConf.Token}
+		m, err := meta.NewClient(addr, &rc)
 		if err != nil {
 			logger.Fatalf("Meta: %s", err)
 		}
@@ -260,7 +269,7 @@ func jfs_init(cname, jsonConf, user, group, superuser, supergroup *C.char) uintp
 		if err != nil {
 			logger.Fatalf("load setting: %s", err)
 		}
-		blob, err := createStorage(format)
+		blob, err := createStorage(format, m)
 		if err != nil {
 			logger.Fatalf("object storage: %s", err)
 		}
@@ -283,6 +292,11 @@ func jfs_init(cname, jsonConf, user, group, superuser, supergroup *C.char) uintp
 			Prefetch:       3,
 			Writeback:      jConf.Writeback,
 			Partitions:     format.Partitions,
+			PackSize:       format.PackSize << 10,
+			PackIndex:      m,
+			Dedup:          format.Dedup,
+			DedupIndex:     m,
+			ExternalIndex:  m,
 			UploadLimit:    jConf.UploadLimit,
 			GetTimeout:     time.Second * time.Duration(jConf.GetTimeout),
 			PutTimeout:     time.Second * time.Duration(jConf.PutTimeout),
@@ -292,6 +306,10 @@ func jfs_init(cname, jsonConf, user, group, superuser, supergroup *C.char) uintp
 		if chunkConf.CacheDir != "memory" {
 			chunkConf.CacheDir = filepath.Join(chunkConf.CacheDir, format.UUID)
 		}
+		chunkConf.ExternalStorage, err = object.CreateStorage(strings.ToLower(format.Storage), format.Bucket, format.AccessKey, format.SecretKey)
+		if err != nil {
+			logger.Fatalf("object storage: %s", err)
+		}
 		store := chunk.NewCachedStore(blob, chunkConf)
 		m.OnMsg(meta.DeleteChunk, meta.MsgCallback(func(args ...interface{}) error {
 			chunkid := args[0].(uint64)
@@ -315,6 +333,8 @@ func jfs_init(cname, jsonConf, user, group, superuser, supergroup *C.char) uintp
 			Format:    format,
 			Chunk:     &chunkConf,
 			AccessLog: jConf.AccessLog,
+			// the buffered data can be committed when capacity is almost reached
+			CapacityGrace: uint64(jConf.MemorySize) << 20,
 		}
 		if !jConf.NoUsageReport {
 			go usage.ReportUsage(m, "java-sdk "+version.Version())
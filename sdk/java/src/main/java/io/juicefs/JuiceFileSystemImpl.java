@@ -330,6 +330,7 @@ public class JuiceFileSystemImpl extends FileSystem {
     obj.put("noUsageReport", Boolean.valueOf(getConf(conf, "no-usage-report", "false")));
     obj.put("freeSpace", getConf(conf, "free-space", ""));
     obj.put("accessLog", getConf(conf, "access-log", ""));
+    obj.put("token", getConf(conf, "token", ""));
     String jsonConf = obj.toString(2);
     handle = lib.jfs_init(name, jsonConf, user, group, superuser, supergroup);
     if (handle <= 0) {